@@ -0,0 +1,29 @@
+package backend
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// handleNotebookActivity returns a notebook's activity feed, newest first: sources added,
+// notes generated or edited, sharing changes and so on
+func (s *Server) handleNotebookActivity(c *gin.Context) {
+	ctx := c.Request.Context()
+	notebookID := c.Param("id")
+	if err := s.checkNotebookAccess(ctx, notebookID, c.GetString("user_id")); err != nil {
+		c.JSON(http.StatusForbidden, ErrorResponse{Error: "Access denied"})
+		return
+	}
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	if limit <= 0 || limit > 500 {
+		limit = 50
+	}
+	activities, err := s.store.ListNotebookActivity(ctx, notebookID, limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to list notebook activity"})
+		return
+	}
+	c.JSON(http.StatusOK, activities)
+}
@@ -1,11 +1,17 @@
 package backend
 
 import (
+	"bufio"
 	"context"
 	"fmt"
+	"io"
+	"os"
 	"os/exec"
+	"path/filepath"
 	"regexp"
+	"slices"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/kataras/golog"
@@ -13,6 +19,7 @@ import (
 	ollamallm "github.com/tmc/langchaingo/llms/ollama"
 	"github.com/tmc/langchaingo/llms/openai"
 	"github.com/tmc/langchaingo/prompts"
+	"github.com/tmc/langchaingo/schema"
 )
 
 // Agent handles AI operations for generating notes and chat responses
@@ -21,54 +28,115 @@ type Agent struct {
 	llm         llms.Model
 	cfg         Config
 	provider    LLMProvider
+	images      []imageProvider   // IMAGE_PROVIDER followed by the IMAGE_FALLBACKS providers
+	reranker    reranker          // nil unless RERANK_PROVIDER is set
+	speech      speechSynthesizer // nil unless PODCAST_TTS_PROVIDER is set
+	usage       usageSink
+
+	routedMu   sync.Mutex
+	routedLLMs map[ModelRoute]llms.Model // Models of MODEL_ROUTES, created on first use
 }
 
-// NewAgent creates a new agent
-func NewAgent(cfg Config, vectorStore *VectorStore) (*Agent, error) {
-	llm, err := createLLM(cfg)
+// NewAgent creates a new agent, which passes the usage of its LLM and image calls to usage
+func NewAgent(cfg Config, vectorStore *VectorStore, usage usageSink) (*Agent, error) {
+	llm, err := createLLM(cfg, usage)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create LLM: %w", err)
 	}
 
-	// Select image provider based on config
-	var provider LLMProvider
-	switch cfg.ImageProvider {
+	// The image provider also serves Gemini text routes
+	provider, err := newImageProvider(cfg, cfg.ImageProvider, llm, usage)
+	if err != nil {
+		return nil, err
+	}
+	imageProviders := []imageProvider{{route: ModelRoute{Provider: cfg.ImageProvider, Model: cfg.imageModel(cfg.ImageProvider)}, client: provider}}
+	for _, name := range cfg.ImageFallbacks {
+		if slices.ContainsFunc(imageProviders, func(p imageProvider) bool { return p.route.Provider == name }) {
+			continue
+		}
+		client, err := newImageProvider(cfg, name, llm, usage)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create image fallback %s: %w", name, err)
+		}
+		imageProviders = append(imageProviders, imageProvider{route: ModelRoute{Provider: name, Model: cfg.imageModel(name)}, client: client})
+	}
+
+	return &Agent{
+		vectorStore: vectorStore,
+		llm:         llm,
+		cfg:         cfg,
+		provider:    provider,
+		images:      imageProviders,
+		reranker:    newReranker(cfg),
+		speech:      newSpeechSynthesizer(cfg),
+		usage:       usage,
+		routedLLMs:  make(map[ModelRoute]llms.Model),
+	}, nil
+}
+
+// newImageProvider creates the client of an image provider. Text is generated by llm, except
+// with Gemini routes.
+func newImageProvider(cfg Config, name string, llm llms.Model, usage usageSink) (LLMProvider, error) {
+	switch name {
 	case "glm":
 		if cfg.GLMAPIKey == "" {
 			return nil, fmt.Errorf("glm_api_key is required when image_provider is 'glm'")
 		}
-		provider = NewGLMImageClient(cfg.GLMAPIKey)
+		return NewGLMImageClient(cfg.GLMAPIKey, cfg.ImageTimeout, cfg.UploadDir), nil
 	case "zimage":
 		if cfg.ZImageAPIKey == "" {
 			return nil, fmt.Errorf("zimage_api_key is required when image_provider is 'zimage'")
 		}
-		provider = NewZImageClient(cfg.ZImageAPIKey)
+		return NewZImageClient(cfg.ZImageAPIKey, cfg.ImageTimeout, cfg.UploadDir), nil
+	case "openai":
+		if cfg.OpenAIAPIKey == "" {
+			return nil, fmt.Errorf("openai_api_key is required when image_provider is 'openai'")
+		}
+		return NewOpenAIImageClient(cfg.OpenAIAPIKey, cfg.OpenAIImageBaseURL(), cfg.ImageTimeout, cfg.UploadDir), nil
+	case "sd":
+		return NewSDImageClient(cfg.SDURL, cfg.SDBackend, cfg.SDSampler, cfg.SDSteps, cfg.SDSize, cfg.ImageTimeout, cfg.UploadDir)
+	case "mock":
+		return NewMockImageClient(cfg.UploadDir), nil
 	case "gemini":
-		provider = NewGeminiClient(cfg.GoogleAPIKey, llm)
+		gemini := NewGeminiClient(cfg.GoogleAPIKey, llm, cfg.TransformationTimeout, cfg.ImageTimeout, cfg.UploadDir)
+		gemini.usage = usage
+		return gemini, nil
 	default:
-		return nil, fmt.Errorf("unknown image provider: %s (supported: gemini, glm, zimage)", cfg.ImageProvider)
+		return nil, fmt.Errorf("unknown image provider: %s (supported: gemini, glm, zimage, openai, sd, mock)", name)
 	}
-
-	return &Agent{
-		vectorStore: vectorStore,
-		llm:         llm,
-		cfg:         cfg,
-		provider:    provider,
-	}, nil
 }
 
-// createLLM creates an LLM based on configuration
-func createLLM(cfg Config) (llms.Model, error) {
+// createLLM creates an LLM based on configuration, falling back to the LLM_FALLBACKS models
+func createLLM(cfg Config, usage usageSink) (llms.Model, error) {
+	if cfg.IsMock() {
+		return newFallbackLLM(cfg, ModelRoute{Provider: "mock", Model: "mock"}, usage)
+	}
+	if cfg.IsAzure() {
+		return newFallbackLLM(cfg, ModelRoute{Provider: "azure", Model: cfg.AzureOpenAIDeployment}, usage)
+	}
 	if cfg.IsOllama() {
+		return newFallbackLLM(cfg, ModelRoute{Provider: "ollama", Model: cfg.OllamaModel}, usage)
+	}
+	return newFallbackLLM(cfg, ModelRoute{Provider: "openai", Model: cfg.OpenAIModel}, usage)
+}
+
+// newLLM creates a client for a model of the OpenAI, Ollama, Azure OpenAI or mock provider
+func newLLM(cfg Config, route ModelRoute) (llms.Model, error) {
+	switch route.Provider {
+	case "mock":
+		return mockLLM{}, nil
+	case "azure":
+		return openai.New(azureOptions(cfg, route.Model)...)
+	case "ollama":
 		return ollamallm.New(
-			ollamallm.WithModel(cfg.OllamaModel),
+			ollamallm.WithModel(route.Model),
 			ollamallm.WithServerURL(cfg.OllamaBaseURL),
 		)
 	}
 
 	opts := []openai.Option{
 		openai.WithToken(cfg.OpenAIAPIKey),
-		openai.WithModel(cfg.OpenAIModel),
+		openai.WithModel(route.Model),
 	}
 	if cfg.OpenAIBaseURL != "" {
 		opts = append(opts, openai.WithBaseURL(cfg.OpenAIBaseURL))
@@ -77,26 +145,103 @@ func createLLM(cfg Config) (llms.Model, error) {
 	return openai.New(opts...)
 }
 
-// GenerateTransformation generates a note based on transformation type
-func (a *Agent) GenerateTransformation(ctx context.Context, req *TransformationRequest, sources []Source) (*TransformationResponse, error) {
+// llmFor returns the model MODEL_ROUTES sends a kind of generation to, or the default LLM.
+// It returns nil for Gemini routes, which are run through the provider instead and so have no
+// fallbacks.
+func (a *Agent) llmFor(kind string) (llms.Model, error) {
+	route, ok := a.cfg.ModelRoutes[kind]
+	if !ok {
+		return a.llm, nil
+	}
+	if route.Provider == "gemini" {
+		return nil, nil
+	}
+
+	a.routedMu.Lock()
+	defer a.routedMu.Unlock()
+	if llm, ok := a.routedLLMs[route]; ok {
+		return llm, nil
+	}
+	llm, err := newFallbackLLM(a.cfg, route, a.usage)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the model for %s: %w", kind, err)
+	}
+	a.routedLLMs[route] = llm
+	return llm, nil
+}
+
+// generateFor runs a prompt on the model routed for a kind of generation
+func (a *Agent) generateFor(ctx context.Context, kind, prompt string) (string, error) {
+	ctx = withUsageOperation(ctx, kind)
+	llm, err := a.llmFor(kind)
+	if err != nil {
+		return "", err
+	}
+	if llm == nil {
+		route := a.cfg.ModelRoutes[kind]
+		response, err := a.provider.GenerateTextWithModel(ctx, prompt, route.Model)
+		if err == nil {
+			recordGeneration(ctx, route, route)
+		}
+		return response, err
+	}
+	return a.provider.GenerateFromSinglePrompt(ctx, llm, prompt)
+}
+
+// azureOptions returns the client options for an Azure OpenAI deployment. The embedding
+// deployment is always passed, as the client won't start without one.
+func azureOptions(cfg Config, deployment string) []openai.Option {
+	return []openai.Option{
+		openai.WithAPIType(openai.APITypeAzure),
+		openai.WithBaseURL(cfg.AzureOpenAIEndpoint),
+		openai.WithToken(cfg.AzureOpenAIAPIKey),
+		openai.WithAPIVersion(cfg.AzureOpenAIAPIVersion),
+		openai.WithModel(deployment),
+		openai.WithEmbeddingModel(firstNonEmpty(cfg.AzureOpenAIEmbeddingDeployment, deployment)),
+	}
+}
+
+// maxContextRetries is how many times a generation is retried with a halved context budget
+// after the provider rejects the prompt as too long
+const maxContextRetries = 3
+
+// isContextLengthError reports whether err looks like a provider context-window overflow
+func isContextLengthError(err error) bool {
+	if err == nil {
+		return false
+	}
+	msg := strings.ToLower(err.Error())
+	markers := []string{
+		"context_length_exceeded",
+		"context length",
+		"maximum context",
+		"context window",
+		"too many tokens",
+		"prompt is too long",
+		"input is too long",
+	}
+	for _, marker := range markers {
+		if strings.Contains(msg, marker) {
+			return true
+		}
+	}
+	return false
+}
+
+// buildTransformationPrompt formats the transformation prompt, truncating each source to limit characters
+func (a *Agent) buildTransformationPrompt(req *TransformationRequest, sources []Source, limit int) (string, error) {
 	// Build context from sources
 	var sourceContext strings.Builder
 	for i, src := range sources {
 		sourceContext.WriteString(fmt.Sprintf("\n## Source %d: %s\n", i+1, src.Name))
 
-		// Use MaxContextLength from config, or default to a safe large value if not set (or too small)
-		limit := a.cfg.MaxContextLength
-		if limit <= 0 {
-			limit = 100000 // Default to 100k chars if config is invalid
-		}
-
 		if src.Content != "" {
-			if len(src.Content) <= limit {
+			if runes := []rune(src.Content); len(runes) <= limit {
 				sourceContext.WriteString(src.Content)
 			} else {
-				// Truncate content instead of replacing it entirely
-				sourceContext.WriteString(src.Content[:limit])
-				sourceContext.WriteString(fmt.Sprintf("\n... [Content truncated, total length: %d]", len(src.Content)))
+				// Truncate content instead of replacing it entirely, at a character boundary
+				sourceContext.WriteString(string(runes[:limit]))
+				sourceContext.WriteString(fmt.Sprintf("\n... [Content truncated, total length: %d]", len(runes)))
 			}
 		} else {
 			sourceContext.WriteString(fmt.Sprintf("[Source content: %s, type: %s]", src.Name, src.Type))
@@ -121,35 +266,65 @@ func (a *Agent) GenerateTransformation(ctx context.Context, req *TransformationR
 		"prompt":  req.Prompt,
 	})
 	if err != nil {
-		return nil, fmt.Errorf("failed to format prompt: %w", err)
+		return "", fmt.Errorf("failed to format prompt: %w", err)
 	}
 
-	// Generate response
-	var response string
-	var genErr error
+	return promptValue, nil
+}
 
-	if req.Type == "ppt" {
-		response, genErr = a.provider.GenerateTextWithModel(ctx, promptValue, "gemini-3-flash-preview")
-	} else if req.Type == "insight" {
-		// For insight type: first generate a summary, then call DeepInsight
-		ctx, cancel := context.WithTimeout(ctx, 300*time.Second)
-		defer cancel()
+// runTransformation sends a formatted transformation prompt to the provider
+func (a *Agent) runTransformation(ctx context.Context, req *TransformationRequest, promptValue string) (string, error) {
+	generateCtx, cancel := context.WithTimeout(ctx, a.cfg.TransformationTimeout)
+	defer cancel()
 
+	if req.Type == "insight" {
+		// For insight type: first generate a summary, then call DeepInsight
 		// Step 1: Generate summary
-		summary, err := a.provider.GenerateFromSinglePrompt(ctx, a.llm, promptValue)
+		summary, err := a.generateFor(generateCtx, req.Type, promptValue)
 		if err != nil {
-			return nil, fmt.Errorf("failed to generate summary: %w", err)
+			return "", fmt.Errorf("failed to generate summary: %w", err)
 		}
 
-		// Step 2: Call DeepInsight with the summary
-		response, err = a.callDeepInsight(ctx, summary)
+		// Step 2: Call DeepInsight with the summary. It has a timeout of its own, but stops
+		// with the caller.
+		response, err := a.callDeepInsight(ctx, summary)
+		if err != nil {
+			return "", fmt.Errorf("failed to generate deep insight: %w", err)
+		}
+		return response, nil
+	}
+
+	return a.generateFor(generateCtx, req.Type, promptValue)
+}
+
+// GenerateTransformation generates a note based on transformation type
+func (a *Agent) GenerateTransformation(ctx context.Context, req *TransformationRequest, sources []Source) (*TransformationResponse, error) {
+	// Use MaxContextLength from config, or default to a safe large value if not set (or too small)
+	limit := a.cfg.MaxContextLength
+	if limit <= 0 {
+		limit = 100000 // Default to 100k chars if config is invalid
+	}
+
+	// Generate response, shrinking the per-source budget when the provider reports a context overflow
+	ctx, trace := withGenerationTrace(ctx)
+	var response string
+	var genErr error
+	retries := 0
+	for {
+		promptValue, err := a.buildTransformationPrompt(req, sources, limit)
 		if err != nil {
-			return nil, fmt.Errorf("failed to generate deep insight: %w", err)
+			return nil, err
+		}
+
+		response, genErr = a.runTransformation(ctx, req, promptValue)
+		if genErr == nil || !isContextLengthError(genErr) || retries >= maxContextRetries {
+			break
 		}
-	} else {
-		ctx, cancel := context.WithTimeout(ctx, 300*time.Second)
-		defer cancel()
-		response, genErr = a.provider.GenerateFromSinglePrompt(ctx, a.llm, promptValue)
+
+		retries++
+		limit /= 2
+		golog.Warnf("context length exceeded for %s transformation, retrying with %d chars per source (attempt %d/%d)",
+			req.Type, limit, retries, maxContextRetries)
 	}
 
 	if genErr != nil {
@@ -166,28 +341,40 @@ func (a *Agent) GenerateTransformation(ctx context.Context, req *TransformationR
 		}
 	}
 
+	metadata := map[string]interface{}{
+		"length":    req.Length,
+		"format":    req.Format,
+		"citations": sourceCitations(sources, limit),
+	}
+	if retries > 0 {
+		// Record that the output was generated from truncated sources
+		metadata["context_degraded"] = true
+		metadata["context_limit"] = limit
+		metadata["context_retries"] = retries
+	}
+	trace.addTo(metadata)
+
 	return &TransformationResponse{
 		Type:      req.Type,
 		Content:   response,
 		Sources:   sourceSummaries,
 		CreatedAt: time.Now(),
-		Metadata: map[string]interface{}{
-			"length": req.Length,
-			"format": req.Format,
-		},
+		Metadata:  metadata,
 	}, nil
 }
 
-// Chat performs a chat query with RAG
-func (a *Agent) Chat(ctx context.Context, notebookID, message string, history []ChatMessage) (*ChatResponse, error) {
-	// Perform similarity search to find relevant sources
-	docs, err := a.vectorStore.SimilaritySearch(ctx, notebookID, message, a.cfg.MaxSources)
-	if err != nil {
-		return nil, fmt.Errorf("failed to search documents: %w", err)
-	}
-
+// buildChatPrompt formats the RAG chat prompt from retrieved documents, glossary terms, the answer
+// style and up to historyLimit history messages
+func (a *Agent) buildChatPrompt(docs []schema.Document, glossary []GlossaryTerm, style string, history []ChatMessage, historyLimit int, message string) (string, error) {
 	// Build context from retrieved documents
 	var contextBuilder strings.Builder
+	if len(glossary) > 0 {
+		contextBuilder.WriteString("笔记本术语表（回答时请沿用这些术语和定义）：\n")
+		for _, term := range glossary {
+			contextBuilder.WriteString(fmt.Sprintf("- %s：%s\n", term.Term, term.Definition))
+		}
+		contextBuilder.WriteString("\n")
+	}
 	if len(docs) > 0 {
 		contextBuilder.WriteString("来源中的相关信息：\n\n")
 		for i, doc := range docs {
@@ -201,7 +388,7 @@ func (a *Agent) Chat(ctx context.Context, notebookID, message string, history []
 	// Build chat history
 	var historyBuilder strings.Builder
 	for i, msg := range history {
-		if i >= 10 { // Limit history
+		if i >= historyLimit { // Limit history
 			break
 		}
 		role := "用户"
@@ -214,62 +401,614 @@ func (a *Agent) Chat(ctx context.Context, notebookID, message string, history []
 	// Create RAG prompt using f-string format
 	promptTemplate := prompts.NewPromptTemplate(
 		chatSystemPrompt(),
-		[]string{"history", "context", "question"},
+		[]string{"history", "context", "question", "style"},
 	)
 	promptTemplate.TemplateFormat = prompts.TemplateFormatFString
 
+	styleInstructions := ""
+	if answerStyle := findAnswerStyle(style); answerStyle != nil {
+		styleInstructions = "\n\n回答风格：" + answerStyle.Instructions
+	}
+
 	promptValue, err := promptTemplate.Format(map[string]any{
 		"history":  historyBuilder.String(),
 		"context":  contextBuilder.String(),
 		"question": message,
+		"style":    styleInstructions,
 	})
 	if err != nil {
-		return nil, fmt.Errorf("failed to format prompt: %w", err)
+		return "", fmt.Errorf("failed to format prompt: %w", err)
+	}
+
+	return promptValue, nil
+}
+
+// maxToolRounds bounds how many rounds of tool calls the model can make before it has to answer
+const maxToolRounds = 4
+
+// generateWithTools runs a prompt with the chat tools offered to the model as functions, feeding
+// each round of tool results back until the model answers. It returns the answer and the names
+// of the tools called.
+func (a *Agent) generateWithTools(ctx context.Context, llm llms.Model, prompt string, tools *ChatToolRunner) (string, []string, error) {
+	definitions := make([]llms.Tool, len(tools.Tools))
+	byName := make(map[string]*ChatTool, len(tools.Tools))
+	for i := range tools.Tools {
+		tool := &tools.Tools[i]
+		definitions[i] = llms.Tool{
+			Type: "function",
+			Function: &llms.FunctionDefinition{
+				Name:        tool.Name,
+				Description: tool.Description,
+				Parameters:  tool.Parameters,
+			},
+		}
+		byName[tool.Name] = tool
+	}
+
+	messages := []llms.MessageContent{llms.TextParts(llms.ChatMessageTypeHuman, prompt)}
+	var called []string
+	for round := 0; ; round++ {
+		// The last round offers no tools so the model has to answer with what it has
+		var options []llms.CallOption
+		if round < maxToolRounds {
+			options = append(options, llms.WithTools(definitions))
+		}
+		response, err := llm.GenerateContent(ctx, messages, options...)
+		if err != nil {
+			return "", called, err
+		}
+		if len(response.Choices) == 0 {
+			return "", called, fmt.Errorf("empty response from model")
+		}
+		choice := response.Choices[0]
+		if len(choice.ToolCalls) == 0 {
+			return choice.Content, called, nil
+		}
+
+		request := llms.MessageContent{Role: llms.ChatMessageTypeAI}
+		for _, call := range choice.ToolCalls {
+			request.Parts = append(request.Parts, call)
+		}
+		messages = append(messages, request)
+
+		for _, call := range choice.ToolCalls {
+			if call.FunctionCall == nil {
+				continue
+			}
+			result := fmt.Sprintf("error: unknown tool %q", call.FunctionCall.Name)
+			if tool, ok := byName[call.FunctionCall.Name]; ok {
+				output, err := tools.Invoke(ctx, tool, call.FunctionCall.Arguments)
+				if err != nil {
+					output = "error: " + err.Error()
+				}
+				result = output
+				called = append(called, tool.Name)
+			}
+			messages = append(messages, llms.MessageContent{
+				Role:  llms.ChatMessageTypeTool,
+				Parts: []llms.ContentPart{llms.ToolCallResponse{ToolCallID: call.ID, Name: call.FunctionCall.Name, Content: result}},
+			})
+		}
+	}
+}
+
+// Chat performs a chat query with RAG. glossary holds the notebook's definitions of terms the
+// message mentions, so the answer keeps to them. settings are the notebook's chat settings,
+// which choose the answer style and how sources are retrieved; nil uses the defaults. With tools, the model can also call the notebook's chat tools while answering. With onToken,
+// the answer is passed to it as it is generated; answers from tool calls and from models that
+// don't stream arrive as a single chunk.
+func (a *Agent) Chat(ctx context.Context, notebookID, message string, glossary []GlossaryTerm, settings *ChatSettings, history []ChatMessage, tools *ChatToolRunner, onToken func(chunk string) error) (*ChatResponse, error) {
+	// Perform similarity search to find relevant sources
+	docs, err := a.Retrieve(ctx, notebookID, message, settings)
+	if err != nil {
+		return nil, fmt.Errorf("failed to search documents: %w", err)
+	}
+	var style string
+	if settings != nil {
+		style = settings.AnswerStyle
+	}
+	response, err := a.ChatWithDocs(ctx, docs, message, glossary, style, history, tools, onToken)
+	if err != nil {
+		return nil, err
+	}
+	response.SessionID = notebookID
+	return response, nil
+}
+
+// ChatWithDocs answers a chat message like Chat from documents the caller already retrieved,
+// so callers answering many questions can share searches between them. If the documents score
+// below LOW_CONFIDENCE_SCORE, the answer is flagged, or with LOW_CONFIDENCE_ACTION=not_found
+// replaced by saying the sources don't cover the question.
+func (a *Agent) ChatWithDocs(ctx context.Context, docs []schema.Document, message string, glossary []GlossaryTerm, style string, history []ChatMessage, tools *ChatToolRunner, onToken func(chunk string) error) (*ChatResponse, error) {
+	ctx = withUsageOperation(ctx, "chat")
+	bestScore, scored := a.retrievalScore(docs)
+	lowConfidence := scored && a.cfg.LowConfidenceScore > 0 && bestScore < a.cfg.LowConfidenceScore
+	if lowConfidence && a.cfg.LowConfidenceAction == "not_found" {
+		return notFoundResponse(message, len(docs), bestScore, onToken)
+	}
+
+	// Gemini chat routes can't stream or call tools, so they answer in one piece
+	chatLLM, err := a.llmFor("chat")
+	if err != nil {
+		return nil, err
 	}
 
 	// Generate response
-	ctx, cancel := context.WithTimeout(ctx, 300*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, a.cfg.ChatTimeout)
 	defer cancel()
+	ctx, trace := withGenerationTrace(ctx)
 
-	response, err := a.provider.GenerateFromSinglePrompt(ctx, a.llm, promptValue)
-	if err != nil {
-		return nil, fmt.Errorf("failed to generate response: %w", err)
+	// On context overflow, retry with half the retrieved documents and history
+	historyLimit := 10
+	retries := 0
+	var response string
+	var toolsCalled []string
+	// Once part of the answer has been streamed, a retry would repeat it
+	streamed := false
+	for {
+		promptValue, err := a.buildChatPrompt(docs, glossary, style, history, historyLimit, message)
+		if err != nil {
+			return nil, err
+		}
+
+		switch {
+		case chatLLM == nil:
+			response, err = a.generateFor(ctx, "chat", promptValue)
+		case tools != nil && len(tools.Tools) > 0:
+			response, toolsCalled, err = a.generateWithTools(ctx, chatLLM, promptValue, tools)
+		case onToken != nil:
+			response, err = a.provider.GenerateStreamFromSinglePrompt(ctx, chatLLM, promptValue, func(chunk string) error {
+				streamed = true
+				return onToken(chunk)
+			})
+		default:
+			response, err = a.provider.GenerateFromSinglePrompt(ctx, chatLLM, promptValue)
+		}
+		if err == nil {
+			break
+		}
+		if !isContextLengthError(err) || streamed || retries >= maxContextRetries || (len(docs) <= 1 && historyLimit == 0) {
+			return nil, fmt.Errorf("failed to generate response: %w", err)
+		}
+
+		retries++
+		if len(docs) > 1 {
+			docs = docs[:len(docs)/2]
+		}
+		historyLimit /= 2
+		golog.Warnf("context length exceeded for chat, retrying with %d docs and %d history messages (attempt %d/%d)",
+			len(docs), historyLimit, retries, maxContextRetries)
 	}
 
-	// Build source summaries
+	if onToken != nil && !streamed && response != "" {
+		if err := onToken(response); err != nil {
+			return nil, err
+		}
+	}
+
+	// Build source summaries, scored by their best chunk
 	sourceSummaries := make([]SourceSummary, 0, len(docs))
-	sourceMap := make(map[string]bool)
+	sourceMap := make(map[string]int)
 	for _, doc := range docs {
 		if source, ok := doc.Metadata["source"].(string); ok {
-			if !sourceMap[source] {
+			i, seen := sourceMap[source]
+			if !seen {
+				i = len(sourceSummaries)
 				sourceSummaries = append(sourceSummaries, SourceSummary{
 					ID:   source,
 					Name: source,
 					Type: "file",
 				})
-				sourceMap[source] = true
+				sourceMap[source] = i
+			}
+			if score := float64(doc.Score); scored && (sourceSummaries[i].Score == nil || score > *sourceSummaries[i].Score) {
+				sourceSummaries[i].Score = &score
 			}
 		}
 	}
 
+	metadata := map[string]interface{}{
+		"docs_retrieved": len(docs),
+	}
+	if scored {
+		metadata["best_score"] = bestScore
+	}
+	if lowConfidence {
+		metadata["low_confidence"] = true
+	}
+	citations := citationsFromDocs(docs)
+	if len(citations) > 0 {
+		metadata["citations"] = citations
+	}
+	if len(glossary) > 0 {
+		glossaryTerms := make([]string, len(glossary))
+		for i, term := range glossary {
+			glossaryTerms[i] = term.Term
+		}
+		metadata["glossary_terms"] = glossaryTerms
+	}
+	if findAnswerStyle(style) != nil {
+		metadata["answer_style"] = style
+	}
+	if retries > 0 {
+		metadata["context_degraded"] = true
+		metadata["context_retries"] = retries
+	}
+	if len(toolsCalled) > 0 {
+		metadata["tools_called"] = toolsCalled
+	}
+	trace.addTo(metadata)
+
 	return &ChatResponse{
 		Message:   response,
 		Sources:   sourceSummaries,
-		SessionID: notebookID,
+		Citations: citations,
+		Metadata:  metadata,
+	}, nil
+}
+
+// notFoundResponse is the chat answer when no retrieved document scores high enough: rather
+// than answering from what the model knows, it says the sources don't cover the question
+func notFoundResponse(message string, docsRetrieved int, bestScore float64, onToken func(chunk string) error) (*ChatResponse, error) {
+	reply := "I couldn't find anything about this in the sources. Try rephrasing the question, or add a source that covers it."
+	if strings.IndexFunc(message, isCJK) >= 0 {
+		reply = "来源中没有找到与这个问题相关的内容。可以换个问法，或添加包含相关信息的来源。"
+	}
+	if onToken != nil {
+		if err := onToken(reply); err != nil {
+			return nil, err
+		}
+	}
+	return &ChatResponse{
+		Message: reply,
+		Sources: []SourceSummary{},
 		Metadata: map[string]interface{}{
-			"docs_retrieved": len(docs),
+			"docs_retrieved": docsRetrieved,
+			"best_score":     bestScore,
+			"low_confidence": true,
+			"not_found":      true,
 		},
 	}, nil
 }
 
+// buildNoteAssistPrompt formats the writing assistant prompt from retrieved documents
+func (a *Agent) buildNoteAssistPrompt(docs []schema.Document, note *Note, req *NoteAssistRequest, selection string) (string, error) {
+	var contextBuilder strings.Builder
+	for i, doc := range docs {
+		contextBuilder.WriteString(fmt.Sprintf("[来源 %d] %s\n", i+1, doc.PageContent))
+		if source, ok := doc.Metadata["source"].(string); ok {
+			contextBuilder.WriteString(fmt.Sprintf("来源: %s\n\n", source))
+		}
+	}
+
+	instructions := ""
+	if req.Instructions != "" {
+		instructions = "补充要求：" + req.Instructions
+	}
+
+	promptTemplate := prompts.NewPromptTemplate(
+		noteAssistPrompt(),
+		[]string{"task", "instructions", "context", "note", "selection"},
+	)
+	promptTemplate.TemplateFormat = prompts.TemplateFormatFString
+
+	promptValue, err := promptTemplate.Format(map[string]any{
+		"task":         noteAssistOperations[req.Operation],
+		"instructions": instructions,
+		"context":      contextBuilder.String(),
+		"note":         note.Content,
+		"selection":    selection,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to format prompt: %w", err)
+	}
+	return promptValue, nil
+}
+
+// AssistNote runs a writing assistant operation on a note, or on a passage of it, grounded in
+// the notebook's sources most relevant to that passage
+func (a *Agent) AssistNote(ctx context.Context, note *Note, req *NoteAssistRequest) (*NoteAssistResponse, error) {
+	ctx = withUsageOperation(ctx, "note_assist")
+	selection := req.Selection
+	if selection == "" {
+		selection = note.Content
+	}
+
+	docs, err := a.vectorStore.SimilaritySearch(ctx, note.NotebookID, selection, a.cfg.MaxSources)
+	if err != nil {
+		return nil, fmt.Errorf("failed to search documents: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, a.cfg.TransformationTimeout)
+	defer cancel()
+
+	// On context overflow, retry with half the retrieved documents
+	retries := 0
+	var response string
+	for {
+		promptValue, err := a.buildNoteAssistPrompt(docs, note, req, selection)
+		if err != nil {
+			return nil, err
+		}
+
+		response, err = a.provider.GenerateFromSinglePrompt(ctx, a.llm, promptValue)
+		if err == nil {
+			break
+		}
+		if !isContextLengthError(err) || retries >= maxContextRetries || len(docs) <= 1 {
+			return nil, fmt.Errorf("failed to generate response: %w", err)
+		}
+
+		retries++
+		docs = docs[:len(docs)/2]
+		golog.Warnf("context length exceeded for note assist, retrying with %d docs (attempt %d/%d)",
+			len(docs), retries, maxContextRetries)
+	}
+
+	return &NoteAssistResponse{
+		Operation: req.Operation,
+		Result:    strings.TrimSpace(response),
+		Citations: citationsFromDocs(docs),
+	}, nil
+}
+
+// buildNoteEditPrompt formats the note editing chat prompt with the last historyLimit messages
+// of the session
+func (a *Agent) buildNoteEditPrompt(docs []schema.Document, note *Note, history []ChatMessage, historyLimit int, message string) (string, error) {
+	var contextBuilder strings.Builder
+	for i, doc := range docs {
+		contextBuilder.WriteString(fmt.Sprintf("[来源 %d] %s\n", i+1, doc.PageContent))
+		if source, ok := doc.Metadata["source"].(string); ok {
+			contextBuilder.WriteString(fmt.Sprintf("来源: %s\n\n", source))
+		}
+	}
+
+	if len(history) > historyLimit {
+		history = history[len(history)-historyLimit:]
+	}
+	var historyBuilder strings.Builder
+	for _, msg := range history {
+		if msg.Role != "assistant" {
+			historyBuilder.WriteString(fmt.Sprintf("用户: %s\n", msg.Content))
+			continue
+		}
+		// The note above already contains the edits the user applied
+		outcome := ""
+		if edits := noteEditsOf(&msg); len(edits) > 0 {
+			outcome = fmt.Sprintf("（提议了 %d 处修改，用户未采纳）", len(edits))
+			if applied, ok := msg.Metadata["applied_edits"].([]interface{}); ok {
+				outcome = fmt.Sprintf("（提议了 %d 处修改，用户采纳了其中 %d 处）", len(edits), len(applied))
+			}
+		}
+		historyBuilder.WriteString(fmt.Sprintf("助手: %s%s\n", msg.Content, outcome))
+	}
+
+	promptTemplate := prompts.NewPromptTemplate(
+		noteEditChatPrompt(),
+		[]string{"context", "note", "history", "message"},
+	)
+	promptTemplate.TemplateFormat = prompts.TemplateFormatFString
+
+	promptValue, err := promptTemplate.Format(map[string]any{
+		"context": contextBuilder.String(),
+		"note":    note.Content,
+		"history": historyBuilder.String(),
+		"message": message,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to format prompt: %w", err)
+	}
+	return promptValue, nil
+}
+
+// ProposeNoteEdits answers a message in a note's editing chat with proposed edits to the note,
+// grounded in the notebook's sources most relevant to the message, retrieved with the
+// notebook's settings
+func (a *Agent) ProposeNoteEdits(ctx context.Context, note *Note, settings *ChatSettings, history []ChatMessage, message string) (*NoteEditProposal, error) {
+	ctx = withUsageOperation(ctx, "note_edit")
+	docs, err := a.Retrieve(ctx, note.NotebookID, message, settings)
+	if err != nil {
+		return nil, fmt.Errorf("failed to search documents: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, a.cfg.ChatTimeout)
+	defer cancel()
+
+	// On context overflow, retry with half the retrieved documents and history
+	historyLimit := 10
+	retries := 0
+	var response string
+	for {
+		promptValue, err := a.buildNoteEditPrompt(docs, note, history, historyLimit, message)
+		if err != nil {
+			return nil, err
+		}
+
+		response, err = a.provider.GenerateFromSinglePrompt(ctx, a.llm, promptValue)
+		if err == nil {
+			break
+		}
+		if !isContextLengthError(err) || retries >= maxContextRetries || (len(docs) <= 1 && historyLimit == 0) {
+			return nil, fmt.Errorf("failed to generate response: %w", err)
+		}
+
+		retries++
+		if len(docs) > 1 {
+			docs = docs[:len(docs)/2]
+		}
+		historyLimit /= 2
+		golog.Warnf("context length exceeded for note edit chat, retrying with %d docs and %d history messages (attempt %d/%d)",
+			len(docs), historyLimit, retries, maxContextRetries)
+	}
+
+	explanation, edits := parseNoteEdits(response)
+	return &NoteEditProposal{
+		Message:   explanation,
+		Edits:     edits,
+		Citations: citationsFromDocs(docs),
+	}, nil
+}
+
+// JudgeCoverage retrieves the passages for a question as chat would and has the model judge
+// whether they answer it
+func (a *Agent) JudgeCoverage(ctx context.Context, notebookID, question string, settings *ChatSettings) (*coverageJudgement, error) {
+	ctx = withUsageOperation(ctx, "coverage")
+	docs, err := a.Retrieve(ctx, notebookID, question, settings)
+	if err != nil {
+		return nil, fmt.Errorf("failed to search documents: %w", err)
+	}
+	if len(docs) == 0 {
+		return &coverageJudgement{Support: SupportNone, Reason: "没有检索到任何段落"}, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, a.cfg.ChatTimeout)
+	defer cancel()
+
+	// On context overflow, retry with half the retrieved documents
+	retries := 0
+	var response string
+	for {
+		var contextBuilder strings.Builder
+		for i, doc := range docs {
+			contextBuilder.WriteString(fmt.Sprintf("[段落 %d] %s\n\n", i+1, doc.PageContent))
+		}
+		promptTemplate := prompts.NewPromptTemplate(coverageJudgePrompt(), []string{"question", "context"})
+		promptTemplate.TemplateFormat = prompts.TemplateFormatFString
+		promptValue, err := promptTemplate.Format(map[string]any{
+			"question": question,
+			"context":  contextBuilder.String(),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("failed to format prompt: %w", err)
+		}
+
+		response, err = a.provider.GenerateFromSinglePrompt(ctx, a.llm, promptValue)
+		if err == nil {
+			break
+		}
+		if !isContextLengthError(err) || retries >= maxContextRetries || len(docs) <= 1 {
+			return nil, fmt.Errorf("failed to generate response: %w", err)
+		}
+
+		retries++
+		docs = docs[:len(docs)/2]
+		golog.Warnf("context length exceeded for coverage check, retrying with %d docs (attempt %d/%d)",
+			len(docs), retries, maxContextRetries)
+	}
+
+	judgement := parseCoverageJudgement(response, docs)
+	return judgement, nil
+}
+
+// draftCitationIndex returns the number of a retrieved passage in a draft's citations, adding it if new
+func draftCitationIndex(citations *[]Citation, doc schema.Document) int {
+	cited := citationsFromDocs([]schema.Document{doc})
+	if len(cited) == 0 {
+		return 0
+	}
+	c := cited[0]
+	for _, existing := range *citations {
+		if existing.SourceID == c.SourceID && existing.Start == c.Start && existing.End == c.End {
+			return existing.Index
+		}
+	}
+	c.Index = len(*citations) + 1
+	*citations = append(*citations, c)
+	return c.Index
+}
+
+// WriteDraftSection writes one section of an approved draft outline from the passages of the
+// draft's sources most relevant to it. Passages are numbered across the whole draft, so the
+// returned citations extend the job's.
+func (a *Agent) WriteDraftSection(ctx context.Context, job *DraftJob, index int) (string, []Citation, error) {
+	ctx = withUsageOperation(ctx, "draft")
+	section := job.Sections[index]
+
+	docs, err := a.vectorStore.SimilaritySearch(ctx, job.NotebookID, section.Heading+"\n"+section.Points, a.cfg.MaxSources*3)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to search documents: %w", err)
+	}
+	if len(job.SourceIDs) > 0 {
+		selected := make(map[string]bool, len(job.SourceIDs))
+		for _, id := range job.SourceIDs {
+			selected[id] = true
+		}
+		filtered := docs[:0]
+		for _, doc := range docs {
+			if id, _ := doc.Metadata["source_id"].(string); selected[id] {
+				filtered = append(filtered, doc)
+			}
+		}
+		docs = filtered
+	}
+	if len(docs) > a.cfg.MaxSources {
+		docs = docs[:a.cfg.MaxSources]
+	}
+
+	previous := "（这是第一章）"
+	if index > 0 {
+		runes := []rune(job.Sections[index-1].Content)
+		if len(runes) > 1500 {
+			runes = runes[len(runes)-1500:]
+		}
+		previous = string(runes)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, a.cfg.TransformationTimeout)
+	defer cancel()
+
+	// On context overflow, retry with half the retrieved documents
+	retries := 0
+	for {
+		citations := append([]Citation(nil), job.Citations...)
+		var contextBuilder strings.Builder
+		for _, doc := range docs {
+			contextBuilder.WriteString(fmt.Sprintf("[来源 %d] %s\n", draftCitationIndex(&citations, doc), doc.PageContent))
+			if source, ok := doc.Metadata["source"].(string); ok {
+				contextBuilder.WriteString(fmt.Sprintf("来源: %s\n\n", source))
+			}
+		}
+
+		promptTemplate := prompts.NewPromptTemplate(
+			draftSectionPrompt(),
+			[]string{"outline", "previous", "context", "heading", "points", "length"},
+		)
+		promptTemplate.TemplateFormat = prompts.TemplateFormatFString
+		promptValue, err := promptTemplate.Format(map[string]any{
+			"outline":  job.Outline,
+			"previous": previous,
+			"context":  contextBuilder.String(),
+			"heading":  section.Heading,
+			"points":   section.Points,
+			"length":   draftLengths[job.Length],
+		})
+		if err != nil {
+			return "", nil, fmt.Errorf("failed to format prompt: %w", err)
+		}
+
+		response, err := a.provider.GenerateFromSinglePrompt(ctx, a.llm, promptValue)
+		if err == nil {
+			return strings.TrimSpace(response), citations, nil
+		}
+		if !isContextLengthError(err) || retries >= maxContextRetries || len(docs) <= 1 {
+			return "", nil, fmt.Errorf("failed to generate section %q: %w", section.Heading, err)
+		}
+
+		retries++
+		docs = docs[:len(docs)/2]
+		golog.Warnf("context length exceeded for draft section, retrying with %d docs (attempt %d/%d)",
+			len(docs), retries, maxContextRetries)
+	}
+}
+
 // Slide represents a parsed PPT slide
 type Slide struct {
 	Style   string
 	Content string
 }
 
-// ParsePPTSlides parses the LLM output into individual slides
-func (a *Agent) ParsePPTSlides(content string) []Slide {
+// parsePPTSlides parses the LLM output into individual slides
+func parsePPTSlides(content string) []Slide {
 	var slides []Slide
 
 	// 1. Extract style instructions
@@ -414,45 +1153,73 @@ func (a *Agent) GenerateSummary(ctx context.Context, sources []Source, length st
 	return resp.Content, nil
 }
 
-// callDeepInsight executes the DeepInsight CLI tool and returns the generated report
+// callDeepInsight executes the DeepInsight CLI tool and returns the generated report.
+// The tool runs inside a private temporary directory that is removed afterwards, and
+// its output is streamed to the log line by line so long runs show progress.
 func (a *Agent) callDeepInsight(ctx context.Context, summary string) (string, error) {
-	// Create a temporary file for the report output
-	tmpFile := "./tmp/deepinsight_report_" + fmt.Sprintf("%d", time.Now().Unix()) + ".md"
+	binary, err := filepath.Abs(a.cfg.DeepInsightPath)
+	if err != nil {
+		return "", fmt.Errorf("failed to resolve DeepInsight path: %w", err)
+	}
+
+	workDir, err := os.MkdirTemp("", "deepinsight-")
+	if err != nil {
+		return "", fmt.Errorf("failed to create DeepInsight work directory: %w", err)
+	}
+	defer os.RemoveAll(workDir)
+
+	reportFile := filepath.Join(workDir, "report.md")
 
 	// Execute DeepInsight command
 	// DeepInsight -o report.md "summary text"
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute)
+	// Canceling the insight job stops DeepInsight, which runs for at most DEEPINSIGHT_TIMEOUT
+	ctx, cancel := context.WithTimeout(ctx, a.cfg.DeepInsightTimeout)
 	defer cancel()
-	output, err := execCommandContext(ctx, "./DeepInsight", "-o", tmpFile, escapeShellArg(summary))
-	if err != nil {
+
+	cmd := exec.CommandContext(ctx, binary, "-o", reportFile, summary)
+	cmd.Dir = workDir
+
+	pr, pw := io.Pipe()
+	cmd.Stdout = pw
+	cmd.Stderr = pw
+	if err := cmd.Start(); err != nil {
+		return "", fmt.Errorf("failed to start DeepInsight: %w", err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		err := cmd.Wait()
+		pw.Close()
+		done <- err
+	}()
+
+	// Stream output for progress, keeping the tail for error reporting
+	const tailLines = 20
+	var tail []string
+	scanner := bufio.NewScanner(pr)
+	for scanner.Scan() {
+		line := scanner.Text()
+		golog.Infof("[DeepInsight] %s", line)
+		tail = append(tail, line)
+		if len(tail) > tailLines {
+			tail = tail[1:]
+		}
+	}
+	// Drain anything left (e.g. an overlong line) so the writer never blocks
+	io.Copy(io.Discard, pr)
+
+	if err := <-done; err != nil {
+		output := strings.Join(tail, "\n")
 		golog.Infof("failed to exec DeepInsight: err=%v, output=%s", err, output)
 		return "", fmt.Errorf("DeepInsight command failed: %w, output: %s", err, output)
 	}
 
 	// Read the generated report
-	reportContent, err := execCommandContext(ctx, "/bin/cat", tmpFile)
+	reportContent, err := os.ReadFile(reportFile)
 	if err != nil {
-		golog.Infof("failed to read DeepInsight report: err=%v, output=%s", err, output)
+		golog.Infof("failed to read DeepInsight report: err=%v", err)
 		return "", fmt.Errorf("failed to read DeepInsight report: %w", err)
 	}
 
-	// Clean up temp file
-	_, _ = execCommandContext(context.Background(), "/bin/rm", "-f", tmpFile)
-
-	return reportContent, nil
-}
-
-// escapeShellArg escapes a shell argument to prevent injection
-func escapeShellArg(arg string) string {
-	return "'" + strings.ReplaceAll(arg, "'", "'\"'\"'") + "'"
-}
-
-// execCommandContext is a helper to execute commands with context
-func execCommandContext(ctx context.Context, name string, args ...string) (string, error) {
-	cmd := exec.CommandContext(ctx, name, args...)
-	output, err := cmd.CombinedOutput()
-	if err != nil {
-		return string(output), err
-	}
-	return string(output), nil
+	return string(reportContent), nil
 }
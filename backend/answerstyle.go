@@ -0,0 +1,94 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kataras/golog"
+)
+
+// Limits of a notebook's retrieval settings
+const (
+	maxRetrievalTopK          = 200
+	maxRetrievalContextChunks = 50
+)
+
+// resolveChatSettings returns the notebook's chat settings for a chat message, with the
+// requested answer style in place of the notebook's default if one is requested
+func (s *Server) resolveChatSettings(ctx context.Context, notebookID, requested string) (*ChatSettings, error) {
+	requested = strings.TrimSpace(requested)
+	if requested != "" && findAnswerStyle(requested) == nil {
+		return nil, fmt.Errorf("unknown answer style %q", requested)
+	}
+	settings, err := s.store.GetChatSettings(ctx, notebookID)
+	if err != nil {
+		golog.Errorf("failed to get chat settings: %v", err)
+		settings = &ChatSettings{}
+	}
+	if requested != "" {
+		settings.AnswerStyle = requested
+	}
+	return settings, nil
+}
+
+// handleListAnswerStyles returns the answer styles a chat can use
+func (s *Server) handleListAnswerStyles(c *gin.Context) {
+	c.JSON(http.StatusOK, answerStyles)
+}
+
+// handleGetChatSettings returns the notebook's chat defaults
+func (s *Server) handleGetChatSettings(c *gin.Context) {
+	notebook, ok := s.getOwnedNotebook(c)
+	if !ok {
+		return
+	}
+	settings, err := s.store.GetChatSettings(c.Request.Context(), notebook.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to get chat settings"})
+		return
+	}
+	settings.Defaults = retrievalDefaults(s.cfg)
+	c.JSON(http.StatusOK, settings)
+}
+
+// handleSetChatSettings sets the notebook's chat defaults. They apply to the owner's chats,
+// chat integrations and visitors' chats with the public notebook; the retrieval settings also
+// apply to batch questions, coverage reports and the note editing chat.
+func (s *Server) handleSetChatSettings(c *gin.Context) {
+	notebook, ok := s.getOwnedNotebook(c)
+	if !ok {
+		return
+	}
+
+	var settings ChatSettings
+	if err := c.ShouldBindJSON(&settings); err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+		return
+	}
+	settings.AnswerStyle = strings.TrimSpace(settings.AnswerStyle)
+	if settings.AnswerStyle != "" && findAnswerStyle(settings.AnswerStyle) == nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid answer style", Details: fmt.Sprintf("unknown answer style %q", settings.AnswerStyle)})
+		return
+	}
+	switch {
+	case settings.TopK < 0 || settings.TopK > maxRetrievalTopK:
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid retrieval settings", Details: fmt.Sprintf("top_k must be between 0 and %d", maxRetrievalTopK)})
+		return
+	case settings.MaxContextChunks < 0 || settings.MaxContextChunks > maxRetrievalContextChunks:
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid retrieval settings", Details: fmt.Sprintf("max_context_chunks must be between 0 and %d", maxRetrievalContextChunks)})
+		return
+	case settings.ScoreThreshold < 0 || settings.ScoreThreshold > 1:
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid retrieval settings", Details: "score_threshold must be between 0 and 1"})
+		return
+	}
+
+	if err := s.store.SetChatSettings(c.Request.Context(), notebook.ID, &settings); err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to update chat settings"})
+		return
+	}
+	settings.Defaults = retrievalDefaults(s.cfg)
+	c.JSON(http.StatusOK, settings)
+}
@@ -0,0 +1,106 @@
+package backend
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"path"
+	"regexp"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// staticAssetURL matches /static/... references in index.html, including any existing ?v= suffix
+var staticAssetURL = regexp.MustCompile(`/static/([A-Za-z0-9._/-]+)(\?v=[^"']*)?`)
+
+// frontendAssets serves the embedded frontend with content-hash cache busting.
+// Hashes are computed once from the embedded files, so they change exactly when a build changes them.
+type frontendAssets struct {
+	static    fs.FS
+	hashes    map[string]string // static file path -> short content hash
+	index     []byte            // index.html with hashed asset URLs
+	indexETag string
+}
+
+// newFrontendAssets hashes the embedded static files and rewrites index.html to reference them
+func newFrontendAssets(root fs.FS) (*frontendAssets, error) {
+	static, err := fs.Sub(root, "frontend/static")
+	if err != nil {
+		return nil, err
+	}
+
+	hashes := make(map[string]string)
+	err = fs.WalkDir(static, ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		data, err := fs.ReadFile(static, p)
+		if err != nil {
+			return err
+		}
+		hashes[p] = contentHash(data)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to hash static assets: %w", err)
+	}
+
+	index, err := fs.ReadFile(root, "frontend/index.html")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read index.html: %w", err)
+	}
+	index = staticAssetURL.ReplaceAllFunc(index, func(match []byte) []byte {
+		name := staticAssetURL.FindSubmatch(match)[1]
+		if hash, ok := hashes[string(name)]; ok {
+			return []byte("/static/" + string(name) + "?v=" + hash)
+		}
+		return match
+	})
+
+	return &frontendAssets{
+		static:    static,
+		hashes:    hashes,
+		index:     index,
+		indexETag: `"` + contentHash(index) + `"`,
+	}, nil
+}
+
+// contentHash returns a short hex SHA-256 of data, used for asset versions and ETags
+func contentHash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:8])
+}
+
+// serveIndex serves index.html. It is always revalidated so new asset hashes are picked up immediately.
+func (a *frontendAssets) serveIndex(c *gin.Context) {
+	c.Header("Cache-Control", "no-cache")
+	c.Header("ETag", a.indexETag)
+	if c.GetHeader("If-None-Match") == a.indexETag {
+		c.Status(http.StatusNotModified)
+		return
+	}
+	c.Data(http.StatusOK, "text/html; charset=utf-8", a.index)
+}
+
+// serveStatic serves a static asset. Requests carrying the current content hash
+// are cached forever; anything else is revalidated against the ETag.
+func (a *frontendAssets) serveStatic(c *gin.Context) {
+	name := strings.TrimPrefix(path.Clean(c.Param("filepath")), "/")
+	hash, ok := a.hashes[name]
+	if !ok {
+		c.Status(http.StatusNotFound)
+		return
+	}
+
+	if c.Query("v") == hash {
+		c.Header("Cache-Control", "public, max-age=31536000, immutable")
+	} else {
+		c.Header("Cache-Control", "no-cache")
+	}
+	// http.FileServer honors this ETag for If-None-Match requests
+	c.Header("ETag", `"`+hash+`"`)
+	c.FileFromFS(name, http.FS(a.static))
+}
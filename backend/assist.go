@@ -0,0 +1,94 @@
+package backend
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kataras/golog"
+)
+
+// handleNoteAssist runs a writing assistant operation on a note. With apply set, the result
+// replaces the selected passage (or the whole note) so notes can be edited in place.
+func (s *Server) handleNoteAssist(c *gin.Context) {
+	ctx, cancel := requestContext(c)
+	defer cancel()
+	notebookID := c.Param("id")
+	userID := c.GetString("user_id")
+	if err := s.checkNotebookAccess(ctx, notebookID, userID); err != nil {
+		c.JSON(http.StatusForbidden, ErrorResponse{Error: "Access denied"})
+		return
+	}
+
+	var req NoteAssistRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+		return
+	}
+	if _, ok := noteAssistOperations[req.Operation]; !ok {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Unknown operation", Details: "operation must be rewrite, expand, shorten or critique"})
+		return
+	}
+	if req.Apply && req.Operation == "critique" {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "A critique cannot be applied to the note"})
+		return
+	}
+
+	note, err := s.store.GetNote(ctx, c.Param("noteId"))
+	if err != nil || note.NotebookID != notebookID {
+		c.JSON(http.StatusNotFound, ErrorResponse{Error: "Note not found"})
+		return
+	}
+	if strings.TrimSpace(note.Content) == "" {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Note is empty"})
+		return
+	}
+	if req.Selection != "" && !strings.Contains(note.Content, req.Selection) {
+		c.JSON(http.StatusConflict, ErrorResponse{Error: "Selection not found in note", Details: "the note may have changed since the passage was selected"})
+		return
+	}
+
+	agent, ok := s.requireAgent(c)
+	if !ok {
+		return
+	}
+	if err := s.loadNotebookVectorIndex(ctx, notebookID); err != nil {
+		golog.Errorf("failed to load vector index: %v", err)
+	}
+	response, err := agent.AssistNote(withUsageScope(ctx, userID, notebookID), note, &req)
+	if err != nil {
+		s.reportGenerationError(c, err)
+		c.JSON(generationErrorStatus(err), ErrorResponse{Error: fmt.Sprintf("Generation failed: %v", err)})
+		return
+	}
+
+	if req.Apply {
+		content := response.Result
+		if req.Selection != "" {
+			content = strings.Replace(note.Content, req.Selection, response.Result, 1)
+		}
+		// The assistant's edit is kept as a revision the user can restore from
+		if _, err := s.reviseNote(ctx, note, note.Title, content, note.Metadata); err != nil {
+			c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to update note"})
+			return
+		}
+		response.Note = note
+	}
+
+	activityLog := &ActivityLog{
+		UserID:       userID,
+		Action:       "note_assist",
+		ResourceType: "note",
+		ResourceID:   note.ID,
+		ResourceName: note.Title,
+		Details:      fmt.Sprintf(`{"notebook_id": "%s", "operation": "%s", "applied": %t}`, notebookID, req.Operation, req.Apply),
+		IPAddress:    c.ClientIP(),
+		UserAgent:    c.GetHeader("User-Agent"),
+	}
+	if err := s.store.LogActivity(ctx, activityLog); err != nil {
+		golog.Errorf("failed to log note assist activity: %v", err)
+	}
+
+	c.JSON(http.StatusOK, response)
+}
@@ -3,15 +3,18 @@ package backend
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/golang-jwt/jwt/v5"
 	"github.com/kataras/golog"
+	"golang.org/x/crypto/bcrypt"
 	"golang.org/x/oauth2"
 	"golang.org/x/oauth2/github"
 	"golang.org/x/oauth2/google"
@@ -89,7 +92,7 @@ func (h *AuthHandler) HandleCallback(c *gin.Context) {
 		return
 	}
 
-	var email, name, avatarURL string
+	var subject, email, name, avatarURL string
 
 	switch provider {
 	case "github":
@@ -109,6 +112,7 @@ func (h *AuthHandler) HandleCallback(c *gin.Context) {
 
 		body, _ := io.ReadAll(resp.Body)
 		var ghUser struct {
+			ID        int64  `json:"id"`
 			Email     string `json:"email"`
 			Name      string `json:"name"`
 			Login     string `json:"login"`
@@ -141,6 +145,7 @@ func (h *AuthHandler) HandleCallback(c *gin.Context) {
 			ghUser.Email = ghUser.Login + "@github.com"
 		}
 
+		subject = strconv.FormatInt(ghUser.ID, 10)
 		email = ghUser.Email
 		name = ghUser.Name
 		if name == "" {
@@ -165,12 +170,14 @@ func (h *AuthHandler) HandleCallback(c *gin.Context) {
 
 		body, _ := io.ReadAll(resp.Body)
 		var gUser struct {
+			ID      string `json:"id"`
 			Email   string `json:"email"`
 			Name    string `json:"name"`
 			Picture string `json:"picture"`
 		}
 		json.Unmarshal(body, &gUser)
 
+		subject = gUser.ID
 		email = gUser.Email
 		name = gUser.Name
 		avatarURL = gUser.Picture
@@ -180,6 +187,23 @@ func (h *AuthHandler) HandleCallback(c *gin.Context) {
 		return
 	}
 
+	if subject == "" || subject == "0" {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get user info"})
+		return
+	}
+	identity := &UserIdentity{Provider: provider, Subject: subject, Email: email, Name: name}
+
+	// The flow was started to link the identity to a signed-in user rather than to sign in
+	linkUserID, err := h.parseLinkState(c, c.Query("state"))
+	if err != nil {
+		h.postToOpener(c, provider, toJson(gin.H{"error": err.Error()}))
+		return
+	}
+	if linkUserID != "" {
+		h.finishLinkIdentity(c, linkUserID, identity)
+		return
+	}
+
 	// Create or Update User
 	user := &User{
 		Email:     email,
@@ -187,21 +211,18 @@ func (h *AuthHandler) HandleCallback(c *gin.Context) {
 		AvatarURL: avatarURL,
 		Provider:  provider,
 	}
-
-	if err := h.store.CreateUser(context.Background(), user); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create user"})
+	dbUser, err := h.identityUser(context.Background(), identity, user)
+	if errors.Is(err, errIdentityUnlinked) {
+		h.postToOpener(c, provider, toJson(gin.H{"error": err.Error()}))
 		return
 	}
-
-	// Get the full user object (with ID)
-	dbUser, err := h.store.GetUserByEmail(context.Background(), email)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to get user"})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create user"})
 		return
 	}
 
 	// Generate JWT
-	tokenString, err := GenerateJWT(dbUser.ID, h.config.JWTSecret)
+	tokenString, err := h.newSessionToken(c, dbUser.ID)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
 		return
@@ -222,6 +243,11 @@ func (h *AuthHandler) HandleCallback(c *gin.Context) {
 	}
 
 	// Return token via HTML for popup or redirect
+	h.postToOpener(c, provider, fmt.Sprintf(`{token: "%s", user: %s}`, tokenString, toJson(dbUser)))
+}
+
+// postToOpener ends an OAuth flow run in a popup by sending a message to the page that opened it
+func (h *AuthHandler) postToOpener(c *gin.Context, provider, message string) {
 	// Get origin from redirect URL for security
 	origin := ""
 	if provider == "github" && h.config.GithubRedirectURL != "" {
@@ -242,10 +268,49 @@ func (h *AuthHandler) HandleCallback(c *gin.Context) {
 	c.Header("Content-Type", "text/html")
 	c.String(http.StatusOK, fmt.Sprintf(`
         <script>
-            window.opener.postMessage({token: "%s", user: %s}, "%s");
+            window.opener.postMessage(%s, "%s");
             window.close();
         </script>
-    `, tokenString, toJson(dbUser), origin))
+    `, message, origin))
+}
+
+// HandlePasswordLogin signs in accounts created with a password, such as the setup wizard's admin
+func (h *AuthHandler) HandlePasswordLogin(c *gin.Context) {
+	var req struct {
+		Email    string `json:"email" binding:"required"`
+		Password string `json:"password" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Email and password are required"})
+		return
+	}
+
+	user, passwordHash, err := h.store.GetUserPasswordHash(c.Request.Context(), strings.TrimSpace(req.Email))
+	if err != nil || passwordHash == "" ||
+		bcrypt.CompareHashAndPassword([]byte(passwordHash), []byte(req.Password)) != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid email or password"})
+		return
+	}
+
+	tokenString, err := h.newSessionToken(c, user.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
+		return
+	}
+
+	activityLog := &ActivityLog{
+		UserID:       user.ID,
+		Action:       "login",
+		ResourceName: "password",
+		Details:      fmt.Sprintf(`{"provider": "password", "email": "%s"}`, user.Email),
+		IPAddress:    c.ClientIP(),
+		UserAgent:    c.GetHeader("User-Agent"),
+	}
+	if err := h.store.LogActivity(context.Background(), activityLog); err != nil {
+		golog.Errorf("failed to log login activity: %v", err)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"token": tokenString, "user": user})
 }
 
 func (h *AuthHandler) HandleMe(c *gin.Context) {
@@ -269,10 +334,12 @@ func toJson(v interface{}) string {
 	return string(b)
 }
 
-func GenerateJWT(userID, secret string) (string, error) {
+// GenerateJWT signs a token for a session of a user
+func GenerateJWT(userID, sessionID, secret string, lifetime time.Duration) (string, error) {
 	claims := jwt.MapClaims{
 		"user_id": userID,
-		"exp":     time.Now().Add(time.Hour * 24 * 7).Unix(),
+		"sid":     sessionID,
+		"exp":     time.Now().Add(lifetime).Unix(),
 	}
 	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
 	return token.SignedString([]byte(secret))
@@ -0,0 +1,111 @@
+package backend
+
+import (
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/kataras/golog"
+)
+
+// sessionLifetime is how long a sign-in lasts
+const sessionLifetime = 7 * 24 * time.Hour
+
+// sessionTouchInterval is how often a session's last use is written, so that every request
+// doesn't write to the database
+const sessionTouchInterval = time.Minute
+
+// newSessionToken records a sign-in from the requesting device and returns its token
+func (h *AuthHandler) newSessionToken(c *gin.Context, userID string) (string, error) {
+	session := &AuthSession{
+		UserID:    userID,
+		IPAddress: c.ClientIP(),
+		UserAgent: c.GetHeader("User-Agent"),
+		ExpiresAt: time.Now().Add(sessionLifetime),
+	}
+	if err := h.store.CreateAuthSession(c.Request.Context(), session); err != nil {
+		return "", fmt.Errorf("failed to record session: %w", err)
+	}
+	return GenerateJWT(userID, session.ID, h.config.JWTSecret, sessionLifetime)
+}
+
+// checkSession verifies that the session a token names hasn't been revoked. Tokens issued before
+// sessions were recorded name none and stay valid until they expire.
+func checkSession(c *gin.Context, sessions *Store, claims jwt.MapClaims, userID string) bool {
+	sessionID, ok := claims["sid"].(string)
+	if !ok || sessions == nil {
+		return true
+	}
+	if err := sessions.TouchAuthSession(c.Request.Context(), sessionID, userID, c.ClientIP(), c.GetHeader("User-Agent")); err != nil {
+		auditLogger.Infof("session %s of user %s refused: %v", sessionID, userID, err)
+		return false
+	}
+	c.Set("session_id", sessionID)
+	return true
+}
+
+// HandleListSessions lists the user's signed-in devices and API tokens
+func (h *AuthHandler) HandleListSessions(c *gin.Context) {
+	sessions, err := h.store.ListAuthSessions(c.Request.Context(), c.GetString("user_id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to list sessions"})
+		return
+	}
+	current := c.GetString("session_id")
+	for i := range sessions {
+		sessions[i].Current = sessions[i].ID == current
+	}
+	c.JSON(http.StatusOK, sessions)
+}
+
+// HandleRevokeSession signs out a device or revokes an API token. Its token is refused from
+// the next request on.
+func (h *AuthHandler) HandleRevokeSession(c *gin.Context) {
+	if getTokenGrant(c) != nil {
+		c.JSON(http.StatusForbidden, ErrorResponse{Error: "Sessions can only be revoked from a signed-in session"})
+		return
+	}
+	sessionID := c.Param("sessionId")
+	if err := h.store.DeleteAuthSession(c.Request.Context(), c.GetString("user_id"), sessionID); err != nil {
+		c.JSON(http.StatusNotFound, ErrorResponse{Error: "Session not found"})
+		return
+	}
+	h.logSessionActivity(c, "revoke_session", sessionID, nil)
+	c.Status(http.StatusNoContent)
+}
+
+// HandleRevokeOtherSessions signs out every device and revokes every API token but the
+// session making the request
+func (h *AuthHandler) HandleRevokeOtherSessions(c *gin.Context) {
+	if getTokenGrant(c) != nil {
+		c.JSON(http.StatusForbidden, ErrorResponse{Error: "Sessions can only be revoked from a signed-in session"})
+		return
+	}
+	revoked, err := h.store.DeleteOtherAuthSessions(c.Request.Context(), c.GetString("user_id"), c.GetString("session_id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to revoke sessions"})
+		return
+	}
+	h.logSessionActivity(c, "revoke_other_sessions", "", map[string]int{"revoked": revoked})
+	c.JSON(http.StatusOK, gin.H{"revoked": revoked})
+}
+
+// logSessionActivity records who revoked sessions
+func (h *AuthHandler) logSessionActivity(c *gin.Context, action, sessionID string, details interface{}) {
+	activityLog := &ActivityLog{
+		UserID:       c.GetString("user_id"),
+		Action:       action,
+		ResourceType: "session",
+		ResourceID:   sessionID,
+		IPAddress:    c.ClientIP(),
+		UserAgent:    c.GetHeader("User-Agent"),
+	}
+	if details != nil {
+		activityLog.Details = toJson(details)
+	}
+	if err := h.store.LogActivity(c.Request.Context(), activityLog); err != nil {
+		golog.Errorf("failed to log session activity: %v", err)
+	}
+}
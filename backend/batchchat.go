@@ -0,0 +1,206 @@
+package backend
+
+import (
+	"context"
+	"encoding/csv"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kataras/golog"
+)
+
+// questionBatch groups the questions of a batch by their normalized text, so repeats of a
+// question are searched and answered once
+type questionBatch struct {
+	questions []string         // Trimmed, in the order asked
+	groups    map[string][]int // Indexes of the questions with each normalized text
+	order     []string         // Normalized texts in the order first asked
+}
+
+// newQuestionBatch groups a batch's questions. Empty questions belong to no group.
+func newQuestionBatch(questions []string) *questionBatch {
+	b := &questionBatch{questions: make([]string, len(questions)), groups: make(map[string][]int)}
+	for i, question := range questions {
+		question = strings.TrimSpace(question)
+		b.questions[i] = question
+		if question == "" {
+			continue
+		}
+		key := strings.ToLower(strings.Join(strings.Fields(question), " "))
+		if _, seen := b.groups[key]; !seen {
+			b.order = append(b.order, key)
+		}
+		b.groups[key] = append(b.groups[key], i)
+	}
+	return b
+}
+
+// run calls fn once per group with its first question and the indexes of all its questions,
+// at most workers groups at a time
+func (b *questionBatch) run(workers int, fn func(question string, indexes []int)) {
+	keys := make(chan string)
+	var wg sync.WaitGroup
+	for range min(max(workers, 1), len(b.order)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for key := range keys {
+				indexes := b.groups[key]
+				fn(b.questions[indexes[0]], indexes)
+			}
+		}()
+	}
+	for _, key := range b.order {
+		keys <- key
+	}
+	close(keys)
+	wg.Wait()
+}
+
+// checkBatchSize responds with an error unless a batch has between one question and
+// BATCH_CHAT_MAX_QUESTIONS
+func (s *Server) checkBatchSize(c *gin.Context, questions []string) bool {
+	if len(questions) == 0 {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "No questions"})
+		return false
+	}
+	if max := s.cfg.BatchChatMaxQuestions; max > 0 && len(questions) > max {
+		c.JSON(http.StatusRequestEntityTooLarge, ErrorResponse{Error: fmt.Sprintf("At most %d questions per batch", max)})
+		return false
+	}
+	return true
+}
+
+// handleBatchChat answers a list of questions through the chat pipeline and returns all the
+// answers at once, as JSON or CSV. Questions are answered without a session; repeated
+// questions are searched and answered once. A failed question doesn't fail the batch.
+func (s *Server) handleBatchChat(c *gin.Context) {
+	ctx, cancel := requestContext(c)
+	defer cancel()
+	notebook, ok := s.getOwnedNotebook(c)
+	if !ok {
+		return
+	}
+
+	var req BatchChatRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+		return
+	}
+	if req.Format != "" && req.Format != "json" && req.Format != "csv" {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid format", Details: "format must be json or csv"})
+		return
+	}
+	if !s.checkBatchSize(c, req.Questions) {
+		return
+	}
+	settings, err := s.resolveChatSettings(ctx, notebook.ID, req.Style)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid answer style", Details: err.Error()})
+		return
+	}
+
+	agent, ok := s.requireAgent(c)
+	if !ok {
+		return
+	}
+	if err := s.loadNotebookVectorIndex(ctx, notebook.ID); err != nil {
+		golog.Errorf("failed to load vector index: %v", err)
+	}
+	ctx = withUsageOperation(withUsageScope(ctx, c.GetString("user_id"), notebook.ID), "batch_chat")
+
+	batch := newQuestionBatch(req.Questions)
+	results := make([]BatchChatResult, len(batch.questions))
+	for i, question := range batch.questions {
+		results[i] = BatchChatResult{Index: i, Question: question, Sources: []string{}}
+		if question == "" {
+			results[i].Error = "empty question"
+		}
+	}
+	batch.run(s.cfg.BatchChatWorkers, func(question string, indexes []int) {
+		answer := s.answerBatchQuestion(ctx, agent, notebook.ID, question, settings)
+		for _, i := range indexes {
+			answer.Index, answer.Question = i, batch.questions[i]
+			results[i] = answer
+		}
+	})
+
+	response := BatchChatResponse{Results: results, Retrievals: len(batch.order)}
+	for _, result := range results {
+		if result.Error != "" {
+			response.Failed++
+		} else {
+			response.Answered++
+		}
+	}
+
+	activityLog := &ActivityLog{
+		UserID:       c.GetString("user_id"),
+		Action:       "batch_chat",
+		ResourceType: "notebook",
+		ResourceID:   notebook.ID,
+		ResourceName: notebook.Name,
+		Details:      fmt.Sprintf(`{"notebook_id": "%s", "questions": %d, "failed": %d}`, notebook.ID, len(results), response.Failed),
+		IPAddress:    c.ClientIP(),
+		UserAgent:    c.GetHeader("User-Agent"),
+	}
+	if err := s.store.LogActivity(ctx, activityLog); err != nil {
+		golog.Errorf("failed to log batch chat activity: %v", err)
+	}
+
+	if req.Format == "csv" {
+		writeBatchChatCSV(c, response.Results)
+		return
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// answerBatchQuestion searches the notebook and answers one question of a batch
+func (s *Server) answerBatchQuestion(ctx context.Context, agent *Agent, notebookID, question string, settings *ChatSettings) BatchChatResult {
+	result := BatchChatResult{Sources: []string{}}
+	docs, err := agent.Retrieve(ctx, notebookID, question, settings)
+	if err != nil {
+		result.Error = fmt.Sprintf("failed to search documents: %v", err)
+		return result
+	}
+	response, err := agent.ChatWithDocs(ctx, docs, question, s.chatGlossary(ctx, notebookID, question, nil), settings.AnswerStyle, nil, nil, nil)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	result.Answer = response.Message
+	result.Citations = response.Citations
+	for _, source := range response.Sources {
+		result.Sources = append(result.Sources, source.Name)
+	}
+	return result
+}
+
+// writeBatchChatCSV writes the answers of a batch as a CSV download, one row per question
+func writeBatchChatCSV(c *gin.Context, results []BatchChatResult) {
+	c.Header("Content-Type", "text/csv; charset=utf-8")
+	c.Header("Content-Disposition", `attachment; filename="answers.csv"`)
+	c.Status(http.StatusOK)
+
+	// A byte order mark lets spreadsheet apps detect UTF-8
+	c.Writer.WriteString("\ufeff")
+	w := csv.NewWriter(c.Writer)
+	w.Write([]string{"index", "question", "answer", "sources", "error"})
+	for _, result := range results {
+		w.Write([]string{
+			strconv.Itoa(result.Index),
+			result.Question,
+			result.Answer,
+			strings.Join(result.Sources, "; "),
+			result.Error,
+		})
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		golog.Errorf("failed to write batch chat csv: %v", err)
+	}
+}
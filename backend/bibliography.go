@@ -0,0 +1,823 @@
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kataras/golog"
+)
+
+// maxBibliographySize limits an uploaded BibTeX or CSL JSON export
+const maxBibliographySize = 20 << 20
+
+// Citation styles of the "references" transformation
+const (
+	CitationStyleAPA = "apa"
+	CitationStyleMLA = "mla"
+)
+
+// parseBibliography parses a Zotero CSL JSON export or a BibTeX file
+func parseBibliography(data string) ([]Reference, error) {
+	data = strings.TrimSpace(strings.TrimPrefix(data, "\ufeff"))
+	if strings.HasPrefix(data, "[") || strings.HasPrefix(data, "{") {
+		return parseCSLJSON(data)
+	}
+	refs := parseBibTeX(data)
+	if len(refs) == 0 {
+		return nil, fmt.Errorf("no BibTeX entries found")
+	}
+	return refs, nil
+}
+
+// bibScanner walks a BibTeX document
+type bibScanner struct {
+	data   string
+	pos    int
+	macros map[string]string
+}
+
+func (b *bibScanner) skipSpace() {
+	for b.pos < len(b.data) && unicode.IsSpace(rune(b.data[b.pos])) {
+		b.pos++
+	}
+}
+
+// until reads up to (not including) the first of the given characters
+func (b *bibScanner) until(chars string) string {
+	start := b.pos
+	for b.pos < len(b.data) && !strings.ContainsRune(chars, rune(b.data[b.pos])) {
+		b.pos++
+	}
+	return strings.TrimSpace(b.data[start:b.pos])
+}
+
+// balanced reads a {...} or (...) group starting at the current position and returns its inside
+func (b *bibScanner) balanced(open, close byte) string {
+	depth := 0
+	start := b.pos + 1
+	for ; b.pos < len(b.data); b.pos++ {
+		switch b.data[b.pos] {
+		case open:
+			depth++
+		case close:
+			depth--
+			if depth == 0 {
+				b.pos++
+				return b.data[start : b.pos-1]
+			}
+		}
+	}
+	return b.data[start:]
+}
+
+// value reads a field value: braced, quoted, a number or a macro, joined with #
+func (b *bibScanner) value() string {
+	var parts []string
+	for {
+		b.skipSpace()
+		if b.pos >= len(b.data) {
+			break
+		}
+		switch b.data[b.pos] {
+		case '{':
+			parts = append(parts, b.balanced('{', '}'))
+		case '"':
+			start := b.pos + 1
+			depth := 0
+			for b.pos++; b.pos < len(b.data); b.pos++ {
+				c := b.data[b.pos]
+				if c == '{' {
+					depth++
+				} else if c == '}' {
+					depth--
+				} else if c == '"' && depth == 0 && b.data[b.pos-1] != '\\' {
+					break
+				}
+			}
+			parts = append(parts, b.data[start:min(b.pos, len(b.data))])
+			b.pos++
+		default:
+			token := b.until(",}#) \t\r\n")
+			if macro, ok := b.macros[strings.ToLower(token)]; ok {
+				token = macro
+			}
+			parts = append(parts, token)
+		}
+		b.skipSpace()
+		if b.pos < len(b.data) && b.data[b.pos] == '#' {
+			b.pos++
+			continue
+		}
+		break
+	}
+	return strings.Join(parts, "")
+}
+
+// fields reads `name = value` pairs until the closing delimiter of the entry
+func (b *bibScanner) fields(close byte) map[string]string {
+	fields := make(map[string]string)
+	for {
+		b.skipSpace()
+		if b.pos >= len(b.data) {
+			return fields
+		}
+		if b.data[b.pos] == close {
+			b.pos++
+			return fields
+		}
+		if b.data[b.pos] == ',' {
+			b.pos++
+			continue
+		}
+		name := strings.ToLower(b.until("=,}" + string(close)))
+		if b.pos >= len(b.data) || b.data[b.pos] != '=' {
+			continue
+		}
+		b.pos++
+		fields[name] = b.value()
+	}
+}
+
+// parseBibTeX parses the entries of a BibTeX file; @string macros are expanded and
+// @comment / @preamble blocks are skipped
+func parseBibTeX(data string) []Reference {
+	b := &bibScanner{data: data, macros: map[string]string{
+		"jan": "January", "feb": "February", "mar": "March", "apr": "April", "may": "May", "jun": "June",
+		"jul": "July", "aug": "August", "sep": "September", "oct": "October", "nov": "November", "dec": "December",
+	}}
+
+	var refs []Reference
+	for {
+		at := strings.IndexByte(b.data[b.pos:], '@')
+		if at < 0 {
+			return refs
+		}
+		b.pos += at + 1
+		entryType := strings.ToLower(b.until("{("))
+		if b.pos >= len(b.data) {
+			return refs
+		}
+		open, close := b.data[b.pos], byte('}')
+		if open == '(' {
+			close = ')'
+		}
+
+		switch entryType {
+		case "comment", "preamble":
+			b.balanced(open, close)
+			continue
+		case "string":
+			b.pos++
+			for name, value := range b.fields(close) {
+				b.macros[name] = value
+			}
+			continue
+		}
+
+		b.pos++
+		key := b.until(",}" + string(close))
+		fields := b.fields(close)
+		if ref := bibTeXReference(entryType, key, fields); ref.Title != "" {
+			refs = append(refs, ref)
+		}
+	}
+}
+
+// bibTeXReference maps the fields of a BibTeX entry to a Reference
+func bibTeXReference(entryType, key string, fields map[string]string) Reference {
+	ref := Reference{
+		Key:       key,
+		EntryType: entryType,
+		Title:     cleanTeX(fields["title"]),
+		Volume:    cleanTeX(fields["volume"]),
+		Issue:     cleanTeX(fields["number"]),
+		Pages:     strings.ReplaceAll(cleanTeX(fields["pages"]), "-", "–"),
+		Publisher: cleanTeX(firstNonEmpty(fields["publisher"], fields["school"], fields["institution"], fields["organization"])),
+		DOI:       normalizeDOI(fields["doi"]),
+		URL:       strings.TrimSpace(fields["url"]),
+		Abstract:  cleanTeX(fields["abstract"]),
+		Keywords:  cleanTeX(fields["keywords"]),
+		Venue:     cleanTeX(firstNonEmpty(fields["journal"], fields["journaltitle"], fields["booktitle"], fields["howpublished"])),
+	}
+	ref.Pages = strings.ReplaceAll(ref.Pages, "––", "–")
+
+	ref.Year = cleanTeX(fields["year"])
+	if ref.Year == "" && len(fields["date"]) >= 4 {
+		ref.Year = fields["date"][:4]
+	}
+
+	names := fields["author"]
+	if names == "" {
+		names = fields["editor"]
+	}
+	ref.Authors = parseBibTeXNames(names)
+	return ref
+}
+
+// bibNameSeparator splits author lists on " and " outside of braces
+var bibNameSeparator = regexp.MustCompile(`(?i)\s+and\s+`)
+
+// parseBibTeXNames converts "Last, First and First Last and {Org Name}" into "Family, Given" names
+func parseBibTeXNames(value string) []string {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return nil
+	}
+
+	// Split on top-level " and " only, so "{Barnes and Noble}" stays one name
+	var names []string
+	depth, start := 0, 0
+	for i := 0; i < len(value); i++ {
+		switch value[i] {
+		case '{':
+			depth++
+		case '}':
+			depth--
+		default:
+			if depth == 0 {
+				if loc := bibNameSeparator.FindStringIndex(value[i:]); loc != nil && loc[0] == 0 && i > start {
+					names = append(names, value[start:i])
+					i += loc[1] - 1
+					start = i + 1
+				}
+			}
+		}
+	}
+	names = append(names, value[start:])
+
+	authors := make([]string, 0, len(names))
+	for _, name := range names {
+		name = strings.TrimSpace(name)
+		switch {
+		case name == "":
+		case strings.HasPrefix(name, "{") && strings.HasSuffix(name, "}"):
+			authors = append(authors, cleanTeX(name)) // Literal, e.g. an organization
+		case strings.EqualFold(name, "others"):
+			authors = append(authors, "others")
+		case strings.Contains(name, ","):
+			family, given, _ := strings.Cut(name, ",")
+			authors = append(authors, cleanTeX(family)+", "+cleanTeX(given))
+		default:
+			words := strings.Fields(name)
+			if len(words) == 1 {
+				authors = append(authors, cleanTeX(name))
+				continue
+			}
+			// Lowercase particles ("van", "de") belong to the family name
+			split := len(words) - 1
+			for split > 0 && words[split-1] != "" && unicode.IsLower(rune(words[split-1][0])) {
+				split--
+			}
+			if split == 0 {
+				authors = append(authors, cleanTeX(name))
+				continue
+			}
+			authors = append(authors, cleanTeX(strings.Join(words[split:], " "))+", "+cleanTeX(strings.Join(words[:split], " ")))
+		}
+	}
+	return authors
+}
+
+// texAccents maps an accent command and a letter to the accented letter
+var texAccents = map[string]string{
+	`"a`: "ä", `"e`: "ë", `"i`: "ï", `"o`: "ö", `"u`: "ü", `"y`: "ÿ", `"A`: "Ä", `"E`: "Ë", `"I`: "Ï", `"O`: "Ö", `"U`: "Ü",
+	`'a`: "á", `'e`: "é", `'i`: "í", `'o`: "ó", `'u`: "ú", `'y`: "ý", `'c`: "ć", `'n`: "ń", `'s`: "ś", `'z`: "ź",
+	`'A`: "Á", `'E`: "É", `'I`: "Í", `'O`: "Ó", `'U`: "Ú", `'C`: "Ć", `'S`: "Ś",
+	"`a": "à", "`e": "è", "`i": "ì", "`o": "ò", "`u": "ù", "`A": "À", "`E": "È",
+	`^a`: "â", `^e`: "ê", `^i`: "î", `^o`: "ô", `^u`: "û", `^A`: "Â", `^E`: "Ê",
+	`~n`: "ñ", `~a`: "ã", `~o`: "õ", `~N`: "Ñ",
+	`cc`: "ç", `cC`: "Ç", `vc`: "č", `vs`: "š", `vz`: "ž", `vr`: "ř", `ve`: "ě", `vC`: "Č", `vS`: "Š", `vZ`: "Ž",
+	`ua`: "ă", `Ho`: "ő", `Hu`: "ű", `ka`: "ą", `ke`: "ę", `=a`: "ā", `=e`: "ē", `.z`: "ż",
+}
+
+var (
+	texAccent  = regexp.MustCompile(`\\([."'` + "`" + `^~=cvuHk])\s*\{?\\?([A-Za-z])\}?`)
+	texSymbols = strings.NewReplacer(`\ss`, "ß", `\o`, "ø", `\O`, "Ø", `\aa`, "å", `\AA`, "Å", `\ae`, "æ", `\AE`, "Æ",
+		`\l`, "ł", `\L`, "Ł", `\i`, "i", `\&`, "&", `\%`, "%", `\_`, "_", `\$`, "$", `\#`, "#",
+		"---", "—", "--", "–", "~", " ", "``", "“", "''", "”")
+	texCommand = regexp.MustCompile(`\\[A-Za-z]+\s*`)
+)
+
+// cleanTeX turns a BibTeX value into plain text
+func cleanTeX(value string) string {
+	value = texAccent.ReplaceAllStringFunc(value, func(match string) string {
+		m := texAccent.FindStringSubmatch(match)
+		if letter, ok := texAccents[m[1]+m[2]]; ok {
+			return letter
+		}
+		return m[2]
+	})
+	value = texSymbols.Replace(value)
+	value = texCommand.ReplaceAllString(value, "") // \emph, \textit, ... keep their argument
+	value = strings.NewReplacer("{", "", "}", "").Replace(value)
+	return strings.Join(strings.Fields(value), " ")
+}
+
+// cslItem is the subset of a CSL JSON item (Zotero's "CSL JSON" export) the import uses
+type cslItem struct {
+	ID             any    `json:"id"`
+	Type           string `json:"type"`
+	Title          string `json:"title"`
+	ContainerTitle string `json:"container-title"`
+	Volume         any    `json:"volume"`
+	Issue          any    `json:"issue"`
+	Page           string `json:"page"`
+	Publisher      string `json:"publisher"`
+	DOI            string `json:"DOI"`
+	URL            string `json:"URL"`
+	Abstract       string `json:"abstract"`
+	Keyword        string `json:"keyword"`
+	Author         []struct {
+		Family  string `json:"family"`
+		Given   string `json:"given"`
+		Literal string `json:"literal"`
+	} `json:"author"`
+	Issued struct {
+		DateParts [][]any `json:"date-parts"`
+		Raw       string  `json:"raw"`
+	} `json:"issued"`
+}
+
+// cslEntryTypes maps CSL item types to BibTeX entry types
+var cslEntryTypes = map[string]string{
+	"article-journal":  "article",
+	"article-magazine": "article",
+	"article":          "article",
+	"book":             "book",
+	"chapter":          "incollection",
+	"paper-conference": "inproceedings",
+	"thesis":           "phdthesis",
+	"report":           "techreport",
+}
+
+// parseCSLJSON parses a CSL JSON array (or single item)
+func parseCSLJSON(data string) ([]Reference, error) {
+	var items []cslItem
+	if strings.HasPrefix(data, "{") {
+		var item cslItem
+		if err := json.Unmarshal([]byte(data), &item); err != nil {
+			return nil, fmt.Errorf("invalid CSL JSON: %w", err)
+		}
+		items = append(items, item)
+	} else if err := json.Unmarshal([]byte(data), &items); err != nil {
+		return nil, fmt.Errorf("invalid CSL JSON: %w", err)
+	}
+
+	refs := make([]Reference, 0, len(items))
+	for _, item := range items {
+		if strings.TrimSpace(item.Title) == "" {
+			continue
+		}
+		ref := Reference{
+			Key:       cslString(item.ID),
+			EntryType: cslEntryTypes[item.Type],
+			Title:     strings.TrimSpace(item.Title),
+			Venue:     item.ContainerTitle,
+			Volume:    cslString(item.Volume),
+			Issue:     cslString(item.Issue),
+			Pages:     strings.ReplaceAll(item.Page, "-", "–"),
+			Publisher: item.Publisher,
+			DOI:       normalizeDOI(item.DOI),
+			URL:       item.URL,
+			Abstract:  item.Abstract,
+			Keywords:  item.Keyword,
+		}
+		if ref.EntryType == "" {
+			ref.EntryType = "misc"
+		}
+		for _, a := range item.Author {
+			switch {
+			case a.Literal != "":
+				ref.Authors = append(ref.Authors, a.Literal)
+			case a.Given != "":
+				ref.Authors = append(ref.Authors, a.Family+", "+a.Given)
+			default:
+				ref.Authors = append(ref.Authors, a.Family)
+			}
+		}
+		if len(item.Issued.DateParts) > 0 && len(item.Issued.DateParts[0]) > 0 {
+			ref.Year = cslString(item.Issued.DateParts[0][0])
+		} else if len(item.Issued.Raw) >= 4 {
+			ref.Year = item.Issued.Raw[:4]
+		}
+		refs = append(refs, ref)
+	}
+	return refs, nil
+}
+
+// cslString formats a CSL value that may be a string or a number
+func cslString(v any) string {
+	switch v := v.(type) {
+	case string:
+		return v
+	case float64:
+		return fmt.Sprintf("%g", v)
+	}
+	return ""
+}
+
+// normalizeDOI strips resolver prefixes from a DOI
+func normalizeDOI(doi string) string {
+	doi = strings.TrimSpace(doi)
+	for _, prefix := range []string{"https://doi.org/", "http://doi.org/", "https://dx.doi.org/", "http://dx.doi.org/", "doi:"} {
+		if len(doi) >= len(prefix) && strings.EqualFold(doi[:len(prefix)], prefix) {
+			return doi[len(prefix):]
+		}
+	}
+	return doi
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if strings.TrimSpace(v) != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// link returns the DOI link of a reference, or its URL
+func (r *Reference) link() string {
+	if r.DOI != "" {
+		return "https://doi.org/" + r.DOI
+	}
+	return r.URL
+}
+
+// referenceSourceContent renders a reference as the text of its source, so it can be searched and cited
+func referenceSourceContent(r *Reference) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# %s\n\n", r.Title)
+	if len(r.Authors) > 0 {
+		fmt.Fprintf(&b, "作者：%s\n", strings.Join(r.Authors, "; "))
+	}
+	if r.Year != "" {
+		fmt.Fprintf(&b, "年份：%s\n", r.Year)
+	}
+	if r.Venue != "" {
+		fmt.Fprintf(&b, "出处：%s\n", r.Venue)
+	}
+	if r.Publisher != "" {
+		fmt.Fprintf(&b, "出版者：%s\n", r.Publisher)
+	}
+	if r.DOI != "" {
+		fmt.Fprintf(&b, "DOI：%s\n", r.DOI)
+	}
+	if r.Keywords != "" {
+		fmt.Fprintf(&b, "关键词：%s\n", r.Keywords)
+	}
+	if r.Abstract != "" {
+		fmt.Fprintf(&b, "\n## 摘要\n\n%s\n", r.Abstract)
+	}
+	return b.String()
+}
+
+// sourceReference returns the bibliographic record of a source. Sources without one are cited
+// by name and URL.
+func sourceReference(source *Source) Reference {
+	if raw, ok := source.Metadata["reference"]; ok {
+		if data, err := json.Marshal(raw); err == nil {
+			var ref Reference
+			if json.Unmarshal(data, &ref) == nil && ref.Title != "" {
+				return ref
+			}
+		}
+	}
+	return Reference{EntryType: "misc", Title: source.Name, URL: source.URL}
+}
+
+// splitName splits "Family, Given" into its parts; literal names have no given name
+func splitName(name string) (family, given string) {
+	family, given, _ = strings.Cut(name, ",")
+	return strings.TrimSpace(family), strings.TrimSpace(given)
+}
+
+// initials abbreviates given names: "Jane Ann" -> "J. A.", "Jean-Luc" -> "J.-L."
+func initials(given string) string {
+	var parts []string
+	for _, word := range strings.Fields(given) {
+		var hyphenated []string
+		for _, piece := range strings.Split(word, "-") {
+			if r := []rune(strings.TrimSuffix(piece, ".")); len(r) > 0 {
+				hyphenated = append(hyphenated, string(r[0])+".")
+			}
+		}
+		parts = append(parts, strings.Join(hyphenated, "-"))
+	}
+	return strings.Join(parts, " ")
+}
+
+// apaAuthors formats authors as "Family, G., Family, G., & Family, G."
+func apaAuthors(authors []string) string {
+	formatted := make([]string, 0, len(authors))
+	for _, a := range authors {
+		if a == "others" {
+			continue
+		}
+		family, given := splitName(a)
+		if given == "" {
+			formatted = append(formatted, family)
+		} else {
+			formatted = append(formatted, family+", "+initials(given))
+		}
+	}
+	switch n := len(formatted); {
+	case n == 0:
+		return ""
+	case n == 1:
+		return formatted[0]
+	case n == 2:
+		return formatted[0] + ", & " + formatted[1]
+	case n <= 20:
+		return strings.Join(formatted[:n-1], ", ") + ", & " + formatted[n-1]
+	default:
+		// APA 7: first 19, an ellipsis, then the last author
+		return strings.Join(formatted[:19], ", ") + ", . . . " + formatted[n-1]
+	}
+}
+
+// mlaAuthors formats authors as "Family, Given", "Family, Given, and Given Family" or "Family, Given, et al."
+func mlaAuthors(authors []string) string {
+	if len(authors) == 0 {
+		return ""
+	}
+	first := strings.TrimSuffix(authors[0], ",")
+	switch {
+	case len(authors) == 1:
+		return first
+	case len(authors) == 2 && authors[1] != "others":
+		family, given := splitName(authors[1])
+		return first + ", and " + strings.TrimSpace(given+" "+family)
+	default:
+		return first + ", et al."
+	}
+}
+
+// withPeriod ends text with a period unless it already ends with punctuation
+func withPeriod(text string) string {
+	text = strings.TrimSpace(text)
+	if text == "" || strings.ContainsAny(text[len(text)-1:], ".?!") {
+		return text
+	}
+	return text + "."
+}
+
+// formatCitation formats a reference in APA (7th ed.) or MLA (9th ed.) style, using markdown italics
+func formatCitation(r *Reference, style string) string {
+	container := r.EntryType == "book" || r.EntryType == "phdthesis" || r.EntryType == "techreport" || r.Venue == ""
+	var parts []string
+
+	if style == CitationStyleMLA {
+		if authors := mlaAuthors(r.Authors); authors != "" {
+			parts = append(parts, withPeriod(authors))
+		}
+		if container {
+			parts = append(parts, withPeriod("*"+r.Title+"*"))
+		} else {
+			parts = append(parts, "“"+withPeriod(r.Title)+"”")
+		}
+
+		var details []string
+		if !container {
+			details = append(details, "*"+r.Venue+"*")
+		}
+		if r.Volume != "" {
+			details = append(details, "vol. "+r.Volume)
+		}
+		if r.Issue != "" {
+			details = append(details, "no. "+r.Issue)
+		}
+		if r.Publisher != "" && (container || r.EntryType == "incollection") {
+			details = append(details, r.Publisher)
+		}
+		if r.Year != "" {
+			details = append(details, r.Year)
+		}
+		if r.Pages != "" {
+			details = append(details, "pp. "+r.Pages)
+		}
+		if len(details) > 0 {
+			parts = append(parts, withPeriod(strings.Join(details, ", ")))
+		}
+		if link := r.link(); link != "" {
+			parts = append(parts, withPeriod(strings.TrimPrefix(strings.TrimPrefix(link, "https://"), "http://")))
+		}
+		return strings.Join(parts, " ")
+	}
+
+	year := "(" + r.Year + ")."
+	if r.Year == "" {
+		year = "(n.d.)."
+	}
+	var title []string
+	if container {
+		title = append(title, withPeriod("*"+r.Title+"*"))
+		if r.Publisher != "" {
+			title = append(title, withPeriod(r.Publisher))
+		}
+	} else {
+		title = append(title, withPeriod(r.Title))
+		venue := "*" + r.Venue
+		if r.Volume != "" {
+			venue += ", " + r.Volume + "*"
+			if r.Issue != "" {
+				venue += "(" + r.Issue + ")"
+			}
+		} else {
+			venue += "*"
+		}
+		if r.Pages != "" {
+			venue += ", " + r.Pages
+		}
+		title = append(title, withPeriod(venue))
+	}
+
+	// Without authors the title moves to the author position
+	if authors := apaAuthors(r.Authors); authors != "" {
+		parts = append(parts, withPeriod(authors), year)
+		parts = append(parts, title...)
+	} else {
+		parts = append(parts, title[0], year)
+		parts = append(parts, title[1:]...)
+	}
+	if link := r.link(); link != "" {
+		parts = append(parts, link)
+	}
+	return strings.Join(parts, " ")
+}
+
+// sourceCitationList formats the citations of sources sorted the way the style orders a reference list
+func sourceCitationList(sources []Source, style string) []string {
+	citations := make([]string, 0, len(sources))
+	for i := range sources {
+		ref := sourceReference(&sources[i])
+		citations = append(citations, formatCitation(&ref, style))
+	}
+	// Both APA and MLA order entries alphabetically, ignoring formatting marks
+	sortKey := func(s string) string { return strings.ToLower(strings.TrimLeft(s, "*“\"")) }
+	sort.SliceStable(citations, func(i, j int) bool { return sortKey(citations[i]) < sortKey(citations[j]) })
+	return citations
+}
+
+// citationStyle normalizes a requested style, defaulting to APA
+func citationStyle(style string) string {
+	if strings.EqualFold(style, CitationStyleMLA) {
+		return CitationStyleMLA
+	}
+	return CitationStyleAPA
+}
+
+// referencesTransformation builds the "references" note content without the LLM
+func referencesTransformation(req *TransformationRequest, sources []Source) *TransformationResponse {
+	style := citationStyle(req.CitationStyle)
+	heading := "参考文献"
+	if style == CitationStyleMLA {
+		heading = "引用文献"
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "# %s（%s）\n\n", heading, strings.ToUpper(style))
+	for _, citation := range sourceCitationList(sources, style) {
+		fmt.Fprintf(&b, "- %s\n", citation)
+	}
+	return &TransformationResponse{
+		Type:     req.Type,
+		Content:  b.String(),
+		Metadata: map[string]interface{}{"citation_style": style},
+	}
+}
+
+// handleImportBibliography imports a BibTeX or Zotero CSL JSON export, creating one source per entry
+func (s *Server) handleImportBibliography(c *gin.Context) {
+	ctx := context.Background()
+	notebookID := c.Param("id")
+	userID := c.GetString("user_id")
+	if err := s.checkNotebookAccess(ctx, notebookID, userID); err != nil {
+		c.JSON(http.StatusForbidden, ErrorResponse{Error: "Access denied"})
+		return
+	}
+
+	// Accept a multipart upload or the raw export as the request body
+	var reader io.Reader = c.Request.Body
+	if strings.HasPrefix(c.ContentType(), "multipart/") {
+		file, err := c.FormFile("file")
+		if err != nil {
+			c.JSON(http.StatusBadRequest, ErrorResponse{Error: "No file provided"})
+			return
+		}
+		f, err := file.Open()
+		if err != nil {
+			c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Failed to read file"})
+			return
+		}
+		defer f.Close()
+		reader = f
+	}
+	data, err := io.ReadAll(io.LimitReader(reader, maxBibliographySize))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Failed to read bibliography"})
+		return
+	}
+
+	refs, err := parseBibliography(string(data))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid bibliography", Details: err.Error()})
+		return
+	}
+
+	// Skip entries already imported into the notebook
+	existing, err := s.store.ListSources(ctx, notebookID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to list sources"})
+		return
+	}
+	seen := make(map[string]bool)
+	for i := range existing {
+		if existing[i].Type == "reference" {
+			ref := sourceReference(&existing[i])
+			seen["doi:"+strings.ToLower(ref.DOI)] = ref.DOI != ""
+			seen["key:"+ref.Key] = ref.Key != ""
+		}
+	}
+
+	response := BibliographyImportResponse{Sources: make([]Source, 0, len(refs))}
+	for i := range refs {
+		ref := &refs[i]
+		if seen["doi:"+strings.ToLower(ref.DOI)] || seen["key:"+ref.Key] {
+			response.Skipped++
+			continue
+		}
+
+		source := &Source{
+			NotebookID: notebookID,
+			Name:       ref.Title,
+			Type:       "reference",
+			URL:        ref.link(),
+			Content:    referenceSourceContent(ref),
+			Metadata:   map[string]interface{}{"reference": ref},
+		}
+		activityLog := &ActivityLog{
+			UserID:    userID,
+			Action:    "import_reference",
+			IPAddress: c.ClientIP(),
+			UserAgent: c.GetHeader("User-Agent"),
+		}
+		if err := s.captureSource(ctx, source, activityLog); err != nil {
+			golog.Errorf("failed to import reference %q: %v", ref.Title, err)
+			c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to create source", Details: fmt.Sprintf("%d entries imported before the error", response.Imported)})
+			return
+		}
+		seen["doi:"+strings.ToLower(ref.DOI)] = ref.DOI != ""
+		seen["key:"+ref.Key] = ref.Key != ""
+		response.Imported++
+		response.Sources = append(response.Sources, *source)
+	}
+
+	c.JSON(http.StatusCreated, response)
+}
+
+// handleGetNoteReferences formats the citations of the sources a note was generated from
+func (s *Server) handleGetNoteReferences(c *gin.Context) {
+	ctx := context.Background()
+	notebookID := c.Param("id")
+	if err := s.checkNotebookAccess(ctx, notebookID, c.GetString("user_id")); err != nil {
+		c.JSON(http.StatusForbidden, ErrorResponse{Error: "Access denied"})
+		return
+	}
+
+	note, err := s.store.GetNote(ctx, c.Param("noteId"))
+	if err != nil || note.NotebookID != notebookID {
+		c.JSON(http.StatusNotFound, ErrorResponse{Error: "Note not found"})
+		return
+	}
+
+	sources, err := s.store.ListSources(ctx, notebookID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to get sources"})
+		return
+	}
+	used := make(map[string]bool, len(note.SourceIDs))
+	for _, id := range note.SourceIDs {
+		used[id] = true
+	}
+	noteSources := make([]Source, 0, len(note.SourceIDs))
+	for _, src := range sources {
+		if used[src.ID] {
+			noteSources = append(noteSources, src)
+		}
+	}
+
+	style := citationStyle(c.Query("style"))
+	c.JSON(http.StatusOK, NoteReferencesResponse{
+		Style:      style,
+		References: sourceCitationList(noteSources, style),
+	})
+}
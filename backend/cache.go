@@ -256,6 +256,38 @@ func (cs *CachedStore) UpdateNotebook(ctx context.Context, id string, name, desc
 	return notebook, nil
 }
 
+// SetNotebookCover stores a notebook cover image and invalidates cache
+func (cs *CachedStore) SetNotebookCover(ctx context.Context, id, ext string, data []byte) (*Notebook, error) {
+	notebook, err := cs.Store.SetNotebookCover(ctx, id, ext, data)
+	if err != nil {
+		return nil, err
+	}
+
+	cs.cache.Delete(notebookKey(id))
+	if notebook.UserID != "" {
+		cs.cache.Delete(notebookListKey(notebook.UserID))
+		cs.cache.Delete(notebookListKey(notebook.UserID) + ":stats")
+	}
+
+	return notebook, nil
+}
+
+// DeleteNotebookCover removes a notebook cover image and invalidates cache
+func (cs *CachedStore) DeleteNotebookCover(ctx context.Context, id string) (*Notebook, error) {
+	notebook, err := cs.Store.DeleteNotebookCover(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	cs.cache.Delete(notebookKey(id))
+	if notebook.UserID != "" {
+		cs.cache.Delete(notebookListKey(notebook.UserID))
+		cs.cache.Delete(notebookListKey(notebook.UserID) + ":stats")
+	}
+
+	return notebook, nil
+}
+
 // CreateNotebook creates a notebook and invalidates cache
 func (cs *CachedStore) CreateNotebook(ctx context.Context, userID, name, description string, metadata map[string]interface{}) (*Notebook, error) {
 	notebook, err := cs.Store.CreateNotebook(ctx, userID, name, description, metadata)
@@ -315,6 +347,31 @@ func (cs *CachedStore) ListNotes(ctx context.Context, notebookID string) ([]Note
 	return notes, nil
 }
 
+// SetNoteShare updates a note's sharing link and invalidates cache
+func (cs *CachedStore) SetNoteShare(ctx context.Context, id string, enabled bool, expiresAt *time.Time) (*Note, error) {
+	note, err := cs.Store.SetNoteShare(ctx, id, enabled, expiresAt)
+	if err != nil {
+		return nil, err
+	}
+
+	// Invalidate notes list cache for this notebook
+	cs.cache.Delete(notesListKey(note.NotebookID))
+
+	return note, nil
+}
+
+// SetNotePrivate updates whether a note is private and invalidates cache
+func (cs *CachedStore) SetNotePrivate(ctx context.Context, id string, private bool) (*Note, error) {
+	note, err := cs.Store.SetNotePrivate(ctx, id, private)
+	if err != nil {
+		return nil, err
+	}
+
+	cs.cache.Delete(notesListKey(note.NotebookID))
+
+	return note, nil
+}
+
 // CreateNote creates a note and invalidates cache
 func (cs *CachedStore) CreateNote(ctx context.Context, note *Note) error {
 	err := cs.Store.CreateNote(ctx, note)
@@ -347,6 +404,29 @@ func (cs *CachedStore) DeleteNote(ctx context.Context, id string) error {
 	return nil
 }
 
+// RestoreNote restores a deleted note and invalidates cache
+func (cs *CachedStore) RestoreNote(ctx context.Context, note *Note, versions []NoteVersion) error {
+	if err := cs.Store.RestoreNote(ctx, note, versions); err != nil {
+		return err
+	}
+
+	cs.cache.Delete(notesListKey(note.NotebookID))
+
+	return nil
+}
+
+// ReviseNote replaces a note's title, content and metadata and invalidates cache
+func (cs *CachedStore) ReviseNote(ctx context.Context, note *Note, title, content string, metadata map[string]interface{}) (*NoteVersion, error) {
+	version, err := cs.Store.ReviseNote(ctx, note, title, content, metadata)
+	if err != nil {
+		return nil, err
+	}
+
+	cs.cache.Delete(notesListKey(note.NotebookID))
+
+	return version, nil
+}
+
 // ListSources retrieves all sources for a notebook with caching
 func (cs *CachedStore) ListSources(ctx context.Context, notebookID string) ([]Source, error) {
 	key := sourcesListKey(notebookID)
@@ -398,6 +478,63 @@ func (cs *CachedStore) DeleteSource(ctx context.Context, id string) error {
 	return nil
 }
 
+// RestoreSource restores a deleted source and invalidates cache
+func (cs *CachedStore) RestoreSource(ctx context.Context, source *Source, versions []SourceVersion) error {
+	if err := cs.Store.RestoreSource(ctx, source, versions); err != nil {
+		return err
+	}
+
+	cs.cache.Delete(sourcesListKey(source.NotebookID))
+
+	return nil
+}
+
+// UpdateSource updates a source and invalidates cache
+func (cs *CachedStore) UpdateSource(ctx context.Context, source *Source) error {
+	if err := cs.Store.UpdateSource(ctx, source); err != nil {
+		return err
+	}
+
+	cs.cache.Delete(sourcesListKey(source.NotebookID))
+
+	return nil
+}
+
+// UpdateSourceMetadata updates a source's metadata and invalidates cache
+func (cs *CachedStore) UpdateSourceMetadata(ctx context.Context, source *Source) error {
+	if err := cs.Store.UpdateSourceMetadata(ctx, source); err != nil {
+		return err
+	}
+
+	cs.cache.Delete(sourcesListKey(source.NotebookID))
+
+	return nil
+}
+
+// SetSourcePrivate updates whether a source is private and invalidates cache
+func (cs *CachedStore) SetSourcePrivate(ctx context.Context, id string, private bool) (*Source, error) {
+	source, err := cs.Store.SetSourcePrivate(ctx, id, private)
+	if err != nil {
+		return nil, err
+	}
+
+	cs.cache.Delete(sourcesListKey(source.NotebookID))
+
+	return source, nil
+}
+
+// ReplaceSourceContent replaces a source's content and invalidates cache
+func (cs *CachedStore) ReplaceSourceContent(ctx context.Context, source *Source, content, fileName string, fileSize int64) (*SourceVersion, error) {
+	version, err := cs.Store.ReplaceSourceContent(ctx, source, content, fileName, fileSize)
+	if err != nil {
+		return nil, err
+	}
+
+	cs.cache.Delete(sourcesListKey(source.NotebookID))
+
+	return version, nil
+}
+
 // ListChatSessions retrieves all chat sessions for a notebook with caching
 func (cs *CachedStore) ListChatSessions(ctx context.Context, notebookID string) ([]ChatSession, error) {
 	key := chatSessionsKey(notebookID)
@@ -430,6 +567,18 @@ func (cs *CachedStore) CreateChatSession(ctx context.Context, notebookID, title
 	return session, nil
 }
 
+// CreateNoteEditSession creates a note's editing chat session and invalidates cache
+func (cs *CachedStore) CreateNoteEditSession(ctx context.Context, notebookID, noteID, title string) (*ChatSession, error) {
+	session, err := cs.Store.CreateNoteEditSession(ctx, notebookID, noteID, title)
+	if err != nil {
+		return nil, err
+	}
+
+	cs.cache.Delete(chatSessionsKey(notebookID))
+
+	return session, nil
+}
+
 // DeleteChatSession deletes a chat session and invalidates cache
 func (cs *CachedStore) DeleteChatSession(ctx context.Context, id string) error {
 	// Get the session first to find its notebook ID
@@ -449,6 +598,17 @@ func (cs *CachedStore) DeleteChatSession(ctx context.Context, id string) error {
 	return nil
 }
 
+// RestoreChatSession restores a deleted chat session and invalidates cache
+func (cs *CachedStore) RestoreChatSession(ctx context.Context, session *ChatSession) error {
+	if err := cs.Store.RestoreChatSession(ctx, session); err != nil {
+		return err
+	}
+
+	cs.cache.Delete(chatSessionsKey(session.NotebookID))
+
+	return nil
+}
+
 // GetCacheStats returns the cache statistics
 func (cs *CachedStore) GetCacheStats() CacheStats {
 	return cs.cache.GetStats()
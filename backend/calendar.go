@@ -0,0 +1,673 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kataras/golog"
+)
+
+// Meetings starting within this window around the sync time are imported
+const (
+	calendarLookback  = 7 * 24 * time.Hour
+	calendarLookahead = 24 * time.Hour
+)
+
+// calendarTranscriptWindow is how long after a meeting an upload is taken as its transcript
+const calendarTranscriptWindow = 6 * time.Hour
+
+// calendarMaxFeedSize limits the size of a downloaded ICS feed
+const calendarMaxFeedSize = 10 << 20
+
+// calendarMaxOccurrences bounds the expansion of a recurring event
+const calendarMaxOccurrences = 1000
+
+// meeting is one occurrence of a VEVENT
+type meeting struct {
+	UID         string
+	Title       string
+	Start       time.Time
+	End         time.Time
+	Location    string
+	Organizer   string
+	Attendees   []string
+	Description string
+}
+
+// key identifies an occurrence across syncs
+func (m meeting) key() string {
+	return m.UID + "@" + strconv.FormatInt(m.Start.Unix(), 10)
+}
+
+// icsProperty is a content line like `DTSTART;TZID=Europe/Berlin:20240101T100000`
+type icsProperty struct {
+	Name   string
+	Params map[string]string
+	Value  string
+}
+
+// icsEvent is a VEVENT with its properties by name
+type icsEvent map[string][]icsProperty
+
+func (e icsEvent) get(name string) *icsProperty {
+	if props := e[name]; len(props) > 0 {
+		return &props[0]
+	}
+	return nil
+}
+
+func (e icsEvent) text(name string) string {
+	if p := e.get(name); p != nil {
+		return icsUnescape(p.Value)
+	}
+	return ""
+}
+
+// parseICSEvents splits an iCalendar document into its VEVENTs
+func parseICSEvents(data string) []icsEvent {
+	// Unfold continuation lines (RFC 5545 3.1)
+	data = strings.ReplaceAll(data, "\r\n", "\n")
+	data = strings.ReplaceAll(data, "\n ", "")
+	data = strings.ReplaceAll(data, "\n\t", "")
+
+	var events []icsEvent
+	var current icsEvent
+	depth := 0 // Nested components such as VALARM inside the event
+	for _, line := range strings.Split(data, "\n") {
+		line = strings.TrimRight(line, "\r")
+		switch {
+		case line == "BEGIN:VEVENT":
+			current = make(icsEvent)
+			depth = 0
+		case current == nil:
+		case strings.HasPrefix(line, "BEGIN:"):
+			depth++
+		case line == "END:VEVENT":
+			events = append(events, current)
+			current = nil
+		case strings.HasPrefix(line, "END:"):
+			depth--
+		case depth == 0:
+			if prop, ok := parseICSProperty(line); ok {
+				current[prop.Name] = append(current[prop.Name], prop)
+			}
+		}
+	}
+	return events
+}
+
+// parseICSProperty parses a content line, honoring quoted parameter values
+func parseICSProperty(line string) (icsProperty, bool) {
+	prop := icsProperty{Params: make(map[string]string)}
+	inQuotes := false
+	start := 0
+	var nameDone bool
+	var paramKey string
+	for i, r := range line {
+		switch {
+		case r == '"':
+			inQuotes = !inQuotes
+		case inQuotes:
+		case r == ';' || r == ':':
+			part := line[start:i]
+			if !nameDone {
+				prop.Name = strings.ToUpper(part)
+				nameDone = true
+			} else if paramKey != "" {
+				prop.Params[paramKey] = strings.Trim(part, `"`)
+			}
+			paramKey = ""
+			start = i + 1
+			if r == ':' {
+				prop.Value = line[i+1:]
+				return prop, prop.Name != ""
+			}
+		case r == '=' && nameDone && paramKey == "":
+			paramKey = strings.ToUpper(line[start:i])
+			start = i + 1
+		}
+	}
+	return prop, false
+}
+
+// icsUnescape decodes TEXT values
+func icsUnescape(value string) string {
+	return strings.NewReplacer(`\n`, "\n", `\N`, "\n", `\,`, ",", `\;`, ";", `\\`, `\`).Replace(value)
+}
+
+// parseICSTime parses a DATE-TIME or DATE value. allDay reports a DATE value.
+func parseICSTime(prop *icsProperty) (t time.Time, allDay bool, err error) {
+	value := prop.Value
+	if prop.Params["VALUE"] == "DATE" || len(value) == 8 {
+		t, err = time.ParseInLocation("20060102", value, time.Local)
+		return t, true, err
+	}
+	if strings.HasSuffix(value, "Z") {
+		t, err = time.Parse("20060102T150405Z", value)
+		return t, false, err
+	}
+	loc := time.Local
+	if tzid := prop.Params["TZID"]; tzid != "" {
+		if l, err := time.LoadLocation(tzid); err == nil {
+			loc = l
+		}
+	}
+	t, err = time.ParseInLocation("20060102T150405", value, loc)
+	return t, false, err
+}
+
+// icsPerson formats an ATTENDEE or ORGANIZER as "Name <email>"
+func icsPerson(prop icsProperty) string {
+	email := prop.Value
+	if len(email) > 7 && strings.EqualFold(email[:7], "mailto:") {
+		email = email[7:]
+	}
+	if name := prop.Params["CN"]; name != "" && name != email {
+		return fmt.Sprintf("%s <%s>", name, email)
+	}
+	return email
+}
+
+// parseMeetings returns the timed meetings of an ICS feed starting between from and to.
+// Recurring events are expanded for daily and weekly rules; all-day events are skipped.
+func parseMeetings(data string, from, to time.Time) []meeting {
+	events := parseICSEvents(data)
+
+	// Moved or cancelled occurrences of recurring events
+	overridden := make(map[string]bool)
+	for _, ev := range events {
+		if p := ev.get("RECURRENCE-ID"); p != nil {
+			if t, _, err := parseICSTime(p); err == nil {
+				overridden[ev.text("UID")+"@"+strconv.FormatInt(t.Unix(), 10)] = true
+			}
+		}
+		for _, p := range ev["EXDATE"] {
+			for _, value := range strings.Split(p.Value, ",") {
+				ex := icsProperty{Params: p.Params, Value: value}
+				if t, _, err := parseICSTime(&ex); err == nil {
+					overridden[ev.text("UID")+"@"+strconv.FormatInt(t.Unix(), 10)] = true
+				}
+			}
+		}
+	}
+
+	var meetings []meeting
+	for _, ev := range events {
+		if strings.EqualFold(ev.text("STATUS"), "CANCELLED") || ev.get("DTSTART") == nil {
+			continue
+		}
+		start, allDay, err := parseICSTime(ev.get("DTSTART"))
+		if err != nil || allDay {
+			continue
+		}
+		duration := time.Hour
+		if p := ev.get("DTEND"); p != nil {
+			if end, _, err := parseICSTime(p); err == nil && end.After(start) {
+				duration = end.Sub(start)
+			}
+		} else if p := ev.get("DURATION"); p != nil {
+			if d, err := parseICSDuration(p.Value); err == nil {
+				duration = d
+			}
+		}
+
+		base := meeting{
+			UID:         ev.text("UID"),
+			Title:       ev.text("SUMMARY"),
+			Location:    ev.text("LOCATION"),
+			Description: strings.TrimSpace(ev.text("DESCRIPTION")),
+		}
+		if base.Title == "" {
+			base.Title = "会议"
+		}
+		if p := ev.get("ORGANIZER"); p != nil {
+			base.Organizer = icsPerson(*p)
+		}
+		for _, p := range ev["ATTENDEE"] {
+			base.Attendees = append(base.Attendees, icsPerson(p))
+		}
+
+		starts := []time.Time{start}
+		if p := ev.get("RRULE"); p != nil && ev.get("RECURRENCE-ID") == nil {
+			starts = expandRRule(start, p.Value, to)
+		}
+		for _, s := range starts {
+			m := base
+			m.Start, m.End = s, s.Add(duration)
+			if ev.get("RECURRENCE-ID") == nil && overridden[m.key()] {
+				continue
+			}
+			if !m.Start.Before(from) && m.Start.Before(to) {
+				meetings = append(meetings, m)
+			}
+		}
+	}
+
+	sort.Slice(meetings, func(i, j int) bool { return meetings[i].Start.Before(meetings[j].Start) })
+	return meetings
+}
+
+// expandRRule lists the occurrences of a DAILY or WEEKLY rule up to the given time.
+// Other frequencies only yield the first occurrence.
+func expandRRule(start time.Time, rule string, until time.Time) []time.Time {
+	parts := make(map[string]string)
+	for _, part := range strings.Split(rule, ";") {
+		if k, v, ok := strings.Cut(part, "="); ok {
+			parts[strings.ToUpper(k)] = v
+		}
+	}
+
+	interval, _ := strconv.Atoi(parts["INTERVAL"])
+	if interval < 1 {
+		interval = 1
+	}
+	count, _ := strconv.Atoi(parts["COUNT"])
+	if count < 1 || count > calendarMaxOccurrences {
+		count = calendarMaxOccurrences
+	}
+	if v := parts["UNTIL"]; v != "" {
+		if t, _, err := parseICSTime(&icsProperty{Value: v}); err == nil && t.Before(until) {
+			until = t.Add(time.Second)
+		}
+	}
+
+	weekdays := map[string]time.Weekday{"SU": time.Sunday, "MO": time.Monday, "TU": time.Tuesday, "WE": time.Wednesday, "TH": time.Thursday, "FR": time.Friday, "SA": time.Saturday}
+	var byDay []time.Weekday
+	for _, d := range strings.Split(parts["BYDAY"], ",") {
+		if wd, ok := weekdays[strings.ToUpper(d)]; ok {
+			byDay = append(byDay, wd)
+		}
+	}
+
+	var occurrences []time.Time
+	switch parts["FREQ"] {
+	case "DAILY":
+		for t := start; t.Before(until) && len(occurrences) < count; t = t.AddDate(0, 0, interval) {
+			occurrences = append(occurrences, t)
+		}
+	case "WEEKLY":
+		if len(byDay) == 0 {
+			byDay = []time.Weekday{start.Weekday()}
+		}
+		weekStart := start.AddDate(0, 0, -int(start.Weekday()))
+		for week := weekStart; week.Before(until) && len(occurrences) < count; week = week.AddDate(0, 0, 7*interval) {
+			for day := 0; day < 7 && len(occurrences) < count; day++ {
+				t := week.AddDate(0, 0, day)
+				if t.Before(start) || !t.Before(until) {
+					continue
+				}
+				for _, wd := range byDay {
+					if t.Weekday() == wd {
+						occurrences = append(occurrences, t)
+					}
+				}
+			}
+		}
+	default:
+		occurrences = append(occurrences, start)
+	}
+	return occurrences
+}
+
+// parseICSDuration parses durations like PT1H30M or P1D
+func parseICSDuration(value string) (time.Duration, error) {
+	value = strings.TrimPrefix(strings.ToUpper(value), "+")
+	if !strings.HasPrefix(value, "P") {
+		return 0, fmt.Errorf("invalid duration %q", value)
+	}
+	var d time.Duration
+	var num strings.Builder
+	units := map[rune]time.Duration{'W': 7 * 24 * time.Hour, 'D': 24 * time.Hour, 'H': time.Hour, 'M': time.Minute, 'S': time.Second}
+	for _, r := range value[1:] {
+		switch {
+		case r == 'T':
+		case r >= '0' && r <= '9':
+			num.WriteRune(r)
+		default:
+			n, err := strconv.Atoi(num.String())
+			if err != nil || units[r] == 0 {
+				return 0, fmt.Errorf("invalid duration %q", value)
+			}
+			d += time.Duration(n) * units[r]
+			num.Reset()
+		}
+	}
+	return d, nil
+}
+
+// meetingSourceContent renders a meeting as the text of its source
+func meetingSourceContent(m meeting) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# %s\n\n", m.Title)
+	fmt.Fprintf(&b, "时间：%s – %s\n", m.Start.Local().Format("2006-01-02 15:04"), m.End.Local().Format("15:04"))
+	if m.Location != "" {
+		fmt.Fprintf(&b, "地点：%s\n", m.Location)
+	}
+	if m.Organizer != "" {
+		fmt.Fprintf(&b, "组织者：%s\n", m.Organizer)
+	}
+	if len(m.Attendees) > 0 {
+		b.WriteString("\n## 参会人\n\n")
+		for _, a := range m.Attendees {
+			fmt.Fprintf(&b, "- %s\n", a)
+		}
+	}
+	if m.Description != "" {
+		fmt.Fprintf(&b, "\n## 议程\n\n%s\n", m.Description)
+	}
+	return b.String()
+}
+
+// fetchCalendar downloads an ICS feed. webcal:// links are fetched over HTTPS.
+func fetchCalendar(ctx context.Context, feedURL string) (string, error) {
+	if strings.HasPrefix(feedURL, "webcal://") {
+		feedURL = "https://" + strings.TrimPrefix(feedURL, "webcal://")
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, feedURL, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := integrationHTTPClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("calendar feed returned %s", resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, calendarMaxFeedSize))
+	if err != nil {
+		return "", err
+	}
+	if !strings.Contains(string(data), "BEGIN:VCALENDAR") {
+		return "", fmt.Errorf("not an iCalendar feed")
+	}
+	return string(data), nil
+}
+
+// syncCalendarFeed imports the feed's new meetings as sources and returns how many were added
+func (s *Server) syncCalendarFeed(ctx context.Context, feed *CalendarFeed) (int, error) {
+	if err := s.checkLegalHold(ctx, feed.NotebookID); err != nil {
+		return 0, err
+	}
+	data, err := fetchCalendar(ctx, feed.URL)
+	if err != nil {
+		s.store.UpdateCalendarFeedSync(ctx, feed.ID, err.Error())
+		return 0, err
+	}
+
+	now := time.Now()
+	added := 0
+	for _, m := range parseMeetings(data, now.Add(-calendarLookback), now.Add(calendarLookahead)) {
+		exists, err := s.store.HasCalendarEvent(ctx, feed.ID, m.key())
+		if err != nil {
+			return added, err
+		}
+		if exists {
+			continue
+		}
+
+		source := &Source{
+			NotebookID: feed.NotebookID,
+			Name:       fmt.Sprintf("%s %s", m.Start.Local().Format("2006-01-02"), m.Title),
+			Type:       "meeting",
+			Content:    meetingSourceContent(m),
+			Metadata: map[string]interface{}{
+				"calendar_feed_id": feed.ID,
+				"event_uid":        m.UID,
+				"starts_at":        m.Start,
+				"ends_at":          m.End,
+				"attendees":        m.Attendees,
+			},
+		}
+		activityLog := &ActivityLog{UserID: feed.UserID, Action: "calendar_import", UserAgent: "calendar"}
+		if err := s.captureSource(ctx, source, activityLog); err != nil {
+			return added, err
+		}
+		if err := s.store.CreateCalendarEvent(ctx, &CalendarEvent{
+			FeedID:   feed.ID,
+			EventKey: m.key(),
+			SourceID: source.ID,
+			StartsAt: m.Start,
+			EndsAt:   m.End,
+		}); err != nil {
+			return added, err
+		}
+		added++
+	}
+
+	s.store.UpdateCalendarFeedSync(ctx, feed.ID, "")
+	return added, nil
+}
+
+// calendarSyncLoop periodically syncs all calendar feeds
+func (s *Server) calendarSyncLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		ctx := context.Background()
+		feeds, err := s.store.ListCalendarFeeds(ctx, "")
+		if err != nil {
+			golog.Errorf("failed to list calendar feeds: %v", err)
+			continue
+		}
+		for i := range feeds {
+			if added, err := s.syncCalendarFeed(ctx, &feeds[i]); err != nil {
+				golog.Warnf("failed to sync calendar feed %s: %v", feeds[i].ID, err)
+			} else if added > 0 {
+				golog.Infof("imported %d meetings from calendar feed %s", added, feeds[i].ID)
+			}
+		}
+	}
+}
+
+// summarizeMeeting pairs a meeting with its transcript and saves a meeting summary note generated from both
+func (s *Server) summarizeMeeting(ctx context.Context, agent *Agent, event *CalendarEvent, transcript *Source) (*Note, error) {
+	meetingSource, err := s.store.GetSource(ctx, event.SourceID)
+	if err != nil {
+		return nil, err
+	}
+
+	req := &TransformationRequest{
+		Type:      "meeting_summary",
+		SourceIDs: []string{meetingSource.ID, transcript.ID},
+		Length:    "medium",
+		Format:    "markdown",
+	}
+	response, err := agent.GenerateTransformation(s.withNotebookUsage(ctx, meetingSource.NotebookID), req, []Source{*meetingSource, *transcript})
+	if err != nil {
+		return nil, err
+	}
+
+	note := &Note{
+		NotebookID: meetingSource.NotebookID,
+		Title:      fmt.Sprintf("%s：%s", getTitleForType(req.Type), meetingSource.Name),
+		Content:    response.Content,
+		Type:       req.Type,
+		SourceIDs:  req.SourceIDs,
+		Metadata:   map[string]interface{}{"length": req.Length, "format": req.Format, "citations": response.Metadata["citations"]},
+	}
+	for _, key := range []string{"generated_by", "fallback_from"} {
+		if v, ok := response.Metadata[key]; ok {
+			note.Metadata[key] = v
+		}
+	}
+	if err := s.store.CreateNote(ctx, note); err != nil {
+		return nil, err
+	}
+	if err := s.store.SetMeetingTranscript(ctx, event.FeedID, event.EventKey, transcript.ID, note.ID); err != nil {
+		return nil, err
+	}
+	return note, nil
+}
+
+// autoSummarizeUpload treats an upload right after a meeting of an auto-summary feed as its transcript
+func (s *Server) autoSummarizeUpload(ctx context.Context, source *Source) {
+	now := time.Now()
+	event, err := s.store.LatestUnpairedMeeting(ctx, source.NotebookID, now.Add(-calendarTranscriptWindow), now)
+	if err != nil || event == nil {
+		return
+	}
+	agent := s.currentAgent()
+	if agent == nil {
+		return
+	}
+
+	// Claim the meeting before the slow generation so a second upload doesn't pair with it too
+	if err := s.store.SetMeetingTranscript(ctx, event.FeedID, event.EventKey, source.ID, ""); err != nil {
+		golog.Errorf("failed to pair transcript: %v", err)
+		return
+	}
+	if _, err := s.summarizeMeeting(ctx, agent, event, source); err != nil {
+		golog.Errorf("failed to generate meeting summary: %v", err)
+		return
+	}
+	golog.Infof("generated meeting summary from transcript %s", source.ID)
+}
+
+func (s *Server) handleListCalendarFeeds(c *gin.Context) {
+	ctx := context.Background()
+	notebookID := c.Param("id")
+	if err := s.checkNotebookAccess(ctx, notebookID, c.GetString("user_id")); err != nil {
+		c.JSON(http.StatusForbidden, ErrorResponse{Error: "Access denied"})
+		return
+	}
+
+	feeds, err := s.store.ListCalendarFeeds(ctx, notebookID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to list calendar feeds"})
+		return
+	}
+	c.JSON(http.StatusOK, feeds)
+}
+
+// handleCreateCalendarFeed attaches an ICS feed to a notebook and imports its current meetings
+func (s *Server) handleCreateCalendarFeed(c *gin.Context) {
+	ctx := context.Background()
+	notebookID := c.Param("id")
+	userID := c.GetString("user_id")
+	if err := s.checkNotebookAccess(ctx, notebookID, userID); err != nil {
+		c.JSON(http.StatusForbidden, ErrorResponse{Error: "Access denied"})
+		return
+	}
+
+	var req CalendarFeedRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+		return
+	}
+	feedURL := strings.TrimSpace(req.URL)
+	if !strings.HasPrefix(feedURL, "https://") && !strings.HasPrefix(feedURL, "http://") && !strings.HasPrefix(feedURL, "webcal://") {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "url must be an http(s) or webcal link"})
+		return
+	}
+
+	feed := &CalendarFeed{
+		NotebookID:  notebookID,
+		UserID:      userID,
+		Name:        strings.TrimSpace(req.Name),
+		URL:         feedURL,
+		AutoSummary: req.AutoSummary,
+	}
+	if err := s.store.CreateCalendarFeed(ctx, feed); err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to create calendar feed"})
+		return
+	}
+
+	// The first sync reports a bad URL right away, the feed is kept either way
+	if added, err := s.syncCalendarFeed(ctx, feed); err != nil {
+		golog.Warnf("initial calendar sync failed: %v", err)
+	} else {
+		golog.Infof("imported %d meetings from new calendar feed %s", added, feed.ID)
+	}
+	if updated, err := s.store.GetCalendarFeed(ctx, feed.ID); err == nil {
+		feed = updated
+	}
+
+	c.JSON(http.StatusCreated, feed)
+}
+
+// handleSyncCalendarFeed syncs a feed immediately instead of waiting for the scheduler
+func (s *Server) handleSyncCalendarFeed(c *gin.Context) {
+	ctx := context.Background()
+	notebookID := c.Param("id")
+	if err := s.checkNotebookAccess(ctx, notebookID, c.GetString("user_id")); err != nil {
+		c.JSON(http.StatusForbidden, ErrorResponse{Error: "Access denied"})
+		return
+	}
+
+	feed, err := s.store.GetCalendarFeed(ctx, c.Param("feedId"))
+	if err != nil || feed.NotebookID != notebookID {
+		c.JSON(http.StatusNotFound, ErrorResponse{Error: "Calendar feed not found"})
+		return
+	}
+
+	added, err := s.syncCalendarFeed(ctx, feed)
+	if err != nil {
+		c.JSON(http.StatusBadGateway, ErrorResponse{Error: "Failed to sync calendar feed", Details: err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"added": added})
+}
+
+func (s *Server) handleDeleteCalendarFeed(c *gin.Context) {
+	ctx := context.Background()
+	notebookID := c.Param("id")
+	if err := s.checkNotebookAccess(ctx, notebookID, c.GetString("user_id")); err != nil {
+		c.JSON(http.StatusForbidden, ErrorResponse{Error: "Access denied"})
+		return
+	}
+
+	if err := s.store.DeleteCalendarFeed(ctx, notebookID, c.Param("feedId")); err != nil {
+		c.JSON(http.StatusNotFound, ErrorResponse{Error: "Calendar feed not found"})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// handlePairMeetingTranscript pairs a meeting source with a transcript source and generates the meeting summary
+func (s *Server) handlePairMeetingTranscript(c *gin.Context) {
+	ctx, cancel := requestContext(c)
+	defer cancel()
+	agent, ok := s.requireAgent(c)
+	if !ok {
+		return
+	}
+
+	meetingSource, ok := s.getSourceInNotebook(c)
+	if !ok {
+		return
+	}
+	event, err := s.store.GetCalendarEventBySource(ctx, meetingSource.ID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Source is not a calendar meeting"})
+		return
+	}
+
+	var req MeetingTranscriptRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+		return
+	}
+	transcript, err := s.store.GetSource(ctx, req.TranscriptSourceID)
+	if err != nil || transcript.NotebookID != meetingSource.NotebookID {
+		c.JSON(http.StatusNotFound, ErrorResponse{Error: "Transcript source not found"})
+		return
+	}
+
+	note, err := s.summarizeMeeting(ctx, agent, event, transcript)
+	if err != nil {
+		s.reportGenerationError(c, err)
+		c.JSON(generationErrorStatus(err), ErrorResponse{Error: fmt.Sprintf("Generation failed: %v", err)})
+		return
+	}
+	c.JSON(http.StatusOK, note)
+}
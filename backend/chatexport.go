@@ -0,0 +1,194 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kataras/golog"
+)
+
+// selectChatMessages returns the questions and answers of a session from one message to another,
+// both included. Empty IDs select from the first or up to the last message.
+func selectChatMessages(messages []ChatMessage, fromID, toID string) ([]ChatMessage, error) {
+	from, to := 0, len(messages)-1
+	if fromID != "" || toID != "" {
+		from, to = -1, -1
+		for i, msg := range messages {
+			if msg.ID == fromID {
+				from = i
+			}
+			if msg.ID == toID {
+				to = i
+			}
+		}
+		if fromID == "" {
+			from = 0
+		}
+		if toID == "" {
+			to = len(messages) - 1
+		}
+		if from < 0 || to < 0 {
+			return nil, fmt.Errorf("message not found in this session")
+		}
+		if from > to {
+			return nil, fmt.Errorf("from_message_id comes after to_message_id")
+		}
+	}
+
+	selected := make([]ChatMessage, 0, to-from+1)
+	for _, msg := range messages[from : to+1] {
+		if msg.Role == "user" || msg.Role == "assistant" {
+			selected = append(selected, msg)
+		}
+	}
+	return selected, nil
+}
+
+// formatChatTranscript renders chat messages as markdown, one block per question and answer
+func formatChatTranscript(messages []ChatMessage) string {
+	var sb strings.Builder
+	for i, msg := range messages {
+		if i > 0 {
+			sb.WriteString("\n\n")
+		}
+		if msg.Role == "user" {
+			sb.WriteString("**问：** ")
+		} else {
+			sb.WriteString("**答：** ")
+		}
+		sb.WriteString(strings.TrimSpace(msg.Content))
+	}
+	return sb.String()
+}
+
+// citedSourceIDs returns the sources cited by the answers of a chat, in order of first citation
+func citedSourceIDs(messages []ChatMessage) []string {
+	seen := make(map[string]bool)
+	ids := make([]string, 0)
+	for _, msg := range messages {
+		citations, _ := msg.Metadata["citations"].([]interface{})
+		for _, c := range citations {
+			citation, _ := c.(map[string]interface{})
+			id, _ := citation["source_id"].(string)
+			if id != "" && !seen[id] {
+				seen[id] = true
+				ids = append(ids, id)
+			}
+		}
+	}
+	return ids
+}
+
+// handleExportChatSession saves a chat session, or a range of its messages, as a source the chat
+// can retrieve from, or as a note
+func (s *Server) handleExportChatSession(c *gin.Context) {
+	ctx := context.Background()
+	notebookID := c.Param("id")
+	userID := c.GetString("user_id")
+	if err := s.checkNotebookAccess(ctx, notebookID, userID); err != nil {
+		c.JSON(http.StatusForbidden, ErrorResponse{Error: err.Error()})
+		return
+	}
+	session, err := s.store.GetChatSession(ctx, c.Param("sessionId"))
+	if err != nil || session.NotebookID != notebookID {
+		c.JSON(http.StatusNotFound, ErrorResponse{Error: "Chat session not found"})
+		return
+	}
+
+	var req ChatExportRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+		return
+	}
+	if req.As == "" {
+		req.As = "source"
+	}
+	if req.As != "source" && req.As != "note" {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid export target", Details: `use "source" or "note"`})
+		return
+	}
+
+	messages, err := selectChatMessages(session.Messages, req.FromMessageID, req.ToMessageID)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+		return
+	}
+	if len(messages) == 0 {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "No messages to export"})
+		return
+	}
+	content := formatChatTranscript(messages)
+
+	title := strings.TrimSpace(req.Title)
+	if title == "" && session.Title != "New Chat" {
+		title = session.Title
+	}
+	if title == "" {
+		title = quickNoteTitle(messages[0].Content)
+	}
+	metadata := map[string]interface{}{
+		"chat_session_id": session.ID,
+		"message_count":   len(messages),
+	}
+
+	response := ChatExportResponse{MessageCount: len(messages)}
+	if req.As == "source" {
+		source := &Source{
+			NotebookID: notebookID,
+			Name:       title,
+			Type:       "chat",
+			Content:    content,
+			Metadata:   metadata,
+		}
+		activityLog := &ActivityLog{
+			UserID:    userID,
+			Action:    "import_chat",
+			IPAddress: c.ClientIP(),
+			UserAgent: c.GetHeader("User-Agent"),
+		}
+		if err := s.captureSource(ctx, source, activityLog); err != nil {
+			c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to create source"})
+			return
+		}
+		response.Source = source
+	} else {
+		if s.cfg.MaxNoteContentSize > 0 && len(content) > s.cfg.MaxNoteContentSize {
+			c.JSON(http.StatusRequestEntityTooLarge, ErrorResponse{
+				Error: fmt.Sprintf("Note content exceeds the maximum size of %d bytes", s.cfg.MaxNoteContentSize),
+			})
+			return
+		}
+		note := &Note{
+			NotebookID: notebookID,
+			Title:      title,
+			Content:    content,
+			Type:       "chat",
+			SourceIDs:  citedSourceIDs(messages),
+			Metadata:   metadata,
+		}
+		if err := s.store.CreateNote(ctx, note); err != nil {
+			c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to create note"})
+			return
+		}
+
+		activityLog := &ActivityLog{
+			UserID:       userID,
+			Action:       "import_chat",
+			ResourceType: "note",
+			ResourceID:   note.ID,
+			ResourceName: note.Title,
+			Details:      fmt.Sprintf(`{"notebook_id": "%s", "chat_session_id": "%s", "message_count": %d}`, notebookID, session.ID, len(messages)),
+			IPAddress:    c.ClientIP(),
+			UserAgent:    c.GetHeader("User-Agent"),
+		}
+		if err := s.store.LogActivity(ctx, activityLog); err != nil {
+			golog.Errorf("failed to log chat export activity: %v", err)
+		}
+		response.Note = note
+	}
+
+	c.JSON(http.StatusCreated, response)
+}
@@ -0,0 +1,59 @@
+package backend
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// chatStream sends a chat answer as Server-Sent Events: a "token" event per chunk of the
+// answer, then a "done" event with the full ChatResponse, or an "error" event.
+// A nil chatStream means the client asked for a plain JSON response.
+type chatStream struct {
+	c *gin.Context
+}
+
+// startChatStream switches the response to Server-Sent Events when the client asked for them
+// with ?stream=true or an Accept: text/event-stream header, and returns nil otherwise
+func startChatStream(c *gin.Context) *chatStream {
+	if c.Query("stream") != "true" && !strings.Contains(c.GetHeader("Accept"), "text/event-stream") {
+		return nil
+	}
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	// Keep reverse proxies from buffering the stream
+	c.Header("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+	c.Writer.Flush()
+	return &chatStream{c: c}
+}
+
+// onToken returns the callback streaming answer chunks to the client, nil without a stream.
+// It fails once the client has gone away, which stops the generation.
+func (cs *chatStream) onToken() func(chunk string) error {
+	if cs == nil {
+		return nil
+	}
+	return func(chunk string) error {
+		cs.c.SSEvent("token", gin.H{"content": chunk})
+		cs.c.Writer.Flush()
+		return cs.c.Request.Context().Err()
+	}
+}
+
+// reply sends the final response: as JSON with status without a stream, or as a "done" or
+// "error" event on it, since the status line has already been sent
+func (cs *chatStream) reply(c *gin.Context, status int, obj any) {
+	if cs == nil {
+		c.JSON(status, obj)
+		return
+	}
+	event := "done"
+	if status >= http.StatusBadRequest {
+		event = "error"
+	}
+	c.SSEvent(event, obj)
+	c.Writer.Flush()
+}
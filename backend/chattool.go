@@ -0,0 +1,374 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kataras/golog"
+)
+
+const (
+	// chatToolMaxResponse bounds how much of a tool's response is read
+	chatToolMaxResponse = 256 << 10
+	// chatToolMaxResult bounds how much of a tool's response the model sees, in runes
+	chatToolMaxResult = 8000
+	// chatToolMaxLogged bounds how much of a tool's response is kept in the call log, in runes
+	chatToolMaxLogged = 2000
+)
+
+// chatToolHTTPClient calls chat tool endpoints while the user waits for an answer
+var chatToolHTTPClient = &http.Client{Timeout: 15 * time.Second}
+
+var (
+	// chatToolNamePattern is the function name format the model APIs accept
+	chatToolNamePattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,64}$`)
+	headerNamePattern   = regexp.MustCompile(`^[A-Za-z0-9-]+$`)
+)
+
+// ChatToolRunner exposes a notebook's chat tools to a chat and runs the calls the model makes
+type ChatToolRunner struct {
+	Tools  []ChatTool
+	Invoke func(ctx context.Context, tool *ChatTool, arguments string) (string, error)
+}
+
+// defaultChatToolParameters is the schema of a tool registered without one: a single search query
+func defaultChatToolParameters() map[string]interface{} {
+	return map[string]interface{}{
+		"type": "object",
+		"properties": map[string]interface{}{
+			"query": map[string]interface{}{"type": "string", "description": "What to look up"},
+		},
+		"required": []string{"query"},
+	}
+}
+
+// checkChatToolEndpoint verifies that a tool endpoint is an http(s) URL on an allowed host.
+// It runs when a tool is saved and again on every call, since the allowlist can change.
+func (s *Server) checkChatToolEndpoint(endpoint string) error {
+	if len(s.cfg.ChatToolAllowedHosts) == 0 {
+		return fmt.Errorf("chat tools are disabled, set CHAT_TOOL_ALLOWED_HOSTS to enable them")
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return fmt.Errorf("endpoint must be an http(s) URL")
+	}
+	if !hostAllowed(u.Hostname(), s.cfg.ChatToolAllowedHosts) {
+		return fmt.Errorf("host %s is not in CHAT_TOOL_ALLOWED_HOSTS", u.Hostname())
+	}
+	return nil
+}
+
+// hostAllowed reports whether host is in an allowlist, where "*.example.com" matches subdomains
+func hostAllowed(host string, allowlist []string) bool {
+	host = strings.ToLower(host)
+	for _, allowed := range allowlist {
+		allowed = strings.ToLower(allowed)
+		if host == allowed || (strings.HasPrefix(allowed, "*.") && strings.HasSuffix(host, allowed[1:])) {
+			return true
+		}
+	}
+	return false
+}
+
+// chatToolRunner returns the enabled tools of a notebook for a chat, or nil if there are none.
+// Notebooks with CSV or Excel sources also get the built-in tool that queries their tables, and
+// notebooks with database sources the one that queries the databases, unless one of their own
+// tools has its name.
+func (s *Server) chatToolRunner(ctx context.Context, notebookID, sessionID string) *ChatToolRunner {
+	var tools []ChatTool
+	if len(s.cfg.ChatToolAllowedHosts) > 0 {
+		var err error
+		if tools, err = s.store.ListChatTools(ctx, notebookID, true); err != nil {
+			golog.Errorf("failed to list chat tools: %v", err)
+		}
+	}
+	hasTool := func(name string) bool {
+		return slices.ContainsFunc(tools, func(t ChatTool) bool { return t.Name == name })
+	}
+	tables := s.notebookTables(ctx, notebookID)
+	if len(tables) > 0 && !hasTool(tableToolName) {
+		tools = append(tools, tableTool(notebookID, tables))
+	}
+	var databases []SourceDatabase
+	if s.databaseSourcesEnabled() {
+		var err error
+		if databases, err = s.store.ListSourceDatabases(ctx, notebookID); err != nil {
+			golog.Errorf("failed to list database sources: %v", err)
+		}
+	}
+	if len(databases) > 0 && !hasTool(databaseToolName) {
+		tools = append(tools, databaseTool(notebookID, databases))
+	}
+	if len(tools) == 0 {
+		return nil
+	}
+	return &ChatToolRunner{
+		Tools: tools,
+		Invoke: func(ctx context.Context, tool *ChatTool, arguments string) (string, error) {
+			if tool.ID != "" {
+				return s.invokeChatTool(ctx, tool, sessionID, arguments)
+			}
+			var result string
+			var err error
+			if tool.Name == databaseToolName {
+				result, err = s.queryDatabase(ctx, databases, arguments)
+			} else {
+				result, err = queryTables(ctx, tables, arguments)
+			}
+			return truncateRunes(result, chatToolMaxResult), err
+		},
+	}
+}
+
+// invokeChatTool POSTs the model's arguments to a tool endpoint and returns the response for the
+// model. Every call is logged, including the ones that fail.
+func (s *Server) invokeChatTool(ctx context.Context, tool *ChatTool, sessionID, arguments string) (string, error) {
+	call := &ChatToolCall{
+		ToolID:     tool.ID,
+		NotebookID: tool.NotebookID,
+		SessionID:  sessionID,
+		ToolName:   tool.Name,
+		Arguments:  arguments,
+	}
+	start := time.Now()
+	result, err := s.callChatTool(ctx, tool, arguments, call)
+	call.DurationMS = time.Since(start).Milliseconds()
+	if err != nil {
+		call.Error = err.Error()
+	}
+	call.Response = truncateRunes(result, chatToolMaxLogged)
+	if err := s.store.LogChatToolCall(context.Background(), call); err != nil {
+		golog.Errorf("failed to log chat tool call: %v", err)
+	}
+	return truncateRunes(result, chatToolMaxResult), err
+}
+
+// callChatTool makes the HTTP request of a tool call, recording its status on call
+func (s *Server) callChatTool(ctx context.Context, tool *ChatTool, arguments string, call *ChatToolCall) (string, error) {
+	if strings.TrimSpace(arguments) == "" {
+		arguments = "{}"
+	}
+	var args map[string]interface{}
+	if err := json.Unmarshal([]byte(arguments), &args); err != nil {
+		return "", fmt.Errorf("arguments must be a JSON object")
+	}
+	if err := s.checkChatToolEndpoint(tool.Endpoint); err != nil {
+		return "", err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, tool.Endpoint, bytes.NewReader([]byte(arguments)))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "notex-chat-tool")
+	if tool.AuthHeader != "" && tool.AuthValue != "" {
+		req.Header.Set(tool.AuthHeader, tool.AuthValue)
+	}
+
+	// Redirects have to stay on allowed hosts too
+	client := *chatToolHTTPClient
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		if len(via) >= 5 {
+			return fmt.Errorf("too many redirects")
+		}
+		return s.checkChatToolEndpoint(req.URL.String())
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	call.StatusCode = resp.StatusCode
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, chatToolMaxResponse))
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return string(body), fmt.Errorf("tool returned %s", resp.Status)
+	}
+	return string(body), nil
+}
+
+// validateChatTool checks a tool request and copies it onto tool
+func (s *Server) validateChatTool(req *ChatToolRequest, tool *ChatTool) error {
+	req.Name = strings.TrimSpace(req.Name)
+	if !chatToolNamePattern.MatchString(req.Name) {
+		return fmt.Errorf("name must be 1-64 letters, digits, underscores or hyphens")
+	}
+	endpoint := strings.TrimSpace(req.Endpoint)
+	if err := s.checkChatToolEndpoint(endpoint); err != nil {
+		return err
+	}
+	header := strings.TrimSpace(req.AuthHeader)
+	if header != "" && !headerNamePattern.MatchString(header) {
+		return fmt.Errorf("auth_header must be a header name, such as Authorization")
+	}
+	parameters := req.Parameters
+	if parameters == nil {
+		parameters = defaultChatToolParameters()
+	}
+	if parameters["type"] != "object" {
+		return fmt.Errorf(`parameters must be a JSON Schema with "type": "object"`)
+	}
+
+	tool.Name = req.Name
+	tool.Description = strings.TrimSpace(req.Description)
+	tool.Endpoint = endpoint
+	tool.Parameters = parameters
+	tool.AuthHeader = header
+	if req.AuthValue != "" {
+		tool.AuthValue = req.AuthValue
+	}
+	if header == "" {
+		tool.AuthValue = ""
+	}
+	if req.Enabled != nil {
+		tool.Enabled = *req.Enabled
+	}
+	return nil
+}
+
+// isUniqueConstraintError reports whether err is a unique constraint violation
+func isUniqueConstraintError(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "UNIQUE constraint failed")
+}
+
+func (s *Server) handleListChatTools(c *gin.Context) {
+	ctx := context.Background()
+	notebookID := c.Param("id")
+	if err := s.checkNotebookAccess(ctx, notebookID, c.GetString("user_id")); err != nil {
+		c.JSON(http.StatusForbidden, ErrorResponse{Error: "Access denied"})
+		return
+	}
+	tools, err := s.store.ListChatTools(ctx, notebookID, false)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to list chat tools"})
+		return
+	}
+	c.JSON(http.StatusOK, tools)
+}
+
+func (s *Server) handleCreateChatTool(c *gin.Context) {
+	ctx := context.Background()
+	notebookID := c.Param("id")
+	userID := c.GetString("user_id")
+	if err := s.checkNotebookAccess(ctx, notebookID, userID); err != nil {
+		c.JSON(http.StatusForbidden, ErrorResponse{Error: "Access denied"})
+		return
+	}
+
+	var req ChatToolRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+		return
+	}
+	tool := &ChatTool{NotebookID: notebookID, UserID: userID, Enabled: true}
+	if err := s.validateChatTool(&req, tool); err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid chat tool", Details: err.Error()})
+		return
+	}
+	if err := s.store.CreateChatTool(ctx, tool); err != nil {
+		if isUniqueConstraintError(err) {
+			c.JSON(http.StatusConflict, ErrorResponse{Error: "A chat tool with this name already exists"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to create chat tool"})
+		return
+	}
+
+	activityLog := &ActivityLog{
+		UserID:       userID,
+		Action:       "create_chat_tool",
+		ResourceType: "notebook",
+		ResourceID:   notebookID,
+		ResourceName: tool.Name,
+		Details:      fmt.Sprintf(`{"tool_id": "%s", "endpoint": %q}`, tool.ID, tool.Endpoint),
+		IPAddress:    c.ClientIP(),
+		UserAgent:    c.GetHeader("User-Agent"),
+	}
+	if err := s.store.LogActivity(ctx, activityLog); err != nil {
+		golog.Errorf("failed to log chat tool creation activity: %v", err)
+	}
+
+	c.JSON(http.StatusCreated, tool)
+}
+
+func (s *Server) handleUpdateChatTool(c *gin.Context) {
+	ctx := context.Background()
+	notebookID := c.Param("id")
+	if err := s.checkNotebookAccess(ctx, notebookID, c.GetString("user_id")); err != nil {
+		c.JSON(http.StatusForbidden, ErrorResponse{Error: "Access denied"})
+		return
+	}
+
+	tool, err := s.store.GetChatTool(ctx, c.Param("toolId"))
+	if err != nil || tool.NotebookID != notebookID {
+		c.JSON(http.StatusNotFound, ErrorResponse{Error: "Chat tool not found"})
+		return
+	}
+	var req ChatToolRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+		return
+	}
+	if err := s.validateChatTool(&req, tool); err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid chat tool", Details: err.Error()})
+		return
+	}
+	if err := s.store.UpdateChatTool(ctx, tool); err != nil {
+		if isUniqueConstraintError(err) {
+			c.JSON(http.StatusConflict, ErrorResponse{Error: "A chat tool with this name already exists"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to update chat tool"})
+		return
+	}
+	c.JSON(http.StatusOK, tool)
+}
+
+func (s *Server) handleDeleteChatTool(c *gin.Context) {
+	ctx := context.Background()
+	notebookID := c.Param("id")
+	if err := s.checkNotebookAccess(ctx, notebookID, c.GetString("user_id")); err != nil {
+		c.JSON(http.StatusForbidden, ErrorResponse{Error: "Access denied"})
+		return
+	}
+	if err := s.store.DeleteChatTool(ctx, notebookID, c.Param("toolId")); err != nil {
+		c.JSON(http.StatusNotFound, ErrorResponse{Error: "Chat tool not found"})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// handleListChatToolCalls returns the call log of a notebook's chat tools, newest first
+func (s *Server) handleListChatToolCalls(c *gin.Context) {
+	ctx := context.Background()
+	notebookID := c.Param("id")
+	if err := s.checkNotebookAccess(ctx, notebookID, c.GetString("user_id")); err != nil {
+		c.JSON(http.StatusForbidden, ErrorResponse{Error: "Access denied"})
+		return
+	}
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	if limit <= 0 || limit > 500 {
+		limit = 50
+	}
+	calls, err := s.store.ListChatToolCalls(ctx, notebookID, c.Query("tool_id"), limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to list chat tool calls"})
+		return
+	}
+	c.JSON(http.StatusOK, calls)
+}
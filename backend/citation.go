@@ -0,0 +1,189 @@
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"github.com/tmc/langchaingo/schema"
+)
+
+// citationsFromDocs builds citations for retrieved chunks, numbered in the order they were given to the LLM.
+// Chunks without a source ID (ingested straight from files) can't be linked and are skipped.
+func citationsFromDocs(docs []schema.Document) []Citation {
+	citations := make([]Citation, 0, len(docs))
+	for i, doc := range docs {
+		sourceID, _ := doc.Metadata["source_id"].(string)
+		if sourceID == "" {
+			continue
+		}
+		sourceName, _ := doc.Metadata["source"].(string)
+		start, _ := doc.Metadata["start"].(int)
+		end, _ := doc.Metadata["end"].(int)
+		firstPage, _ := doc.Metadata["first_page"].(int)
+		lastPage, _ := doc.Metadata["last_page"].(int)
+		startTime, _ := doc.Metadata["start_time"].(int)
+		endTime, _ := doc.Metadata["end_time"].(int)
+		chapter, _ := doc.Metadata["chapter"].(string)
+		citations = append(citations, Citation{
+			Index:      i + 1,
+			SourceID:   sourceID,
+			SourceName: sourceName,
+			Start:      start,
+			End:        end,
+			FirstPage:  firstPage,
+			LastPage:   lastPage,
+			StartTime:  startTime,
+			EndTime:    endTime,
+			Chapter:    chapter,
+		})
+	}
+	return citations
+}
+
+// sourceCitations cites the part of each source a transformation was given,
+// i.e. everything up to the per-source character limit
+func sourceCitations(sources []Source, limit int) []Citation {
+	citations := make([]Citation, len(sources))
+	for i, src := range sources {
+		citations[i] = Citation{
+			Index:      i + 1,
+			SourceID:   src.ID,
+			SourceName: src.Name,
+			End:        min(utf8.RuneCountInString(src.Content), limit),
+		}
+		setCitationLocation(src.Content, &citations[i])
+	}
+	return citations
+}
+
+// setCitationLocation sets the pages of a PDF source or slides of a deck, the time in the audio
+// of a transcript, or the chapter of an EPUB book or section of a Word document a citation's
+// passage is at
+func setCitationLocation(content string, c *Citation) {
+	runes := []rune(content)
+	chunks := []textChunk{{Start: c.Start, End: c.End}}
+	setChunkPages(runes, chunks)
+	setChunkTimes(runes, chunks)
+	setChunkChapters(runes, chunks)
+	c.FirstPage, c.LastPage = chunks[0].FirstPage, chunks[0].LastPage
+	c.StartTime, c.EndTime = chunks[0].StartTime, chunks[0].EndTime
+	c.Chapter = chunks[0].Chapter
+}
+
+// citationLabel names the source of a citation, with its pages for PDFs, its slides for decks,
+// its time for transcripts and its chapter for books: "report.pdf, p.42", "deck.pptx, slide 3",
+// "lecture.mp3, 12:05", "novel.epub, 第三章 雨夜"
+func citationLabel(c Citation) string {
+	isDeck := strings.EqualFold(filepath.Ext(c.SourceName), ".pptx")
+	switch {
+	case c.EndTime > 0:
+		return fmt.Sprintf("%s, %s", c.SourceName, formatClock(c.StartTime))
+	case c.FirstPage == 0 && c.Chapter != "":
+		return fmt.Sprintf("%s, %s", c.SourceName, c.Chapter)
+	case c.FirstPage == 0:
+		return c.SourceName
+	case isDeck && c.LastPage > c.FirstPage:
+		return fmt.Sprintf("%s, slides %d–%d", c.SourceName, c.FirstPage, c.LastPage)
+	case isDeck:
+		return fmt.Sprintf("%s, slide %d", c.SourceName, c.FirstPage)
+	case c.LastPage > c.FirstPage:
+		return fmt.Sprintf("%s, pp.%d–%d", c.SourceName, c.FirstPage, c.LastPage)
+	default:
+		return fmt.Sprintf("%s, p.%d", c.SourceName, c.FirstPage)
+	}
+}
+
+// metadataCitations decodes the citations stored in note or chat message metadata
+func metadataCitations(metadata map[string]interface{}) []Citation {
+	raw, ok := metadata["citations"]
+	if !ok {
+		return nil
+	}
+	data, err := json.Marshal(raw)
+	if err != nil {
+		return nil
+	}
+	var citations []Citation
+	if err := json.Unmarshal(data, &citations); err != nil {
+		return nil
+	}
+	return citations
+}
+
+// chatMessageMetadata is the metadata persisted with an assistant reply, keeping its citations
+// and the chat tools it called
+func chatMessageMetadata(response *ChatResponse) map[string]interface{} {
+	metadata := make(map[string]interface{})
+	if len(response.Citations) > 0 {
+		metadata["citations"] = response.Citations
+	}
+	for _, key := range []string{"tools_called", "generated_by", "fallback_from"} {
+		if v, ok := response.Metadata[key]; ok {
+			metadata[key] = v
+		}
+	}
+	if len(metadata) == 0 {
+		return nil
+	}
+	return metadata
+}
+
+// publicCitationURL links to a source passage in the public viewer of a notebook
+func publicCitationURL(token string, c Citation) string {
+	return fmt.Sprintf("/public/%s#cite=%s:%d-%d", token, c.SourceID, c.Start, c.End)
+}
+
+// publicNoteMetadata copies note metadata, adding public viewer deep links to its citations
+func publicNoteMetadata(token string, metadata map[string]interface{}) map[string]interface{} {
+	citations := metadataCitations(metadata)
+	if len(citations) == 0 {
+		return metadata
+	}
+
+	public := make(map[string]interface{}, len(metadata))
+	for k, v := range metadata {
+		public[k] = v
+	}
+	for i := range citations {
+		citations[i].URL = publicCitationURL(token, citations[i])
+	}
+	public["citations"] = citations
+	return public
+}
+
+// handleGetPublicSourceContent returns the full text of a source in a public notebook,
+// so citation links can highlight the cited passage
+func (s *Server) handleGetPublicSourceContent(c *gin.Context) {
+	ctx := context.Background()
+
+	notebook, policy, ok := s.getPublicNotebook(c)
+	if !ok {
+		return
+	}
+	if !policy.Sources {
+		c.JSON(http.StatusForbidden, ErrorResponse{Error: "Sources are not shared"})
+		return
+	}
+
+	source, err := s.store.GetSource(ctx, c.Param("sourceId"))
+	if err != nil || source.NotebookID != notebook.ID || source.Private {
+		c.JSON(http.StatusNotFound, ErrorResponse{Error: "Source not found"})
+		return
+	}
+
+	response := gin.H{
+		"id":      source.ID,
+		"name":    source.Name,
+		"content": source.Content,
+	}
+	if s.publicFileAllowed(ctx, notebook.ID, nil) {
+		response["media"] = sourceMedia(source)
+	}
+	c.JSON(http.StatusOK, response)
+}
@@ -1,9 +1,14 @@
 package backend
 
 import (
+	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
+	"runtime"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
 )
@@ -14,7 +19,16 @@ type Config struct {
 	ServerHost string
 	ServerPort string
 
+	// Local desktop mode (single implicit user, no OAuth, localhost only)
+	LocalMode bool
+
+	// Data directories (resolved with filepath so they work on Windows, macOS and Linux)
+	DataDir   string
+	UploadDir string
+	LogDir    string
+
 	// LLM settings
+	LLMProvider    string // "mock" for canned offline replies; empty picks Azure, Ollama or OpenAI from their settings
 	OpenAIAPIKey   string
 	OpenAIBaseURL  string
 	OpenAIModel    string
@@ -23,48 +37,234 @@ type Config struct {
 	OllamaBaseURL  string
 	OllamaModel    string
 
+	// Azure OpenAI; models are addressed by the deployment names given to them in Azure
+	AzureOpenAIEndpoint            string // e.g. https://my-resource.openai.azure.com
+	AzureOpenAIAPIKey              string
+	AzureOpenAIDeployment          string // Chat model deployment
+	AzureOpenAIEmbeddingDeployment string // Embedding model deployment, for pgvector and qdrant
+	AzureOpenAIAPIVersion          string
+
+	// Models used for particular kinds of generation instead of the default LLM, keyed by
+	// transformation type or "chat"
+	ModelRoutes map[string]ModelRoute
+
+	// Models tried in order when a generation fails on its own model, e.g. when the provider
+	// is down or rate-limits
+	LLMFallbacks []ModelRoute
+
+	// Prices used to estimate the cost of usage, by model name, over the built-in ones
+	ModelPrices map[string]ModelPrice
+
+	// LLM timeouts (client-supplied deadlines are honored when shorter)
+	ChatTimeout           time.Duration
+	TransformationTimeout time.Duration
+	ImageTimeout          time.Duration
+
 	// Image generation settings
-	ImageProvider    string // "gemini", "glm", "zimage"
+	ImageProvider    string   // "gemini", "glm", "zimage", "openai", "sd", "mock"
+	ImageFallbacks   []string // Image providers tried in order when ImageProvider fails
+	ImageRetries     int      // Retries of a failed image generation before falling back
 	GLMAPIKey        string
 	GLMImageModel    string
 	GeminiImageModel string
 	ZImageAPIKey     string
 	ZImageModel      string
+	OpenAIImageModel string
+	SDURL            string // Self-hosted Stable Diffusion server
+	SDBackend        string // "a1111" or "comfyui"
+	SDModel          string // Checkpoint; empty keeps the one A1111 has loaded
+	SDSampler        string // Empty for the backend's default
+	SDSteps          int
+	SDSize           string // WIDTHxHEIGHT
 
 	// Vector store settings
-	VectorStoreType string // "memory", "supabase", "pgvector", "redis", "sqlite"
-	SupabaseURL     string
-	SupabaseKey     string
-	PostgreSQLURL   string
-	RedisURL        string
-	SQLitePath      string
+	VectorStoreType  string // "memory", "supabase", "pgvector", "qdrant", "redis", "sqlite"
+	SupabaseURL      string
+	SupabaseKey      string
+	PostgreSQLURL    string
+	QdrantURL        string
+	QdrantAPIKey     string
+	QdrantCollection string // All notebooks share one collection, filtered by notebook_id
+	RedisURL         string
+	SQLitePath       string
 
 	// Store settings (for checkpoints)
 	StoreType string // "memory", "sqlite", "postgres", "redis"
 	StorePath string
 
+	// Blob storage settings (oversized note content, generated assets)
+	BlobStoragePath        string
+	NoteInlineContentLimit int // Notes larger than this (bytes) are stored as blobs
+	MaxNoteContentSize     int // Maximum note size accepted from clients (bytes), 0 = unlimited
+
 	// Application settings
 	MaxSources       int
 	MaxContextLength int
+
+	// ScoreThreshold is the default minimum similarity score of a retrieved chunk, for vector
+	// stores that report one; notebooks can override it and the chunk counts
+	ScoreThreshold float64
+
+	// LowConfidenceScore flags chat answers whose best retrieved chunk scores below it, 0 never;
+	// with LowConfidenceAction "not_found" they say the sources don't cover the question instead
+	LowConfidenceScore  float64
+	LowConfidenceAction string // "not_found" or "flag"
+
+	// Reranking (optional)
+	RerankProvider   string // "cohere", "jina" or "ollama"; empty disables reranking
+	RerankModel      string // Defaults to a model of the provider
+	RerankAPIKey     string
+	RerankURL        string // Overrides the provider's endpoint, e.g. for a self-hosted reranker
+	RerankCandidates int    // Chunks retrieved for the reranker to pick the best MaxSources from
 	ChunkSize        int
 	ChunkOverlap     int
+	ChunkNeighbors   int // Chunks on each side of a retrieved chunk added to its context, 0 none
+
+	// Sources of at least this many characters also get a layer of summaries that questions are
+	// matched against before their chunks; 0 disables summary layers
+	SummaryLayerThreshold int
 
 	// Podcast generation
-	EnablePodcast bool
-	PodcastVoice  string
+	EnablePodcast      bool
+	PodcastVoice       string        // Voice of the first speaker
+	PodcastVoices      []string      // Voices handed to the speakers in order; speaker=voice items pin a speaker's
+	PodcastTTSProvider string        // "openai" or "mock"; empty leaves podcasts as scripts
+	PodcastTTSModel    string        // OpenAI speech model
+	PodcastPause       time.Duration // Silence between turns
+
+	// Audio transcription
+	TranscriptionProvider string // "openai", "whispercpp" or "mock"; empty rejects audio uploads
+	TranscriptionModel    string // OpenAI transcription model
+	TranscriptionLanguage string // ISO-639-1 code of the spoken language; empty detects it
+	WhisperCppBinary      string // whisper.cpp command line tool
+	WhisperCppModel       string // ggml model file for whisper.cpp
+	FFmpegPath            string // Converts audio to the 16 kHz WAV whisper.cpp reads, and extracts the audio of videos
+
+	// OCR of images and scanned PDFs
+	OCRProvider       string // "tesseract", "vision" or "mock"; empty rejects image uploads
+	OCRLanguages      string // Tesseract languages joined by "+"
+	TesseractBinary   string // Tesseract command line tool
+	OCRVisionFallback bool   // Read with the vision model what Tesseract can't
+	PdftoppmPath      string // Renders PDF pages to images (poppler-utils)
+	OCRMaxPages       int    // Pages of a scanned PDF read at most, 0 for all
+
+	// Virus scanning of uploads
+	VirusScanner     string        // "clamav", "http" or "mock"; empty skips scanning
+	ClamAVAddress    string        // clamd socket, "unix:///path" or "tcp://host:port"
+	VirusScanURL     string        // Scanning API of the http scanner
+	VirusScanToken   string        // Bearer token for the scanning API
+	VirusScanTimeout time.Duration // How long one scan may take
+	QuarantineDir    string        // Where flagged files are moved
+
+	// YouTube sources
+	YouTubeLanguages []string // Caption languages in order of preference; a video's first track otherwise
+
+	// Crawls of web sites and sitemaps added as URL sources
+	CrawlMaxPages   int // Most pages one crawl may read
+	SitemapMaxPages int // Most pages one sitemap import may add
+
+	// Watermarks on the generated images of public notebooks and shared notes
+	PublicWatermark      string // Text stamped in the corner of the image
+	PublicWatermarkImage string // Logo stamped in the corner of the image
+	PublicAttribution    string // Footer added below the image; {notebook} and {owner} are replaced
+	WatermarkFont        string // Font file for the text, needed for Chinese
+	MagickPath           string // ImageMagick command line tool
+
+	// Generated images
+	AssetSweepInterval time.Duration // How often images no note references are deleted, 0 keeps them
 
 	// Document conversion
 	EnableMarkitdown bool
+	URLParser        string // How new URL sources are read: "markitdown" or "readability"; empty picks markitdown when it is enabled
+
+	// External tools
+	DeepInsightPath    string
+	DeepInsightTimeout time.Duration // How long DeepInsight may run for an insight (client-supplied deadlines are honored when shorter)
 
 	// Demo settings
 	AllowMultipleNotesOfSameType bool
 
+	// Quick capture
+	InboxNotebookName string // Notebook that /api/quick-note files snippets into, created on first use
+
+	// Calendar feeds
+	CalendarSyncInterval time.Duration // How often calendar feeds are polled for meetings, 0 disables polling
+
+	// Confluence and SharePoint connectors
+	ConnectorSyncInterval time.Duration // How often connectors are synced, 0 disables syncing in the background
+	MicrosoftGraphURL     string        // Microsoft Graph endpoint, changed for national clouds
+	MicrosoftLoginURL     string        // Microsoft identity platform endpoint, changed for national clouds
+
+	// Folder watch agent (notex -watch)
+	WatchServerURL string        // Notex server the watched folder is uploaded to
+	WatchHookToken string        // Token of the ingest hook filing the files into a notebook
+	WatchInterval  time.Duration // How often the folder is scanned for new and changed files
+
+	// Event export to analytics warehouses
+	EventExportSink     string            // "webhook", "kafka" or "s3", empty disables exporting
+	EventExportInterval time.Duration     // How often new activity and usage events are exported
+	EventExportURL      string            // Webhook URL, or the Kafka REST Proxy URL
+	EventExportToken    string            // Bearer token sent to the webhook or REST Proxy
+	EventExportTopic    string            // Kafka topic the events are produced to
+	EventExportS3       ConnectorSettings // Bucket, prefix, region, endpoint and access key ID of the s3 sink
+	EventExportS3Secret string            // Secret access key of EventExportS3
+
+	// Error reporting of panics and LLM pipeline failures, off unless a DSN or URL is set
+	SentryDSN         string // Sentry project DSN, https://<key>@<host>/<project id>
+	SentryEnvironment string // Environment the reports are filed under
+	ErrorReportURL    string // Webhook the reports are POSTed to as JSON
+	ErrorReportToken  string // Bearer token sent to the webhook
+
+	// Source health checks
+	SourceCheckInterval time.Duration // How often URL sources are checked for broken or changed pages, 0 disables checks
+
+	// Source and note versions
+	SourceVersionLimit int // Previous contents kept per source, 0 keeps them all
+	NoteVersionLimit   int // Previous revisions kept per note, 0 keeps them all
+
+	// Background ingestion
+	IngestWorkers int // Sources fetched and extracted at once
+
+	// Background transformations
+	TransformWorkers  int // Transformations (notes, insights, slides) generated at once
+	SlideImageWorkers int // Images of a slide deck generated at once
+
+	// Batch question answering
+	BatchChatMaxQuestions int // Questions accepted per batch-chat request
+	BatchChatWorkers      int // Questions of a batch answered at once
+
+	// Related papers
+	SemanticScholarAPIKey string // Optional, raises the Semantic Scholar rate limit
+
+	// Custom chat tools
+	ChatToolAllowedHosts []string // Hosts user-defined chat tools may call, "*.example.com" matches subdomains; empty disables them
+
+	// Database sources, disabled when both are empty
+	DatabaseSourceHosts []string // Hosts of PostgreSQL databases that may be sources, matched like ChatToolAllowedHosts
+	DatabaseSourceDir   string   // Directory of SQLite files that may be sources
+
+	// Per-user limits, 0 for no limit
+	RateLimitPerMinute    int // API requests
+	QuotaTransformsPerDay int // Transformations started
+	QuotaImagesPerDay     int // Images generated for infographics, slides and covers
+	QuotaUploadMBPerDay   int // Megabytes of uploaded files
+
+	// Chat with public notebooks, whose visitors aren't signed in, 0 for no limit
+	PublicChatPerMinute    int // Questions from one IP address
+	QuotaPublicChatsPerDay int // Questions to the public notebooks of one owner, who pays for them
+
+	// Request latency tracking
+	SlowRequestThreshold  time.Duration            // Requests slower than this are logged as slow, 0 disables it
+	SlowRequestThresholds map[string]time.Duration // Thresholds of routes keyed by "METHOD /route/:param", overriding SlowRequestThreshold
+	SlowRequestLogSize    int                      // Latest slow requests kept for GET /api/admin/slow-requests
+
 	// LangSmith tracing (optional)
 	LangChainAPIKey  string
 	LangChainProject string
 
 	// Auth settings
 	JWTSecret string
+	SecretKey string // Encrypts credentials stored in the database, such as connector secrets
 
 	// GitHub OAuth
 	GithubClientID     string
@@ -77,6 +277,42 @@ type Config struct {
 	GoogleRedirectURL  string
 }
 
+// ModelRoute names the provider and model that a kind of generation is sent to
+type ModelRoute struct {
+	Provider string // "openai", "ollama", "azure", "gemini" or "mock"
+	Model    string // Model name; the deployment name for Azure
+}
+
+// String returns the route as provider/model
+func (r ModelRoute) String() string {
+	return r.Provider + "/" + r.Model
+}
+
+// imageModel returns the model an image provider generates images with
+func (c Config) imageModel(provider string) string {
+	switch provider {
+	case "glm":
+		return c.GLMImageModel
+	case "zimage":
+		return c.ZImageModel
+	case "openai":
+		return c.OpenAIImageModel
+	case "sd":
+		return c.SDModel
+	case "mock":
+		return "mock"
+	default:
+		return c.GeminiImageModel
+	}
+}
+
+// ModelPrice is what a model costs in USD, per million tokens or per image
+type ModelPrice struct {
+	Input  float64 // Per million prompt tokens
+	Output float64 // Per million completion tokens
+	Image  float64 // Per image, for image models
+}
+
 // loadEnv loads .env file if it exists (ignoring errors if file not found)
 func loadEnv() {
 	// Try to load .env file from current directory
@@ -91,42 +327,159 @@ func LoadConfig() Config {
 	// Load .env file first (if exists)
 	loadEnv()
 
+	// Other data paths default to locations under DATA_DIR
+	dataDir := filepath.Clean(getEnv("DATA_DIR", "data"))
+
 	cfg := Config{
-		ServerHost:                   getEnv("SERVER_HOST", "0.0.0.0"),
-		ServerPort:                   getEnv("SERVER_PORT", "8080"),
-		OpenAIAPIKey:                 getEnv("OPENAI_API_KEY", ""),
-		OpenAIBaseURL:                getEnv("OPENAI_BASE_URL", ""),
-		OpenAIModel:                  getEnv("OPENAI_MODEL", "gpt-4o-mini"),
-		EmbeddingModel:               getEnv("EMBEDDING_MODEL", "text-embedding-3-small"),
-		GoogleAPIKey:                 getEnv("GOOGLE_API_KEY", ""),
-		OllamaBaseURL:                getEnv("OLLAMA_BASE_URL", "http://localhost:11434"),
-		OllamaModel:                  getEnv("OLLAMA_MODEL", "llama3.2"),
-		ImageProvider:                getEnv("IMAGE_PROVIDER", "gemini"),
-		GLMAPIKey:                    getEnv("GLM_API_KEY", ""),
-		GLMImageModel:                getEnv("GLM_IMAGE_MODEL", "glm-image"),
-		GeminiImageModel:             getEnv("GEMINI_IMAGE_MODEL", "gemini-2.0-flash-exp"),
-		ZImageAPIKey:                 getEnv("ZIMAGE_API_KEY", ""),
-		ZImageModel:                  getEnv("ZIMAGE_MODEL", "z-image-turbo"),
-		VectorStoreType:              getEnv("VECTOR_STORE_TYPE", "sqlite"),
-		SupabaseURL:                  getEnv("SUPABASE_URL", ""),
-		SupabaseKey:                  getEnv("SUPABASE_KEY", ""),
-		PostgreSQLURL:                getEnv("POSTGRES_URL", ""),
-		RedisURL:                     getEnv("REDIS_URL", "redis://localhost:6379"),
-		SQLitePath:                   getEnv("SQLITE_PATH", "./data/vector.db"),
-		StoreType:                    getEnv("STORE_TYPE", "sqlite"),
-		StorePath:                    getEnv("STORE_PATH", "./data/checkpoints.db"),
-		MaxSources:                   getEnvInt("MAX_SOURCES", 5),
-		MaxContextLength:             getEnvInt("MAX_CONTEXT_LENGTH", 128000),
-		ChunkSize:                    getEnvInt("CHUNK_SIZE", 1000),
-		ChunkOverlap:                 getEnvInt("CHUNK_OVERLAP", 200),
-		EnablePodcast:                getEnvBool("ENABLE_PODCAST", true),
-		PodcastVoice:                 getEnv("PODCAST_VOICE", "alloy"),
-		EnableMarkitdown:             getEnvBool("ENABLE_MARKITDOWN", true),
-		AllowMultipleNotesOfSameType: getEnvBool("ALLOW_MULTIPLE_NOTES_OF_SAME_TYPE", true),
-		LangChainAPIKey:              getEnv("LANGCHAIN_API_KEY", ""),
-		LangChainProject:             getEnv("LANGCHAIN_PROJECT", "notex"),
+		ServerHost:                     getEnv("SERVER_HOST", "0.0.0.0"),
+		ServerPort:                     getEnv("SERVER_PORT", "8080"),
+		DataDir:                        dataDir,
+		UploadDir:                      getEnvPath("UPLOAD_DIR", filepath.Join(dataDir, "uploads")),
+		LogDir:                         getEnvPath("LOG_DIR", "logs"),
+		LLMProvider:                    getEnv("LLM_PROVIDER", ""),
+		OpenAIAPIKey:                   getEnv("OPENAI_API_KEY", ""),
+		OpenAIBaseURL:                  getEnv("OPENAI_BASE_URL", ""),
+		OpenAIModel:                    getEnv("OPENAI_MODEL", "gpt-4o-mini"),
+		EmbeddingModel:                 getEnv("EMBEDDING_MODEL", "text-embedding-3-small"),
+		GoogleAPIKey:                   getEnv("GOOGLE_API_KEY", ""),
+		OllamaBaseURL:                  getEnv("OLLAMA_BASE_URL", "http://localhost:11434"),
+		OllamaModel:                    getEnv("OLLAMA_MODEL", "llama3.2"),
+		AzureOpenAIEndpoint:            getEnv("AZURE_OPENAI_ENDPOINT", ""),
+		AzureOpenAIAPIKey:              getEnv("AZURE_OPENAI_API_KEY", ""),
+		AzureOpenAIDeployment:          getEnv("AZURE_OPENAI_DEPLOYMENT", ""),
+		AzureOpenAIEmbeddingDeployment: getEnv("AZURE_OPENAI_EMBEDDING_DEPLOYMENT", ""),
+		AzureOpenAIAPIVersion:          getEnv("AZURE_OPENAI_API_VERSION", "2024-10-21"),
+		ChatTimeout:                    getEnvTimeout("CHAT_TIMEOUT", 300*time.Second),
+		TransformationTimeout:          getEnvTimeout("TRANSFORMATION_TIMEOUT", 300*time.Second),
+		ImageTimeout:                   getEnvTimeout("IMAGE_TIMEOUT", 300*time.Second),
+		ImageProvider:                  getEnv("IMAGE_PROVIDER", "gemini"),
+		ImageFallbacks:                 getEnvList("IMAGE_FALLBACKS"),
+		ImageRetries:                   getEnvInt("IMAGE_RETRIES", 1),
+		GLMAPIKey:                      getEnv("GLM_API_KEY", ""),
+		GLMImageModel:                  getEnv("GLM_IMAGE_MODEL", "glm-image"),
+		GeminiImageModel:               getEnv("GEMINI_IMAGE_MODEL", "gemini-2.0-flash-exp"),
+		ZImageAPIKey:                   getEnv("ZIMAGE_API_KEY", ""),
+		ZImageModel:                    getEnv("ZIMAGE_MODEL", "z-image-turbo"),
+		OpenAIImageModel:               getEnv("OPENAI_IMAGE_MODEL", "gpt-image-1"),
+		SDURL:                          getEnv("SD_URL", "http://127.0.0.1:7860"),
+		SDBackend:                      getEnv("SD_BACKEND", "a1111"),
+		SDModel:                        getEnv("SD_MODEL", ""),
+		SDSampler:                      getEnv("SD_SAMPLER", ""),
+		SDSteps:                        getEnvInt("SD_STEPS", 25),
+		SDSize:                         getEnv("SD_SIZE", "1024x1024"),
+		VectorStoreType:                getEnv("VECTOR_STORE_TYPE", "sqlite"),
+		SupabaseURL:                    getEnv("SUPABASE_URL", ""),
+		SupabaseKey:                    getEnv("SUPABASE_KEY", ""),
+		PostgreSQLURL:                  getEnv("POSTGRES_URL", ""),
+		QdrantURL:                      getEnv("QDRANT_URL", "http://localhost:6333"),
+		QdrantAPIKey:                   getEnv("QDRANT_API_KEY", ""),
+		QdrantCollection:               getEnv("QDRANT_COLLECTION", "notex_chunks"),
+		RedisURL:                       getEnv("REDIS_URL", "redis://localhost:6379"),
+		SQLitePath:                     getEnvPath("SQLITE_PATH", filepath.Join(dataDir, "vector.db")),
+		StoreType:                      getEnv("STORE_TYPE", "sqlite"),
+		StorePath:                      getEnvPath("STORE_PATH", filepath.Join(dataDir, "checkpoints.db")),
+		BlobStoragePath:                getEnvPath("BLOB_STORAGE_PATH", filepath.Join(dataDir, "blobs")),
+		NoteInlineContentLimit:         getEnvInt("NOTE_INLINE_CONTENT_LIMIT", 64*1024),
+		MaxNoteContentSize:             getEnvInt("MAX_NOTE_CONTENT_SIZE", 5*1024*1024),
+		MaxSources:                     getEnvInt("MAX_SOURCES", 5),
+		MaxContextLength:               getEnvInt("MAX_CONTEXT_LENGTH", 128000),
+		ScoreThreshold:                 getEnvFloat("RETRIEVAL_SCORE_THRESHOLD", 0),
+		LowConfidenceScore:             getEnvFloat("LOW_CONFIDENCE_SCORE", 0),
+		LowConfidenceAction:            getEnv("LOW_CONFIDENCE_ACTION", "not_found"),
+		ChunkSize:                      getEnvInt("CHUNK_SIZE", 1000),
+		ChunkOverlap:                   getEnvInt("CHUNK_OVERLAP", 200),
+		ChunkNeighbors:                 getEnvInt("CHUNK_NEIGHBORS", 0),
+		EnablePodcast:                  getEnvBool("ENABLE_PODCAST", true),
+		PodcastVoice:                   getEnv("PODCAST_VOICE", "alloy"),
+		PodcastVoices:                  getEnvList("PODCAST_VOICES"),
+		PodcastTTSProvider:             getEnv("PODCAST_TTS_PROVIDER", ""),
+		PodcastTTSModel:                getEnv("PODCAST_TTS_MODEL", "gpt-4o-mini-tts"),
+		PodcastPause:                   getEnvDuration("PODCAST_PAUSE", 600*time.Millisecond),
+		TranscriptionProvider:          getEnv("TRANSCRIPTION_PROVIDER", ""),
+		TranscriptionModel:             getEnv("TRANSCRIPTION_MODEL", "whisper-1"),
+		TranscriptionLanguage:          getEnv("TRANSCRIPTION_LANGUAGE", ""),
+		WhisperCppBinary:               getEnv("WHISPER_CPP_BINARY", "whisper-cli"),
+		WhisperCppModel:                getEnv("WHISPER_CPP_MODEL", ""),
+		FFmpegPath:                     getEnv("FFMPEG_PATH", "ffmpeg"),
+		OCRProvider:                    getEnv("OCR_PROVIDER", ""),
+		OCRLanguages:                   getEnv("OCR_LANGUAGES", "chi_sim+eng"),
+		TesseractBinary:                getEnv("TESSERACT_BINARY", "tesseract"),
+		OCRVisionFallback:              getEnvBool("OCR_VISION_FALLBACK", false),
+		PdftoppmPath:                   getEnv("PDFTOPPM_PATH", "pdftoppm"),
+		OCRMaxPages:                    getEnvInt("OCR_MAX_PAGES", 50),
+		VirusScanner:                   getEnv("VIRUS_SCANNER", ""),
+		ClamAVAddress:                  getEnv("CLAMAV_ADDRESS", "unix:///var/run/clamav/clamd.ctl"),
+		VirusScanURL:                   getEnv("VIRUS_SCAN_URL", ""),
+		VirusScanToken:                 getEnv("VIRUS_SCAN_TOKEN", ""),
+		VirusScanTimeout:               getEnvTimeout("VIRUS_SCAN_TIMEOUT", 2*time.Minute),
+		QuarantineDir:                  getEnvPath("QUARANTINE_DIR", filepath.Join(dataDir, "quarantine")),
+		YouTubeLanguages:               getEnvList("YOUTUBE_LANGUAGES"),
+		CrawlMaxPages:                  getEnvInt("CRAWL_MAX_PAGES", 100),
+		SitemapMaxPages:                getEnvInt("SITEMAP_MAX_PAGES", 500),
+		PublicWatermark:                getEnv("PUBLIC_WATERMARK", ""),
+		PublicWatermarkImage:           getEnv("PUBLIC_WATERMARK_IMAGE", ""),
+		PublicAttribution:              getEnv("PUBLIC_ATTRIBUTION", ""),
+		WatermarkFont:                  getEnv("WATERMARK_FONT", ""),
+		MagickPath:                     getEnv("MAGICK_PATH", "magick"),
+		AssetSweepInterval:             getEnvDuration("ASSET_SWEEP_INTERVAL", time.Hour),
+		EnableMarkitdown:               getEnvBool("ENABLE_MARKITDOWN", true),
+		URLParser:                      getEnv("URL_PARSER", ""),
+		DeepInsightPath:                getEnvPath("DEEPINSIGHT_PATH", deepInsightDefaultPath()),
+		DeepInsightTimeout:             getEnvTimeout("DEEPINSIGHT_TIMEOUT", 10*time.Minute),
+		AllowMultipleNotesOfSameType:   getEnvBool("ALLOW_MULTIPLE_NOTES_OF_SAME_TYPE", true),
+		InboxNotebookName:              getEnv("INBOX_NOTEBOOK_NAME", "收件箱"),
+		CalendarSyncInterval:           getEnvDuration("CALENDAR_SYNC_INTERVAL", 15*time.Minute),
+		ConnectorSyncInterval:          getEnvDuration("CONNECTOR_SYNC_INTERVAL", time.Hour),
+		MicrosoftGraphURL:              getEnv("MICROSOFT_GRAPH_URL", "https://graph.microsoft.com/v1.0"),
+		MicrosoftLoginURL:              getEnv("MICROSOFT_LOGIN_URL", "https://login.microsoftonline.com"),
+		WatchServerURL:                 getEnv("NOTEX_SERVER_URL", "http://localhost:8080"),
+		WatchHookToken:                 getEnv("NOTEX_HOOK_TOKEN", ""),
+		WatchInterval:                  getEnvDuration("WATCH_INTERVAL", 10*time.Second),
+		EventExportSink:                getEnv("EVENT_EXPORT_SINK", ""),
+		EventExportInterval:            getEnvDuration("EVENT_EXPORT_INTERVAL", 5*time.Minute),
+		EventExportURL:                 getEnv("EVENT_EXPORT_URL", ""),
+		EventExportToken:               getEnv("EVENT_EXPORT_TOKEN", ""),
+		EventExportTopic:               getEnv("EVENT_EXPORT_TOPIC", "notex-events"),
+		EventExportS3Secret:            getEnv("EVENT_EXPORT_S3_SECRET_ACCESS_KEY", ""),
+		SentryDSN:                      getEnv("SENTRY_DSN", ""),
+		SentryEnvironment:              getEnv("SENTRY_ENVIRONMENT", "production"),
+		ErrorReportURL:                 getEnv("ERROR_REPORT_URL", ""),
+		ErrorReportToken:               getEnv("ERROR_REPORT_TOKEN", ""),
+		SourceCheckInterval:            getEnvDuration("SOURCE_CHECK_INTERVAL", 24*time.Hour),
+		SourceVersionLimit:             getEnvInt("SOURCE_VERSION_LIMIT", 20),
+		SummaryLayerThreshold:          getEnvInt("SUMMARY_LAYER_THRESHOLD", 0),
+		NoteVersionLimit:               getEnvInt("NOTE_VERSION_LIMIT", 20),
+		IngestWorkers:                  getEnvInt("INGEST_WORKERS", 2),
+		TransformWorkers:               getEnvInt("TRANSFORM_WORKERS", 2),
+		SlideImageWorkers:              getEnvInt("SLIDE_IMAGE_WORKERS", 4),
+		BatchChatMaxQuestions:          getEnvInt("BATCH_CHAT_MAX_QUESTIONS", 50),
+		BatchChatWorkers:               getEnvInt("BATCH_CHAT_WORKERS", 2),
+		SemanticScholarAPIKey:          getEnv("SEMANTIC_SCHOLAR_API_KEY", ""),
+		ChatToolAllowedHosts:           getEnvList("CHAT_TOOL_ALLOWED_HOSTS"),
+		DatabaseSourceHosts:            getEnvList("DATABASE_SOURCE_HOSTS"),
+		DatabaseSourceDir:              getEnv("DATABASE_SOURCE_DIR", ""),
+		ModelRoutes:                    parseModelRoutes(getEnvList("MODEL_ROUTES")),
+		LLMFallbacks:                   parseModelList(getEnvList("LLM_FALLBACKS")),
+		ModelPrices:                    parseModelPrices(getEnvList("MODEL_PRICES")),
+		RerankProvider:                 getEnv("RERANK_PROVIDER", ""),
+		RerankModel:                    getEnv("RERANK_MODEL", ""),
+		RerankAPIKey:                   getEnv("RERANK_API_KEY", ""),
+		RerankURL:                      getEnv("RERANK_URL", ""),
+		RerankCandidates:               getEnvInt("RERANK_CANDIDATES", 50),
+		RateLimitPerMinute:             getEnvInt("RATE_LIMIT_PER_MINUTE", 0),
+		QuotaTransformsPerDay:          getEnvInt("QUOTA_TRANSFORMS_PER_DAY", 0),
+		QuotaImagesPerDay:              getEnvInt("QUOTA_IMAGES_PER_DAY", 0),
+		QuotaUploadMBPerDay:            getEnvInt("QUOTA_UPLOAD_MB_PER_DAY", 0),
+		PublicChatPerMinute:            getEnvInt("PUBLIC_CHAT_PER_MINUTE", 10),
+		QuotaPublicChatsPerDay:         getEnvInt("QUOTA_PUBLIC_CHATS_PER_DAY", 200),
+		SlowRequestThreshold:           getEnvDuration("SLOW_REQUEST_THRESHOLD", 5*time.Second),
+		SlowRequestThresholds:          parseRouteThresholds(getEnvList("SLOW_REQUEST_THRESHOLDS")),
+		SlowRequestLogSize:             getEnvInt("SLOW_REQUEST_LOG_SIZE", 100),
+		LangChainAPIKey:                getEnv("LANGCHAIN_API_KEY", ""),
+		LangChainProject:               getEnv("LANGCHAIN_PROJECT", "notex"),
 
 		JWTSecret: getEnv("JWT_SECRET", "your-secret-key-change-me"),
+		SecretKey: getEnv("SECRET_KEY", getEnv("JWT_SECRET", "your-secret-key-change-me")),
 
 		GithubClientID:     getEnv("GITHUB_CLIENT_ID", ""),
 		GithubClientSecret: getEnv("GITHUB_CLIENT_SECRET", ""),
@@ -137,6 +490,36 @@ func LoadConfig() Config {
 		GoogleRedirectURL:  getEnv("GOOGLE_REDIRECT_URL", ""),
 	}
 
+	// Slide decks have always been written by Gemini
+	if _, ok := cfg.ModelRoutes["ppt"]; !ok {
+		cfg.ModelRoutes["ppt"] = ModelRoute{Provider: "gemini", Model: "gemini-3-flash-preview"}
+		if cfg.IsMock() {
+			cfg.ModelRoutes["ppt"] = ModelRoute{Provider: "mock", Model: "mock"}
+		}
+	}
+
+	// Offline, images come from the mock too unless a provider is picked
+	if cfg.IsMock() && os.Getenv("IMAGE_PROVIDER") == "" {
+		cfg.ImageProvider = "mock"
+	}
+	if cfg.IsMock() && os.Getenv("PODCAST_TTS_PROVIDER") == "" {
+		cfg.PodcastTTSProvider = "mock"
+	}
+	if cfg.IsMock() && os.Getenv("TRANSCRIPTION_PROVIDER") == "" {
+		cfg.TranscriptionProvider = "mock"
+	}
+	if cfg.IsMock() && os.Getenv("OCR_PROVIDER") == "" {
+		cfg.OCRProvider = "mock"
+	}
+
+	cfg.EventExportS3 = ConnectorSettings{
+		Bucket:      getEnv("EVENT_EXPORT_S3_BUCKET", ""),
+		Prefix:      strings.TrimLeft(getEnv("EVENT_EXPORT_S3_PREFIX", "notex-events/"), "/"),
+		Region:      getEnv("EVENT_EXPORT_S3_REGION", "us-east-1"),
+		Endpoint:    strings.TrimRight(getEnv("EVENT_EXPORT_S3_ENDPOINT", ""), "/"),
+		AccessKeyID: getEnv("EVENT_EXPORT_S3_ACCESS_KEY_ID", ""),
+	}
+
 	// Auto-detect provider from base URL or model name
 	if cfg.OpenAIBaseURL == "" && cfg.OpenAIModel != "" {
 		if contains(cfg.OpenAIModel, "ollama") || contains(cfg.OpenAIModel, "llama") {
@@ -147,16 +530,40 @@ func LoadConfig() Config {
 	return cfg
 }
 
-// ValidateConfig validates the configuration
-func ValidateConfig(cfg Config) error {
-	// Check if at least one LLM provider is configured
-	hasOpenAI := cfg.OpenAIAPIKey != ""
-	hasOllama := cfg.OpenAIBaseURL != "" && contains(cfg.OpenAIBaseURL, "11434")
+// EnableLocalMode configures a single-user desktop setup: the server binds to
+// localhost, OAuth is bypassed, and data lives under the OS user data directory
+// unless DATA_DIR is set explicitly
+func (c *Config) EnableLocalMode() error {
+	c.LocalMode = true
+	c.ServerHost = "127.0.0.1"
+
+	if os.Getenv("DATA_DIR") != "" {
+		return nil
+	}
 
-	if !hasOpenAI && !hasOllama {
-		return fmt.Errorf("either OPENAI_API_KEY or OLLAMA_BASE_URL must be set")
+	base, err := os.UserConfigDir()
+	if err != nil {
+		return fmt.Errorf("failed to locate user data directory: %w", err)
 	}
 
+	dataDir := filepath.Join(base, "notex")
+	c.DataDir = dataDir
+	c.UploadDir = getEnvPath("UPLOAD_DIR", filepath.Join(dataDir, "uploads"))
+	c.LogDir = getEnvPath("LOG_DIR", filepath.Join(dataDir, "logs"))
+	c.SQLitePath = getEnvPath("SQLITE_PATH", filepath.Join(dataDir, "vector.db"))
+	c.StorePath = getEnvPath("STORE_PATH", filepath.Join(dataDir, "checkpoints.db"))
+	c.BlobStoragePath = getEnvPath("BLOB_STORAGE_PATH", filepath.Join(dataDir, "blobs"))
+	c.QuarantineDir = getEnvPath("QUARANTINE_DIR", filepath.Join(dataDir, "quarantine"))
+
+	return nil
+}
+
+// ErrLLMNotConfigured is returned by ValidateConfig when no LLM provider is set up.
+// The server can still start in this state so the setup wizard can collect keys.
+var ErrLLMNotConfigured = errors.New("either OPENAI_API_KEY or OLLAMA_BASE_URL must be set")
+
+// ValidateConfig validates the configuration
+func ValidateConfig(cfg Config) error {
 	// Validate vector store configuration
 	switch cfg.VectorStoreType {
 	case "supabase":
@@ -167,6 +574,10 @@ func ValidateConfig(cfg Config) error {
 		if cfg.PostgreSQLURL == "" {
 			return fmt.Errorf("POSTGRES_URL required for postgres vector store")
 		}
+	case "qdrant":
+		if cfg.QdrantURL == "" || cfg.QdrantCollection == "" {
+			return fmt.Errorf("QDRANT_URL and QDRANT_COLLECTION required for qdrant vector store")
+		}
 	case "redis":
 		// Redis URL has default
 	case "sqlite":
@@ -177,6 +588,139 @@ func ValidateConfig(cfg Config) error {
 		return fmt.Errorf("unknown vector store type: %s", cfg.VectorStoreType)
 	}
 
+	switch cfg.RerankProvider {
+	case "cohere", "jina":
+		if cfg.RerankAPIKey == "" && cfg.RerankURL == "" {
+			return fmt.Errorf("RERANK_API_KEY required for %s reranker", cfg.RerankProvider)
+		}
+	case "", "ollama":
+	default:
+		return fmt.Errorf("unknown rerank provider: %s (supported: cohere, jina, ollama)", cfg.RerankProvider)
+	}
+
+	switch cfg.LLMProvider {
+	case "", "mock":
+	default:
+		return fmt.Errorf("unknown LLM provider: %s (supported: mock, or empty to pick by the provider settings)", cfg.LLMProvider)
+	}
+
+	if cfg.IsAzure() && (cfg.AzureOpenAIAPIKey == "" || cfg.AzureOpenAIDeployment == "") {
+		return fmt.Errorf("AZURE_OPENAI_API_KEY and AZURE_OPENAI_DEPLOYMENT required with AZURE_OPENAI_ENDPOINT")
+	}
+
+	for kind, route := range cfg.ModelRoutes {
+		switch route.Provider {
+		case "openai", "ollama", "azure", "gemini", "mock":
+		default:
+			return fmt.Errorf("unknown provider in MODEL_ROUTES for %s: %q (supported: openai, ollama, azure, gemini, mock)", kind, route.Provider)
+		}
+		if route.Model == "" {
+			return fmt.Errorf("MODEL_ROUTES entry for %s needs a model, as in %s=%s/model", kind, kind, route.Provider)
+		}
+		if route.Provider == "azure" && (cfg.AzureOpenAIEndpoint == "" || cfg.AzureOpenAIAPIKey == "") {
+			return fmt.Errorf("AZURE_OPENAI_ENDPOINT and AZURE_OPENAI_API_KEY required for MODEL_ROUTES entry %s", kind)
+		}
+	}
+
+	for _, route := range cfg.LLMFallbacks {
+		switch route.Provider {
+		case "openai", "ollama", "azure", "mock":
+		default:
+			return fmt.Errorf("unknown provider in LLM_FALLBACKS: %q (supported: openai, ollama, azure, mock)", route.Provider)
+		}
+		if route.Model == "" {
+			return fmt.Errorf("LLM_FALLBACKS entry %s needs a model, as in %s/model", route.Provider, route.Provider)
+		}
+		if route.Provider == "azure" && (cfg.AzureOpenAIEndpoint == "" || cfg.AzureOpenAIAPIKey == "") {
+			return fmt.Errorf("AZURE_OPENAI_ENDPOINT and AZURE_OPENAI_API_KEY required for LLM_FALLBACKS entry azure/%s", route.Model)
+		}
+	}
+
+	for _, name := range cfg.ImageFallbacks {
+		switch name {
+		case "gemini", "glm", "zimage", "openai", "sd", "mock":
+		default:
+			return fmt.Errorf("unknown provider in IMAGE_FALLBACKS: %q (supported: gemini, glm, zimage, openai, sd, mock)", name)
+		}
+	}
+
+	switch cfg.PodcastTTSProvider {
+	case "", "mock":
+	case "openai":
+		if cfg.OpenAIAPIKey == "" {
+			return fmt.Errorf("OPENAI_API_KEY required for the openai podcast TTS provider")
+		}
+	default:
+		return fmt.Errorf("unknown podcast TTS provider: %s (supported: openai, mock)", cfg.PodcastTTSProvider)
+	}
+
+	switch cfg.TranscriptionProvider {
+	case "", "mock":
+	case "openai":
+		if cfg.OpenAIAPIKey == "" {
+			return fmt.Errorf("OPENAI_API_KEY required for the openai transcription provider")
+		}
+	case "whispercpp":
+		if cfg.WhisperCppModel == "" {
+			return fmt.Errorf("WHISPER_CPP_MODEL required for the whispercpp transcription provider")
+		}
+	default:
+		return fmt.Errorf("unknown transcription provider: %s (supported: openai, whispercpp, mock)", cfg.TranscriptionProvider)
+	}
+
+	switch cfg.OCRProvider {
+	case "", "tesseract", "vision", "mock":
+	default:
+		return fmt.Errorf("unknown OCR provider: %s (supported: tesseract, vision, mock)", cfg.OCRProvider)
+	}
+
+	switch cfg.URLParser {
+	case "", URLParserMarkitdown, URLParserReadability:
+	default:
+		return fmt.Errorf("unknown URL parser: %s (supported: markitdown, readability)", cfg.URLParser)
+	}
+
+	switch cfg.VirusScanner {
+	case "", "clamav", "mock":
+	case "http":
+		if cfg.VirusScanURL == "" {
+			return fmt.Errorf("VIRUS_SCAN_URL required for the http virus scanner")
+		}
+	default:
+		return fmt.Errorf("unknown virus scanner: %s (supported: clamav, http, mock)", cfg.VirusScanner)
+	}
+
+	switch cfg.EventExportSink {
+	case "":
+	case "webhook", "kafka":
+		if cfg.EventExportURL == "" {
+			return fmt.Errorf("EVENT_EXPORT_URL required for the %s event export sink", cfg.EventExportSink)
+		}
+	case "s3":
+		if cfg.EventExportS3.Bucket == "" {
+			return fmt.Errorf("EVENT_EXPORT_S3_BUCKET required for the s3 event export sink")
+		}
+	default:
+		return fmt.Errorf("unknown event export sink: %s (supported: webhook, kafka, s3)", cfg.EventExportSink)
+	}
+
+	if cfg.SentryDSN != "" {
+		if _, _, err := parseSentryDSN(cfg.SentryDSN); err != nil {
+			return fmt.Errorf("invalid SENTRY_DSN: %w", err)
+		}
+	}
+
+	switch cfg.LowConfidenceAction {
+	case "not_found", "flag":
+	default:
+		return fmt.Errorf("unknown low confidence action: %s (supported: not_found, flag)", cfg.LowConfidenceAction)
+	}
+
+	// Check if at least one LLM provider is configured
+	if !cfg.HasLLMProvider() {
+		return ErrLLMNotConfigured
+	}
+
 	return nil
 }
 
@@ -188,6 +732,110 @@ func getEnv(key, defaultValue string) string {
 	return defaultValue
 }
 
+// getEnvPath gets an environment variable as a filesystem path, normalizing
+// separators for the current platform, or returns a default value
+func getEnvPath(key, defaultValue string) string {
+	return filepath.Clean(filepath.FromSlash(getEnv(key, defaultValue)))
+}
+
+// deepInsightDefaultPath returns the default DeepInsight binary location for the current platform
+func deepInsightDefaultPath() string {
+	if runtime.GOOS == "windows" {
+		return "DeepInsight.exe"
+	}
+	return "DeepInsight"
+}
+
+// getEnvList reads a comma-separated list, dropping empty items
+func getEnvList(key string) []string {
+	var items []string
+	for _, item := range strings.Split(os.Getenv(key), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// parseModelRoutes reads MODEL_ROUTES items of the form kind=provider/model, e.g.
+// summary=openai/gpt-4o-mini. Malformed items are kept with an empty provider or model so
+// ValidateConfig reports them.
+func parseModelRoutes(items []string) map[string]ModelRoute {
+	routes := make(map[string]ModelRoute, len(items))
+	for _, item := range items {
+		kind, target, _ := strings.Cut(item, "=")
+		routes[strings.TrimSpace(kind)] = parseModelRoute(target)
+	}
+	return routes
+}
+
+// parseModelList reads LLM_FALLBACKS items of the form provider/model, e.g. ollama/llama3.2
+func parseModelList(items []string) []ModelRoute {
+	routes := make([]ModelRoute, len(items))
+	for i, item := range items {
+		routes[i] = parseModelRoute(item)
+	}
+	return routes
+}
+
+// parseModelRoute reads a provider/model pair, keeping a malformed one with an empty provider or
+// model so ValidateConfig reports it
+func parseModelRoute(target string) ModelRoute {
+	provider, model, _ := strings.Cut(strings.TrimSpace(target), "/")
+	return ModelRoute{
+		Provider: strings.ToLower(strings.TrimSpace(provider)),
+		Model:    strings.TrimSpace(model),
+	}
+}
+
+// parseModelPrices reads MODEL_PRICES items of the form model=input/output, in USD per million
+// tokens, or model=price for the price of one image of an image model. Malformed items are skipped.
+func parseModelPrices(items []string) map[string]ModelPrice {
+	prices := make(map[string]ModelPrice, len(items))
+	for _, item := range items {
+		model, value, _ := strings.Cut(item, "=")
+		input, output, hasOutput := strings.Cut(value, "/")
+		in, err := strconv.ParseFloat(strings.TrimSpace(input), 64)
+		if err != nil {
+			continue
+		}
+		if !hasOutput {
+			prices[strings.TrimSpace(model)] = ModelPrice{Image: in}
+			continue
+		}
+		out, err := strconv.ParseFloat(strings.TrimSpace(output), 64)
+		if err != nil {
+			continue
+		}
+		prices[strings.TrimSpace(model)] = ModelPrice{Input: in, Output: out}
+	}
+	return prices
+}
+
+// parseRouteThresholds reads SLOW_REQUEST_THRESHOLDS items of the form "METHOD /route=duration",
+// e.g. "POST /api/notebooks/:id/chat=30s"; durations are seconds or Go durations. Malformed
+// items are skipped.
+func parseRouteThresholds(items []string) map[string]time.Duration {
+	thresholds := make(map[string]time.Duration, len(items))
+	for _, item := range items {
+		route, value, ok := strings.Cut(item, "=")
+		method, path, hasPath := strings.Cut(strings.TrimSpace(route), " ")
+		if !ok || !hasPath {
+			continue
+		}
+		value = strings.TrimSpace(value)
+		threshold, err := time.ParseDuration(value)
+		if seconds, serr := strconv.Atoi(value); serr == nil {
+			threshold, err = time.Duration(seconds)*time.Second, nil
+		}
+		if err != nil {
+			continue
+		}
+		thresholds[strings.ToUpper(method)+" "+strings.TrimSpace(path)] = threshold
+	}
+	return thresholds
+}
+
 // getEnvInt gets an environment variable as an integer or returns a default value
 func getEnvInt(key string, defaultValue int) int {
 	if value := os.Getenv(key); value != "" {
@@ -198,6 +846,16 @@ func getEnvInt(key string, defaultValue int) int {
 	return defaultValue
 }
 
+// getEnvFloat gets an environment variable as a float or returns a default value
+func getEnvFloat(key string, defaultValue float64) float64 {
+	if value := os.Getenv(key); value != "" {
+		if floatVal, err := strconv.ParseFloat(value, 64); err == nil {
+			return floatVal
+		}
+	}
+	return defaultValue
+}
+
 // getEnvBool gets an environment variable as a boolean or returns a default value
 func getEnvBool(key string, defaultValue bool) bool {
 	if value := os.Getenv(key); value != "" {
@@ -208,6 +866,30 @@ func getEnvBool(key string, defaultValue bool) bool {
 	return defaultValue
 }
 
+// getEnvDuration gets an environment variable as a duration or returns a default value.
+// Plain integers are interpreted as seconds, otherwise Go duration syntax (e.g. "90s", "5m") is used.
+// Negative values fall back to the default.
+func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
+	if value := os.Getenv(key); value != "" {
+		if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+			return time.Duration(seconds) * time.Second
+		}
+		if d, err := time.ParseDuration(value); err == nil && d >= 0 {
+			return d
+		}
+	}
+	return defaultValue
+}
+
+// getEnvTimeout reads a timeout like getEnvDuration. A timeout of 0 would fail every call at
+// once, so it falls back to the default, unlike intervals, where 0 turns a job off.
+func getEnvTimeout(key string, defaultValue time.Duration) time.Duration {
+	if d := getEnvDuration(key, defaultValue); d > 0 {
+		return d
+	}
+	return defaultValue
+}
+
 // contains checks if a string contains a substring
 func contains(s, substr string) bool {
 	return len(s) >= len(substr) && (s == substr || len(s) > len(substr) && (s[:len(substr)] == substr || s[len(s)-len(substr):] == substr || containsMiddle(s, substr)))
@@ -230,6 +912,44 @@ func (c *Config) GetBaseURL() string {
 	return ""
 }
 
+// OpenAIImageBaseURL returns the base URL of the OpenAI image, speech and transcription APIs:
+// OPENAI_BASE_URL, unless it points at Ollama, which serves none of them
+func (c *Config) OpenAIImageBaseURL() string {
+	if c.IsOllama() {
+		return ""
+	}
+	return c.OpenAIBaseURL
+}
+
+// HasLLMProvider returns true if an OpenAI key, an Ollama server or Azure OpenAI is configured,
+// or the mock provider is selected
+func (c *Config) HasLLMProvider() bool {
+	return c.OpenAIAPIKey != "" || c.IsOllama() || c.IsAzure() || c.IsMock()
+}
+
+// IsMock returns true if the LLM and embedder are the offline mocks. It takes precedence over
+// every other provider.
+func (c *Config) IsMock() bool {
+	return c.LLMProvider == "mock"
+}
+
+// IsAzure returns true if using Azure OpenAI as the LLM provider. It takes precedence over
+// OpenAI and Ollama.
+func (c *Config) IsAzure() bool {
+	return c.AzureOpenAIEndpoint != ""
+}
+
+// LLMModel returns the name of the chat model in use: the Azure deployment, or the model name
+func (c *Config) LLMModel() string {
+	if c.IsMock() {
+		return "mock"
+	}
+	if c.IsAzure() {
+		return c.AzureOpenAIDeployment
+	}
+	return c.OpenAIModel
+}
+
 // IsOllama returns true if using Ollama as the LLM provider
 func (c *Config) IsOllama() bool {
 	return c.OpenAIBaseURL != "" && contains(c.OpenAIBaseURL, "11434")
@@ -237,6 +957,9 @@ func (c *Config) IsOllama() bool {
 
 // SupportsFunctionCalling returns true if the configured model supports function calling
 func (c *Config) SupportsFunctionCalling() bool {
+	if c.IsAzure() {
+		return true // Azure only hosts OpenAI models, whose chat models all call tools
+	}
 	if c.IsOllama() {
 		return true // Most Ollama models support tool calling now
 	}
@@ -0,0 +1,259 @@
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/html"
+)
+
+// confluencePageSize is how many pages a Confluence search returns at a time
+const confluencePageSize = 25
+
+// confluencePage is a page in Confluence search results, expanded with its body and version
+type confluencePage struct {
+	ID      string `json:"id"`
+	Title   string `json:"title"`
+	Version struct {
+		Number int `json:"number"`
+	} `json:"version"`
+	Space struct {
+		Key string `json:"key"`
+	} `json:"space"`
+	Body struct {
+		Storage struct {
+			Value string `json:"value"`
+		} `json:"storage"`
+	} `json:"body"`
+	Links struct {
+		WebUI string `json:"webui"`
+	} `json:"_links"`
+}
+
+// confluenceCQL selects the pages of the connector's spaces, modified since the cursor if there is one
+func confluenceCQL(connector *Connector) string {
+	keys := make([]string, len(connector.Settings.Spaces))
+	for i, key := range connector.Settings.Spaces {
+		keys[i] = strconv.Quote(key)
+	}
+	cql := fmt.Sprintf("type = page AND space IN (%s)", strings.Join(keys, ", "))
+	if since, err := time.Parse(time.RFC3339, connector.Cursor); err == nil {
+		// CQL compares dates in the server's time zone, so a day of overlap is kept; unchanged
+		// pages are skipped by their version anyway
+		cql += fmt.Sprintf(` AND lastmodified >= "%s"`, since.AddDate(0, 0, -1).Format("2006-01-02"))
+	}
+	return cql + " ORDER BY lastmodified"
+}
+
+// confluenceGet GETs a Confluence REST API URL and decodes its JSON response into result.
+// Cloud signs in with an account email and API token, Data Center with a personal access token.
+func confluenceGet(ctx context.Context, connector *Connector, apiURL string, result interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, apiURL, nil)
+	if err != nil {
+		return err
+	}
+	if connector.Settings.Username != "" {
+		req.SetBasicAuth(connector.Settings.Username, connector.Secret)
+	} else {
+		req.Header.Set("Authorization", "Bearer "+connector.Secret)
+	}
+	req.Header.Set("Accept", "application/json")
+
+	resp, err := integrationHTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("confluence returned %s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+// syncConfluence imports the pages of the connector's spaces created or edited since the last
+// sync. Pages deleted in Confluence keep their sources.
+func (s *Server) syncConfluence(ctx context.Context, connector *Connector, result *ConnectorSyncResult) error {
+	startedAt := time.Now()
+	baseURL := connector.Settings.BaseURL
+	query := url.Values{
+		"cql":    {confluenceCQL(connector)},
+		"expand": {"body.storage,version,space"},
+		"limit":  {strconv.Itoa(confluencePageSize)},
+	}
+	next := baseURL + "/rest/api/content/search?" + query.Encode()
+
+	for next != "" {
+		var page struct {
+			Results []confluencePage `json:"results"`
+			Links   struct {
+				Base string `json:"base"`
+				Next string `json:"next"`
+			} `json:"_links"`
+		}
+		if err := confluenceGet(ctx, connector, next, &page); err != nil {
+			return err
+		}
+
+		for _, p := range page.Results {
+			version := strconv.Itoa(p.Version.Number)
+			sourceID, changed, err := s.connectorItemChanged(ctx, connector, p.ID, version)
+			if err != nil {
+				return err
+			}
+			if !changed {
+				continue
+			}
+
+			doc := &connectorDocument{
+				Key:     p.ID,
+				Version: version,
+				Name:    p.Title,
+				Type:    "confluence",
+				URL:     baseURL + p.Links.WebUI,
+				Content: fmt.Sprintf("# %s\n\n%s", p.Title, confluenceText(p.Body.Storage.Value)),
+				Metadata: map[string]interface{}{
+					"space":   p.Space.Key,
+					"page_id": p.ID,
+					"version": p.Version.Number,
+				},
+			}
+			added, err := s.saveConnectorDocument(ctx, connector, sourceID, doc)
+			if err != nil {
+				return err
+			}
+			if added {
+				result.Added++
+			} else {
+				result.Updated++
+			}
+		}
+
+		// The next link is relative to the base, which includes the context path such as /wiki
+		next = ""
+		if page.Links.Next != "" {
+			base := page.Links.Base
+			if base == "" {
+				base = baseURL
+			}
+			next = base + page.Links.Next
+		}
+	}
+
+	connector.Cursor = startedAt.Format(time.RFC3339)
+	return nil
+}
+
+// confluenceText renders a page in Confluence storage format (XHTML with ac: and ri: elements)
+// as plain text, keeping headings, list items and table rows on lines of their own
+func confluenceText(storage string) string {
+	z := html.NewTokenizer(strings.NewReader(storage))
+	z.AllowCDATA(true) // Code blocks keep their text in CDATA sections
+
+	var b strings.Builder
+	hidden := 0        // Depth inside elements whose text isn't content, such as macro parameters
+	cell := 0          // Depth inside table cells, where blocks don't break the row
+	item := 0          // Depth inside list items, where blocks don't break the item
+	firstCell := false // Whether the next table cell starts its row
+	breakBlock := func() {
+		switch {
+		case cell == 0 && item == 0:
+			b.WriteString("\n\n")
+		case !strings.HasSuffix(b.String(), " ") && !strings.HasSuffix(b.String(), "\n"):
+			b.WriteString(" ")
+		}
+	}
+	for {
+		tt := z.Next()
+		switch tt {
+		case html.ErrorToken:
+			return tidyConfluenceText(b.String())
+		case html.TextToken:
+			if hidden == 0 {
+				b.Write(z.Text())
+			}
+		case html.StartTagToken, html.SelfClosingTagToken:
+			name, _ := z.TagName()
+			switch tag := string(name); tag {
+			case "ac:parameter", "head", "style", "script":
+				if tt == html.StartTagToken {
+					hidden++
+				}
+			case "h1", "h2", "h3", "h4", "h5", "h6":
+				b.WriteString("\n\n" + strings.Repeat("#", int(tag[1]-'0')) + " ")
+			case "li":
+				b.WriteString("\n- ")
+				if tt == html.StartTagToken {
+					item++
+				}
+			case "tr":
+				b.WriteString("\n")
+				firstCell = true
+			case "td", "th":
+				if !firstCell {
+					if strings.HasSuffix(b.String(), " ") {
+						b.WriteString("| ")
+					} else {
+						b.WriteString(" | ")
+					}
+				}
+				firstCell = false
+				if tt == html.StartTagToken {
+					cell++
+				}
+			case "ac:plain-text-body":
+				b.WriteString("\n```\n")
+			case "br":
+				b.WriteString("\n")
+			case "p", "div", "blockquote", "pre", "table", "ul", "ol":
+				breakBlock()
+			}
+		case html.EndTagToken:
+			name, _ := z.TagName()
+			switch string(name) {
+			case "ac:parameter", "head", "style", "script":
+				if hidden > 0 {
+					hidden--
+				}
+			case "td", "th":
+				if cell > 0 {
+					cell--
+				}
+			case "li":
+				if item > 0 {
+					item--
+				}
+			case "ac:plain-text-body":
+				b.WriteString("\n```\n")
+			case "h1", "h2", "h3", "h4", "h5", "h6", "p", "div", "blockquote", "pre", "table", "ul", "ol":
+				breakBlock()
+			}
+		}
+	}
+}
+
+// tidyConfluenceText trims trailing spaces and collapses runs of blank lines
+func tidyConfluenceText(text string) string {
+	var lines []string
+	blank := false
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimRight(line, " \t\u00a0")
+		if line == "" {
+			blank = len(lines) > 0
+			continue
+		}
+		if blank {
+			lines = append(lines, "")
+			blank = false
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,347 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kataras/golog"
+)
+
+// connectorMaxFileSize limits the size of a document downloaded by a connector
+const connectorMaxFileSize = 50 << 20
+
+// connectorDocument is an item of a connector rendered as a source
+type connectorDocument struct {
+	Key      string // Stable ID of the item in the remote system
+	Version  string // Changes whenever the item does
+	Name     string
+	Type     string
+	URL      string
+	Content  string
+	FileName string
+	FileSize int64
+	Metadata map[string]interface{}
+}
+
+// syncConnector imports the items of a connector that are new or changed since the last sync
+func (s *Server) syncConnector(ctx context.Context, connector *Connector) (*ConnectorSyncResult, error) {
+	result := &ConnectorSyncResult{}
+	if err := s.checkLegalHold(ctx, connector.NotebookID); err != nil {
+		return result, err
+	}
+	var err error
+	switch connector.Kind {
+	case "confluence":
+		err = s.syncConfluence(ctx, connector, result)
+	case "sharepoint":
+		err = s.syncSharePoint(ctx, connector, result)
+	case "s3":
+		err = s.syncS3(ctx, connector, result)
+	default:
+		err = fmt.Errorf("unknown connector kind: %s", connector.Kind)
+	}
+	if err != nil {
+		s.store.UpdateConnectorSync(ctx, connector, err.Error())
+		return result, err
+	}
+
+	s.store.UpdateConnectorSync(ctx, connector, "")
+	return result, nil
+}
+
+// connectorImportable reports whether documents with a file name's extension can be read as sources
+func (s *Server) connectorImportable(name string) bool {
+	switch ext := strings.ToLower(filepath.Ext(name)); ext {
+	case ".txt", ".md", ".csv", ".tsv", ".epub", ".docx", ".pptx", ".xlsx":
+		return true
+	case ".pdf":
+		return s.cfg.EnableMarkitdown || s.ocr != nil
+	default:
+		if isImage(name) {
+			return s.ocr != nil
+		}
+		return s.cfg.EnableMarkitdown && s.vectorStore.needsMarkitdown(ext)
+	}
+}
+
+// connectorItemChanged reports whether an item needs importing, and the source it was imported
+// as before. Items whose source was deleted in the notebook are not imported again.
+func (s *Server) connectorItemChanged(ctx context.Context, connector *Connector, key, version string) (string, bool, error) {
+	sourceID, seen, found, err := s.store.GetConnectorItem(ctx, connector.ID, key)
+	if err != nil {
+		return "", false, err
+	}
+	if !found {
+		return "", true, nil
+	}
+	return sourceID, sourceID != "" && seen != version, nil
+}
+
+// saveConnectorDocument adds an item as a source, or updates the source it was imported as,
+// keeping the previous content as a version. It reports whether the source is new.
+func (s *Server) saveConnectorDocument(ctx context.Context, connector *Connector, sourceID string, doc *connectorDocument) (bool, error) {
+	doc.Metadata["connector_id"] = connector.ID
+
+	var source *Source
+	if sourceID != "" {
+		source, _ = s.store.GetSource(ctx, sourceID)
+	}
+	if source == nil {
+		source = &Source{
+			NotebookID: connector.NotebookID,
+			Name:       doc.Name,
+			Type:       doc.Type,
+			URL:        doc.URL,
+			Content:    doc.Content,
+			FileName:   doc.FileName,
+			FileSize:   doc.FileSize,
+			Metadata:   doc.Metadata,
+		}
+		activityLog := &ActivityLog{UserID: connector.UserID, Action: "connector_import", UserAgent: connector.Kind}
+		if err := s.captureSource(ctx, source, activityLog); err != nil {
+			return false, err
+		}
+		return true, s.store.SaveConnectorItem(ctx, connector.ID, doc.Key, source.ID, doc.Version)
+	}
+
+	// Load the existing index first, otherwise loading it later would index the new content twice
+	if err := s.loadNotebookVectorIndex(ctx, source.NotebookID); err != nil {
+		golog.Errorf("failed to load vector index: %v", err)
+	}
+	if doc.Content == source.Content && doc.FileName != "" {
+		// A fresh download of the same text isn't kept, the source goes on using its file
+		if path, ok := doc.Metadata["path"].(string); ok {
+			os.Remove(path)
+		}
+		doc.FileName, doc.FileSize = source.FileName, source.FileSize
+		doc.Metadata["path"] = source.Metadata["path"]
+	}
+	source.Name = doc.Name
+	source.URL = doc.URL
+	source.Metadata = doc.Metadata
+	if _, err := s.replaceSourceContent(ctx, source, doc.Content, doc.FileName, doc.FileSize); err != nil {
+		return false, err
+	}
+	// replaceSourceContent leaves the name alone, and everything alone if the content is unchanged
+	source.FileName = doc.FileName
+	source.FileSize = doc.FileSize
+	if err := s.store.UpdateSource(ctx, source); err != nil {
+		return false, err
+	}
+	return false, s.store.SaveConnectorItem(ctx, connector.ID, doc.Key, source.ID, doc.Version)
+}
+
+// removeConnectorItem deletes the source of an item removed from the remote system
+func (s *Server) removeConnectorItem(ctx context.Context, connector *Connector, key string) (bool, error) {
+	sourceID, _, found, err := s.store.GetConnectorItem(ctx, connector.ID, key)
+	if err != nil || !found {
+		return false, err
+	}
+	if err := s.store.DeleteConnectorItem(ctx, connector.ID, key); err != nil {
+		return false, err
+	}
+	if sourceID == "" {
+		return false, nil
+	}
+
+	source, err := s.store.GetSource(ctx, sourceID)
+	if err != nil {
+		return false, nil
+	}
+	if err := s.store.DeleteSource(ctx, source.ID); err != nil {
+		return false, err
+	}
+	if err := s.vectorStore.DeleteBySource(ctx, source.NotebookID, source.ID, source.Name); err != nil {
+		golog.Warnf("failed to delete chunks of source %s, re-indexing notebook: %v", source.ID, err)
+		if err := s.reindexNotebookVectorIndex(ctx, source.NotebookID); err != nil {
+			golog.Errorf("failed to re-index notebook %s: %v", source.NotebookID, err)
+		}
+	}
+	return true, nil
+}
+
+// connectorSyncLoop periodically syncs all connectors
+func (s *Server) connectorSyncLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		ctx := context.Background()
+		connectors, err := s.store.ListConnectors(ctx, "")
+		if err != nil {
+			golog.Errorf("failed to list connectors: %v", err)
+			continue
+		}
+		for i := range connectors {
+			if result, err := s.syncConnector(ctx, &connectors[i]); err != nil {
+				golog.Warnf("failed to sync connector %s: %v", connectors[i].ID, err)
+			} else if result.Added+result.Updated+result.Removed > 0 {
+				golog.Infof("synced connector %s: %d added, %d updated, %d removed", connectors[i].ID, result.Added, result.Updated, result.Removed)
+			}
+		}
+	}
+}
+
+// validateConnector checks the settings of a new connector and fills in defaults
+func validateConnector(connector *Connector) error {
+	settings := &connector.Settings
+	if connector.Secret == "" && connector.Kind != "s3" {
+		return fmt.Errorf("secret is required")
+	}
+	switch connector.Kind {
+	case "confluence":
+		settings.BaseURL = strings.TrimRight(strings.TrimSpace(settings.BaseURL), "/")
+		if !strings.HasPrefix(settings.BaseURL, "https://") && !strings.HasPrefix(settings.BaseURL, "http://") {
+			return fmt.Errorf("settings.base_url must be an http(s) link")
+		}
+		if len(settings.Spaces) == 0 {
+			return fmt.Errorf("settings.spaces is required")
+		}
+		for _, key := range settings.Spaces {
+			if key == "" || strings.ContainsAny(key, `"\ `) {
+				return fmt.Errorf("invalid space key %q", key)
+			}
+		}
+		if connector.Name == "" {
+			connector.Name = "Confluence " + strings.Join(settings.Spaces, ", ")
+		}
+	case "sharepoint":
+		if settings.Site == "" || settings.TenantID == "" || settings.ClientID == "" {
+			return fmt.Errorf("settings.site, settings.tenant_id and settings.client_id are required")
+		}
+		if settings.Library == "" {
+			settings.Library = "Documents"
+		}
+		settings.DriveID = ""
+		if connector.Name == "" {
+			connector.Name = "SharePoint " + settings.Library
+		}
+	case "s3":
+		settings.Bucket = strings.TrimSpace(settings.Bucket)
+		if settings.Bucket == "" || strings.ContainsAny(settings.Bucket, "/ ") {
+			return fmt.Errorf("settings.bucket is required and must be a bucket name")
+		}
+		settings.Prefix = strings.TrimLeft(settings.Prefix, "/")
+		if settings.Region == "" {
+			settings.Region = "us-east-1"
+		}
+		settings.Endpoint = strings.TrimRight(strings.TrimSpace(settings.Endpoint), "/")
+		if settings.Endpoint != "" && !strings.HasPrefix(settings.Endpoint, "https://") && !strings.HasPrefix(settings.Endpoint, "http://") {
+			return fmt.Errorf("settings.endpoint must be an http(s) link")
+		}
+		if (settings.AccessKeyID == "") != (connector.Secret == "") {
+			return fmt.Errorf("settings.access_key_id and secret must be given together")
+		}
+		if connector.Name == "" {
+			connector.Name = "S3 " + settings.Bucket + "/" + settings.Prefix
+		}
+	default:
+		return fmt.Errorf("unknown connector kind: %s (supported: confluence, sharepoint, s3)", connector.Kind)
+	}
+	return nil
+}
+
+func (s *Server) handleListConnectors(c *gin.Context) {
+	ctx := context.Background()
+	notebookID := c.Param("id")
+	if err := s.checkNotebookAccess(ctx, notebookID, c.GetString("user_id")); err != nil {
+		c.JSON(http.StatusForbidden, ErrorResponse{Error: "Access denied"})
+		return
+	}
+
+	connectors, err := s.store.ListConnectors(ctx, notebookID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to list connectors"})
+		return
+	}
+	c.JSON(http.StatusOK, connectors)
+}
+
+// handleCreateConnector attaches a Confluence, SharePoint or S3 connector to a notebook and runs its first sync
+func (s *Server) handleCreateConnector(c *gin.Context) {
+	ctx := context.Background()
+	notebookID := c.Param("id")
+	userID := c.GetString("user_id")
+	if err := s.checkNotebookAccess(ctx, notebookID, userID); err != nil {
+		c.JSON(http.StatusForbidden, ErrorResponse{Error: "Access denied"})
+		return
+	}
+
+	var req ConnectorRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+		return
+	}
+	connector := &Connector{
+		NotebookID: notebookID,
+		UserID:     userID,
+		Kind:       req.Kind,
+		Name:       strings.TrimSpace(req.Name),
+		Settings:   req.Settings,
+		Secret:     req.Secret,
+	}
+	if err := validateConnector(connector); err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+		return
+	}
+	if err := s.store.CreateConnector(ctx, connector); err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to create connector"})
+		return
+	}
+
+	// The first sync reports bad settings right away, the connector is kept either way
+	if result, err := s.syncConnector(ctx, connector); err != nil {
+		golog.Warnf("initial connector sync failed: %v", err)
+	} else {
+		golog.Infof("imported %d items from new connector %s", result.Added, connector.ID)
+	}
+	if updated, err := s.store.GetConnector(ctx, connector.ID); err == nil {
+		connector = updated
+	}
+
+	c.JSON(http.StatusCreated, connector)
+}
+
+// handleSyncConnector syncs a connector immediately instead of waiting for the scheduler
+func (s *Server) handleSyncConnector(c *gin.Context) {
+	ctx := context.Background()
+	notebookID := c.Param("id")
+	if err := s.checkNotebookAccess(ctx, notebookID, c.GetString("user_id")); err != nil {
+		c.JSON(http.StatusForbidden, ErrorResponse{Error: "Access denied"})
+		return
+	}
+
+	connector, err := s.store.GetConnector(ctx, c.Param("connectorId"))
+	if err != nil || connector.NotebookID != notebookID {
+		c.JSON(http.StatusNotFound, ErrorResponse{Error: "Connector not found"})
+		return
+	}
+
+	result, err := s.syncConnector(ctx, connector)
+	if err != nil {
+		c.JSON(http.StatusBadGateway, ErrorResponse{Error: "Failed to sync connector", Details: err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+func (s *Server) handleDeleteConnector(c *gin.Context) {
+	ctx := context.Background()
+	notebookID := c.Param("id")
+	if err := s.checkNotebookAccess(ctx, notebookID, c.GetString("user_id")); err != nil {
+		c.JSON(http.StatusForbidden, ErrorResponse{Error: "Access denied"})
+		return
+	}
+
+	if err := s.store.DeleteConnector(ctx, notebookID, c.Param("connectorId")); err != nil {
+		c.JSON(http.StatusNotFound, ErrorResponse{Error: "Connector not found"})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,173 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kataras/golog"
+)
+
+// maxCoverImageSize is the largest cover image accepted for upload (bytes)
+const maxCoverImageSize = 5 * 1024 * 1024
+
+// coverImageExtensions maps accepted cover image content types to file extensions
+var coverImageExtensions = map[string]string{
+	"image/png":  ".png",
+	"image/jpeg": ".jpg",
+	"image/gif":  ".gif",
+	"image/webp": ".webp",
+}
+
+// handleUploadNotebookCover sets a notebook's cover from an uploaded image (multipart field "file")
+func (s *Server) handleUploadNotebookCover(c *gin.Context) {
+	ctx := context.Background()
+	notebookID := c.Param("id")
+	userID := c.GetString("user_id")
+
+	if err := s.checkNotebookAccess(ctx, notebookID, userID); err != nil {
+		c.JSON(http.StatusForbidden, ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	fileHeader, err := c.FormFile("file")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "file required"})
+		return
+	}
+	if fileHeader.Size > maxCoverImageSize {
+		c.JSON(http.StatusRequestEntityTooLarge, ErrorResponse{Error: fmt.Sprintf("Cover image exceeds maximum size of %d bytes", maxCoverImageSize)})
+		return
+	}
+
+	file, err := fileHeader.Open()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Failed to read file"})
+		return
+	}
+	defer file.Close()
+
+	data, err := io.ReadAll(io.LimitReader(file, maxCoverImageSize+1))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Failed to read file"})
+		return
+	}
+
+	s.saveNotebookCover(c, notebookID, data)
+}
+
+// handleGenerateNotebookCover asks the image provider for a cover based on the notebook's name and description
+func (s *Server) handleGenerateNotebookCover(c *gin.Context) {
+	ctx, cancel := requestContext(c)
+	defer cancel()
+	agent, ok := s.requireAgent(c)
+	if !ok {
+		return
+	}
+	notebookID := c.Param("id")
+	userID := c.GetString("user_id")
+
+	if err := s.checkNotebookAccess(ctx, notebookID, userID); err != nil {
+		c.JSON(http.StatusForbidden, ErrorResponse{Error: err.Error()})
+		return
+	}
+	notebook, err := s.store.GetNotebook(ctx, notebookID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, ErrorResponse{Error: "Notebook not found"})
+		return
+	}
+
+	var req struct {
+		Prompt string `json:"prompt"`
+	}
+	// The body is optional; a default prompt is derived from the notebook
+	_ = c.ShouldBindJSON(&req)
+	prompt := req.Prompt
+	if prompt == "" {
+		prompt = fmt.Sprintf("A clean, minimal cover illustration for a notebook titled %q. %s "+
+			"No text, no letters, soft colors, suitable as a card background.", notebook.Name, notebook.Description)
+	}
+
+	ctx = withUsageOperation(withUsageScope(ctx, userID, notebookID), "cover")
+	image, err := agent.generateImage(ctx, prompt, userID)
+	if err != nil {
+		golog.Errorf("failed to generate cover for notebook %s: %v", notebookID, err)
+		s.reportGenerationError(c, err)
+		c.JSON(generationErrorStatus(err), ErrorResponse{Error: fmt.Sprintf("Failed to generate cover: %v", err)})
+		return
+	}
+
+	// Providers write into the uploads directory; move the image into blob storage
+	golog.Infof("cover of notebook %s generated by %s", notebookID, image.GeneratedBy)
+	data, err := os.ReadFile(image.Path)
+	os.Remove(image.Path)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to read generated cover"})
+		return
+	}
+
+	s.saveNotebookCover(c, notebookID, data)
+}
+
+// saveNotebookCover validates image data and stores it as the notebook's cover
+func (s *Server) saveNotebookCover(c *gin.Context, notebookID string, data []byte) {
+	if len(data) > maxCoverImageSize {
+		c.JSON(http.StatusRequestEntityTooLarge, ErrorResponse{Error: fmt.Sprintf("Cover image exceeds maximum size of %d bytes", maxCoverImageSize)})
+		return
+	}
+	ext, ok := coverImageExtensions[http.DetectContentType(data)]
+	if !ok {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Cover must be a PNG, JPEG, GIF or WebP image"})
+		return
+	}
+
+	notebook, err := s.store.SetNotebookCover(context.Background(), notebookID, ext, data)
+	if err != nil {
+		golog.Errorf("failed to save cover for notebook %s: %v", notebookID, err)
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to save cover image"})
+		return
+	}
+
+	c.JSON(http.StatusOK, notebook)
+}
+
+func (s *Server) handleDeleteNotebookCover(c *gin.Context) {
+	ctx := context.Background()
+	notebookID := c.Param("id")
+	userID := c.GetString("user_id")
+
+	if err := s.checkNotebookAccess(ctx, notebookID, userID); err != nil {
+		c.JSON(http.StatusForbidden, ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	notebook, err := s.store.DeleteNotebookCover(ctx, notebookID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to delete cover image"})
+		return
+	}
+
+	c.JSON(http.StatusOK, notebook)
+}
+
+// serveNotebookCover writes a cover image, applying the same access rules as other notebook files
+func (s *Server) serveNotebookCover(c *gin.Context, notebook *Notebook, data []byte) {
+	userID := c.GetString("user_id")
+	if !notebook.IsPublic {
+		if userID == "" {
+			c.JSON(http.StatusUnauthorized, ErrorResponse{Error: "Authorization required"})
+			return
+		}
+		if (notebook.UserID != "" && userID != notebook.UserID) || !tokenAllowsNotebook(c, notebook.ID) {
+			c.JSON(http.StatusForbidden, ErrorResponse{Error: "Access denied"})
+			return
+		}
+	}
+
+	// Cover file names change on every update, so they can be cached aggressively
+	c.Header("Cache-Control", "private, max-age=31536000, immutable")
+	c.Data(http.StatusOK, http.DetectContentType(data), data)
+}
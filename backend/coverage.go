@@ -0,0 +1,251 @@
+package backend
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kataras/golog"
+	"github.com/tmc/langchaingo/schema"
+)
+
+// coverageJudgement is the model's verdict on whether a question's retrieved passages answer it
+type coverageJudgement struct {
+	Support    string
+	Reason     string
+	Retrieved  []schema.Document
+	Supporting []schema.Document // The retrieved passages the model named as supporting the answer
+}
+
+var (
+	coverageSupportLine  = regexp.MustCompile(`支持程度\s*[:：]\s*(\S+)`)
+	coveragePassagesLine = regexp.MustCompile(`相关段落\s*[:：]\s*(.*)`)
+	coverageReasonLine   = regexp.MustCompile(`理由\s*[:：]\s*(.+)`)
+	coverageNumber       = regexp.MustCompile(`\d+`)
+)
+
+// parseCoverageJudgement reads the model's three-line verdict on the passages docs. A verdict
+// it can't read counts as no support, so the question is flagged for a look.
+func parseCoverageJudgement(response string, docs []schema.Document) *coverageJudgement {
+	judgement := &coverageJudgement{Support: SupportNone, Retrieved: docs}
+	if m := coverageSupportLine.FindStringSubmatch(response); m != nil {
+		switch {
+		case strings.HasPrefix(m[1], "充分"), strings.EqualFold(m[1], "strong"):
+			judgement.Support = SupportStrong
+		case strings.HasPrefix(m[1], "部分"), strings.EqualFold(m[1], "partial"):
+			judgement.Support = SupportPartial
+		}
+	}
+	if m := coverageReasonLine.FindStringSubmatch(response); m != nil {
+		judgement.Reason = strings.TrimSpace(m[1])
+	}
+	if judgement.Support == SupportNone {
+		return judgement
+	}
+	if m := coveragePassagesLine.FindStringSubmatch(response); m != nil {
+		seen := make(map[int]bool)
+		for _, number := range coverageNumber.FindAllString(m[1], -1) {
+			n, _ := strconv.Atoi(number)
+			if n >= 1 && n <= len(docs) && !seen[n] {
+				seen[n] = true
+				judgement.Supporting = append(judgement.Supporting, docs[n-1])
+			}
+		}
+	}
+	return judgement
+}
+
+// docSourceIDs returns the distinct source IDs of passages, in order
+func docSourceIDs(docs []schema.Document) []string {
+	ids := make([]string, 0, len(docs))
+	seen := make(map[string]bool)
+	for _, doc := range docs {
+		id, _ := doc.Metadata["source_id"].(string)
+		if id != "" && !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// handleCoverageReport checks a list of questions against a notebook's sources. For each
+// question, the passages chat would retrieve are judged on whether they answer it; the report
+// lists the weakly supported questions and what each source contributes.
+func (s *Server) handleCoverageReport(c *gin.Context) {
+	ctx, cancel := requestContext(c)
+	defer cancel()
+	notebook, ok := s.getOwnedNotebook(c)
+	if !ok {
+		return
+	}
+
+	var req CoverageRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+		return
+	}
+	if !s.checkBatchSize(c, req.Questions) {
+		return
+	}
+	sources, err := s.store.ListSources(ctx, notebook.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to list sources"})
+		return
+	}
+
+	agent, ok := s.requireAgent(c)
+	if !ok {
+		return
+	}
+	if err := s.loadNotebookVectorIndex(ctx, notebook.ID); err != nil {
+		golog.Errorf("failed to load vector index: %v", err)
+	}
+
+	settings, _ := s.resolveChatSettings(ctx, notebook.ID, "")
+	ctx = withUsageScope(ctx, c.GetString("user_id"), notebook.ID)
+
+	batch := newQuestionBatch(req.Questions)
+	report := &CoverageReport{
+		Questions: make([]QuestionCoverage, len(batch.questions)),
+		Sources:   make([]SourceCoverage, 0, len(sources)),
+		Weak:      []int{},
+	}
+	for i, question := range batch.questions {
+		report.Questions[i] = QuestionCoverage{Index: i, Question: question, Sources: []string{}, Retrieved: []string{}}
+		if question == "" {
+			report.Questions[i].Error = "empty question"
+		}
+	}
+	batch.run(s.cfg.BatchChatWorkers, func(question string, indexes []int) {
+		result := QuestionCoverage{Sources: []string{}, Retrieved: []string{}}
+		judgement, err := agent.JudgeCoverage(ctx, notebook.ID, question, settings)
+		if err != nil {
+			result.Error = err.Error()
+		} else {
+			result.Support = judgement.Support
+			result.Reason = judgement.Reason
+			result.Sources = docSourceIDs(judgement.Supporting)
+			result.Retrieved = docSourceIDs(judgement.Retrieved)
+		}
+		for _, i := range indexes {
+			result.Index, result.Question = i, batch.questions[i]
+			report.Questions[i] = result
+		}
+	})
+
+	bySource := make(map[string]*SourceCoverage, len(sources))
+	for _, src := range sources {
+		report.Sources = append(report.Sources, SourceCoverage{SourceID: src.ID, SourceName: src.Name, Supported: []int{}})
+	}
+	for i := range report.Sources {
+		bySource[report.Sources[i].SourceID] = &report.Sources[i]
+	}
+	for _, q := range report.Questions {
+		if q.Error == "" && q.Support != SupportStrong {
+			report.Weak = append(report.Weak, q.Index)
+		}
+		for _, id := range q.Sources {
+			if sc := bySource[id]; sc != nil {
+				sc.Supported = append(sc.Supported, q.Index)
+			}
+		}
+		for _, id := range q.Retrieved {
+			if sc := bySource[id]; sc != nil {
+				sc.Retrieved++
+			}
+		}
+	}
+	sort.SliceStable(report.Sources, func(i, j int) bool {
+		return len(report.Sources[i].Supported) > len(report.Sources[j].Supported)
+	})
+
+	if req.SaveNote {
+		note := &Note{
+			NotebookID: notebook.ID,
+			Title:      "来源覆盖报告：" + time.Now().Format("2006-01-02"),
+			Content:    coverageReportMarkdown(report, bySource),
+			Type:       "coverage",
+			SourceIDs:  []string{},
+			Metadata:   map[string]interface{}{"questions": len(report.Questions), "weak": len(report.Weak)},
+		}
+		if err := s.store.CreateNote(ctx, note); err != nil {
+			c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to create note"})
+			return
+		}
+		report.Note = note
+	}
+
+	activityLog := &ActivityLog{
+		UserID:       c.GetString("user_id"),
+		Action:       "coverage_report",
+		ResourceType: "notebook",
+		ResourceID:   notebook.ID,
+		ResourceName: notebook.Name,
+		Details:      fmt.Sprintf(`{"notebook_id": "%s", "questions": %d, "weak": %d}`, notebook.ID, len(report.Questions), len(report.Weak)),
+		IPAddress:    c.ClientIP(),
+		UserAgent:    c.GetHeader("User-Agent"),
+	}
+	if err := s.store.LogActivity(ctx, activityLog); err != nil {
+		golog.Errorf("failed to log coverage report activity: %v", err)
+	}
+
+	c.JSON(http.StatusOK, report)
+}
+
+// coverageSupportLabels names the support levels in a saved report
+var coverageSupportLabels = map[string]string{
+	SupportStrong:  "充分",
+	SupportPartial: "部分",
+	SupportNone:    "无",
+}
+
+// coverageReportMarkdown formats a coverage report as a note
+func coverageReportMarkdown(report *CoverageReport, bySource map[string]*SourceCoverage) string {
+	cell := func(s string) string {
+		return strings.ReplaceAll(strings.ReplaceAll(s, "|", "\\|"), "\n", " ")
+	}
+	sourceNames := func(ids []string) string {
+		names := make([]string, 0, len(ids))
+		for _, id := range ids {
+			if sc := bySource[id]; sc != nil {
+				names = append(names, sc.SourceName)
+			}
+		}
+		if len(names) == 0 {
+			return "—"
+		}
+		return cell(strings.Join(names, "、"))
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "共 %d 个问题，其中 %d 个缺少充分的来源支持。\n\n", len(report.Questions), len(report.Weak))
+
+	b.WriteString("## 问题\n\n| # | 问题 | 支持程度 | 支持来源 | 说明 |\n| --- | --- | --- | --- | --- |\n")
+	for _, q := range report.Questions {
+		support, reason := coverageSupportLabels[q.Support], q.Reason
+		if q.Error != "" {
+			support, reason = "出错", q.Error
+		}
+		fmt.Fprintf(&b, "| %d | %s | %s | %s | %s |\n", q.Index+1, cell(q.Question), support, sourceNames(q.Sources), cell(reason))
+	}
+
+	b.WriteString("\n## 来源\n\n| 来源 | 支持的问题 | 被检索次数 |\n| --- | --- | --- |\n")
+	for _, sc := range report.Sources {
+		supported := make([]string, len(sc.Supported))
+		for i, index := range sc.Supported {
+			supported[i] = strconv.Itoa(index + 1)
+		}
+		list := strings.Join(supported, ", ")
+		if list == "" {
+			list = "—"
+		}
+		fmt.Fprintf(&b, "| %s | %s | %d |\n", cell(sc.SourceName), list, sc.Retrieved)
+	}
+	return b.String()
+}
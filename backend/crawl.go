@@ -0,0 +1,485 @@
+package backend
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/kataras/golog"
+	"golang.org/x/net/html"
+	"golang.org/x/net/html/charset"
+)
+
+// Limits of site crawls
+const (
+	crawlDefaultDepth = 2
+	crawlMaxDepth     = 5
+	crawlDefaultPages = 20
+	crawlMaxPageSize  = 5 << 20
+	// crawlDelay spaces the requests of a crawl, so that it doesn't hammer the site
+	crawlDelay = 200 * time.Millisecond
+)
+
+// crawlUserAgent identifies the crawler to sites and to their robots.txt
+const crawlUserAgent = "notex-crawler"
+
+var crawlHTTPClient = &http.Client{Timeout: 30 * time.Second}
+
+// crawlSkippedExtensions are links to files rather than pages
+var crawlSkippedExtensions = map[string]bool{
+	".pdf": true, ".zip": true, ".gz": true, ".tar": true, ".exe": true, ".dmg": true,
+	".png": true, ".jpg": true, ".jpeg": true, ".gif": true, ".svg": true, ".webp": true, ".ico": true,
+	".mp3": true, ".mp4": true, ".webm": true, ".css": true, ".js": true, ".json": true, ".xml": true,
+	".woff": true, ".woff2": true,
+}
+
+// crawlHiddenElements are the parts of a page that aren't its content. Their links are still
+// followed, as documentation sites list their pages in the navigation.
+var crawlHiddenElements = map[string]bool{
+	"nav": true, "header": true, "footer": true, "aside": true, "form": true,
+	"script": true, "style": true, "noscript": true, "svg": true, "template": true,
+}
+
+// CrawlOptions turns a URL source into a crawl of the site it links to, stored as "crawl" in
+// the metadata of the source
+type CrawlOptions struct {
+	MaxDepth   int    `json:"max_depth"`             // Links followed from the first page; 0 means 2
+	MaxPages   int    `json:"max_pages"`             // 0 means 20, at most CRAWL_MAX_PAGES
+	SameDomain *bool  `json:"same_domain,omitempty"` // Only follow links to the first page's host; default true
+	PathPrefix string `json:"path_prefix,omitempty"` // Only follow links to paths starting with it, such as "/docs/"
+	Merge      bool   `json:"merge"`                 // One source with a section per page, instead of a source per page
+	Pages      int    `json:"pages,omitempty"`       // Pages the last crawl read
+}
+
+// crawledPage is a page read by a crawl
+type crawledPage struct {
+	URL     string
+	Title   string
+	Content string
+}
+
+// normalizeCrawlOptions fills in the defaults of a crawl and checks its limits
+func normalizeCrawlOptions(opts *CrawlOptions, maxPages int) error {
+	switch {
+	case opts.MaxDepth < 0 || opts.MaxDepth > crawlMaxDepth:
+		return fmt.Errorf("max_depth must be between 1 and %d", crawlMaxDepth)
+	case opts.MaxPages < 0 || opts.MaxPages > maxPages:
+		return fmt.Errorf("max_pages must be between 1 and %d", maxPages)
+	}
+	if opts.MaxDepth == 0 {
+		opts.MaxDepth = crawlDefaultDepth
+	}
+	if opts.MaxPages == 0 {
+		opts.MaxPages = min(crawlDefaultPages, maxPages)
+	}
+	if opts.SameDomain == nil {
+		sameDomain := true
+		opts.SameDomain = &sameDomain
+	}
+	if opts.PathPrefix != "" && !strings.HasPrefix(opts.PathPrefix, "/") {
+		opts.PathPrefix = "/" + opts.PathPrefix
+	}
+	return nil
+}
+
+// sourceCrawlOptions returns the crawl of a source, if it was added as one
+func sourceCrawlOptions(source *Source) (CrawlOptions, bool) {
+	var opts CrawlOptions
+	value, ok := source.Metadata["crawl"]
+	if !ok {
+		return opts, false
+	}
+	data, err := json.Marshal(value)
+	if err != nil || json.Unmarshal(data, &opts) != nil {
+		return opts, false
+	}
+	return opts, true
+}
+
+// isCrawledPage reports whether a source is a page read by the crawler, from a crawl or a
+// sitemap, whose content is converted by it rather than by markitdown
+func isCrawledPage(source *Source) bool {
+	for _, key := range []string{"crawl", "crawl_root", "sitemap", "sitemap_root"} {
+		if _, ok := source.Metadata[key]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// crawlSite reads the pages of a site breadth first from start, following links up to the
+// depth and page limits of opts and skipping what the site's robots.txt disallows. Pages that
+// fail to load are skipped, except the first.
+func crawlSite(ctx context.Context, start string, opts CrawlOptions) ([]crawledPage, error) {
+	startURL, err := url.Parse(start)
+	if err != nil || (startURL.Scheme != "http" && startURL.Scheme != "https") {
+		return nil, fmt.Errorf("not a web page: %s", start)
+	}
+	disallowed := fetchRobotsDisallows(ctx, startURL)
+
+	type queued struct {
+		url   string
+		depth int
+	}
+	queue := []queued{{url: start}}
+	seen := map[string]bool{crawlKey(startURL): true}
+	var pages []crawledPage
+	for len(queue) > 0 && len(pages) < opts.MaxPages {
+		next := queue[0]
+		queue = queue[1:]
+		if len(pages) > 0 {
+			select {
+			case <-ctx.Done():
+				return pages, ctx.Err()
+			case <-time.After(crawlDelay):
+			}
+		}
+
+		page, links, err := fetchCrawlPage(ctx, next.url)
+		if err != nil {
+			if next.depth == 0 {
+				return nil, err
+			}
+			golog.Warnf("crawl of %s skipped %s: %v", start, next.url, err)
+			continue
+		}
+		if strings.TrimSpace(page.Content) != "" {
+			pages = append(pages, *page)
+		}
+		if next.depth >= opts.MaxDepth {
+			continue
+		}
+		for _, link := range links {
+			if key := crawlKey(link); !seen[key] && crawlAllowed(link, startURL, opts, disallowed) {
+				seen[key] = true
+				queue = append(queue, queued{url: link.String(), depth: next.depth + 1})
+			}
+		}
+	}
+	if len(pages) == 0 {
+		return nil, fmt.Errorf("no text found on %s", start)
+	}
+	return pages, nil
+}
+
+// crawlKey identifies a page regardless of the fragment and a trailing slash
+func crawlKey(u *url.URL) string {
+	return strings.ToLower(u.Host) + strings.TrimSuffix(u.EscapedPath(), "/") + "?" + u.RawQuery
+}
+
+// crawlAllowed reports whether a crawl follows a link
+func crawlAllowed(link, start *url.URL, opts CrawlOptions, disallowed []string) bool {
+	if link.Scheme != "http" && link.Scheme != "https" {
+		return false
+	}
+	if (opts.SameDomain == nil || *opts.SameDomain) && !strings.EqualFold(link.Host, start.Host) {
+		return false
+	}
+	if opts.PathPrefix != "" && !strings.HasPrefix(link.Path, opts.PathPrefix) {
+		return false
+	}
+	if crawlSkippedExtensions[strings.ToLower(path.Ext(link.Path))] {
+		return false
+	}
+	// robots.txt rules are for the host they were fetched from
+	if strings.EqualFold(link.Host, start.Host) {
+		for _, prefix := range disallowed {
+			if strings.HasPrefix(link.EscapedPath(), prefix) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// fetchRobotsDisallows returns the paths a site's robots.txt disallows to all crawlers or to
+// ours. A missing or unreadable robots.txt allows everything.
+func fetchRobotsDisallows(ctx context.Context, site *url.URL) []string {
+	robotsURL := url.URL{Scheme: site.Scheme, Host: site.Host, Path: "/robots.txt"}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, robotsURL.String(), nil)
+	if err != nil {
+		return nil
+	}
+	req.Header.Set("User-Agent", crawlUserAgent)
+	resp, err := crawlHTTPClient.Do(req)
+	if err != nil {
+		return nil
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil
+	}
+
+	// Rules of consecutive User-agent lines apply to all of them
+	var all, ours []string
+	var agents []string
+	hasOurs := false // Whether a group names our crawler, in which case the * group is ignored
+	inRules := false
+	scanner := bufio.NewScanner(io.LimitReader(resp.Body, 512<<10))
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		field, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		field, value = strings.ToLower(strings.TrimSpace(field)), strings.TrimSpace(value)
+		switch field {
+		case "user-agent":
+			if inRules {
+				agents = nil
+				inRules = false
+			}
+			agent := strings.ToLower(value)
+			agents = append(agents, agent)
+			hasOurs = hasOurs || (agent != "*" && strings.HasPrefix(crawlUserAgent, agent))
+		case "disallow":
+			inRules = true
+			if value == "" {
+				continue
+			}
+			for _, agent := range agents {
+				switch {
+				case agent == "*":
+					all = append(all, value)
+				case strings.HasPrefix(crawlUserAgent, agent):
+					ours = append(ours, value)
+				}
+			}
+		default:
+			inRules = true
+		}
+	}
+	if hasOurs {
+		return ours
+	}
+	return all
+}
+
+// fetchHTML fetches and parses a web page, decoding its charset. It returns the page and the
+// URL it redirected to.
+func fetchHTML(ctx context.Context, pageURL, userAgent string) (*html.Node, *url.URL, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, pageURL, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	req.Header.Set("User-Agent", userAgent)
+	req.Header.Set("Accept", "text/html,application/xhtml+xml")
+	resp, err := crawlHTTPClient.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("%s returned %s", pageURL, resp.Status)
+	}
+	contentType := resp.Header.Get("Content-Type")
+	if mediaType, _, _ := mime.ParseMediaType(contentType); mediaType != "text/html" && mediaType != "application/xhtml+xml" {
+		return nil, nil, fmt.Errorf("%s is not a web page (%s)", pageURL, contentType)
+	}
+	body, err := charset.NewReader(io.LimitReader(resp.Body, crawlMaxPageSize), contentType)
+	if err != nil {
+		return nil, nil, err
+	}
+	doc, err := html.Parse(body)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid page %s: %w", pageURL, err)
+	}
+	return doc, resp.Request.URL, nil
+}
+
+// fetchCrawlPage reads a web page and returns its text and the links on it
+func fetchCrawlPage(ctx context.Context, pageURL string) (*crawledPage, []*url.URL, error) {
+	doc, finalURL, err := fetchHTML(ctx, pageURL, crawlUserAgent)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Links resolve against the page it redirected to, or its <base>
+	base := finalURL
+	var title string
+	var links []*url.URL
+	var content *html.Node // <main> or <article>, else <body>
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.ElementNode {
+			switch n.Data {
+			case "base":
+				if href := attrValue(n, "href"); href != "" {
+					if resolved, err := base.Parse(href); err == nil {
+						base = resolved
+					}
+				}
+			case "title":
+				if title == "" && n.FirstChild != nil {
+					title = strings.Join(strings.Fields(n.FirstChild.Data), " ")
+				}
+			case "a":
+				if href := attrValue(n, "href"); href != "" && !strings.Contains(attrValue(n, "rel"), "nofollow") {
+					if link, err := base.Parse(href); err == nil {
+						link.Fragment = ""
+						links = append(links, link)
+					}
+				}
+			case "main", "article":
+				if content == nil || content.Data == "body" {
+					content = n
+				}
+			case "body":
+				if content == nil {
+					content = n
+				}
+			}
+			if attrValue(n, "role") == "main" && (content == nil || content.Data == "body") {
+				content = n
+			}
+		}
+		for child := n.FirstChild; child != nil; child = child.NextSibling {
+			walk(child)
+		}
+	}
+	walk(doc)
+
+	page := &crawledPage{URL: finalURL.String(), Title: title}
+	if content != nil {
+		removeCrawlHidden(content)
+		var buf bytes.Buffer
+		if err := html.Render(&buf, content); err != nil {
+			return nil, nil, err
+		}
+		// Pages read like the storage format of Confluence pages
+		page.Content = confluenceText(buf.String())
+	}
+	// A <title> is often the page's heading followed by the site's name
+	if heading := firstHeading(page.Content); heading != "" && (page.Title == "" || strings.Contains(page.Title, heading)) {
+		page.Title = heading
+	}
+	if page.Title == "" {
+		page.Title = page.URL
+	}
+	return page, links, nil
+}
+
+// attrValue returns the value of an attribute of an HTML element
+func attrValue(n *html.Node, key string) string {
+	for _, a := range n.Attr {
+		if a.Key == key {
+			return a.Val
+		}
+	}
+	return ""
+}
+
+// removeCrawlHidden removes the elements that aren't content from a page
+func removeCrawlHidden(n *html.Node) {
+	for child := n.FirstChild; child != nil; {
+		next := child.NextSibling
+		if child.Type == html.ElementNode && (crawlHiddenElements[child.Data] || attrValue(child, "aria-hidden") == "true") {
+			n.RemoveChild(child)
+		} else if child.Type == html.CommentNode {
+			n.RemoveChild(child)
+		} else {
+			removeCrawlHidden(child)
+		}
+		child = next
+	}
+}
+
+// mergeCrawledPages joins the pages of a crawl into the content of one source, each page a
+// section under its title, so that citations name the page
+func mergeCrawledPages(pages []crawledPage) string {
+	var b strings.Builder
+	for i, page := range pages {
+		if i > 0 {
+			b.WriteString("\n\n")
+		}
+		// The page's own heading gives way to the section's
+		text := page.Content
+		first, rest, _ := strings.Cut(text, "\n")
+		if m := atxHeadingRe.FindStringSubmatch(first); m != nil && cleanHeading(m[2]) == page.Title {
+			text = strings.TrimSpace(rest)
+		}
+		b.WriteString(epubChapterBreak + page.Title + "\n\n" + page.URL + "\n\n" + text)
+	}
+	return b.String() + "\n"
+}
+
+// ingestCrawl crawls the site of a URL source. A merged crawl becomes the content of the
+// source; otherwise the source keeps the first page and each other page is added as a source
+// of its own, skipping pages the notebook already has.
+func (s *Server) ingestCrawl(ctx context.Context, userID string, source *Source) error {
+	opts, _ := sourceCrawlOptions(source)
+	pages, err := crawlSite(ctx, source.URL, opts)
+	if err != nil {
+		return fmt.Errorf("failed to crawl site: %w", err)
+	}
+	opts.Pages = len(pages)
+	source.Metadata["crawl"] = opts
+	if opts.Merge {
+		source.Content = mergeCrawledPages(pages)
+		return nil
+	}
+	source.Content = pages[0].Content
+
+	existing, err := s.store.ListSources(ctx, source.NotebookID)
+	if err != nil {
+		return err
+	}
+	known := make(map[string]bool, len(existing))
+	for _, src := range existing {
+		known[src.URL] = true
+	}
+	for _, page := range pages[1:] {
+		if known[page.URL] {
+			continue
+		}
+		known[page.URL] = true
+		pageSource := &Source{
+			NotebookID: source.NotebookID,
+			Name:       page.Title,
+			Type:       "url",
+			URL:        page.URL,
+			Content:    page.Content,
+			Metadata:   map[string]interface{}{"crawl_root": source.ID},
+		}
+		if err := s.captureSource(ctx, pageSource, &ActivityLog{UserID: userID, Action: "add_source", UserAgent: crawlUserAgent}); err != nil {
+			return fmt.Errorf("failed to add %s: %w", page.URL, err)
+		}
+	}
+	return nil
+}
+
+// fetchURLSource fetches the current content of a URL source. A merged crawl is crawled again,
+// a sitemap lists its pages again, and a crawled page is read the way the crawler reads it.
+func (s *Server) fetchURLSource(ctx context.Context, source *Source) (string, error) {
+	if opts, ok := sourceSitemapOptions(source); ok {
+		pages, err := sitemapPages(ctx, source.URL, opts)
+		if err != nil {
+			return "", err
+		}
+		return sitemapListing(source.URL, pages), nil
+	}
+	if opts, ok := sourceCrawlOptions(source); ok && opts.Merge {
+		pages, err := crawlSite(ctx, source.URL, opts)
+		if err != nil {
+			return "", err
+		}
+		return mergeCrawledPages(pages), nil
+	}
+	if isCrawledPage(source) {
+		page, _, err := fetchCrawlPage(ctx, source.URL)
+		if err != nil {
+			return "", err
+		}
+		return page.Content, nil
+	}
+	return s.extractURL(ctx, source, "")
+}
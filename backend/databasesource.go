@@ -0,0 +1,585 @@
+package backend
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kataras/golog"
+)
+
+const (
+	// databaseToolName is the function name of the built-in tool that queries database sources
+	databaseToolName = "query_database"
+	// databaseQueryTimeout bounds how long connecting to a database source and a query take
+	databaseQueryTimeout = 10 * time.Second
+	// databaseMaxDescribed bounds the runes of each database's tables in the tool description
+	databaseMaxDescribed = 4000
+)
+
+// databaseBlockedNames are identifier prefixes a query may not use: the system catalogs, and
+// functions that read server files, reach other databases or run queries given as strings
+var databaseBlockedNames = []string{"sqlite_", "pg_", "information_schema", "load_extension", "dblink", "lo_", "ts_stat"}
+
+// databaseBlockedWords are identifiers a query may not use anywhere: the functions that render
+// tables or queries given as strings as XML, and PostgreSQL's casts of strings to object IDs,
+// through which a string literal names a table
+var databaseBlockedWords = []string{"_to_xml", "regclass", "regproc", "regprocedure", "regtype", "regnamespace", "regoper", "regoperator", "regrole"}
+
+// DatabaseSourceRequest connects a database source. Tables lists the tables and views the chat
+// may query, as "name" or "schema.name".
+type DatabaseSourceRequest struct {
+	DSN    string   `json:"dsn"`
+	Tables []string `json:"tables"`
+}
+
+// dbRelation is a table or view of a database source
+type dbRelation struct {
+	schema string // Empty for SQLite
+	name   string
+}
+
+// qualifiedName names a relation the way the tool description lists it, leaving out PostgreSQL's
+// default schema
+func (r dbRelation) qualifiedName() string {
+	if r.schema == "" || r.schema == "public" {
+		return r.name
+	}
+	return r.schema + "." + r.name
+}
+
+// allowedIn reports whether a relation is one of the allowed tables
+func (r dbRelation) allowedIn(tables []string) bool {
+	for _, table := range tables {
+		table = strings.ToLower(strings.TrimSpace(table))
+		if table == strings.ToLower(r.qualifiedName()) || (r.schema != "" && table == strings.ToLower(r.schema+"."+r.name)) {
+			return true
+		}
+	}
+	return false
+}
+
+// databaseSourcesEnabled reports whether an administrator allowed any database to be a source
+func (s *Server) databaseSourcesEnabled() bool {
+	return len(s.cfg.DatabaseSourceHosts) > 0 || s.cfg.DatabaseSourceDir != ""
+}
+
+// databaseDriver checks that a DSN names a database allowed to be a source and returns its
+// driver. It runs when a source is added and again whenever it is opened, since the allowlist
+// can change.
+func (s *Server) databaseDriver(dsn string) (string, error) {
+	if !s.databaseSourcesEnabled() {
+		return "", fmt.Errorf("database sources are disabled, set DATABASE_SOURCE_HOSTS or DATABASE_SOURCE_DIR to enable them")
+	}
+	switch {
+	case strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://"):
+		u, err := url.Parse(dsn)
+		if err != nil || u.Host == "" {
+			return "", fmt.Errorf("invalid postgres URL")
+		}
+		if !hostAllowed(u.Hostname(), s.cfg.DatabaseSourceHosts) {
+			return "", fmt.Errorf("host %s is not in DATABASE_SOURCE_HOSTS", u.Hostname())
+		}
+		return "postgres", nil
+	case strings.HasPrefix(dsn, "sqlite:"):
+		if _, err := s.databasePath(dsn); err != nil {
+			return "", err
+		}
+		return "sqlite", nil
+	default:
+		return "", fmt.Errorf("dsn must be a postgres:// URL or sqlite:<file>")
+	}
+}
+
+// databasePath resolves the file of a sqlite: DSN, which must be in DATABASE_SOURCE_DIR.
+// Relative paths are relative to that directory.
+func (s *Server) databasePath(dsn string) (string, error) {
+	if s.cfg.DatabaseSourceDir == "" {
+		return "", fmt.Errorf("SQLite sources are disabled, set DATABASE_SOURCE_DIR to enable them")
+	}
+	dir, err := filepath.EvalSymlinks(s.cfg.DatabaseSourceDir)
+	if err != nil {
+		return "", fmt.Errorf("DATABASE_SOURCE_DIR not found")
+	}
+	if dir, err = filepath.Abs(dir); err != nil {
+		return "", err
+	}
+	path := strings.TrimPrefix(strings.TrimPrefix(dsn, "sqlite:"), "//")
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(dir, path)
+	}
+	path, err = filepath.EvalSymlinks(path)
+	if err != nil {
+		return "", fmt.Errorf("database file not found")
+	}
+	rel, err := filepath.Rel(dir, path)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("database file must be in DATABASE_SOURCE_DIR")
+	}
+	return path, nil
+}
+
+// openSourceDatabase opens a database source read-only: SQLite files are opened in read-only
+// mode, and PostgreSQL sessions only allow read-only transactions
+func (s *Server) openSourceDatabase(database *SourceDatabase) (*sql.DB, error) {
+	driver, err := s.databaseDriver(database.DSN)
+	if err != nil {
+		return nil, err
+	}
+	var db *sql.DB
+	switch driver {
+	case "sqlite":
+		path, err := s.databasePath(database.DSN)
+		if err != nil {
+			return nil, err
+		}
+		u := url.URL{Scheme: "file", Path: path, RawQuery: "mode=ro&_pragma=query_only(1)&_pragma=busy_timeout(5000)"}
+		if db, err = sql.Open("sqlite", u.String()); err != nil {
+			return nil, err
+		}
+	case "postgres":
+		if !slices.Contains(sql.Drivers(), pgvectorDriver) {
+			return nil, fmt.Errorf("postgres database sources need a build with the pgx driver (-tags pgvector)")
+		}
+		u, _ := url.Parse(database.DSN)
+		q := u.Query()
+		q.Set("default_transaction_read_only", "on")
+		// Backslashes in string literals are literal, as checkDatabaseQuery reads them
+		q.Set("standard_conforming_strings", "on")
+		q.Set("statement_timeout", fmt.Sprint(databaseQueryTimeout.Milliseconds()))
+		u.RawQuery = q.Encode()
+		if db, err = sql.Open(pgvectorDriver, u.String()); err != nil {
+			return nil, err
+		}
+	}
+	db.SetMaxOpenConns(1)
+	return db, nil
+}
+
+// databaseRelations lists the tables and views of a database, without their columns
+func databaseRelations(ctx context.Context, db *sql.DB, driver string) ([]dbRelation, error) {
+	query := `SELECT '', name FROM sqlite_master WHERE type IN ('table', 'view') AND name NOT LIKE 'sqlite_%' ORDER BY name`
+	if driver == "postgres" {
+		query = `SELECT table_schema, table_name FROM information_schema.tables
+			WHERE table_schema NOT IN ('pg_catalog', 'information_schema') ORDER BY table_schema, table_name`
+	}
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var relations []dbRelation
+	for rows.Next() {
+		var r dbRelation
+		if err := rows.Scan(&r.schema, &r.name); err != nil {
+			return nil, err
+		}
+		relations = append(relations, r)
+	}
+	return relations, rows.Err()
+}
+
+// checkDatabaseGrants verifies that a PostgreSQL role can read no table or view but the allowed
+// ones, which is what keeps queries to them; checkDatabaseQuery only turns down the queries
+// that obviously reach further. SQLite files have no roles, and are only read through
+// checkDatabaseQuery.
+func checkDatabaseGrants(ctx context.Context, db *sql.DB, driver string, tables []string) error {
+	if driver != "postgres" {
+		return nil
+	}
+	rows, err := db.QueryContext(ctx, `SELECT n.nspname, c.relname FROM pg_catalog.pg_class c
+		JOIN pg_catalog.pg_namespace n ON n.oid = c.relnamespace
+		WHERE c.relkind IN ('r', 'v', 'm', 'f', 'p')
+			AND n.nspname NOT IN ('pg_catalog', 'information_schema') AND n.nspname NOT LIKE 'pg_toast%'
+			AND (has_table_privilege(c.oid, 'SELECT') OR has_any_column_privilege(c.oid, 'SELECT'))
+		ORDER BY n.nspname, c.relname`)
+	if err != nil {
+		return fmt.Errorf("failed to check the role's privileges: %w", err)
+	}
+	defer rows.Close()
+
+	var readable []string
+	for rows.Next() {
+		var r dbRelation
+		if err := rows.Scan(&r.schema, &r.name); err != nil {
+			return err
+		}
+		if !r.allowedIn(tables) {
+			readable = append(readable, r.qualifiedName())
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(readable) > 0 {
+		return fmt.Errorf("the database role can also read %s; connect as a role granted SELECT on the allowed tables only", strings.Join(readable, ", "))
+	}
+	return nil
+}
+
+// relationColumns lists the columns of a table or view as "name type"
+func relationColumns(ctx context.Context, db *sql.DB, driver string, r dbRelation) ([]string, error) {
+	query, args := `SELECT name, type FROM pragma_table_info(?)`, []any{r.name}
+	if driver == "postgres" {
+		query = `SELECT column_name, data_type FROM information_schema.columns
+			WHERE table_schema = $1 AND table_name = $2 ORDER BY ordinal_position`
+		args = []any{r.schema, r.name}
+	}
+	rows, err := db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var columns []string
+	for rows.Next() {
+		var name, kind string
+		if err := rows.Scan(&name, &kind); err != nil {
+			return nil, err
+		}
+		columns = append(columns, strings.TrimSpace(name+" "+kind))
+	}
+	return columns, rows.Err()
+}
+
+// describeDatabase introspects the allowed tables of a database source, returning them with
+// their columns as the source's content
+func (s *Server) describeDatabase(ctx context.Context, database *SourceDatabase) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, databaseQueryTimeout)
+	defer cancel()
+	db, err := s.openSourceDatabase(database)
+	if err != nil {
+		return "", err
+	}
+	defer db.Close()
+
+	if err := checkDatabaseGrants(ctx, db, database.Driver, database.Tables); err != nil {
+		return "", err
+	}
+	relations, err := databaseRelations(ctx, db, database.Driver)
+	if err != nil {
+		return "", fmt.Errorf("failed to list tables: %w", err)
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "Live %s database with these tables:\n\n", database.Driver)
+	for _, table := range database.Tables {
+		i := slices.IndexFunc(relations, func(r dbRelation) bool { return r.allowedIn([]string{table}) })
+		if i < 0 {
+			return "", fmt.Errorf("table %s not found", table)
+		}
+		columns, err := relationColumns(ctx, db, database.Driver, relations[i])
+		if err != nil {
+			return "", fmt.Errorf("failed to list columns of %s: %w", table, err)
+		}
+		fmt.Fprintf(&b, "%s (%s)\n", relations[i].qualifiedName(), strings.Join(columns, ", "))
+	}
+	return b.String(), nil
+}
+
+// prepareDatabaseSource checks a database source's connection and tables, returning the
+// connection to store and the source's content
+func (s *Server) prepareDatabaseSource(ctx context.Context, req *DatabaseSourceRequest) (*SourceDatabase, string, error) {
+	if req == nil || strings.TrimSpace(req.DSN) == "" {
+		return nil, "", fmt.Errorf("database.dsn is required")
+	}
+	var tables []string
+	for _, table := range req.Tables {
+		if table = strings.TrimSpace(table); table != "" && !slices.Contains(tables, table) {
+			tables = append(tables, table)
+		}
+	}
+	if len(tables) == 0 {
+		return nil, "", fmt.Errorf("database.tables must list the tables the chat may query")
+	}
+	driver, err := s.databaseDriver(strings.TrimSpace(req.DSN))
+	if err != nil {
+		return nil, "", err
+	}
+	database := &SourceDatabase{Driver: driver, DSN: strings.TrimSpace(req.DSN), Tables: tables}
+	content, err := s.describeDatabase(ctx, database)
+	if err != nil {
+		return nil, "", err
+	}
+	return database, content, nil
+}
+
+// databaseSourceMetadata describes the connection of a database source in its metadata,
+// leaving out the DSN
+func databaseSourceMetadata(metadata map[string]interface{}, database *SourceDatabase) map[string]interface{} {
+	if metadata == nil {
+		metadata = make(map[string]interface{})
+	}
+	metadata["driver"] = database.Driver
+	metadata["tables"] = database.Tables
+	return metadata
+}
+
+// refreshDatabaseSource introspects the tables of a database source again, keeping its previous
+// content as a version
+func (s *Server) refreshDatabaseSource(c *gin.Context, source *Source) {
+	ctx := c.Request.Context()
+	database, err := s.store.GetSourceDatabase(ctx, source.ID)
+	if err != nil || database == nil {
+		c.JSON(http.StatusNotFound, ErrorResponse{Error: "Database connection not found"})
+		return
+	}
+	content, err := s.describeDatabase(ctx, database)
+	if err != nil {
+		golog.Errorf("failed to describe database of source %s: %v", source.ID, err)
+		c.JSON(http.StatusBadGateway, ErrorResponse{Error: "Failed to read database tables", Details: err.Error()})
+		return
+	}
+
+	version, err := s.replaceSourceContent(ctx, source, content, source.FileName, source.FileSize)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to update source", Details: err.Error()})
+		return
+	}
+	s.logSourceChange(c, "refresh_source", source, version)
+
+	c.JSON(http.StatusOK, sourceRefreshResponse{Source: summarizeSources([]Source{*source})[0], Changed: version != nil, Version: version})
+}
+
+// databaseTool describes the built-in database query tool to the model, listing each database
+// with its allowed tables
+func databaseTool(notebookID string, databases []SourceDatabase) ChatTool {
+	var b strings.Builder
+	b.WriteString("Runs a read-only SQL query on the notebook's live databases and returns up to 50 rows of the result as CSV. " +
+		"Use it for questions about current data held in these databases. Write a single SELECT statement in the " +
+		"database's SQL dialect, using only the tables listed.\n\nDatabases:")
+	names := make([]string, len(databases))
+	for i, database := range databases {
+		names[i] = database.SourceName
+		fmt.Fprintf(&b, "\n\n%q (%s)\n%s", database.SourceName, database.Driver,
+			strings.TrimSpace(truncateRunes(database.Schema, databaseMaxDescribed)))
+	}
+
+	properties := map[string]interface{}{
+		"sql": map[string]interface{}{"type": "string", "description": "A single SELECT statement"},
+	}
+	required := []string{"sql"}
+	if len(databases) > 1 {
+		properties["database"] = map[string]interface{}{"type": "string", "enum": names, "description": "The database to query"}
+		required = append(required, "database")
+	}
+	return ChatTool{
+		NotebookID:  notebookID,
+		Name:        databaseToolName,
+		Description: b.String(),
+		Parameters: map[string]interface{}{
+			"type":       "object",
+			"properties": properties,
+			"required":   required,
+		},
+		Enabled: true,
+	}
+}
+
+// sqlToken is a token of a query: an identifier or keyword, or a punctuation character.
+// String literals and comments are dropped.
+type sqlToken struct {
+	text  string // Lowercased, without the quotes of a quoted identifier
+	ident bool
+}
+
+// sqlTokens splits a query into tokens, understanding the quoting of SQLite and PostgreSQL
+func sqlTokens(query string) ([]sqlToken, error) {
+	runes := []rune(query)
+	var tokens []sqlToken
+	// skipTo moves past the closing delimiter of a quoted span starting at i, returning the
+	// position after it and the span's content
+	skipTo := func(i int, closing string) (int, string, error) {
+		end := strings.Index(string(runes[i:]), closing)
+		if end < 0 {
+			return 0, "", fmt.Errorf("unterminated quote or comment")
+		}
+		content := []rune(string(runes[i:])[:end])
+		return i + len(content) + len([]rune(closing)), string(content), nil
+	}
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		var err error
+		var content string
+		switch {
+		case r == ' ' || r == '\t' || r == '\n' || r == '\r':
+			i++
+		case r == '-' && i+1 < len(runes) && runes[i+1] == '-':
+			if i, _, err = skipTo(i, "\n"); err != nil {
+				i = len(runes)
+			}
+		case r == '/' && i+1 < len(runes) && runes[i+1] == '*':
+			if i, _, err = skipTo(i+2, "*/"); err != nil {
+				return nil, err
+			}
+		case (i == 0 || !isIdentRune(runes[i-1])) &&
+			((r == 'e' || r == 'E') && i+1 < len(runes) && runes[i+1] == '\'' ||
+				(r == 'u' || r == 'U') && i+2 < len(runes) && runes[i+1] == '&' && (runes[i+2] == '\'' || runes[i+2] == '"')):
+			// PostgreSQL's escape strings, E'\'', and Unicode escapes, U&'...' and U&"...", end
+			// where this tokenizer can't tell, hiding the names that follow them
+			return nil, fmt.Errorf("escape string literals are not allowed")
+		case r == '\'':
+			// Doubled quotes inside a literal read as two adjacent literals
+			if i, _, err = skipTo(i+1, "'"); err != nil {
+				return nil, err
+			}
+		case r == '"' || r == '`' || r == '[':
+			closing := map[rune]string{'"': `"`, '`': "`", '[': "]"}[r]
+			if i, content, err = skipTo(i+1, closing); err != nil {
+				return nil, err
+			}
+			tokens = append(tokens, sqlToken{text: strings.ToLower(content), ident: true})
+		case r == '$' && i+1 < len(runes) && (runes[i+1] == '$' || isIdentRune(runes[i+1])):
+			// A PostgreSQL dollar-quoted string: $tag$ ... $tag$
+			j := i + 1
+			for j < len(runes) && isIdentRune(runes[j]) {
+				j++
+			}
+			if j < len(runes) && runes[j] == '$' {
+				if i, _, err = skipTo(j+1, string(runes[i:j+1])); err != nil {
+					return nil, err
+				}
+			} else {
+				// A positional parameter such as $1
+				i = j
+			}
+		case isIdentRune(r):
+			j := i
+			for j < len(runes) && (isIdentRune(runes[j]) || runes[j] == '$') {
+				j++
+			}
+			tokens = append(tokens, sqlToken{text: strings.ToLower(string(runes[i:j])), ident: true})
+			i = j
+		default:
+			tokens = append(tokens, sqlToken{text: string(r)})
+			i++
+		}
+	}
+	return tokens, nil
+}
+
+func isIdentRune(r rune) bool {
+	return r == '_' || (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') || r > 127
+}
+
+// checkDatabaseQuery verifies that a query is a single SELECT statement that names none of the
+// database's tables but the allowed ones, nor a system catalog. A column or alias that shares
+// the name of a table that isn't allowed is rejected too.
+func checkDatabaseQuery(query string, relations []dbRelation, tables []string) error {
+	tokens, err := sqlTokens(query)
+	if err != nil {
+		return err
+	}
+	if len(tokens) == 0 || !tokens[0].ident || (tokens[0].text != "select" && tokens[0].text != "with") {
+		return fmt.Errorf("only a single SELECT statement is allowed")
+	}
+
+	// Names of tables that aren't allowed, unless an allowed table in another schema shares them,
+	// and the allowance of every schema-qualified name
+	forbidden := make(map[string]bool)
+	qualified := make(map[string]bool)
+	for _, r := range relations {
+		name := strings.ToLower(r.name)
+		allowed := r.allowedIn(tables)
+		if !allowed {
+			if _, ok := forbidden[name]; !ok {
+				forbidden[name] = true
+			}
+		} else {
+			forbidden[name] = false
+		}
+		if r.schema != "" {
+			qualified[strings.ToLower(r.schema)+"."+name] = allowed
+		}
+	}
+
+	for i, token := range tokens {
+		if token.text == ";" {
+			return fmt.Errorf("only a single SELECT statement is allowed")
+		}
+		if !token.ident {
+			continue
+		}
+		for _, blocked := range databaseBlockedNames {
+			if strings.HasPrefix(token.text, blocked) {
+				return fmt.Errorf("queries may not use %s", token.text)
+			}
+		}
+		for _, blocked := range databaseBlockedWords {
+			if token.text == blocked || (strings.HasPrefix(blocked, "_") && strings.Contains(token.text, blocked)) {
+				return fmt.Errorf("queries may not use %s", token.text)
+			}
+		}
+		if forbidden[token.text] {
+			return fmt.Errorf("table %s is not allowed", token.text)
+		}
+		if i+2 < len(tokens) && tokens[i+1].text == "." && tokens[i+2].ident {
+			name := token.text + "." + tokens[i+2].text
+			if allowed, ok := qualified[name]; ok && !allowed {
+				return fmt.Errorf("table %s is not allowed", name)
+			}
+		}
+	}
+	return nil
+}
+
+// queryDatabase runs a SELECT query the model wrote on one of the notebook's database sources,
+// returning the result as CSV
+func (s *Server) queryDatabase(ctx context.Context, databases []SourceDatabase, arguments string) (string, error) {
+	var args struct {
+		Database string `json:"database"`
+		SQL      string `json:"sql"`
+	}
+	if err := json.Unmarshal([]byte(arguments), &args); err != nil {
+		return "", fmt.Errorf("arguments must be a JSON object with a sql field")
+	}
+	i := 0
+	if len(databases) > 1 || args.Database != "" {
+		i = slices.IndexFunc(databases, func(d SourceDatabase) bool { return strings.EqualFold(d.SourceName, args.Database) })
+		if i < 0 {
+			return "", fmt.Errorf("unknown database %q", args.Database)
+		}
+	}
+	database := &databases[i]
+
+	ctx, cancel := context.WithTimeout(ctx, databaseQueryTimeout)
+	defer cancel()
+	db, err := s.openSourceDatabase(database)
+	if err != nil {
+		return "", err
+	}
+	defer db.Close()
+
+	// Grants can change after the source is added
+	if err := checkDatabaseGrants(ctx, db, database.Driver, database.Tables); err != nil {
+		return "", err
+	}
+	relations, err := databaseRelations(ctx, db, database.Driver)
+	if err != nil {
+		return "", fmt.Errorf("failed to list tables: %w", err)
+	}
+	query := strings.TrimRight(strings.TrimSpace(args.SQL), "; \t\r\n")
+	if err := checkDatabaseQuery(query, relations, database.Tables); err != nil {
+		return "", err
+	}
+
+	tx, err := db.BeginTx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+	rows, err := tx.QueryContext(ctx, query)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+	return queryResultCSV(rows)
+}
@@ -0,0 +1,23 @@
+package backend
+
+import (
+	"os/exec"
+	"runtime"
+)
+
+// localUserEmail identifies the implicit user created for local desktop mode
+const localUserEmail = "local@notex.local"
+
+// OpenBrowser opens url in the user's default browser
+func OpenBrowser(url string) error {
+	var cmd *exec.Cmd
+	switch runtime.GOOS {
+	case "windows":
+		cmd = exec.Command("rundll32", "url.dll,FileProtocolHandler", url)
+	case "darwin":
+		cmd = exec.Command("open", url)
+	default:
+		cmd = exec.Command("xdg-open", url)
+	}
+	return cmd.Start()
+}
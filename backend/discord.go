@@ -0,0 +1,178 @@
+package backend
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kataras/golog"
+)
+
+const discordAPIBase = "https://discord.com/api/v10"
+
+// discordMaxMessageLength is Discord's limit on message content
+const discordMaxMessageLength = 2000
+
+// Discord interaction and response types used by the /notex command
+const (
+	discordInteractionPing               = 1
+	discordInteractionApplicationCommand = 2
+
+	discordResponsePong                    = 1
+	discordResponseChannelMessage          = 4
+	discordResponseDeferredChannelMessage  = 5
+	discordOptionSubCommand                = 1
+	discordOptionString                    = 3
+	discordApplicationCommandTypeChatInput = 1
+)
+
+// discordInteraction is the subset of an interaction payload the bot needs
+type discordInteraction struct {
+	Type          int    `json:"type"`
+	Token         string `json:"token"`
+	ApplicationID string `json:"application_id"`
+	Data          struct {
+		Name    string                `json:"name"`
+		Options []discordCommandInput `json:"options"`
+	} `json:"data"`
+}
+
+type discordCommandInput struct {
+	Name    string                `json:"name"`
+	Type    int                   `json:"type"`
+	Value   any                   `json:"value"`
+	Options []discordCommandInput `json:"options"`
+}
+
+// discordPublicKey decodes the hex-encoded application public key
+func discordPublicKey(key string) (ed25519.PublicKey, error) {
+	raw, err := hex.DecodeString(key)
+	if err != nil || len(raw) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid Discord public key")
+	}
+	return ed25519.PublicKey(raw), nil
+}
+
+// verifyDiscordSignature checks the Ed25519 signature Discord puts on every interaction
+func verifyDiscordSignature(publicKey string, header http.Header, body []byte) bool {
+	key, err := discordPublicKey(publicKey)
+	if err != nil {
+		return false
+	}
+	sig, err := hex.DecodeString(header.Get("X-Signature-Ed25519"))
+	if err != nil || len(sig) != ed25519.SignatureSize {
+		return false
+	}
+	message := append([]byte(header.Get("X-Signature-Timestamp")), body...)
+	return ed25519.Verify(key, message, sig)
+}
+
+// discordCommand converts the /notex subcommand options into an integrationCommand
+func discordCommand(options []discordCommandInput) integrationCommand {
+	if len(options) == 0 {
+		return integrationCommand{Action: "help"}
+	}
+
+	sub := options[0]
+	cmd := integrationCommand{Action: sub.Name}
+	for _, opt := range sub.Options {
+		value, _ := opt.Value.(string)
+		switch opt.Name {
+		case "notebook":
+			cmd.Notebook = value
+		case "question":
+			cmd.Question = value
+		}
+	}
+	return cmd
+}
+
+// handleDiscordInteraction handles the interactions endpoint of the Discord application.
+// Questions get a deferred response that is edited once the answer is ready.
+func (s *Server) handleDiscordInteraction(c *gin.Context) {
+	in, body, ok := s.loadIntegration(c, IntegrationDiscord)
+	if !ok {
+		return
+	}
+	if !verifyDiscordSignature(in.PublicKey, c.Request.Header, body) {
+		c.JSON(http.StatusUnauthorized, ErrorResponse{Error: "Invalid signature"})
+		return
+	}
+
+	var interaction discordInteraction
+	if err := json.Unmarshal(body, &interaction); err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid interaction"})
+		return
+	}
+
+	switch interaction.Type {
+	case discordInteractionPing:
+		c.JSON(http.StatusOK, gin.H{"type": discordResponsePong})
+		return
+	case discordInteractionApplicationCommand:
+	default:
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Unsupported interaction type"})
+		return
+	}
+
+	cmd := discordCommand(interaction.Data.Options)
+	if cmd.Action != "ask" {
+		c.JSON(http.StatusOK, gin.H{
+			"type": discordResponseChannelMessage,
+			"data": gin.H{"content": truncateDiscordMessage(s.runIntegrationCommand(c.Request.Context(), in.UserID, cmd))},
+		})
+		return
+	}
+
+	go func() {
+		ctx := context.Background()
+		answer := s.runIntegrationCommand(ctx, in.UserID, cmd)
+		url := fmt.Sprintf("%s/webhooks/%s/%s/messages/@original", discordAPIBase, interaction.ApplicationID, interaction.Token)
+		if _, err := postJSON(ctx, http.MethodPatch, url, gin.H{"content": truncateDiscordMessage(answer)}, nil); err != nil {
+			golog.Errorf("failed to post discord answer: %v", err)
+		}
+	}()
+
+	c.JSON(http.StatusOK, gin.H{"type": discordResponseDeferredChannelMessage})
+}
+
+// truncateDiscordMessage keeps a message within Discord's length limit
+func truncateDiscordMessage(text string) string {
+	return truncateRunes(text, discordMaxMessageLength)
+}
+
+// registerDiscordCommand registers the global /notex command of the Discord application
+func registerDiscordCommand(ctx context.Context, in *Integration) error {
+	stringOption := func(name, description string) gin.H {
+		return gin.H{"type": discordOptionString, "name": name, "description": description, "required": true}
+	}
+	command := gin.H{
+		"name":        "notex",
+		"type":        discordApplicationCommandTypeChatInput,
+		"description": "Ask questions about your Notex notebooks",
+		"options": []gin.H{
+			{
+				"type":        discordOptionSubCommand,
+				"name":        "ask",
+				"description": "Answer a question from a notebook's sources",
+				"options": []gin.H{
+					stringOption("notebook", "Notebook name"),
+					stringOption("question", "Your question"),
+				},
+			},
+			{
+				"type":        discordOptionSubCommand,
+				"name":        "list",
+				"description": "List your notebooks",
+			},
+		},
+	}
+
+	url := fmt.Sprintf("%s/applications/%s/commands", discordAPIBase, in.ApplicationID)
+	_, err := postJSON(ctx, http.MethodPut, url, []gin.H{command}, http.Header{"Authorization": {"Bot " + in.BotToken}})
+	return err
+}
@@ -0,0 +1,419 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kataras/golog"
+)
+
+// draftLengths maps a draft's length setting to the length asked of each section
+var draftLengths = map[string]string{
+	"short":  "约 300 字",
+	"medium": "约 600 字",
+	"long":   "约 1200 字",
+}
+
+// parseDraftOutline reads the document title ("# ") and the sections ("## ") of an outline.
+// Lines under a section heading become its points.
+func parseDraftOutline(outline string) (title string, sections []DraftSection) {
+	for _, line := range strings.Split(outline, "\n") {
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(trimmed, "## "):
+			sections = append(sections, DraftSection{Heading: strings.TrimSpace(trimmed[3:])})
+		case strings.HasPrefix(trimmed, "# ") && len(sections) == 0:
+			title = strings.TrimSpace(trimmed[2:])
+		case len(sections) > 0 && trimmed != "":
+			sections[len(sections)-1].Points += line + "\n"
+		}
+	}
+	for i := range sections {
+		sections[i].Points = strings.TrimRight(sections[i].Points, "\n")
+	}
+	return title, sections
+}
+
+// draftSources loads the sources a draft is written from
+func (s *Server) draftSources(ctx context.Context, job *DraftJob) ([]Source, error) {
+	sources, err := s.store.ListSources(ctx, job.NotebookID)
+	if err != nil {
+		return nil, err
+	}
+	if len(job.SourceIDs) > 0 {
+		selected := make(map[string]bool, len(job.SourceIDs))
+		for _, id := range job.SourceIDs {
+			selected[id] = true
+		}
+		filtered := make([]Source, 0, len(job.SourceIDs))
+		for _, src := range sources {
+			if selected[src.ID] {
+				filtered = append(filtered, src)
+			}
+		}
+		sources = filtered
+	}
+	if len(sources) == 0 {
+		return nil, fmt.Errorf("no sources available")
+	}
+	return sources, nil
+}
+
+// resumeDraftJobs restarts the draft jobs that were generating when the server stopped
+func (s *Server) resumeDraftJobs() {
+	jobs, err := s.store.ListActiveDraftJobs(context.Background())
+	if err != nil {
+		golog.Errorf("failed to list draft jobs: %v", err)
+		return
+	}
+	for _, job := range jobs {
+		golog.Infof("resuming draft %s (%s)", job.ID, job.Status)
+		go s.runDraftJob(job.ID)
+	}
+}
+
+// runDraftJob advances a draft job through its current stage: the outline, or the remaining
+// sections and the finished note. Failures are stored on the job so it can be resumed.
+func (s *Server) runDraftJob(id string) {
+	if _, running := s.draftJobs.LoadOrStore(id, true); running {
+		return
+	}
+	defer s.draftJobs.Delete(id)
+
+	ctx := context.Background()
+	job, err := s.store.GetDraftJob(ctx, id)
+	if err != nil {
+		golog.Errorf("failed to load draft %s: %v", id, err)
+		return
+	}
+	report := &ErrorReport{Component: "draft", UserID: job.UserID, NotebookID: job.NotebookID,
+		Extra: map[string]string{"draft_id": job.ID}}
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			s.reportPanic(recovered, report)
+			job.Status = DraftStatusFailed
+			job.Error = fmt.Sprintf("internal error: %v", recovered)
+			if err := s.store.SaveDraftJob(context.Background(), job); err != nil {
+				golog.Errorf("failed to save draft %s: %v", id, err)
+			}
+		}
+	}()
+	ctx = withUsageOperation(withUsageScope(ctx, job.UserID, job.NotebookID), "draft")
+
+	agent := s.currentAgent()
+	if agent == nil {
+		err = fmt.Errorf("LLM provider is not configured")
+	} else {
+		if err := s.loadNotebookVectorIndex(ctx, job.NotebookID); err != nil {
+			golog.Errorf("failed to load vector index: %v", err)
+		}
+		switch job.Status {
+		case DraftStatusOutlining:
+			err = s.outlineDraft(ctx, agent, job)
+		case DraftStatusDrafting:
+			err = s.writeDraft(ctx, agent, job)
+		}
+	}
+
+	if err != nil {
+		golog.Errorf("draft %s failed: %v", id, err)
+		report.Kind = "error"
+		report.Message = err.Error()
+		s.reportError(report)
+		job.Status = DraftStatusFailed
+		job.Error = err.Error()
+		if err := s.store.SaveDraftJob(ctx, job); err != nil {
+			golog.Errorf("failed to save draft %s: %v", id, err)
+		}
+	}
+}
+
+// outlineDraft generates the outline and waits for the user to approve it
+func (s *Server) outlineDraft(ctx context.Context, agent *Agent, job *DraftJob) error {
+	sources, err := s.draftSources(ctx, job)
+	if err != nil {
+		return err
+	}
+	req := &TransformationRequest{
+		Type:      "draft_outline",
+		Prompt:    job.Brief,
+		Length:    job.Length,
+		Format:    "markdown",
+		SourceIDs: job.SourceIDs,
+	}
+	response, err := agent.GenerateTransformation(ctx, req, sources)
+	if err != nil {
+		return err
+	}
+
+	job.Outline = response.Content
+	job.Status = DraftStatusAwaitingApproval
+	job.Error = ""
+	return s.store.SaveDraftJob(ctx, job)
+}
+
+// writeDraft writes the sections that aren't written yet, storing each one as it is done,
+// then assembles them into a note
+func (s *Server) writeDraft(ctx context.Context, agent *Agent, job *DraftJob) error {
+	for i := range job.Sections {
+		if job.Sections[i].Content != "" {
+			continue
+		}
+		content, citations, err := agent.WriteDraftSection(ctx, job, i)
+		if err != nil {
+			return err
+		}
+		job.Sections[i].Content = content
+		job.Citations = citations
+		if err := s.store.SaveDraftJob(ctx, job); err != nil {
+			return err
+		}
+	}
+
+	title, _ := parseDraftOutline(job.Outline)
+	if title == "" {
+		title = truncateRunes(job.Brief, 40)
+	}
+	var content strings.Builder
+	fmt.Fprintf(&content, "# %s\n\n", title)
+	for _, section := range job.Sections {
+		fmt.Fprintf(&content, "## %s\n\n%s\n\n", section.Heading, section.Content)
+	}
+
+	sources, err := s.draftSources(ctx, job)
+	if err != nil {
+		return err
+	}
+	sourceIDs := make([]string, len(sources))
+	for i, src := range sources {
+		sourceIDs[i] = src.ID
+	}
+
+	note := &Note{
+		NotebookID: job.NotebookID,
+		Title:      title,
+		Content:    strings.TrimSpace(content.String()),
+		Type:       "draft",
+		SourceIDs:  sourceIDs,
+		Metadata:   map[string]interface{}{"length": job.Length, "draft_id": job.ID, "citations": job.Citations},
+	}
+	if err := s.store.CreateNote(ctx, note); err != nil {
+		return err
+	}
+
+	job.NoteID = note.ID
+	job.Status = DraftStatusCompleted
+	job.Error = ""
+	return s.store.SaveDraftJob(ctx, job)
+}
+
+// notebookDraft loads a draft job of the notebook in the request, answering 403 or 404 itself
+func (s *Server) notebookDraft(c *gin.Context) (*DraftJob, bool) {
+	ctx := c.Request.Context()
+	notebookID := c.Param("id")
+	if err := s.checkNotebookAccess(ctx, notebookID, c.GetString("user_id")); err != nil {
+		c.JSON(http.StatusForbidden, ErrorResponse{Error: "Access denied"})
+		return nil, false
+	}
+	job, err := s.store.GetDraftJob(ctx, c.Param("draftId"))
+	if err != nil || job.NotebookID != notebookID {
+		c.JSON(http.StatusNotFound, ErrorResponse{Error: "Draft not found"})
+		return nil, false
+	}
+	return job, true
+}
+
+func (s *Server) handleListDrafts(c *gin.Context) {
+	ctx := c.Request.Context()
+	notebookID := c.Param("id")
+	if err := s.checkNotebookAccess(ctx, notebookID, c.GetString("user_id")); err != nil {
+		c.JSON(http.StatusForbidden, ErrorResponse{Error: "Access denied"})
+		return
+	}
+	jobs, err := s.store.ListDraftJobs(ctx, notebookID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to list drafts"})
+		return
+	}
+	c.JSON(http.StatusOK, jobs)
+}
+
+// handleCreateDraft starts a draft job; its outline is generated in the background
+func (s *Server) handleCreateDraft(c *gin.Context) {
+	ctx := context.Background()
+	notebookID := c.Param("id")
+	userID := c.GetString("user_id")
+	if err := s.checkNotebookAccess(ctx, notebookID, userID); err != nil {
+		c.JSON(http.StatusForbidden, ErrorResponse{Error: "Access denied"})
+		return
+	}
+
+	var req DraftRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+		return
+	}
+	if req.Length == "" {
+		req.Length = "medium"
+	}
+	if _, ok := draftLengths[req.Length]; !ok {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "length must be short, medium or long"})
+		return
+	}
+	if _, ok := s.requireAgent(c); !ok {
+		return
+	}
+
+	job := &DraftJob{
+		NotebookID: notebookID,
+		UserID:     userID,
+		Brief:      strings.TrimSpace(req.Brief),
+		Length:     req.Length,
+		SourceIDs:  req.SourceIDs,
+		Status:     DraftStatusOutlining,
+	}
+	if _, err := s.draftSources(ctx, job); err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "No sources available"})
+		return
+	}
+	if err := s.store.CreateDraftJob(ctx, job); err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to create draft"})
+		return
+	}
+
+	activityLog := &ActivityLog{
+		UserID:       userID,
+		Action:       "create_draft",
+		ResourceType: "notebook",
+		ResourceID:   notebookID,
+		Details:      fmt.Sprintf(`{"draft_id": "%s"}`, job.ID),
+		IPAddress:    c.ClientIP(),
+		UserAgent:    c.GetHeader("User-Agent"),
+	}
+	if err := s.store.LogActivity(ctx, activityLog); err != nil {
+		golog.Errorf("failed to log draft creation activity: %v", err)
+	}
+
+	go s.runDraftJob(job.ID)
+	c.JSON(http.StatusAccepted, job)
+}
+
+func (s *Server) handleGetDraft(c *gin.Context) {
+	job, ok := s.notebookDraft(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, job)
+}
+
+// handleUpdateDraftOutline saves the user's edits to an outline waiting for approval
+func (s *Server) handleUpdateDraftOutline(c *gin.Context) {
+	job, ok := s.notebookDraft(c)
+	if !ok {
+		return
+	}
+	var req DraftOutlineRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+		return
+	}
+	if job.Status != DraftStatusAwaitingApproval {
+		c.JSON(http.StatusConflict, ErrorResponse{Error: "Outline can only be edited before it is approved"})
+		return
+	}
+
+	job.Outline = req.Outline
+	if err := s.store.SaveDraftJob(c.Request.Context(), job); err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to save outline"})
+		return
+	}
+	c.JSON(http.StatusOK, job)
+}
+
+// handleApproveDraft approves the outline, optionally edited in the same request, and starts
+// writing the sections in the background
+func (s *Server) handleApproveDraft(c *gin.Context) {
+	job, ok := s.notebookDraft(c)
+	if !ok {
+		return
+	}
+	var req struct {
+		Outline string `json:"outline"`
+	}
+	c.ShouldBindJSON(&req)
+	if job.Status != DraftStatusAwaitingApproval {
+		c.JSON(http.StatusConflict, ErrorResponse{Error: "Draft is not waiting for approval"})
+		return
+	}
+	if _, ok := s.requireAgent(c); !ok {
+		return
+	}
+
+	if strings.TrimSpace(req.Outline) != "" {
+		job.Outline = req.Outline
+	}
+	_, sections := parseDraftOutline(job.Outline)
+	if len(sections) == 0 {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Outline has no sections", Details: `start each section with a "## " heading`})
+		return
+	}
+
+	job.Sections = sections
+	job.Status = DraftStatusDrafting
+	if err := s.store.SaveDraftJob(c.Request.Context(), job); err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to save draft"})
+		return
+	}
+
+	go s.runDraftJob(job.ID)
+	c.JSON(http.StatusAccepted, job)
+}
+
+// handleResumeDraft retries a failed draft from the stage and section where it stopped
+func (s *Server) handleResumeDraft(c *gin.Context) {
+	job, ok := s.notebookDraft(c)
+	if !ok {
+		return
+	}
+	switch job.Status {
+	case DraftStatusFailed:
+		job.Status = DraftStatusOutlining
+		if len(job.Sections) > 0 {
+			job.Status = DraftStatusDrafting
+		}
+		job.Error = ""
+	case DraftStatusOutlining, DraftStatusDrafting:
+		// Already generating, or interrupted; running it again is a no-op in the first case
+	default:
+		c.JSON(http.StatusConflict, ErrorResponse{Error: "Draft has nothing to resume"})
+		return
+	}
+	if _, ok := s.requireAgent(c); !ok {
+		return
+	}
+
+	if err := s.store.SaveDraftJob(c.Request.Context(), job); err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to save draft"})
+		return
+	}
+
+	go s.runDraftJob(job.ID)
+	c.JSON(http.StatusAccepted, job)
+}
+
+// handleDeleteDraft deletes a draft job. A job being generated stops at its next step;
+// a finished document stays as a note.
+func (s *Server) handleDeleteDraft(c *gin.Context) {
+	job, ok := s.notebookDraft(c)
+	if !ok {
+		return
+	}
+	if err := s.store.DeleteDraftJob(c.Request.Context(), job.NotebookID, job.ID); err != nil {
+		c.JSON(http.StatusNotFound, ErrorResponse{Error: "Draft not found"})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,273 @@
+package backend
+
+import (
+	"archive/zip"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// epubMaxFileSize bounds what is read of one file in an EPUB, so that a crafted archive
+// can't fill memory
+const epubMaxFileSize = 32 << 20
+
+// epubChapterBreak is the line an EPUB chapter starts with, before its "# Title" heading.
+// A vertical tab is whitespace, so it doesn't end up in the words of chunks, and it keeps the
+// heading on a line of its own for the table of contents.
+const epubChapterBreak = "\v\n# "
+
+// epubPackage is the part of an EPUB package document (the .opf file) needed to read the book
+type epubPackage struct {
+	Manifest []struct {
+		ID         string `xml:"id,attr"`
+		Href       string `xml:"href,attr"`
+		MediaType  string `xml:"media-type,attr"`
+		Properties string `xml:"properties,attr"`
+	} `xml:"manifest>item"`
+	Spine struct {
+		TOC   string `xml:"toc,attr"` // Manifest ID of the EPUB 2 NCX table of contents
+		Items []struct {
+			IDRef  string `xml:"idref,attr"`
+			Linear string `xml:"linear,attr"`
+		} `xml:"itemref"`
+	} `xml:"spine"`
+}
+
+// epubNavPoint is an entry of an EPUB 2 NCX table of contents
+type epubNavPoint struct {
+	Label   string `xml:"navLabel>text"`
+	Content struct {
+		Src string `xml:"src,attr"`
+	} `xml:"content"`
+	Children []epubNavPoint `xml:"navPoint"`
+}
+
+// extractEPUB converts an EPUB book to text, one chapter per file of its reading order. Each
+// chapter starts with epubChapterBreak and its title, taken from the book's table of contents
+// or else its first heading, so that chunks can tell which chapter they are in. Files without
+// a title, such as the rest of a chapter split across files, continue the chapter before.
+func extractEPUB(filePath string) (string, error) {
+	archive, err := zip.OpenReader(filePath)
+	if err != nil {
+		return "", fmt.Errorf("invalid EPUB: %w", err)
+	}
+	defer archive.Close()
+
+	files := make(map[string]*zip.File, len(archive.File))
+	for _, f := range archive.File {
+		files[f.Name] = f
+	}
+	read := func(name string) ([]byte, error) {
+		f, ok := files[name]
+		if !ok {
+			return nil, fmt.Errorf("invalid EPUB: %s is missing", name)
+		}
+		r, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return io.ReadAll(io.LimitReader(r, epubMaxFileSize))
+	}
+
+	// META-INF/container.xml points at the package document
+	data, err := read("META-INF/container.xml")
+	if err != nil {
+		return "", err
+	}
+	var container struct {
+		Rootfiles []struct {
+			FullPath string `xml:"full-path,attr"`
+		} `xml:"rootfiles>rootfile"`
+	}
+	if err := xml.Unmarshal(data, &container); err != nil || len(container.Rootfiles) == 0 {
+		return "", fmt.Errorf("invalid EPUB: no package document")
+	}
+	opfPath := container.Rootfiles[0].FullPath
+	data, err = read(opfPath)
+	if err != nil {
+		return "", err
+	}
+	var pkg epubPackage
+	if err := xml.Unmarshal(data, &pkg); err != nil {
+		return "", fmt.Errorf("invalid EPUB package document: %w", err)
+	}
+
+	hrefs := make(map[string]string, len(pkg.Manifest))
+	var navPath, ncxPath string
+	for _, item := range pkg.Manifest {
+		hrefs[item.ID] = epubPath(opfPath, item.Href)
+		if strings.Contains(" "+item.Properties+" ", " nav ") {
+			navPath = hrefs[item.ID]
+		}
+		if item.ID == pkg.Spine.TOC || (ncxPath == "" && item.MediaType == "application/x-dtbncx+xml") {
+			ncxPath = hrefs[item.ID]
+		}
+	}
+	titles := epubChapterTitles(read, navPath, ncxPath)
+
+	var b strings.Builder
+	for _, item := range pkg.Spine.Items {
+		name, ok := hrefs[item.IDRef]
+		if !ok || item.Linear == "no" {
+			continue
+		}
+		data, err := read(name)
+		if err != nil {
+			return "", err
+		}
+		// Chapters are XHTML, which reads like the storage format of Confluence pages
+		text := strings.TrimSpace(confluenceText(string(data)))
+		title := titles[name]
+		if title == "" {
+			title = firstHeading(text)
+		}
+		if title != "" {
+			// The chapter's own heading gives way to the chapter break's
+			first, rest, _ := strings.Cut(text, "\n")
+			if m := atxHeadingRe.FindStringSubmatch(first); m != nil && cleanHeading(m[2]) == title {
+				text = strings.TrimSpace(rest)
+			}
+			b.WriteString("\n\n" + epubChapterBreak + title + "\n\n")
+		} else if text != "" {
+			b.WriteString("\n\n")
+		}
+		b.WriteString(text)
+	}
+	content := strings.TrimLeft(b.String(), "\n")
+	if strings.TrimSpace(strings.ReplaceAll(content, "\v", "")) == "" {
+		return "", fmt.Errorf("no text found in the EPUB")
+	}
+	return content + "\n", nil
+}
+
+// epubPath resolves a link of a file in an EPUB to the name of the file it points at
+func epubPath(from, href string) string {
+	href, _, _ = strings.Cut(href, "#")
+	if unescaped, err := url.PathUnescape(href); err == nil {
+		href = unescaped
+	}
+	return path.Join(path.Dir(from), href)
+}
+
+// epubChapterTitles maps the files of a book to their titles in its table of contents: the
+// EPUB 3 navigation document if there is one, else the EPUB 2 NCX. The first entry of a file
+// names it.
+func epubChapterTitles(read func(string) ([]byte, error), navPath, ncxPath string) map[string]string {
+	titles := make(map[string]string)
+	add := func(from, href, title string) {
+		title = strings.Join(strings.Fields(title), " ")
+		if name := epubPath(from, href); title != "" && titles[name] == "" {
+			titles[name] = title
+		}
+	}
+
+	if navPath != "" {
+		if data, err := read(navPath); err == nil {
+			z := html.NewTokenizer(strings.NewReader(string(data)))
+			inTOC := false // Inside the nav of the table of contents, not of landmarks or pages
+			var href string
+			var label strings.Builder
+			for tt := z.Next(); tt != html.ErrorToken; tt = z.Next() {
+				token := z.Token()
+				switch {
+				case tt == html.StartTagToken && token.Data == "nav":
+					for _, attr := range token.Attr {
+						if attr.Key == "epub:type" && strings.Contains(" "+attr.Val+" ", " toc ") {
+							inTOC = true
+						}
+					}
+				case tt == html.EndTagToken && token.Data == "nav":
+					inTOC = false
+				case !inTOC:
+				case tt == html.StartTagToken && token.Data == "a":
+					href = ""
+					label.Reset()
+					for _, attr := range token.Attr {
+						if attr.Key == "href" {
+							href = attr.Val
+						}
+					}
+				case tt == html.TextToken && href != "":
+					label.WriteString(token.Data)
+				case tt == html.EndTagToken && token.Data == "a":
+					if href != "" {
+						add(navPath, href, label.String())
+					}
+					href = ""
+				}
+			}
+			if len(titles) > 0 {
+				return titles
+			}
+		}
+	}
+
+	if ncxPath != "" {
+		if data, err := read(ncxPath); err == nil {
+			var ncx struct {
+				Points []epubNavPoint `xml:"navMap>navPoint"`
+			}
+			if xml.Unmarshal(data, &ncx) == nil {
+				var walk func(points []epubNavPoint)
+				walk = func(points []epubNavPoint) {
+					for _, point := range points {
+						add(ncxPath, point.Content.Src, point.Label)
+						walk(point.Children)
+					}
+				}
+				walk(ncx.Points)
+			}
+		}
+	}
+	return titles
+}
+
+// firstHeading returns the title of the first Markdown heading of text, or an empty string
+func firstHeading(text string) string {
+	for _, line := range strings.Split(text, "\n") {
+		if m := atxHeadingRe.FindStringSubmatch(line); m != nil {
+			if title := cleanHeading(m[2]); title != "" {
+				return title
+			}
+		}
+	}
+	return ""
+}
+
+// setChunkChapters sets the EPUB chapter or Word section each chunk starts in, from the chapter
+// breaks of the content. Chunks of other sources get no chapter.
+func setChunkChapters(runes []rune, chunks []textChunk) {
+	content := string(runes)
+	if !strings.Contains(content, epubChapterBreak) {
+		return
+	}
+	var starts []int
+	var titles []string
+	offset := 0 // Rune offset of content[index:] below
+	for index := 0; ; {
+		i := strings.Index(content[index:], epubChapterBreak)
+		if i < 0 {
+			break
+		}
+		offset += len([]rune(content[index : index+i]))
+		index += i
+		title, _, _ := strings.Cut(content[index+len(epubChapterBreak):], "\n")
+		starts = append(starts, offset)
+		titles = append(titles, strings.TrimSpace(title))
+		offset += len([]rune(epubChapterBreak))
+		index += len(epubChapterBreak)
+	}
+	// A chunk is in the last chapter that starts at or before it
+	for i := range chunks {
+		if n := sort.SearchInts(starts, chunks[i].Start+1); n > 0 {
+			chunks[i].Chapter = titles[n-1]
+		}
+	}
+}
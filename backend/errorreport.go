@@ -0,0 +1,251 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/kataras/golog"
+)
+
+// errorReportTimeout bounds sending one error report
+const errorReportTimeout = 10 * time.Second
+
+// errorReporter sends error reports to Sentry, the error report webhook, or both
+type errorReporter struct {
+	sentryURL     string // Store endpoint of the Sentry project
+	sentryHeader  http.Header
+	webhookURL    string
+	webhookHeader http.Header
+	environment   string
+	serverName    string
+}
+
+// newErrorReporter creates the reporter of SENTRY_DSN and ERROR_REPORT_URL, or nil if neither is set
+func newErrorReporter(cfg Config) (*errorReporter, error) {
+	if cfg.SentryDSN == "" && cfg.ErrorReportURL == "" {
+		return nil, nil
+	}
+	r := &errorReporter{environment: cfg.SentryEnvironment}
+	r.serverName, _ = os.Hostname()
+	if cfg.SentryDSN != "" {
+		storeURL, key, err := parseSentryDSN(cfg.SentryDSN)
+		if err != nil {
+			return nil, err
+		}
+		r.sentryURL = storeURL
+		r.sentryHeader = http.Header{}
+		r.sentryHeader.Set("X-Sentry-Auth", "Sentry sentry_version=7, sentry_client=notex/1.0, sentry_key="+key)
+	}
+	if cfg.ErrorReportURL != "" {
+		r.webhookURL = cfg.ErrorReportURL
+		r.webhookHeader = http.Header{}
+		if cfg.ErrorReportToken != "" {
+			r.webhookHeader.Set("Authorization", "Bearer "+cfg.ErrorReportToken)
+		}
+	}
+	return r, nil
+}
+
+// parseSentryDSN returns the store endpoint and public key of a Sentry DSN of the form
+// https://<key>@<host>[/<path>]/<project id>
+func parseSentryDSN(dsn string) (string, string, error) {
+	u, err := url.Parse(dsn)
+	if err != nil {
+		return "", "", err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return "", "", fmt.Errorf("must be an http(s) URL")
+	}
+	if u.User == nil || u.User.Username() == "" {
+		return "", "", fmt.Errorf("missing public key")
+	}
+	p := strings.TrimRight(u.Path, "/")
+	i := strings.LastIndex(p, "/")
+	prefix, project := p[:max(i, 0)], p[i+1:]
+	if project == "" {
+		return "", "", fmt.Errorf("missing project ID")
+	}
+	return u.Scheme + "://" + u.Host + prefix + "/api/" + project + "/store/", u.User.Username(), nil
+}
+
+// send delivers a report to each destination
+func (r *errorReporter) send(ctx context.Context, report *ErrorReport) error {
+	var errs []error
+	if r.sentryURL != "" {
+		if _, err := postJSON(ctx, http.MethodPost, r.sentryURL, sentryEvent(report), r.sentryHeader); err != nil {
+			errs = append(errs, fmt.Errorf("sentry: %w", err))
+		}
+	}
+	if r.webhookURL != "" {
+		if _, err := postJSON(ctx, http.MethodPost, r.webhookURL, report, r.webhookHeader); err != nil {
+			errs = append(errs, fmt.Errorf("webhook: %w", err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// sentryEvent converts a report to a Sentry event
+func sentryEvent(report *ErrorReport) map[string]any {
+	frames := make([]map[string]any, len(report.Stack))
+	for i, f := range report.Stack {
+		frames[i] = map[string]any{
+			"function": f.Function,
+			"filename": f.File,
+			"lineno":   f.Line,
+			"in_app":   strings.HasPrefix(f.Function, "github.com/smallnest/notex"),
+		}
+	}
+	exception := map[string]any{
+		"type":      report.Component + " " + report.Kind,
+		"value":     report.Message,
+		"mechanism": map[string]any{"type": report.Kind, "handled": report.Kind != "panic"},
+	}
+	if len(frames) > 0 {
+		exception["stacktrace"] = map[string]any{"frames": frames}
+	}
+	tags := map[string]string{"component": report.Component}
+	for k, v := range map[string]string{"notebook_id": report.NotebookID, "request_id": report.RequestID, "route": report.Route} {
+		if v != "" {
+			tags[k] = v
+		}
+	}
+	event := map[string]any{
+		"event_id":    strings.ReplaceAll(uuid.New().String(), "-", ""),
+		"timestamp":   report.Time.UTC().Format(time.RFC3339Nano),
+		"level":       "error",
+		"platform":    "go",
+		"logger":      report.Component,
+		"environment": report.Environment,
+		"server_name": report.ServerName,
+		"exception":   map[string]any{"values": []any{exception}},
+		"tags":        tags,
+		"extra":       report.Extra,
+	}
+	if report.Kind == "panic" {
+		event["level"] = "fatal"
+	}
+	if report.UserID != "" {
+		event["user"] = map[string]string{"id": report.UserID}
+	}
+	return event
+}
+
+// reportError sends a report in the background, if error reporting is on
+func (s *Server) reportError(report *ErrorReport) {
+	if s.errorReporter == nil {
+		return
+	}
+	report.Environment = s.errorReporter.environment
+	report.ServerName = s.errorReporter.serverName
+	report.Time = time.Now()
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), errorReportTimeout)
+		defer cancel()
+		if err := s.errorReporter.send(ctx, report); err != nil {
+			golog.Warnf("failed to send error report: %v", err)
+		}
+	}()
+}
+
+// reportPanic logs and reports a recovered panic. It must be called from the deferred function
+// that recovered it, for the stack to lead to the panic.
+func (s *Server) reportPanic(recovered any, report *ErrorReport) {
+	golog.Errorf("panic in %s: %v\n%s", report.Component, recovered, debug.Stack())
+	report.Kind = "panic"
+	report.Message = fmt.Sprint(recovered)
+	report.Stack = panicStack()
+	s.reportError(report)
+}
+
+// panicStack returns the stack of the panic being recovered, outermost call first, leaving out
+// the recovering calls and the runtime's
+func panicStack() []StackFrame {
+	pcs := make([]uintptr, 64)
+	frames := runtime.CallersFrames(pcs[:runtime.Callers(1, pcs)])
+	var stack []StackFrame
+	for {
+		frame, more := frames.Next()
+		if frame.Function == "runtime.gopanic" {
+			// What came before are the recovering calls
+			stack = stack[:0]
+		} else if !strings.HasPrefix(frame.Function, "runtime.") {
+			stack = append(stack, StackFrame{Function: frame.Function, File: frame.File, Line: frame.Line})
+		}
+		if !more {
+			break
+		}
+	}
+	slices.Reverse(stack)
+	return stack
+}
+
+// requestErrorReport returns a report of a request's user, notebook, ID and route
+func requestErrorReport(c *gin.Context, kind, message string) *ErrorReport {
+	report := &ErrorReport{
+		Kind:      kind,
+		Component: "http",
+		Message:   message,
+		UserID:    c.GetString("user_id"),
+		RequestID: c.GetString("request_id"),
+		Route:     c.Request.Method + " " + c.FullPath(),
+	}
+	if strings.HasPrefix(c.FullPath(), "/api/notebooks/:id") {
+		report.NotebookID = c.Param("id")
+	}
+	return report
+}
+
+// handlePanic reports a panic of a request handler and replies 500 with the request ID, unless
+// the handler already started its reply
+func (s *Server) handlePanic(c *gin.Context, recovered any) {
+	report := requestErrorReport(c, "panic", "")
+	s.reportPanic(recovered, report)
+	if c.Writer.Written() {
+		c.Abort()
+		return
+	}
+	c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorResponse{
+		Error: "Internal server error", Details: "request " + report.RequestID})
+}
+
+// reportGenerationError reports an LLM generation failure of a request, except context overflows
+// and timeouts, which aren't faults of the pipeline
+func (s *Server) reportGenerationError(c *gin.Context, err error) {
+	if generationErrorStatus(err) == http.StatusInternalServerError {
+		s.reportError(requestErrorReport(c, "error", err.Error()))
+	}
+}
+
+// goSupervised runs fn in the background, reporting a panic and running fn again instead of
+// letting the panic crash the server
+func (s *Server) goSupervised(component string, fn func()) {
+	go func() {
+		for s.runRecovered(component, fn) {
+			// Don't spin on a panic that happens right away
+			time.Sleep(time.Minute)
+		}
+	}()
+}
+
+// runRecovered runs fn and reports whether it panicked
+func (s *Server) runRecovered(component string, fn func()) (panicked bool) {
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			s.reportPanic(recovered, &ErrorReport{Component: component})
+			panicked = true
+		}
+	}()
+	fn()
+	return false
+}
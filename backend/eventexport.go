@@ -0,0 +1,172 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/kataras/golog"
+)
+
+// eventExportBatchSize is how many events are sent to the sink at a time
+const eventExportBatchSize = 1000
+
+// exportStreams are the event streams exported, each with its own cursor
+var exportStreams = []string{"activity", "usage"}
+
+// eventSink delivers a batch of events of one stream to an analytics warehouse
+type eventSink interface {
+	send(ctx context.Context, stream string, events []ExportedEvent) error
+}
+
+// newEventSink creates the sink configured with EVENT_EXPORT_SINK, nil if exporting is off
+func newEventSink(cfg Config) (eventSink, error) {
+	header := http.Header{}
+	if cfg.EventExportToken != "" {
+		header.Set("Authorization", "Bearer "+cfg.EventExportToken)
+	}
+	switch cfg.EventExportSink {
+	case "":
+		return nil, nil
+	case "webhook":
+		return &webhookEventSink{url: cfg.EventExportURL, header: header}, nil
+	case "kafka":
+		header.Set("Content-Type", "application/vnd.kafka.json.v2+json")
+		url := strings.TrimRight(cfg.EventExportURL, "/") + "/topics/" + cfg.EventExportTopic
+		return &kafkaEventSink{url: url, header: header}, nil
+	case "s3":
+		client, err := newS3Client(cfg.EventExportS3, cfg.EventExportS3Secret)
+		if err != nil {
+			return nil, err
+		}
+		return &s3EventSink{client: client, prefix: cfg.EventExportS3.Prefix}, nil
+	default:
+		return nil, fmt.Errorf("unknown event export sink: %s", cfg.EventExportSink)
+	}
+}
+
+// webhookEventSink posts each batch as {"stream": ..., "events": [...]}
+type webhookEventSink struct {
+	url    string
+	header http.Header
+}
+
+func (w *webhookEventSink) send(ctx context.Context, stream string, events []ExportedEvent) error {
+	_, err := postJSON(ctx, http.MethodPost, w.url, gin.H{"stream": stream, "events": events}, w.header)
+	return err
+}
+
+// kafkaEventSink produces each event as a record through a Kafka REST Proxy, keyed by user so
+// a user's events stay in order within a partition
+type kafkaEventSink struct {
+	url    string
+	header http.Header
+}
+
+func (k *kafkaEventSink) send(ctx context.Context, stream string, events []ExportedEvent) error {
+	records := make([]gin.H, len(events))
+	for i := range events {
+		records[i] = gin.H{"key": events[i].UserID, "value": events[i]}
+	}
+	_, err := postJSON(ctx, http.MethodPost, k.url, gin.H{"records": records}, k.header)
+	return err
+}
+
+// s3EventSink writes each batch as a JSON Lines object, partitioned by day as
+// <prefix>dt=YYYY-MM-DD/<stream>-<time>-<id>.jsonl
+type s3EventSink struct {
+	client *s3Client
+	prefix string
+}
+
+func (s *s3EventSink) send(ctx context.Context, stream string, events []ExportedEvent) error {
+	var body bytes.Buffer
+	encoder := json.NewEncoder(&body)
+	for i := range events {
+		if err := encoder.Encode(&events[i]); err != nil {
+			return err
+		}
+	}
+	now := time.Now().UTC()
+	key := fmt.Sprintf("%sdt=%s/%s-%s-%s.jsonl", s.prefix, now.Format("2006-01-02"), stream,
+		now.Format("20060102T150405Z"), uuid.New().String()[:8])
+	return s.client.put(ctx, key, body.Bytes())
+}
+
+// exportEvents sends the events of each stream that were not exported yet, in batches, and
+// returns how many were sent per stream. Events of the current second are left for the next
+// export, as more may still be written with the same timestamp.
+func (s *Server) exportEvents(ctx context.Context) (map[string]int, error) {
+	s.eventExportMu.Lock()
+	defer s.eventExportMu.Unlock()
+
+	exported := make(map[string]int)
+	until := time.Now()
+	for _, stream := range exportStreams {
+		cursor, err := s.store.GetEventExportCursor(ctx, stream)
+		if err != nil {
+			return exported, err
+		}
+		for {
+			events, err := s.store.ListExportEvents(ctx, stream, cursor, until, eventExportBatchSize)
+			if err != nil {
+				return exported, err
+			}
+			if len(events) == 0 {
+				break
+			}
+			if err := s.eventSink.send(ctx, stream, events); err != nil {
+				return exported, fmt.Errorf("failed to export %s events: %w", stream, err)
+			}
+			last := events[len(events)-1]
+			cursor = EventCursor{CreatedAt: last.CreatedAt.Unix(), ID: last.ID}
+			if err := s.store.SetEventExportCursor(ctx, stream, cursor); err != nil {
+				return exported, err
+			}
+			exported[stream] += len(events)
+			if len(events) < eventExportBatchSize {
+				break
+			}
+		}
+	}
+	return exported, nil
+}
+
+// eventExportLoop periodically exports new events to the sink
+func (s *Server) eventExportLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		exported, err := s.exportEvents(context.Background())
+		if err != nil {
+			golog.Warnf("event export failed: %v", err)
+		}
+		if exported["activity"]+exported["usage"] > 0 {
+			golog.Infof("exported %d activity and %d usage events", exported["activity"], exported["usage"])
+		}
+	}
+}
+
+// handleExportEvents exports new events right away instead of waiting for the schedule, for admins
+func (s *Server) handleExportEvents(c *gin.Context) {
+	if !s.requireAdmin(c) {
+		return
+	}
+	if s.eventSink == nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Event export is not configured", Details: "set EVENT_EXPORT_SINK"})
+		return
+	}
+	exported, err := s.exportEvents(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusBadGateway, ErrorResponse{Error: "Event export failed", Details: err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"activity": exported["activity"], "usage": exported["usage"]})
+}
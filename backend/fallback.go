@@ -0,0 +1,223 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kataras/golog"
+	"github.com/tmc/langchaingo/llms"
+)
+
+// fallbackLLM runs generations on a model and, when one fails, retries it on the models of
+// LLM_FALLBACKS in order. A streamed generation isn't retried once part of it has been passed on,
+// nor is one whose context has ended.
+type fallbackLLM struct {
+	routes []ModelRoute
+	models []llms.Model
+	usage  usageSink
+}
+
+// newFallbackLLM creates the client for a model followed by the LLM_FALLBACKS models. The token
+// usage of each generation goes to usage.
+func newFallbackLLM(cfg Config, route ModelRoute, usage usageSink) (llms.Model, error) {
+	f := &fallbackLLM{usage: usage}
+	for _, r := range append([]ModelRoute{route}, cfg.LLMFallbacks...) {
+		if slices.Contains(f.routes, r) {
+			continue
+		}
+		llm, err := newLLM(cfg, r)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create %s: %w", r, err)
+		}
+		f.routes = append(f.routes, r)
+		f.models = append(f.models, llm)
+	}
+	return f, nil
+}
+
+// GenerateContent implements llms.Model
+func (f *fallbackLLM) GenerateContent(ctx context.Context, messages []llms.MessageContent, options ...llms.CallOption) (*llms.ContentResponse, error) {
+	var opts llms.CallOptions
+	for _, option := range options {
+		option(&opts)
+	}
+	streamed := false
+	if onChunk := opts.StreamingFunc; onChunk != nil {
+		options = append(slices.Clip(options), llms.WithStreamingFunc(func(ctx context.Context, chunk []byte) error {
+			streamed = true
+			return onChunk(ctx, chunk)
+		}))
+	}
+
+	var errs []error
+	for i, model := range f.models {
+		start := time.Now()
+		response, err := model.GenerateContent(ctx, messages, options...)
+		recordTiming(ctx, stageLLM, start)
+		if err == nil {
+			recordGeneration(ctx, f.routes[i], f.routes[0])
+			promptTokens, completionTokens := responseTokens(response)
+			f.usage.record(ctx, f.routes[i], promptTokens, completionTokens, 0)
+			return response, nil
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", f.routes[i], err))
+		if streamed || ctx.Err() != nil || i == len(f.models)-1 {
+			break
+		}
+		golog.Warnf("generation on %s failed, falling back to %s: %v", f.routes[i], f.routes[i+1], err)
+	}
+	if len(errs) == 1 {
+		return nil, errors.Unwrap(errs[0])
+	}
+	return nil, errors.Join(errs...)
+}
+
+// Call implements llms.Model
+func (f *fallbackLLM) Call(ctx context.Context, prompt string, options ...llms.CallOption) (string, error) {
+	return llms.GenerateFromSinglePrompt(ctx, f, prompt, options...)
+}
+
+// responseTokens returns the prompt and completion tokens OpenAI and Ollama report for a generation
+func responseTokens(response *llms.ContentResponse) (int, int) {
+	if len(response.Choices) == 0 {
+		return 0, 0
+	}
+	info := response.Choices[0].GenerationInfo
+	promptTokens, _ := info["PromptTokens"].(int)
+	completionTokens, _ := info["CompletionTokens"].(int)
+	return promptTokens, completionTokens
+}
+
+// generationTrace records which model produced the last generation run under a context
+type generationTrace struct {
+	mu      sync.Mutex
+	route   ModelRoute
+	primary ModelRoute
+}
+
+type generationTraceKey struct{}
+
+// withGenerationTrace returns a context whose generations are recorded in the returned trace
+func withGenerationTrace(ctx context.Context) (context.Context, *generationTrace) {
+	trace := &generationTrace{}
+	return context.WithValue(ctx, generationTraceKey{}, trace), trace
+}
+
+// recordGeneration notes in the context's trace, if any, that route produced a generation
+// meant for primary
+func recordGeneration(ctx context.Context, route, primary ModelRoute) {
+	trace, ok := ctx.Value(generationTraceKey{}).(*generationTrace)
+	if !ok {
+		return
+	}
+	trace.mu.Lock()
+	defer trace.mu.Unlock()
+	trace.route = route
+	trace.primary = primary
+}
+
+// addTo adds to response metadata the model that produced the generation as "generated_by",
+// and if that was a fallback, the model that failed as "fallback_from"
+func (t *generationTrace) addTo(metadata map[string]interface{}) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.route.Provider == "" {
+		return
+	}
+	metadata["generated_by"] = t.route.String()
+	if t.route != t.primary {
+		metadata["fallback_from"] = t.primary.String()
+	}
+}
+
+// imageRetryDelay is the wait before an image generation is retried, growing with each attempt
+const imageRetryDelay = 2 * time.Second
+
+// imageProvider is an image provider with the model it generates images with
+type imageProvider struct {
+	route  ModelRoute
+	client LLMProvider
+}
+
+// generatedImage is an image file and the provider that generated it
+type generatedImage struct {
+	Path         string
+	GeneratedBy  ModelRoute
+	FallbackFrom string // The provider that failed first, empty if none did
+}
+
+// generateImage generates an image with the image provider. A failed generation is retried
+// IMAGE_RETRIES times, unless the provider refused it, then falls back to the IMAGE_FALLBACKS
+// providers in order. The image is recorded in the usage of the provider that generated it.
+func (a *Agent) generateImage(ctx context.Context, prompt, userID string) (*generatedImage, error) {
+	var errs []error
+	for i, p := range a.images {
+		for attempt := 0; ; attempt++ {
+			start := time.Now()
+			imagePath, err := p.client.GenerateImage(ctx, p.route.Model, prompt, userID)
+			recordTiming(ctx, stageLLM, start)
+			if err == nil {
+				a.usage.record(ctx, p.route, 0, 0, 1)
+				image := &generatedImage{Path: imagePath, GeneratedBy: p.route}
+				if i > 0 {
+					image.FallbackFrom = a.images[0].route.String()
+				}
+				return image, nil
+			}
+			if ctx.Err() != nil {
+				return nil, err
+			}
+			if attempt >= a.cfg.ImageRetries || isImageRefusal(err) {
+				errs = append(errs, fmt.Errorf("%s: %w", p.route, err))
+				break
+			}
+			golog.Warnf("image generation on %s failed, retrying: %v", p.route, err)
+			select {
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			case <-time.After(imageRetryDelay * time.Duration(attempt+1)):
+			}
+		}
+		if i < len(a.images)-1 {
+			golog.Warnf("image generation on %s failed, falling back to %s: %v", p.route, a.images[i+1].route, errs[len(errs)-1])
+		}
+	}
+	if len(errs) == 1 {
+		return nil, errors.Unwrap(errs[0])
+	}
+	return nil, errors.Join(errs...)
+}
+
+// isImageRefusal reports whether an image provider refused a generation, which a retry on the
+// same provider wouldn't change: a content filter, or an exhausted quota or balance
+func isImageRefusal(err error) bool {
+	msg := strings.ToLower(err.Error())
+	markers := []string{
+		"content_policy",
+		"content policy",
+		"content filter",
+		"moderation",
+		"safety",
+		"sensitive",
+		"quota",
+		"insufficient",
+		"billing",
+		"balance",
+		"api_key",
+		"api key",
+		"unauthorized",
+		"status: 401",
+		"status: 403",
+	}
+	for _, marker := range markers {
+		if strings.Contains(msg, marker) {
+			return true
+		}
+	}
+	return false
+}
@@ -156,7 +156,11 @@ class OpenNotebook {
             ppt: '幻灯片',
             insight: '洞察报告',
             data_table: '数据表格',
-            data_chart: '数据图表'
+            data_chart: '数据图表',
+            meeting_summary: '会议纪要',
+            references: '参考文献',
+            draft: '长文草稿',
+            chat: '对话记录'
         };
 
         this.init();
@@ -164,17 +168,19 @@ class OpenNotebook {
 
     async init() {
         await this.initAuth();
+        await this.checkSetup();
         await this.loadConfig();
         this.bindEvents();
         this.initResizers();
         this.initNotebookNameEditor();
+        this.initQuickCapture();
 
         // 清理过期缓存
         this.cache.cleanup();
 
         // Check if URL contains /notes/:id or /public/:token for direct notebook access
         // Only load notebooks if not accessing a public notebook directly
-        if (!this.checkURLForNotebook() && !this.checkURLForPublicNotebook()) {
+        if (!this.checkURLForNotebook() && !this.checkURLForPublicNotebook() && !this.checkURLForSharedNote()) {
             await this.loadNotebooks();
             this.applyConfig();
             this.switchView('landing');
@@ -183,6 +189,37 @@ class OpenNotebook {
         }
     }
 
+    // 快速记录：Ctrl/⌘ + Shift + K 随时把一段文字存入收件箱笔记本
+    initQuickCapture() {
+        document.addEventListener('keydown', (e) => {
+            if (!(e.ctrlKey || e.metaKey) || !e.shiftKey || e.key.toLowerCase() !== 'k') return;
+            if (!this.token && !this.currentUser) return;
+            e.preventDefault();
+            this.quickCapture();
+        });
+    }
+
+    async quickCapture() {
+        const content = prompt('快速记录（将保存到收件箱笔记本）');
+        if (!content || !content.trim()) return;
+
+        try {
+            const result = await this.api('/quick-note', {
+                method: 'POST',
+                body: JSON.stringify({ content })
+            });
+            this.showToast(`已保存到「${result.notebook_name}」`, 'success');
+
+            if (this.currentNotebook && this.currentNotebook.id === result.notebook_id) {
+                await this.loadSources();
+            } else if (!this.currentNotebook) {
+                await this.loadNotebooks();
+            }
+        } catch (error) {
+            this.showError('快速记录失败: ' + error.message);
+        }
+    }
+
     // Check if URL contains /public/:token and load the public notebook
     checkURLForPublicNotebook() {
         const path = window.location.pathname;
@@ -199,16 +236,19 @@ class OpenNotebook {
         try {
             this.setStatus('加载公开笔记本...');
 
+            // 所有者未公开的部分返回 403，按空列表显示
             const [notebook, sources, notes] = await Promise.all([
                 fetch(`/public/notebooks/${token}`).then(r => {
                     if (!r.ok) throw new Error('Failed to load notebook');
                     return r.json();
                 }),
                 fetch(`/public/notebooks/${token}/sources`).then(r => {
+                    if (r.status === 403) return [];
                     if (!r.ok) throw new Error('Failed to load sources');
                     return r.json();
                 }),
                 fetch(`/public/notebooks/${token}/notes`).then(r => {
+                    if (r.status === 403) return [];
                     if (!r.ok) throw new Error('Failed to load notes');
                     return r.json();
                 })
@@ -216,6 +256,7 @@ class OpenNotebook {
 
             this.currentNotebook = notebook;
             this.currentPublicToken = token;
+            this.publicChatHistory = [];
 
             // 先显示笔记列表 tab（创建容器）
             this.showNotesListTab();
@@ -231,6 +272,10 @@ class OpenNotebook {
 
             this.switchView('workspace');
             this.setStatus('公开笔记本: ' + notebook.name);
+            this.connectPresence(`/public/notebooks/${token}/presence`);
+
+            // Citation deep links point at a source passage
+            this.openCitationFromHash();
         } catch (error) {
             console.error('Failed to load public notebook:', error);
             this.showError('加载公开笔记本失败');
@@ -238,10 +283,184 @@ class OpenNotebook {
         }
     }
 
+    // Check if URL contains /public/notes/:token and load the shared note
+    checkURLForSharedNote() {
+        const path = window.location.pathname;
+        const match = path.match(/^\/public\/notes\/([a-f0-9-]+)$/);
+        if (match) {
+            this.loadSharedNote(match[1]);
+            return true;
+        }
+        return false;
+    }
+
+    // Load a single shared note by token
+    async loadSharedNote(token) {
+        try {
+            this.setStatus('加载分享笔记...');
+
+            const response = await fetch(`/public/notes/${token}`, {
+                headers: { 'Accept': 'application/json' }
+            });
+            if (!response.ok) throw new Error('Failed to load note');
+            const note = await response.json();
+
+            this.currentNotebook = { id: note.notebook_id, name: note.notebook_name };
+            this.currentSharedNoteToken = token;
+
+            this.showNotesListTab();
+            await this.renderNotesCompactGridPublic([note]);
+
+            this.setReadOnlyMode(true);
+            this.switchView('workspace');
+            await this.viewNote(note);
+            this.setStatus('分享笔记: ' + note.title);
+        } catch (error) {
+            console.error('Failed to load shared note:', error);
+            this.showError('分享链接无效或已过期');
+            this.switchView('landing');
+        }
+    }
+
+    // Create, refresh or revoke the share link of a note
+    async shareNote(note) {
+        if (note.share_token) {
+            const url = `${window.location.origin}/public/notes/${note.share_token}`;
+            if (!confirm(`该笔记已分享：\n${url}\n\n确定要取消分享吗？`)) {
+                try {
+                    await navigator.clipboard.writeText(url);
+                    this.showToast('分享链接已复制', 'success');
+                } catch (err) {
+                    this.showError('复制失败');
+                }
+                return;
+            }
+            try {
+                const updated = await this.api(`/notebooks/${this.currentNotebook.id}/notes/${note.id}/share`, {
+                    method: 'PUT',
+                    body: JSON.stringify({ enabled: false })
+                });
+                note.share_token = updated.share_token;
+                note.share_expires_at = updated.share_expires_at;
+                this.showToast('已取消分享', 'success');
+            } catch (error) {
+                this.showError('取消分享失败');
+            }
+            return;
+        }
+
+        const input = prompt('分享链接有效期（小时），留空表示永不过期', '72');
+        if (input === null) return;
+        const hours = parseInt(input.trim(), 10);
+        if (input.trim() && (isNaN(hours) || hours <= 0)) {
+            this.showError('请输入有效的小时数');
+            return;
+        }
+
+        try {
+            const updated = await this.api(`/notebooks/${this.currentNotebook.id}/notes/${note.id}/share`, {
+                method: 'PUT',
+                body: JSON.stringify({ enabled: true, expires_in_hours: input.trim() ? hours : 0 })
+            });
+            note.share_token = updated.share_token;
+            note.share_expires_at = updated.share_expires_at;
+
+            const url = `${window.location.origin}/public/notes/${updated.share_token}`;
+            try {
+                await navigator.clipboard.writeText(url);
+                this.showToast('分享链接已复制', 'success');
+            } catch (err) {
+                prompt('分享链接', url);
+            }
+        } catch (error) {
+            this.showError('分享失败');
+        }
+    }
+
+    // 笔记设为仅自己可见后，公开页面和笔记的分享链接都看不到它
+    async setNotePrivate(note, button) {
+        try {
+            const updated = await this.api(`/notebooks/${this.currentNotebook.id}/notes/${note.id}/private`, {
+                method: 'PUT',
+                body: JSON.stringify({ private: !note.private })
+            });
+            note.private = !!updated.private;
+            button.classList.toggle('active', note.private);
+            button.title = note.private ? '仅自己可见，点击取消' : '设为仅自己可见';
+            const card = document.querySelector(`.compact-note-card[data-note-id="${note.id}"]`);
+            if (card) card.classList.toggle('private', note.private);
+            this.showToast(note.private ? '已设为仅自己可见' : '已取消仅自己可见', 'success');
+        } catch (error) {
+            this.showError('操作失败');
+        }
+    }
+
+    async exportNote(note, format) {
+        try {
+            const response = await fetch(`${this.apiBase}/notebooks/${this.currentNotebook.id}/notes/${note.id}/export?format=${format}`, {
+                headers: this.token ? { 'Authorization': `Bearer ${this.token}` } : {}
+            });
+            if (!response.ok) {
+                const error = await response.json().catch(() => ({ error: '导出失败' }));
+                throw new Error(error.error || '导出失败');
+            }
+            const url = URL.createObjectURL(await response.blob());
+            const link = document.createElement('a');
+            link.href = url;
+            link.download = `${note.title || 'note'}.${format}`;
+            link.click();
+            URL.revokeObjectURL(url);
+        } catch (error) {
+            this.showError(`导出 ${format.toUpperCase()} 失败: ` + error.message);
+        }
+    }
+
+    async generatePodcastAudio(note) {
+        const button = document.getElementById('btnPodcastAudio');
+        if (button) {
+            button.disabled = true;
+            button.textContent = '正在合成音频...';
+        }
+        try {
+            const result = await this.api(`/notebooks/${this.currentNotebook.id}/notes/${note.id}/audio`, {
+                method: 'POST'
+            });
+            await this.loadNotes();
+            await this.viewNote(result.note);
+        } catch (error) {
+            this.showError('生成音频失败: ' + error.message);
+            if (button) {
+                button.disabled = false;
+                button.textContent = '生成音频';
+            }
+        }
+    }
+
+    async exportNotebook(nb) {
+        try {
+            const response = await fetch(`${this.apiBase}/notebooks/${nb.id}/export`, {
+                headers: this.token ? { 'Authorization': `Bearer ${this.token}` } : {}
+            });
+            if (!response.ok) {
+                const error = await response.json().catch(() => ({ error: '导出失败' }));
+                throw new Error(error.error || '导出失败');
+            }
+            const url = URL.createObjectURL(await response.blob());
+            const link = document.createElement('a');
+            link.href = url;
+            link.download = `${nb.name || 'notebook'}.zip`;
+            link.click();
+            URL.revokeObjectURL(url);
+        } catch (error) {
+            this.showError('导出笔记本失败: ' + error.message);
+        }
+    }
+
     // Handle back to list button click
     async handleBackToList() {
         // Clear public notebook state
         this.currentPublicToken = null;
+        this.currentSharedNoteToken = null;
         this.currentNotebook = null;
 
         // Reload user's notebooks
@@ -262,6 +481,20 @@ class OpenNotebook {
             // 禁用编辑功能
             const addSourceBtn = document.getElementById('btnAddSource');
             if (addSourceBtn) addSourceBtn.style.display = 'none';
+            const relatedBtn = document.getElementById('btnRelatedPapers');
+            if (relatedBtn) relatedBtn.style.display = 'none';
+            const searchBtn = document.getElementById('btnSearchSources');
+            if (searchBtn) searchBtn.style.display = 'none';
+            const activityBtn = document.getElementById('btnNotebookActivity');
+            if (activityBtn) activityBtn.style.display = 'none';
+            const saveChatBtn = document.getElementById('btnSaveChat');
+            if (saveChatBtn) saveChatBtn.style.display = 'none';
+            const promptLibraryBtn = document.getElementById('btnPromptLibrary');
+            if (promptLibraryBtn) promptLibraryBtn.style.display = 'none';
+            const styleSelect = document.getElementById('chatStyleSelect');
+            if (styleSelect) styleSelect.style.display = 'none';
+            const retrievalBtn = document.getElementById('btnRetrievalSettings');
+            if (retrievalBtn) retrievalBtn.style.display = 'none';
 
             // 隐藏编辑按钮
             document.querySelectorAll('.transform-card').forEach(btn => {
@@ -269,11 +502,12 @@ class OpenNotebook {
                 btn.style.opacity = '0.5';
             });
 
-            // 隐藏聊天功能
+            // 隐藏聊天功能，除非所有者允许访客对话
+            const chatDisplay = this.currentNotebook?.share_policy?.chat ? '' : 'none';
             const chatWrapper = document.querySelector('.chat-messages-wrapper');
-            if (chatWrapper) chatWrapper.style.display = 'none';
+            if (chatWrapper) chatWrapper.style.display = chatDisplay;
             const chatInput = document.querySelector('.chat-input-wrapper');
-            if (chatInput) chatInput.style.display = 'none';
+            if (chatInput) chatInput.style.display = chatDisplay;
 
             // 显示公开标识
             this.showPublicBadge();
@@ -281,6 +515,20 @@ class OpenNotebook {
             workspace.classList.remove('readonly-mode');
             const addSourceBtn = document.getElementById('btnAddSource');
             if (addSourceBtn) addSourceBtn.style.display = '';
+            const relatedBtn = document.getElementById('btnRelatedPapers');
+            if (relatedBtn) relatedBtn.style.display = '';
+            const searchBtn = document.getElementById('btnSearchSources');
+            if (searchBtn) searchBtn.style.display = '';
+            const activityBtn = document.getElementById('btnNotebookActivity');
+            if (activityBtn) activityBtn.style.display = '';
+            const saveChatBtn = document.getElementById('btnSaveChat');
+            if (saveChatBtn) saveChatBtn.style.display = '';
+            const promptLibraryBtn = document.getElementById('btnPromptLibrary');
+            if (promptLibraryBtn) promptLibraryBtn.style.display = '';
+            const styleSelect = document.getElementById('chatStyleSelect');
+            if (styleSelect) styleSelect.style.display = '';
+            const retrievalBtn = document.getElementById('btnRetrievalSettings');
+            if (retrievalBtn) retrievalBtn.style.display = '';
 
             document.querySelectorAll('.transform-card').forEach(btn => {
                 btn.style.pointerEvents = '';
@@ -415,12 +663,21 @@ class OpenNotebook {
                 this.showShareDialog(this.currentNotebook);
             }
         });
+        safeAddEventListener('btnNotebookActivity', 'click', () => {
+            if (this.currentNotebook) {
+                this.showNotebookActivity(this.currentNotebook);
+            }
+        });
 
         // Share modal events
         safeAddEventListener('btnCloseShareModal', 'click', () => this.closeShareModal());
         safeAddEventListener('btnCancelShare', 'click', () => this.closeShareModal());
         safeAddEventListener('btnCopyLink', 'click', () => this.copyShareLink());
         safeAddEventListener('btnToggleShare', 'click', () => this.toggleShareFromModal());
+        safeAddEventListener('btnSaveSharePolicy', 'click', () => this.saveSharePolicy());
+        safeAddEventListener('sharePolicyNotes', 'change', (e) => {
+            document.getElementById('sharePolicyTypes').classList.toggle('disabled', !e.target.checked);
+        });
 
         // Auth events
         safeAddEventListener('btnLogin', 'click', () => this.handleLogin());
@@ -449,10 +706,14 @@ class OpenNotebook {
         });
         
         safeAddEventListener('newNotebookForm', 'submit', (e) => this.handleCreateNotebook(e));
+        safeAddEventListener('btnImportNotebook', 'click', () => document.getElementById('notebookImportInput').click());
+        safeAddEventListener('notebookImportInput', 'change', (e) => this.handleNotebookImport(e));
         safeAddEventListener('btnCloseNotebookModal', 'click', () => this.closeModals());
         safeAddEventListener('btnCancelNotebook', 'click', () => this.closeModals());
 
         safeAddEventListener('btnAddSource', 'click', () => this.showAddSourceModal());
+        safeAddEventListener('btnRelatedPapers', 'click', () => this.showRelatedPapers());
+        safeAddEventListener('btnSearchSources', 'click', () => this.showSourceSearch());
         safeAddEventListener('btnCloseSourceModal', 'click', () => this.closeModals());
         const dropZone = document.getElementById('dropZone');
         if (dropZone) {
@@ -468,6 +729,8 @@ class OpenNotebook {
         }
         
         safeAddEventListener('fileInput', 'change', (e) => this.handleFileUpload(e));
+        safeAddEventListener('bibDropZone', 'click', () => document.getElementById('bibInput').click());
+        safeAddEventListener('bibInput', 'change', (e) => this.handleBibliographyImport(e));
         safeAddEventListener('textSourceForm', 'submit', (e) => this.handleTextSource(e));
         safeAddEventListener('urlSourceForm', 'submit', (e) => this.handleURLSource(e));
         safeAddEventListener('btnCancelText', 'click', () => this.closeModals());
@@ -496,6 +759,10 @@ class OpenNotebook {
         });
 
         safeAddEventListener('chatForm', 'submit', (e) => this.handleChat(e));
+        safeAddEventListener('btnSaveChat', 'click', () => this.showSaveChatDialog());
+        safeAddEventListener('btnPromptLibrary', 'click', () => this.showPromptLibrary());
+        safeAddEventListener('chatStyleSelect', 'change', (e) => this.saveAnswerStyle(e.target.value));
+        safeAddEventListener('btnRetrievalSettings', 'click', () => this.showRetrievalSettings());
 
         safeAddEventListener('modalOverlay', 'click', (e) => {
             if (e.target.id === 'modalOverlay') {
@@ -575,6 +842,12 @@ class OpenNotebook {
     // Auth Methods
     async initAuth() {
         if (!this.token) {
+            // 本地模式下无需登录，服务器直接返回本地用户
+            try {
+                this.currentUser = await this.api('/auth/me');
+            } catch (error) {
+                this.currentUser = null;
+            }
             this.updateAuthUI();
             return;
         }
@@ -607,7 +880,9 @@ class OpenNotebook {
             // Get provider display name
             const providerNames = {
                 'github': 'GitHub',
-                'google': 'Google'
+                'google': 'Google',
+                'password': '邮箱密码',
+                'local': '本地模式'
             };
             const providerName = providerNames[this.currentUser.provider] || this.currentUser.provider;
             const tooltipText = `登录方式: ${providerName}\n账号ID: ${this.currentUser.email}`;
@@ -675,6 +950,12 @@ class OpenNotebook {
                             </svg>
                             使用 Google 登录
                         </button>
+                        <div class="login-divider"><span>或使用邮箱密码</span></div>
+                        <form class="login-form" id="passwordLoginForm">
+                            <input type="email" class="input-field" name="email" placeholder="邮箱" required>
+                            <input type="password" class="input-field" name="password" placeholder="密码" required>
+                            <button type="submit" class="btn-primary">登录</button>
+                        </form>
                     </div>
                 </div>
             `;
@@ -690,6 +971,10 @@ class OpenNotebook {
             document.getElementById('btnLoginGoogle').addEventListener('click', () => {
                 this.loginWithProvider('google');
             });
+            document.getElementById('passwordLoginForm').addEventListener('submit', (e) => {
+                e.preventDefault();
+                this.loginWithPassword(e.target);
+            });
         }
 
         modal.classList.add('active');
@@ -702,6 +987,139 @@ class OpenNotebook {
         }
     }
 
+    // 保存登录状态
+    setSession(token, user) {
+        this.token = token;
+        this.currentUser = user;
+        localStorage.setItem('token', this.token);
+
+        // Also set token as cookie for image loading
+        document.cookie = `token=${this.token}; path=/; SameSite=Lax`;
+
+        this.updateAuthUI();
+    }
+
+    async loginWithPassword(form) {
+        const formData = new FormData(form);
+        try {
+            const response = await fetch('/auth/login', {
+                method: 'POST',
+                headers: { 'Content-Type': 'application/json' },
+                body: JSON.stringify({
+                    email: formData.get('email'),
+                    password: formData.get('password')
+                })
+            });
+            const data = await response.json().catch(() => ({ error: '登录失败' }));
+            if (!response.ok) {
+                throw new Error(data.error || '登录失败');
+            }
+
+            this.closeLoginModal();
+            form.reset();
+            this.setSession(data.token, data.user);
+            this.loadNotebooks();
+        } catch (error) {
+            this.showError(error.message);
+        }
+    }
+
+    // 首次运行：服务器还没有任何账户时显示设置向导
+    async checkSetup() {
+        try {
+            const status = await this.api('/setup');
+            if (status.setup_required) {
+                this.showSetupModal(status);
+            }
+        } catch (error) {
+            console.warn('Setup check failed:', error);
+        }
+    }
+
+    showSetupModal(status) {
+        const modal = document.createElement('div');
+        modal.id = 'setupModal';
+        modal.className = 'login-modal active';
+        modal.innerHTML = `
+            <div class="login-modal-content">
+                <div class="login-modal-header">
+                    <h3>初始化设置</h3>
+                </div>
+                <form class="login-modal-body login-form" id="setupForm">
+                    <label class="input-label">管理员账户</label>
+                    <input type="text" class="input-field" name="name" placeholder="名称 (可选)">
+                    <input type="email" class="input-field" name="email" placeholder="邮箱" required>
+                    <input type="password" class="input-field" name="password" placeholder="密码 (至少 8 位)" minlength="8" required>
+                    <label class="input-label">模型服务${status.llm_configured ? ' (已通过环境变量配置，可留空)' : ''}</label>
+                    <select class="input-field" name="provider">
+                        <option value="openai">OpenAI 兼容接口</option>
+                        <option value="ollama">Ollama (本地)</option>
+                        <option value="azure">Azure OpenAI</option>
+                    </select>
+                    <input type="password" class="input-field" name="api_key" placeholder="API Key">
+                    <input type="text" class="input-field" name="base_url" placeholder="接口地址 (可选)">
+                    <input type="text" class="input-field" name="model" placeholder="模型名称 (可选)">
+                    <input type="password" class="input-field" name="google_api_key" placeholder="Google API Key (可选，用于生成图片)">
+                    <button type="submit" class="btn-primary">完成设置</button>
+                </form>
+            </div>
+        `;
+        document.body.appendChild(modal);
+
+        const form = document.getElementById('setupForm');
+        form.addEventListener('submit', (e) => {
+            e.preventDefault();
+            this.submitSetup(e.target);
+        });
+
+        // Azure OpenAI 用资源地址和部署名称代替接口地址和模型名称
+        form.elements.provider.addEventListener('change', (e) => {
+            const azure = e.target.value === 'azure';
+            form.elements.base_url.placeholder = azure ? '资源地址，如 https://xxx.openai.azure.com' : '接口地址 (可选)';
+            form.elements.model.placeholder = azure ? '模型部署名称' : '模型名称 (可选)';
+        });
+    }
+
+    async submitSetup(form) {
+        const formData = new FormData(form);
+        const settings = { google_api_key: formData.get('google_api_key') };
+        if (formData.get('provider') === 'ollama') {
+            const baseURL = formData.get('base_url') || 'http://localhost:11434';
+            settings.ollama_base_url = baseURL;
+            settings.openai_base_url = baseURL;
+            settings.ollama_model = formData.get('model');
+        } else if (formData.get('provider') === 'azure') {
+            settings.azure_openai_api_key = formData.get('api_key');
+            settings.azure_openai_endpoint = formData.get('base_url');
+            settings.azure_openai_deployment = formData.get('model');
+        } else {
+            settings.openai_api_key = formData.get('api_key');
+            settings.openai_base_url = formData.get('base_url');
+            settings.openai_model = formData.get('model');
+        }
+
+        try {
+            const result = await this.api('/setup', {
+                method: 'POST',
+                body: JSON.stringify({
+                    admin: {
+                        name: formData.get('name'),
+                        email: formData.get('email'),
+                        password: formData.get('password')
+                    },
+                    settings
+                })
+            });
+
+            document.getElementById('setupModal').remove();
+            this.setSession(result.token, result.user);
+            this.showToast('设置完成', 'success');
+            this.loadNotebooks();
+        } catch (error) {
+            this.showError(error.message);
+        }
+    }
+
     loginWithProvider(provider) {
         this.closeLoginModal();
 
@@ -726,17 +1144,12 @@ class OpenNotebook {
             }
 
             if (event.data.token && event.data.user) {
-                this.token = event.data.token;
-                this.currentUser = event.data.user;
-                localStorage.setItem('token', this.token);
-
-                // Also set token as cookie for image loading
-                document.cookie = `token=${this.token}; path=/; SameSite=Lax`;
-
-                this.updateAuthUI();
+                this.setSession(event.data.token, event.data.user);
 
                 // Reload data
                 this.loadNotebooks();
+            } else if (event.data.error) {
+                this.showError('登录失败: ' + event.data.error);
             }
         };
 
@@ -829,11 +1242,38 @@ class OpenNotebook {
             card.querySelector('.notebook-card-name').textContent = nb.name;
             card.querySelector('.notebook-card-desc').textContent = nb.description || '暂无描述';
 
+            // 法律保留：管理员冻结的笔记本只读
+            if (nb.legal_hold) {
+                card.classList.add('legal-hold');
+                card.title = `法律保留中，内容不可修改${nb.legal_hold.reason ? '：' + nb.legal_hold.reason : ''}`;
+            }
+
             // 直接使用从 API 获取的统计信息
             card.querySelector('.stat-sources').textContent = `${nb.source_count || 0} 来源`;
             card.querySelector('.stat-notes').textContent = `${nb.note_count || 0} 笔记`;
             card.querySelector('.stat-date').textContent = this.formatDate(nb.created_at);
 
+            // 封面图片
+            if (nb.cover_image_url) {
+                const cover = card.querySelector('.notebook-card-cover');
+                cover.style.backgroundImage = `url('${nb.cover_image_url}')`;
+                cover.classList.remove('hidden');
+                card.querySelector('.notebook-card-icon').classList.add('hidden');
+            }
+
+            const coverCardBtn = clone.querySelector('.btn-cover-card');
+            if (coverCardBtn) {
+                coverCardBtn.addEventListener('click', (e) => {
+                    e.stopPropagation();
+                    this.showCoverMenu(nb, coverCardBtn);
+                });
+            }
+
+            clone.querySelector('.btn-export-card')?.addEventListener('click', (e) => {
+                e.stopPropagation();
+                this.exportNotebook(nb);
+            });
+
             // 更新分享按钮状态
             const shareCardBtn = clone.querySelector('.btn-share-card');
             if (shareCardBtn) {
@@ -853,7 +1293,7 @@ class OpenNotebook {
             }
 
             card.addEventListener('click', (e) => {
-                if (!e.target.closest('.btn-delete-card') && !e.target.closest('.btn-share-card')) {
+                if (!e.target.closest('.btn-delete-card') && !e.target.closest('.btn-share-card') && !e.target.closest('.btn-cover-card') && !e.target.closest('.btn-export-card')) {
                     this.selectNotebook(nb.id);
                 }
             });
@@ -949,6 +1389,7 @@ class OpenNotebook {
             workspace.classList.add('hidden');
             header.classList.remove('hidden');
             this.currentNotebook = null;
+            this.disconnectPresence();
             this.renderNotebookCards();
             // Update URL to root when returning to landing page
             window.history.pushState({}, '', '/');
@@ -1054,6 +1495,7 @@ class OpenNotebook {
                 const card = document.createElement('div');
                 card.className = 'compact-note-card';
                 card.dataset.noteId = note.id;
+                card.classList.toggle('private', !!note.private);
 
                 const plainText = note.content
                     .replace(/^#+\s+/gm, '')
@@ -1153,10 +1595,77 @@ class OpenNotebook {
         await Promise.all([
             this.loadSources(),
             this.loadNotes(),
-            this.loadChatSessions()
+            this.loadChatSessions(),
+            this.loadAnswerStyle()
         ]);
 
-        this.setStatus(`当前选择: ${this.currentNotebook.name}`);
+        const tokenParam = this.token ? `?token=${encodeURIComponent(this.token)}` : '';
+        this.connectPresence(`/api/notebooks/${id}/presence${tokenParam}`);
+
+        this.setStatus(this.currentNotebook.legal_hold
+            ? `当前选择: ${this.currentNotebook.name}（法律保留中，内容只读）`
+            : `当前选择: ${this.currentNotebook.name}`);
+    }
+
+    // 在线状态：通过 WebSocket 告诉服务器本页仍打开（心跳），并显示同时在看这个笔记本的人
+    connectPresence(path) {
+        this.disconnectPresence();
+        this.presencePath = path;
+        const protocol = location.protocol === 'https:' ? 'wss:' : 'ws:';
+        const ws = new WebSocket(`${protocol}//${location.host}${path}`);
+        this.presenceSocket = ws;
+        const heartbeat = setInterval(() => {
+            if (ws.readyState === WebSocket.OPEN) ws.send('{"type":"heartbeat"}');
+        }, 20000);
+        ws.onmessage = (event) => {
+            try {
+                const message = JSON.parse(event.data);
+                if (message.type === 'presence') this.renderPresence(message);
+            } catch (e) {
+                console.warn('Invalid presence message', e);
+            }
+        };
+        ws.onclose = () => {
+            clearInterval(heartbeat);
+            // 断线后重连，除非已离开这个笔记本
+            if (this.presenceSocket === ws) {
+                this.presenceSocket = null;
+                setTimeout(() => {
+                    if (this.presencePath === path && !this.presenceSocket) this.connectPresence(path);
+                }, 5000);
+            }
+        };
+    }
+
+    disconnectPresence() {
+        this.presencePath = null;
+        const ws = this.presenceSocket;
+        this.presenceSocket = null;
+        if (ws) ws.close();
+        const container = document.getElementById('notebookPresence');
+        if (container) {
+            container.innerHTML = '';
+            container.classList.add('hidden');
+        }
+    }
+
+    renderPresence(presence) {
+        const container = document.getElementById('notebookPresence');
+        if (!container) return;
+        const me = this.currentUser && this.currentUser.id;
+        const others = (presence.collaborators || []).filter(c => c.active && c.user_id !== me);
+        const avatars = others.map(c => {
+            const name = this.escapeHtml(c.name || c.email);
+            const title = `${name} 正在查看${c.sessions > 1 ? `（${c.sessions} 个窗口）` : ''}`;
+            return c.avatar_url
+                ? `<img class="presence-avatar" src="${this.escapeHtml(c.avatar_url)}" alt="${name}" title="${title}">`
+                : `<span class="presence-avatar" title="${title}">${name.charAt(0).toUpperCase()}</span>`;
+        }).join('');
+        const anonymous = presence.public_viewers > 0
+            ? `<span class="presence-public" title="公开页面的匿名访客">${presence.public_viewers} 位访客</span>`
+            : '';
+        container.innerHTML = avatars + anonymous;
+        container.classList.toggle('hidden', !avatars && !anonymous);
     }
 
     // 更新分享按钮状态
@@ -1174,6 +1683,79 @@ class OpenNotebook {
         }
     }
 
+    // 笔记本动态：来源添加、笔记生成、公开分享等操作记录
+    async showNotebookActivity(notebook) {
+        let activities;
+        try {
+            activities = await this.api(`/notebooks/${notebook.id}/activity?limit=100`);
+        } catch (error) {
+            this.showError('无法加载笔记本动态');
+            return;
+        }
+
+        const labels = {
+            create_notebook: '创建了笔记本',
+            add_source: '添加了来源',
+            upload_file: '上传了文件',
+            quick_note: '快速记录了来源',
+            hook_ingest: '通过自动化添加了来源',
+            telegram_capture: '通过 Telegram 添加了来源',
+            calendar_import: '从日历导入了会议',
+            import_reference: '导入了文献',
+            import_chat: '保存了对话',
+            run_prompt: '运行了提示词',
+            edit_source: '编辑了来源',
+            refresh_source: '更新了来源内容',
+            restore_source: '恢复了来源版本',
+            source_changed: '来源网页内容有变化',
+            source_broken: '来源链接失效',
+            create_note: '添加了笔记',
+            transform: '生成了笔记',
+            edit_note: '编辑了笔记',
+            restore_note: '恢复了笔记版本',
+            note_assist: '使用写作助手修改了笔记',
+            chat_edit_note: '通过对话编辑修改了笔记',
+            batch_chat: '批量提问',
+            coverage_report: '来源覆盖报告',
+            share_note: '分享了笔记',
+            unshare_note: '取消分享笔记',
+            make_public: '公开了笔记本',
+            make_private: '取消公开笔记本',
+            update_share_policy: '修改了公开范围',
+            set_legal_hold: '设置了法律保留',
+            release_legal_hold: '解除了法律保留',
+            create_draft: '开始撰写长文',
+            check_overlap: '检查了来源重合',
+            create_chat_tool: '添加了对话工具',
+            create_hook: '添加了自动化入口',
+        };
+
+        let modal = document.getElementById('notebookActivityModal');
+        if (modal) modal.remove();
+        modal = document.createElement('div');
+        modal.id = 'notebookActivityModal';
+        modal.className = 'login-modal active';
+        modal.innerHTML = `
+            <div class="login-modal-content">
+                <div class="login-modal-header">
+                    <h3>${this.escapeHtml(notebook.name)} · 动态</h3>
+                    <button class="btn-close-login">×</button>
+                </div>
+                <div class="login-modal-body activity-feed">
+                    ${activities.length === 0 ? '<p class="empty-hint">暂无动态</p>' : activities.map(a => `
+                        <div class="activity-item">
+                            <span class="activity-time">${new Date(a.created_at).toLocaleString()}</span>
+                            <span class="activity-action">${this.escapeHtml(labels[a.action] || a.action)}</span>
+                            ${a.resource_type !== 'notebook' && a.resource_name ? `<span class="activity-resource">${this.escapeHtml(a.resource_name)}</span>` : ''}
+                        </div>
+                    `).join('')}
+                </div>
+            </div>
+        `;
+        document.body.appendChild(modal);
+        modal.querySelector('.btn-close-login').addEventListener('click', () => modal.remove());
+    }
+
     // 显示分享对话框
     showShareDialog(notebook) {
         this.currentShareNotebook = notebook;
@@ -1185,12 +1767,61 @@ class OpenNotebook {
 
         // 更新状态显示
         this.updateShareModalState(notebook);
+        this.loadSharePolicy(notebook);
 
         // 显示模态框
         modal.classList.add('active');
         overlay.classList.add('active');
     }
 
+    // 加载公开范围设置
+    async loadSharePolicy(notebook) {
+        try {
+            const policy = await this.api(`/notebooks/${notebook.id}/public/policy`);
+            this.renderSharePolicy(policy);
+        } catch (error) {
+            this.showError(`加载公开范围失败: ${error.message}`);
+        }
+    }
+
+    // 渲染公开范围：笔记、笔记类型、来源、访客对话
+    renderSharePolicy(policy) {
+        document.getElementById('sharePolicyNotes').checked = policy.notes;
+        document.getElementById('sharePolicySources').checked = policy.sources;
+        document.getElementById('sharePolicyChat').checked = policy.chat;
+
+        const types = document.getElementById('sharePolicyTypes');
+        const selected = new Set(policy.note_types || []);
+        types.innerHTML = Object.entries(this.noteTypeNameMap).map(([type, name]) => `
+            <label class="share-policy-option">
+                <input type="checkbox" value="${type}" ${selected.has(type) ? 'checked' : ''}> ${this.escapeHtml(name)}
+            </label>
+        `).join('');
+        types.classList.toggle('disabled', !policy.notes);
+    }
+
+    // 保存公开范围
+    async saveSharePolicy() {
+        if (!this.currentShareNotebook) return;
+
+        const noteTypes = Array.from(document.querySelectorAll('#sharePolicyTypes input:checked')).map(input => input.value);
+        try {
+            const policy = await this.api(`/notebooks/${this.currentShareNotebook.id}/public/policy`, {
+                method: 'PUT',
+                body: JSON.stringify({
+                    notes: document.getElementById('sharePolicyNotes').checked,
+                    note_types: noteTypes,
+                    sources: document.getElementById('sharePolicySources').checked,
+                    chat: document.getElementById('sharePolicyChat').checked,
+                }),
+            });
+            this.renderSharePolicy(policy);
+            this.showToast('公开范围已保存', 'success');
+        } catch (error) {
+            this.showError(`保存失败: ${error.message}`);
+        }
+    }
+
     // 更新分享对话框状态
     updateShareModalState(notebook) {
         const statusIcon = document.getElementById('shareStatusIcon');
@@ -1422,6 +2053,104 @@ class OpenNotebook {
         }
     }
 
+    async handleNotebookImport(e) {
+        const file = e.target.files[0];
+        if (!file) return;
+
+        const formData = new FormData();
+        formData.append('file', file);
+
+        this.showLoading('导入笔记本中...');
+        try {
+            const result = await this.api('/notebooks/import', {
+                method: 'POST',
+                body: formData,
+            });
+            this.cache.delete('notebooks');
+            this.notebooks.push(result.notebook);
+            this.renderNotebooks();
+            this.selectNotebook(result.notebook.id);
+            this.closeModals();
+            this.hideLoading();
+            this.showToast(`已导入 ${result.sources} 个来源、${result.notes} 条笔记和 ${result.chats} 个对话`, 'success');
+        } catch (error) {
+            this.hideLoading();
+            this.showError(`导入失败: ${error.message}`);
+        }
+        e.target.value = '';
+    }
+
+    // 笔记本封面菜单：上传、AI 生成或移除
+    showCoverMenu(nb, anchor) {
+        document.querySelector('.cover-menu')?.remove();
+
+        const menu = document.createElement('div');
+        menu.className = 'cover-menu';
+        menu.innerHTML = `
+            <button data-action="upload">上传图片</button>
+            <button data-action="generate">AI 生成</button>
+            ${nb.cover_image_url ? '<button data-action="remove">移除封面</button>' : ''}
+        `;
+        const rect = anchor.getBoundingClientRect();
+        menu.style.top = `${rect.bottom + window.scrollY + 4}px`;
+        menu.style.left = `${rect.left + window.scrollX}px`;
+        document.body.appendChild(menu);
+
+        const closeMenu = () => {
+            menu.remove();
+            document.removeEventListener('click', closeMenu);
+        };
+        setTimeout(() => document.addEventListener('click', closeMenu), 0);
+
+        menu.addEventListener('click', (e) => {
+            const action = e.target.dataset.action;
+            if (!action) return;
+            e.stopPropagation();
+            closeMenu();
+
+            if (action === 'upload') {
+                const input = document.createElement('input');
+                input.type = 'file';
+                input.accept = 'image/png,image/jpeg,image/gif,image/webp';
+                input.addEventListener('change', () => {
+                    if (input.files.length > 0) {
+                        this.uploadNotebookCover(nb.id, input.files[0]);
+                    }
+                });
+                input.click();
+            } else if (action === 'generate') {
+                this.generateNotebookCover(nb.id);
+            } else if (action === 'remove') {
+                this.updateNotebookCover(nb.id, `/notebooks/${nb.id}/cover`, { method: 'DELETE' });
+            }
+        });
+    }
+
+    uploadNotebookCover(id, file) {
+        const formData = new FormData();
+        formData.append('file', file);
+        return this.updateNotebookCover(id, `/notebooks/${id}/cover`, { method: 'PUT', body: formData });
+    }
+
+    generateNotebookCover(id) {
+        this.showToast('正在生成封面...', 'success');
+        return this.updateNotebookCover(id, `/notebooks/${id}/cover/generate`, { method: 'POST', body: '{}' });
+    }
+
+    async updateNotebookCover(id, endpoint, options) {
+        try {
+            const updated = await this.api(endpoint, options);
+            const nb = this.notebooks.find(n => n.id === id);
+            if (nb) {
+                nb.cover_image_url = updated.cover_image_url;
+            }
+            this.cache.delete('notebooks');
+            this.renderNotebooks();
+        } catch (error) {
+            this.showError('更新封面失败: ' + error.message);
+        }
+    }
+
     async deleteNotebook(id) {
         try {
             await this.api(`/notebooks/${id}`, { method: 'DELETE' });
@@ -1520,6 +2249,7 @@ class OpenNotebook {
                 const card = clone.querySelector('.source-card');
 
                 card.dataset.id = source.id;
+                card.dataset.type = source.type;
                 card.querySelector('.source-type-badge').textContent = source.type;
                 card.querySelector('.source-name').textContent = source.name;
                 card.querySelector('.source-meta').textContent = this.formatFileSize(source.file_size) || '文本来源';
@@ -1528,14 +2258,57 @@ class OpenNotebook {
                 const icon = this.getSourceIcon(source.type);
                 card.querySelector('.source-icon').innerHTML = icon;
 
-                const removeBtn = card.querySelector('.btn-remove-source');
-                removeBtn.addEventListener('click', () => {
+                if (!source.read_at) {
+                    card.classList.add('unread');
+                }
+                if (source.private) {
+                    card.classList.add('private');
+                }
+
+                // 定期检查发现链接失效或页面内容已变化的网页来源
+                if (source.health && source.health.status !== 'ok') {
+                    card.classList.add(`source-${source.health.status}`);
+                    card.querySelector('.source-meta').textContent = source.health.status === 'broken' ? '链接失效' : '页面内容已变化';
+                    card.title = source.health.error || `页面与导入时的内容相似度为 ${Math.round((source.health.similarity || 0) * 100)}%`;
+                }
+
+                // 网页和上传文件在后台导入
+                if (source.ingest_status === 'queued' || source.ingest_status === 'running') {
+                    card.classList.add('source-ingesting');
+                    card.querySelector('.source-meta').textContent = source.ingest_status === 'queued' ? '等待导入...'
+                        : source.ingest_total ? `正在导入 ${source.ingest_done || 0}/${source.ingest_total} 页...` : '正在导入...';
+                } else if (source.ingest_status === 'failed') {
+                    card.classList.add('source-ingest-failed');
+                    card.querySelector('.source-meta').textContent = '导入失败';
+                    card.title = source.ingest_error || '';
+                }
+
+                const removeBtn = card.querySelector('.btn-remove-source');
+                removeBtn.addEventListener('click', (e) => {
+                    e.stopPropagation();
                     this.removeSource(source.id);
                 });
 
+                // Opening a source shows its full text and marks it as read
+                card.addEventListener('click', () => this.showSourcePassage(source.id));
+
                 container.appendChild(clone);
             });
 
+            // 有来源仍在导入时定时刷新列表
+            clearTimeout(this.ingestPollTimer);
+            if (sources.some(s => s.ingest_status === 'queued' || s.ingest_status === 'running')) {
+                this.ingestPollTimer = setTimeout(() => this.loadSources(), 2000);
+            }
+
+            // 每个笔记本只提醒一次
+            const flagged = sources.filter(s => s.health && s.health.status !== 'ok');
+            this.sourceHealthNotified = this.sourceHealthNotified || new Set();
+            if (flagged.length > 0 && !this.sourceHealthNotified.has(this.currentNotebook.id)) {
+                this.sourceHealthNotified.add(this.currentNotebook.id);
+                this.showToast(`${flagged.length} 个网页来源链接失效或内容已变化`, 'warn');
+            }
+
             this.updateFooter();
         } catch (error) {
             console.error('加载来源失败:', error);
@@ -1548,6 +2321,12 @@ class OpenNotebook {
             text: '<svg viewBox="0 0 40 40" fill="none" stroke="currentColor" stroke-width="1.5"><path d="M8 6 L32 6"/><path d="M8 12 L32 12"/><path d="M8 18 L28 18"/><path d="M8 24 L32 24"/><path d="M8 30 L24 30"/></svg>',
             url: '<svg viewBox="0 0 40 40" fill="none" stroke="currentColor" stroke-width="1.5"><path d="M12 20 C12 14 16 10 22 10 C28 10 32 14 32 20 C32 26 28 30 22 30"/><path d="M28 20 C28 26 24 30 18 30 C12 30 8 26 8 20 C8 14 12 10 18 10"/></svg>',
             insight: '<svg viewBox="0 0 40 40" fill="none" stroke="currentColor" stroke-width="1.5"><circle cx="20" cy="20" r="14"/><path d="M20 12 L20 22"/><path d="M20 26 L20 28"/><circle cx="20" cy="20" r="8" stroke-dasharray="2 2"/></svg>',
+            reference: '<svg viewBox="0 0 40 40" fill="none" stroke="currentColor" stroke-width="1.5"><path d="M8 8 L19 8 C20 8 20 9 20 9 L20 34 C20 33 19 33 19 33 L8 33 Z"/><path d="M32 8 L21 8 C20 8 20 9 20 9 L20 34 C20 33 21 33 21 33 L32 33 Z"/><path d="M11 14 L17 14"/><path d="M11 19 L17 19"/><path d="M23 14 L29 14"/></svg>',
+            chat: '<svg viewBox="0 0 40 40" fill="none" stroke="currentColor" stroke-width="1.5"><path d="M6 8 L28 8 L28 24 L14 24 L8 30 L8 24 L6 24 Z"/><path d="M30 14 L34 14 L34 30 L32 30 L32 35 L26 30 L16 30 L16 27"/><path d="M11 14 L23 14"/><path d="M11 19 L19 19"/></svg>',
+            database: '<svg viewBox="0 0 40 40" fill="none" stroke="currentColor" stroke-width="1.5"><ellipse cx="20" cy="9" rx="12" ry="4"/><path d="M8 9 L8 31 C8 33 13 35 20 35 C27 35 32 33 32 31 L32 9"/><path d="M8 16 C8 18 13 20 20 20 C27 20 32 18 32 16"/><path d="M8 23 C8 25 13 27 20 27 C27 27 32 25 32 23"/></svg>',
+            confluence: '<svg viewBox="0 0 40 40" fill="none" stroke="currentColor" stroke-width="1.5"><path d="M12 4 L28 4 L34 10 L34 30 L12 30 Z"/><path d="M6 10 L6 36 L28 36"/><path d="M17 13 L28 13"/><path d="M17 18 L29 18"/><path d="M17 23 L25 23"/></svg>',
+            youtube: '<svg viewBox="0 0 40 40" fill="none" stroke="currentColor" stroke-width="1.5"><rect x="5" y="9" width="30" height="22" rx="6"/><path d="M17 15 L25 20 L17 25 Z"/></svg>',
+            meeting: '<svg viewBox="0 0 40 40" fill="none" stroke="currentColor" stroke-width="1.5"><rect x="7" y="9" width="26" height="24" rx="2"/><path d="M7 16 L33 16"/><path d="M14 5 L14 12"/><path d="M26 5 L26 12"/><path d="M13 22 L17 22"/><path d="M23 22 L27 22"/><path d="M13 27 L17 27"/></svg>',
         };
         return icons[type] || icons.file;
     }
@@ -1692,6 +2471,32 @@ class OpenNotebook {
         document.getElementById('fileInput').value = '';
     }
 
+    async handleBibliographyImport(e) {
+        const file = e.target.files[0];
+        if (!file || !this.currentNotebook) return;
+
+        const formData = new FormData();
+        formData.append('file', file);
+
+        this.showLoading('导入文献中...');
+        try {
+            const result = await this.api(`/notebooks/${this.currentNotebook.id}/sources/bibliography`, {
+                method: 'POST',
+                body: formData,
+            });
+            this.hideLoading();
+            this.closeModals();
+            await this.loadSources();
+            await this.updateCurrentNotebookCounts();
+            const skipped = result.skipped ? `，跳过 ${result.skipped} 条重复文献` : '';
+            this.showToast(`已导入 ${result.imported} 条文献${skipped}`, 'success');
+        } catch (error) {
+            this.hideLoading();
+            this.showError(`导入失败: ${error.message}`);
+        }
+        e.target.value = '';
+    }
+
     async handleTextSource(e) {
         e.preventDefault();
         const form = e.target;
@@ -1727,6 +2532,14 @@ class OpenNotebook {
 
         this.showLoading('获取网址内容中...');
 
+        // 抓取整个站点时，未填写的限制使用服务端默认值
+        const crawl = data.get('crawl') ? {
+            max_depth: parseInt(data.get('crawl_depth'), 10) || 0,
+            max_pages: parseInt(data.get('crawl_pages'), 10) || 0,
+            path_prefix: data.get('crawl_prefix') || '',
+            merge: !!data.get('crawl_merge'),
+        } : undefined;
+
         try {
             await this.api(`/notebooks/${this.currentNotebook.id}/sources`, {
                 method: 'POST',
@@ -1734,6 +2547,9 @@ class OpenNotebook {
                     name: data.get('name') || data.get('url'),
                     type: 'url',
                     url: data.get('url'),
+                    language: data.get('language') || '',
+                    parser: data.get('readability') ? 'readability' : '',
+                    crawl,
                 }),
             });
 
@@ -1761,11 +2577,15 @@ class OpenNotebook {
 
     async removeSource(id) {
         try {
-            await this.api(`/notebooks/${this.currentNotebook.id}/sources/${id}`, {
+            const result = await this.api(`/notebooks/${this.currentNotebook.id}/sources/${id}`, {
                 method: 'DELETE',
             });
             await this.loadSources();
             await this.updateCurrentNotebookCounts();
+            this.showUndoToast('来源已移除', result, async () => {
+                await this.loadSources();
+                await this.updateCurrentNotebookCounts();
+            });
         } catch (error) {
             this.showError('移除来源失败');
         }
@@ -1852,6 +2672,11 @@ class OpenNotebook {
     }
 
     async viewNote(note) {
+        // Lists hold only the beginning of long notes; load the full content first
+        if (note.content_external) {
+            note = await this.loadFullNote(note);
+        }
+
         // Debug: log note metadata
         console.log('viewNote - metadata:', note.metadata);
         console.log('viewNote - image_url:', note.metadata?.image_url);
@@ -1934,6 +2759,33 @@ class OpenNotebook {
                         </button>
                     </div>
                 </div>
+                ${this.currentPublicToken ? '' : `
+                    <div class="infographic-actions">
+                        <button class="btn-text" id="btnPptExport">下载 PPTX</button>
+                    </div>
+                `}
+            `;
+        }
+
+        // Podcast audio player
+        let podcastAudioHTML = '';
+        if (note.type === 'podcast') {
+            const audioUrl = note.metadata?.audio_url ? this.rewriteImageUrlsForPublic(note.metadata.audio_url) : null;
+            const voices = Object.entries(note.metadata?.speaker_voices || {})
+                .map(([speaker, voice]) => `${this.escapeHtml(speaker)}：${this.escapeHtml(voice)}`)
+                .join('　');
+            const canVoice = !this.currentPublicToken && !this.currentSharedNoteToken;
+            podcastAudioHTML = `
+                <div class="podcast-audio-container">
+                    ${audioUrl ? `<audio controls preload="metadata" src="${audioUrl}" class="podcast-audio"></audio>` : ''}
+                    ${voices ? `<div class="podcast-voices">${voices}</div>` : ''}
+                    ${note.metadata?.audio_error ? `<div class="podcast-audio-error">音频生成失败：${this.escapeHtml(note.metadata.audio_error)}</div>` : ''}
+                    ${canVoice ? `
+                        <div class="infographic-actions">
+                            <button class="btn-text" id="btnPodcastAudio">${audioUrl ? '重新生成音频' : '生成音频'}</button>
+                        </div>
+                    ` : ''}
+                </div>
             `;
         }
 
@@ -1952,6 +2804,11 @@ class OpenNotebook {
             existingNoteView.remove();
         }
 
+        // Only the owner can share, never from a public or shared view
+        const canShare = !this.currentPublicToken && !this.currentSharedNoteToken;
+
+        const citationsHTML = this.renderCitationsHTML(note.metadata?.citations);
+
         // Create note view container and insert it after chat-messages-wrapper
         const noteViewHTML = `
             <div class="note-view-container">
@@ -1961,6 +2818,67 @@ class OpenNotebook {
                         <span class="note-view-title-text">${note.title}</span>
                     </div>
                     <div class="note-view-actions">
+                        ${canShare ? `
+                        <button class="btn-copy-note" id="btnShareNote" title="分享笔记">
+                            <svg width="16" height="16" viewBox="0 0 16 16" fill="none" stroke="currentColor" stroke-width="2">
+                                <circle cx="12" cy="3" r="2"/>
+                                <circle cx="4" cy="8" r="2"/>
+                                <circle cx="12" cy="13" r="2"/>
+                                <path d="M6 7 L10 4 M6 9 L10 12"/>
+                            </svg>
+                        </button>
+                        <button class="btn-copy-note${note.private ? ' active' : ''}" id="btnNotePrivate" title="${note.private ? '仅自己可见，点击取消' : '设为仅自己可见'}">
+                            <svg width="16" height="16" viewBox="0 0 16 16" fill="none" stroke="currentColor" stroke-width="2">
+                                <rect x="3" y="7" width="10" height="7" rx="1"/>
+                                <path d="M5 7 L5 5 A3 3 0 0 1 11 5 L11 7"/>
+                            </svg>
+                        </button>` : ''}
+                        ${canShare && note.source_ids?.length ? `
+                        <button class="btn-copy-note" id="btnNoteReferences" title="参考文献">
+                            <svg width="16" height="16" viewBox="0 0 16 16" fill="none" stroke="currentColor" stroke-width="2">
+                                <path d="M2 12 C4 12 6 11 6 8 L6 4 L2 4 L2 8 L5 8"/>
+                                <path d="M10 12 C12 12 14 11 14 8 L14 4 L10 4 L10 8 L13 8"/>
+                            </svg>
+                        </button>` : ''}
+                        ${canShare ? `
+                        <button class="btn-copy-note" id="btnEditNote" title="编辑笔记">
+                            <svg width="16" height="16" viewBox="0 0 16 16" fill="none" stroke="currentColor" stroke-width="2">
+                                <path d="M2 14 L14 14"/>
+                                <path d="M4 11 L4 9 L10 3 L12 5 L6 11 Z"/>
+                            </svg>
+                        </button>
+                        <button class="btn-copy-note" id="btnNoteVersions" title="历史版本">
+                            <svg width="16" height="16" viewBox="0 0 16 16" fill="none" stroke="currentColor" stroke-width="2">
+                                <circle cx="8" cy="8" r="6"/>
+                                <polyline points="8,5 8,8 10,10"/>
+                            </svg>
+                        </button>` : ''}
+                        ${canShare ? `
+                        <button class="btn-copy-note" id="btnNoteAssist" title="写作助手">
+                            <svg width="16" height="16" viewBox="0 0 16 16" fill="none" stroke="currentColor" stroke-width="2">
+                                <path d="M11 2 L14 5 L6 13 L2 14 L3 10 Z"/>
+                            </svg>
+                        </button>` : ''}
+                        ${canShare ? `
+                        <button class="btn-copy-note" id="btnNoteEditChat" title="对话编辑">
+                            <svg width="16" height="16" viewBox="0 0 16 16" fill="none" stroke="currentColor" stroke-width="2">
+                                <path d="M2 3 L14 3 L14 11 L7 11 L4 14 L4 11 L2 11 Z"/>
+                                <line x1="5" y1="7" x2="11" y2="7"/>
+                            </svg>
+                        </button>` : ''}
+                        ${canShare ? `
+                        <button class="btn-copy-note" id="btnNoteOverlap" title="来源重合检查">
+                            <svg width="16" height="16" viewBox="0 0 16 16" fill="none" stroke="currentColor" stroke-width="2">
+                                <rect x="2" y="2" width="8" height="8" rx="1"/>
+                                <rect x="6" y="6" width="8" height="8" rx="1"/>
+                            </svg>
+                        </button>` : ''}
+                        ${canShare ? `
+                        <button class="btn-copy-note" id="btnExportNotePdf" title="下载 PDF">
+                            <svg width="16" height="16" viewBox="0 0 16 16" fill="none" stroke="currentColor" stroke-width="2">
+                                <path d="M8 2 L8 10 M4 7 L8 11 L12 7 M3 14 L13 14"/>
+                            </svg>
+                        </button>` : ''}
                         <button class="btn-copy-note" id="btnCopyNote" title="复制 Markdown">
                             <svg width="16" height="16" viewBox="0 0 16 16" fill="none" stroke="currentColor" stroke-width="2">
                                 <rect x="3" y="3" width="10" height="10" rx="1"/>
@@ -1973,7 +2891,9 @@ class OpenNotebook {
                     ${infographicErrorHTML}
                     ${infographicHTML}
                     ${pptSliderHTML}
+                    ${podcastAudioHTML}
                     <div class="markdown-content" style="${showMarkdownContent ? '' : 'display:none'}">${renderedContent}</div>
+                    ${citationsHTML}
                 </div>
             </div>
         `;
@@ -1981,6 +2901,8 @@ class OpenNotebook {
         const chatWrapper = document.querySelector('.chat-messages-wrapper');
         chatWrapper.insertAdjacentHTML('afterend', noteViewHTML);
 
+        document.getElementById('btnPodcastAudio')?.addEventListener('click', () => this.generatePodcastAudio(note));
+
         // PPT Navigation Logic
         if (note.metadata?.slides) {
             let currentSlide = 0;
@@ -1995,6 +2917,7 @@ class OpenNotebook {
 
             document.getElementById('btnPptPrev').addEventListener('click', () => showSlide(currentSlide - 1));
             document.getElementById('btnPptNext').addEventListener('click', () => showSlide(currentSlide + 1));
+            document.getElementById('btnPptExport')?.addEventListener('click', () => this.exportNote(note, 'pptx'));
             
             // Key navigation
             const keyHandler = (e) => {
@@ -2220,6 +3143,54 @@ class OpenNotebook {
         // Switch to note tab
         this.switchPanelTab('note');
 
+        this.bindCitationLinks(document.querySelector('.note-view-container'), note.metadata?.citations);
+
+        // Share button
+        const shareBtn = document.getElementById('btnShareNote');
+        if (shareBtn) {
+            shareBtn.addEventListener('click', () => this.shareNote(note));
+        }
+
+        const privateBtn = document.getElementById('btnNotePrivate');
+        if (privateBtn) {
+            privateBtn.addEventListener('click', () => this.setNotePrivate(note, privateBtn));
+        }
+
+        const referencesBtn = document.getElementById('btnNoteReferences');
+        if (referencesBtn) {
+            referencesBtn.addEventListener('click', () => this.showNoteReferences(note));
+        }
+
+        const editBtn = document.getElementById('btnEditNote');
+        if (editBtn) {
+            editBtn.addEventListener('click', () => this.showNoteEditor(note));
+        }
+
+        const versionsBtn = document.getElementById('btnNoteVersions');
+        if (versionsBtn) {
+            versionsBtn.addEventListener('click', () => this.showNoteVersions(note));
+        }
+
+        const assistBtn = document.getElementById('btnNoteAssist');
+        if (assistBtn) {
+            assistBtn.addEventListener('click', () => this.showNoteAssist(note));
+        }
+
+        const editChatBtn = document.getElementById('btnNoteEditChat');
+        if (editChatBtn) {
+            editChatBtn.addEventListener('click', () => this.showNoteEditChat(note));
+        }
+
+        const overlapBtn = document.getElementById('btnNoteOverlap');
+        if (overlapBtn) {
+            overlapBtn.addEventListener('click', () => this.showNoteOverlap(note));
+        }
+
+        const pdfBtn = document.getElementById('btnExportNotePdf');
+        if (pdfBtn) {
+            pdfBtn.addEventListener('click', () => this.exportNote(note, 'pdf'));
+        }
+
         // Copy button
         const copyBtn = document.getElementById('btnCopyNote');
         copyBtn.addEventListener('click', async () => {
@@ -2266,7 +3237,7 @@ class OpenNotebook {
         }
 
         try {
-            await this.api(`/notebooks/${this.currentNotebook.id}/notes/${id}`, {
+            const result = await this.api(`/notebooks/${this.currentNotebook.id}/notes/${id}`, {
                 method: 'DELETE',
             });
             await this.loadNotes();
@@ -2277,6 +3248,11 @@ class OpenNotebook {
             if (tabBtnNotesList && !tabBtnNotesList.classList.contains('hidden')) {
                 this.renderNotesCompactGrid();
             }
+            this.showUndoToast('笔记已删除', result, async () => {
+                await this.loadNotes();
+                await this.updateCurrentNotebookCounts();
+                this.renderNotesCompactGrid();
+            });
         } catch (error) {
             this.showError('删除笔记失败');
             // Reload to restore if deletion failed
@@ -2298,6 +3274,12 @@ class OpenNotebook {
             return;
         }
 
+        // 长文草稿：先生成大纲，确认后再逐节撰写
+        if (type === 'draft') {
+            this.showDrafts();
+            return;
+        }
+
         const sources = await this.api(`/notebooks/${this.currentNotebook.id}/sources`);
         if (sources.length === 0) {
             this.showError('请先添加来源');
@@ -2323,9 +3305,22 @@ class OpenNotebook {
         placeholder.querySelector('.note-date').textContent = '刚刚';
         placeholder.querySelector('.note-type-badge').textContent = type.toUpperCase();
         
-        // 占位符暂不显示删除按钮
+        // 生成期间删除按钮用于取消任务
         const delBtn = placeholder.querySelector('.btn-delete-note');
-        if (delBtn) delBtn.style.display = 'none';
+        let jobId = null;
+        const cancelJob = async (e) => {
+            e.stopPropagation();
+            if (!jobId) return;
+            try {
+                await this.api(`/notebooks/${this.currentNotebook.id}/transform/${jobId}`, { method: 'DELETE' });
+            } catch (error) {
+                this.showError(error.message);
+            }
+        };
+        if (delBtn) {
+            delBtn.title = '取消生成';
+            delBtn.addEventListener('click', cancelJob);
+        }
         
         // 如果有“暂无笔记”状态，先清空
         const emptyState = notesContainer.querySelector('.empty-state');
@@ -2336,16 +3331,21 @@ class OpenNotebook {
 
         try {
             const sourceIds = sources.map(s => s.id);
-            const note = await this.api(`/notebooks/${this.currentNotebook.id}/transform`, {
+            const unreadOnly = document.getElementById('transformUnreadOnly')?.checked || false;
+            const notebookId = this.currentNotebook.id;
+            const job = await this.api(`/notebooks/${notebookId}/transform`, {
                 method: 'POST',
                 body: JSON.stringify({
                     type: type,
                     prompt: customPrompt || undefined,
                     source_ids: sourceIds,
+                    unread_only: unreadOnly,
                     length: 'medium',
                     format: 'markdown',
                 }),
             });
+            jobId = job.id;
+            const note = await this.waitForTransformJob(notebookId, job.id, placeholder);
 
             // 3. 停止动画并更新占位符
             if (element) element.classList.remove('loading');
@@ -2367,8 +3367,10 @@ class OpenNotebook {
             placeholder.querySelector('.note-preview').textContent = plainText;
             placeholder.querySelector('.note-sources').textContent = `${note.source_ids?.length || 0} 来源`;
 
-            // 恢复删除按钮并绑定事件
+            // 删除按钮恢复为删除笔记
             if (delBtn) {
+                delBtn.removeEventListener('click', cancelJob);
+                delBtn.title = '';
                 delBtn.addEventListener('click', (e) => {
                     e.stopPropagation();
                     this.deleteNote(note.id);
@@ -2406,11 +3408,237 @@ class OpenNotebook {
         } catch (error) {
             if (element) element.classList.remove('loading');
             placeholder.remove(); // 失败则移除占位符
-            this.showError(error.message);
+            if (error.canceled) {
+                this.showToast(`已取消生成${typeName}`, 'success');
+            } else {
+                this.showError(error.message);
+            }
+        }
+    }
+
+    // 轮询转换任务直到完成，返回生成的笔记
+    async waitForTransformJob(notebookId, jobId, placeholder) {
+        const stageText = {
+            queued: '任务排队中，请稍候...',
+            generating: 'AI 正在分析您的来源并撰写笔记，请稍候...',
+            rendering: '正在生成图片，请稍候...',
+            voicing: '正在合成播客音频，请稍候...',
+        };
+        for (;;) {
+            await new Promise(resolve => setTimeout(resolve, 2000));
+            const job = await this.api(`/notebooks/${notebookId}/transform/${jobId}`);
+            if (job.status === 'completed' && job.note) {
+                return job.note;
+            }
+            if (job.status === 'failed') {
+                throw new Error(job.error || '生成失败');
+            }
+            if (job.status === 'canceled') {
+                const error = new Error('已取消');
+                error.canceled = true;
+                throw error;
+            }
+            const text = stageText[job.stage || job.status];
+            if (text) {
+                placeholder.querySelector('.note-preview').textContent = text;
+            }
         }
     }
 
     // 聊天方法
+    // 把当前对话保存为来源（之后的对话可以检索到）或笔记
+    showSaveChatDialog() {
+        if (!this.currentNotebook || !this.currentChatSession) {
+            this.showWarn('还没有可保存的对话');
+            return;
+        }
+        const sessionId = this.currentChatSession;
+
+        let modal = document.getElementById('saveChatModal');
+        if (modal) modal.remove();
+        modal = document.createElement('div');
+        modal.id = 'saveChatModal';
+        modal.className = 'login-modal active';
+        modal.innerHTML = `
+            <div class="login-modal-content">
+                <div class="login-modal-header">
+                    <h3>保存对话</h3>
+                    <button class="btn-close-login">×</button>
+                </div>
+                <div class="login-modal-body">
+                    <input type="text" class="input-field save-chat-title" placeholder="标题（默认为第一个问题）">
+                    <label class="save-chat-option"><input type="radio" name="saveChatAs" value="source" checked> 保存为来源，之后的对话可以引用</label>
+                    <label class="save-chat-option"><input type="radio" name="saveChatAs" value="note"> 保存为笔记</label>
+                    <div class="source-edit-actions"><button class="btn-primary btn-save-chat-confirm">保存</button></div>
+                </div>
+            </div>
+        `;
+        document.body.appendChild(modal);
+        modal.querySelector('.btn-close-login').addEventListener('click', () => modal.remove());
+
+        modal.querySelector('.btn-save-chat-confirm').addEventListener('click', async () => {
+            const as = modal.querySelector('input[name="saveChatAs"]:checked').value;
+            try {
+                await this.api(`/notebooks/${this.currentNotebook.id}/chat/sessions/${sessionId}/export`, {
+                    method: 'POST',
+                    body: JSON.stringify({ as, title: modal.querySelector('.save-chat-title').value }),
+                });
+                modal.remove();
+                if (as === 'source') {
+                    await this.loadSources();
+                } else {
+                    await this.loadNotes();
+                }
+                await this.updateCurrentNotebookCounts();
+                this.showToast(as === 'source' ? '对话已保存为来源' : '对话已保存为笔记', 'success');
+            } catch (error) {
+                this.showError(error.message);
+            }
+        });
+    }
+
+    // 提示词库：保存常用的分析提问，在当前笔记本中一键运行
+    async showPromptLibrary() {
+        if (!this.currentNotebook) {
+            this.showError('请先选择一个笔记本');
+            return;
+        }
+        let prompts;
+        try {
+            prompts = await this.api('/prompts');
+        } catch (error) {
+            this.showError('无法加载提示词库');
+            return;
+        }
+
+        let modal = document.getElementById('promptLibraryModal');
+        if (modal) modal.remove();
+        modal = document.createElement('div');
+        modal.id = 'promptLibraryModal';
+        modal.className = 'login-modal active';
+        modal.innerHTML = `
+            <div class="login-modal-content">
+                <div class="login-modal-header">
+                    <h3>提示词库</h3>
+                    <button class="btn-close-login">×</button>
+                </div>
+                <div class="login-modal-body prompt-library">
+                    <div class="source-edit-actions"><button class="btn-primary btn-new-prompt">新建提示词</button></div>
+                    ${prompts.length === 0 ? '<p class="empty-hint">还没有保存的提示词</p>' : prompts.map(p => `
+                        <div class="prompt-item" data-id="${p.id}">
+                            <div class="prompt-item-title">${this.escapeHtml(p.title)}</div>
+                            <div class="prompt-item-text">${this.escapeHtml(p.text)}</div>
+                            <div class="prompt-item-actions">
+                                <button class="btn-text btn-run-prompt">运行</button>
+                                <button class="btn-text btn-edit-prompt">编辑</button>
+                                <button class="btn-text btn-delete-prompt">删除</button>
+                            </div>
+                        </div>
+                    `).join('')}
+                </div>
+            </div>
+        `;
+        document.body.appendChild(modal);
+        modal.querySelector('.btn-close-login').addEventListener('click', () => modal.remove());
+        modal.querySelector('.btn-new-prompt').addEventListener('click', () => this.showPromptEditor(null));
+
+        modal.querySelectorAll('.prompt-item').forEach(item => {
+            const prompt = prompts.find(p => p.id === item.dataset.id);
+            item.querySelector('.btn-run-prompt').addEventListener('click', () => this.showRunPrompt(prompt));
+            item.querySelector('.btn-edit-prompt').addEventListener('click', () => this.showPromptEditor(prompt));
+            item.querySelector('.btn-delete-prompt').addEventListener('click', async () => {
+                if (!confirm(`删除提示词「${prompt.title}」？`)) return;
+                try {
+                    await this.api(`/prompts/${prompt.id}`, { method: 'DELETE' });
+                    item.remove();
+                } catch (error) {
+                    this.showError(error.message);
+                }
+            });
+        });
+    }
+
+    // 新建或编辑提示词，文本中的 {名称} 是运行时填写的变量
+    showPromptEditor(prompt) {
+        const body = document.querySelector('#promptLibraryModal .login-modal-body');
+        if (!body) return;
+        body.innerHTML = `
+            <input type="text" class="input-field prompt-edit-title" placeholder="标题，例如：每周风险回顾">
+            <textarea class="input-field prompt-edit-text" rows="8" placeholder="提问内容"></textarea>
+            <p class="empty-hint">用 {名称} 表示运行时填写的变量，{date} 和 {notebook} 会自动填入日期和笔记本名称</p>
+            <div class="source-edit-actions">
+                <button class="btn-secondary btn-cancel-prompt">返回</button>
+                <button class="btn-primary btn-save-prompt">保存</button>
+            </div>
+        `;
+        body.querySelector('.prompt-edit-title').value = prompt ? prompt.title : '';
+        body.querySelector('.prompt-edit-text').value = prompt ? prompt.text : '';
+        body.querySelector('.btn-cancel-prompt').addEventListener('click', () => this.showPromptLibrary());
+        body.querySelector('.btn-save-prompt').addEventListener('click', async () => {
+            const text = body.querySelector('.prompt-edit-text').value;
+            // 保留文本中仍在使用的变量的说明和默认值
+            const variables = (prompt ? prompt.variables : []).filter(v => text.includes(`{${v.name}}`));
+            try {
+                await this.api(prompt ? `/prompts/${prompt.id}` : '/prompts', {
+                    method: prompt ? 'PUT' : 'POST',
+                    body: JSON.stringify({ title: body.querySelector('.prompt-edit-title').value, text, variables }),
+                });
+                this.showToast('提示词已保存', 'success');
+                this.showPromptLibrary();
+            } catch (error) {
+                this.showError(error.message);
+            }
+        });
+    }
+
+    // 填写变量后在当前笔记本中运行提示词，回答显示在对话区
+    showRunPrompt(prompt) {
+        const run = async (values) => {
+            document.getElementById('promptLibraryModal')?.remove();
+            const builtins = { date: new Date().toISOString().slice(0, 10), notebook: this.currentNotebook.name };
+            const message = prompt.text.replace(/\{(\w+)\}/g, (match, name) => values[name] || prompt.variables.find(v => v.name === name)?.default || builtins[name] || match);
+            this.addMessage('user', message);
+            await this.streamChatReply(`${this.apiBase}/prompts/${prompt.id}/run`, {
+                notebook_id: this.currentNotebook.id,
+                session_id: this.currentChatSession || undefined,
+                variables: values,
+            });
+        };
+        if (prompt.variables.length === 0) {
+            run({});
+            return;
+        }
+
+        const body = document.querySelector('#promptLibraryModal .login-modal-body');
+        if (!body) return;
+        body.innerHTML = `
+            <div class="prompt-item-title">${this.escapeHtml(prompt.title)}</div>
+            ${prompt.variables.map(v => `
+                <label class="prompt-variable">
+                    <span>${this.escapeHtml(v.description || v.name)}</span>
+                    <input type="text" class="input-field" data-name="${this.escapeHtml(v.name)}" value="${this.escapeHtml(v.default || '')}">
+                </label>
+            `).join('')}
+            <div class="source-edit-actions">
+                <button class="btn-secondary btn-cancel-prompt">返回</button>
+                <button class="btn-primary btn-confirm-run">运行</button>
+            </div>
+        `;
+        body.querySelector('.btn-cancel-prompt').addEventListener('click', () => this.showPromptLibrary());
+        body.querySelector('.btn-confirm-run').addEventListener('click', () => {
+            const values = {};
+            body.querySelectorAll('.prompt-variable input').forEach(input => {
+                if (input.value.trim()) values[input.dataset.name] = input.value.trim();
+            });
+            const missing = prompt.variables.filter(v => !values[v.name] && !v.default);
+            if (missing.length > 0) {
+                this.showWarn(`请填写：${missing.map(v => v.description || v.name).join('、')}`);
+                return;
+            }
+            run(values);
+        });
+    }
+
     async loadChatSessions() {
         if (!this.currentNotebook) return;
 
@@ -2449,33 +3677,233 @@ class OpenNotebook {
         this.addMessage('user', message);
         input.value = '';
 
+        if (this.currentPublicToken) {
+            await this.handlePublicChat(message);
+            return;
+        }
+
         const sources = await this.api(`/notebooks/${this.currentNotebook.id}/sources`);
         if (sources.length === 0) {
             this.addMessage('assistant', '请先为笔记本添加一些来源。');
             return;
         }
 
+        await this.streamChatReply(`${this.apiBase}/notebooks/${this.currentNotebook.id}/chat`, {
+            message: message,
+            session_id: this.currentChatSession || undefined,
+            style: document.getElementById('chatStyleSelect')?.value || undefined,
+        });
+    }
+
+    // 加载回答风格列表和当前笔记本的默认风格
+    async loadAnswerStyle() {
+        const select = document.getElementById('chatStyleSelect');
+        if (!select) return;
+
+        try {
+            if (!this.answerStyles) {
+                this.answerStyles = await this.api('/chat/styles');
+                select.innerHTML = '<option value="">默认风格</option>' + this.answerStyles.map(style =>
+                    `<option value="${this.escapeHtml(style.id)}">${this.escapeHtml(style.name)}</option>`
+                ).join('');
+            }
+            this.chatSettings = await this.api(`/notebooks/${this.currentNotebook.id}/chat/settings`);
+            select.value = this.chatSettings.answer_style || '';
+        } catch (error) {
+            this.chatSettings = null;
+            select.value = '';
+        }
+    }
+
+    // 保存笔记本的对话设置，未改动的设置保持原值
+    async saveChatSettings(changes) {
+        const { defaults, ...current } = this.chatSettings || {};
+        this.chatSettings = await this.api(`/notebooks/${this.currentNotebook.id}/chat/settings`, {
+            method: 'PUT',
+            body: JSON.stringify({ ...current, ...changes }),
+        });
+    }
+
+    // 把选择的回答风格保存为笔记本的默认风格
+    async saveAnswerStyle(style) {
+        if (!this.currentNotebook || this.currentPublicToken) return;
+
+        try {
+            await this.saveChatSettings({ answer_style: style });
+            this.setStatus(style ? '已设置笔记本的默认回答风格' : '已恢复默认回答风格');
+        } catch (error) {
+            this.showError('保存回答风格失败');
+        }
+    }
+
+    // 检索设置：每个问题检索的片段数、最低相似度和提供给模型的片段数，留空使用服务器默认值
+    showRetrievalSettings() {
+        if (!this.currentNotebook || this.currentPublicToken) return;
+
+        const settings = this.chatSettings || {};
+        const defaults = settings.defaults || {};
+        const value = (v) => (v ? v : '');
+        let modal = document.getElementById('retrievalSettingsModal');
+        if (modal) modal.remove();
+        modal = document.createElement('div');
+        modal.id = 'retrievalSettingsModal';
+        modal.className = 'login-modal active';
+        modal.innerHTML = `
+            <div class="login-modal-content">
+                <div class="login-modal-header">
+                    <h3>检索设置</h3>
+                    <button class="btn-close-login">×</button>
+                </div>
+                <div class="login-modal-body retrieval-settings">
+                    <p class="note-edit-chat-hint">来源很少时可减少片段数，来源很多时可增加检索数量并设置最低相似度。留空使用默认值。</p>
+                    <label>每个问题检索的片段数
+                        <input type="number" class="input-field" name="top_k" min="0" max="200" placeholder="${value(defaults.top_k)}" value="${value(settings.top_k)}">
+                    </label>
+                    <label>提供给模型的片段数
+                        <input type="number" class="input-field" name="max_context_chunks" min="0" max="50" placeholder="${value(defaults.max_context_chunks)}" value="${value(settings.max_context_chunks)}">
+                    </label>
+                    <label>最低相似度（0-1，仅 pgvector 和 Qdrant）
+                        <input type="number" class="input-field" name="score_threshold" min="0" max="1" step="0.05" placeholder="${defaults.score_threshold || 0}" value="${value(settings.score_threshold)}">
+                    </label>
+                    <div class="source-edit-actions"><button class="btn-primary btn-save-retrieval">保存</button></div>
+                </div>
+            </div>
+        `;
+        document.body.appendChild(modal);
+        modal.querySelector('.btn-close-login').addEventListener('click', () => modal.remove());
+
+        modal.querySelector('.btn-save-retrieval').addEventListener('click', async () => {
+            const number = (name) => Number(modal.querySelector(`input[name="${name}"]`).value) || 0;
+            try {
+                await this.saveChatSettings({
+                    top_k: number('top_k'),
+                    max_context_chunks: number('max_context_chunks'),
+                    score_threshold: number('score_threshold'),
+                });
+                modal.remove();
+                this.showToast('检索设置已保存', 'success');
+            } catch (error) {
+                this.showError(`保存失败: ${error.message}`);
+            }
+        });
+    }
+
+    // 发送对话请求并显示回答：回答逐段显示，完成后换成带来源和引用的完整消息
+    async streamChatReply(url, body) {
         this.setStatus('思考中...');
 
+        let pending = null;
+        let partial = '';
         try {
-            const response = await this.api(`/notebooks/${this.currentNotebook.id}/chat`, {
-                method: 'POST',
-                body: JSON.stringify({
-                    message: message,
-                    session_id: this.currentChatSession || undefined,
-                }),
+            const response = await this.streamChat(url, body, (chunk) => {
+                if (!pending) pending = this.addMessage('assistant', '');
+                partial += chunk;
+                pending.querySelector('.message-text').innerHTML = marked.parse(partial);
+                const container = document.getElementById('chatMessages');
+                container.scrollTop = container.scrollHeight;
             });
 
-            this.addMessage('assistant', response.message, response.sources);
+            if (pending) pending.remove();
+            const messageEl = this.addMessage('assistant', response.message, response.sources, response.citations, response.metadata?.tools_called, response.metadata?.glossary_terms);
+            this.markLowConfidence(messageEl, response.metadata);
             this.currentChatSession = response.session_id;
             this.setStatus('就绪');
         } catch (error) {
+            if (pending) pending.remove();
+            this.addMessage('assistant', `错误: ${error.message}`);
+            this.setStatus('错误');
+        }
+    }
+
+    // 访客与公开笔记本对话：不保存会话，由前端带上之前的消息
+    async handlePublicChat(message) {
+        this.setStatus('思考中...');
+
+        let pending = null;
+        let partial = '';
+        try {
+            const response = await this.streamChat(`/public/notebooks/${this.currentPublicToken}/chat`, {
+                message: message,
+                history: this.publicChatHistory,
+            }, (chunk) => {
+                if (!pending) pending = this.addMessage('assistant', '');
+                partial += chunk;
+                pending.querySelector('.message-text').innerHTML = marked.parse(partial);
+                const container = document.getElementById('chatMessages');
+                container.scrollTop = container.scrollHeight;
+            });
+
+            if (pending) pending.remove();
+            const messageEl = this.addMessage('assistant', response.message, response.sources, response.citations);
+            this.markLowConfidence(messageEl, response.metadata);
+            this.publicChatHistory.push({ role: 'user', content: message }, { role: 'assistant', content: response.message });
+            this.setStatus('就绪');
+        } catch (error) {
+            if (pending) pending.remove();
             this.addMessage('assistant', `错误: ${error.message}`);
             this.setStatus('错误');
         }
     }
 
-    addMessage(role, content, sources = []) {
+    // 以 Server-Sent Events 发送聊天请求：每段回答交给 onToken，返回 done 事件中的完整回复
+    async streamChat(url, body, onToken) {
+        const headers = {
+            'Content-Type': 'application/json',
+            'Accept': 'text/event-stream',
+        };
+        if (this.token) {
+            headers['Authorization'] = `Bearer ${this.token}`;
+        }
+
+        const response = await fetch(url, {
+            method: 'POST',
+            headers,
+            body: JSON.stringify(body),
+        });
+        if (!response.ok) {
+            const error = await response.json().catch(() => ({ error: '请求失败' }));
+            throw new Error(error.error || '请求失败');
+        }
+
+        const reader = response.body.getReader();
+        const decoder = new TextDecoder();
+        let buffer = '';
+        while (true) {
+            const { value, done } = await reader.read();
+            if (done) break;
+            buffer += decoder.decode(value, { stream: true });
+
+            // 事件之间以空行分隔
+            let end;
+            while ((end = buffer.indexOf('\n\n')) !== -1) {
+                const block = buffer.slice(0, end);
+                buffer = buffer.slice(end + 2);
+                let event = 'message';
+                let data = '';
+                block.split('\n').forEach(line => {
+                    if (line.startsWith('event:')) event = line.slice(6).trim();
+                    else if (line.startsWith('data:')) data += line.slice(5);
+                });
+                if (!data) continue;
+                const payload = JSON.parse(data);
+                if (event === 'token') onToken(payload.content);
+                else if (event === 'done') return payload;
+                else if (event === 'error') throw new Error(payload.error || '请求失败');
+            }
+        }
+        throw new Error('连接已中断');
+    }
+
+    // 检索到的来源相关度偏低时，提示回答可能不是来自来源
+    markLowConfidence(messageEl, metadata) {
+        if (!messageEl || !metadata?.low_confidence || metadata.not_found) return;
+        const tag = document.createElement('span');
+        tag.className = 'source-tag low-confidence-tag';
+        tag.textContent = '来源相关度低，回答可能不准确';
+        messageEl.querySelector('.message-sources').appendChild(tag);
+    }
+
+    addMessage(role, content, sources = [], citations = [], toolsCalled = [], glossaryTerms = []) {
         const container = document.getElementById('chatMessages');
         const template = document.getElementById('messageTemplate');
 
@@ -2503,10 +3931,40 @@ class OpenNotebook {
                 const tag = document.createElement('span');
                 tag.className = 'source-tag';
                 tag.textContent = source.name || source.id;
+                if (typeof source.score === 'number') {
+                    tag.textContent += ` · ${Math.round(source.score * 100)}%`;
+                    tag.title = '检索相关度';
+                }
+                sourcesContainer.appendChild(tag);
+            });
+        }
+
+        if (toolsCalled && toolsCalled.length > 0) {
+            const sourcesContainer = message.querySelector('.message-sources');
+            [...new Set(toolsCalled)].forEach(name => {
+                const tag = document.createElement('span');
+                tag.className = 'source-tag tool-tag';
+                tag.textContent = `工具: ${name}`;
+                sourcesContainer.appendChild(tag);
+            });
+        }
+
+        // 回答参考了笔记本术语表中的这些术语
+        if (glossaryTerms && glossaryTerms.length > 0) {
+            const sourcesContainer = message.querySelector('.message-sources');
+            glossaryTerms.forEach(term => {
+                const tag = document.createElement('span');
+                tag.className = 'source-tag tool-tag';
+                tag.textContent = `术语: ${term}`;
                 sourcesContainer.appendChild(tag);
             });
         }
 
+        if (citations && citations.length > 0) {
+            message.querySelector('.message-content').insertAdjacentHTML('beforeend', this.renderCitationsHTML(citations));
+            this.bindCitationLinks(message, citations);
+        }
+
         container.appendChild(clone);
 
         // Render MathJax for the new message if available
@@ -2517,21 +3975,1126 @@ class OpenNotebook {
         }
 
         container.scrollTop = container.scrollHeight;
+        return message;
     }
 
-    // UI 方法
-    closeModals() {
-        document.querySelectorAll('.modal').forEach(m => m.classList.remove('active'));
-        document.getElementById('modalOverlay').classList.remove('active');
-        this.hideLoading();
+    // 渲染来源引用列表，公开视图中的引用带有可分享的深链接
+    renderCitationsHTML(citations) {
+        if (!Array.isArray(citations) || citations.length === 0) return '';
+        // A shared note has no access to its notebook's sources
+        const linkable = !this.currentSharedNoteToken;
+
+        const items = citations.map((c, i) => {
+            const label = `[${c.index}] ${this.escapeHtml(this.citationName(c))}`;
+            if (!linkable) {
+                return `<li><span class="citation-link disabled">${label}</span></li>`;
+            }
+            const href = c.url ? this.escapeHtml(c.url) : '#';
+            return `<li><a class="citation-link" href="${href}" data-citation="${i}">${label}</a></li>`;
+        }).join('');
+
+        return `
+            <div class="citations">
+                <div class="citations-title">来源引用</div>
+                <ol class="citations-list">${items}</ol>
+            </div>
+        `;
     }
 
-    showLoading(text) {
-        document.getElementById('loadingText').textContent = text || '处理中...';
-        document.getElementById('loadingOverlay').classList.add('active');
+    // Name the source of a citation, with its pages for PDFs, its slides for decks, its time for
+    // transcripts and its chapter for books: "report.pdf, p.42", "deck.pptx, slide 3",
+    // "lecture.mp3, 12:05", "novel.epub, 第三章 雨夜"
+    citationName(c) {
+        const name = c.source_name || c.source_id;
+        if (c.end_time) {
+            const t = c.start_time || 0;
+            const clock = t >= 3600
+                ? `${Math.floor(t / 3600)}:${String(Math.floor(t / 60) % 60).padStart(2, '0')}:${String(t % 60).padStart(2, '0')}`
+                : `${Math.floor(t / 60)}:${String(t % 60).padStart(2, '0')}`;
+            return `${name}, ${clock}`;
+        }
+        if (!c.first_page) return c.chapter ? `${name}, ${c.chapter}` : name;
+        if (/\.pptx$/i.test(name)) {
+            return c.last_page > c.first_page ? `${name}, slides ${c.first_page}–${c.last_page}` : `${name}, slide ${c.first_page}`;
+        }
+        return c.last_page > c.first_page ? `${name}, pp.${c.first_page}–${c.last_page}` : `${name}, p.${c.first_page}`;
     }
 
-    hideLoading() {
+    bindCitationLinks(container, citations) {
+        if (!container || !Array.isArray(citations)) return;
+        container.querySelectorAll('.citation-link[data-citation]').forEach(link => {
+            link.addEventListener('click', (e) => {
+                e.preventDefault();
+                const citation = citations[parseInt(link.dataset.citation, 10)];
+                if (citation.url) {
+                    history.replaceState(null, '', citation.url);
+                }
+                this.showSourcePassage(citation.source_id, citation.start, citation.end);
+            });
+        });
+    }
+
+    // 打开公开笔记本时，处理 #cite=<source_id>:<start>-<end> 深链接
+    openCitationFromHash() {
+        const match = window.location.hash.match(/^#cite=([a-f0-9-]+):(\d+)-(\d+)$/);
+        if (match) {
+            this.showSourcePassage(match[1], parseInt(match[2], 10), parseInt(match[3], 10));
+        }
+    }
+
+    // 显示来源全文；给出引用范围时高亮并定位到被引用的段落
+    // Show the formatted citations of the sources a note was generated from
+    async showNoteReferences(note, style = 'apa') {
+        let result;
+        try {
+            result = await this.api(`/notebooks/${this.currentNotebook.id}/notes/${note.id}/references?style=${style}`);
+        } catch (error) {
+            this.showError('无法加载参考文献');
+            return;
+        }
+
+        let modal = document.getElementById('noteReferencesModal');
+        if (modal) modal.remove();
+        modal = document.createElement('div');
+        modal.id = 'noteReferencesModal';
+        modal.className = 'login-modal active';
+        modal.innerHTML = `
+            <div class="login-modal-content source-passage-content">
+                <div class="login-modal-header">
+                    <h3>参考文献</h3>
+                    <button class="btn-text" data-style="apa">APA</button>
+                    <button class="btn-text" data-style="mla">MLA</button>
+                    <button class="btn-text btn-copy-references">复制</button>
+                    <button class="btn-close-login">×</button>
+                </div>
+                <div class="login-modal-body">
+                    <ul class="note-references">
+                        ${result.references.map(ref => `<li>${this.escapeHtml(ref).replace(/\*([^*]+)\*/g, '<em>$1</em>')}</li>`).join('')}
+                    </ul>
+                </div>
+            </div>
+        `;
+        document.body.appendChild(modal);
+
+        modal.querySelector(`[data-style="${result.style}"]`)?.classList.add('active');
+        modal.querySelectorAll('[data-style]').forEach(btn => {
+            btn.addEventListener('click', () => this.showNoteReferences(note, btn.dataset.style));
+        });
+        modal.querySelector('.btn-copy-references').addEventListener('click', async () => {
+            try {
+                await navigator.clipboard.writeText(result.references.join('\n'));
+                this.setStatus('已复制!');
+            } catch (err) {
+                this.showError('复制失败');
+            }
+        });
+        modal.querySelector('.btn-close-login').addEventListener('click', () => modal.remove());
+    }
+
+    // 编辑笔记标题和内容，原内容保存为历史版本
+    showNoteEditor(note) {
+        let modal = document.getElementById('noteEditModal');
+        if (modal) modal.remove();
+        modal = document.createElement('div');
+        modal.id = 'noteEditModal';
+        modal.className = 'login-modal active';
+        modal.innerHTML = `
+            <div class="login-modal-content source-passage-content">
+                <div class="login-modal-header">
+                    <h3>编辑笔记</h3>
+                    <button class="btn-close-login">×</button>
+                </div>
+                <div class="login-modal-body">
+                    <input type="text" class="input-field note-edit-title" value="${this.escapeHtml(note.title)}">
+                    <textarea class="input-field source-edit-content note-edit-content">${this.escapeHtml(note.content)}</textarea>
+                    <div class="source-edit-actions"><button class="btn-primary btn-save-note">保存</button></div>
+                </div>
+            </div>
+        `;
+        document.body.appendChild(modal);
+        modal.querySelector('.btn-close-login').addEventListener('click', () => modal.remove());
+
+        modal.querySelector('.btn-save-note').addEventListener('click', async () => {
+            try {
+                const result = await this.api(`/notebooks/${this.currentNotebook.id}/notes/${note.id}`, {
+                    method: 'PUT',
+                    body: JSON.stringify({
+                        title: modal.querySelector('.note-edit-title').value,
+                        content: modal.querySelector('.note-edit-content').value,
+                    }),
+                });
+                modal.remove();
+                await this.afterNoteRevision(result, '笔记已保存');
+            } catch (error) {
+                this.showError(error.message);
+            }
+        });
+    }
+
+    // 笔记修改或恢复后刷新列表和笔记视图
+    async afterNoteRevision(result, message) {
+        if (!result.changed) {
+            this.showToast('内容没有变化', 'success');
+            return;
+        }
+        await this.loadNotes();
+        await this.viewNote(result.note);
+        this.showToast(`${message}，原内容保存为版本 ${result.version.version}`, 'success');
+    }
+
+    // 笔记历史版本：查看任意版本并恢复
+    async showNoteVersions(note) {
+        let versions;
+        try {
+            versions = await this.api(`/notebooks/${this.currentNotebook.id}/notes/${note.id}/versions`);
+        } catch (error) {
+            this.showError('无法加载历史版本');
+            return;
+        }
+
+        let modal = document.getElementById('noteVersionsModal');
+        if (modal) modal.remove();
+        modal = document.createElement('div');
+        modal.id = 'noteVersionsModal';
+        modal.className = 'login-modal active';
+        modal.innerHTML = `
+            <div class="login-modal-content source-passage-content">
+                <div class="login-modal-header">
+                    <h3>${this.escapeHtml(note.title)} · 历史版本</h3>
+                    ${versions.length > 0 ? `<select class="source-version-select">${versions.map(v => `
+                        <option value="${v.version}">版本 ${v.version}（${new Date(v.created_at).toLocaleString()} 被替换）</option>
+                    `).join('')}</select>` : ''}
+                    ${versions.length > 0 ? '<button class="btn-text btn-restore-version">恢复此版本</button>' : ''}
+                    <button class="btn-close-login">×</button>
+                </div>
+                <div class="login-modal-body note-version-body">
+                    ${versions.length === 0 ? '<p class="empty-hint">这篇笔记还没有被修改过</p>' : ''}
+                </div>
+            </div>
+        `;
+        document.body.appendChild(modal);
+        modal.querySelector('.btn-close-login').addEventListener('click', () => modal.remove());
+        if (versions.length === 0) return;
+
+        const select = modal.querySelector('.source-version-select');
+        const body = modal.querySelector('.note-version-body');
+        const render = async () => {
+            try {
+                const version = await this.api(`/notebooks/${this.currentNotebook.id}/notes/${note.id}/versions/${select.value}`);
+                body.innerHTML = `
+                    <h4 class="note-version-title">${this.escapeHtml(version.title)}</h4>
+                    <div class="markdown-content">${marked.parse(version.content || '')}</div>
+                `;
+            } catch (error) {
+                body.innerHTML = `<p class="empty-hint">${this.escapeHtml(error.message)}</p>`;
+            }
+        };
+        select.addEventListener('change', render);
+        render();
+
+        // 恢复前的内容会另存为新版本，恢复本身也可以撤销
+        modal.querySelector('.btn-restore-version').addEventListener('click', async () => {
+            if (!confirm(`确定恢复到版本 ${select.value} 吗？当前内容会保存为新版本。`)) return;
+            try {
+                const result = await this.api(`/notebooks/${this.currentNotebook.id}/notes/${note.id}/versions/${select.value}/restore`, { method: 'POST' });
+                modal.remove();
+                await this.afterNoteRevision(result, '已恢复');
+            } catch (error) {
+                this.showError(error.message);
+            }
+        });
+    }
+
+    showNoteAssist(note) {
+        let modal = document.getElementById('noteAssistModal');
+        if (modal) modal.remove();
+        modal = document.createElement('div');
+        modal.id = 'noteAssistModal';
+        modal.className = 'login-modal active';
+        modal.innerHTML = `
+            <div class="login-modal-content source-passage-content">
+                <div class="login-modal-header">
+                    <h3>写作助手</h3>
+                    <button class="btn-close-login">×</button>
+                </div>
+                <div class="login-modal-body note-assist">
+                    <label class="input-label">选中要处理的段落（不选则处理全文）</label>
+                    <textarea class="input-field note-assist-source" readonly>${this.escapeHtml(note.content)}</textarea>
+                    <input type="text" class="input-field note-assist-instructions" placeholder="补充要求（可选），如：面向初学者、语气更正式">
+                    <label class="note-assist-apply"><input type="checkbox"> 直接应用到笔记</label>
+                    <div class="modal-actions">
+                        <button class="btn-secondary" data-operation="rewrite">改写</button>
+                        <button class="btn-secondary" data-operation="expand">扩写</button>
+                        <button class="btn-secondary" data-operation="shorten">精简</button>
+                        <button class="btn-secondary" data-operation="critique">评审</button>
+                    </div>
+                    <div class="note-assist-result hidden"></div>
+                </div>
+            </div>
+        `;
+        document.body.appendChild(modal);
+
+        const textarea = modal.querySelector('.note-assist-source');
+        const resultEl = modal.querySelector('.note-assist-result');
+        modal.querySelectorAll('[data-operation]').forEach(btn => {
+            btn.addEventListener('click', async () => {
+                const operation = btn.dataset.operation;
+                const apply = modal.querySelector('.note-assist-apply input').checked && operation !== 'critique';
+                const selection = textarea.value.substring(textarea.selectionStart, textarea.selectionEnd);
+
+                this.showLoading('写作助手处理中...');
+                let response;
+                try {
+                    response = await this.api(`/notebooks/${this.currentNotebook.id}/notes/${note.id}/assist`, {
+                        method: 'POST',
+                        body: JSON.stringify({
+                            operation,
+                            selection,
+                            instructions: modal.querySelector('.note-assist-instructions').value.trim(),
+                            apply,
+                        }),
+                    });
+                } catch (error) {
+                    this.hideLoading();
+                    this.showError(error.message);
+                    return;
+                }
+                this.hideLoading();
+
+                if (response.note) {
+                    modal.remove();
+                    await this.loadNotes();
+                    await this.viewNote(response.note);
+                    this.showToast('已更新笔记', 'success');
+                    return;
+                }
+
+                resultEl.classList.remove('hidden');
+                resultEl.innerHTML = `
+                    <div class="note-assist-result-header">
+                        <span>${btn.textContent}结果</span>
+                        <button class="btn-text btn-copy-assist">复制</button>
+                    </div>
+                    <div class="markdown-content">${marked.parse(response.result)}</div>
+                    ${this.renderCitationsHTML(response.citations)}
+                `;
+                this.bindCitationLinks(resultEl, response.citations);
+                resultEl.querySelector('.btn-copy-assist').addEventListener('click', async () => {
+                    try {
+                        await navigator.clipboard.writeText(response.result);
+                        this.setStatus('已复制!');
+                    } catch (err) {
+                        this.showError('复制失败');
+                    }
+                });
+            });
+        });
+        modal.querySelector('.btn-close-login').addEventListener('click', () => modal.remove());
+    }
+
+    // 对话编辑：与助手多轮对话修改笔记，助手的回复是修改建议，逐条确认后才应用
+    showNoteEditChat(note) {
+        let modal = document.getElementById('noteEditChatModal');
+        if (modal) modal.remove();
+        modal = document.createElement('div');
+        modal.id = 'noteEditChatModal';
+        modal.className = 'login-modal active';
+        modal.innerHTML = `
+            <div class="login-modal-content source-passage-content">
+                <div class="login-modal-header">
+                    <h3>对话编辑 · ${this.escapeHtml(note.title)}</h3>
+                    <button class="btn-close-login">×</button>
+                </div>
+                <div class="login-modal-body note-edit-chat">
+                    <div class="note-edit-chat-messages">
+                        <p class="note-edit-chat-hint">说说想怎么修改这篇笔记，如：把第二段改得更简洁、补充来源中的数据。助手会给出修改建议，确认后才会应用。</p>
+                    </div>
+                    <form class="note-edit-chat-form">
+                        <input type="text" class="input-field" placeholder="输入修改要求..." autocomplete="off">
+                        <button type="submit" class="btn-primary">发送</button>
+                    </form>
+                </div>
+            </div>
+        `;
+        document.body.appendChild(modal);
+
+        const messagesEl = modal.querySelector('.note-edit-chat-messages');
+        const input = modal.querySelector('.note-edit-chat-form input');
+        let sessionId = null;
+        let changed = false;
+
+        const appendMessage = (role, html) => {
+            const el = document.createElement('div');
+            el.className = `note-edit-chat-message ${role}`;
+            el.innerHTML = html;
+            messagesEl.appendChild(el);
+            messagesEl.scrollTop = messagesEl.scrollHeight;
+            return el;
+        };
+
+        const renderProposal = (proposal) => {
+            const edits = proposal.edits || [];
+            const el = appendMessage('assistant', `
+                <div class="markdown-content">${marked.parse(proposal.message || (edits.length ? '' : '（没有回复内容）'))}</div>
+                ${edits.map((edit, i) => `
+                    <label class="note-edit-proposal">
+                        <input type="checkbox" data-index="${i}" checked>
+                        <div class="source-diff-hunk">
+                            ${edit.find ? `<div class="diff-line diff-delete">- ${this.escapeHtml(edit.find)}</div>` : '<div class="diff-line">（添加到笔记末尾）</div>'}
+                            ${edit.replace ? `<div class="diff-line diff-insert">+ ${this.escapeHtml(edit.replace)}</div>` : ''}
+                        </div>
+                    </label>
+                `).join('')}
+                ${edits.length ? '<div class="modal-actions"><button class="btn-primary btn-apply-edits">应用所选修改</button></div>' : ''}
+                ${this.renderCitationsHTML(proposal.citations)}
+            `);
+            this.bindCitationLinks(el, proposal.citations);
+
+            const applyBtn = el.querySelector('.btn-apply-edits');
+            if (!applyBtn) return;
+            applyBtn.addEventListener('click', async () => {
+                const picked = [...el.querySelectorAll('.note-edit-proposal input:checked')].map(box => Number(box.dataset.index));
+                if (picked.length === 0) {
+                    this.showWarn('请至少选择一处修改');
+                    return;
+                }
+                try {
+                    const result = await this.api(`/notebooks/${this.currentNotebook.id}/notes/${note.id}/edit-chat/${proposal.message_id}/apply`, {
+                        method: 'POST',
+                        body: JSON.stringify({ edits: picked }),
+                    });
+                    note = result.note;
+                    changed = true;
+                    applyBtn.disabled = true;
+                    applyBtn.textContent = '已应用';
+                    el.querySelectorAll('.note-edit-proposal input').forEach(box => box.disabled = true);
+                    this.showToast('已更新笔记', 'success');
+                } catch (error) {
+                    this.showError(error.message);
+                }
+            });
+        };
+
+        modal.querySelector('.note-edit-chat-form').addEventListener('submit', async (e) => {
+            e.preventDefault();
+            const message = input.value.trim();
+            if (!message) return;
+            input.value = '';
+            modal.querySelector('.note-edit-chat-hint')?.remove();
+            appendMessage('user', this.escapeHtml(message));
+
+            const pending = appendMessage('assistant', '思考中...');
+            try {
+                const proposal = await this.api(`/notebooks/${this.currentNotebook.id}/notes/${note.id}/edit-chat`, {
+                    method: 'POST',
+                    body: JSON.stringify({ message, session_id: sessionId || undefined }),
+                });
+                sessionId = proposal.session_id;
+                pending.remove();
+                renderProposal(proposal);
+            } catch (error) {
+                pending.textContent = `错误: ${error.message}`;
+            }
+        });
+
+        modal.querySelector('.btn-close-login').addEventListener('click', async () => {
+            modal.remove();
+            if (changed) {
+                await this.loadNotes();
+                await this.viewNote(note);
+            }
+        });
+        input.focus();
+    }
+
+    async showDrafts() {
+        let modal = document.getElementById('draftModal');
+        if (modal) modal.remove();
+        modal = document.createElement('div');
+        modal.id = 'draftModal';
+        modal.className = 'login-modal active';
+        modal.innerHTML = `
+            <div class="login-modal-content source-passage-content">
+                <div class="login-modal-header">
+                    <h3>长文草稿</h3>
+                    <button class="btn-close-login">×</button>
+                </div>
+                <div class="login-modal-body draft-panel">
+                    <textarea class="input-field draft-brief" placeholder="写作要求，如：面向管理层，总结这些资料中的主要风险与建议"></textarea>
+                    <div class="modal-actions">
+                        <select class="input-field draft-length">
+                            <option value="short">每节约 300 字</option>
+                            <option value="medium" selected>每节约 600 字</option>
+                            <option value="long">每节约 1200 字</option>
+                        </select>
+                        <button class="btn-primary btn-create-draft">生成大纲</button>
+                    </div>
+                    <div class="draft-list"></div>
+                </div>
+            </div>
+        `;
+        document.body.appendChild(modal);
+
+        const notebookId = this.currentNotebook.id;
+        const listEl = modal.querySelector('.draft-list');
+        const statusNames = {
+            outlining: '正在生成大纲',
+            awaiting_approval: '待确认大纲',
+            drafting: '正在撰写',
+            completed: '已完成',
+            failed: '失败',
+        };
+
+        let timer = null;
+        const close = () => {
+            clearTimeout(timer);
+            modal.remove();
+        };
+
+        const render = async () => {
+            clearTimeout(timer);
+            if (!document.body.contains(modal)) return;
+            let drafts;
+            try {
+                drafts = await this.api(`/notebooks/${notebookId}/drafts`);
+            } catch (error) {
+                listEl.innerHTML = `<div class="empty-state">${this.escapeHtml(error.message)}</div>`;
+                return;
+            }
+            // 编辑中的大纲不被轮询刷新覆盖
+            if (listEl.contains(document.activeElement) && document.activeElement.tagName === 'TEXTAREA') {
+                timer = setTimeout(render, 3000);
+                return;
+            }
+
+            listEl.innerHTML = drafts.length === 0 ? '<div class="empty-state">暂无草稿</div>' : '';
+            drafts.forEach(draft => {
+                const item = document.createElement('div');
+                item.className = 'draft-item';
+                const written = (draft.sections || []).filter(s => s.content).length;
+                const progress = draft.status === 'drafting' ? `（${written}/${draft.sections.length} 节）` : '';
+                item.innerHTML = `
+                    <div class="draft-item-header">
+                        <span class="draft-brief-text">${this.escapeHtml(draft.brief)}</span>
+                        <span class="draft-status draft-status-${draft.status}">${statusNames[draft.status] || draft.status}${progress}</span>
+                    </div>
+                    ${draft.error ? `<div class="draft-error">${this.escapeHtml(draft.error)}</div>` : ''}
+                    ${draft.status === 'awaiting_approval' ? `<textarea class="input-field draft-outline">${this.escapeHtml(draft.outline)}</textarea>` : ''}
+                    <div class="modal-actions">
+                        ${draft.status === 'awaiting_approval' ? '<button class="btn-secondary" data-action="save">保存大纲</button><button class="btn-primary" data-action="approve">确认并撰写</button>' : ''}
+                        ${draft.status === 'failed' ? '<button class="btn-secondary" data-action="resume">继续</button>' : ''}
+                        ${draft.status === 'completed' && draft.note_id ? '<button class="btn-primary" data-action="view">查看笔记</button>' : ''}
+                        <button class="btn-text" data-action="delete">删除</button>
+                    </div>
+                `;
+
+                const outline = () => item.querySelector('.draft-outline')?.value || '';
+                const act = async (path, method, body, message) => {
+                    try {
+                        await this.api(`/notebooks/${notebookId}/drafts/${draft.id}${path}`, {
+                            method,
+                            body: body ? JSON.stringify(body) : undefined,
+                        });
+                        if (message) this.showToast(message, 'success');
+                    } catch (error) {
+                        this.showError(error.message);
+                    }
+                    render();
+                };
+                item.querySelectorAll('[data-action]').forEach(btn => {
+                    btn.addEventListener('click', async () => {
+                        switch (btn.dataset.action) {
+                            case 'save':
+                                return act('/outline', 'PUT', { outline: outline() }, '大纲已保存');
+                            case 'approve':
+                                return act('/approve', 'POST', { outline: outline() });
+                            case 'resume':
+                                return act('/resume', 'POST');
+                            case 'delete':
+                                if (!confirm('确定删除这份草稿？已生成的笔记会保留。')) return;
+                                return act('', 'DELETE');
+                            case 'view': {
+                                const notes = await this.api(`/notebooks/${notebookId}/notes`);
+                                const note = notes.find(n => n.id === draft.note_id);
+                                if (!note) {
+                                    this.showError('笔记已被删除');
+                                    return;
+                                }
+                                close();
+                                await this.viewNote(note);
+                                return;
+                            }
+                        }
+                    });
+                });
+                listEl.appendChild(item);
+            });
+
+            if (drafts.some(d => d.status === 'outlining' || d.status === 'drafting')) {
+                timer = setTimeout(render, 3000);
+            } else if (drafts.some(d => d.status === 'completed')) {
+                this.loadNotes();
+            }
+        };
+
+        modal.querySelector('.btn-create-draft').addEventListener('click', async () => {
+            const brief = modal.querySelector('.draft-brief').value.trim();
+            if (!brief) {
+                this.showError('请输入写作要求');
+                return;
+            }
+            try {
+                await this.api(`/notebooks/${notebookId}/drafts`, {
+                    method: 'POST',
+                    body: JSON.stringify({ brief, length: modal.querySelector('.draft-length').value }),
+                });
+            } catch (error) {
+                this.showError(error.message);
+                return;
+            }
+            modal.querySelector('.draft-brief').value = '';
+            render();
+        });
+        modal.querySelector('.btn-close-login').addEventListener('click', close);
+        render();
+    }
+
+    async showNoteOverlap(note) {
+        this.showLoading('检查与来源的重合中...');
+        let report;
+        try {
+            report = await this.api(`/notebooks/${this.currentNotebook.id}/overlap`, {
+                method: 'POST',
+                body: JSON.stringify({ note_id: note.id }),
+            });
+        } catch (error) {
+            this.hideLoading();
+            this.showError('重合检查失败');
+            return;
+        }
+        this.hideLoading();
+
+        let modal = document.getElementById('noteOverlapModal');
+        if (modal) modal.remove();
+        modal = document.createElement('div');
+        modal.id = 'noteOverlapModal';
+        modal.className = 'login-modal active';
+        modal.innerHTML = `
+            <div class="login-modal-content source-passage-content">
+                <div class="login-modal-header">
+                    <h3>来源重合检查</h3>
+                    <button class="btn-close-login">×</button>
+                </div>
+                <div class="login-modal-body">
+                    <p class="overlap-summary">${report.passages.length
+                        ? `${report.passages.length} 处段落与来源高度相似，约占全文 ${Math.round(report.coverage * 100)}%`
+                        : '未发现与来源高度相似的段落'}</p>
+                    <ul class="overlap-passages">
+                        ${report.passages.map((p, i) => `
+                            <li data-index="${i}">
+                                <div class="overlap-passage-meta">
+                                    <span class="overlap-score">${Math.round(p.similarity * 100)}%</span>
+                                    ${this.escapeHtml(this.citationName(p.citation))}
+                                    ${p.quoted ? '<span class="overlap-quoted">已加引号</span>' : ''}
+                                </div>
+                                <p>${this.escapeHtml(p.text)}</p>
+                            </li>
+                        `).join('')}
+                    </ul>
+                </div>
+            </div>
+        `;
+        document.body.appendChild(modal);
+
+        modal.querySelectorAll('.overlap-passages li').forEach(item => {
+            item.addEventListener('click', () => {
+                const { citation } = report.passages[item.dataset.index];
+                this.showSourcePassage(citation.source_id, citation.start, citation.end);
+            });
+        });
+        modal.querySelector('.btn-close-login').addEventListener('click', () => modal.remove());
+    }
+
+    // 在来源中查找：同时按原文匹配和语义相似度检索段落，不调用模型
+    showSourceSearch() {
+        if (!this.currentNotebook) return;
+
+        let modal = document.getElementById('sourceSearchModal');
+        if (modal) modal.remove();
+        modal = document.createElement('div');
+        modal.id = 'sourceSearchModal';
+        modal.className = 'login-modal active';
+        modal.innerHTML = `
+            <div class="login-modal-content source-passage-content">
+                <div class="login-modal-header">
+                    <h3>在来源中查找</h3>
+                    <button class="btn-close-login">×</button>
+                </div>
+                <div class="login-modal-body">
+                    <form class="note-edit-chat-form source-search-form">
+                        <input type="text" class="input-field" placeholder="输入要查找的内容..." autocomplete="off">
+                        <button type="submit" class="btn-primary">查找</button>
+                    </form>
+                    <ul class="source-search-results"></ul>
+                </div>
+            </div>
+        `;
+        document.body.appendChild(modal);
+        modal.querySelector('.btn-close-login').addEventListener('click', () => modal.remove());
+
+        const input = modal.querySelector('.source-search-form input');
+        const list = modal.querySelector('.source-search-results');
+        input.focus();
+
+        // 原文匹配的位置相对于段落起点高亮
+        const highlight = (passage) => {
+            const text = Array.from(passage.text);
+            let html = '';
+            let pos = 0;
+            (passage.matches || []).forEach(([start, end]) => {
+                const from = start - passage.start;
+                if (from < pos) return;
+                html += this.escapeHtml(text.slice(pos, from).join(''));
+                html += `<mark>${this.escapeHtml(text.slice(from, end - passage.start).join(''))}</mark>`;
+                pos = end - passage.start;
+            });
+            return html + this.escapeHtml(text.slice(pos).join(''));
+        };
+
+        modal.querySelector('.source-search-form').addEventListener('submit', async (e) => {
+            e.preventDefault();
+            const query = input.value.trim();
+            if (!query) return;
+
+            list.innerHTML = '<li>查找中...</li>';
+            let result;
+            try {
+                result = await this.api(`/notebooks/${this.currentNotebook.id}/search?q=${encodeURIComponent(query)}`);
+            } catch (error) {
+                list.innerHTML = `<li>${this.escapeHtml(error.message)}</li>`;
+                return;
+            }
+            if (!result.passages.length) {
+                list.innerHTML = '<li>没有找到匹配的段落</li>';
+                return;
+            }
+            list.innerHTML = result.passages.map((passage, i) => `
+                <li data-index="${i}">
+                    <div class="related-paper-meta">
+                        ${this.escapeHtml(passage.source_name)}
+                        · ${passage.matched_by.map(by => by === 'keyword' ? '原文匹配' : '语义相似').join('、')}
+                    </div>
+                    <p class="source-search-text">${highlight(passage)}</p>
+                </li>
+            `).join('');
+            list.querySelectorAll('li[data-index]').forEach(item => {
+                item.addEventListener('click', () => {
+                    const passage = result.passages[item.dataset.index];
+                    this.showSourcePassage(passage.source_id, passage.start, passage.end);
+                });
+            });
+        });
+    }
+
+    async showRelatedPapers() {
+        if (!this.currentNotebook) return;
+
+        this.showLoading('查找相关论文中...');
+        let result;
+        try {
+            result = await this.api(`/notebooks/${this.currentNotebook.id}/related-papers`);
+        } catch (error) {
+            this.hideLoading();
+            this.showError(error.message === 'No paper sources'
+                ? '请先通过 arXiv ID、DOI 或文献导入添加论文'
+                : '查找相关论文失败');
+            return;
+        }
+        this.hideLoading();
+
+        let modal = document.getElementById('relatedPapersModal');
+        if (modal) modal.remove();
+        modal = document.createElement('div');
+        modal.id = 'relatedPapersModal';
+        modal.className = 'login-modal active';
+        const provider = result.provider === 'crossref' ? 'Crossref' : 'Semantic Scholar';
+        modal.innerHTML = `
+            <div class="login-modal-content source-passage-content">
+                <div class="login-modal-header">
+                    <h3>相关论文</h3>
+                    <button class="btn-close-login">×</button>
+                </div>
+                <div class="login-modal-body">
+                    <p class="related-papers-provider">来自 ${provider}</p>
+                    <ul class="related-papers">
+                        ${result.papers.length ? result.papers.map((paper, i) => {
+                            const ref = paper.reference;
+                            const authors = (ref.authors || []).slice(0, 3).map(a => a.split(',')[0]).join(', ')
+                                + ((ref.authors || []).length > 3 ? ' 等' : '');
+                            const meta = [authors, ref.venue, ref.year].filter(Boolean).join(' · ');
+                            return `
+                                <li>
+                                    <div class="related-paper-info">
+                                        <a href="${this.escapeHtml(ref.url || 'https://doi.org/' + ref.doi)}" target="_blank" rel="noopener">${this.escapeHtml(ref.title)}</a>
+                                        <div class="related-paper-meta">${this.escapeHtml(meta)}${paper.citations ? ` · 被引 ${paper.citations}` : ''}</div>
+                                        ${ref.abstract ? `<p class="related-paper-abstract">${this.escapeHtml(ref.abstract)}</p>` : ''}
+                                    </div>
+                                    <button class="btn-secondary btn-add-related" data-index="${i}">添加</button>
+                                </li>
+                            `;
+                        }).join('') : '<li>没有找到新的相关论文</li>'}
+                    </ul>
+                </div>
+            </div>
+        `;
+        document.body.appendChild(modal);
+
+        modal.querySelectorAll('.btn-add-related').forEach(btn => {
+            btn.addEventListener('click', async () => {
+                const paper = result.papers[btn.dataset.index];
+                btn.disabled = true;
+                btn.textContent = '添加中...';
+                try {
+                    await this.api(`/notebooks/${this.currentNotebook.id}/sources`, {
+                        method: 'POST',
+                        body: JSON.stringify({
+                            name: paper.reference.title,
+                            type: 'url',
+                            url: paper.id,
+                        }),
+                    });
+                    btn.textContent = '已添加';
+                    await this.loadSources();
+                    await this.updateCurrentNotebookCounts();
+                } catch (error) {
+                    btn.disabled = false;
+                    btn.textContent = '添加';
+                    this.showError(error.message);
+                }
+            });
+        });
+        modal.querySelector('.btn-close-login').addEventListener('click', () => modal.remove());
+    }
+
+    async loadFullNote(note) {
+        try {
+            if (this.currentPublicToken) {
+                const response = await fetch(`/public/notebooks/${this.currentPublicToken}/notes/${note.id}`);
+                if (!response.ok) throw new Error('Failed to load note');
+                return await response.json();
+            }
+            return await this.api(`/notebooks/${note.notebook_id}/notes/${note.id}`);
+        } catch (error) {
+            console.error('加载笔记失败:', error);
+            this.showError('无法加载完整笔记内容');
+            return note;
+        }
+    }
+
+    async showSourcePassage(sourceId, start, end) {
+        let source;
+        try {
+            if (this.currentPublicToken) {
+                const response = await fetch(`/public/notebooks/${this.currentPublicToken}/sources/${sourceId}/content`);
+                if (!response.ok) throw new Error('Failed to load source');
+                source = await response.json();
+            } else {
+                source = await this.api(`/notebooks/${this.currentNotebook.id}/sources/${sourceId}/content`);
+                const card = document.querySelector(`.source-card[data-id="${sourceId}"]`);
+                source.name = card ? card.querySelector('.source-name').textContent : '';
+                source.type = card ? card.dataset.type : '';
+                source.private = card ? card.classList.contains('private') : false;
+            }
+        } catch (error) {
+            this.showError('无法加载引用的来源');
+            return;
+        }
+
+        // Offsets are in Unicode code points, same as the backend's runes
+        const chars = Array.from(source.content || '');
+        const hasPassage = start !== undefined && end !== undefined;
+        const before = hasPassage ? chars.slice(0, start).join('') : chars.join('');
+        const passage = hasPassage ? chars.slice(start, end).join('') : '';
+        const after = hasPassage ? chars.slice(end).join('') : '';
+        const canMarkUnread = !this.currentPublicToken && !this.currentSharedNoteToken;
+
+        // 转写的音视频来源：播放器从被引用段落开头所在的时间开始播放
+        let player = '';
+        if (source.media) {
+            const markers = [...(before + passage.slice(0, 12)).matchAll(/^\[(\d+):(\d\d):(\d\d)-/gm)];
+            const last = markers[markers.length - 1];
+            const seconds = hasPassage && last ? (+last[1]) * 3600 + (+last[2]) * 60 + (+last[3]) : 0;
+            if (source.media.kind === 'youtube') {
+                player = `<iframe class="source-passage-media source-passage-youtube" src="${this.escapeHtml(source.media.url)}?start=${seconds}" allow="autoplay; encrypted-media; picture-in-picture" allowfullscreen></iframe>`;
+            } else {
+                const tag = source.media.kind === 'video' ? 'video' : 'audio';
+                player = `<${tag} class="source-passage-media" controls preload="metadata" src="${this.escapeHtml(source.media.url)}#t=${seconds}"></${tag}>`;
+            }
+        }
+
+        let modal = document.getElementById('sourcePassageModal');
+        if (modal) modal.remove();
+        modal = document.createElement('div');
+        modal.id = 'sourcePassageModal';
+        modal.className = 'login-modal active';
+        modal.innerHTML = `
+            <div class="login-modal-content source-passage-content">
+                <div class="login-modal-header">
+                    <h3>${this.escapeHtml(source.name || '来源')}</h3>
+                    ${canMarkUnread && source.type === 'url' ? '<button class="btn-text btn-refresh-source">重新抓取</button>' : ''}
+                    ${canMarkUnread && source.parser ? `<button class="btn-text btn-reextract-source">${source.parser === 'readability' ? '完整网页' : '只提取正文'}</button>` : ''}
+                    ${canMarkUnread && source.type === 'database' ? '<button class="btn-text btn-refresh-source">刷新表结构</button>' : ''}
+                    ${canMarkUnread && source.type === 'file' ? '<button class="btn-text btn-reupload-source">重新上传</button>' : ''}
+                    ${canMarkUnread && source.type === 'text' ? '<button class="btn-text btn-edit-source">编辑</button>' : ''}
+                    ${canMarkUnread ? '<button class="btn-text btn-source-versions">历史版本</button>' : ''}
+                    ${canMarkUnread ? `<button class="btn-text btn-source-private">${source.private ? '取消仅自己可见' : '仅自己可见'}</button>` : ''}
+                    ${canMarkUnread ? '<button class="btn-text btn-mark-unread">标记为未读</button>' : ''}
+                    <button class="btn-close-login">×</button>
+                </div>
+                ${player}
+                <div class="login-modal-body source-passage-body">${this.escapeHtml(before)}<mark id="sourcePassageMark">${this.escapeHtml(passage)}</mark>${this.escapeHtml(after)}</div>
+            </div>
+        `;
+        document.body.appendChild(modal);
+
+        modal.querySelector('.btn-close-login').addEventListener('click', () => {
+            modal.remove();
+            if (window.location.hash.startsWith('#cite=')) {
+                history.replaceState(null, '', window.location.pathname);
+            }
+        });
+
+        // 来源设为仅自己可见后，公开页面、公开对话和聊天集成都不会用到它
+        const privateBtn = modal.querySelector('.btn-source-private');
+        if (privateBtn) {
+            privateBtn.addEventListener('click', async () => {
+                try {
+                    const updated = await this.api(`/notebooks/${this.currentNotebook.id}/sources/${sourceId}/private`, {
+                        method: 'PUT',
+                        body: JSON.stringify({ private: !source.private })
+                    });
+                    source.private = !!updated.private;
+                    privateBtn.textContent = source.private ? '取消仅自己可见' : '仅自己可见';
+                    const card = document.querySelector(`.source-card[data-id="${sourceId}"]`);
+                    if (card) card.classList.toggle('private', source.private);
+                } catch (error) {
+                    this.showError('操作失败');
+                }
+            });
+        }
+
+        const markUnreadBtn = modal.querySelector('.btn-mark-unread');
+        if (markUnreadBtn) {
+            markUnreadBtn.addEventListener('click', async () => {
+                try {
+                    await this.api(`/notebooks/${this.currentNotebook.id}/sources/${sourceId}/read`, { method: 'DELETE' });
+                    this.setSourceReadState(sourceId, false);
+                    modal.remove();
+                } catch (error) {
+                    this.showError('操作失败');
+                }
+            });
+        }
+
+        const refreshBtn = modal.querySelector('.btn-refresh-source');
+        if (refreshBtn) {
+            refreshBtn.addEventListener('click', async () => {
+                this.showLoading(source.type === 'database' ? '正在读取表结构...' : '正在重新抓取网页...');
+                try {
+                    const result = await this.api(`/notebooks/${this.currentNotebook.id}/sources/${sourceId}/refresh`, { method: 'POST' });
+                    this.hideLoading();
+                    await this.afterSourceRefresh(sourceId, result);
+                } catch (error) {
+                    this.hideLoading();
+                    this.showError(error.message);
+                }
+            });
+        }
+
+        // 换一种方式解析网页：只提取正文，或保留完整网页
+        const reextractBtn = modal.querySelector('.btn-reextract-source');
+        if (reextractBtn) {
+            reextractBtn.addEventListener('click', async () => {
+                this.showLoading('正在重新解析网页...');
+                try {
+                    const result = await this.api(`/notebooks/${this.currentNotebook.id}/sources/${sourceId}/reextract`, {
+                        method: 'POST',
+                        body: JSON.stringify({ parser: source.parser === 'readability' ? 'markitdown' : 'readability' }),
+                    });
+                    this.hideLoading();
+                    await this.afterSourceRefresh(sourceId, result);
+                } catch (error) {
+                    this.hideLoading();
+                    this.showError(error.message);
+                }
+            });
+        }
+
+        const reuploadBtn = modal.querySelector('.btn-reupload-source');
+        if (reuploadBtn) {
+            reuploadBtn.addEventListener('click', () => {
+                const input = document.createElement('input');
+                input.type = 'file';
+                input.addEventListener('change', async () => {
+                    if (!input.files.length) return;
+                    const formData = new FormData();
+                    formData.append('file', input.files[0]);
+                    this.showLoading('正在上传新版本...');
+                    try {
+                        const result = await this.api(`/notebooks/${this.currentNotebook.id}/sources/${sourceId}/file`, {
+                            method: 'PUT',
+                            body: formData,
+                        });
+                        this.hideLoading();
+                        await this.afterSourceRefresh(sourceId, result);
+                    } catch (error) {
+                        this.hideLoading();
+                        this.showError(error.message);
+                    }
+                });
+                input.click();
+            });
+        }
+
+        const editBtn = modal.querySelector('.btn-edit-source');
+        if (editBtn) {
+            editBtn.addEventListener('click', () => {
+                const body = modal.querySelector('.source-passage-body');
+                body.innerHTML = `
+                    <textarea class="source-edit-content">${this.escapeHtml(source.content || '')}</textarea>
+                    <div class="source-edit-actions"><button class="btn-primary btn-save-source">保存</button></div>
+                `;
+                editBtn.remove();
+                body.querySelector('.btn-save-source').addEventListener('click', async () => {
+                    try {
+                        const result = await this.api(`/notebooks/${this.currentNotebook.id}/sources/${sourceId}/content`, {
+                            method: 'PUT',
+                            body: JSON.stringify({ content: body.querySelector('.source-edit-content').value }),
+                        });
+                        modal.remove();
+                        await this.afterSourceRefresh(sourceId, result);
+                    } catch (error) {
+                        this.showError(error.message);
+                    }
+                });
+            });
+        }
+
+        const versionsBtn = modal.querySelector('.btn-source-versions');
+        if (versionsBtn) {
+            versionsBtn.addEventListener('click', () => this.showSourceVersions(sourceId, source.name));
+        }
+
+        // The content endpoint records the read for the owner
+        if (canMarkUnread) {
+            this.setSourceReadState(sourceId, true);
+        }
+
+        if (hasPassage) {
+            document.getElementById('sourcePassageMark').scrollIntoView({ block: 'center' });
+        }
+    }
+
+    // 来源更新后刷新列表，内容有变化时直接展示差异
+    async afterSourceRefresh(sourceId, result) {
+        await this.loadSources();
+        if (!result.changed) {
+            this.showToast('内容没有变化', 'success');
+            return;
+        }
+        this.showToast(`内容已更新，原内容保存为版本 ${result.version.version}`, 'success');
+        this.showSourceVersions(sourceId, result.source.name, result.version.version);
+    }
+
+    // 历史版本与当前内容的逐行对比
+    async showSourceVersions(sourceId, name, version) {
+        let versions;
+        try {
+            versions = await this.api(`/notebooks/${this.currentNotebook.id}/sources/${sourceId}/versions`);
+        } catch (error) {
+            this.showError('无法加载历史版本');
+            return;
+        }
+
+        let modal = document.getElementById('sourcePassageModal');
+        if (modal) modal.remove();
+        modal = document.createElement('div');
+        modal.id = 'sourcePassageModal';
+        modal.className = 'login-modal active';
+        modal.innerHTML = `
+            <div class="login-modal-content source-passage-content">
+                <div class="login-modal-header">
+                    <h3>${this.escapeHtml(name || '来源')} · 历史版本</h3>
+                    ${versions.length > 0 ? `<select class="source-version-select">${versions.map(v => `
+                        <option value="${v.version}">版本 ${v.version}（${new Date(v.created_at).toLocaleString()} 被替换）</option>
+                    `).join('')}</select>` : ''}
+                    ${versions.length > 0 ? '<button class="btn-text btn-restore-version">恢复此版本</button>' : ''}
+                    <button class="btn-close-login">×</button>
+                </div>
+                <div class="login-modal-body source-diff-body">
+                    ${versions.length === 0 ? '<p class="empty-hint">这个来源还没有被重新抓取或重新上传过</p>' : ''}
+                </div>
+            </div>
+        `;
+        document.body.appendChild(modal);
+        modal.querySelector('.btn-close-login').addEventListener('click', () => modal.remove());
+        if (versions.length === 0) return;
+
+        const select = modal.querySelector('.source-version-select');
+        const body = modal.querySelector('.source-diff-body');
+        const render = async () => {
+            try {
+                const diff = await this.api(`/notebooks/${this.currentNotebook.id}/sources/${sourceId}/diff?from=${select.value}`);
+                const marks = { insert: '+', delete: '-', equal: ' ' };
+                body.innerHTML = `
+                    <div class="source-diff-stats"><span class="diff-added">+${diff.added}</span> <span class="diff-removed">-${diff.removed}</span> 行，与当前内容相比</div>
+                    ${diff.hunks.length === 0 ? '<p class="empty-hint">与当前内容相同</p>' : ''}
+                    ${diff.hunks.map(hunk => `
+                        <div class="source-diff-hunk">${hunk.lines.map(line => `<div class="diff-line diff-${line.op}"><span class="diff-line-no">${line.old_line || ''}</span><span class="diff-line-no">${line.new_line || ''}</span>${marks[line.op]} ${this.escapeHtml(line.text)}</div>`).join('')}</div>
+                    `).join('')}
+                `;
+            } catch (error) {
+                body.innerHTML = `<p class="empty-hint">${this.escapeHtml(error.message)}</p>`;
+            }
+        };
+        if (version) select.value = version;
+        select.addEventListener('change', render);
+        render();
+
+        // 恢复前的内容会另存为新版本，恢复本身也可以撤销
+        modal.querySelector('.btn-restore-version').addEventListener('click', async () => {
+            if (!confirm(`确定恢复到版本 ${select.value} 吗？当前内容会保存为新版本。`)) return;
+            try {
+                const result = await this.api(`/notebooks/${this.currentNotebook.id}/sources/${sourceId}/versions/${select.value}/restore`, { method: 'POST' });
+                modal.remove();
+                await this.afterSourceRefresh(sourceId, result);
+            } catch (error) {
+                this.showError(error.message);
+            }
+        });
+    }
+
+    setSourceReadState(sourceId, read) {
+        const card = document.querySelector(`.source-card[data-id="${sourceId}"]`);
+        if (card) {
+            card.classList.toggle('unread', !read);
+            this.updateFooter();
+        }
+    }
+
+    // UI 方法
+    closeModals() {
+        document.querySelectorAll('.modal').forEach(m => m.classList.remove('active'));
+        document.getElementById('modalOverlay').classList.remove('active');
+        this.hideLoading();
+    }
+
+    showLoading(text) {
+        document.getElementById('loadingText').textContent = text || '处理中...';
+        document.getElementById('loadingOverlay').classList.add('active');
+    }
+
+    hideLoading() {
         document.getElementById('loadingOverlay').classList.remove('active');
     }
 
@@ -2578,6 +5141,34 @@ class OpenNotebook {
         }, 5000);
     }
 
+    // 删除后的撤销提示，服务器在撤销期限内可恢复被删除的内容
+    showUndoToast(message, result, onRestored) {
+        if (!result || !result.undo_token) return;
+
+        const toast = document.createElement('div');
+        toast.className = 'undo-toast';
+        toast.innerHTML = `<span>${this.escapeHtml(message)}</span><button class="btn-undo">撤销</button>`;
+        document.body.appendChild(toast);
+
+        const dismiss = () => {
+            toast.style.opacity = '0';
+            setTimeout(() => toast.remove(), 300);
+        };
+        const timer = setTimeout(dismiss, Math.min(new Date(result.expires_at) - Date.now(), 10000));
+
+        toast.querySelector('.btn-undo').addEventListener('click', async () => {
+            clearTimeout(timer);
+            toast.remove();
+            try {
+                await this.api(`/undo/${result.undo_token}`, { method: 'POST' });
+                await onRestored();
+                this.showToast('已撤销删除', 'success');
+            } catch (error) {
+                this.showError(`撤销失败: ${error.message}`);
+            }
+        });
+    }
+
     showError(message) {
         this.setStatus(`错误: ${message}`);
         this.showToast(message, 'error');
@@ -2590,7 +5181,13 @@ class OpenNotebook {
     updateFooter() {
         const sourceCount = document.querySelectorAll('.source-card').length;
         const noteCount = document.querySelectorAll('.note-item').length;
-        document.getElementById('footerStats').textContent = `${sourceCount} 来源 · ${noteCount} 笔记`;
+        let stats = `${sourceCount} 来源 · ${noteCount} 笔记`;
+        // Read state is per user, so it's only shown for the owner's own notebooks
+        if (sourceCount > 0 && !this.currentPublicToken && !this.currentSharedNoteToken) {
+            const unreadCount = document.querySelectorAll('.source-card.unread').length;
+            stats += ` · 已读 ${sourceCount - unreadCount}/${sourceCount}`;
+        }
+        document.getElementById('footerStats').textContent = stats;
     }
 
     formatDate(dateString) {
@@ -24,22 +24,55 @@ type LLMProvider interface {
 
 	// GenerateFromSinglePrompt generates text from a single prompt using the default LLM
 	GenerateFromSinglePrompt(ctx context.Context, llm llms.Model, prompt string, options ...llms.CallOption) (string, error)
+
+	// GenerateStreamFromSinglePrompt generates text like GenerateFromSinglePrompt, passing each chunk
+	// to onChunk as it arrives. Returning an error from onChunk stops the generation.
+	GenerateStreamFromSinglePrompt(ctx context.Context, llm llms.Model, prompt string, onChunk func(chunk string) error, options ...llms.CallOption) (string, error)
 }
 
 // GeminiClient is the default implementation of LLMProvider using Google GenAI
 type GeminiClient struct {
 	googleAPIKey string
 	llm          llms.Model // maybe other llm except gemini for chat/summary etc.
+	textTimeout  time.Duration
+	imageTimeout time.Duration
+	uploadDir    string
+	usage        usageSink // Receives the token usage of text generations
 }
 
 // NewGeminiClient creates a new GeminiClient
-func NewGeminiClient(googleAPIKey string, llm llms.Model) *GeminiClient {
+func NewGeminiClient(googleAPIKey string, llm llms.Model, textTimeout, imageTimeout time.Duration, uploadDir string) *GeminiClient {
 	return &GeminiClient{
 		googleAPIKey: googleAPIKey,
 		llm:          llm,
+		textTimeout:  textTimeout,
+		imageTimeout: imageTimeout,
+		uploadDir:    uploadDir,
 	}
 }
 
+// saveGeneratedImage writes generated image data into the user's upload directory and returns the file path
+func saveGeneratedImage(uploadRoot, userID string, imageData []byte) (string, error) {
+	fileName := fmt.Sprintf("infograph_%d.png", time.Now().UnixNano())
+	uploadDir := uploadRoot
+	if userID != "" {
+		uploadDir = filepath.Join(uploadRoot, userID)
+	}
+
+	if err := os.MkdirAll(uploadDir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create upload directory: %w", err)
+	}
+
+	filePath := filepath.Join(uploadDir, fileName)
+	if err := os.WriteFile(filePath, imageData, 0644); err != nil {
+		golog.Errorf("failed to save image to %s: %v", filePath, err)
+		return "", fmt.Errorf("failed to save image: %w", err)
+	}
+
+	golog.Infof("infographic saved to %s", filePath)
+	return filePath, nil
+}
+
 // GenerateImage generates an image using the Google GenAI SDK
 func (n *GeminiClient) GenerateImage(ctx context.Context, model, prompt string, userID string) (string, error) {
 	if n.googleAPIKey == "" {
@@ -74,7 +107,7 @@ func (n *GeminiClient) GenerateImage(ctx context.Context, model, prompt string,
 			golog.Infof("generating images with model %s using GenerateContent...", model)
 		}
 
-		genCtx, cancel := context.WithTimeout(ctx, 300*time.Second)
+		genCtx, cancel := context.WithTimeout(ctx, n.imageTimeout)
 		resp, err := client.Models.GenerateContent(genCtx, model, genai.Text(prompt), nil)
 		if err != nil {
 			cancel()
@@ -109,26 +142,7 @@ func (n *GeminiClient) GenerateImage(ctx context.Context, model, prompt string,
 		golog.Infof("image data received successfully, saving...")
 
 		// Save the image to user-specific directory
-		fileName := fmt.Sprintf("infograph_%d.png", time.Now().UnixNano())
-		var uploadDir string
-		if userID != "" {
-			uploadDir = filepath.Join("./data/uploads", userID)
-		} else {
-			uploadDir = "./data/uploads"
-		}
-
-		if err := os.MkdirAll(uploadDir, 0755); err != nil {
-			return "", fmt.Errorf("failed to create upload directory: %w", err)
-		}
-
-		filePath := filepath.Join(uploadDir, fileName)
-		if err := os.WriteFile(filePath, imageData, 0644); err != nil {
-			golog.Errorf("failed to save image to %s: %v", filePath, err)
-			return "", fmt.Errorf("failed to save image: %w", err)
-		}
-
-		golog.Infof("infographic saved to %s", filePath)
-		return filePath, nil
+		return saveGeneratedImage(n.uploadDir, userID, imageData)
 	}
 
 	return "", fmt.Errorf("failed to generate image after 3 attempts: %w", lastErr)
@@ -142,7 +156,7 @@ func (n *GeminiClient) GenerateTextWithModel(ctx context.Context, prompt string,
 	}
 
 	httpClient := &http.Client{
-		Timeout: 5 * time.Minute, // Give the model enough time to "think"
+		Timeout: n.textTimeout, // Give the model enough time to "think"
 		Transport: &http.Transport{
 			DisableKeepAlives: false,
 			MaxIdleConns:      100,
@@ -162,7 +176,7 @@ func (n *GeminiClient) GenerateTextWithModel(ctx context.Context, prompt string,
 	golog.Infof("generating text with model %s using GenerateContent...", model)
 
 	// Set a timeout for the text generation
-	ctx, cancel := context.WithTimeout(ctx, 300*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, n.textTimeout)
 	defer cancel()
 
 	resp, err := client.Models.GenerateContent(ctx, model, genai.Text(prompt), nil)
@@ -189,10 +203,31 @@ func (n *GeminiClient) GenerateTextWithModel(ctx context.Context, prompt string,
 		return "", fmt.Errorf("empty response from model")
 	}
 
+	if resp.UsageMetadata != nil {
+		n.usage.record(ctx, ModelRoute{Provider: "gemini", Model: model},
+			int(resp.UsageMetadata.PromptTokenCount), int(resp.UsageMetadata.CandidatesTokenCount), 0)
+	}
 	return result, nil
 }
 
 // GenerateFromSinglePrompt generates text from a single prompt using the specified LLM
 func (n *GeminiClient) GenerateFromSinglePrompt(ctx context.Context, llm llms.Model, prompt string, options ...llms.CallOption) (string, error) {
-	return llms.GenerateFromSinglePrompt(ctx, n.llm, prompt, options...)
+	return llms.GenerateFromSinglePrompt(ctx, n.textModel(llm), prompt, options...)
+}
+
+// GenerateStreamFromSinglePrompt generates text from a single prompt, streaming chunks to onChunk
+func (n *GeminiClient) GenerateStreamFromSinglePrompt(ctx context.Context, llm llms.Model, prompt string, onChunk func(chunk string) error, options ...llms.CallOption) (string, error) {
+	options = append(options, llms.WithStreamingFunc(func(ctx context.Context, chunk []byte) error {
+		return onChunk(string(chunk))
+	}))
+	return llms.GenerateFromSinglePrompt(ctx, n.textModel(llm), prompt, options...)
+}
+
+// textModel returns the model a caller passed in, such as one routed by MODEL_ROUTES, or the
+// client's own LLM
+func (n *GeminiClient) textModel(llm llms.Model) llms.Model {
+	if llm != nil {
+		return llm
+	}
+	return n.llm
 }
@@ -0,0 +1,111 @@
+package backend
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/kataras/golog"
+)
+
+// assetGracePeriod is how long a generated asset no note references is kept. A transformation
+// saves its note after the image is stored, and a deleted note can still be restored for a while.
+const assetGracePeriod = time.Hour
+
+// assetPrefix starts the names of generated assets, before the hash of their content
+const assetPrefix = "asset_"
+
+// storeGeneratedAsset moves a generated image into the owner's uploads under the hash of its
+// content, so that an identical image, such as a regenerated slide, is stored only once, and
+// returns the name to link to. If it can't, the image stays where it was generated.
+func (s *Server) storeGeneratedAsset(ctx context.Context, userID, path string) string {
+	name := filepath.Base(path)
+	sum, size, err := hashFile(path)
+	if err != nil {
+		golog.Errorf("failed to hash generated image %s: %v", name, err)
+		return name
+	}
+
+	assetName := assetPrefix + sum[:32] + strings.ToLower(filepath.Ext(path))
+	assetPath := filepath.Join(s.cfg.UploadDir, userID, assetName)
+	if assetPath != path {
+		if _, err := os.Stat(assetPath); err == nil {
+			os.Remove(path)
+		} else if err := os.Rename(path, assetPath); err != nil {
+			golog.Errorf("failed to store generated image %s: %v", name, err)
+			return name
+		}
+	}
+
+	asset := &GeneratedAsset{UserID: userID, FileName: assetName, SHA256: sum, Size: size}
+	if err := s.store.RegisterAsset(ctx, asset); err != nil {
+		// Unregistered, the file is never swept, which is how images were kept before
+		golog.Errorf("failed to register generated image %s: %v", assetName, err)
+	}
+	return assetName
+}
+
+// hashFile returns the hex SHA-256 and the size of a file
+func hashFile(path string) (string, int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", 0, err
+	}
+	defer file.Close()
+	h := sha256.New()
+	size, err := io.Copy(h, file)
+	if err != nil {
+		return "", 0, err
+	}
+	return hex.EncodeToString(h.Sum(nil)), size, nil
+}
+
+// assetSweepLoop periodically deletes generated assets no note references anymore
+func (s *Server) assetSweepLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if removed, err := s.sweepAssets(context.Background()); err != nil {
+			golog.Errorf("failed to sweep generated assets: %v", err)
+		} else if removed > 0 {
+			golog.Infof("removed %d unused generated assets", removed)
+		}
+	}
+}
+
+// sweepAssets deletes the generated assets that have gone unreferenced for assetGracePeriod,
+// along with their watermarked copies, and returns how many it deleted
+func (s *Server) sweepAssets(ctx context.Context) (int, error) {
+	assets, err := s.store.ListUnusedAssets(ctx, time.Now().Add(-assetGracePeriod))
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	for _, asset := range assets {
+		// A note may have taken up the asset since it was listed
+		deleted, err := s.store.DeleteUnusedAsset(ctx, asset.UserID, asset.FileName)
+		if err != nil {
+			return removed, err
+		}
+		if !deleted {
+			continue
+		}
+		ownerDir := filepath.Join(s.cfg.UploadDir, asset.UserID)
+		if err := os.Remove(filepath.Join(ownerDir, asset.FileName)); err != nil && !os.IsNotExist(err) {
+			golog.Warnf("failed to remove generated asset %s: %v", asset.FileName, err)
+		}
+		ext := filepath.Ext(asset.FileName)
+		copies, _ := filepath.Glob(filepath.Join(ownerDir, watermarkDir, strings.TrimSuffix(asset.FileName, ext)+"-*"+ext))
+		for _, copy := range copies {
+			os.Remove(copy)
+		}
+		removed++
+	}
+	return removed, nil
+}
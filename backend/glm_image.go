@@ -6,8 +6,6 @@ import (
 	"fmt"
 	"io"
 	"net/http"
-	"os"
-	"path/filepath"
 	"strings"
 	"time"
 
@@ -21,15 +19,17 @@ type GLMImageClient struct {
 	apiKey     string
 	baseURL    string
 	httpClient *http.Client
+	uploadDir  string
 }
 
 // NewGLMImageClient creates a new GLM image client
-func NewGLMImageClient(apiKey string) *GLMImageClient {
+func NewGLMImageClient(apiKey string, timeout time.Duration, uploadDir string) *GLMImageClient {
 	return &GLMImageClient{
-		apiKey:  apiKey,
-		baseURL: "https://open.bigmodel.cn/api/paas/v4/images/generations",
+		apiKey:    apiKey,
+		uploadDir: uploadDir,
+		baseURL:   "https://open.bigmodel.cn/api/paas/v4/images/generations",
 		httpClient: &http.Client{
-			Timeout: 5 * time.Minute,
+			Timeout: timeout,
 			Transport: &http.Transport{
 				DisableKeepAlives: false,
 				MaxIdleConns:      100,
@@ -142,26 +142,7 @@ func (g *GLMImageClient) GenerateImage(ctx context.Context, model, prompt string
 	golog.Infof("image data received successfully (%d bytes), saving...", len(imageData))
 
 	// Save the image to user-specific directory
-	fileName := fmt.Sprintf("infograph_%d.png", time.Now().UnixNano())
-	var uploadDir string
-	if userID != "" {
-		uploadDir = filepath.Join("./data/uploads", userID)
-	} else {
-		uploadDir = "./data/uploads"
-	}
-
-	if err := os.MkdirAll(uploadDir, 0755); err != nil {
-		return "", fmt.Errorf("failed to create upload directory: %w", err)
-	}
-
-	filePath := filepath.Join(uploadDir, fileName)
-	if err := os.WriteFile(filePath, imageData, 0644); err != nil {
-		golog.Errorf("failed to save image to %s: %v", filePath, err)
-		return "", fmt.Errorf("failed to save image: %w", err)
-	}
-
-	golog.Infof("infographic saved to %s", filePath)
-	return filePath, nil
+	return saveGeneratedImage(g.uploadDir, userID, imageData)
 }
 
 // GenerateTextWithModel generates text using GLM (optional, for compatibility)
@@ -174,6 +155,11 @@ func (g *GLMImageClient) GenerateFromSinglePrompt(ctx context.Context, llm llms.
 	return "", fmt.Errorf("GLM-Image client does not support text generation")
 }
 
+// GenerateStreamFromSinglePrompt generates streamed text (optional, for compatibility)
+func (g *GLMImageClient) GenerateStreamFromSinglePrompt(ctx context.Context, llm llms.Model, prompt string, onChunk func(chunk string) error, options ...llms.CallOption) (string, error) {
+	return "", fmt.Errorf("GLM-Image client does not support text generation")
+}
+
 // generateToken generates a JWT token from the API key
 // GLM API key format: id.secret
 func (g *GLMImageClient) generateToken() (string, error) {
@@ -0,0 +1,227 @@
+package backend
+
+import (
+	"context"
+	"regexp"
+	"strings"
+
+	"github.com/kataras/golog"
+)
+
+const (
+	// glossaryMaxTerms bounds how many definitions are added to a chat prompt
+	glossaryMaxTerms = 8
+	// glossaryMaxDefinition bounds the length of a definition in the prompt, in runes
+	glossaryMaxDefinition = 300
+	// glossaryMaxTerm is the longest text taken as a term, in runes; longer ones are prose
+	glossaryMaxTerm = 60
+)
+
+// GlossaryTerm is a term defined in a notebook's glossary note
+type GlossaryTerm struct {
+	Term       string
+	Definition string
+}
+
+var (
+	// "- **Term**: definition", "**Term** — definition", "1. **Term**：definition"
+	glossaryBoldEntry = regexp.MustCompile(`^(?:[-*+]|\d+[.)])?\s*\*\*(.+?)\*\*\s*(?:[:：]|[-–—]+)?\s*(.+)$`)
+	// "- Term: definition"
+	glossaryListEntry = regexp.MustCompile(`^(?:[-*+]|\d+[.)])\s+([^:：]+?)\s*[:：]\s*(.+)$`)
+	glossaryHeading   = regexp.MustCompile(`^#{2,6}\s+(.+)$`)
+	glossaryBoldLine  = regexp.MustCompile(`^\*\*([^*]+)\*\*$`)
+	glossaryTableRule = regexp.MustCompile(`^:?-{2,}:?$`)
+	// glossaryAlias splits "机器学习 (Machine Learning)" into its two names
+	glossaryAlias = regexp.MustCompile(`^(.+?)\s*[(（](.+?)[)）]$`)
+)
+
+// isGlossaryNote reports whether a note is a glossary: a glossary transformation or a note
+// titled as one
+func isGlossaryNote(note *Note) bool {
+	if note.Type == "glossary" {
+		return true
+	}
+	title := strings.ToLower(note.Title)
+	return strings.Contains(title, "术语表") || strings.Contains(title, "glossary")
+}
+
+// cleanGlossaryText strips inline markdown emphasis and code marks
+func cleanGlossaryText(s string) string {
+	s = strings.NewReplacer("**", "", "__", "", "`", "").Replace(s)
+	return strings.Trim(strings.TrimSpace(s), "*_:： ")
+}
+
+// parseGlossary reads the terms of a glossary note written as a markdown table, a list of
+// "Term: definition" items, or a heading per term followed by its definition
+func parseGlossary(content string) []GlossaryTerm {
+	var terms []GlossaryTerm
+	add := func(term, definition string) {
+		term, definition = cleanGlossaryText(term), cleanGlossaryText(definition)
+		if term == "" || definition == "" || len([]rune(term)) > glossaryMaxTerm {
+			return
+		}
+		if r := []rune(definition); len(r) > glossaryMaxDefinition {
+			definition = string(r[:glossaryMaxDefinition]) + "…"
+		}
+		terms = append(terms, GlossaryTerm{Term: term, Definition: definition})
+	}
+
+	lines := strings.Split(content, "\n")
+	heading := ""
+	var paragraph []string
+	flush := func() {
+		if heading != "" && len(paragraph) > 0 {
+			add(heading, strings.Join(paragraph, " "))
+		}
+		heading, paragraph = "", nil
+	}
+
+	for i, raw := range lines {
+		line := strings.TrimSpace(raw)
+		switch {
+		case line == "":
+			if len(paragraph) > 0 {
+				flush()
+			}
+
+		case strings.HasPrefix(line, "|"):
+			flush()
+			cells := strings.Split(strings.Trim(line, "|"), "|")
+			if len(cells) < 2 || glossaryTableRule.MatchString(strings.TrimSpace(cells[0])) {
+				continue
+			}
+			// The row above a rule row is the table header
+			if i+1 < len(lines) {
+				next := strings.Split(strings.Trim(strings.TrimSpace(lines[i+1]), "|"), "|")
+				if glossaryTableRule.MatchString(strings.TrimSpace(next[0])) {
+					continue
+				}
+			}
+			add(cells[0], cells[1])
+
+		case glossaryHeading.MatchString(line):
+			flush()
+			heading = glossaryHeading.FindStringSubmatch(line)[1]
+
+		case glossaryBoldLine.MatchString(line):
+			flush()
+			heading = glossaryBoldLine.FindStringSubmatch(line)[1]
+
+		case glossaryBoldEntry.MatchString(line):
+			flush()
+			m := glossaryBoldEntry.FindStringSubmatch(line)
+			add(m[1], m[2])
+
+		case glossaryListEntry.MatchString(line):
+			flush()
+			m := glossaryListEntry.FindStringSubmatch(line)
+			add(m[1], m[2])
+
+		case heading != "":
+			// A heading followed by a list is a section title, not a term
+			if strings.HasPrefix(line, "- ") || strings.HasPrefix(line, "* ") {
+				heading, paragraph = "", nil
+				continue
+			}
+			paragraph = append(paragraph, line)
+		}
+	}
+	flush()
+	return terms
+}
+
+// glossaryTermNames returns the names a term can appear under in a question: the term itself
+// and, for "中文 (English)" terms, each of the two names
+func glossaryTermNames(term string) []string {
+	names := []string{term}
+	if m := glossaryAlias.FindStringSubmatch(term); m != nil {
+		names = append(names, strings.TrimSpace(m[1]), strings.TrimSpace(m[2]))
+	}
+	return names
+}
+
+// mentionsGlossaryTerm reports whether a question mentions a name. Latin names must match as
+// whole words, so "AI" doesn't match "said", though a plural "s" or "es" may follow.
+func mentionsGlossaryTerm(question, name string) bool {
+	if len([]rune(name)) < 2 {
+		return false
+	}
+	lower := strings.ToLower(question)
+	name = strings.ToLower(name)
+	for start := 0; ; {
+		i := strings.Index(lower[start:], name)
+		if i < 0 {
+			return false
+		}
+		i += start
+		end := i + len(name)
+		if isWordByte(name[len(name)-1]) {
+			if strings.HasPrefix(lower[end:], "es") && (end+2 == len(lower) || !isWordByte(lower[end+2])) {
+				end += 2
+			} else if strings.HasPrefix(lower[end:], "s") && (end+1 == len(lower) || !isWordByte(lower[end+1])) {
+				end++
+			}
+		}
+		if (i == 0 || !isWordByte(lower[i-1]) || !isWordByte(name[0])) &&
+			(end == len(lower) || !isWordByte(lower[end]) || !isWordByte(name[len(name)-1])) {
+			return true
+		}
+		start = i + 1
+	}
+}
+
+func isWordByte(b byte) bool {
+	return b == '_' || (b >= '0' && b <= '9') || (b >= 'a' && b <= 'z') || (b >= 'A' && b <= 'Z')
+}
+
+// matchGlossaryTerms returns the terms a question mentions, at most glossaryMaxTerms
+func matchGlossaryTerms(terms []GlossaryTerm, question string) []GlossaryTerm {
+	var matched []GlossaryTerm
+	for _, term := range terms {
+		for _, name := range glossaryTermNames(term.Term) {
+			if mentionsGlossaryTerm(question, name) {
+				matched = append(matched, term)
+				break
+			}
+		}
+		if len(matched) == glossaryMaxTerms {
+			break
+		}
+	}
+	return matched
+}
+
+// chatGlossary returns the definitions from a notebook's glossary notes of the terms a question
+// mentions. allow limits which notes are read, e.g. to those a public notebook exposes; nil
+// allows all. If a term is defined twice, the newer note wins.
+func (s *Server) chatGlossary(ctx context.Context, notebookID, question string, allow func(*Note) bool) []GlossaryTerm {
+	notes, err := s.store.ListNotes(ctx, notebookID)
+	if err != nil {
+		golog.Errorf("failed to list notes for glossary: %v", err)
+		return nil
+	}
+
+	var terms []GlossaryTerm
+	seen := make(map[string]bool)
+	// Notes are listed newest first
+	for i := range notes {
+		note := &notes[i]
+		if !isGlossaryNote(note) || (allow != nil && !allow(note)) {
+			continue
+		}
+		// The listed notes may be shared with the store's cache
+		full := *note
+		if err := s.store.LoadNoteContent(ctx, &full); err != nil {
+			golog.Errorf("failed to load glossary note %s: %v", note.ID, err)
+			continue
+		}
+		for _, term := range parseGlossary(full.Content) {
+			key := strings.ToLower(term.Term)
+			if !seen[key] {
+				seen[key] = true
+				terms = append(terms, term)
+			}
+		}
+	}
+	return matchGlossaryTerms(terms, question)
+}
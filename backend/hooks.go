@@ -0,0 +1,437 @@
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/kataras/golog"
+)
+
+// hookTemplateField matches {field} placeholders in a hook's name template
+var hookTemplateField = regexp.MustCompile(`\{(\w+)\}`)
+
+// hookPayload reads the pushed fields from a JSON body or a form post. Nested JSON values are kept as JSON text.
+func hookPayload(c *gin.Context) (map[string]string, error) {
+	fields := make(map[string]string)
+
+	if strings.HasPrefix(c.ContentType(), "application/json") {
+		var raw map[string]any
+		if err := c.ShouldBindJSON(&raw); err != nil {
+			return nil, err
+		}
+		for k, v := range raw {
+			switch v := v.(type) {
+			case string:
+				fields[k] = v
+			case nil:
+			default:
+				b, _ := json.Marshal(v)
+				fields[k] = string(b)
+			}
+		}
+		return fields, nil
+	}
+
+	if err := c.Request.ParseForm(); err != nil {
+		return nil, err
+	}
+	for k := range c.Request.PostForm {
+		fields[k] = c.Request.PostForm.Get(k)
+	}
+	return fields, nil
+}
+
+// renderHookName fills a name template with payload fields plus {date}, {time} and {hook}.
+// A missing {title} falls back to the given default title.
+func renderHookName(template string, hook *IngestHook, fields map[string]string, title string) string {
+	if template == "" {
+		template = "{title}"
+	}
+	now := time.Now()
+	return strings.TrimSpace(hookTemplateField.ReplaceAllStringFunc(template, func(match string) string {
+		key := match[1 : len(match)-1]
+		if v := strings.TrimSpace(fields[key]); v != "" {
+			return v
+		}
+		switch key {
+		case "title":
+			return title
+		case "date":
+			return now.Format("2006-01-02")
+		case "time":
+			return now.Format("15:04")
+		case "hook":
+			return hook.Name
+		}
+		return ""
+	}))
+}
+
+// hookAuth authenticates a request by its ingest hook token, taken from the X-Hook-Token
+// header only, since query strings end up in access logs. The hook and its owner are set on
+// the context.
+func (s *Server) hookAuth() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		token := c.GetHeader("X-Hook-Token")
+		if token == "" {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, ErrorResponse{Error: "Hook token required"})
+			return
+		}
+		hook, err := s.store.GetIngestHookByToken(c.Request.Context(), token)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, ErrorResponse{Error: "Invalid hook token"})
+			return
+		}
+		c.Set("hook", hook)
+		c.Set("user_id", hook.UserID)
+		c.Next()
+	}
+}
+
+// handleHookIngest receives content pushed by an automation tool and adds it to the hook's notebook
+func (s *Server) handleHookIngest(c *gin.Context) {
+	ctx := context.Background()
+	hook := c.MustGet("hook").(*IngestHook)
+
+	fields, err := hookPayload(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid payload", Details: err.Error()})
+		return
+	}
+
+	content := strings.TrimSpace(fields["content"])
+	url := strings.TrimSpace(fields["url"])
+	if content == "" && url == "" {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "content or url is required"})
+		return
+	}
+
+	source := &Source{
+		NotebookID: hook.NotebookID,
+		Type:       "text",
+		URL:        url,
+		Content:    content,
+		Metadata:   map[string]interface{}{"hook_id": hook.ID},
+	}
+	// Without content the URL is fetched like a URL source
+	if content == "" {
+		article, err := s.extractURL(ctx, source, s.defaultURLParser())
+		if err != nil {
+			c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Failed to fetch URL", Details: err.Error()})
+			return
+		}
+		source.Type = "url"
+		source.Content = article
+	}
+
+	title := url
+	if source.Type == "text" {
+		title = quickNoteTitle(content)
+	}
+	source.Name = renderHookName(hook.NameTemplate, hook, fields, title)
+	if source.Name == "" {
+		source.Name = title
+	}
+
+	activityLog := &ActivityLog{
+		UserID:    hook.UserID,
+		Action:    "hook_ingest",
+		IPAddress: c.ClientIP(),
+		UserAgent: c.GetHeader("User-Agent"),
+	}
+	if err := s.captureSource(ctx, source, activityLog); err != nil {
+		if err == errLegalHold {
+			c.JSON(http.StatusLocked, ErrorResponse{Error: "Notebook is under legal hold"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to create source"})
+		return
+	}
+
+	if err := s.store.TouchIngestHook(ctx, hook.ID); err != nil {
+		golog.Errorf("failed to update ingest hook: %v", err)
+	}
+
+	c.JSON(http.StatusCreated, source)
+}
+
+// hookFileStatus tells whether a file of a watched folder is "new" to the hook's notebook, a
+// "changed" version of a file uploaded before from the same path, or "unchanged" because its
+// bytes are already in the notebook. The matching source is returned with the latter two.
+func (s *Server) hookFileStatus(ctx context.Context, hook *IngestHook, file HookFile) (string, *Source, error) {
+	source, err := s.store.FindSourceByMetadata(ctx, hook.NotebookID, map[string]string{"sha256": strings.ToLower(file.SHA256)})
+	if err != nil {
+		return "", nil, err
+	}
+	if source != nil {
+		return "unchanged", source, nil
+	}
+	source, err = s.store.FindSourceByMetadata(ctx, hook.NotebookID, map[string]string{"hook_id": hook.ID, "watch_path": file.Path})
+	if err != nil {
+		return "", nil, err
+	}
+	if source != nil && source.Type == "file" {
+		return "changed", source, nil
+	}
+	return "new", nil, nil
+}
+
+// handleHookFilesCheck tells the folder watch agent which of its files need uploading, so
+// unchanged files aren't sent again
+func (s *Server) handleHookFilesCheck(c *gin.Context) {
+	ctx := c.Request.Context()
+	hook := c.MustGet("hook").(*IngestHook)
+
+	var req HookFilesCheckRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	results := make([]HookFileResult, len(req.Files))
+	for i, file := range req.Files {
+		status, source, err := s.hookFileStatus(ctx, hook, file)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to check files", Details: err.Error()})
+			return
+		}
+		results[i] = HookFileResult{Path: file.Path, Status: status}
+		if source != nil {
+			results[i].SourceID = source.ID
+		}
+	}
+	c.JSON(http.StatusOK, results)
+}
+
+// handleHookFiles receives a batch of files from the folder watch agent and adds them to the
+// hook's notebook. Each file part is matched with a path field, in the same order, giving its
+// path relative to the watched folder. A file whose bytes are already in the notebook is
+// skipped, and a new version of a file uploaded before from the same path replaces its
+// content, keeping the previous content as a version.
+func (s *Server) handleHookFiles(c *gin.Context) {
+	ctx := c.Request.Context()
+	hook := c.MustGet("hook").(*IngestHook)
+	if err := s.checkLegalHold(ctx, hook.NotebookID); err != nil {
+		c.JSON(http.StatusLocked, ErrorResponse{Error: "Notebook is under legal hold"})
+		return
+	}
+
+	form, err := c.MultipartForm()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid payload", Details: err.Error()})
+		return
+	}
+	files := form.File["file"]
+	if len(files) == 0 {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "file required"})
+		return
+	}
+	paths := form.Value["path"]
+
+	results := make([]HookFileResult, len(files))
+	for i, file := range files {
+		watchPath := file.Filename
+		if i < len(paths) && paths[i] != "" {
+			watchPath = filepath.ToSlash(filepath.Clean(paths[i]))
+		}
+		results[i] = s.saveHookFile(c, hook, file, watchPath)
+		if results[i].Status == "failed" {
+			golog.Warnf("failed to import %s through hook %s: %s", watchPath, hook.ID, results[i].Error)
+		}
+	}
+
+	if err := s.store.TouchIngestHook(ctx, hook.ID); err != nil {
+		golog.Errorf("failed to update ingest hook: %v", err)
+	}
+	c.JSON(http.StatusOK, results)
+}
+
+// saveHookFile adds one uploaded file of a watched folder to the hook's notebook. New files
+// are extracted in the background like other uploads.
+func (s *Server) saveHookFile(c *gin.Context, hook *IngestHook, file *multipart.FileHeader, watchPath string) HookFileResult {
+	ctx := c.Request.Context()
+	result := HookFileResult{Path: watchPath, Status: "failed"}
+
+	name := path.Base(watchPath)
+	ext := filepath.Ext(name)
+	uniqueFileName := fmt.Sprintf("%s_%s%s", strings.TrimSuffix(name, ext), uuid.New().String()[:8], ext)
+	userUploadDir := filepath.Join(s.cfg.UploadDir, hook.UserID)
+	filePath := filepath.Join(userUploadDir, uniqueFileName)
+	if err := os.MkdirAll(userUploadDir, 0755); err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	if err := c.SaveUploadedFile(file, filePath); err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	hash, err := fileSHA256(filePath)
+	if err != nil {
+		os.Remove(filePath)
+		result.Error = err.Error()
+		return result
+	}
+
+	status, source, err := s.hookFileStatus(ctx, hook, HookFile{Path: watchPath, SHA256: hash})
+	if err != nil {
+		os.Remove(filePath)
+		result.Error = err.Error()
+		return result
+	}
+	switch status {
+	case "unchanged":
+		os.Remove(filePath)
+		result.Status = "unchanged"
+		result.SourceID = source.ID
+		return result
+
+	case "changed":
+		// Load the existing index first, otherwise loading it later would index the new content twice
+		if err := s.loadNotebookVectorIndex(ctx, source.NotebookID); err != nil {
+			golog.Errorf("failed to load vector index: %v", err)
+		}
+		version, err := s.replaceSourceFile(ctx, source, filePath, uniqueFileName, file.Size)
+		if err != nil {
+			result.Error = err.Error()
+			return result
+		}
+		result.SourceID = source.ID
+		if version == nil {
+			// Different bytes with the same text; remembered so they aren't sent again
+			source.Metadata["sha256"] = hash
+			if err := s.store.UpdateSourceMetadata(ctx, source); err != nil {
+				golog.Errorf("failed to update source metadata: %v", err)
+			}
+			result.Status = "unchanged"
+			return result
+		}
+		result.Status = "updated"
+		return result
+	}
+
+	source = &Source{
+		NotebookID: hook.NotebookID,
+		Name:       name,
+		Type:       "file",
+		FileName:   uniqueFileName,
+		FileSize:   file.Size,
+		Metadata: map[string]interface{}{
+			"path":       filePath,
+			"user_id":    hook.UserID,
+			"hook_id":    hook.ID,
+			"watch_path": watchPath,
+			"sha256":     hash,
+		},
+	}
+	if err := s.store.CreateSource(ctx, source); err != nil {
+		os.Remove(filePath)
+		result.Error = err.Error()
+		return result
+	}
+
+	activityLog := &ActivityLog{
+		UserID:       hook.UserID,
+		Action:       "hook_upload",
+		ResourceType: "source",
+		ResourceID:   source.ID,
+		ResourceName: name,
+		Details:      fmt.Sprintf(`{"notebook_id": "%s", "hook_id": "%s", "file_size": %d}`, hook.NotebookID, hook.ID, file.Size),
+		IPAddress:    c.ClientIP(),
+		UserAgent:    c.GetHeader("User-Agent"),
+	}
+	if err := s.store.LogActivity(ctx, activityLog); err != nil {
+		golog.Errorf("failed to log hook upload activity: %v", err)
+	}
+
+	result.SourceID = source.ID
+	if _, err := s.queueSourceIngest(ctx, source, hook.UserID, "file"); err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	result.Status = "added"
+	return result
+}
+
+func (s *Server) handleListIngestHooks(c *gin.Context) {
+	hooks, err := s.store.ListIngestHooks(c.Request.Context(), c.GetString("user_id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to list hooks"})
+		return
+	}
+	c.JSON(http.StatusOK, hooks)
+}
+
+// handleCreateIngestHook creates a hook filing pushed content into one of the user's notebooks
+func (s *Server) handleCreateIngestHook(c *gin.Context) {
+	ctx := context.Background()
+	userID := c.GetString("user_id")
+
+	var req IngestHookRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	notebook, err := s.store.GetNotebook(ctx, req.NotebookID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, ErrorResponse{Error: "Notebook not found"})
+		return
+	}
+	if notebook.UserID != userID {
+		c.JSON(http.StatusForbidden, ErrorResponse{Error: "Access denied"})
+		return
+	}
+
+	token, err := randomToken()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to generate hook token"})
+		return
+	}
+
+	hook := &IngestHook{
+		UserID:       userID,
+		Name:         strings.TrimSpace(req.Name),
+		Token:        token,
+		NotebookID:   notebook.ID,
+		NameTemplate: strings.TrimSpace(req.NameTemplate),
+	}
+	if err := s.store.CreateIngestHook(ctx, hook); err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to create hook"})
+		return
+	}
+
+	activityLog := &ActivityLog{
+		UserID:       userID,
+		Action:       "create_hook",
+		ResourceType: "notebook",
+		ResourceID:   notebook.ID,
+		ResourceName: notebook.Name,
+		Details:      fmt.Sprintf(`{"hook_id": "%s"}`, hook.ID),
+		IPAddress:    c.ClientIP(),
+		UserAgent:    c.GetHeader("User-Agent"),
+	}
+	if err := s.store.LogActivity(ctx, activityLog); err != nil {
+		golog.Errorf("failed to log hook creation activity: %v", err)
+	}
+
+	c.JSON(http.StatusCreated, hook)
+}
+
+func (s *Server) handleDeleteIngestHook(c *gin.Context) {
+	if err := s.store.DeleteIngestHook(c.Request.Context(), c.GetString("user_id"), c.Param("hookId")); err != nil {
+		c.JSON(http.StatusNotFound, ErrorResponse{Error: "Hook not found"})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
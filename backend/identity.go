@@ -0,0 +1,267 @@
+package backend
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/kataras/golog"
+	"golang.org/x/oauth2"
+)
+
+// identityLinkLifetime is how long a user has to authorize a provider when linking it
+const identityLinkLifetime = 10 * time.Minute
+
+// identityLinkCookie holds the nonce that ties a linking flow to the browser that started it
+const identityLinkCookie = "notex_link_nonce"
+
+// errIdentityUnlinked refuses sign-ins with an identity its user unlinked
+var errIdentityUnlinked = errors.New("this account was unlinked; sign in another way and link it again")
+
+// identityUser returns the user an OAuth identity signs in. A linked identity signs in its
+// user, whatever email the provider now reports. Otherwise the identity signs in the user with
+// its email, created if needed, and is linked to them, as all identities were before they were
+// recorded; an identity its user unlinked doesn't sign in until it is linked again.
+func (h *AuthHandler) identityUser(ctx context.Context, identity *UserIdentity, user *User) (*User, error) {
+	if linked, err := h.store.GetUserIdentity(ctx, identity.Provider, identity.Subject); err == nil {
+		identity.UserID = linked.UserID
+		if err := h.store.TouchUserIdentity(ctx, identity); err != nil {
+			golog.Errorf("failed to record sign-in with %s identity %s: %v", identity.Provider, identity.Subject, err)
+		}
+		return h.store.GetUser(ctx, linked.UserID)
+	}
+	unlinked, err := h.store.IsIdentityUnlinked(ctx, identity.Provider, identity.Subject)
+	if err != nil {
+		return nil, err
+	}
+	if unlinked {
+		return nil, errIdentityUnlinked
+	}
+
+	if err := h.store.CreateUser(ctx, user); err != nil {
+		return nil, err
+	}
+	dbUser, err := h.store.GetUserByEmail(ctx, user.Email)
+	if err != nil {
+		return nil, err
+	}
+	identity.UserID = dbUser.ID
+	if err := h.store.LinkUserIdentity(ctx, identity); err != nil {
+		// The user already has another identity of the provider with the same email
+		golog.Warnf("failed to link %s identity %s to user %s: %v", identity.Provider, identity.Subject, dbUser.ID, err)
+	}
+	return dbUser, nil
+}
+
+// providerConfig returns the OAuth configuration of a provider, nil if it isn't configured
+func (h *AuthHandler) providerConfig(provider string) *oauth2.Config {
+	switch provider {
+	case "github":
+		return h.githubConfig
+	case "google":
+		return h.googleConfig
+	}
+	return nil
+}
+
+// linkState signs the OAuth state of a linking flow, which tells the callback which user to
+// link the identity to. It names the session that started the flow, so that revoking the
+// session also stops the flow, and holds the hash of the nonce set as a cookie in the browser
+// that started it, so that the flow can't be finished by anyone else.
+func linkState(userID, sessionID, nonce, secret string) (string, error) {
+	claims := jwt.MapClaims{
+		"link_user": userID,
+		"sid":       sessionID,
+		"nonce":     linkNonceHash(nonce),
+		"exp":       time.Now().Add(identityLinkLifetime).Unix(),
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	return token.SignedString([]byte(secret))
+}
+
+func linkNonceHash(nonce string) string {
+	sum := sha256.Sum256([]byte(nonce))
+	return hex.EncodeToString(sum[:])
+}
+
+// setLinkCookie sets, or with an empty nonce clears, the nonce cookie of a linking flow. The
+// provider redirects to the callback with a top-level navigation, which Lax cookies follow.
+func setLinkCookie(c *gin.Context, nonce string) {
+	maxAge := int(identityLinkLifetime.Seconds())
+	if nonce == "" {
+		maxAge = -1
+	}
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(identityLinkCookie, nonce, maxAge, "/", "", strings.HasPrefix(requestBaseURL(c), "https:"), true)
+}
+
+// parseLinkState returns the user a linking flow was started by, or an empty string if the
+// state is that of a sign-in. A linking flow that is no longer valid, or that a different
+// browser than the one that started it finishes, is refused.
+func (h *AuthHandler) parseLinkState(c *gin.Context, state string) (string, error) {
+	token, err := jwt.Parse(state, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		return []byte(h.config.JWTSecret), nil
+	})
+	if err != nil || !token.Valid {
+		return "", nil
+	}
+	claims, _ := token.Claims.(jwt.MapClaims)
+	userID, _ := claims["link_user"].(string)
+	if userID == "" {
+		return "", nil
+	}
+
+	nonce, _ := c.Cookie(identityLinkCookie)
+	setLinkCookie(c, "")
+	nonceHash, _ := claims["nonce"].(string)
+	if nonce == "" || !hmac.Equal([]byte(linkNonceHash(nonce)), []byte(nonceHash)) {
+		auditLogger.Infof("identity link of user %s refused: finished in another browser", userID)
+		return "", fmt.Errorf("linking was started in another browser; start it again in this one")
+	}
+	if sessionID, ok := claims["sid"].(string); ok && sessionID != "" {
+		if err := h.store.TouchAuthSession(c.Request.Context(), sessionID, userID, c.ClientIP(), c.GetHeader("User-Agent")); err != nil {
+			auditLogger.Infof("identity link of user %s refused: %v", userID, err)
+			return "", fmt.Errorf("the session that started linking has ended; sign in and start again")
+		}
+	}
+	return userID, nil
+}
+
+// HandleListIdentities lists the OAuth identities the user can sign in with
+func (h *AuthHandler) HandleListIdentities(c *gin.Context) {
+	identities, err := h.store.ListUserIdentities(c.Request.Context(), c.GetString("user_id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to list identities"})
+		return
+	}
+	c.JSON(http.StatusOK, identities)
+}
+
+// HandleLinkIdentity starts linking an identity of a provider to the user. It returns the
+// provider's authorization page, which is opened in a popup like a sign-in; the callback then
+// links the identity instead of signing in with it.
+func (h *AuthHandler) HandleLinkIdentity(c *gin.Context) {
+	if getTokenGrant(c) != nil {
+		c.JSON(http.StatusForbidden, ErrorResponse{Error: "Identities can only be linked from a signed-in session"})
+		return
+	}
+	if h.config.LocalMode {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Identities are not used in local mode"})
+		return
+	}
+	provider := c.Param("provider")
+	oauthConfig := h.providerConfig(provider)
+	if oauthConfig == nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: fmt.Sprintf("%s sign-in is not configured", provider)})
+		return
+	}
+
+	nonce, err := randomToken()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to start linking"})
+		return
+	}
+	state, err := linkState(c.GetString("user_id"), c.GetString("session_id"), nonce, h.config.JWTSecret)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to start linking"})
+		return
+	}
+	setLinkCookie(c, nonce)
+	c.JSON(http.StatusOK, gin.H{"url": oauthConfig.AuthCodeURL(state, oauth2.AccessTypeOnline)})
+}
+
+// finishLinkIdentity links the identity a provider returned to the user who started the flow.
+// An identity signs in one user only, and a user has one identity of each provider.
+func (h *AuthHandler) finishLinkIdentity(c *gin.Context, userID string, identity *UserIdentity) {
+	ctx := c.Request.Context()
+	fail := func(message string) {
+		h.postToOpener(c, identity.Provider, toJson(gin.H{"error": message}))
+	}
+
+	if linked, err := h.store.GetUserIdentity(ctx, identity.Provider, identity.Subject); err == nil {
+		if linked.UserID != userID {
+			fail(fmt.Sprintf("This %s account already signs in another user", identity.Provider))
+			return
+		}
+		identity = linked
+	} else {
+		identity.UserID = userID
+		if err := h.store.LinkUserIdentity(ctx, identity); err != nil {
+			fail(fmt.Sprintf("Another %s account is linked already; unlink it first", identity.Provider))
+			return
+		}
+
+		activityLog := &ActivityLog{
+			UserID:       userID,
+			Action:       "link_identity",
+			ResourceType: "identity",
+			ResourceID:   identity.Subject,
+			ResourceName: identity.Provider,
+			Details:      toJson(gin.H{"provider": identity.Provider, "email": identity.Email}),
+			IPAddress:    c.ClientIP(),
+			UserAgent:    c.GetHeader("User-Agent"),
+		}
+		if err := h.store.LogActivity(ctx, activityLog); err != nil {
+			golog.Errorf("failed to log identity activity: %v", err)
+		}
+	}
+	h.postToOpener(c, identity.Provider, toJson(gin.H{"identity": identity}))
+}
+
+// HandleUnlinkIdentity unlinks the user's identity of a provider, which then signs in no one
+// until it is linked again. The last way to sign in, an identity of a user without a password,
+// can't be unlinked.
+func (h *AuthHandler) HandleUnlinkIdentity(c *gin.Context) {
+	if getTokenGrant(c) != nil {
+		c.JSON(http.StatusForbidden, ErrorResponse{Error: "Identities can only be unlinked from a signed-in session"})
+		return
+	}
+	ctx := c.Request.Context()
+	userID := c.GetString("user_id")
+	provider := c.Param("provider")
+
+	identities, err := h.store.ListUserIdentities(ctx, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to list identities"})
+		return
+	}
+	if len(identities) == 1 && identities[0].Provider == provider {
+		user, err := h.store.GetUser(ctx, userID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to get user"})
+			return
+		}
+		if _, passwordHash, err := h.store.GetUserPasswordHash(ctx, user.Email); err != nil || passwordHash == "" {
+			c.JSON(http.StatusConflict, ErrorResponse{Error: "This is the only way to sign in; link another account first"})
+			return
+		}
+	}
+	if err := h.store.DeleteUserIdentity(ctx, userID, provider); err != nil {
+		c.JSON(http.StatusNotFound, ErrorResponse{Error: "Identity not found"})
+		return
+	}
+
+	activityLog := &ActivityLog{
+		UserID:       userID,
+		Action:       "unlink_identity",
+		ResourceType: "identity",
+		ResourceName: provider,
+		IPAddress:    c.ClientIP(),
+		UserAgent:    c.GetHeader("User-Agent"),
+	}
+	if err := h.store.LogActivity(ctx, activityLog); err != nil {
+		golog.Errorf("failed to log identity activity: %v", err)
+	}
+	c.Status(http.StatusNoContent)
+}
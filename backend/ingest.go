@@ -0,0 +1,255 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kataras/golog"
+)
+
+// ingestQueueSize is how many ingest jobs can wait for a worker before enqueueing blocks
+const ingestQueueSize = 256
+
+// startIngestWorkers starts the workers that run queued ingest jobs, then requeues the jobs
+// that were queued or running when the server stopped
+func (s *Server) startIngestWorkers(workers int) {
+	if workers < 1 {
+		workers = 1
+	}
+	for i := 0; i < workers; i++ {
+		go func() {
+			for id := range s.ingestQueue {
+				s.runIngestJob(id)
+			}
+		}()
+	}
+
+	jobs, err := s.store.ListActiveIngestJobs(context.Background())
+	if err != nil {
+		golog.Errorf("failed to list ingest jobs: %v", err)
+		return
+	}
+	for _, job := range jobs {
+		golog.Infof("resuming ingest job %s for source %s", job.ID, job.SourceID)
+		s.enqueueIngestJob(job.ID)
+	}
+}
+
+// enqueueIngestJob hands a job to the workers without blocking the caller
+func (s *Server) enqueueIngestJob(id string) {
+	select {
+	case s.ingestQueue <- id:
+	default:
+		go func() { s.ingestQueue <- id }()
+	}
+}
+
+// queueSourceIngest creates an ingest job for a source that was just created without its
+// content, and annotates the source with it
+func (s *Server) queueSourceIngest(ctx context.Context, source *Source, userID, kind string) (*IngestJob, error) {
+	job := &IngestJob{
+		SourceID:   source.ID,
+		NotebookID: source.NotebookID,
+		UserID:     userID,
+		Kind:       kind,
+		Status:     IngestStatusQueued,
+	}
+	if err := s.store.CreateIngestJob(ctx, job); err != nil {
+		return nil, err
+	}
+	source.IngestStatus = job.Status
+	source.IngestJobID = job.ID
+	s.enqueueIngestJob(job.ID)
+	return job, nil
+}
+
+// runIngestJob fetches or extracts a source's content and indexes it. Failures are stored on
+// the job; the source is kept so the user can see what went wrong.
+func (s *Server) runIngestJob(id string) {
+	ctx := context.Background()
+	job, err := s.store.GetIngestJob(ctx, id)
+	if err != nil {
+		// The source, and its jobs with it, may have been deleted while queued
+		golog.Warnf("failed to load ingest job %s: %v", id, err)
+		return
+	}
+	if job.Status != IngestStatusQueued && job.Status != IngestStatusRunning {
+		return
+	}
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			s.reportPanic(recovered, &ErrorReport{Component: "ingest", UserID: job.UserID, NotebookID: job.NotebookID,
+				Extra: map[string]string{"job_id": job.ID, "source_id": job.SourceID, "kind": job.Kind}})
+			job.Status = IngestStatusFailed
+			job.Stage = ""
+			job.Error = fmt.Sprintf("internal error: %v", recovered)
+			if err := s.store.SaveIngestJob(ctx, job); err != nil {
+				golog.Errorf("failed to save ingest job %s: %v", job.ID, err)
+			}
+		}
+	}()
+
+	source, err := s.store.GetSource(ctx, job.SourceID)
+	if err == nil {
+		err = s.ingestSource(ctx, job, source)
+	}
+	job.Stage = ""
+	if err != nil {
+		golog.Errorf("ingest job %s for source %s failed: %v", job.ID, job.SourceID, err)
+		job.Status = IngestStatusFailed
+		job.Error = err.Error()
+	} else {
+		job.Status = IngestStatusDone
+	}
+	if err := s.store.SaveIngestJob(ctx, job); err != nil {
+		golog.Errorf("failed to save ingest job %s: %v", job.ID, err)
+	}
+
+	// An upload right after a meeting may be its transcript
+	if job.Status == IngestStatusDone && job.Kind == "file" {
+		go s.autoSummarizeUpload(context.Background(), source)
+	}
+}
+
+// ingestSource runs the stages of an ingest job, saving each stage on the job for progress polling
+func (s *Server) ingestSource(ctx context.Context, job *IngestJob, source *Source) error {
+	setStage := func(stage string) {
+		job.Status = IngestStatusRunning
+		job.Stage = stage
+		if err := s.store.SaveIngestJob(ctx, job); err != nil {
+			golog.Errorf("failed to save ingest job %s: %v", job.ID, err)
+		}
+	}
+
+	switch job.Kind {
+	case "paper":
+		setStage("fetching")
+		kind, paperID := parsePaperID(source.URL)
+		if kind == "" {
+			return fmt.Errorf("not a paper link: %s", source.URL)
+		}
+		if err := s.resolvePaper(ctx, source, job.UserID, kind, paperID); err != nil {
+			return fmt.Errorf("failed to resolve paper: %w", err)
+		}
+	case "youtube":
+		setStage("fetching")
+		videoID := parseYouTubeID(source.URL)
+		if videoID == "" {
+			return fmt.Errorf("not a YouTube link: %s", source.URL)
+		}
+		if err := s.resolveYouTube(ctx, source, videoID); err != nil {
+			return fmt.Errorf("failed to fetch YouTube video: %w", err)
+		}
+	case "crawl":
+		setStage("crawling")
+		if err := s.ingestCrawl(ctx, job.UserID, source); err != nil {
+			return err
+		}
+	case "sitemap":
+		setStage("fetching")
+		if err := s.ingestSitemap(ctx, job, source); err != nil {
+			return err
+		}
+	case "url":
+		setStage("fetching")
+		content, err := s.extractURL(ctx, source, "")
+		if err != nil {
+			return err
+		}
+		source.Content = content
+		golog.Infof("URL content fetched successfully, size: %d bytes", len(content))
+	case "file":
+		path, _ := source.Metadata["path"].(string)
+		if scan, ok := source.Metadata["scan"].(map[string]any); ok && scan["status"] == ScanStatusInfected {
+			// A retried job of a quarantined file
+			return fmt.Errorf("%w: %v", errInfected, scan["signature"])
+		}
+		if s.virusScanner != nil {
+			setStage("scanning")
+			scan, err := s.scanUpload(ctx, path)
+			if scan != nil {
+				source.Metadata["scan"] = scan
+			}
+			if err != nil {
+				if scan != nil {
+					// The scan is kept on the source, which shows the user why the file is gone
+					if uerr := s.store.UpdateSource(ctx, source); uerr != nil {
+						golog.Errorf("failed to save the scan of source %s: %v", source.ID, uerr)
+					}
+				}
+				return err
+			}
+		}
+		if kind := mediaKind(path); kind != "" {
+			setStage("transcribing")
+			content, duration, err := s.transcribeMedia(ctx, path)
+			if err != nil {
+				return fmt.Errorf("failed to transcribe %s: %w", kind, err)
+			}
+			source.Content = content
+			// Citations of the transcript point at positions in the recording
+			source.Metadata["media"] = kind
+			source.Metadata["duration"] = math.Round(duration.Seconds())
+			break
+		}
+		setStage("extracting")
+		content, ocr, err := s.extractDocument(ctx, path)
+		if err != nil {
+			return fmt.Errorf("failed to extract document content: %w", err)
+		}
+		source.Content = content
+		if ocr {
+			source.Metadata["ocr"] = s.ocr.name()
+		}
+	case "index":
+		// The content was stored with the source, as for imported notebooks
+	default:
+		return fmt.Errorf("unknown ingest job kind: %s", job.Kind)
+	}
+
+	setStage("indexing")
+	// A resumed job may have indexed the source before the server stopped
+	if err := s.vectorStore.DeleteBySourceID(ctx, source.ID); err != nil {
+		golog.Errorf("failed to remove old chunks of source %s: %v", source.ID, err)
+	}
+	source.ChunkCount = 0
+	s.ingestSourceText(ctx, source)
+	return s.store.UpdateSource(ctx, source)
+}
+
+// withIngestStatus annotates sources with their latest ingest job. The slice is modified in
+// place, so it must not be shared with the cache.
+func (s *Server) withIngestStatus(ctx context.Context, notebookID string, sources []Source) error {
+	jobs, err := s.store.ListLatestIngestJobs(ctx, notebookID)
+	if err != nil {
+		return err
+	}
+	for i := range sources {
+		if job, ok := jobs[sources[i].ID]; ok {
+			sources[i].IngestStatus = job.Status
+			sources[i].IngestJobID = job.ID
+			sources[i].IngestError = job.Error
+			sources[i].IngestDone = job.Progress
+			sources[i].IngestTotal = job.Total
+		}
+	}
+	return nil
+}
+
+// handleGetIngestJob returns the status of an ingest job
+func (s *Server) handleGetIngestJob(c *gin.Context) {
+	ctx := c.Request.Context()
+	job, err := s.store.GetIngestJob(ctx, c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, ErrorResponse{Error: "Job not found"})
+		return
+	}
+	if err := s.checkNotebookAccess(ctx, job.NotebookID, c.GetString("user_id")); err != nil || !tokenAllowsNotebook(c, job.NotebookID) {
+		c.JSON(http.StatusNotFound, ErrorResponse{Error: "Job not found"})
+		return
+	}
+	c.JSON(http.StatusOK, job)
+}
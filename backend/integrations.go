@@ -0,0 +1,329 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kataras/golog"
+)
+
+// Supported chat platform integrations
+const (
+	IntegrationSlack    = "slack"
+	IntegrationDiscord  = "discord"
+	IntegrationTelegram = "telegram"
+)
+
+// integrationHTTPClient calls the chat platforms' APIs
+var integrationHTTPClient = &http.Client{Timeout: 15 * time.Second}
+
+// integrationCommand is a parsed /notex command, independent of the platform it came from
+type integrationCommand struct {
+	Action   string // "ask", "list" or "help"
+	Notebook string // Notebook name or ID
+	Question string
+}
+
+// integrationHelp describes the commands understood by the bots
+const integrationHelp = "用法：\n" +
+	"• `/notex ask <笔记本> <问题>` 基于笔记本来源回答问题，名称含空格时请加引号\n" +
+	"• `/notex list` 列出可用的笔记本"
+
+// parseIntegrationCommand parses slash command text like `ask "My Notebook" what is X?`
+func parseIntegrationCommand(text string) integrationCommand {
+	text = strings.TrimSpace(text)
+	action, rest, _ := strings.Cut(text, " ")
+	rest = strings.TrimSpace(rest)
+
+	switch strings.ToLower(action) {
+	case "ask":
+		var notebook string
+		if strings.HasPrefix(rest, `"`) {
+			if end := strings.Index(rest[1:], `"`); end >= 0 {
+				notebook, rest = rest[1:end+1], rest[end+2:]
+			}
+		}
+		if notebook == "" {
+			notebook, rest, _ = strings.Cut(rest, " ")
+		}
+		return integrationCommand{Action: "ask", Notebook: notebook, Question: strings.TrimSpace(rest)}
+	case "list":
+		return integrationCommand{Action: "list"}
+	default:
+		return integrationCommand{Action: "help"}
+	}
+}
+
+// findNotebook resolves a notebook of the user by ID or (case-insensitive) name
+func (s *Server) findNotebook(ctx context.Context, userID, nameOrID string) (*Notebook, error) {
+	notebooks, err := s.store.ListNotebooks(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	for i := range notebooks {
+		if notebooks[i].ID == nameOrID || strings.EqualFold(notebooks[i].Name, nameOrID) {
+			return &notebooks[i], nil
+		}
+	}
+	return nil, fmt.Errorf("notebook %q not found", nameOrID)
+}
+
+// runIntegrationCommand executes a command on behalf of the integration's owner and returns the reply text
+func (s *Server) runIntegrationCommand(ctx context.Context, userID string, cmd integrationCommand) string {
+	switch cmd.Action {
+	case "list":
+		notebooks, err := s.store.ListNotebooks(ctx, userID)
+		if err != nil {
+			return "获取笔记本列表失败"
+		}
+		if len(notebooks) == 0 {
+			return "还没有笔记本"
+		}
+		var b strings.Builder
+		b.WriteString("笔记本：\n")
+		for _, nb := range notebooks {
+			b.WriteString("• " + nb.Name + "\n")
+		}
+		return b.String()
+
+	case "ask":
+		if cmd.Notebook == "" || cmd.Question == "" {
+			return integrationHelp
+		}
+		notebook, err := s.findNotebook(ctx, userID, cmd.Notebook)
+		if err != nil {
+			return fmt.Sprintf("找不到笔记本「%s」", cmd.Notebook)
+		}
+		agent := s.currentAgent()
+		if agent == nil {
+			return "尚未配置 LLM，请先完成设置"
+		}
+
+		if err := s.loadNotebookVectorIndex(ctx, notebook.ID); err != nil {
+			golog.Errorf("failed to load vector index: %v", err)
+		}
+		settings, _ := s.resolveChatSettings(ctx, notebook.ID, "")
+		// Answers are posted to a channel, so private sources and notes stay out of them
+		if err := s.hidePrivateSources(ctx, notebook.ID, settings); err != nil {
+			golog.Errorf("failed to list private sources: %v", err)
+			return "回答失败，请稍后重试"
+		}
+		ctx = withUsageScope(ctx, userID, notebook.ID)
+		glossary := s.chatGlossary(ctx, notebook.ID, cmd.Question, func(note *Note) bool { return !note.Private })
+		response, err := agent.Chat(ctx, notebook.ID, cmd.Question, glossary, settings, nil, nil, nil)
+		if err != nil {
+			golog.Errorf("integration chat failed: %v", err)
+			return "回答失败，请稍后重试"
+		}
+		return formatCitedAnswer(notebook.Name, cmd.Question, response)
+
+	default:
+		return integrationHelp
+	}
+}
+
+// formatCitedAnswer renders a chat answer with its numbered source citations for posting to a channel
+func formatCitedAnswer(notebookName, question string, response *ChatResponse) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%s* · %s\n\n", notebookName, question)
+	b.WriteString(strings.TrimSpace(response.Message))
+
+	if len(response.Citations) > 0 {
+		b.WriteString("\n\n来源：")
+		for _, c := range response.Citations {
+			fmt.Fprintf(&b, "\n[%d] %s", c.Index, citationLabel(c))
+		}
+	} else if len(response.Sources) > 0 {
+		b.WriteString("\n\n来源：")
+		for _, src := range response.Sources {
+			b.WriteString("\n• " + src.Name)
+		}
+	}
+	return b.String()
+}
+
+// postJSON sends a JSON payload to a platform API, returning the response body. The header
+// may override the JSON content type.
+func postJSON(ctx context.Context, method, url string, payload any, header http.Header) ([]byte, error) {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range header {
+		req.Header[k] = v
+	}
+
+	resp, err := integrationHTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	if resp.StatusCode >= 300 {
+		return body, fmt.Errorf("%s %s: %s: %s", method, url, resp.Status, body)
+	}
+	return body, nil
+}
+
+// integrationResponse hides secrets and adds the endpoint the platform should call
+func integrationResponse(in *Integration) IntegrationResponse {
+	return IntegrationResponse{
+		Integration: *in,
+		HasBotToken: in.BotToken != "",
+		Endpoint:    "/integrations/" + in.Provider + "/" + in.ID,
+	}
+}
+
+func (s *Server) handleListIntegrations(c *gin.Context) {
+	integrations, err := s.store.ListIntegrations(c.Request.Context(), c.GetString("user_id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to list integrations"})
+		return
+	}
+
+	result := make([]IntegrationResponse, len(integrations))
+	for i := range integrations {
+		result[i] = integrationResponse(&integrations[i])
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+// handleSaveIntegration configures a chat platform bot of the current user
+func (s *Server) handleSaveIntegration(c *gin.Context) {
+	ctx := c.Request.Context()
+	provider := c.Param("provider")
+
+	var req IntegrationRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	in := &Integration{
+		UserID:        c.GetString("user_id"),
+		Provider:      provider,
+		BotToken:      strings.TrimSpace(req.BotToken),
+		SigningSecret: strings.TrimSpace(req.SigningSecret),
+		PublicKey:     strings.TrimSpace(req.PublicKey),
+		ApplicationID: strings.TrimSpace(req.ApplicationID),
+	}
+
+	switch provider {
+	case IntegrationSlack:
+		if in.SigningSecret == "" {
+			c.JSON(http.StatusBadRequest, ErrorResponse{Error: "signing_secret is required for Slack"})
+			return
+		}
+	case IntegrationDiscord:
+		if in.PublicKey == "" || in.ApplicationID == "" {
+			c.JSON(http.StatusBadRequest, ErrorResponse{Error: "public_key and application_id are required for Discord"})
+			return
+		}
+		if _, err := discordPublicKey(in.PublicKey); err != nil {
+			c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+			return
+		}
+	case IntegrationTelegram:
+		if in.BotToken == "" {
+			c.JSON(http.StatusBadRequest, ErrorResponse{Error: "bot_token is required for Telegram"})
+			return
+		}
+		// Telegram echoes this secret on every webhook call
+		secret, err := randomToken()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to generate webhook secret"})
+			return
+		}
+		in.SigningSecret = secret
+	default:
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Unsupported integration provider"})
+		return
+	}
+
+	if err := s.store.SaveIntegration(ctx, in); err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to save integration"})
+		return
+	}
+
+	if provider == IntegrationTelegram {
+		webhookURL := strings.TrimRight(req.BaseURL, "/")
+		if webhookURL == "" {
+			webhookURL = requestBaseURL(c)
+		}
+		webhookURL += integrationResponse(in).Endpoint
+		if err := setTelegramWebhook(ctx, in, webhookURL); err != nil {
+			golog.Warnf("failed to set telegram webhook: %v", err)
+			c.JSON(http.StatusBadGateway, ErrorResponse{Error: "Integration saved, but registering the Telegram webhook failed", Details: err.Error()})
+			return
+		}
+	}
+
+	// With a bot token, Discord's /notex command can be registered for the user
+	if provider == IntegrationDiscord && in.BotToken != "" {
+		if err := registerDiscordCommand(ctx, in); err != nil {
+			golog.Warnf("failed to register discord command: %v", err)
+			c.JSON(http.StatusBadGateway, ErrorResponse{Error: "Integration saved, but registering the Discord command failed", Details: err.Error()})
+			return
+		}
+	}
+
+	c.JSON(http.StatusOK, integrationResponse(in))
+}
+
+func (s *Server) handleDeleteIntegration(c *gin.Context) {
+	if err := s.store.DeleteIntegration(c.Request.Context(), c.GetString("user_id"), c.Param("provider")); err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to delete integration"})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// randomToken returns a random hex string usable as a webhook secret
+func randomToken() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// requestBaseURL reconstructs the public base URL of this server from the request, honoring proxies
+func requestBaseURL(c *gin.Context) string {
+	scheme := "http"
+	if c.Request.TLS != nil || c.GetHeader("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return scheme + "://" + c.Request.Host
+}
+
+// loadIntegration reads the raw request body and the integration addressed by the webhook URL.
+// The body is needed verbatim for signature verification.
+func (s *Server) loadIntegration(c *gin.Context, provider string) (*Integration, []byte, bool) {
+	in, err := s.store.GetIntegration(c.Request.Context(), c.Param("integrationId"))
+	if err != nil || in.Provider != provider {
+		c.JSON(http.StatusNotFound, ErrorResponse{Error: "Integration not found"})
+		return nil, nil, false
+	}
+
+	body, err := io.ReadAll(io.LimitReader(c.Request.Body, 1<<20))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Failed to read request"})
+		return nil, nil, false
+	}
+	return in, body, true
+}
@@ -0,0 +1,193 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kataras/golog"
+)
+
+// legalHoldAllowedRoutes are the notebook writes that don't change its sources, notes or chat
+// history, so they still work on a notebook under legal hold
+var legalHoldAllowedRoutes = map[string]bool{
+	"/api/notebooks/:id/sources/:sourceId/read":  true, // Read markers of the user
+	"/api/notebooks/:id/sources/:sourceId/check": true, // Link health check
+	"/api/notebooks/:id/overlap":                 true, // Compares a draft against the sources
+}
+
+// errLegalHold refuses a change to a notebook under legal hold
+var errLegalHold = fmt.Errorf("notebook is under legal hold")
+
+// checkLegalHold returns errLegalHold if a notebook is under legal hold. Writers outside the
+// notebook routes, such as captures and connector syncs, call it before changing a notebook.
+func (s *Server) checkLegalHold(ctx context.Context, notebookID string) error {
+	hold, err := s.store.GetLegalHold(ctx, notebookID)
+	if err != nil {
+		return err
+	}
+	if hold != nil {
+		return errLegalHold
+	}
+	return nil
+}
+
+// legalHoldGuard answers 423 Locked to writes to a notebook under legal hold. Reads, and the
+// writes in legalHoldAllowedRoutes, pass.
+func (s *Server) legalHoldGuard() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		notebookID := c.Param("id")
+		if notebookID == "" || c.Request.Method == http.MethodGet || c.Request.Method == http.MethodHead || legalHoldAllowedRoutes[c.FullPath()] {
+			c.Next()
+			return
+		}
+		hold, err := s.store.GetLegalHold(c.Request.Context(), notebookID)
+		if err != nil {
+			golog.Errorf("failed to check legal hold of notebook %s: %v", notebookID, err)
+			c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to check legal hold"})
+			return
+		}
+		if hold != nil {
+			c.AbortWithStatusJSON(http.StatusLocked, ErrorResponse{Error: "Notebook is under legal hold", Details: hold.Reason})
+			return
+		}
+		c.Next()
+	}
+}
+
+// requireAdmin answers 403 unless the request is from an admin. Without login everyone is.
+func (s *Server) requireAdmin(c *gin.Context) bool {
+	if s.localUserID != "" {
+		return true
+	}
+	user, err := s.store.GetUser(c.Request.Context(), c.GetString("user_id"))
+	if err != nil || user.Role != RoleAdmin {
+		c.JSON(http.StatusForbidden, ErrorResponse{Error: "Admin access required"})
+		return false
+	}
+	return true
+}
+
+// LegalHoldResponse is a legal hold in the admin's list, with the notebook it holds
+type LegalHoldResponse struct {
+	LegalHold
+	NotebookName string `json:"notebook_name"`
+	OwnerID      string `json:"owner_id"`
+}
+
+// handleListLegalHolds lists the notebooks under legal hold
+func (s *Server) handleListLegalHolds(c *gin.Context) {
+	if !s.requireAdmin(c) {
+		return
+	}
+	ctx := c.Request.Context()
+	holds, err := s.store.ListLegalHolds(ctx)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to list legal holds", Details: err.Error()})
+		return
+	}
+	response := make([]LegalHoldResponse, 0, len(holds))
+	for _, hold := range holds {
+		item := LegalHoldResponse{LegalHold: hold}
+		if notebook, err := s.store.GetNotebook(ctx, hold.NotebookID); err == nil {
+			item.NotebookName = notebook.Name
+			item.OwnerID = notebook.UserID
+		}
+		response = append(response, item)
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// handleSetLegalHold puts a notebook on legal hold, or changes the reason of its hold
+func (s *Server) handleSetLegalHold(c *gin.Context) {
+	if !s.requireAdmin(c) {
+		return
+	}
+	ctx := c.Request.Context()
+	var req struct {
+		Reason string `json:"reason"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+		return
+	}
+	notebook, err := s.store.GetNotebook(ctx, c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, ErrorResponse{Error: "Notebook not found"})
+		return
+	}
+
+	hold := &LegalHold{NotebookID: notebook.ID, Reason: strings.TrimSpace(req.Reason), SetBy: c.GetString("user_id")}
+	if err := s.store.SetLegalHold(ctx, hold); err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to set legal hold", Details: err.Error()})
+		return
+	}
+	hold, err = s.store.GetLegalHold(ctx, notebook.ID)
+	if err != nil || hold == nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to set legal hold"})
+		return
+	}
+	s.logLegalHoldChange(c, "set_legal_hold", notebook, hold.Reason)
+	c.JSON(http.StatusOK, hold)
+}
+
+// handleReleaseLegalHold lifts the legal hold of a notebook
+func (s *Server) handleReleaseLegalHold(c *gin.Context) {
+	if !s.requireAdmin(c) {
+		return
+	}
+	ctx := c.Request.Context()
+	notebook, err := s.store.GetNotebook(ctx, c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, ErrorResponse{Error: "Notebook not found"})
+		return
+	}
+	if err := s.store.ReleaseLegalHold(ctx, notebook.ID); err != nil {
+		c.JSON(http.StatusNotFound, ErrorResponse{Error: "Notebook is not under legal hold"})
+		return
+	}
+	s.logLegalHoldChange(c, "release_legal_hold", notebook, "")
+	c.Status(http.StatusNoContent)
+}
+
+// logLegalHoldChange records who set or released a legal hold
+func (s *Server) logLegalHoldChange(c *gin.Context, action string, notebook *Notebook, reason string) {
+	activityLog := &ActivityLog{
+		UserID:       c.GetString("user_id"),
+		Action:       action,
+		ResourceType: "notebook",
+		ResourceID:   notebook.ID,
+		ResourceName: notebook.Name,
+		Details:      fmt.Sprintf(`{"notebook_id": "%s", "owner_id": "%s", "reason": %q}`, notebook.ID, notebook.UserID, reason),
+		IPAddress:    c.ClientIP(),
+		UserAgent:    c.GetHeader("User-Agent"),
+	}
+	if err := s.store.LogActivity(c.Request.Context(), activityLog); err != nil {
+		golog.Errorf("failed to log legal hold activity: %v", err)
+	}
+}
+
+// withLegalHolds annotates an owner's notebooks with their legal holds. The notebooks are
+// copied, as the store may share them with its cache.
+func (s *Server) withLegalHolds(ctx context.Context, notebooks []NotebookWithStats) []NotebookWithStats {
+	holds, err := s.store.ListLegalHolds(ctx)
+	if err != nil {
+		golog.Errorf("failed to list legal holds: %v", err)
+		return notebooks
+	}
+	if len(holds) == 0 {
+		return notebooks
+	}
+	byNotebook := make(map[string]*LegalHold, len(holds))
+	for i := range holds {
+		byNotebook[holds[i].NotebookID] = &holds[i]
+	}
+	annotated := make([]NotebookWithStats, len(notebooks))
+	for i, notebook := range notebooks {
+		notebook.LegalHold = byNotebook[notebook.ID]
+		annotated[i] = notebook
+	}
+	return annotated
+}
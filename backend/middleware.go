@@ -6,10 +6,12 @@ import (
 	"io"
 	"net/http"
 	"os"
+	"path/filepath"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
 	"github.com/kataras/golog"
 	rotatelogs "github.com/lestrrat-go/file-rotatelogs"
 )
@@ -17,19 +19,27 @@ import (
 var auditLogger *golog.Logger
 
 func init() {
-	// Create audit logger
+	// Create audit logger (stdout only until InitAuditLog configures the log directory)
 	auditLogger = golog.New()
+	auditLogger.SetOutput(os.Stdout)
 
+	// Set audit logger configuration
+	auditLogger.SetLevel("info")
+	auditLogger.SetTimeFormat("2006-01-02 15:04:05")
+}
+
+// InitAuditLog configures the audit logger to also write rotated files into logDir
+func InitAuditLog(logDir string) {
 	// Create logs directory if not exists
-	if err := os.MkdirAll("./logs", 0755); err != nil {
+	if err := os.MkdirAll(logDir, 0755); err != nil {
 		golog.Errorf("failed to create logs directory: %v", err)
 	}
 
 	// Setup log rotation
-	logFiles := "./logs/audit.log.%Y%m%d"
+	logFiles := filepath.Join(logDir, "audit.log.%Y%m%d")
 	writer, err := rotatelogs.New(
 		logFiles,
-		rotatelogs.WithLinkName("./logs/audit.log"),
+		rotatelogs.WithLinkName(filepath.Join(logDir, "audit.log")),
 		rotatelogs.WithMaxAge(time.Duration(7)*24*time.Hour),
 		rotatelogs.WithRotationTime(24*time.Hour),
 	)
@@ -40,10 +50,6 @@ func init() {
 		// Write to both file and stdout
 		auditLogger.SetOutput(io.MultiWriter(writer, os.Stdout))
 	}
-
-	// Set audit logger configuration
-	auditLogger.SetLevel("info")
-	auditLogger.SetTimeFormat("2006-01-02 15:04:05")
 }
 
 // getClientIP extracts the real client IP from the request, taking into account
@@ -92,6 +98,20 @@ func (r *responseBodyWriter) Write(b []byte) (int, error) {
 	return r.ResponseWriter.Write(b)
 }
 
+// RequestIDMiddleware gives each request an ID, taken from the X-Request-ID header if the
+// client or a proxy set one, and returns it in the same header. Error reports carry it.
+func RequestIDMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.GetHeader("X-Request-ID")
+		if id == "" || len(id) > 128 {
+			id = uuid.New().String()
+		}
+		c.Set("request_id", id)
+		c.Header("X-Request-ID", id)
+		c.Next()
+	}
+}
+
 // AuditMiddleware creates a middleware that logs all HTTP requests with full details
 func AuditMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
@@ -180,7 +200,7 @@ func AuditMiddlewareLite() gin.HandlerFunc {
 }
 
 // AuthMiddleware authenticates requests using JWT
-func AuthMiddleware(secret string) gin.HandlerFunc {
+func AuthMiddleware(secret string, sessions *Store) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		tokenString := c.GetHeader("Authorization")
 		if tokenString == "" {
@@ -211,6 +231,14 @@ func AuthMiddleware(secret string) gin.HandlerFunc {
 				c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid token claims"})
 				return
 			}
+			if !checkSession(c, sessions, claims, userID) {
+				c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Session revoked or expired"})
+				return
+			}
+			// Scoped API tokens are checked against the route
+			if !setTokenGrant(c, claims) {
+				return
+			}
 			c.Set("user_id", userID)
 		} else {
 			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
@@ -221,9 +249,17 @@ func AuthMiddleware(secret string) gin.HandlerFunc {
 	}
 }
 
+// LocalAuthMiddleware authenticates every request as the implicit local user (desktop mode)
+func LocalAuthMiddleware(userID string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Set("user_id", userID)
+		c.Next()
+	}
+}
+
 // OptionalAuthMiddleware tries to authenticate using JWT, but doesn't require it
 // It supports Authorization header, cookie, and token URL parameter
-func OptionalAuthMiddleware(secret string) gin.HandlerFunc {
+func OptionalAuthMiddleware(secret string, sessions *Store) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		var tokenString string
 
@@ -277,6 +313,14 @@ func OptionalAuthMiddleware(secret string) gin.HandlerFunc {
 
 		if claims, ok := token.Claims.(jwt.MapClaims); ok && token.Valid {
 			if userID, ok := claims["user_id"].(string); ok {
+				// A revoked session continues without setting user_id
+				if !checkSession(c, sessions, claims, userID) {
+					c.Next()
+					return
+				}
+				if !setTokenGrant(c, claims) {
+					return
+				}
 				auditLogger.Infof("OptionalAuth: Successfully authenticated user_id: %s", userID)
 				c.Set("user_id", userID)
 			}
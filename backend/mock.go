@@ -0,0 +1,362 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"hash/fnv"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/kataras/golog"
+	"github.com/tmc/langchaingo/llms"
+)
+
+// mockEmbeddingDimension is the length of the mock embedder's vectors
+const mockEmbeddingDimension = 256
+
+// mockLLM is the LLM of LLM_PROVIDER=mock, for CI, demos and development without API keys or a
+// network. A reply depends on nothing but the prompt, so runs are reproducible. The few kinds
+// of output the application parses, such as slide outlines, mind maps and charts, are answered
+// in their expected format; anything else gets a Markdown reply quoting the prompt's sources.
+type mockLLM struct{}
+
+var (
+	mockQuestion     = regexp.MustCompile(`(?m)^用户问题：(.+)$`)
+	mockSourceHeader = regexp.MustCompile(`(?m)^## Source (\d+): (.+)$`)
+	mockSourceLine   = regexp.MustCompile(`(?m)^\[来源 (\d+)\] (.+)$`)
+)
+
+// GenerateContent implements llms.Model, streaming the reply in small chunks if asked to
+func (m mockLLM) GenerateContent(ctx context.Context, messages []llms.MessageContent, options ...llms.CallOption) (*llms.ContentResponse, error) {
+	var opts llms.CallOptions
+	for _, option := range options {
+		option(&opts)
+	}
+	var prompt strings.Builder
+	for _, message := range messages {
+		for _, part := range message.Parts {
+			if text, ok := part.(llms.TextContent); ok {
+				prompt.WriteString(text.Text)
+				prompt.WriteString("\n")
+			}
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	reply := mockReply(prompt.String())
+	if opts.StreamingFunc != nil {
+		runes := []rune(reply)
+		for i := 0; i < len(runes); i += 8 {
+			if err := opts.StreamingFunc(ctx, []byte(string(runes[i:min(i+8, len(runes))]))); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return &llms.ContentResponse{Choices: []*llms.ContentChoice{{
+		Content:    reply,
+		StopReason: "stop",
+		GenerationInfo: map[string]any{
+			"PromptTokens":     mockTokens(prompt.String()),
+			"CompletionTokens": mockTokens(reply),
+		},
+	}}}, nil
+}
+
+// Call implements llms.Model
+func (m mockLLM) Call(ctx context.Context, prompt string, options ...llms.CallOption) (string, error) {
+	return llms.GenerateFromSinglePrompt(ctx, m, prompt, options...)
+}
+
+// mockTokens estimates the tokens of a text, for usage records
+func mockTokens(text string) int {
+	return (len(text) + 3) / 4
+}
+
+// mockHash hashes a text to pick the mock's numbers and colors
+func mockHash(text string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(text))
+	return h.Sum32()
+}
+
+// mockReply returns the reply to a prompt
+func mockReply(prompt string) string {
+	excerpts := mockExcerpts(prompt)
+	switch {
+	case strings.HasSuffix(strings.TrimSpace(prompt), "分数："):
+		// Reranking asks for a bare relevance score
+		return strconv.Itoa(int(mockHash(prompt) % 11))
+	case strings.Contains(prompt, "支持程度："):
+		// The coverage judge asks for three labelled lines
+		if len(excerpts) == 0 {
+			return "支持程度：无\n相关段落：无\n理由：没有检索到段落（离线模拟回复）。"
+		}
+		return "支持程度：部分\n相关段落：1\n理由：离线模拟回复，未实际判断段落内容。"
+	case strings.Contains(prompt, "mindmap"):
+		var b strings.Builder
+		b.WriteString("```mermaid\nmindmap\n  root((模拟导图))\n")
+		for i, excerpt := range excerpts {
+			fmt.Fprintf(&b, "    (%s)\n      [来源 %d]\n", mockLabel(excerpt, 10), i+1)
+		}
+		b.WriteString("```")
+		return b.String()
+	case strings.Contains(prompt, "ECharts"):
+		labels := make([]string, 0, len(excerpts))
+		values := make([]string, 0, len(excerpts))
+		for i, excerpt := range excerpts {
+			labels = append(labels, strconv.Quote(mockLabel(excerpt, 8)))
+			values = append(values, strconv.Itoa(int(mockHash(excerpt)%90)+10+i))
+		}
+		return `[{"title":"模拟图表","option":{"title":{"text":"模拟图表"},"tooltip":{},` +
+			`"xAxis":{"type":"category","data":[` + strings.Join(labels, ",") + `]},` +
+			`"yAxis":{"type":"value"},"series":[{"type":"bar","data":[` + strings.Join(values, ",") + `]}]}}]`
+	case strings.Contains(prompt, "// 叙事目标"):
+		return mockSlides(excerpts)
+	case strings.Contains(prompt, "播客脚本"):
+		return mockPodcast(excerpts)
+	}
+
+	var b strings.Builder
+	b.WriteString("> 离线模拟回复：未调用语言模型，内容由提示词直接生成。\n\n")
+	if m := mockQuestion.FindStringSubmatch(prompt); m != nil {
+		fmt.Fprintf(&b, "关于“%s”，", strings.TrimSpace(m[1]))
+	}
+	if len(excerpts) == 0 {
+		b.WriteString("没有找到可引用的来源内容。")
+		return b.String()
+	}
+	b.WriteString("来源中的相关内容如下：\n\n")
+	for _, excerpt := range excerpts {
+		fmt.Fprintf(&b, "- %s\n", excerpt)
+	}
+	return strings.TrimRight(b.String(), "\n")
+}
+
+// mockExcerpts returns the first sentence of up to five of the sources included in a prompt,
+// as transformations and chat include them, with their source numbers
+func mockExcerpts(prompt string) []string {
+	var excerpts []string
+	if matches := mockSourceLine.FindAllStringSubmatch(prompt, 5); len(matches) > 0 {
+		for _, m := range matches {
+			excerpts = append(excerpts, fmt.Sprintf("%s [来源 %s]", mockSentence(m[2]), m[1]))
+		}
+		return excerpts
+	}
+	for _, loc := range mockSourceHeader.FindAllStringSubmatchIndex(prompt, 5) {
+		body := prompt[loc[1]:]
+		for _, line := range strings.Split(body, "\n") {
+			line = strings.TrimSpace(strings.TrimLeft(line, "#>-*| "))
+			if line != "" {
+				excerpts = append(excerpts, fmt.Sprintf("%s：%s [来源 %s]", prompt[loc[4]:loc[5]], mockSentence(line), prompt[loc[2]:loc[3]]))
+				break
+			}
+		}
+	}
+	return excerpts
+}
+
+// mockSentence returns the first sentence of a text, cut to 120 characters
+func mockSentence(text string) string {
+	text = strings.TrimSpace(text)
+	if i := strings.IndexAny(text, "。！？.!?"); i > 0 {
+		_, size := utf8.DecodeRuneInString(text[i:])
+		text = text[:i+size]
+	}
+	if runes := []rune(text); len(runes) > 120 {
+		text = string(runes[:120]) + "…"
+	}
+	return text
+}
+
+// mockLabel shortens a text to a mind map or chart label, with spaces for the punctuation those
+// formats can't take
+func mockLabel(text string, length int) string {
+	runes := make([]rune, 0, length)
+	for _, r := range text {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			runes = append(runes, r)
+		} else if len(runes) > 0 && runes[len(runes)-1] != ' ' {
+			runes = append(runes, ' ')
+		}
+		if len(runes) == length {
+			break
+		}
+	}
+	if label := strings.TrimSpace(string(runes)); label != "" {
+		return label
+	}
+	return "要点"
+}
+
+// mockSlides returns a slide outline of a cover, one slide per excerpt and a closing slide, in
+// the structure parsePPTSlides expects
+func mockSlides(excerpts []string) string {
+	titles := append(append([]string{"模拟演示文稿"}, excerpts...), "总结")
+	var b strings.Builder
+	for i, title := range titles {
+		fmt.Fprintf(&b, "## Slide %d: %s\n\n", i+1, mockLabel(title, 20))
+		fmt.Fprintf(&b, "#### // 叙事目标\n离线模拟幻灯片 %d。\n\n", i+1)
+		fmt.Fprintf(&b, "#### // 关键内容\n%s\n\n", title)
+		b.WriteString("#### // 视觉元素\n简单的几何图形。\n\n")
+		b.WriteString("#### // 布局\n标题居中。\n\n")
+	}
+	return strings.TrimRight(b.String(), "\n")
+}
+
+// mockPodcast returns a podcast script of two hosts taking turns, one excerpt each, in the
+// structure parsePodcastTurns expects
+func mockPodcast(excerpts []string) string {
+	var b strings.Builder
+	b.WriteString("## 播客脚本\n\n[开场音乐]\n\n主持人1：欢迎收听本期节目，这是一段离线模拟的播客。\n\n")
+	for i, excerpt := range excerpts {
+		fmt.Fprintf(&b, "主持人%d：%s\n\n", 2-i%2, excerpt)
+	}
+	b.WriteString("主持人1：感谢收听，我们下期再见。")
+	return b.String()
+}
+
+// mockEmbedder is the embedder of LLM_PROVIDER=mock. It hashes the words of a text, and the
+// pairs of adjacent characters of CJK text, into a normalized vector, so texts sharing words
+// are close and vector search still finds relevant chunks.
+type mockEmbedder struct{}
+
+// EmbedDocuments implements embeddings.Embedder
+func (e mockEmbedder) EmbedDocuments(ctx context.Context, texts []string) ([][]float32, error) {
+	vectors := make([][]float32, len(texts))
+	for i, text := range texts {
+		vectors[i] = mockEmbedding(text)
+	}
+	return vectors, nil
+}
+
+// EmbedQuery implements embeddings.Embedder
+func (e mockEmbedder) EmbedQuery(ctx context.Context, text string) ([]float32, error) {
+	return mockEmbedding(text), nil
+}
+
+func mockEmbedding(text string) []float32 {
+	vector := make([]float32, mockEmbeddingDimension)
+	add := func(term string) {
+		vector[mockHash(term)%mockEmbeddingDimension]++
+	}
+	var word []rune
+	flush := func() {
+		if len(word) > 0 {
+			add(string(word))
+			word = word[:0]
+		}
+	}
+	var previous rune // Last CJK character, 0 after any other
+	for _, r := range strings.ToLower(text) {
+		switch {
+		case unicode.Is(unicode.Han, r):
+			flush()
+			if previous != 0 {
+				add(string([]rune{previous, r}))
+			}
+			previous = r
+			continue
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			word = append(word, r)
+		default:
+			flush()
+		}
+		previous = 0
+	}
+	flush()
+
+	var norm float64
+	for _, v := range vector {
+		norm += float64(v * v)
+	}
+	if norm == 0 {
+		vector[0] = 1
+		return vector
+	}
+	for i := range vector {
+		vector[i] /= float32(math.Sqrt(norm))
+	}
+	return vector
+}
+
+// MockImageClient is the image provider of IMAGE_PROVIDER=mock. It draws an abstract picture
+// whose colors depend on the prompt, and generates text with the mock LLM.
+type MockImageClient struct {
+	uploadDir string
+}
+
+// NewMockImageClient creates a new mock image client
+func NewMockImageClient(uploadDir string) *MockImageClient {
+	return &MockImageClient{uploadDir: uploadDir}
+}
+
+// GenerateImage draws a 16:9 picture for a prompt and saves it in the user's upload directory
+func (m *MockImageClient) GenerateImage(ctx context.Context, model, prompt string, userID string) (string, error) {
+	if err := ctx.Err(); err != nil {
+		return "", err
+	}
+	golog.Infof("generating mock image...")
+
+	const width, height = 1024, 576
+	hash := mockHash(prompt)
+	shade := func(shift uint32) color.NRGBA {
+		h := hash >> shift
+		return color.NRGBA{R: uint8(h), G: uint8(h >> 8), B: uint8(h >> 16), A: 255}
+	}
+	from, to, accent := shade(0), shade(7), shade(13)
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	cx, cy, radius := width/4+int(hash%uint32(width/2)), height/2, height/4+int(hash%uint32(height/8))
+	for y := range height {
+		for x := range width {
+			t := float64(x+y) / float64(width+height)
+			c := color.NRGBA{
+				R: uint8(float64(from.R)*(1-t) + float64(to.R)*t),
+				G: uint8(float64(from.G)*(1-t) + float64(to.G)*t),
+				B: uint8(float64(from.B)*(1-t) + float64(to.B)*t),
+				A: 255,
+			}
+			if dx, dy := x-cx, y-cy; dx*dx+dy*dy < radius*radius {
+				c = accent
+			}
+			img.SetNRGBA(x, y, c)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return "", fmt.Errorf("failed to encode image: %w", err)
+	}
+	return saveGeneratedImage(m.uploadDir, userID, buf.Bytes())
+}
+
+// GenerateTextWithModel generates text with the mock LLM, whatever the model
+func (m *MockImageClient) GenerateTextWithModel(ctx context.Context, prompt string, model string) (string, error) {
+	return llms.GenerateFromSinglePrompt(ctx, mockLLM{}, prompt)
+}
+
+// GenerateFromSinglePrompt generates text from a single prompt using the specified LLM, or the
+// mock LLM without one
+func (m *MockImageClient) GenerateFromSinglePrompt(ctx context.Context, llm llms.Model, prompt string, options ...llms.CallOption) (string, error) {
+	if llm == nil {
+		llm = mockLLM{}
+	}
+	return llms.GenerateFromSinglePrompt(ctx, llm, prompt, options...)
+}
+
+// GenerateStreamFromSinglePrompt generates text from a single prompt, streaming chunks to onChunk
+func (m *MockImageClient) GenerateStreamFromSinglePrompt(ctx context.Context, llm llms.Model, prompt string, onChunk func(chunk string) error, options ...llms.CallOption) (string, error) {
+	options = append(options, llms.WithStreamingFunc(func(ctx context.Context, chunk []byte) error {
+		return onChunk(string(chunk))
+	}))
+	return m.GenerateFromSinglePrompt(ctx, llm, prompt, options...)
+}
@@ -0,0 +1,123 @@
+package backend
+
+import (
+	"context"
+	"maps"
+	"slices"
+	"strings"
+
+	"github.com/kataras/golog"
+	"github.com/tmc/langchaingo/schema"
+)
+
+// chunkKey identifies a chunk by its source and its number within the source
+type chunkKey struct {
+	sourceID, sourceName string
+	chunk                int
+}
+
+// expandNeighbors widens each retrieved chunk into a passage with up to CHUNK_NEIGHBORS chunks
+// on each side from the same source, so the model doesn't answer from a sentence cut off
+// mid-thought. A chunk already in an earlier passage isn't repeated, and a chunk whose
+// neighbors can't be read is kept as it was retrieved.
+func (a *Agent) expandNeighbors(ctx context.Context, notebookID string, docs []schema.Document) []schema.Document {
+	window := a.cfg.ChunkNeighbors
+	used := make(map[chunkKey]bool)
+	expanded := make([]schema.Document, 0, len(docs))
+	for _, doc := range docs {
+		sourceID, _ := doc.Metadata["source_id"].(string)
+		sourceName, _ := doc.Metadata["source"].(string)
+		chunk, ok := doc.Metadata["chunk"].(int)
+		if !ok {
+			expanded = append(expanded, doc)
+			continue
+		}
+		key := chunkKey{sourceID, sourceName, chunk}
+		if used[key] {
+			continue
+		}
+
+		neighbors, err := a.vectorStore.ChunkRange(ctx, notebookID, sourceID, sourceName, chunk-window, chunk+window)
+		if err != nil {
+			golog.Warnf("failed to read the chunks around chunk %d of %s: %v", chunk, sourceName, err)
+		}
+		numberOf := func(i int) int {
+			n, _ := neighbors[i].Metadata["chunk"].(int)
+			return n
+		}
+		center := slices.IndexFunc(neighbors, func(d schema.Document) bool { return d.Metadata["chunk"] == chunk })
+		if center < 0 {
+			used[key] = true
+			expanded = append(expanded, doc)
+			continue
+		}
+
+		// Keep the unbroken run of chunks around the retrieved one that no earlier passage has
+		first, last := center, center
+		for first > 0 && numberOf(first-1) == numberOf(first)-1 && !used[chunkKey{sourceID, sourceName, numberOf(first - 1)}] {
+			first--
+		}
+		for last < len(neighbors)-1 && numberOf(last+1) == numberOf(last)+1 && !used[chunkKey{sourceID, sourceName, numberOf(last + 1)}] {
+			last++
+		}
+
+		text := neighbors[first].PageContent
+		for i := first; i <= last; i++ {
+			used[chunkKey{sourceID, sourceName, numberOf(i)}] = true
+			if i > first {
+				end, _ := neighbors[i-1].Metadata["end"].(int)
+				text = a.joinChunkText(text, end, neighbors[i])
+			}
+		}
+
+		// The metadata map may be the vector store's own, so it is copied before changing
+		doc.PageContent = text
+		doc.Metadata = maps.Clone(doc.Metadata)
+		doc.Metadata["start"] = neighbors[first].Metadata["start"]
+		doc.Metadata["end"] = neighbors[last].Metadata["end"]
+		if page, ok := neighbors[first].Metadata["first_page"]; ok {
+			doc.Metadata["first_page"] = page
+			doc.Metadata["last_page"] = neighbors[last].Metadata["last_page"]
+		}
+		if startTime, ok := neighbors[first].Metadata["start_time"]; ok {
+			doc.Metadata["start_time"] = startTime
+			doc.Metadata["end_time"] = neighbors[last].Metadata["end_time"]
+		}
+		if chapter, ok := neighbors[first].Metadata["chapter"]; ok {
+			doc.Metadata["chapter"] = chapter
+		}
+		doc.Metadata["neighbors"] = last - first
+		expanded = append(expanded, doc)
+	}
+	return expanded
+}
+
+// joinChunkText appends the next chunk of a source to text that ends at rune offset end of the
+// source. Consecutive chunks overlap by CHUNK_OVERLAP characters or words, which are dropped
+// from the next chunk.
+func (a *Agent) joinChunkText(text string, end int, next schema.Document) string {
+	start, _ := next.Metadata["start"].(int)
+	nextEnd, _ := next.Metadata["end"].(int)
+	if start >= end {
+		return text + "\n" + next.PageContent
+	}
+
+	// Chunks of CJK text hold their part of the source exactly, so the overlap is in runes
+	runes := []rune(next.PageContent)
+	if len(runes) == nextEnd-start {
+		return text + string(runes[min(end-start, len(runes)):])
+	}
+
+	// Other chunks are the source's words joined by spaces; find the words text ends with
+	words := strings.Fields(next.PageContent)
+	tail := strings.Fields(text)
+	for k := min(min(a.cfg.ChunkOverlap, len(words)), len(tail)); k > 0; k-- {
+		if slices.Equal(tail[len(tail)-k:], words[:k]) {
+			if k == len(words) {
+				return text
+			}
+			return text + " " + strings.Join(words[k:], " ")
+		}
+	}
+	return text + " " + next.PageContent
+}
@@ -0,0 +1,253 @@
+package backend
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kataras/golog"
+)
+
+// notebookExportFormat identifies the manifest of a notebook archive, versioned so that an
+// importer can tell archives of later layouts apart
+const notebookExportFormat = "notex-notebook/v1"
+
+// notebookManifest is manifest.json of a notebook archive. Paths are relative to the archive root.
+type notebookManifest struct {
+	Format     string                   `json:"format"`
+	ExportedAt time.Time                `json:"exported_at"`
+	Notebook   *Notebook                `json:"notebook"`
+	Sources    []notebookManifestSource `json:"sources"`
+	Notes      []notebookManifestNote   `json:"notes"`
+	Chats      []notebookManifestChat   `json:"chats"`
+}
+
+type notebookManifestSource struct {
+	ID        string                 `json:"id"`
+	Name      string                 `json:"name"`
+	Type      string                 `json:"type"`
+	URL       string                 `json:"url,omitempty"`
+	FileName  string                 `json:"file_name,omitempty"`
+	FileSize  int64                  `json:"file_size,omitempty"`
+	CreatedAt time.Time              `json:"created_at"`
+	UpdatedAt time.Time              `json:"updated_at"`
+	Metadata  map[string]interface{} `json:"metadata,omitempty"`
+	Private   bool                   `json:"private,omitempty"`
+	Text      string                 `json:"text"`           // Extracted text
+	File      string                 `json:"file,omitempty"` // Original upload, if still on disk
+}
+
+type notebookManifestNote struct {
+	ID        string                 `json:"id"`
+	Title     string                 `json:"title"`
+	Type      string                 `json:"type"`
+	SourceIDs []string               `json:"source_ids"`
+	CreatedAt time.Time              `json:"created_at"`
+	UpdatedAt time.Time              `json:"updated_at"`
+	Metadata  map[string]interface{} `json:"metadata,omitempty"`
+	Private   bool                   `json:"private,omitempty"`
+	File      string                 `json:"file"`
+}
+
+type notebookManifestChat struct {
+	ID        string    `json:"id"`
+	Title     string    `json:"title"`
+	Messages  int       `json:"messages"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+	File      string    `json:"file"`
+}
+
+// archiveName makes a name safe as a file name inside an archive, numbered so that items with
+// the same name don't collide
+func archiveName(index int, name, ext string) string {
+	name = strings.Map(func(r rune) rune {
+		if r < 32 || strings.ContainsRune(`/\:*?"<>|`, r) {
+			return '_'
+		}
+		return r
+	}, strings.TrimSpace(name))
+	if runes := []rune(name); len(runes) > 80 {
+		name = string(runes[:80])
+	}
+	if name == "" {
+		name = "untitled"
+	}
+	return fmt.Sprintf("%03d-%s%s", index+1, name, ext)
+}
+
+// exportMetadata copies item metadata without the fields that only make sense on this server,
+// such as file paths. Imports drop them too, so that an archive can't point a source at a
+// file of the server.
+func exportMetadata(metadata map[string]interface{}) map[string]interface{} {
+	exported := make(map[string]interface{}, len(metadata))
+	for k, v := range metadata {
+		if k != "path" && k != "user_id" {
+			exported[k] = v
+		}
+	}
+	return exported
+}
+
+// handleExportNotebook downloads a notebook as a ZIP archive for backup or migration: each
+// source's extracted text and original file, notes as Markdown, chat sessions as JSON, and a
+// manifest.json describing them
+func (s *Server) handleExportNotebook(c *gin.Context) {
+	ctx := c.Request.Context()
+	notebookID := c.Param("id")
+	if err := s.checkNotebookAccess(ctx, notebookID, c.GetString("user_id")); err != nil {
+		c.JSON(http.StatusForbidden, ErrorResponse{Error: "Access denied"})
+		return
+	}
+
+	notebook, err := s.store.GetNotebook(ctx, notebookID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, ErrorResponse{Error: "Notebook not found"})
+		return
+	}
+	sources, err := s.store.ListSources(ctx, notebookID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to list sources"})
+		return
+	}
+	listed, err := s.store.ListNotes(ctx, notebookID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to list notes"})
+		return
+	}
+	// The listed notes may be shared with the store's cache
+	notes := append([]Note(nil), listed...)
+	for i := range notes {
+		if err := s.store.LoadNoteContent(ctx, &notes[i]); err != nil {
+			c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to load notes"})
+			return
+		}
+	}
+	sessions, err := s.store.ListChatSessions(ctx, notebookID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to list chat sessions"})
+		return
+	}
+	chats := make([]*ChatSession, 0, len(sessions))
+	for i := range sessions {
+		session, err := s.store.GetChatSession(ctx, sessions[i].ID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to load chat session"})
+			return
+		}
+		chats = append(chats, session)
+	}
+
+	name := strings.TrimSpace(notebook.Name)
+	if name == "" {
+		name = "notebook"
+	}
+	c.Header("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": name + ".zip"}))
+	c.Header("Content-Type", "application/zip")
+	c.Status(http.StatusOK)
+
+	// The archive is streamed, so a failure past this point can only cut it short
+	if err := writeNotebookArchive(c.Writer, notebook, sources, notes, chats); err != nil {
+		golog.Errorf("failed to export notebook %s: %v", notebookID, err)
+	}
+}
+
+// writeNotebookArchive writes the ZIP archive of a notebook
+func writeNotebookArchive(w io.Writer, notebook *Notebook, sources []Source, notes []Note, chats []*ChatSession) error {
+	// The notebook may be shared with the store's cache
+	exported := *notebook
+	exported.PublicToken = ""
+
+	zw := zip.NewWriter(w)
+	manifest := notebookManifest{
+		Format:     notebookExportFormat,
+		ExportedAt: time.Now(),
+		Notebook:   &exported,
+		Sources:    make([]notebookManifestSource, 0, len(sources)),
+		Notes:      make([]notebookManifestNote, 0, len(notes)),
+		Chats:      make([]notebookManifestChat, 0, len(chats)),
+	}
+
+	for i := range sources {
+		src := &sources[i]
+		ext := filepath.Ext(src.FileName)
+		base := strings.TrimSuffix(src.Name, ext)
+		entry := notebookManifestSource{
+			ID: src.ID, Name: src.Name, Type: src.Type, URL: src.URL, FileName: src.FileName, FileSize: src.FileSize,
+			CreatedAt: src.CreatedAt, UpdatedAt: src.UpdatedAt, Metadata: exportMetadata(src.Metadata), Private: src.Private,
+			Text: "sources/" + archiveName(i, base, ".txt"),
+		}
+		if err := writeArchiveFile(zw, entry.Text, src.UpdatedAt, strings.NewReader(src.Content)); err != nil {
+			return err
+		}
+		if path, ok := src.Metadata["path"].(string); ok && src.FileName != "" {
+			if file, err := os.Open(path); err == nil {
+				entry.File = "sources/files/" + archiveName(i, base, ext)
+				err = writeArchiveFile(zw, entry.File, src.UpdatedAt, file)
+				file.Close()
+				if err != nil {
+					return err
+				}
+			}
+		}
+		manifest.Sources = append(manifest.Sources, entry)
+	}
+
+	for i := range notes {
+		note := &notes[i]
+		entry := notebookManifestNote{
+			ID: note.ID, Title: note.Title, Type: note.Type, SourceIDs: note.SourceIDs,
+			CreatedAt: note.CreatedAt, UpdatedAt: note.UpdatedAt, Metadata: exportMetadata(note.Metadata), Private: note.Private,
+			File: "notes/" + archiveName(i, note.Title, ".md"),
+		}
+		content := "# " + note.Title + "\n\n" + note.Content + "\n"
+		if err := writeArchiveFile(zw, entry.File, note.UpdatedAt, strings.NewReader(content)); err != nil {
+			return err
+		}
+		manifest.Notes = append(manifest.Notes, entry)
+	}
+
+	for i, chat := range chats {
+		entry := notebookManifestChat{
+			ID: chat.ID, Title: chat.Title, Messages: len(chat.Messages),
+			CreatedAt: chat.CreatedAt, UpdatedAt: chat.UpdatedAt,
+			File: "chats/" + archiveName(i, chat.Title, ".json"),
+		}
+		data, err := json.MarshalIndent(chat, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := writeArchiveFile(zw, entry.File, chat.UpdatedAt, bytes.NewReader(data)); err != nil {
+			return err
+		}
+		manifest.Chats = append(manifest.Chats, entry)
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeArchiveFile(zw, "manifest.json", manifest.ExportedAt, bytes.NewReader(data)); err != nil {
+		return err
+	}
+	return zw.Close()
+}
+
+// writeArchiveFile adds a compressed file to an archive
+func writeArchiveFile(zw *zip.Writer, name string, modified time.Time, r io.Reader) error {
+	w, err := zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: modified})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, r)
+	return err
+}
@@ -0,0 +1,252 @@
+package backend
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/kataras/golog"
+)
+
+// archiveFileMaxSize bounds each file read from an imported archive, so a small archive can't
+// unpack into an unbounded amount of data
+const archiveFileMaxSize = 100 << 20
+
+// readArchiveFile reads a file of an imported archive
+func readArchiveFile(files map[string]*zip.File, name string) ([]byte, error) {
+	f, ok := files[name]
+	if !ok {
+		return nil, fmt.Errorf("%s is missing from the archive", name)
+	}
+	r, err := f.Open()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", name, err)
+	}
+	defer r.Close()
+	data, err := io.ReadAll(io.LimitReader(r, archiveFileMaxSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", name, err)
+	}
+	if len(data) > archiveFileMaxSize {
+		return nil, fmt.Errorf("%s is larger than 100MB", name)
+	}
+	return data, nil
+}
+
+// handleImportNotebook recreates a notebook from an archive made by handleExportNotebook, owned
+// by the importing user. Items get new IDs; the sources are indexed again in the background.
+func (s *Server) handleImportNotebook(c *gin.Context) {
+	ctx := context.Background()
+	userID := c.GetString("user_id")
+
+	fileHeader, err := c.FormFile("file")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "file required"})
+		return
+	}
+	file, err := fileHeader.Open()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to read file"})
+		return
+	}
+	defer file.Close()
+	zr, err := zip.NewReader(file, fileHeader.Size)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Not a ZIP archive", Details: err.Error()})
+		return
+	}
+	files := make(map[string]*zip.File, len(zr.File))
+	for _, f := range zr.File {
+		files[f.Name] = f
+	}
+
+	var manifest notebookManifest
+	data, err := readArchiveFile(files, "manifest.json")
+	if err == nil {
+		err = json.Unmarshal(data, &manifest)
+	}
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid notebook archive", Details: err.Error()})
+		return
+	}
+	if manifest.Format != notebookExportFormat || manifest.Notebook == nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid notebook archive",
+			Details: fmt.Sprintf("unsupported format %q (supported: %s)", manifest.Format, notebookExportFormat)})
+		return
+	}
+
+	name := strings.TrimSpace(c.PostForm("name"))
+	if name == "" {
+		name = manifest.Notebook.Name
+	}
+	notebook, err := s.store.CreateNotebook(ctx, userID, name, manifest.Notebook.Description, manifest.Notebook.Metadata)
+	if err != nil {
+		golog.Errorf("error creating notebook: %v", err)
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: fmt.Sprintf("Failed to create notebook: %v", err)})
+		return
+	}
+
+	result := &NotebookImportResult{Notebook: notebook}
+	sources, written, err := s.importNotebookArchive(ctx, notebook, userID, files, &manifest, result)
+	if err != nil {
+		// Don't leave a half-imported notebook behind
+		for _, saved := range written {
+			os.Remove(saved)
+		}
+		if err := s.store.DeleteNotebook(ctx, notebook.ID); err != nil {
+			golog.Errorf("failed to delete partly imported notebook %s: %v", notebook.ID, err)
+		}
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Failed to import notebook", Details: err.Error()})
+		return
+	}
+
+	for i := range sources {
+		if _, err := s.queueSourceIngest(ctx, &sources[i], userID, "index"); err != nil {
+			golog.Errorf("failed to queue indexing of imported source %s: %v", sources[i].ID, err)
+		}
+	}
+
+	activityLog := &ActivityLog{
+		UserID:       userID,
+		Action:       "import_notebook",
+		ResourceType: "notebook",
+		ResourceID:   notebook.ID,
+		ResourceName: notebook.Name,
+		Details: fmt.Sprintf(`{"sources": %d, "notes": %d, "chats": %d}`,
+			result.Sources, result.Notes, result.Chats),
+		IPAddress: c.ClientIP(),
+		UserAgent: c.GetHeader("User-Agent"),
+	}
+	if err := s.store.LogActivity(ctx, activityLog); err != nil {
+		golog.Errorf("failed to log notebook import activity: %v", err)
+	}
+
+	c.JSON(http.StatusCreated, result)
+}
+
+// importNotebookArchive creates the sources, notes and chat sessions of an archive in a new
+// notebook, and returns the sources created and the upload files written so far, even on
+// failure
+func (s *Server) importNotebookArchive(ctx context.Context, notebook *Notebook, userID string, files map[string]*zip.File, manifest *notebookManifest, result *NotebookImportResult) ([]Source, []string, error) {
+	sources := make([]Source, 0, len(manifest.Sources))
+	var written []string
+	sourceIDs := make(map[string]string, len(manifest.Sources))
+	userUploadDir := filepath.Join(s.cfg.UploadDir, userID)
+
+	for _, entry := range manifest.Sources {
+		content, err := readArchiveFile(files, entry.Text)
+		if err != nil {
+			return sources, written, err
+		}
+		// The server's own metadata, such as where the file is, is never taken from the archive
+		source := Source{
+			NotebookID: notebook.ID,
+			Name:       entry.Name,
+			Type:       entry.Type,
+			URL:        entry.URL,
+			Content:    string(content),
+			Metadata:   exportMetadata(entry.Metadata),
+			Private:    entry.Private,
+		}
+		// A database source's connection isn't exported, so it comes back as its last snapshot
+		if source.Type == "database" {
+			source.Type = "text"
+		}
+
+		if entry.File != "" {
+			data, err := readArchiveFile(files, entry.File)
+			if err != nil {
+				return sources, written, err
+			}
+			ext := path.Ext(entry.File)
+			base := strings.TrimSuffix(path.Base(entry.File), ext)
+			if len(base) > 4 && base[3] == '-' {
+				base = base[4:] // The number archiveName added
+			}
+			uniqueFileName := fmt.Sprintf("%s_%s%s", base, uuid.New().String()[:8], ext)
+			if err := os.MkdirAll(userUploadDir, 0755); err != nil {
+				return sources, written, err
+			}
+			filePath := filepath.Join(userUploadDir, uniqueFileName)
+			if err := os.WriteFile(filePath, data, 0644); err != nil {
+				return sources, written, err
+			}
+			written = append(written, filePath)
+			source.FileName = uniqueFileName
+			source.FileSize = int64(len(data))
+			source.Metadata["path"] = filePath
+			source.Metadata["user_id"] = userID
+		}
+
+		if err := s.store.CreateSource(ctx, &source); err != nil {
+			return sources, written, err
+		}
+		sources = append(sources, source)
+		sourceIDs[entry.ID] = source.ID
+	}
+	result.Sources = len(sources)
+
+	mapSourceIDs := func(ids []string) []string {
+		mapped := make([]string, 0, len(ids))
+		for _, id := range ids {
+			if newID, ok := sourceIDs[id]; ok {
+				mapped = append(mapped, newID)
+			}
+		}
+		return mapped
+	}
+
+	for _, entry := range manifest.Notes {
+		data, err := readArchiveFile(files, entry.File)
+		if err != nil {
+			return sources, written, err
+		}
+		// The export put the title on top of the note's content
+		content := strings.TrimPrefix(string(data), "# "+entry.Title+"\n\n")
+		content = strings.TrimSuffix(content, "\n")
+		note := &Note{
+			NotebookID: notebook.ID,
+			Title:      entry.Title,
+			Content:    content,
+			Type:       entry.Type,
+			SourceIDs:  mapSourceIDs(entry.SourceIDs),
+			Metadata:   entry.Metadata,
+			Private:    entry.Private,
+		}
+		if err := s.store.CreateNote(ctx, note); err != nil {
+			return sources, written, err
+		}
+		result.Notes++
+	}
+
+	for _, entry := range manifest.Chats {
+		data, err := readArchiveFile(files, entry.File)
+		if err != nil {
+			return sources, written, err
+		}
+		var chat ChatSession
+		if err := json.Unmarshal(data, &chat); err != nil {
+			return sources, written, fmt.Errorf("invalid chat session %s: %w", entry.File, err)
+		}
+		session, err := s.store.CreateChatSession(ctx, notebook.ID, entry.Title)
+		if err != nil {
+			return sources, written, err
+		}
+		for _, msg := range chat.Messages {
+			if _, err := s.store.AddChatMessage(ctx, session.ID, msg.Role, msg.Content, mapSourceIDs(msg.Sources), msg.Metadata); err != nil {
+				return sources, written, err
+			}
+		}
+		result.Chats++
+	}
+	return sources, written, nil
+}
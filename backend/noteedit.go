@@ -0,0 +1,244 @@
+package backend
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kataras/golog"
+)
+
+var (
+	// noteEditBlock matches a search/replace block in an editing chat reply
+	noteEditBlock = regexp.MustCompile(`(?s)<{7} ?FIND[ \t]*\r?\n(.*?)\r?\n?={7}[ \t]*\r?\n(.*?)\r?\n?>{7} ?REPLACE[ \t]*`)
+	// noteEditFence matches code fence lines left around the blocks
+	noteEditFence = regexp.MustCompile("(?m)^[ \t]*```[^\n]*\n?")
+)
+
+// parseNoteEdits splits an editing chat reply into its explanation and proposed edits
+func parseNoteEdits(response string) (string, []NoteEdit) {
+	edits := make([]NoteEdit, 0)
+	for _, m := range noteEditBlock.FindAllStringSubmatch(response, -1) {
+		edits = append(edits, NoteEdit{Find: m[1], Replace: m[2]})
+	}
+	explanation := noteEditBlock.ReplaceAllString(response, "")
+	if len(edits) > 0 {
+		explanation = noteEditFence.ReplaceAllString(explanation, "")
+	}
+	return strings.TrimSpace(explanation), edits
+}
+
+// noteEditsOf returns the edits an editing chat message proposed
+func noteEditsOf(msg *ChatMessage) []NoteEdit {
+	raw, ok := msg.Metadata["edits"]
+	if !ok {
+		return nil
+	}
+	data, _ := json.Marshal(raw)
+	var edits []NoteEdit
+	if err := json.Unmarshal(data, &edits); err != nil {
+		return nil
+	}
+	return edits
+}
+
+// applyNoteEdit applies an edit to a note's content. The text it replaces must occur exactly
+// once, so an edit proposed for an older revision of the note never lands in the wrong place.
+func applyNoteEdit(content string, edit NoteEdit) (string, error) {
+	if edit.Find == "" {
+		if strings.TrimSpace(content) == "" {
+			return edit.Replace, nil
+		}
+		return strings.TrimRight(content, "\n") + "\n\n" + edit.Replace, nil
+	}
+	switch strings.Count(content, edit.Find) {
+	case 0:
+		return "", fmt.Errorf("text to replace not found in note")
+	case 1:
+		return strings.Replace(content, edit.Find, edit.Replace, 1), nil
+	default:
+		return "", fmt.Errorf("text to replace occurs more than once in note")
+	}
+}
+
+// getNoteEditSession loads a session of a note's editing chat
+func (s *Server) getNoteEditSession(c *gin.Context, note *Note, sessionID string) (*ChatSession, bool) {
+	session, err := s.store.GetChatSession(c.Request.Context(), sessionID)
+	if err != nil || session.NotebookID != note.NotebookID || session.Metadata["note_id"] != note.ID {
+		c.JSON(http.StatusNotFound, ErrorResponse{Error: "Session not found"})
+		return nil, false
+	}
+	return session, true
+}
+
+// handleNoteEditChat answers a message in a note's editing chat. The reply proposes edits to
+// the note, which are kept with the message until the user applies them.
+func (s *Server) handleNoteEditChat(c *gin.Context) {
+	note, ok := s.getNoteInNotebook(c)
+	if !ok {
+		return
+	}
+	ctx, cancel := requestContext(c)
+	defer cancel()
+
+	var req NoteEditChatRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	var session *ChatSession
+	if req.SessionID != "" {
+		if session, ok = s.getNoteEditSession(c, note, req.SessionID); !ok {
+			return
+		}
+	}
+
+	agent, ok := s.requireAgent(c)
+	if !ok {
+		return
+	}
+	if err := s.loadNotebookVectorIndex(ctx, note.NotebookID); err != nil {
+		golog.Errorf("failed to load vector index: %v", err)
+	}
+
+	var history []ChatMessage
+	if session != nil {
+		history = session.Messages
+	}
+	settings, _ := s.resolveChatSettings(ctx, note.NotebookID, "")
+	proposal, err := agent.ProposeNoteEdits(withUsageScope(ctx, c.GetString("user_id"), note.NotebookID), note, settings, history, req.Message)
+	if err != nil {
+		s.reportGenerationError(c, err)
+		c.JSON(generationErrorStatus(err), ErrorResponse{Error: fmt.Sprintf("Generation failed: %v", err)})
+		return
+	}
+
+	// Drop edits that can't be applied to the note as it is
+	edits := make([]NoteEdit, 0, len(proposal.Edits))
+	for _, edit := range proposal.Edits {
+		if _, err := applyNoteEdit(note.Content, edit); err != nil {
+			golog.Warnf("dropping proposed edit to note %s: %v", note.ID, err)
+			continue
+		}
+		edits = append(edits, edit)
+	}
+	proposal.Edits = edits
+
+	if session == nil {
+		session, err = s.store.CreateNoteEditSession(ctx, note.NotebookID, note.ID, "Edit: "+note.Title)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to create session"})
+			return
+		}
+	}
+	if _, err := s.store.AddChatMessage(ctx, session.ID, "user", req.Message, nil, nil); err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to save message"})
+		return
+	}
+	msg, err := s.store.AddChatMessage(ctx, session.ID, "assistant", proposal.Message, nil, map[string]interface{}{
+		"note_id":   note.ID,
+		"edits":     proposal.Edits,
+		"citations": proposal.Citations,
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to save message"})
+		return
+	}
+
+	proposal.SessionID = session.ID
+	proposal.MessageID = msg.ID
+	c.JSON(http.StatusOK, proposal)
+}
+
+// handleApplyNoteEdits applies the edits an editing chat message proposed, all of them or the
+// ones picked by index. Either all picked edits apply or none do; the replaced revision is kept
+// as a version.
+func (s *Server) handleApplyNoteEdits(c *gin.Context) {
+	note, ok := s.getNoteInNotebook(c)
+	if !ok {
+		return
+	}
+	ctx := c.Request.Context()
+
+	msg, err := s.store.GetChatMessage(ctx, c.Param("messageId"))
+	if err != nil || msg.Role != "assistant" {
+		c.JSON(http.StatusNotFound, ErrorResponse{Error: "Message not found"})
+		return
+	}
+	if _, ok := s.getNoteEditSession(c, note, msg.SessionID); !ok {
+		return
+	}
+	edits := noteEditsOf(msg)
+	if len(edits) == 0 {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "The message proposes no edits"})
+		return
+	}
+	if _, applied := msg.Metadata["applied_edits"]; applied {
+		c.JSON(http.StatusConflict, ErrorResponse{Error: "Edits already applied"})
+		return
+	}
+
+	// The body is optional
+	var req ApplyNoteEditsRequest
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+		return
+	}
+	picked := req.Edits
+	if len(picked) == 0 {
+		for i := range edits {
+			picked = append(picked, i)
+		}
+	}
+	slices.Sort(picked)
+	picked = slices.Compact(picked)
+
+	content := note.Content
+	var failures []string
+	for _, i := range picked {
+		if i < 0 || i >= len(edits) {
+			c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid edit index", Details: fmt.Sprintf("the message proposes %d edits", len(edits))})
+			return
+		}
+		next, err := applyNoteEdit(content, edits[i])
+		if err != nil {
+			failures = append(failures, fmt.Sprintf("edit %d: %v", i, err))
+			continue
+		}
+		content = next
+	}
+	if len(failures) > 0 {
+		c.JSON(http.StatusConflict, ErrorResponse{Error: "Edits no longer apply to the note", Details: strings.Join(failures, "; ")})
+		return
+	}
+	if s.cfg.MaxNoteContentSize > 0 && len(content) > s.cfg.MaxNoteContentSize {
+		c.JSON(http.StatusRequestEntityTooLarge, ErrorResponse{
+			Error: fmt.Sprintf("Note content exceeds the maximum size of %d bytes", s.cfg.MaxNoteContentSize),
+		})
+		return
+	}
+
+	version, err := s.reviseNote(ctx, note, note.Title, content, note.Metadata)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to update note", Details: err.Error()})
+		return
+	}
+
+	msg.Metadata["applied_edits"] = picked
+	if version != nil {
+		msg.Metadata["version"] = version.Version
+	}
+	if err := s.store.SetChatMessageMetadata(ctx, msg.ID, msg.Metadata); err != nil {
+		golog.Errorf("failed to mark edits of message %s applied: %v", msg.ID, err)
+	}
+	s.logNoteChange(c, "chat_edit_note", note, version)
+
+	c.JSON(http.StatusOK, noteUpdateResponse{Note: note, Changed: version != nil, Version: version})
+}
@@ -0,0 +1,208 @@
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kataras/golog"
+)
+
+// noteUpdateResponse is the outcome of an edit or restore of a note
+type noteUpdateResponse struct {
+	Note    *Note        `json:"note"`
+	Changed bool         `json:"changed"`
+	Version *NoteVersion `json:"version,omitempty"` // The replaced revision, nil if nothing changed
+}
+
+// getNoteInNotebook loads the note named in the URL, responding with an error unless it
+// belongs to a notebook the user can access
+func (s *Server) getNoteInNotebook(c *gin.Context) (*Note, bool) {
+	ctx := c.Request.Context()
+	notebookID := c.Param("id")
+	if err := s.checkNotebookAccess(ctx, notebookID, c.GetString("user_id")); err != nil {
+		c.JSON(http.StatusForbidden, ErrorResponse{Error: err.Error()})
+		return nil, false
+	}
+	note, err := s.store.GetNote(ctx, c.Param("noteId"))
+	if err != nil || note.NotebookID != notebookID {
+		c.JSON(http.StatusNotFound, ErrorResponse{Error: "Note not found"})
+		return nil, false
+	}
+	return note, true
+}
+
+// reviseNote replaces a note's title, content and metadata, keeping the current revision as a
+// version and pruning the oldest ones. It returns nil without a change.
+func (s *Server) reviseNote(ctx context.Context, note *Note, title, content string, metadata map[string]interface{}) (*NoteVersion, error) {
+	oldMetadata, _ := json.Marshal(note.Metadata)
+	newMetadata, _ := json.Marshal(metadata)
+	if title == note.Title && content == note.Content && string(oldMetadata) == string(newMetadata) {
+		return nil, nil
+	}
+	version, err := s.store.ReviseNote(ctx, note, title, content, metadata)
+	if err != nil {
+		return nil, err
+	}
+	if s.cfg.NoteVersionLimit > 0 {
+		if err := s.store.PruneNoteVersions(ctx, note.ID, s.cfg.NoteVersionLimit); err != nil {
+			golog.Errorf("failed to prune versions of note %s: %v", note.ID, err)
+		}
+	}
+	return version, nil
+}
+
+// logNoteChange records an edit or restore of a note in the user's activity log
+func (s *Server) logNoteChange(c *gin.Context, action string, note *Note, version *NoteVersion) {
+	versionNumber := 0
+	if version != nil {
+		versionNumber = version.Version
+	}
+	activityLog := &ActivityLog{
+		UserID:       c.GetString("user_id"),
+		Action:       action,
+		ResourceType: "note",
+		ResourceID:   note.ID,
+		ResourceName: note.Title,
+		Details:      fmt.Sprintf(`{"notebook_id": "%s", "note_type": "%s", "changed": %t, "version": %d}`, note.NotebookID, note.Type, version != nil, versionNumber),
+		IPAddress:    c.ClientIP(),
+		UserAgent:    c.GetHeader("User-Agent"),
+	}
+	if err := s.store.LogActivity(c.Request.Context(), activityLog); err != nil {
+		golog.Errorf("failed to log note change activity: %v", err)
+	}
+}
+
+// handleUpdateNote edits a note's title, content or metadata. Omitted fields are kept; metadata
+// keys are merged into the note's metadata, and a null value removes a key. The replaced
+// revision is kept as a version.
+func (s *Server) handleUpdateNote(c *gin.Context) {
+	note, ok := s.getNoteInNotebook(c)
+	if !ok {
+		return
+	}
+
+	var req struct {
+		Title    *string                `json:"title"`
+		Content  *string                `json:"content"`
+		Metadata map[string]interface{} `json:"metadata"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+		return
+	}
+	if req.Title == nil && req.Content == nil && req.Metadata == nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Nothing to update", Details: "set title, content or metadata"})
+		return
+	}
+
+	title := note.Title
+	if req.Title != nil {
+		title = strings.TrimSpace(*req.Title)
+		if title == "" {
+			c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Title must not be empty"})
+			return
+		}
+	}
+	content := note.Content
+	if req.Content != nil {
+		content = *req.Content
+		if s.cfg.MaxNoteContentSize > 0 && len(content) > s.cfg.MaxNoteContentSize {
+			c.JSON(http.StatusRequestEntityTooLarge, ErrorResponse{
+				Error: fmt.Sprintf("Note content exceeds the maximum size of %d bytes", s.cfg.MaxNoteContentSize),
+			})
+			return
+		}
+	}
+	metadata := make(map[string]interface{}, len(note.Metadata)+len(req.Metadata))
+	for k, v := range note.Metadata {
+		metadata[k] = v
+	}
+	for k, v := range req.Metadata {
+		if v == nil {
+			delete(metadata, k)
+		} else {
+			metadata[k] = v
+		}
+	}
+
+	version, err := s.reviseNote(c.Request.Context(), note, title, content, metadata)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to update note", Details: err.Error()})
+		return
+	}
+	s.logNoteChange(c, "edit_note", note, version)
+
+	c.JSON(http.StatusOK, noteUpdateResponse{Note: note, Changed: version != nil, Version: version})
+}
+
+// handleListNoteVersions lists the previous revisions of a note, newest first
+func (s *Server) handleListNoteVersions(c *gin.Context) {
+	note, ok := s.getNoteInNotebook(c)
+	if !ok {
+		return
+	}
+
+	versions, err := s.store.ListNoteVersions(c.Request.Context(), note.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to list note versions"})
+		return
+	}
+
+	c.JSON(http.StatusOK, versions)
+}
+
+// handleGetNoteVersion returns a previous revision of a note with its content
+func (s *Server) handleGetNoteVersion(c *gin.Context) {
+	note, ok := s.getNoteInNotebook(c)
+	if !ok {
+		return
+	}
+
+	number, err := strconv.Atoi(c.Param("version"))
+	if err != nil || number < 1 {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid version"})
+		return
+	}
+	version, err := s.store.GetNoteVersion(c.Request.Context(), note.ID, number)
+	if err != nil {
+		c.JSON(http.StatusNotFound, ErrorResponse{Error: "Note version not found"})
+		return
+	}
+
+	c.JSON(http.StatusOK, version)
+}
+
+// handleRestoreNoteVersion rolls a note back to a previous revision. The revision being
+// replaced is kept as a new version, so a restore can itself be undone.
+func (s *Server) handleRestoreNoteVersion(c *gin.Context) {
+	note, ok := s.getNoteInNotebook(c)
+	if !ok {
+		return
+	}
+
+	number, err := strconv.Atoi(c.Param("version"))
+	if err != nil || number < 1 {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid version"})
+		return
+	}
+	ctx := c.Request.Context()
+	restored, err := s.store.GetNoteVersion(ctx, note.ID, number)
+	if err != nil {
+		c.JSON(http.StatusNotFound, ErrorResponse{Error: "Note version not found"})
+		return
+	}
+
+	version, err := s.reviseNote(ctx, note, restored.Title, restored.Content, restored.Metadata)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to restore note", Details: err.Error()})
+		return
+	}
+	s.logNoteChange(c, "restore_note", note, version)
+
+	c.JSON(http.StatusOK, noteUpdateResponse{Note: note, Changed: version != nil, Version: version})
+}
@@ -0,0 +1,255 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"mime"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/kataras/golog"
+	"github.com/tmc/langchaingo/llms"
+)
+
+// imageExtensions are the uploads read with OCR instead of converted as documents
+var imageExtensions = map[string]bool{
+	".png": true, ".jpg": true, ".jpeg": true, ".webp": true, ".gif": true, ".bmp": true, ".tif": true, ".tiff": true,
+}
+
+// ocrMinPDFText is how much text, not counting whitespace, a converted PDF needs to count as
+// having a text layer. Scanned PDFs convert to nothing but page breaks.
+const ocrMinPDFText = 100
+
+// ocrPDFResolution is the DPI PDF pages are rendered at for OCR
+const ocrPDFResolution = 200
+
+// ocrVisionPrompt asks a vision model for the text of a page
+const ocrVisionPrompt = "Transcribe all the text in this image exactly as written, in reading order and in its original language. " +
+	"Keep headings, lists and tables as Markdown. Reply with the text only, without comments; reply with nothing if there is no text."
+
+// isImage tells by its extension whether a file is an image to read with OCR
+func isImage(path string) bool {
+	return imageExtensions[strings.ToLower(filepath.Ext(path))]
+}
+
+// ocrEngine reads the text of an image file
+type ocrEngine interface {
+	name() string
+	recognize(ctx context.Context, path string) (string, error)
+}
+
+// newOCREngine returns the engine of OCR_PROVIDER, or nil if OCR is off. agent gives the
+// vision engine the current LLM, which setup may replace.
+func newOCREngine(cfg Config, agent func() *Agent) ocrEngine {
+	vision := &visionOCR{agent: agent}
+	switch cfg.OCRProvider {
+	case "tesseract":
+		tesseract := &tesseractOCR{binary: cfg.TesseractBinary, languages: cfg.OCRLanguages}
+		if cfg.OCRVisionFallback {
+			return &fallbackOCR{engines: []ocrEngine{tesseract, vision}}
+		}
+		return tesseract
+	case "vision":
+		return vision
+	case "mock":
+		return mockOCR{}
+	}
+	return nil
+}
+
+// tesseractOCR runs the Tesseract command line tool
+type tesseractOCR struct {
+	binary    string
+	languages string // Tesseract language codes joined by "+", e.g. chi_sim+eng
+}
+
+func (t *tesseractOCR) name() string { return "tesseract" }
+
+func (t *tesseractOCR) recognize(ctx context.Context, path string) (string, error) {
+	args := []string{path, "stdout"}
+	if t.languages != "" {
+		args = append(args, "-l", t.languages)
+	}
+	cmd := exec.CommandContext(ctx, t.binary, args...)
+	var stderr strings.Builder
+	cmd.Stderr = &stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("tesseract failed: %w, output: %s", err, stderr.String())
+	}
+	return string(output), nil
+}
+
+// visionOCR asks the configured LLM, or the model MODEL_ROUTES sends "ocr" to, to read the
+// image. The model must accept images.
+type visionOCR struct {
+	agent func() *Agent
+}
+
+func (v *visionOCR) name() string { return "vision" }
+
+func (v *visionOCR) recognize(ctx context.Context, path string) (string, error) {
+	agent := v.agent()
+	if agent == nil {
+		return "", fmt.Errorf("LLM provider is not configured")
+	}
+	llm, err := agent.llmFor("ocr")
+	if err != nil {
+		return "", err
+	}
+	if llm == nil {
+		// Gemini routes only generate text, so the image goes to the default LLM
+		llm = agent.llm
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	mimeType := mime.TypeByExtension(strings.ToLower(filepath.Ext(path)))
+	if mimeType == "" {
+		mimeType = "image/png"
+	}
+
+	response, err := llm.GenerateContent(withUsageOperation(ctx, "ocr"), []llms.MessageContent{{
+		Role:  llms.ChatMessageTypeHuman,
+		Parts: []llms.ContentPart{llms.BinaryPart(mimeType, data), llms.TextPart(ocrVisionPrompt)},
+	}})
+	if err != nil {
+		return "", fmt.Errorf("vision model failed: %w", err)
+	}
+	if len(response.Choices) == 0 {
+		return "", fmt.Errorf("vision model returned no answer")
+	}
+	return response.Choices[0].Content, nil
+}
+
+// fallbackOCR tries its engines in order until one reads some text
+type fallbackOCR struct {
+	engines []ocrEngine
+}
+
+func (f *fallbackOCR) name() string { return f.engines[0].name() }
+
+func (f *fallbackOCR) recognize(ctx context.Context, path string) (string, error) {
+	var lastErr error
+	for i, engine := range f.engines {
+		text, err := engine.recognize(ctx, path)
+		if err == nil && strings.TrimSpace(text) != "" {
+			return text, nil
+		}
+		if err == nil {
+			err = fmt.Errorf("%s found no text", engine.name())
+		}
+		lastErr = err
+		if i < len(f.engines)-1 {
+			golog.Warnf("OCR with %s failed, trying %s: %v", engine.name(), f.engines[i+1].name(), err)
+		}
+	}
+	return "", lastErr
+}
+
+// mockOCR is the engine of OCR_PROVIDER=mock. It reads a stock sentence naming the file, so
+// that scanned uploads can be tried offline.
+type mockOCR struct{}
+
+func (mockOCR) name() string { return "mock" }
+
+func (mockOCR) recognize(ctx context.Context, path string) (string, error) {
+	return fmt.Sprintf("这是模拟 OCR 从 %s 中识别出的文字。", filepath.Base(path)), nil
+}
+
+// extractDocument converts a document to text like the vector store does, reading images and
+// PDFs without a text layer with OCR when it is configured. ocr tells whether it was used.
+func (s *Server) extractDocument(ctx context.Context, path string) (content string, ocr bool, err error) {
+	if isImage(path) {
+		if s.ocr == nil {
+			return "", false, fmt.Errorf("OCR is not configured, set OCR_PROVIDER")
+		}
+		text, err := s.ocr.recognize(ctx, path)
+		if err != nil {
+			return "", false, err
+		}
+		if strings.TrimSpace(text) == "" {
+			return "", false, fmt.Errorf("no text found in the image")
+		}
+		return strings.TrimSpace(text) + "\n", true, nil
+	}
+
+	isPDF := strings.ToLower(filepath.Ext(path)) == ".pdf"
+	// Without markitdown a PDF would be read as its raw bytes
+	if !isPDF || s.ocr == nil || s.cfg.EnableMarkitdown {
+		content, err = s.vectorStore.ExtractDocument(ctx, path)
+		if !isPDF || s.ocr == nil || (err == nil && hasTextLayer(content)) {
+			return content, false, err
+		}
+	}
+
+	text, ocrErr := s.recognizePDF(ctx, path)
+	if ocrErr != nil {
+		if err == nil && s.cfg.EnableMarkitdown {
+			golog.Warnf("failed to OCR %s, keeping its converted text: %v", filepath.Base(path), ocrErr)
+			return content, false, nil
+		}
+		return "", false, fmt.Errorf("failed to OCR the PDF: %w", ocrErr)
+	}
+	return text, true, nil
+}
+
+// hasTextLayer reports whether a PDF converted to enough text to not be a scan
+func hasTextLayer(content string) bool {
+	count := 0
+	for _, r := range content {
+		if r > ' ' {
+			count++
+			if count >= ocrMinPDFText {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// recognizePDF renders the pages of a PDF with pdftoppm and reads them with OCR, up to
+// OCR_MAX_PAGES pages. Each page starts with a "## 第 N 页" heading.
+func (s *Server) recognizePDF(ctx context.Context, path string) (string, error) {
+	tmpDir, err := os.MkdirTemp("", "ocr-")
+	if err != nil {
+		return "", fmt.Errorf("failed to create temp directory: %w", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	args := []string{"-r", fmt.Sprint(ocrPDFResolution), "-png"}
+	if s.cfg.OCRMaxPages > 0 {
+		args = append(args, "-l", fmt.Sprint(s.cfg.OCRMaxPages))
+	}
+	cmd := exec.CommandContext(ctx, s.cfg.PdftoppmPath, append(args, path, filepath.Join(tmpDir, "page"))...)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return "", fmt.Errorf("failed to render pages: %w, output: %s", err, output)
+	}
+	// pdftoppm pads page numbers to the same width, so the names sort in page order
+	pages, err := filepath.Glob(filepath.Join(tmpDir, "page*.png"))
+	if err != nil || len(pages) == 0 {
+		return "", fmt.Errorf("the PDF has no pages")
+	}
+	sort.Strings(pages)
+
+	var b strings.Builder
+	for i, page := range pages {
+		text, err := s.ocr.recognize(ctx, page)
+		if err != nil {
+			return "", fmt.Errorf("page %d: %w", i+1, err)
+		}
+		if text = strings.TrimSpace(text); text == "" {
+			continue
+		}
+		fmt.Fprintf(&b, "## 第 %d 页\n\n%s\n\n", i+1, text)
+	}
+	if b.Len() == 0 {
+		return "", fmt.Errorf("no text found in the PDF")
+	}
+	golog.Infof("read %d pages of %s with OCR (%s)", len(pages), filepath.Base(path), s.ocr.name())
+	return b.String(), nil
+}
@@ -0,0 +1,824 @@
+package backend
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"math"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// officeMaxPartSize bounds what is read of one part of a Word, PowerPoint or Excel file, so that
+// a crafted archive can't fill memory
+const officeMaxPartSize = 64 << 20
+
+// headingStyleRe matches the names of Word's built-in heading styles. Style IDs are translated
+// in localized Word ("1" for "heading 1" in Chinese), their names are not.
+var headingStyleRe = regexp.MustCompile(`^heading ([1-9])$`)
+
+// openOffice opens an Office Open XML file and returns a reader of its parts
+func openOffice(filePath string) (*zip.ReadCloser, func(name string) ([]byte, error), error) {
+	archive, err := zip.OpenReader(filePath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("invalid Office file: %w", err)
+	}
+	files := make(map[string]*zip.File, len(archive.File))
+	for _, f := range archive.File {
+		files[f.Name] = f
+	}
+	read := func(name string) ([]byte, error) {
+		f, ok := files[name]
+		if !ok {
+			return nil, fmt.Errorf("invalid Office file: %s is missing", name)
+		}
+		r, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		defer r.Close()
+		return io.ReadAll(io.LimitReader(r, officeMaxPartSize))
+	}
+	return archive, read, nil
+}
+
+// officeRelationships maps the relationship IDs of a part to the parts they point at, and the
+// types of the relationships to their first target
+func officeRelationships(read func(string) ([]byte, error), part string) map[string]string {
+	targets := make(map[string]string)
+	data, err := read(path.Join(path.Dir(part), "_rels", path.Base(part)+".rels"))
+	if err != nil {
+		return targets
+	}
+	var rels struct {
+		Items []struct {
+			ID         string `xml:"Id,attr"`
+			Type       string `xml:"Type,attr"`
+			Target     string `xml:"Target,attr"`
+			TargetMode string `xml:"TargetMode,attr"`
+		} `xml:"Relationship"`
+	}
+	if xml.Unmarshal(data, &rels) != nil {
+		return targets
+	}
+	for _, rel := range rels.Items {
+		if rel.TargetMode == "External" {
+			continue
+		}
+		target := epubPath(part, rel.Target)
+		if strings.HasPrefix(rel.Target, "/") {
+			target = strings.TrimPrefix(rel.Target, "/")
+		}
+		targets[rel.ID] = target
+		kind := rel.Type[strings.LastIndex(rel.Type, "/")+1:]
+		if _, ok := targets[kind]; !ok {
+			targets[kind] = target
+		}
+	}
+	return targets
+}
+
+// attr returns the value of an attribute of an element by its local name
+func attr(element xml.StartElement, name string) string {
+	for _, a := range element.Attr {
+		if a.Name.Local == name {
+			return a.Value
+		}
+	}
+	return ""
+}
+
+// markdownCell flattens text into a cell of a Markdown table
+func markdownCell(text string) string {
+	return strings.ReplaceAll(strings.Join(strings.Fields(text), " "), "|", `\|`)
+}
+
+// markdownTable formats rows as a Markdown table, the first row as its header
+func markdownTable(rows [][]string) string {
+	width := 0
+	for _, row := range rows {
+		width = max(width, len(row))
+	}
+	lines := make([]string, 0, len(rows)+1)
+	for i, row := range rows {
+		cells := make([]string, width)
+		copy(cells, row)
+		lines = append(lines, "| "+strings.Join(cells, " | ")+" |")
+		if i == 0 {
+			lines = append(lines, strings.Repeat("| --- ", width)+"|")
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// docxBlock is a paragraph or table of a Word document
+type docxBlock struct {
+	text    string
+	heading int // Heading level, 0 for body text
+	title   bool
+	list    int // Indentation of a list item plus one, 0 for other paragraphs
+	table   [][]string
+}
+
+// extractDOCX converts a Word document to Markdown: headings by their styles, lists and tables.
+// Each heading of the top level used starts a numbered section, "§2 Methods", with
+// epubChapterBreak, so that chunks record the section they are in like the chapters of a book.
+func extractDOCX(filePath string) (string, error) {
+	archive, read, err := openOffice(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer archive.Close()
+
+	data, err := read("word/document.xml")
+	if err != nil {
+		return "", err
+	}
+	styles := docxHeadingStyles(read)
+	blocks, err := docxBlocks(data, styles)
+	if err != nil {
+		return "", err
+	}
+
+	top := 0 // The top heading level used, whose headings start sections
+	for _, block := range blocks {
+		if block.heading > 0 && (top == 0 || block.heading < top) {
+			top = block.heading
+		}
+	}
+	var b strings.Builder
+	section := 0
+	for i, block := range blocks {
+		if block.list > 0 && i > 0 && blocks[i-1].list > 0 {
+			b.WriteString("\n") // The items of a list go on consecutive lines
+		} else {
+			b.WriteString("\n\n")
+		}
+		switch {
+		case block.table != nil:
+			b.WriteString(markdownTable(block.table))
+		case block.heading > 0 && block.heading == top:
+			section++
+			b.WriteString(epubChapterBreak + fmt.Sprintf("§%d %s", section, block.text))
+		case block.heading > 0:
+			// Levels below the top are kept relative to it, as sections are level 1
+			b.WriteString(strings.Repeat("#", min(block.heading-top+1, 6)) + " " + block.text)
+		case block.title:
+			b.WriteString("# " + block.text)
+		case block.list > 0:
+			b.WriteString(strings.Repeat("  ", block.list-1) + "- " + block.text)
+		default:
+			b.WriteString(block.text)
+		}
+	}
+	// The chapter break of a first section starts with a vertical tab, which is whitespace
+	content := strings.TrimRight(strings.TrimLeft(b.String(), "\n"), " \t\n")
+	if content == "" {
+		return "", fmt.Errorf("no text found in the Word document")
+	}
+	return content + "\n", nil
+}
+
+// docxHeadingStyles maps the style IDs of a Word document's heading styles to their levels,
+// 0 for the title style
+func docxHeadingStyles(read func(string) ([]byte, error)) map[string]int {
+	levels := make(map[string]int)
+	data, err := read("word/styles.xml")
+	if err != nil {
+		return levels
+	}
+	var styles struct {
+		Items []struct {
+			ID   string `xml:"styleId,attr"`
+			Name struct {
+				Val string `xml:"val,attr"`
+			} `xml:"name"`
+			OutlineLevel *struct {
+				Val string `xml:"val,attr"`
+			} `xml:"pPr>outlineLvl"`
+		} `xml:"style"`
+	}
+	if xml.Unmarshal(data, &styles) != nil {
+		return levels
+	}
+	for _, style := range styles.Items {
+		name := strings.ToLower(style.Name.Val)
+		if m := headingStyleRe.FindStringSubmatch(name); m != nil {
+			levels[style.ID], _ = strconv.Atoi(m[1])
+		} else if name == "title" {
+			levels[style.ID] = 0
+		} else if style.OutlineLevel != nil {
+			if level, err := strconv.Atoi(style.OutlineLevel.Val); err == nil && level < 9 {
+				levels[style.ID] = level + 1
+			}
+		}
+	}
+	return levels
+}
+
+// docxBlocks reads the paragraphs and tables of a document's body. Text boxes and nested
+// tables are read into the paragraph or cell they are in; deleted revisions are left out.
+func docxBlocks(data []byte, styles map[string]int) ([]docxBlock, error) {
+	d := xml.NewDecoder(bytes.NewReader(data))
+	var blocks []docxBlock
+	var para strings.Builder
+	var block docxBlock
+	paraDepth, tableDepth := 0, 0
+	inText := false
+	var rows [][]string
+	var cell strings.Builder
+
+	for {
+		token, err := d.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid Word document: %w", err)
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			if !strings.Contains(t.Name.Space, "wordprocessingml") {
+				continue
+			}
+			switch t.Name.Local {
+			case "p":
+				paraDepth++
+				if paraDepth == 1 {
+					para.Reset()
+					block = docxBlock{}
+				} else {
+					para.WriteString(" ")
+				}
+			case "pStyle":
+				if paraDepth == 1 {
+					if level, ok := styles[attr(t, "val")]; ok {
+						block.heading, block.title = level, level == 0
+					}
+				}
+			case "outlineLvl":
+				if level, err := strconv.Atoi(attr(t, "val")); paraDepth == 1 && err == nil && level < 9 {
+					block.heading, block.title = level+1, false
+				}
+			case "numPr":
+				if paraDepth == 1 && block.list == 0 {
+					block.list = 1
+				}
+			case "ilvl":
+				if level, err := strconv.Atoi(attr(t, "val")); paraDepth == 1 && err == nil {
+					block.list = level + 1
+				}
+			case "t":
+				inText = true
+			case "tab":
+				if paraDepth > 0 {
+					para.WriteString("\t")
+				}
+			case "br", "cr":
+				if paraDepth > 0 {
+					para.WriteString("\n")
+				}
+			case "tbl":
+				tableDepth++
+				if tableDepth == 1 {
+					rows = nil
+				}
+			case "tr":
+				if tableDepth == 1 {
+					rows = append(rows, nil)
+				}
+			case "tc":
+				if tableDepth == 1 {
+					cell.Reset()
+				}
+			}
+		case xml.EndElement:
+			if !strings.Contains(t.Name.Space, "wordprocessingml") {
+				continue
+			}
+			switch t.Name.Local {
+			case "t":
+				inText = false
+			case "p":
+				paraDepth--
+				if paraDepth > 0 {
+					continue
+				}
+				text := strings.TrimSpace(para.String())
+				if tableDepth > 0 {
+					cell.WriteString(" " + text)
+					continue
+				}
+				if text == "" {
+					continue
+				}
+				if block.heading > 0 || block.title {
+					text = strings.Join(strings.Fields(text), " ")
+				}
+				block.text = text
+				blocks = append(blocks, block)
+			case "tc":
+				if tableDepth == 1 && len(rows) > 0 {
+					rows[len(rows)-1] = append(rows[len(rows)-1], markdownCell(cell.String()))
+				}
+			case "tbl":
+				tableDepth--
+				if tableDepth == 0 && len(rows) > 0 {
+					blocks = append(blocks, docxBlock{table: rows})
+				}
+			}
+		case xml.CharData:
+			if inText && paraDepth > 0 {
+				para.Write(t)
+			}
+		}
+	}
+	return blocks, nil
+}
+
+// pptxShape is the text of a shape of a slide
+type pptxShape struct {
+	placeholder string // Placeholder type, e.g. "title", "body" or "sldNum"
+	paragraphs  []pptxParagraph
+	table       [][]string
+}
+
+// pptxParagraph is a paragraph of a shape, with its list level from 0
+type pptxParagraph struct {
+	text  string
+	level int
+}
+
+// bulleted reports whether the paragraphs of a shape are list items, as in the body
+// placeholders of slide layouts, rather than the text of a text box
+func (s pptxShape) bulleted() bool {
+	return s.placeholder == "body" || s.placeholder == "obj"
+}
+
+// extractPPTX converts a PowerPoint deck to Markdown, a "## 幻灯片 N：Title" heading per slide
+// with its text, tables and speaker notes. Slides are separated by form feeds like the pages
+// of a PDF, so chunks and citations record the slides they are on.
+func extractPPTX(filePath string) (string, error) {
+	archive, read, err := openOffice(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer archive.Close()
+
+	const presentationPath = "ppt/presentation.xml"
+	data, err := read(presentationPath)
+	if err != nil {
+		return "", err
+	}
+	var presentation struct {
+		Slides []struct {
+			RelID string `xml:"http://schemas.openxmlformats.org/officeDocument/2006/relationships id,attr"`
+		} `xml:"sldIdLst>sldId"`
+	}
+	if err := xml.Unmarshal(data, &presentation); err != nil {
+		return "", fmt.Errorf("invalid PowerPoint presentation: %w", err)
+	}
+	rels := officeRelationships(read, presentationPath)
+
+	slides := make([]string, 0, len(presentation.Slides))
+	hasText := false
+	for i, ref := range presentation.Slides {
+		slidePath, ok := rels[ref.RelID]
+		if !ok {
+			continue
+		}
+		data, err := read(slidePath)
+		if err != nil {
+			return "", err
+		}
+		shapes, err := pptxShapes(data)
+		if err != nil {
+			return "", fmt.Errorf("slide %d: %w", i+1, err)
+		}
+
+		var title string
+		var body []string // Paragraphs, lists and tables
+		for _, shape := range shapes {
+			switch {
+			case shape.placeholder == "title" || shape.placeholder == "ctrTitle":
+				for _, p := range shape.paragraphs {
+					if title == "" {
+						title = strings.Join(strings.Fields(p.text), " ")
+					}
+				}
+			case shape.placeholder == "sldNum" || shape.placeholder == "dt" || shape.placeholder == "ftr":
+			case shape.table != nil:
+				body = append(body, markdownTable(shape.table))
+			case shape.bulleted():
+				var items []string
+				for _, p := range shape.paragraphs {
+					items = append(items, strings.Repeat("  ", p.level)+"- "+strings.ReplaceAll(p.text, "\n", " "))
+				}
+				if len(items) > 0 {
+					body = append(body, strings.Join(items, "\n"))
+				}
+			default:
+				for _, p := range shape.paragraphs {
+					body = append(body, p.text)
+				}
+			}
+		}
+
+		// Speaker notes are the body of the slide's notes page
+		var notes []string
+		if notesPath, ok := officeRelationships(read, slidePath)["notesSlide"]; ok {
+			if data, err := read(notesPath); err == nil {
+				if shapes, err := pptxShapes(data); err == nil {
+					for _, shape := range shapes {
+						if shape.placeholder == "body" {
+							for _, p := range shape.paragraphs {
+								notes = append(notes, strings.Split(p.text, "\n")...)
+							}
+						}
+					}
+				}
+			}
+		}
+
+		var b strings.Builder
+		b.WriteString(fmt.Sprintf("## 幻灯片 %d", i+1))
+		if title != "" {
+			b.WriteString("：" + title)
+		}
+		b.WriteString("\n\n")
+		if len(body) > 0 {
+			b.WriteString(strings.Join(body, "\n\n") + "\n\n")
+		}
+		if len(notes) > 0 {
+			b.WriteString("> 演讲者备注：\n")
+			for _, note := range notes {
+				b.WriteString(strings.TrimRight("> "+note, " ") + "\n")
+			}
+		}
+		if title != "" || len(body) > 0 || len(notes) > 0 {
+			hasText = true
+		}
+		slides = append(slides, strings.TrimSpace(b.String())+"\n")
+	}
+	if !hasText {
+		return "", fmt.Errorf("no text found in the PowerPoint presentation")
+	}
+	return strings.Join(slides, "\f\n"), nil
+}
+
+// pptxShapes reads the text of the shapes of a slide or notes page, in document order. The
+// shapes of groups are read one by one, and the cells of a table into rows.
+func pptxShapes(data []byte) ([]pptxShape, error) {
+	d := xml.NewDecoder(bytes.NewReader(data))
+	var shapes []pptxShape
+	var shape *pptxShape
+	var para strings.Builder
+	level := 0
+	inText, inCell := false, false
+	var cell strings.Builder
+
+	for {
+		token, err := d.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid slide: %w", err)
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			switch t.Name.Local {
+			case "sp", "graphicFrame":
+				shapes = append(shapes, pptxShape{})
+				shape = &shapes[len(shapes)-1]
+			case "ph":
+				if shape != nil {
+					shape.placeholder = attr(t, "type")
+					if shape.placeholder == "" {
+						shape.placeholder = "body" // Placeholders without a type hold body text
+					}
+				}
+			case "p":
+				para.Reset()
+				level = 0
+			case "pPr":
+				if l, err := strconv.Atoi(attr(t, "lvl")); err == nil {
+					level = l
+				}
+			case "t":
+				inText = true
+			case "br":
+				para.WriteString("\n")
+			case "tr":
+				if shape != nil {
+					shape.table = append(shape.table, nil)
+				}
+			case "tc":
+				inCell = true
+				cell.Reset()
+			}
+		case xml.EndElement:
+			switch t.Name.Local {
+			case "t":
+				inText = false
+			case "p":
+				if t.Name.Space != "http://schemas.openxmlformats.org/drawingml/2006/main" || shape == nil {
+					continue
+				}
+				text := strings.TrimSpace(para.String())
+				if text == "" {
+					continue
+				}
+				if inCell {
+					cell.WriteString(" " + text)
+					continue
+				}
+				shape.paragraphs = append(shape.paragraphs, pptxParagraph{text: text, level: level})
+			case "tc":
+				inCell = false
+				if shape != nil && len(shape.table) > 0 {
+					row := &shape.table[len(shape.table)-1]
+					*row = append(*row, markdownCell(cell.String()))
+				}
+			case "sp", "graphicFrame":
+				shape = nil
+			}
+		case xml.CharData:
+			if inText {
+				para.Write(t)
+			}
+		}
+	}
+	return shapes, nil
+}
+
+// xlsxDateFormats are the built-in number formats of Excel that show dates and times
+var xlsxDateFormats = map[int]bool{14: true, 15: true, 16: true, 17: true, 18: true, 19: true, 20: true, 21: true, 22: true, 45: true, 46: true, 47: true}
+
+// xlsxFormatLiteralRe matches the quoted text and bracketed colors, locales and conditions of a
+// number format, which don't make it a date
+var xlsxFormatLiteralRe = regexp.MustCompile(`"[^"]*"|\[[^\]]*\]|\\.`)
+
+// extractXLSX converts an Excel workbook to a Markdown table per sheet, under a "## sheet"
+// heading, with the first row of a sheet as its header. Values are read as Excel shows them
+// roughly: shared strings, numbers without float noise, dates as 2006-01-02 and TRUE or FALSE.
+func extractXLSX(filePath string) (string, error) {
+	archive, read, err := openOffice(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer archive.Close()
+
+	const workbookPath = "xl/workbook.xml"
+	data, err := read(workbookPath)
+	if err != nil {
+		return "", err
+	}
+	var workbook struct {
+		Properties struct {
+			Date1904 string `xml:"date1904,attr"`
+		} `xml:"workbookPr"`
+		Sheets []struct {
+			Name  string `xml:"name,attr"`
+			RelID string `xml:"http://schemas.openxmlformats.org/officeDocument/2006/relationships id,attr"`
+		} `xml:"sheets>sheet"`
+	}
+	if err := xml.Unmarshal(data, &workbook); err != nil {
+		return "", fmt.Errorf("invalid Excel workbook: %w", err)
+	}
+	rels := officeRelationships(read, workbookPath)
+	sharedStrings := xlsxSharedStrings(read, rels["sharedStrings"])
+	dateStyles := xlsxDateStyles(read, rels["styles"])
+	epoch := time.Date(1899, 12, 30, 0, 0, 0, 0, time.UTC)
+	if workbook.Properties.Date1904 == "1" || workbook.Properties.Date1904 == "true" {
+		epoch = time.Date(1904, 1, 1, 0, 0, 0, 0, time.UTC)
+	}
+
+	var sheets []string
+	for _, sheet := range workbook.Sheets {
+		sheetPath, ok := rels[sheet.RelID]
+		if !ok {
+			continue
+		}
+		data, err := read(sheetPath)
+		if err != nil {
+			return "", err
+		}
+		rows, err := xlsxRows(data, sharedStrings, dateStyles, epoch)
+		if err != nil {
+			return "", fmt.Errorf("sheet %s: %w", sheet.Name, err)
+		}
+		if len(rows) == 0 {
+			continue
+		}
+		sheets = append(sheets, "## "+sheet.Name+"\n\n"+markdownTable(rows))
+	}
+	if len(sheets) == 0 {
+		return "", fmt.Errorf("no data found in the Excel workbook")
+	}
+	return strings.Join(sheets, "\n\n") + "\n", nil
+}
+
+// xlsxSharedStrings reads the shared strings table of a workbook. Phonetic guides are left out.
+func xlsxSharedStrings(read func(string) ([]byte, error), part string) []string {
+	if part == "" {
+		return nil
+	}
+	data, err := read(part)
+	if err != nil {
+		return nil
+	}
+	d := xml.NewDecoder(bytes.NewReader(data))
+	var values []string
+	var value strings.Builder
+	inText, inPhonetic := false, false
+	for {
+		token, err := d.Token()
+		if err != nil {
+			return values
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			switch t.Name.Local {
+			case "si":
+				value.Reset()
+			case "t":
+				inText = !inPhonetic
+			case "rPh":
+				inPhonetic = true
+			}
+		case xml.EndElement:
+			switch t.Name.Local {
+			case "si":
+				values = append(values, value.String())
+			case "t":
+				inText = false
+			case "rPh":
+				inPhonetic = false
+			}
+		case xml.CharData:
+			if inText {
+				value.Write(t)
+			}
+		}
+	}
+}
+
+// xlsxDateStyles returns the cell styles of a workbook whose number format shows a date or time
+func xlsxDateStyles(read func(string) ([]byte, error), part string) map[int]bool {
+	styles := make(map[int]bool)
+	if part == "" {
+		return styles
+	}
+	data, err := read(part)
+	if err != nil {
+		return styles
+	}
+	var stylesheet struct {
+		NumFmts []struct {
+			ID   int    `xml:"numFmtId,attr"`
+			Code string `xml:"formatCode,attr"`
+		} `xml:"numFmts>numFmt"`
+		CellXfs []struct {
+			NumFmtID int `xml:"numFmtId,attr"`
+		} `xml:"cellXfs>xf"`
+	}
+	if xml.Unmarshal(data, &stylesheet) != nil {
+		return styles
+	}
+	dateFormats := make(map[int]bool)
+	for id := range xlsxDateFormats {
+		dateFormats[id] = true
+	}
+	for _, format := range stylesheet.NumFmts {
+		code := strings.ToLower(xlsxFormatLiteralRe.ReplaceAllString(format.Code, ""))
+		dateFormats[format.ID] = strings.ContainsAny(code, "ydhs")
+	}
+	for i, xf := range stylesheet.CellXfs {
+		if dateFormats[xf.NumFmtID] {
+			styles[i] = true
+		}
+	}
+	return styles
+}
+
+// xlsxRows reads the rows of a worksheet that have values, placing each cell in the column of
+// its reference, and drops the empty columns at their ends
+func xlsxRows(data []byte, sharedStrings []string, dateStyles map[int]bool, epoch time.Time) ([][]string, error) {
+	d := xml.NewDecoder(bytes.NewReader(data))
+	var rows [][]string
+	var row []string
+	var cellType, cellRef string
+	cellStyle := 0
+	var value strings.Builder
+	inValue := false
+	column := 0 // Column of the next cell without a reference
+
+	for {
+		token, err := d.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid worksheet: %w", err)
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			switch t.Name.Local {
+			case "row":
+				row = nil
+				column = 0
+			case "c":
+				cellType, cellRef = attr(t, "t"), attr(t, "r")
+				cellStyle, _ = strconv.Atoi(attr(t, "s"))
+				value.Reset()
+			case "v", "t":
+				inValue = true
+			}
+		case xml.EndElement:
+			switch t.Name.Local {
+			case "v", "t":
+				inValue = false
+			case "c":
+				if ref := xlsxColumn(cellRef); ref >= 0 {
+					column = ref
+				}
+				text := xlsxValue(value.String(), cellType, dateStyles[cellStyle], sharedStrings, epoch)
+				if text != "" {
+					for len(row) <= column {
+						row = append(row, "")
+					}
+					row[column] = markdownCell(text)
+				}
+				column++
+			case "row":
+				if len(row) > 0 {
+					rows = append(rows, row)
+				}
+			}
+		case xml.CharData:
+			if inValue {
+				value.Write(t)
+			}
+		}
+	}
+	return rows, nil
+}
+
+// xlsxColumn returns the column index of a cell reference such as "C7", or -1
+func xlsxColumn(ref string) int {
+	column := 0
+	n := 0
+	for _, r := range ref {
+		if r < 'A' || r > 'Z' {
+			break
+		}
+		column = column*26 + int(r-'A'+1)
+		n++
+	}
+	if n == 0 || n > 3 {
+		return -1
+	}
+	return column - 1
+}
+
+// xlsxValue turns the stored value of a cell into text
+func xlsxValue(raw, cellType string, isDate bool, sharedStrings []string, epoch time.Time) string {
+	switch cellType {
+	case "s":
+		if i, err := strconv.Atoi(raw); err == nil && i >= 0 && i < len(sharedStrings) {
+			return sharedStrings[i]
+		}
+		return ""
+	case "b":
+		if raw == "1" {
+			return "TRUE"
+		}
+		return "FALSE"
+	case "str", "inlineStr", "e":
+		return raw
+	}
+	n, err := strconv.ParseFloat(raw, 64)
+	if err != nil {
+		return raw
+	}
+	if isDate {
+		date := epoch.Add(time.Duration(math.Round(n*86400)) * time.Second)
+		switch {
+		case n < 1:
+			return date.Format("15:04:05")
+		case n == math.Trunc(n):
+			return date.Format("2006-01-02")
+		default:
+			return date.Format("2006-01-02 15:04:05")
+		}
+	}
+	// Excel shows 15 significant digits, which hides the noise of binary fractions
+	n, _ = strconv.ParseFloat(strconv.FormatFloat(n, 'g', 15, 64), 64)
+	return strconv.FormatFloat(n, 'f', -1, 64)
+}
@@ -0,0 +1,181 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/kataras/golog"
+	"github.com/tmc/langchaingo/llms"
+)
+
+// OpenAIImageClient is a client for OpenAI image generation (gpt-image-1, DALL·E). Text is
+// generated by the LLM passed in, as it has no model of its own.
+type OpenAIImageClient struct {
+	apiKey     string
+	baseURL    string
+	httpClient *http.Client
+	uploadDir  string
+}
+
+// NewOpenAIImageClient creates a new OpenAI image client. baseURL defaults to the OpenAI API.
+func NewOpenAIImageClient(apiKey, baseURL string, timeout time.Duration, uploadDir string) *OpenAIImageClient {
+	if baseURL == "" {
+		baseURL = "https://api.openai.com/v1"
+	}
+	return &OpenAIImageClient{
+		apiKey:    apiKey,
+		uploadDir: uploadDir,
+		baseURL:   strings.TrimRight(baseURL, "/") + "/images/generations",
+		httpClient: &http.Client{
+			Timeout: timeout,
+			Transport: &http.Transport{
+				DisableKeepAlives: false,
+				MaxIdleConns:      100,
+				IdleConnTimeout:   5 * time.Minute,
+			},
+		},
+	}
+}
+
+// GenerateImage generates an image using the OpenAI images API
+func (o *OpenAIImageClient) GenerateImage(ctx context.Context, model, prompt string, userID string) (string, error) {
+	if o.apiKey == "" {
+		golog.Errorf("openai_api_key is not set")
+		return "", fmt.Errorf("openai_api_key is not set")
+	}
+
+	// Prepare request payload. gpt-image-1 always returns base64 data, while DALL·E
+	// returns a URL unless asked otherwise, so both are handled below.
+	requestBody := map[string]interface{}{
+		"model":  model,
+		"prompt": prompt,
+		"size":   "1024x1024",
+		"n":      1,
+	}
+	jsonBody, err := json.Marshal(requestBody)
+	if err != nil {
+		return "", fmt.Errorf("failed to marshal request body: %w", err)
+	}
+
+	golog.Infof("generating image with OpenAI model %s...", model)
+
+	// Create request
+	req, err := http.NewRequestWithContext(ctx, "POST", o.baseURL, bytes.NewReader(jsonBody))
+	if err != nil {
+		return "", fmt.Errorf("failed to create request: %w", err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+o.apiKey)
+
+	// Send request
+	resp, err := o.httpClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to send request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	// Read response body
+	var result struct {
+		Created int `json:"created"`
+		Data    []struct {
+			B64JSON string `json:"b64_json"`
+			URL     string `json:"url"`
+		} `json:"data"`
+		Error *struct {
+			Message string `json:"message"`
+			Type    string `json:"type"`
+			Code    string `json:"code"`
+		} `json:"error"`
+	}
+
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return "", fmt.Errorf("failed to decode response (status %d): %w", resp.StatusCode, err)
+	}
+
+	// Check for API error
+	if result.Error != nil {
+		golog.Errorf("OpenAI image API error: %s - %s", result.Error.Type, result.Error.Message)
+		return "", fmt.Errorf("OpenAI image API error (%s): %s", result.Error.Type, result.Error.Message)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("OpenAI image API error, status: %d", resp.StatusCode)
+	}
+
+	if len(result.Data) == 0 || (result.Data[0].B64JSON == "" && result.Data[0].URL == "") {
+		golog.Errorf("no image returned by OpenAI image API")
+		return "", fmt.Errorf("no image in response")
+	}
+
+	var imageData []byte
+	if result.Data[0].B64JSON != "" {
+		imageData, err = base64.StdEncoding.DecodeString(result.Data[0].B64JSON)
+		if err != nil {
+			return "", fmt.Errorf("failed to decode image data: %w", err)
+		}
+	} else {
+		imageData, err = o.download(ctx, result.Data[0].URL)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	golog.Infof("image data received successfully (%d bytes), saving...", len(imageData))
+
+	// Save the image to user-specific directory
+	return saveGeneratedImage(o.uploadDir, userID, imageData)
+}
+
+// download fetches an image returned by URL
+func (o *OpenAIImageClient) download(ctx context.Context, imageURL string) ([]byte, error) {
+	golog.Infof("image URL received: %s, downloading...", imageURL)
+
+	downloadReq, err := http.NewRequestWithContext(ctx, "GET", imageURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create download request: %w", err)
+	}
+
+	downloadResp, err := o.httpClient.Do(downloadReq)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download image: %w", err)
+	}
+	defer downloadResp.Body.Close()
+
+	imageData, err := io.ReadAll(downloadResp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read image data: %w", err)
+	}
+
+	if downloadResp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to download image, status: %d", downloadResp.StatusCode)
+	}
+	return imageData, nil
+}
+
+// GenerateTextWithModel generates text with a Gemini model, which this client can't
+func (o *OpenAIImageClient) GenerateTextWithModel(ctx context.Context, prompt string, model string) (string, error) {
+	return "", fmt.Errorf("OpenAI image client does not support Gemini text generation")
+}
+
+// GenerateFromSinglePrompt generates text from a single prompt using the specified LLM
+func (o *OpenAIImageClient) GenerateFromSinglePrompt(ctx context.Context, llm llms.Model, prompt string, options ...llms.CallOption) (string, error) {
+	if llm == nil {
+		return "", fmt.Errorf("OpenAI image client does not support text generation without an LLM")
+	}
+	return llms.GenerateFromSinglePrompt(ctx, llm, prompt, options...)
+}
+
+// GenerateStreamFromSinglePrompt generates text from a single prompt, streaming chunks to onChunk
+func (o *OpenAIImageClient) GenerateStreamFromSinglePrompt(ctx context.Context, llm llms.Model, prompt string, onChunk func(chunk string) error, options ...llms.CallOption) (string, error) {
+	options = append(options, llms.WithStreamingFunc(func(ctx context.Context, chunk []byte) error {
+		return onChunk(string(chunk))
+	}))
+	return o.GenerateFromSinglePrompt(ctx, llm, prompt, options...)
+}
@@ -0,0 +1,316 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kataras/golog"
+)
+
+const (
+	// overlapShingleSize is the length of the token sequences compared between draft and sources
+	overlapShingleSize = 4
+	// overlapMinTokens skips passages too short for an overlap to mean anything
+	overlapMinTokens = 8
+	// overlapMaxHits bounds how many source positions are kept per shingle; very common phrases
+	// add nothing but cost
+	overlapMaxHits          = 32
+	overlapDefaultThreshold = 0.5
+
+	overlapOpeningQuotes = "\"“「『'‘«"
+	overlapClosingQuotes = "\"”」』'’»"
+)
+
+// overlapToken is a normalized word, or a single CJK character, with its rune offsets in the text
+type overlapToken struct {
+	text       string
+	start, end int
+}
+
+// isCJK reports whether a rune belongs to a script written without spaces between words
+func isCJK(r rune) bool {
+	return unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana)
+}
+
+// overlapTokens splits text into lowercased words and CJK characters. Punctuation and
+// whitespace are dropped, so reformatting a passage doesn't hide a copy.
+func overlapTokens(text string) []overlapToken {
+	var tokens []overlapToken
+	var word []rune
+	wordStart := 0
+	flush := func(end int) {
+		if len(word) > 0 {
+			tokens = append(tokens, overlapToken{text: strings.ToLower(string(word)), start: wordStart, end: end})
+			word = word[:0]
+		}
+	}
+
+	i := 0
+	for _, r := range text {
+		switch {
+		case isCJK(r):
+			flush(i)
+			tokens = append(tokens, overlapToken{text: string(r), start: i, end: i + 1})
+		case unicode.IsLetter(r) || unicode.IsDigit(r):
+			if len(word) == 0 {
+				wordStart = i
+			}
+			word = append(word, r)
+		default:
+			flush(i)
+		}
+		i++
+	}
+	flush(i)
+	return tokens
+}
+
+// shingleKey joins the n tokens starting at i
+func shingleKey(tokens []overlapToken, i int) string {
+	parts := make([]string, overlapShingleSize)
+	for j := range parts {
+		parts[j] = tokens[i+j].text
+	}
+	return strings.Join(parts, " ")
+}
+
+// overlapSentence is a passage of the draft with its rune offsets
+type overlapSentence struct {
+	text       string
+	start, end int
+}
+
+// overlapSentences splits a draft into sentences and lines
+func overlapSentences(text string) []overlapSentence {
+	runes := []rune(text)
+	var sentences []overlapSentence
+	start := 0
+	emit := func(end int) {
+		// Trim surrounding whitespace so offsets point at the sentence itself
+		for start < end && unicode.IsSpace(runes[start]) {
+			start++
+		}
+		trimmed := end
+		for trimmed > start && unicode.IsSpace(runes[trimmed-1]) {
+			trimmed--
+		}
+		if trimmed > start {
+			sentences = append(sentences, overlapSentence{text: string(runes[start:trimmed]), start: start, end: trimmed})
+		}
+		start = end
+	}
+	for i, r := range runes {
+		if i < start || !strings.ContainsRune("\n。！？；!?;.", r) {
+			continue
+		}
+		// Closing quotes after the terminator belong to the sentence
+		end := i + 1
+		for end < len(runes) && strings.ContainsRune(overlapClosingQuotes, runes[end]) {
+			end++
+		}
+		// A period inside a word is a decimal point or an abbreviation
+		if r == '.' && end < len(runes) && !unicode.IsSpace(runes[end]) {
+			continue
+		}
+		emit(end)
+	}
+	emit(len(runes))
+	return sentences
+}
+
+// isQuoted reports whether a passage is wrapped in quotation marks
+func isQuoted(text string) bool {
+	text = strings.TrimRight(text, ".,;:!?。，；：！？ ")
+	runes := []rune(text)
+	if len(runes) < 2 {
+		return false
+	}
+	return strings.ContainsRune(overlapOpeningQuotes, runes[0]) && strings.ContainsRune(overlapClosingQuotes, runes[len(runes)-1])
+}
+
+// overlapIndex maps each shingle of the sources to where it occurs
+type overlapIndex struct {
+	tokens [][]overlapToken
+	hits   map[string][]overlapHit
+}
+
+type overlapHit struct {
+	source, pos int
+}
+
+func newOverlapIndex(sources []Source) *overlapIndex {
+	idx := &overlapIndex{tokens: make([][]overlapToken, len(sources)), hits: make(map[string][]overlapHit)}
+	for s := range sources {
+		tokens := overlapTokens(sources[s].Content)
+		idx.tokens[s] = tokens
+		for i := 0; i+overlapShingleSize <= len(tokens); i++ {
+			key := shingleKey(tokens, i)
+			if len(idx.hits[key]) < overlapMaxHits {
+				idx.hits[key] = append(idx.hits[key], overlapHit{source: s, pos: i})
+			}
+		}
+	}
+	return idx
+}
+
+// match finds the source sharing the most shingles with a passage. It returns the source, the
+// share of the passage's shingles found in it, and the rune span of the matching source passage.
+func (idx *overlapIndex) match(tokens []overlapToken) (source int, similarity float64, start, end int) {
+	shingles := len(tokens) - overlapShingleSize + 1
+	matched := make(map[int]int)
+	positions := make(map[int][]int)
+	for i := 0; i < shingles; i++ {
+		seen := make(map[int]bool)
+		for _, hit := range idx.hits[shingleKey(tokens, i)] {
+			if !seen[hit.source] {
+				seen[hit.source] = true
+				matched[hit.source]++
+			}
+			positions[hit.source] = append(positions[hit.source], hit.pos)
+		}
+	}
+
+	source = -1
+	for s, count := range matched {
+		if source < 0 || count > matched[source] || (count == matched[source] && s < source) {
+			source = s
+		}
+	}
+	if source < 0 {
+		return -1, 0, 0, 0
+	}
+
+	// The source passage is the densest run of matching positions no longer than about
+	// twice the draft passage, which skips stray hits elsewhere in the source
+	pos := positions[source]
+	sort.Ints(pos)
+	window := 2 * len(tokens)
+	first, last, best := pos[0], pos[0], 1
+	for i, j := 0, 0; j < len(pos); j++ {
+		for pos[j]-pos[i] > window {
+			i++
+		}
+		if j-i+1 > best {
+			first, last, best = pos[i], pos[j], j-i+1
+		}
+	}
+	sourceTokens := idx.tokens[source]
+	return source, float64(matched[source]) / float64(shingles), sourceTokens[first].start, sourceTokens[last+overlapShingleSize-1].end
+}
+
+// checkOverlap flags the passages of a draft whose similarity to a source reaches the threshold
+func checkOverlap(draft string, sources []Source, threshold float64) *OverlapReport {
+	report := &OverlapReport{Passages: make([]OverlapPassage, 0)}
+	idx := newOverlapIndex(sources)
+
+	flagged := 0
+	for _, sentence := range overlapSentences(draft) {
+		tokens := overlapTokens(sentence.text)
+		if len(tokens) < overlapMinTokens {
+			continue
+		}
+		s, similarity, start, end := idx.match(tokens)
+		if s < 0 || similarity < threshold {
+			continue
+		}
+		flagged += sentence.end - sentence.start
+		passage := OverlapPassage{
+			Start:      sentence.start,
+			End:        sentence.end,
+			Text:       sentence.text,
+			Similarity: math.Round(similarity*100) / 100,
+			Quoted:     isQuoted(sentence.text),
+			Citation: Citation{
+				Index:      s + 1,
+				SourceID:   sources[s].ID,
+				SourceName: sources[s].Name,
+				Start:      start,
+				End:        end,
+			},
+		}
+		setCitationLocation(sources[s].Content, &passage.Citation)
+		report.Passages = append(report.Passages, passage)
+	}
+
+	if total := len([]rune(draft)); total > 0 {
+		report.Coverage = math.Round(float64(flagged)/float64(total)*100) / 100
+	}
+	return report
+}
+
+// handleCheckOverlap compares a draft note against the notebook's sources and flags
+// near-verbatim passages, so writers can quote or rephrase them
+func (s *Server) handleCheckOverlap(c *gin.Context) {
+	ctx := context.Background()
+	notebookID := c.Param("id")
+	userID := c.GetString("user_id")
+	if err := s.checkNotebookAccess(ctx, notebookID, userID); err != nil {
+		c.JSON(http.StatusForbidden, ErrorResponse{Error: "Access denied"})
+		return
+	}
+
+	var req OverlapCheckRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+		return
+	}
+	if req.Threshold <= 0 || req.Threshold > 1 {
+		req.Threshold = overlapDefaultThreshold
+	}
+
+	draft := req.Content
+	if req.NoteID != "" {
+		note, err := s.store.GetNote(ctx, req.NoteID)
+		if err != nil || note.NotebookID != notebookID {
+			c.JSON(http.StatusNotFound, ErrorResponse{Error: "Note not found"})
+			return
+		}
+		draft = note.Content
+	}
+	if strings.TrimSpace(draft) == "" {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "note_id or content is required"})
+		return
+	}
+
+	sources, err := s.store.ListSources(ctx, notebookID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to get sources"})
+		return
+	}
+	if len(req.SourceIDs) > 0 {
+		selected := make(map[string]bool, len(req.SourceIDs))
+		for _, id := range req.SourceIDs {
+			selected[id] = true
+		}
+		filtered := sources[:0]
+		for _, src := range sources {
+			if selected[src.ID] {
+				filtered = append(filtered, src)
+			}
+		}
+		sources = filtered
+	}
+
+	report := checkOverlap(draft, sources, req.Threshold)
+
+	activityLog := &ActivityLog{
+		UserID:       userID,
+		Action:       "check_overlap",
+		ResourceType: "notebook",
+		ResourceID:   notebookID,
+		Details:      fmt.Sprintf(`{"note_id": "%s", "flagged": %d}`, req.NoteID, len(report.Passages)),
+		IPAddress:    c.ClientIP(),
+		UserAgent:    c.GetHeader("User-Agent"),
+	}
+	if err := s.store.LogActivity(ctx, activityLog); err != nil {
+		golog.Errorf("failed to log overlap check activity: %v", err)
+	}
+
+	c.JSON(http.StatusOK, report)
+}
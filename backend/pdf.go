@@ -0,0 +1,581 @@
+package backend
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"io"
+	"math"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf16"
+
+	"github.com/kataras/golog"
+)
+
+// A4 page size and margin, in points
+const (
+	pdfPageWidth    = 595.28
+	pdfPageHeight   = 841.89
+	pdfMargin       = 56.0
+	pdfContentWidth = pdfPageWidth - 2*pdfMargin
+)
+
+// Fonts of an exported PDF. Chinese text uses STSong-Light through the Adobe-GB1 character
+// collection, which PDF readers supply, so no font has to be embedded.
+const (
+	pdfFontRegular = "F1" // Helvetica
+	pdfFontBold    = "F2" // Helvetica-Bold
+	pdfFontMono    = "F3" // Courier
+	pdfFontCJK     = "F4" // STSong-Light
+)
+
+// Widths of the printable ASCII characters of Helvetica and Helvetica-Bold, in 1/1000 em
+var (
+	pdfHelveticaWidths = [95]int{
+		278, 278, 355, 556, 556, 889, 667, 191, 333, 333, 389, 584, 278, 333, 278, 278,
+		556, 556, 556, 556, 556, 556, 556, 556, 556, 556, 278, 278, 584, 584, 584, 556,
+		1015, 667, 667, 722, 722, 667, 611, 778, 722, 278, 500, 667, 556, 833, 722, 778,
+		667, 778, 722, 667, 611, 722, 667, 944, 667, 667, 611, 278, 278, 278, 469, 556,
+		333, 556, 556, 500, 556, 556, 278, 556, 556, 222, 222, 500, 222, 833, 556, 556,
+		556, 556, 333, 500, 278, 556, 500, 722, 500, 500, 500, 334, 260, 334, 584,
+	}
+	pdfHelveticaBoldWidths = [95]int{
+		278, 333, 474, 556, 556, 889, 722, 238, 333, 333, 389, 584, 278, 333, 278, 278,
+		556, 556, 556, 556, 556, 556, 556, 556, 556, 556, 333, 333, 584, 584, 584, 611,
+		975, 722, 722, 722, 722, 667, 611, 778, 722, 278, 556, 722, 611, 833, 722, 778,
+		667, 778, 722, 667, 611, 722, 667, 944, 667, 667, 611, 333, 278, 333, 584, 556,
+		333, 556, 611, 556, 611, 556, 333, 611, 611, 278, 278, 556, 278, 889, 611, 611,
+		611, 611, 389, 556, 333, 611, 556, 778, 556, 556, 500, 389, 280, 389, 584,
+	}
+)
+
+var (
+	pdfHeading     = regexp.MustCompile(`^(#{1,6})\s+(.*)$`)
+	pdfBullet      = regexp.MustCompile(`^(\s*)[-*+]\s+(.*)$`)
+	pdfNumbered    = regexp.MustCompile(`^(\s*)(\d+[.)])\s+(.*)$`)
+	pdfRule        = regexp.MustCompile(`^\s*([-*_])(\s*[-*_]){2,}\s*$`)
+	pdfTableDivide = regexp.MustCompile(`^\s*\|?(\s*:?-+:?\s*\|)+\s*:?-*:?\s*$`)
+	pdfImageLine   = regexp.MustCompile(`^\s*!\[([^\]]*)\]\(([^)\s]+)[^)]*\)\s*$`)
+	pdfLink        = regexp.MustCompile(`!?\[([^\]]*)\]\([^)]*\)`)
+	pdfEmphasis    = regexp.MustCompile(`(^|[^*\w])[*_]([^*_\s][^*_]*)[*_]`)
+)
+
+// pdfImage is an image XObject of a PDF
+type pdfImage struct {
+	data       []byte
+	filter     string // "DCTDecode" for JPEG, "FlateDecode" for raw samples
+	colorSpace string
+	width      int
+	height     int
+}
+
+// pdfSpan is a run of inline text with one style
+type pdfSpan struct {
+	text string
+	bold bool
+	code bool
+}
+
+// pdfPiece is the smallest unit a line is broken between: a word with its trailing spaces, or
+// a single CJK character
+type pdfPiece struct {
+	font  string
+	text  string
+	width float64
+}
+
+// pdfDocument lays out Markdown on pages
+type pdfDocument struct {
+	pages  []*bytes.Buffer // Content stream of each page
+	images []pdfImage
+	y      float64 // Baseline of the last line of the current page
+	// resolveImage returns the file of an image URL in the note, or "" if it isn't one of ours
+	resolveImage func(url string) string
+}
+
+func newPDFDocument(resolveImage func(url string) string) *pdfDocument {
+	d := &pdfDocument{resolveImage: resolveImage}
+	d.newPage()
+	return d
+}
+
+func (d *pdfDocument) newPage() {
+	d.pages = append(d.pages, &bytes.Buffer{})
+	d.y = pdfPageHeight - pdfMargin
+}
+
+func (d *pdfDocument) page() *bytes.Buffer {
+	return d.pages[len(d.pages)-1]
+}
+
+// space moves down by h points, starting a page if they don't fit on this one
+func (d *pdfDocument) space(h float64) {
+	if d.y-h < pdfMargin {
+		d.newPage()
+	}
+	d.y -= h
+}
+
+// runeFont returns the font a character is set in
+func runeFont(r rune, bold, code bool) string {
+	switch {
+	case r >= 0x80 && r != '•':
+		return pdfFontCJK
+	case code:
+		return pdfFontMono
+	case bold:
+		return pdfFontBold
+	}
+	return pdfFontRegular
+}
+
+// runeWidth returns the width of a character in 1/1000 em
+func runeWidth(font string, r rune) float64 {
+	switch font {
+	case pdfFontCJK:
+		return 1000
+	case pdfFontMono:
+		return 600
+	}
+	if r == '•' {
+		return 350
+	}
+	if r < 32 || r > 126 {
+		return 0
+	}
+	if font == pdfFontBold {
+		return float64(pdfHelveticaBoldWidths[r-32])
+	}
+	return float64(pdfHelveticaWidths[r-32])
+}
+
+// pdfPieces splits spans into the pieces lines are broken between
+func pdfPieces(spans []pdfSpan, size float64) []pdfPiece {
+	var pieces []pdfPiece
+	for _, span := range spans {
+		var word strings.Builder
+		wordFont := ""
+		wordWidth := 0.0
+		flush := func() {
+			if word.Len() > 0 {
+				pieces = append(pieces, pdfPiece{font: wordFont, text: word.String(), width: wordWidth})
+				word.Reset()
+				wordWidth = 0
+			}
+		}
+		for _, r := range span.text {
+			if r == '\t' {
+				r = ' '
+			}
+			// Characters outside the Basic Multilingual Plane, such as emoji, can't be shown
+			if r < 32 || r > 0xFFFF {
+				continue
+			}
+			font := runeFont(r, span.bold, span.code)
+			w := runeWidth(font, r) * size / 1000
+			if font == pdfFontCJK {
+				flush()
+				pieces = append(pieces, pdfPiece{font: font, text: string(r), width: w})
+				continue
+			}
+			if wordFont != font {
+				flush()
+				wordFont = font
+			}
+			word.WriteRune(r)
+			wordWidth += w
+			if r == ' ' {
+				flush()
+			}
+		}
+		flush()
+	}
+	return pieces
+}
+
+// text lays out spans as a paragraph wrapped to the width from indent to the right margin
+func (d *pdfDocument) text(spans []pdfSpan, size, indent float64, gray float64) {
+	d.paragraph(spans, size, indent, gray, "")
+}
+
+// paragraph lays out a paragraph like text, with a list marker hanging left of its first line
+func (d *pdfDocument) paragraph(spans []pdfSpan, size, indent float64, gray float64, marker string) {
+	leading := size * 1.5
+	maxWidth := pdfContentWidth - indent
+	var line []pdfPiece
+	lineWidth := 0.0
+	emit := func() {
+		// Trailing spaces don't count towards the line
+		for len(line) > 0 && strings.TrimSpace(line[len(line)-1].text) == "" {
+			line = line[:len(line)-1]
+		}
+		d.space(leading)
+		if marker != "" {
+			markerPieces := pdfPieces([]pdfSpan{{text: marker}}, size)
+			width := 0.0
+			for _, piece := range markerPieces {
+				width += piece.width
+			}
+			d.line(markerPieces, size, pdfMargin+indent-width-size/2, gray)
+			marker = ""
+		}
+		d.line(line, size, pdfMargin+indent, gray)
+		line, lineWidth = nil, 0
+	}
+	for _, piece := range pdfPieces(spans, size) {
+		if lineWidth+piece.width > maxWidth && len(line) > 0 {
+			emit()
+			if strings.TrimSpace(piece.text) == "" {
+				continue
+			}
+		}
+		if piece.width > maxWidth {
+			// A word wider than the line is broken between its characters
+			for _, r := range piece.text {
+				w := runeWidth(piece.font, r) * size / 1000
+				if lineWidth+w > maxWidth && len(line) > 0 {
+					emit()
+				}
+				line = append(line, pdfPiece{font: piece.font, text: string(r), width: w})
+				lineWidth += w
+			}
+			continue
+		}
+		line = append(line, piece)
+		lineWidth += piece.width
+	}
+	if len(line) > 0 {
+		emit()
+	}
+}
+
+// line draws pieces at the current baseline, one text object per run of a font
+func (d *pdfDocument) line(pieces []pdfPiece, size, x, gray float64) {
+	if len(pieces) == 0 {
+		return
+	}
+	p := d.page()
+	fmt.Fprintf(p, "BT %.2f g ", gray)
+	for i := 0; i < len(pieces); {
+		font := pieces[i].font
+		var run strings.Builder
+		width := 0.0
+		for ; i < len(pieces) && pieces[i].font == font; i++ {
+			run.WriteString(pieces[i].text)
+			width += pieces[i].width
+		}
+		fmt.Fprintf(p, "/%s %.1f Tf 1 0 0 1 %.2f %.2f Tm %s Tj ", font, size, x, d.y, pdfEncodeText(font, run.String()))
+		x += width
+	}
+	p.WriteString("ET\n")
+}
+
+// pdfEncodeText encodes text as a string operand in the encoding of its font: UTF-16BE for
+// the CJK font's UniGB-UCS2-H CMap, WinAnsi for the others
+func pdfEncodeText(font, text string) string {
+	if font == pdfFontCJK {
+		var b strings.Builder
+		b.WriteByte('<')
+		for _, u := range utf16.Encode([]rune(text)) {
+			fmt.Fprintf(&b, "%04X", u)
+		}
+		b.WriteByte('>')
+		return b.String()
+	}
+	var b strings.Builder
+	b.WriteByte('(')
+	for _, r := range text {
+		switch {
+		case r == '(' || r == ')' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r == '•':
+			b.WriteString(`\225`)
+		case r >= 32 && r <= 126:
+			b.WriteRune(r)
+		}
+	}
+	b.WriteByte(')')
+	return b.String()
+}
+
+// rule draws a horizontal line across the page
+func (d *pdfDocument) rule() {
+	d.space(12)
+	fmt.Fprintf(d.page(), "0.8 G 0.5 w %.2f %.2f m %.2f %.2f l S\n", pdfMargin, d.y, pdfPageWidth-pdfMargin, d.y)
+	d.space(6)
+}
+
+// image draws an image file scaled to fit the page width, skipping files that aren't images
+func (d *pdfDocument) image(file string) {
+	img, err := loadPDFImage(file)
+	if err != nil {
+		golog.Warnf("skipping image %s of PDF export: %v", filepath.Base(file), err)
+		return
+	}
+	w, h := float64(img.width), float64(img.height)
+	// One pixel is shown as one point, unless that's larger than the page
+	scale := math.Min(1, math.Min(pdfContentWidth/w, (pdfPageHeight-2*pdfMargin)/h))
+	w, h = w*scale, h*scale
+	d.space(h + 6)
+	d.images = append(d.images, img)
+	fmt.Fprintf(d.page(), "q %.2f 0 0 %.2f %.2f %.2f cm /Im%d Do Q\n", w, h, pdfMargin, d.y, len(d.images))
+	d.space(6)
+}
+
+// loadPDFImage reads an image file as a PDF image: JPEG as is, other formats decoded and
+// flattened onto white
+func loadPDFImage(file string) (pdfImage, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return pdfImage{}, err
+	}
+	if cfg, format, err := image.DecodeConfig(bytes.NewReader(data)); err == nil && format == "jpeg" {
+		switch cfg.ColorModel {
+		case color.YCbCrModel, color.RGBAModel:
+			return pdfImage{data: data, filter: "DCTDecode", colorSpace: "DeviceRGB", width: cfg.Width, height: cfg.Height}, nil
+		case color.GrayModel:
+			return pdfImage{data: data, filter: "DCTDecode", colorSpace: "DeviceGray", width: cfg.Width, height: cfg.Height}, nil
+		}
+	}
+
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return pdfImage{}, err
+	}
+	bounds := src.Bounds()
+	flat := image.NewRGBA(bounds)
+	draw.Draw(flat, bounds, image.White, image.Point{}, draw.Src)
+	draw.Draw(flat, bounds, src, bounds.Min, draw.Over)
+
+	var buf bytes.Buffer
+	zw := zlib.NewWriter(&buf)
+	row := make([]byte, 0, bounds.Dx()*3)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		row = row[:0]
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			offset := flat.PixOffset(x, y)
+			row = append(row, flat.Pix[offset:offset+3]...)
+		}
+		zw.Write(row)
+	}
+	if err := zw.Close(); err != nil {
+		return pdfImage{}, err
+	}
+	return pdfImage{data: buf.Bytes(), filter: "FlateDecode", colorSpace: "DeviceRGB", width: bounds.Dx(), height: bounds.Dy()}, nil
+}
+
+// pdfInline parses the inline Markdown of a line into spans: **bold** and `code`, with links
+// reduced to their text and other emphasis dropped
+func pdfInline(text string, bold bool) []pdfSpan {
+	text = pdfLink.ReplaceAllString(text, "$1")
+	var spans []pdfSpan
+	for i, part := range strings.Split(text, "`") {
+		if i%2 == 1 {
+			spans = append(spans, pdfSpan{text: part, code: true})
+			continue
+		}
+		part = pdfEmphasis.ReplaceAllString(part, "$1$2")
+		part = strings.ReplaceAll(part, "__", "**")
+		for j, chunk := range strings.Split(part, "**") {
+			if chunk != "" {
+				spans = append(spans, pdfSpan{text: chunk, bold: bold != (j%2 == 1)})
+			}
+		}
+	}
+	return spans
+}
+
+// markdown lays out a Markdown document: headings, paragraphs, lists, quotes, code blocks,
+// tables, rules and images
+func (d *pdfDocument) markdown(content string) {
+	var paragraph []string
+	flush := func() {
+		if len(paragraph) > 0 {
+			d.text(pdfInline(strings.Join(paragraph, " "), false), 11, 0, 0)
+			d.space(6)
+			paragraph = nil
+		}
+	}
+	lines := strings.Split(strings.ReplaceAll(content, "\r\n", "\n"), "\n")
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+		trimmed := strings.TrimSpace(line)
+
+		if strings.HasPrefix(trimmed, "```") || strings.HasPrefix(trimmed, "~~~") {
+			flush()
+			fence := trimmed[:3]
+			for i++; i < len(lines) && !strings.HasPrefix(strings.TrimSpace(lines[i]), fence); i++ {
+				code := strings.ReplaceAll(lines[i], "\t", "    ")
+				if code == "" {
+					d.space(13.5)
+					continue
+				}
+				d.text([]pdfSpan{{text: code, code: true}}, 9, 12, 0.2)
+			}
+			d.space(6)
+			continue
+		}
+
+		switch m := pdfHeading.FindStringSubmatch(trimmed); {
+		case trimmed == "":
+			flush()
+		case m != nil:
+			flush()
+			size := []float64{20, 16, 14, 12.5, 11.5, 11}[len(m[1])-1]
+			d.space(size * 0.5)
+			d.text(pdfInline(strings.TrimRight(m[2], " #"), true), size, 0, 0)
+			d.space(4)
+		case pdfRule.MatchString(trimmed):
+			flush()
+			d.rule()
+		case pdfImageLine.MatchString(trimmed):
+			flush()
+			if file := d.resolveImage(pdfImageLine.FindStringSubmatch(trimmed)[2]); file != "" {
+				d.image(file)
+			}
+		case strings.HasPrefix(trimmed, ">"):
+			flush()
+			d.text(pdfInline(strings.TrimSpace(strings.TrimLeft(trimmed, "> ")), false), 11, 16, 0.4)
+		case strings.HasPrefix(trimmed, "|"):
+			flush()
+			header := i+1 < len(lines) && pdfTableDivide.MatchString(lines[i+1])
+			if pdfTableDivide.MatchString(trimmed) {
+				continue
+			}
+			cells := strings.Split(strings.Trim(trimmed, "|"), "|")
+			for j := range cells {
+				cells[j] = strings.TrimSpace(cells[j])
+			}
+			d.text(pdfInline(strings.Join(cells, "  |  "), header), 10, 0, 0)
+		default:
+			if m := pdfBullet.FindStringSubmatch(line); m != nil {
+				flush()
+				d.listItem("•", m[2], len(m[1]))
+			} else if m := pdfNumbered.FindStringSubmatch(line); m != nil {
+				flush()
+				d.listItem(m[2], m[3], len(m[1]))
+			} else {
+				paragraph = append(paragraph, trimmed)
+			}
+		}
+	}
+	flush()
+}
+
+// listItem lays out a list item with its marker hanging in the indent of its nesting level
+func (d *pdfDocument) listItem(marker, text string, leadingSpaces int) {
+	indent := 14 + float64(min(leadingSpaces/2, 4))*14
+	d.paragraph(pdfInline(text, false), 11, indent, 0, marker)
+}
+
+// writePDF writes the laid out document, with a title in its metadata
+func (d *pdfDocument) writePDF(w io.Writer, title string) error {
+	var buf bytes.Buffer
+	var offsets []int
+	obj := func(body string) {
+		offsets = append(offsets, buf.Len())
+		fmt.Fprintf(&buf, "%d 0 obj\n%s\nendobj\n", len(offsets), body)
+	}
+	stream := func(dict string, data []byte) {
+		offsets = append(offsets, buf.Len())
+		fmt.Fprintf(&buf, "%d 0 obj\n<< %s /Length %d >>\nstream\n", len(offsets), dict, len(data))
+		buf.Write(data)
+		buf.WriteString("\nendstream\nendobj\n")
+	}
+
+	// 1 catalog, 2 page tree, 3-8 fonts, 9 info, then images, then each page's contents and page
+	imageBase := 10
+	pageBase := imageBase + len(d.images)
+	kids := make([]string, len(d.pages))
+	for i := range d.pages {
+		kids[i] = fmt.Sprintf("%d 0 R", pageBase+2*i+1)
+	}
+	xobjects := make([]string, len(d.images))
+	for i := range d.images {
+		xobjects[i] = fmt.Sprintf("/Im%d %d 0 R", i+1, imageBase+i)
+	}
+
+	buf.WriteString("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n")
+	obj("<< /Type /Catalog /Pages 2 0 R >>")
+	obj(fmt.Sprintf("<< /Type /Pages /Kids [%s] /Count %d >>", strings.Join(kids, " "), len(d.pages)))
+	obj("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica /Encoding /WinAnsiEncoding >>")
+	obj("<< /Type /Font /Subtype /Type1 /BaseFont /Helvetica-Bold /Encoding /WinAnsiEncoding >>")
+	obj("<< /Type /Font /Subtype /Type1 /BaseFont /Courier /Encoding /WinAnsiEncoding >>")
+	obj("<< /Type /Font /Subtype /Type0 /BaseFont /STSong-Light /Encoding /UniGB-UCS2-H /DescendantFonts [7 0 R] >>")
+	obj("<< /Type /Font /Subtype /CIDFontType0 /BaseFont /STSong-Light /CIDSystemInfo << /Registry (Adobe) /Ordering (GB1) /Supplement 2 >> /FontDescriptor 8 0 R /DW 1000 >>")
+	obj("<< /Type /FontDescriptor /FontName /STSong-Light /Flags 6 /FontBBox [-25 -254 1000 880] /ItalicAngle 0 /Ascent 880 /Descent -120 /CapHeight 880 /StemV 93 >>")
+	obj(fmt.Sprintf("<< /Title %s /Producer (Notex) /CreationDate (D:%s) >>", pdfEncodeText(pdfFontCJK, "\ufeff"+title), time.Now().UTC().Format("20060102150405Z")))
+	for _, img := range d.images {
+		stream(fmt.Sprintf("/Type /XObject /Subtype /Image /Width %d /Height %d /ColorSpace /%s /BitsPerComponent 8 /Filter /%s",
+			img.width, img.height, img.colorSpace, img.filter), img.data)
+	}
+	resources := fmt.Sprintf("<< /Font << /F1 3 0 R /F2 4 0 R /F3 5 0 R /F4 6 0 R >> /XObject << %s >> >>", strings.Join(xobjects, " "))
+	for i, page := range d.pages {
+		var compressed bytes.Buffer
+		zw := zlib.NewWriter(&compressed)
+		zw.Write(page.Bytes())
+		if err := zw.Close(); err != nil {
+			return err
+		}
+		stream("/Filter /FlateDecode", compressed.Bytes())
+		obj(fmt.Sprintf("<< /Type /Page /Parent 2 0 R /MediaBox [0 0 %.2f %.2f] /Resources %s /Contents %d 0 R >>",
+			pdfPageWidth, pdfPageHeight, resources, pageBase+2*i))
+	}
+
+	xref := buf.Len()
+	fmt.Fprintf(&buf, "xref\n0 %d\n0000000000 65535 f \n", len(offsets)+1)
+	for _, offset := range offsets {
+		fmt.Fprintf(&buf, "%010d 00000 n \n", offset)
+	}
+	fmt.Fprintf(&buf, "trailer\n<< /Size %d /Root 1 0 R /Info 9 0 R >>\nstartxref\n%d\n%%%%EOF\n", len(offsets)+1, xref)
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// notePDF renders a note as a PDF: its title, its generated infographic or slide images, and
+// its content, which the images replace as the frontend shows them
+func (s *Server) notePDF(w io.Writer, note *Note, ownerID string) error {
+	userDir := filepath.Join(s.cfg.UploadDir, ownerID)
+	// Images of a note are served from /api/files/<name>, from the owner's upload directory
+	resolve := func(url string) string {
+		if strings.Contains(url, "://") && !strings.Contains(url, "/api/files/") {
+			return ""
+		}
+		name := path.Base(strings.SplitN(url, "?", 2)[0])
+		if name == "." || name == "/" {
+			return ""
+		}
+		return filepath.Join(userDir, name)
+	}
+
+	d := newPDFDocument(resolve)
+	title := strings.TrimSpace(note.Title)
+	if title != "" {
+		d.text(pdfInline(title, true), 20, 0, 0)
+		d.text([]pdfSpan{{text: note.UpdatedAt.Format("2006-01-02 15:04")}}, 9, 0, 0.5)
+		d.space(12)
+	}
+
+	images := metadataStrings(note.Metadata["slides"])
+	if url, ok := note.Metadata["image_url"].(string); ok && url != "" {
+		images = append([]string{url}, images...)
+	}
+	for _, url := range images {
+		if file := resolve(url); file != "" {
+			d.image(file)
+		}
+	}
+	if len(images) == 0 || note.Type != "infograph" && note.Type != "ppt" {
+		d.markdown(note.Content)
+	}
+	return d.writePDF(w, title)
+}
@@ -0,0 +1,438 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kataras/golog"
+)
+
+// podcastSampleRate is the sample rate of synthesized speech, which is 16-bit mono PCM as the
+// OpenAI speech API returns with the pcm format
+const podcastSampleRate = 24000
+
+// podcastSegmentLimit is the most characters sent to the speech API at once, which accepts 4096
+const podcastSegmentLimit = 2000
+
+// podcastSpeechWorkers is how many segments of a podcast are synthesized at once
+const podcastSpeechWorkers = 4
+
+// podcastBuiltinVoices are the OpenAI voices handed out after PODCAST_VOICE when PODCAST_VOICES
+// names none
+var podcastBuiltinVoices = []string{"alloy", "onyx", "nova", "echo", "shimmer", "fable"}
+
+// podcastStageDirection matches the [bracketed] stage directions of a script
+var podcastStageDirection = regexp.MustCompile(`\[[^\]]*\]|【[^】]*】`)
+
+// podcastTurn is what one speaker says before the next one takes over
+type podcastTurn struct {
+	Speaker string
+	Text    string
+}
+
+// parsePodcastTurns reads the turns of a podcast script, whose lines start with a speaker
+// label such as "主持人1：" or "**Host A**:". Lines without a label continue the current turn.
+// Headings, stage directions and markdown emphasis are not read aloud.
+func parsePodcastTurns(script string) []podcastTurn {
+	var turns []podcastTurn
+	for _, line := range strings.Split(script, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") || strings.Trim(line, "-*_ ") == "" {
+			continue
+		}
+		line = strings.TrimSpace(strings.TrimLeft(line, "->"))
+
+		speaker, text, ok := podcastSpeakerLine(line)
+		if !ok {
+			if len(turns) == 0 {
+				continue
+			}
+			text = line
+		}
+		text = podcastStageDirection.ReplaceAllString(text, "")
+		text = strings.TrimSpace(strings.NewReplacer("**", "", "__", "", "`", "").Replace(text))
+		switch {
+		case ok && (len(turns) == 0 || turns[len(turns)-1].Speaker != speaker):
+			turns = append(turns, podcastTurn{Speaker: speaker, Text: text})
+		case text != "":
+			last := &turns[len(turns)-1]
+			last.Text = strings.TrimSpace(last.Text + "\n" + text)
+		}
+	}
+	return slices.DeleteFunc(turns, func(t podcastTurn) bool { return t.Text == "" })
+}
+
+// podcastSpeakerLine splits a line into its speaker label and text. A label is a short name
+// before the first colon without sentence punctuation, so a sentence with a colon in it
+// continues the current turn.
+func podcastSpeakerLine(line string) (string, string, bool) {
+	i := strings.IndexAny(line, ":：")
+	if i <= 0 {
+		return "", "", false
+	}
+	_, size := utf8.DecodeRuneInString(line[i:])
+	label := strings.TrimSpace(strings.Trim(line[:i], "*_[]【】 "))
+	if label == "" || utf8.RuneCountInString(label) > 20 || strings.ContainsAny(label, "，。！？,.!?;；\"“”") {
+		return "", "", false
+	}
+	return label, strings.TrimLeft(line[i+size:], "*_ "), true
+}
+
+// podcastVoices assigns a voice to each speaker, in order of first appearance. Items of
+// PODCAST_VOICES and the overrides of the form speaker=voice pin a speaker's voice; the others
+// are handed out in order, skipping voices taken while unused ones remain. Without any,
+// PODCAST_VOICE goes first, followed by the built-in voices.
+func podcastVoices(cfg Config, turns []podcastTurn, overrides map[string]string) map[string]string {
+	voices := make(map[string]string)
+	var pool []string
+	for _, item := range cfg.PodcastVoices {
+		if speaker, voice, ok := strings.Cut(item, "="); ok {
+			voices[strings.TrimSpace(speaker)] = strings.TrimSpace(voice)
+		} else {
+			pool = append(pool, item)
+		}
+	}
+	for speaker, voice := range overrides {
+		if voice = strings.TrimSpace(voice); voice != "" {
+			voices[speaker] = voice
+		}
+	}
+	if len(pool) == 0 {
+		pool = append([]string{cfg.PodcastVoice}, podcastBuiltinVoices...)
+	}
+
+	assigned := make(map[string]string)
+	taken := make(map[string]bool)
+	for _, turn := range turns {
+		if voice, ok := voices[turn.Speaker]; ok {
+			assigned[turn.Speaker] = voice
+			taken[voice] = true
+		}
+	}
+	next := 0
+	for _, turn := range turns {
+		if _, ok := assigned[turn.Speaker]; ok {
+			continue
+		}
+		voice := pool[next%len(pool)]
+		for i := range pool {
+			if candidate := pool[(next+i)%len(pool)]; !taken[candidate] {
+				voice, next = candidate, next+i
+				break
+			}
+		}
+		next++
+		assigned[turn.Speaker] = voice
+		taken[voice] = true
+	}
+	return assigned
+}
+
+// podcastSegments splits a turn into pieces the speech API accepts, at sentence ends where
+// possible
+func podcastSegments(text string) []string {
+	var segments []string
+	for utf8.RuneCountInString(text) > podcastSegmentLimit {
+		runes := []rune(text)
+		cut := podcastSegmentLimit
+		for i := podcastSegmentLimit - 1; i > podcastSegmentLimit/2; i-- {
+			if strings.ContainsRune("。！？.!?\n", runes[i]) {
+				cut = i + 1
+				break
+			}
+		}
+		segments = append(segments, strings.TrimSpace(string(runes[:cut])))
+		text = strings.TrimSpace(string(runes[cut:]))
+	}
+	if text != "" {
+		segments = append(segments, text)
+	}
+	return segments
+}
+
+// speechSynthesizer reads a text aloud in a voice, returning 16-bit mono PCM at
+// podcastSampleRate
+type speechSynthesizer interface {
+	synthesize(ctx context.Context, voice, text string) ([]byte, error)
+}
+
+// newSpeechSynthesizer creates the synthesizer configured by PODCAST_TTS_PROVIDER, or nil if
+// podcasts stay scripts
+func newSpeechSynthesizer(cfg Config) speechSynthesizer {
+	switch cfg.PodcastTTSProvider {
+	case "openai":
+		return &openAISpeech{
+			url:    strings.TrimRight(firstNonEmpty(cfg.OpenAIImageBaseURL(), "https://api.openai.com/v1"), "/") + "/audio/speech",
+			apiKey: cfg.OpenAIAPIKey,
+			model:  cfg.PodcastTTSModel,
+			client: &http.Client{Timeout: cfg.TransformationTimeout},
+		}
+	case "mock":
+		return mockSpeech{}
+	}
+	return nil
+}
+
+// speechRoute names the model of a synthesizer in usage records
+func speechRoute(cfg Config) ModelRoute {
+	if cfg.PodcastTTSProvider == "mock" {
+		return ModelRoute{Provider: "mock", Model: "mock"}
+	}
+	return ModelRoute{Provider: cfg.PodcastTTSProvider, Model: cfg.PodcastTTSModel}
+}
+
+// openAISpeech calls the OpenAI speech API, or a server compatible with it
+type openAISpeech struct {
+	url    string
+	apiKey string
+	model  string
+	client *http.Client
+}
+
+func (o *openAISpeech) synthesize(ctx context.Context, voice, text string) ([]byte, error) {
+	body, err := json.Marshal(map[string]any{
+		"model":           o.model,
+		"voice":           voice,
+		"input":           text,
+		"response_format": "pcm",
+	})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, o.url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+o.apiKey)
+
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send speech request: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return nil, fmt.Errorf("OpenAI speech API error, status %d: %s", resp.StatusCode, message)
+	}
+	pcm, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read speech: %w", err)
+	}
+	return pcm[:len(pcm)/2*2], nil
+}
+
+// mockSpeech is the synthesizer of PODCAST_TTS_PROVIDER=mock. It hums a tone per voice, a
+// syllable per character of the text, so the audio of the same script is always the same.
+type mockSpeech struct{}
+
+func (mockSpeech) synthesize(ctx context.Context, voice, text string) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	const syllable = podcastSampleRate / 10
+	pitch := 140 + float64(mockHash(voice)%160)
+	syllables := min(utf8.RuneCountInString(text), 600)
+	pcm := make([]byte, syllables*syllable*2)
+	for i := range syllables * syllable {
+		t := float64(i) / podcastSampleRate
+		envelope := math.Sin(math.Pi * float64(i%syllable) / syllable)
+		sample := int16(6000 * envelope * math.Sin(2*math.Pi*pitch*t))
+		binary.LittleEndian.PutUint16(pcm[2*i:], uint16(sample))
+	}
+	return pcm, nil
+}
+
+// PodcastAudio is a podcast script read aloud
+type PodcastAudio struct {
+	WAV      []byte
+	Duration time.Duration
+	Voices   map[string]string // The voice of each speaker
+}
+
+// SynthesizePodcast reads a podcast script aloud, each speaker in their own voice, with
+// PODCAST_PAUSE of silence between turns. overrides pins the voices of some speakers.
+func (a *Agent) SynthesizePodcast(ctx context.Context, script string, overrides map[string]string) (*PodcastAudio, error) {
+	if a.speech == nil {
+		return nil, fmt.Errorf("podcast audio is not configured, set PODCAST_TTS_PROVIDER")
+	}
+	turns := parsePodcastTurns(script)
+	if len(turns) == 0 {
+		return nil, fmt.Errorf("no speaker turns found in the script")
+	}
+	voices := podcastVoices(a.cfg, turns, overrides)
+
+	type segment struct {
+		turn       int
+		voice      string
+		text       string
+		pcm        []byte
+		err        error
+		continuing bool // Not the first segment of its turn
+	}
+	var segments []*segment
+	for i, turn := range turns {
+		for j, text := range podcastSegments(turn.Text) {
+			segments = append(segments, &segment{turn: i, voice: voices[turn.Speaker], text: text, continuing: j > 0})
+		}
+	}
+
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for range min(podcastSpeechWorkers, len(segments)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				seg := segments[i]
+				seg.pcm, seg.err = a.speech.synthesize(ctx, seg.voice, seg.text)
+				if seg.err == nil {
+					// Speech models bill the input text; its tokens are estimated
+					a.usage.record(ctx, speechRoute(a.cfg), (len(seg.text)+3)/4, 0, 0)
+				}
+			}
+		}()
+	}
+	for i := range segments {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+
+	pause := make([]byte, int(a.cfg.PodcastPause.Seconds()*podcastSampleRate)*2)
+	var pcm bytes.Buffer
+	for i, seg := range segments {
+		if seg.err != nil {
+			return nil, fmt.Errorf("failed to synthesize turn %d (%s): %w", seg.turn+1, turns[seg.turn].Speaker, seg.err)
+		}
+		if i > 0 && !seg.continuing {
+			pcm.Write(pause)
+		}
+		pcm.Write(seg.pcm)
+	}
+
+	return &PodcastAudio{
+		WAV:      wavFile(pcm.Bytes()),
+		Duration: time.Duration(pcm.Len()/2) * time.Second / podcastSampleRate,
+		Voices:   voices,
+	}, nil
+}
+
+// wavFile wraps 16-bit mono PCM at podcastSampleRate in a WAV header
+func wavFile(pcm []byte) []byte {
+	var b bytes.Buffer
+	header := []any{
+		[4]byte{'R', 'I', 'F', 'F'}, uint32(36 + len(pcm)), [4]byte{'W', 'A', 'V', 'E'},
+		[4]byte{'f', 'm', 't', ' '}, uint32(16), uint16(1), uint16(1),
+		uint32(podcastSampleRate), uint32(podcastSampleRate * 2), uint16(2), uint16(16),
+		[4]byte{'d', 'a', 't', 'a'}, uint32(len(pcm)),
+	}
+	for _, field := range header {
+		binary.Write(&b, binary.LittleEndian, field)
+	}
+	b.Write(pcm)
+	return b.Bytes()
+}
+
+// voicePodcast reads a podcast script aloud and saves the audio in the user's upload
+// directory, returning the note metadata describing it
+func (s *Server) voicePodcast(ctx context.Context, agent *Agent, script, userID string, overrides map[string]string) (map[string]interface{}, error) {
+	audio, err := agent.SynthesizePodcast(withUsageOperation(ctx, "podcast_audio"), script, overrides)
+	if err != nil {
+		return nil, err
+	}
+	dir := filepath.Join(s.cfg.UploadDir, userID)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create upload directory: %w", err)
+	}
+	fileName := fmt.Sprintf("podcast_%d.wav", time.Now().UnixNano())
+	if err := os.WriteFile(filepath.Join(dir, fileName), audio.WAV, 0644); err != nil {
+		return nil, fmt.Errorf("failed to save podcast audio: %w", err)
+	}
+	golog.Infof("podcast audio saved to %s (%s, %d speakers)", fileName, audio.Duration.Round(time.Second), len(audio.Voices))
+	return map[string]interface{}{
+		"audio_url":          "/api/files/" + fileName,
+		"audio_duration":     int(audio.Duration.Round(time.Second).Seconds()),
+		"speaker_voices":     audio.Voices,
+		"audio_generated_by": speechRoute(s.cfg).String(),
+	}, nil
+}
+
+// PodcastAudioRequest picks the voices of some speakers when a podcast is read aloud again
+type PodcastAudioRequest struct {
+	Voices map[string]string `json:"voices,omitempty"` // Voice by speaker label
+}
+
+// handleGeneratePodcastAudio reads a podcast note aloud, replacing its previous audio. The
+// script is read as it is now, so edits to it are heard.
+func (s *Server) handleGeneratePodcastAudio(c *gin.Context) {
+	ctx, cancel := requestContext(c)
+	defer cancel()
+	note, ok := s.getNoteInNotebook(c)
+	if !ok {
+		return
+	}
+	if note.Type != "podcast" {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Only podcast notes can be read aloud"})
+		return
+	}
+	var req PodcastAudioRequest
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+			return
+		}
+	}
+
+	agent, ok := s.requireAgent(c)
+	if !ok {
+		return
+	}
+	if agent.speech == nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Podcast audio is not configured", Details: "set PODCAST_TTS_PROVIDER to openai or mock"})
+		return
+	}
+	userID := c.GetString("user_id")
+	audio, err := s.voicePodcast(withUsageScope(ctx, userID, note.NotebookID), agent, note.Content, userID, req.Voices)
+	if err != nil {
+		s.reportGenerationError(c, err)
+		c.JSON(generationErrorStatus(err), ErrorResponse{Error: fmt.Sprintf("Audio generation failed: %v", err)})
+		return
+	}
+
+	metadata := make(map[string]interface{}, len(note.Metadata)+len(audio))
+	for k, v := range note.Metadata {
+		metadata[k] = v
+	}
+	delete(metadata, "audio_error")
+	for k, v := range audio {
+		metadata[k] = v
+	}
+	version, err := s.reviseNote(ctx, note, note.Title, note.Content, metadata)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to update note"})
+		return
+	}
+	updated, err := s.store.GetNote(ctx, note.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to load note"})
+		return
+	}
+	s.logNoteChange(c, "podcast_audio", updated, version)
+	c.JSON(http.StatusOK, noteUpdateResponse{Note: updated, Changed: version != nil, Version: version})
+}
@@ -0,0 +1,389 @@
+package backend
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"image"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"io"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kataras/golog"
+)
+
+// Sizes of a 16:9 deck and its notes pages, in EMUs (914400 per inch)
+const (
+	pptxSlideWidth  = 12192000
+	pptxSlideHeight = 6858000
+	pptxNotesWidth  = 6858000
+	pptxNotesHeight = 9144000
+	pptxMargin      = 457200
+)
+
+// pptxSlideMarker matches the "Slide 2:" prefix of a generated slide's first line
+var pptxSlideMarker = regexp.MustCompile(`^(?i:slide|幻灯片)\s*\d+\s*[:：]?\s*|^第\d+张幻灯片\s*[:：]?\s*`)
+
+// pptxSlide is one slide of an exported deck: a picture filling the slide, or a title and body
+// text when there is no picture. Notes become the slide's speaker notes.
+type pptxSlide struct {
+	Title     string
+	Body      []string
+	Notes     string
+	Image     []byte
+	ImageType string // "png", "jpeg" or "gif"
+}
+
+// pptxImageType returns the extension a picture is stored under in a deck, or "" if
+// PowerPoint can't show its format
+func pptxImageType(data []byte) string {
+	switch http.DetectContentType(data) {
+	case "image/png":
+		return "png"
+	case "image/jpeg":
+		return "jpeg"
+	case "image/gif":
+		return "gif"
+	}
+	return ""
+}
+
+// pptxEscape escapes text for an XML element or attribute
+func pptxEscape(text string) string {
+	var b strings.Builder
+	xml.EscapeText(&b, []byte(text))
+	return b.String()
+}
+
+// splitSlideText makes a title and body lines of a slide's generated content. Slide markers
+// such as "## Slide 2:" are dropped from the title.
+func splitSlideText(content string) (string, []string) {
+	var title string
+	var body []string
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if title == "" {
+			title = strings.TrimSpace(pptxSlideMarker.ReplaceAllString(strings.TrimLeft(line, "# "), ""))
+			if title == "" {
+				title = strings.TrimLeft(line, "# ")
+			}
+			continue
+		}
+		body = append(body, line)
+	}
+	return title, body
+}
+
+// writePPTX writes slides as a PowerPoint presentation
+func writePPTX(w io.Writer, slides []pptxSlide) error {
+	zw := zip.NewWriter(w)
+	files := make(map[string]string)
+	var media []struct {
+		name string
+		data []byte
+	}
+
+	var types, presRels, slideIDs strings.Builder
+	types.WriteString(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types"><Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/><Default Extension="xml" ContentType="application/xml"/><Default Extension="png" ContentType="image/png"/><Default Extension="jpeg" ContentType="image/jpeg"/><Default Extension="gif" ContentType="image/gif"/><Override PartName="/ppt/presentation.xml" ContentType="application/vnd.openxmlformats-officedocument.presentationml.presentation.main+xml"/><Override PartName="/ppt/slideMasters/slideMaster1.xml" ContentType="application/vnd.openxmlformats-officedocument.presentationml.slideMaster+xml"/><Override PartName="/ppt/slideLayouts/slideLayout1.xml" ContentType="application/vnd.openxmlformats-officedocument.presentationml.slideLayout+xml"/><Override PartName="/ppt/notesMasters/notesMaster1.xml" ContentType="application/vnd.openxmlformats-officedocument.presentationml.notesMaster+xml"/><Override PartName="/ppt/theme/theme1.xml" ContentType="application/vnd.openxmlformats-officedocument.theme+xml"/><Override PartName="/ppt/theme/theme2.xml" ContentType="application/vnd.openxmlformats-officedocument.theme+xml"/><Override PartName="/ppt/presProps.xml" ContentType="application/vnd.openxmlformats-officedocument.presentationml.presProps+xml"/><Override PartName="/ppt/viewProps.xml" ContentType="application/vnd.openxmlformats-officedocument.presentationml.viewProps+xml"/><Override PartName="/ppt/tableStyles.xml" ContentType="application/vnd.openxmlformats-officedocument.presentationml.tableStyles+xml"/><Override PartName="/docProps/core.xml" ContentType="application/vnd.openxmlformats-package.core-properties+xml"/><Override PartName="/docProps/app.xml" ContentType="application/vnd.openxmlformats-officedocument.extended-properties+xml"/>`)
+	presRels.WriteString(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships"><Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/slideMaster" Target="slideMasters/slideMaster1.xml"/><Relationship Id="rId2" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/notesMaster" Target="notesMasters/notesMaster1.xml"/><Relationship Id="rId3" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/theme" Target="theme/theme1.xml"/><Relationship Id="rId4" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/presProps" Target="presProps.xml"/><Relationship Id="rId5" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/viewProps" Target="viewProps.xml"/><Relationship Id="rId6" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/tableStyles" Target="tableStyles.xml"/>`)
+
+	for i, slide := range slides {
+		n := i + 1
+		fmt.Fprintf(&types, `<Override PartName="/ppt/slides/slide%d.xml" ContentType="application/vnd.openxmlformats-officedocument.presentationml.slide+xml"/>`, n)
+		fmt.Fprintf(&presRels, `<Relationship Id="rId%d" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/slide" Target="slides/slide%d.xml"/>`, n+10, n)
+		fmt.Fprintf(&slideIDs, `<p:sldId id="%d" r:id="rId%d"/>`, 255+n, n+10)
+
+		slideRels := `<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/slideLayout" Target="../slideLayouts/slideLayout1.xml"/>`
+		var shapes string
+		if slide.Image != nil {
+			imageName := fmt.Sprintf("image%d.%s", n, slide.ImageType)
+			media = append(media, struct {
+				name string
+				data []byte
+			}{imageName, slide.Image})
+			slideRels += fmt.Sprintf(`<Relationship Id="rId2" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/image" Target="../media/%s"/>`, imageName)
+			shapes = pptxPicture(slide.Image)
+		} else {
+			shapes = pptxTextBox(2, "Title", pptxMargin, pptxMargin, pptxSlideWidth-2*pptxMargin, 1143000, []string{slide.Title}, 3200, true) +
+				pptxTextBox(3, "Body", pptxMargin, pptxMargin+1371600, pptxSlideWidth-2*pptxMargin, pptxSlideHeight-2*pptxMargin-1371600, slide.Body, 1800, false)
+		}
+		if slide.Notes != "" {
+			fmt.Fprintf(&types, `<Override PartName="/ppt/notesSlides/notesSlide%d.xml" ContentType="application/vnd.openxmlformats-officedocument.presentationml.notesSlide+xml"/>`, n)
+			slideRels += fmt.Sprintf(`<Relationship Id="rId3" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/notesSlide" Target="../notesSlides/notesSlide%d.xml"/>`, n)
+			files[fmt.Sprintf("ppt/notesSlides/notesSlide%d.xml", n)] = pptxNotesSlide(slide.Notes)
+			files[fmt.Sprintf("ppt/notesSlides/_rels/notesSlide%d.xml.rels", n)] = pptxRels(
+				`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/notesMaster" Target="../notesMasters/notesMaster1.xml"/>` +
+					fmt.Sprintf(`<Relationship Id="rId2" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/slide" Target="../slides/slide%d.xml"/>`, n))
+		}
+		files[fmt.Sprintf("ppt/slides/slide%d.xml", n)] = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<p:sld ` + pptxNamespaces + `><p:cSld><p:spTree>` + pptxGroupProps + shapes + `</p:spTree></p:cSld><p:clrMapOvr><a:masterClrMapping/></p:clrMapOvr></p:sld>`
+		files[fmt.Sprintf("ppt/slides/_rels/slide%d.xml.rels", n)] = pptxRels(slideRels)
+	}
+	types.WriteString(`</Types>`)
+	presRels.WriteString(`</Relationships>`)
+
+	files["[Content_Types].xml"] = types.String()
+	files["ppt/_rels/presentation.xml.rels"] = presRels.String()
+	files["ppt/presentation.xml"] = fmt.Sprintf(`<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<p:presentation %s saveSubsetFonts="1"><p:sldMasterIdLst><p:sldMasterId id="2147483648" r:id="rId1"/></p:sldMasterIdLst><p:notesMasterIdLst><p:notesMasterId r:id="rId2"/></p:notesMasterIdLst><p:sldIdLst>%s</p:sldIdLst><p:sldSz cx="%d" cy="%d"/><p:notesSz cx="%d" cy="%d"/></p:presentation>`,
+		pptxNamespaces, slideIDs.String(), pptxSlideWidth, pptxSlideHeight, pptxNotesWidth, pptxNotesHeight)
+	for name, content := range pptxStaticParts {
+		files[name] = content
+	}
+
+	// The content types must come first for some readers
+	names := []string{"[Content_Types].xml"}
+	for name := range files {
+		if name != names[0] {
+			names = append(names, name)
+		}
+	}
+	for _, name := range names {
+		f, err := zw.Create(name)
+		if err != nil {
+			return err
+		}
+		if _, err := io.WriteString(f, files[name]); err != nil {
+			return err
+		}
+	}
+	for _, m := range media {
+		f, err := zw.CreateHeader(&zip.FileHeader{Name: "ppt/media/" + m.name, Method: zip.Store})
+		if err != nil {
+			return err
+		}
+		if _, err := f.Write(m.data); err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+// pptxPicture places a picture in the middle of the slide, as large as fits without cropping
+func pptxPicture(data []byte) string {
+	x, y, cx, cy := 0, 0, pptxSlideWidth, pptxSlideHeight
+	if cfg, _, err := image.DecodeConfig(bytes.NewReader(data)); err == nil && cfg.Width > 0 && cfg.Height > 0 {
+		if cfg.Width*pptxSlideHeight > cfg.Height*pptxSlideWidth {
+			cy = pptxSlideWidth * cfg.Height / cfg.Width
+			y = (pptxSlideHeight - cy) / 2
+		} else {
+			cx = pptxSlideHeight * cfg.Width / cfg.Height
+			x = (pptxSlideWidth - cx) / 2
+		}
+	}
+	return fmt.Sprintf(`<p:pic><p:nvPicPr><p:cNvPr id="2" name="Slide image"/><p:cNvPicPr><a:picLocks noChangeAspect="1"/></p:cNvPicPr><p:nvPr/></p:nvPicPr><p:blipFill><a:blip r:embed="rId2"/><a:stretch><a:fillRect/></a:stretch></p:blipFill><p:spPr><a:xfrm><a:off x="%d" y="%d"/><a:ext cx="%d" cy="%d"/></a:xfrm><a:prstGeom prst="rect"><a:avLst/></a:prstGeom></p:spPr></p:pic>`, x, y, cx, cy)
+}
+
+// pptxTextBox is a text box with one paragraph per line, size in hundredths of a point
+func pptxTextBox(id int, name string, x, y, cx, cy int, lines []string, size int, bold bool) string {
+	b := 0
+	if bold {
+		b = 1
+	}
+	var paragraphs strings.Builder
+	for _, line := range lines {
+		fmt.Fprintf(&paragraphs, `<a:p><a:r><a:rPr lang="zh-CN" sz="%d" b="%d"/><a:t>%s</a:t></a:r></a:p>`, size, b, pptxEscape(line))
+	}
+	if len(lines) == 0 {
+		paragraphs.WriteString(`<a:p><a:endParaRPr lang="zh-CN"/></a:p>`)
+	}
+	return fmt.Sprintf(`<p:sp><p:nvSpPr><p:cNvPr id="%d" name="%s"/><p:cNvSpPr txBox="1"/><p:nvPr/></p:nvSpPr><p:spPr><a:xfrm><a:off x="%d" y="%d"/><a:ext cx="%d" cy="%d"/></a:xfrm><a:prstGeom prst="rect"><a:avLst/></a:prstGeom></p:spPr><p:txBody><a:bodyPr wrap="square"><a:normAutofit/></a:bodyPr><a:lstStyle/>%s</p:txBody></p:sp>`,
+		id, name, x, y, cx, cy, paragraphs.String())
+}
+
+// pptxNotesSlide is the speaker notes page of a slide
+func pptxNotesSlide(notes string) string {
+	var paragraphs strings.Builder
+	for _, line := range strings.Split(strings.TrimSpace(notes), "\n") {
+		fmt.Fprintf(&paragraphs, `<a:p><a:r><a:rPr lang="zh-CN"/><a:t>%s</a:t></a:r></a:p>`, pptxEscape(strings.TrimRight(line, "\r")))
+	}
+	return `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<p:notes ` + pptxNamespaces + `><p:cSld><p:spTree>` + pptxGroupProps +
+		`<p:sp><p:nvSpPr><p:cNvPr id="2" name="Slide Image Placeholder"/><p:cNvSpPr><a:spLocks noGrp="1" noRot="1" noChangeAspect="1"/></p:cNvSpPr><p:nvPr><p:ph type="sldImg"/></p:nvPr></p:nvSpPr><p:spPr/></p:sp>` +
+		`<p:sp><p:nvSpPr><p:cNvPr id="3" name="Notes Placeholder"/><p:cNvSpPr><a:spLocks noGrp="1"/></p:cNvSpPr><p:nvPr><p:ph type="body" idx="1"/></p:nvPr></p:nvSpPr><p:spPr/><p:txBody><a:bodyPr/><a:lstStyle/>` + paragraphs.String() + `</p:txBody></p:sp>` +
+		`</p:spTree></p:cSld><p:clrMapOvr><a:masterClrMapping/></p:clrMapOvr></p:notes>`
+}
+
+// pptxRels wraps relationships in a relationships part
+func pptxRels(relationships string) string {
+	return `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` + relationships + `</Relationships>`
+}
+
+const (
+	pptxNamespaces = `xmlns:a="http://schemas.openxmlformats.org/drawingml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships" xmlns:p="http://schemas.openxmlformats.org/presentationml/2006/main"`
+	pptxGroupProps = `<p:nvGrpSpPr><p:cNvPr id="1" name=""/><p:cNvGrpSpPr/><p:nvPr/></p:nvGrpSpPr><p:grpSpPr><a:xfrm><a:off x="0" y="0"/><a:ext cx="0" cy="0"/><a:chOff x="0" y="0"/><a:chExt cx="0" cy="0"/></a:xfrm></p:grpSpPr>`
+	pptxClrMap     = `<p:clrMap bg1="lt1" tx1="dk1" bg2="lt2" tx2="dk2" accent1="accent1" accent2="accent2" accent3="accent3" accent4="accent4" accent5="accent5" accent6="accent6" hlink="hlink" folHlink="folHlink"/>`
+	pptxTheme      = `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<a:theme xmlns:a="http://schemas.openxmlformats.org/drawingml/2006/main" name="Notex"><a:themeElements><a:clrScheme name="Notex"><a:dk1><a:srgbClr val="000000"/></a:dk1><a:lt1><a:srgbClr val="FFFFFF"/></a:lt1><a:dk2><a:srgbClr val="1F2937"/></a:dk2><a:lt2><a:srgbClr val="F3F4F6"/></a:lt2><a:accent1><a:srgbClr val="2563EB"/></a:accent1><a:accent2><a:srgbClr val="7C3AED"/></a:accent2><a:accent3><a:srgbClr val="059669"/></a:accent3><a:accent4><a:srgbClr val="D97706"/></a:accent4><a:accent5><a:srgbClr val="DC2626"/></a:accent5><a:accent6><a:srgbClr val="0891B2"/></a:accent6><a:hlink><a:srgbClr val="2563EB"/></a:hlink><a:folHlink><a:srgbClr val="7C3AED"/></a:folHlink></a:clrScheme><a:fontScheme name="Notex"><a:majorFont><a:latin typeface="Calibri"/><a:ea typeface=""/><a:cs typeface=""/></a:majorFont><a:minorFont><a:latin typeface="Calibri"/><a:ea typeface=""/><a:cs typeface=""/></a:minorFont></a:fontScheme><a:fmtScheme name="Notex"><a:fillStyleLst><a:solidFill><a:schemeClr val="phClr"/></a:solidFill><a:solidFill><a:schemeClr val="phClr"/></a:solidFill><a:solidFill><a:schemeClr val="phClr"/></a:solidFill></a:fillStyleLst><a:lnStyleLst><a:ln w="6350"><a:solidFill><a:schemeClr val="phClr"/></a:solidFill></a:ln><a:ln w="12700"><a:solidFill><a:schemeClr val="phClr"/></a:solidFill></a:ln><a:ln w="19050"><a:solidFill><a:schemeClr val="phClr"/></a:solidFill></a:ln></a:lnStyleLst><a:effectStyleLst><a:effectStyle><a:effectLst/></a:effectStyle><a:effectStyle><a:effectLst/></a:effectStyle><a:effectStyle><a:effectLst/></a:effectStyle></a:effectStyleLst><a:bgFillStyleLst><a:solidFill><a:schemeClr val="phClr"/></a:solidFill><a:solidFill><a:schemeClr val="phClr"/></a:solidFill><a:solidFill><a:schemeClr val="phClr"/></a:solidFill></a:bgFillStyleLst></a:fmtScheme></a:themeElements></a:theme>`
+)
+
+// pptxStaticParts are the parts of a deck that don't depend on its slides
+var pptxStaticParts = map[string]string{
+	"_rels/.rels": pptxRels(`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="ppt/presentation.xml"/><Relationship Id="rId2" Type="http://schemas.openxmlformats.org/package/2006/relationships/metadata/core-properties" Target="docProps/core.xml"/><Relationship Id="rId3" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/extended-properties" Target="docProps/app.xml"/>`),
+	"docProps/core.xml": `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<cp:coreProperties xmlns:cp="http://schemas.openxmlformats.org/package/2006/metadata/core-properties" xmlns:dc="http://purl.org/dc/elements/1.1/"><dc:creator>Notex</dc:creator></cp:coreProperties>`,
+	"docProps/app.xml": `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<Properties xmlns="http://schemas.openxmlformats.org/officeDocument/2006/extended-properties"><Application>Notex</Application></Properties>`,
+	"ppt/presProps.xml": `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<p:presentationPr ` + pptxNamespaces + `/>`,
+	"ppt/viewProps.xml": `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<p:viewPr ` + pptxNamespaces + `/>`,
+	"ppt/tableStyles.xml": `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<a:tblStyleLst xmlns:a="http://schemas.openxmlformats.org/drawingml/2006/main" def="{5C22544A-7EE6-4342-B048-85BDC9FD1C3A}"/>`,
+	"ppt/theme/theme1.xml": pptxTheme,
+	"ppt/theme/theme2.xml": pptxTheme,
+	"ppt/slideMasters/slideMaster1.xml": `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<p:sldMaster ` + pptxNamespaces + `><p:cSld><p:bg><p:bgRef idx="1001"><a:schemeClr val="bg1"/></p:bgRef></p:bg><p:spTree>` + pptxGroupProps + `</p:spTree></p:cSld>` + pptxClrMap + `<p:sldLayoutIdLst><p:sldLayoutId id="2147483649" r:id="rId1"/></p:sldLayoutIdLst><p:txStyles><p:titleStyle/><p:bodyStyle/><p:otherStyle/></p:txStyles></p:sldMaster>`,
+	"ppt/slideMasters/_rels/slideMaster1.xml.rels": pptxRels(`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/slideLayout" Target="../slideLayouts/slideLayout1.xml"/><Relationship Id="rId2" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/theme" Target="../theme/theme1.xml"/>`),
+	"ppt/slideLayouts/slideLayout1.xml": `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<p:sldLayout ` + pptxNamespaces + ` type="blank" preserve="1"><p:cSld name="Blank"><p:spTree>` + pptxGroupProps + `</p:spTree></p:cSld><p:clrMapOvr><a:masterClrMapping/></p:clrMapOvr></p:sldLayout>`,
+	"ppt/slideLayouts/_rels/slideLayout1.xml.rels": pptxRels(`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/slideMaster" Target="../slideMasters/slideMaster1.xml"/>`),
+	"ppt/notesMasters/notesMaster1.xml": `<?xml version="1.0" encoding="UTF-8" standalone="yes"?>
+<p:notesMaster ` + pptxNamespaces + `><p:cSld><p:bg><p:bgRef idx="1001"><a:schemeClr val="bg1"/></p:bgRef></p:bg><p:spTree>` + pptxGroupProps +
+		`<p:sp><p:nvSpPr><p:cNvPr id="2" name="Slide Image Placeholder"/><p:cNvSpPr><a:spLocks noGrp="1" noRot="1" noChangeAspect="1"/></p:cNvSpPr><p:nvPr><p:ph type="sldImg"/></p:nvPr></p:nvSpPr><p:spPr><a:xfrm><a:off x="685800" y="685800"/><a:ext cx="5486400" cy="3086100"/></a:xfrm><a:prstGeom prst="rect"><a:avLst/></a:prstGeom><a:noFill/><a:ln w="12700"><a:solidFill><a:prstClr val="black"/></a:solidFill></a:ln></p:spPr></p:sp>` +
+		`<p:sp><p:nvSpPr><p:cNvPr id="3" name="Notes Placeholder"/><p:cNvSpPr><a:spLocks noGrp="1"/></p:cNvSpPr><p:nvPr><p:ph type="body" sz="quarter" idx="1"/></p:nvPr></p:nvSpPr><p:spPr><a:xfrm><a:off x="685800" y="4114800"/><a:ext cx="5486400" cy="4343400"/></a:xfrm><a:prstGeom prst="rect"><a:avLst/></a:prstGeom></p:spPr><p:txBody><a:bodyPr/><a:lstStyle/><a:p><a:endParaRPr lang="zh-CN"/></a:p></p:txBody></p:sp>` +
+		`</p:spTree></p:cSld>` + pptxClrMap + `</p:notesMaster>`,
+	"ppt/notesMasters/_rels/notesMaster1.xml.rels": pptxRels(`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/theme" Target="../theme/theme2.xml"/>`),
+}
+
+// pptSlideDeck assembles the slides of a PPT note: each generated image with the content of its
+// slide as speaker notes, and slides whose image is missing as text
+func (s *Server) pptSlideDeck(note *Note, ownerID string) []pptxSlide {
+	parsed := parsePPTSlides(note.Content)
+	images := metadataStrings(note.Metadata["slides"])
+
+	// slide_numbers says which slide each image shows; notes made before it was recorded are
+	// matched by position when no image is missing
+	numbers := make([]int, 0, len(images))
+	if raw, ok := note.Metadata["slide_numbers"].([]interface{}); ok && len(raw) == len(images) {
+		for _, v := range raw {
+			n, _ := v.(float64)
+			numbers = append(numbers, int(n))
+		}
+	} else if len(images) == len(parsed) {
+		for i := range images {
+			numbers = append(numbers, i+1)
+		}
+	}
+
+	imageOf := make(map[int][]byte, len(images))
+	var unmatched [][]byte
+	for i, url := range images {
+		data, err := os.ReadFile(filepath.Join(s.cfg.UploadDir, ownerID, path.Base(url)))
+		if err != nil || pptxImageType(data) == "" {
+			golog.Warnf("skipping slide image %s of note %s: %v", url, note.ID, err)
+			continue
+		}
+		if i < len(numbers) && numbers[i] >= 1 && numbers[i] <= len(parsed) {
+			imageOf[numbers[i]] = data
+		} else {
+			unmatched = append(unmatched, data)
+		}
+	}
+
+	var deck []pptxSlide
+	if len(unmatched) > 0 {
+		// Without knowing which slide an image shows, the deck is the images alone
+		for _, data := range unmatched {
+			deck = append(deck, pptxSlide{Image: data, ImageType: pptxImageType(data)})
+		}
+		return deck
+	}
+	for i, slide := range parsed {
+		content := strings.TrimSpace(slide.Content)
+		if data, ok := imageOf[i+1]; ok {
+			deck = append(deck, pptxSlide{Image: data, ImageType: pptxImageType(data), Notes: content})
+			continue
+		}
+		title, body := splitSlideText(content)
+		deck = append(deck, pptxSlide{Title: title, Body: body})
+	}
+	return deck
+}
+
+// metadataStrings returns the strings of a JSON array from note or source metadata
+func metadataStrings(v interface{}) []string {
+	raw, _ := v.([]interface{})
+	values := make([]string, 0, len(raw))
+	for _, item := range raw {
+		if s, ok := item.(string); ok {
+			values = append(values, s)
+		}
+	}
+	return values
+}
+
+// handleExportNote downloads a note as a file. PPT notes export as a PowerPoint deck of their
+// slide images, with the text of each slide as its speaker notes; any note exports as a PDF
+// with format=pdf.
+func (s *Server) handleExportNote(c *gin.Context) {
+	ctx := c.Request.Context()
+	notebookID := c.Param("id")
+	if err := s.checkNotebookAccess(ctx, notebookID, c.GetString("user_id")); err != nil {
+		c.JSON(http.StatusForbidden, ErrorResponse{Error: "Access denied"})
+		return
+	}
+
+	note, err := s.store.GetNote(ctx, c.Param("noteId"))
+	if err != nil || note.NotebookID != notebookID {
+		c.JSON(http.StatusNotFound, ErrorResponse{Error: "Note not found"})
+		return
+	}
+	format := c.DefaultQuery("format", "pptx")
+	if format != "pptx" && format != "pdf" {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: fmt.Sprintf("unsupported format: %s (supported: pptx, pdf)", format)})
+		return
+	}
+	if format == "pptx" && note.Type != "ppt" {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Only PPT notes can be exported as pptx"})
+		return
+	}
+	notebook, err := s.store.GetNotebook(ctx, notebookID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, ErrorResponse{Error: "Notebook not found"})
+		return
+	}
+
+	title := strings.TrimSpace(note.Title)
+	if format == "pdf" {
+		var buf bytes.Buffer
+		if err := s.notePDF(&buf, note, notebook.UserID); err != nil {
+			c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to export note", Details: err.Error()})
+			return
+		}
+		if title == "" {
+			title = "note"
+		}
+		c.Header("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": title + ".pdf"}))
+		c.Data(http.StatusOK, "application/pdf", buf.Bytes())
+		return
+	}
+
+	var buf bytes.Buffer
+	if err := writePPTX(&buf, s.pptSlideDeck(note, notebook.UserID)); err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to export note", Details: err.Error()})
+		return
+	}
+
+	if title == "" {
+		title = "slides"
+	}
+	c.Header("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": title + ".pptx"}))
+	c.Data(http.StatusOK, "application/vnd.openxmlformats-officedocument.presentationml.presentation", buf.Bytes())
+}
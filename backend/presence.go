@@ -0,0 +1,265 @@
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+	"github.com/kataras/golog"
+)
+
+// presenceHeartbeat is how often an open notebook page tells the server it is still there
+const presenceHeartbeat = 20 * time.Second
+
+// presenceTimeout drops a viewer whose page has missed heartbeats for this long, as when a
+// laptop lid is closed without the socket closing
+const presenceTimeout = 3 * presenceHeartbeat
+
+// presenceWriteTimeout bounds sending an update to a slow viewer
+const presenceWriteTimeout = 10 * time.Second
+
+var presenceUpgrader = websocket.Upgrader{ReadBufferSize: 1024, WriteBufferSize: 4096}
+
+// presenceHub keeps the open presence sockets of each notebook
+type presenceHub struct {
+	mu        sync.Mutex
+	notebooks map[string]map[*presenceViewer]bool
+}
+
+// presenceViewer is one open notebook page: a tab or device of a signed-in user, or an
+// anonymous visitor of the public page
+type presenceViewer struct {
+	user     *User  // nil for public viewers
+	role     string // "owner" or "viewer" of a signed-in user
+	since    time.Time
+	lastSeen time.Time
+	// updates holds the latest presence of the notebook not yet sent; older ones are replaced
+	updates chan []byte
+}
+
+func newPresenceHub() *presenceHub {
+	return &presenceHub{notebooks: make(map[string]map[*presenceViewer]bool)}
+}
+
+// join adds a viewer to a notebook and tells everyone watching it
+func (h *presenceHub) join(notebookID string, viewer *presenceViewer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.notebooks[notebookID] == nil {
+		h.notebooks[notebookID] = make(map[*presenceViewer]bool)
+	}
+	h.notebooks[notebookID][viewer] = true
+	h.broadcastLocked(notebookID)
+}
+
+// leave removes a viewer from a notebook and tells those still watching it
+func (h *presenceHub) leave(notebookID string, viewer *presenceViewer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.notebooks[notebookID], viewer)
+	if len(h.notebooks[notebookID]) == 0 {
+		delete(h.notebooks, notebookID)
+		return
+	}
+	h.broadcastLocked(notebookID)
+}
+
+// heartbeat records that a viewer's page is still open
+func (h *presenceHub) heartbeat(viewer *presenceViewer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	viewer.lastSeen = time.Now()
+}
+
+// collaborators lists the users with access to a notebook, marking those viewing it now, and
+// counts its anonymous public viewers. owner is listed even when away.
+func (h *presenceHub) collaborators(notebookID string, owner *User) CollaboratorsResponse {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return collaboratorsOf(owner, h.notebooks[notebookID])
+}
+
+func collaboratorsOf(owner *User, viewers map[*presenceViewer]bool) CollaboratorsResponse {
+	response := CollaboratorsResponse{Collaborators: []Collaborator{}}
+	add := func(user *User, role string) {
+		response.Collaborators = append(response.Collaborators, Collaborator{
+			UserID: user.ID, Name: user.Name, Email: user.Email, AvatarURL: user.AvatarURL, Role: role,
+		})
+	}
+	if owner != nil {
+		add(owner, "owner")
+	}
+
+	for viewer := range viewers {
+		if viewer.user == nil {
+			response.PublicViewers++
+			continue
+		}
+		index := -1
+		for i := range response.Collaborators {
+			if response.Collaborators[i].UserID == viewer.user.ID {
+				index = i
+			}
+		}
+		if index < 0 {
+			add(viewer.user, viewer.role)
+			index = len(response.Collaborators) - 1
+		}
+		c := &response.Collaborators[index]
+		c.Active = true
+		c.Sessions++
+		if c.ActiveSince == nil || viewer.since.Before(*c.ActiveSince) {
+			since := viewer.since
+			c.ActiveSince = &since
+		}
+		if c.LastSeen == nil || viewer.lastSeen.After(*c.LastSeen) {
+			lastSeen := viewer.lastSeen
+			c.LastSeen = &lastSeen
+		}
+	}
+
+	// The owner first, then whoever has been here longest
+	sort.SliceStable(response.Collaborators, func(i, j int) bool {
+		a, b := response.Collaborators[i], response.Collaborators[j]
+		if (a.Role == "owner") != (b.Role == "owner") {
+			return a.Role == "owner"
+		}
+		return a.ActiveSince != nil && (b.ActiveSince == nil || a.ActiveSince.Before(*b.ActiveSince))
+	})
+	return response
+}
+
+// broadcastLocked sends who is viewing a notebook to its signed-in viewers. Public viewers are
+// not told who else is there.
+func (h *presenceHub) broadcastLocked(notebookID string) {
+	viewers := h.notebooks[notebookID]
+	message, err := json.Marshal(presenceMessage{Type: "presence", CollaboratorsResponse: collaboratorsOf(nil, viewers)})
+	if err != nil {
+		return
+	}
+	for viewer := range viewers {
+		if viewer.user == nil {
+			continue
+		}
+		select {
+		case <-viewer.updates:
+		default:
+		}
+		viewer.updates <- message
+	}
+}
+
+// presenceMessage is a message on a presence socket: "presence" from the server with who is
+// viewing the notebook, "heartbeat" from the page
+type presenceMessage struct {
+	Type string `json:"type"`
+	CollaboratorsResponse
+}
+
+// servePresence upgrades a request to the presence socket of a notebook and keeps the viewer
+// in its presence until the socket closes or heartbeats stop
+func (s *Server) servePresence(c *gin.Context, notebook *Notebook, user *User) {
+	ws, err := presenceUpgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		// The upgrader has already replied with the error
+		golog.Warnf("failed to open presence socket: %v", err)
+		return
+	}
+	defer ws.Close()
+
+	now := time.Now()
+	viewer := &presenceViewer{user: user, role: "viewer", since: now, lastSeen: now, updates: make(chan []byte, 1)}
+	if user != nil && user.ID == notebook.UserID {
+		viewer.role = "owner"
+	}
+	s.presence.join(notebook.ID, viewer)
+	defer s.presence.leave(notebook.ID, viewer)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case message := <-viewer.updates:
+				ws.SetWriteDeadline(time.Now().Add(presenceWriteTimeout))
+				if err := ws.WriteMessage(websocket.TextMessage, message); err != nil {
+					ws.Close()
+					return
+				}
+			}
+		}
+	}()
+
+	ws.SetReadLimit(4096)
+	for {
+		ws.SetReadDeadline(time.Now().Add(presenceTimeout))
+		if _, _, err := ws.ReadMessage(); err != nil {
+			return
+		}
+		s.presence.heartbeat(viewer)
+	}
+}
+
+// handleNotebookPresence opens the presence socket of a notebook for a signed-in user. The
+// token may be passed as ?token=, since browsers can't set headers on WebSocket requests.
+func (s *Server) handleNotebookPresence(c *gin.Context) {
+	ctx := c.Request.Context()
+	userID := c.GetString("user_id")
+	if userID == "" {
+		c.JSON(http.StatusUnauthorized, ErrorResponse{Error: "Authorization required"})
+		return
+	}
+	notebookID := c.Param("id")
+	if err := s.checkNotebookAccess(ctx, notebookID, userID); err != nil {
+		c.JSON(http.StatusForbidden, ErrorResponse{Error: err.Error()})
+		return
+	}
+	notebook, err := s.store.GetNotebook(ctx, notebookID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, ErrorResponse{Error: "Notebook not found"})
+		return
+	}
+	user, err := s.store.GetUser(ctx, userID)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, ErrorResponse{Error: "User not found"})
+		return
+	}
+	s.servePresence(c, notebook, user)
+}
+
+// handlePublicPresence opens the presence socket of a public notebook for an anonymous viewer,
+// who is counted but not named
+func (s *Server) handlePublicPresence(c *gin.Context) {
+	notebook, _, ok := s.getPublicNotebook(c)
+	if !ok {
+		return
+	}
+	s.servePresence(c, notebook, nil)
+}
+
+// handleListCollaborators lists who has access to a notebook and who is viewing it now
+func (s *Server) handleListCollaborators(c *gin.Context) {
+	ctx := c.Request.Context()
+	notebookID := c.Param("id")
+	if err := s.checkNotebookAccess(ctx, notebookID, c.GetString("user_id")); err != nil {
+		c.JSON(http.StatusForbidden, ErrorResponse{Error: err.Error()})
+		return
+	}
+	notebook, err := s.store.GetNotebook(ctx, notebookID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, ErrorResponse{Error: "Notebook not found"})
+		return
+	}
+	var owner *User
+	if notebook.UserID != "" {
+		owner, _ = s.store.GetUser(ctx, notebook.UserID)
+	}
+	c.JSON(http.StatusOK, s.presence.collaborators(notebook.ID, owner))
+}
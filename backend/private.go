@@ -0,0 +1,102 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kataras/golog"
+)
+
+// privateRequest marks a note or source as seen by the owner only, or visible again
+type privateRequest struct {
+	Private bool `json:"private"`
+}
+
+// handleSetNotePrivate hides a note from the notebook's public page and its own share link,
+// or shows it again. The share link itself is kept, and works again once the note is visible.
+func (s *Server) handleSetNotePrivate(c *gin.Context) {
+	note, ok := s.getNoteInNotebook(c)
+	if !ok {
+		return
+	}
+	var req privateRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	note, err := s.store.SetNotePrivate(c.Request.Context(), note.ID, req.Private)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to update note"})
+		return
+	}
+	s.logPrivateChange(c, "note", note.ID, note.Title, note.NotebookID, req.Private)
+	c.JSON(http.StatusOK, note)
+}
+
+// handleSetSourcePrivate hides a source from the notebook's public page, and from the answers
+// of public chat and chat integrations, or shows it again
+func (s *Server) handleSetSourcePrivate(c *gin.Context) {
+	source, ok := s.getSourceInNotebook(c)
+	if !ok {
+		return
+	}
+	var req privateRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	source, err := s.store.SetSourcePrivate(c.Request.Context(), source.ID, req.Private)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to update source"})
+		return
+	}
+	s.logPrivateChange(c, "source", source.ID, source.Name, source.NotebookID, req.Private)
+	c.JSON(http.StatusOK, summarizeSources([]Source{*source})[0])
+}
+
+// logPrivateChange records making a note or source private, or visible again
+func (s *Server) logPrivateChange(c *gin.Context, resourceType, id, name, notebookID string, private bool) {
+	action := "make_" + resourceType + "_private"
+	if !private {
+		action = "make_" + resourceType + "_visible"
+	}
+	activityLog := &ActivityLog{
+		UserID:       c.GetString("user_id"),
+		Action:       action,
+		ResourceType: resourceType,
+		ResourceID:   id,
+		ResourceName: name,
+		Details:      fmt.Sprintf(`{"notebook_id": "%s"}`, notebookID),
+		IPAddress:    c.ClientIP(),
+		UserAgent:    c.GetHeader("User-Agent"),
+	}
+	if err := s.store.LogActivity(c.Request.Context(), activityLog); err != nil {
+		golog.Errorf("failed to log activity: %v", err)
+	}
+}
+
+// hidePrivateSources keeps the private sources of a notebook out of the chunks retrieved
+// with settings, for answers read by others than the owner
+func (s *Server) hidePrivateSources(ctx context.Context, notebookID string, settings *ChatSettings) error {
+	hidden, err := s.store.ListPrivateSourceIDs(ctx, notebookID)
+	if err != nil {
+		return err
+	}
+	settings.hiddenSources = hidden
+	return nil
+}
+
+// visibleSources drops the private sources of a list
+func visibleSources(sources []Source) []Source {
+	visible := make([]Source, 0, len(sources))
+	for _, source := range sources {
+		if !source.Private {
+			visible = append(visible, source)
+		}
+	}
+	return visible
+}
@@ -48,6 +48,12 @@ func getTransformationPrompt(transformType string) string {
 	case "data_chart":
 		return dataChartPrompt()
 
+	case "meeting_summary":
+		return meetingSummaryPrompt()
+
+	case "draft_outline":
+		return draftOutlinePrompt()
+
 	default:
 		return defaultPrompt()
 	}
@@ -119,7 +125,7 @@ func podcastPrompt() string {
 - 包含自然的过渡和提问
 - 有清晰的开场白和结束语
 
-请将其格式化为带有演讲者标签（主持人1，主持人2）和[括号]中舞台指示的播客脚本。`
+请将其格式化为带有演讲者标签（主持人1，主持人2）和[括号]中舞台指示的播客脚本。每段台词另起一行，以“主持人1：”或“主持人2：”开头，以便用不同的声音朗读。`
 }
 
 func timelinePrompt() string {
@@ -418,6 +424,41 @@ func insightPrompt() string {
 请提供一个简洁的摘要，捕捉来源中的关键信息、主要主题和重要细节。摘要将被用于后续的深度洞察分析。`
 }
 
+func meetingSummaryPrompt() string {
+	return `你是一个擅长整理会议纪要的专家。以下来源包含会议的日程信息（标题、时间、参会人、议程）和会议记录稿，请以{format}格式整理一份会议纪要。
+**注意：无论来源是什么语言，请务必使用中文进行回复。不要使用 ` + "```markdown" + ` 标记包裹输出。**
+
+来源：
+{sources}
+
+会议纪要应包括：
+1. 会议基本信息（主题、时间、参会人）
+2. 按议程整理的讨论要点
+3. 达成的决定
+4. 待办事项（负责人和截止时间，如记录中提及）
+5. 未决问题
+
+请只使用记录稿中出现的信息，不要编造内容。`
+}
+
+func draftOutlinePrompt() string {
+	return `你是一个擅长规划长文结构的写作专家。请根据以下来源和写作要求，为一篇长文拟定大纲。
+**注意：无论来源是什么语言，请务必使用中文进行回复。不要使用 ` + "```markdown" + ` 标记包裹输出。**
+
+来源：
+{sources}
+
+写作要求：
+{prompt}
+
+大纲格式：
+1. 第一行是文章标题，以 "# " 开头
+2. 每个章节一个二级标题，以 "## " 开头，共 4 到 8 个章节
+3. 每个章节标题下用 2 到 4 个要点说明本章要写的内容及依据的来源
+
+只规划来源能够支撑的内容，只输出大纲本身。`
+}
+
 func defaultPrompt() string {
 	return `你是一个有用的助手。根据以下来源，以{format}格式提供一个{type}。
 **注意：无论来源是什么语言，请务必使用中文进行回复。不要使用 ` + "```markdown" + ` 标记包裹输出。**
@@ -489,5 +530,158 @@ func chatSystemPrompt() string {
 
 用户问题：{question}
 
-请提供有用的、准确的回答。当引用来源中的信息时，请提及信息来自哪个来源。`
+请提供有用的、准确的回答。当引用来源中的信息时，请提及信息来自哪个来源。{style}`
+}
+
+// AnswerStyle is a preset way of answering chat questions, added to the chat prompt
+type AnswerStyle struct {
+	ID           string `json:"id"`
+	Name         string `json:"name"`
+	Instructions string `json:"-"`
+}
+
+// answerStyles are the chat answer styles, in the order they are offered
+var answerStyles = []AnswerStyle{
+	{ID: "concise", Name: "简洁", Instructions: "用三到五句话直接回答要点，不做铺垫，不展开次要细节。"},
+	{ID: "detailed", Name: "详细", Instructions: "全面回答：先给出结论，再分段展开背景、依据、例子和注意事项，尽量用上来源中的相关细节。"},
+	{ID: "eli5", Name: "通俗易懂", Instructions: "像向没有背景知识的人解释一样回答：用日常语言和类比，避免术语，必须用到的术语要先解释。"},
+	{ID: "bullets", Name: "要点列表", Instructions: "只用要点列表回答，每条一句话，不写段落、开场白或总结。"},
+	{ID: "academic", Name: "学术", Instructions: "用严谨的书面语回答，区分事实与推断，每个论断后用 [来源 N] 标注出处，来源未涉及的内容要明确说明。"},
+}
+
+// findAnswerStyle returns the answer style with an ID, or nil if there is none
+func findAnswerStyle(id string) *AnswerStyle {
+	for i := range answerStyles {
+		if answerStyles[i].ID == id {
+			return &answerStyles[i]
+		}
+	}
+	return nil
+}
+
+// noteAssistOperations describes each writing assistant operation to the LLM
+var noteAssistOperations = map[string]string{
+	"rewrite":  "改写待处理的段落，使其更清晰、更通顺，保持原意和篇幅大致不变。",
+	"expand":   "扩写待处理的段落，用来源中的事实、例子和细节充实内容，保持原有结构和观点。",
+	"shorten":  "精简待处理的段落，保留关键观点和事实，删去重复和次要内容，篇幅约为原文的一半。",
+	"critique": "评审待处理的段落，不要改写它。按条列出问题：与来源不符或缺少来源支持的说法、逻辑漏洞、表达不清之处、遗漏的重要来源信息，并给出具体修改建议。",
+}
+
+// Note writing assistant prompt
+func noteAssistPrompt() string {
+	return `你是一个写作助手，帮助用户修改笔记本中自己撰写的笔记。
+**请使用与笔记相同的语言回复。不要使用 ` + "```markdown" + ` 标记包裹输出。**
+
+任务：{task}
+{instructions}
+
+来源中的相关信息：
+{context}
+
+完整笔记（供参考上下文）：
+{note}
+
+待处理的段落：
+{selection}
+
+只使用来源和笔记中的信息，不要编造事实。除评审外，只输出处理后的段落本身，不要添加解释或前言，并保留原有的 Markdown 格式。`
+}
+
+// rerankRelevancePrompt asks an Ollama model how relevant a passage is to a query
+func rerankRelevancePrompt(query, passage string) string {
+	return `判断下面的段落对回答问题有多大帮助，用 0 到 10 的整数打分：0 表示完全无关，10 表示直接回答了问题。
+只输出分数，不要输出其他内容。
+
+问题：` + query + `
+
+段落：
+` + passage + `
+
+分数：`
+}
+
+// Coverage judge prompt: does retrieval find what a question needs
+func coverageJudgePrompt() string {
+	return `你是一个资料审查员，判断笔记本的来源能否回答一个问题。下面是针对该问题检索到的来源段落。
+
+问题：{question}
+
+检索到的段落：
+{context}
+
+只根据这些段落判断，不要使用你自己的知识。按以下格式输出三行，不要输出其他内容：
+支持程度：充分、部分或无（充分表示段落能完整回答问题，部分表示只能回答其中一部分，无表示段落与问题无关或不包含答案）
+相关段落：能支持回答的段落编号，用逗号分隔；没有则写"无"
+理由：一句话说明判断依据，支持不足时说明缺少什么信息`
+}
+
+// Summary layer prompt: one call per run of a long source's chunks, or per run of the summaries
+// of the layer below. The summaries are searched, so they keep the source's language and terms.
+func sourceSectionSummaryPrompt() string {
+	return `你是一个资料整理助手，正在为一篇很长的文档分段编写摘要，这些摘要之后会用来检索文档中与问题相关的部分。
+**请使用与原文相同的语言输出。**
+
+文档：{source}
+
+{kind}：
+{text}
+
+用一段话概括这部分的主要内容，保留其中的关键术语、人名、数字和结论，以便按问题检索时能找到这部分。只输出摘要本身，不超过 300 字。`
+}
+
+// Note editing chat prompt. Edits are search/replace blocks so they can be applied to the note
+// exactly and shown as a diff before the user accepts them.
+func noteEditChatPrompt() string {
+	return `你是一个编辑助手，和用户一起通过多轮对话修改笔记本中的一篇笔记。
+**请使用与笔记相同的语言回复。**
+
+来源中的相关信息：
+{context}
+
+笔记的当前内容：
+{note}
+
+之前的对话：
+{history}
+
+用户: {message}
+
+先用一两句话说明你打算如何修改，然后把每处修改写成一个替换块：
+
+<<<<<<< FIND
+笔记中要替换的原文
+=======
+替换后的文本
+>>>>>>> REPLACE
+
+要求：
+1. FIND 部分必须逐字照抄笔记当前内容中的一段连续原文（包括 Markdown 标记），并且足够长，在笔记中只出现一次
+2. 每处修改单独一个替换块，只包含需要改动的部分；要在笔记末尾添加内容时，FIND 部分留空
+3. 删除内容时，替换后的文本留空
+4. 只使用来源和笔记中的信息，不要编造事实
+5. 如果用户只是提问、不需要修改笔记，直接回答，不要输出替换块`
+}
+
+// Draft section prompt, one call per section of an approved outline
+func draftSectionPrompt() string {
+	return `你是一个写作专家，正在根据已确认的大纲逐章撰写一篇长文。
+**注意：无论来源是什么语言，请务必使用中文进行回复。不要使用 ` + "```markdown" + ` 标记包裹输出。**
+
+文章大纲：
+{outline}
+
+上一章结尾：
+{previous}
+
+来源中的相关信息：
+{context}
+
+现在请撰写章节「{heading}」，本章要点：
+{points}
+
+要求：
+1. 篇幅{length}，以连贯的段落行文，可以使用三级标题和列表
+2. 每个事实或观点后用 [来源 N] 标注所依据的来源编号，只使用上面提供的来源编号
+3. 与上一章自然衔接，不要重复其他章节的内容
+4. 只输出本章正文，不要输出章节标题本身`
 }
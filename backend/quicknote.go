@@ -0,0 +1,132 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kataras/golog"
+)
+
+// quickNoteTitleLength is the number of characters of the first line used as a default title
+const quickNoteTitleLength = 50
+
+// inboxNotebook returns the user's inbox notebook, creating it on first use
+func (s *Server) inboxNotebook(ctx context.Context, userID string) (*Notebook, error) {
+	s.inboxMu.Lock()
+	defer s.inboxMu.Unlock()
+
+	notebooks, err := s.store.ListNotebooks(ctx, userID)
+	if err != nil {
+		return nil, err
+	}
+	for i := range notebooks {
+		if notebooks[i].Name == s.cfg.InboxNotebookName {
+			return &notebooks[i], nil
+		}
+	}
+
+	golog.Infof("creating inbox notebook %q for user %s", s.cfg.InboxNotebookName, userID)
+	return s.store.CreateNotebook(ctx, userID, s.cfg.InboxNotebookName, "快速记录的内容", map[string]interface{}{"inbox": true})
+}
+
+// quickNoteTitle derives a title from the first non-empty line of a snippet
+func quickNoteTitle(content string) string {
+	for _, line := range strings.Split(content, "\n") {
+		line = strings.TrimSpace(strings.TrimLeft(strings.TrimSpace(line), "#"))
+		if line == "" {
+			continue
+		}
+		runes := []rune(line)
+		if len(runes) > quickNoteTitleLength {
+			return string(runes[:quickNoteTitleLength]) + "..."
+		}
+		return line
+	}
+	return "快速记录"
+}
+
+// captureSource stores a source captured outside the notebook UI, logs the capture and indexes it.
+// activityLog only needs the user, action and client details; the resource fields are filled in.
+func (s *Server) captureSource(ctx context.Context, source *Source, activityLog *ActivityLog) error {
+	if err := s.checkLegalHold(ctx, source.NotebookID); err != nil {
+		return err
+	}
+	// Load the existing index first, otherwise loading it later would index this source twice
+	if err := s.loadNotebookVectorIndex(ctx, source.NotebookID); err != nil {
+		golog.Errorf("failed to load vector index: %v", err)
+	}
+
+	if err := s.store.CreateSource(ctx, source); err != nil {
+		return err
+	}
+
+	activityLog.ResourceType = "source"
+	activityLog.ResourceID = source.ID
+	activityLog.ResourceName = source.Name
+	activityLog.Details = fmt.Sprintf(`{"notebook_id": "%s", "source_type": "%s", "source_url": %q}`, source.NotebookID, source.Type, source.URL)
+	if err := s.store.LogActivity(ctx, activityLog); err != nil {
+		golog.Errorf("failed to log %s activity: %v", activityLog.Action, err)
+	}
+
+	s.ingestSourceText(ctx, source)
+	return nil
+}
+
+// handleQuickNote files a text snippet into the inbox notebook as a source and indexes it
+func (s *Server) handleQuickNote(c *gin.Context) {
+	ctx := context.Background()
+	userID := c.GetString("user_id")
+
+	var req QuickNoteRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+		return
+	}
+	if strings.TrimSpace(req.Content) == "" {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Content is required"})
+		return
+	}
+
+	notebook, err := s.inboxNotebook(ctx, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to get inbox notebook"})
+		return
+	}
+
+	title := strings.TrimSpace(req.Title)
+	if title == "" {
+		title = quickNoteTitle(req.Content)
+	}
+
+	source := &Source{
+		NotebookID: notebook.ID,
+		Name:       title,
+		Type:       "text",
+		URL:        req.URL,
+		Content:    req.Content,
+		Metadata:   map[string]interface{}{"quick_note": true},
+	}
+	activityLog := &ActivityLog{
+		UserID:    userID,
+		Action:    "quick_note",
+		IPAddress: c.ClientIP(),
+		UserAgent: c.GetHeader("User-Agent"),
+	}
+	if err := s.captureSource(ctx, source, activityLog); err != nil {
+		if err == errLegalHold {
+			c.JSON(http.StatusLocked, ErrorResponse{Error: "Notebook is under legal hold"})
+			return
+		}
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to create source"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, QuickNoteResponse{
+		NotebookID:   notebook.ID,
+		NotebookName: notebook.Name,
+		Source:       source,
+	})
+}
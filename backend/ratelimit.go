@@ -0,0 +1,294 @@
+package backend
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// rateLimiter counts what each user has used of the per-user limits in the current window.
+// Counts are kept in memory and start over when the server restarts, except for images, which
+// are counted from the usage table.
+type rateLimiter struct {
+	mu       sync.Mutex
+	counters map[limitKey]*limitCounter
+	// swept is when counters of ended windows were last dropped
+	swept time.Time
+}
+
+// rateLimiterSweepInterval is how often counters of ended windows are dropped, so that keys
+// seen once, such as the IP addresses of public visitors, don't pile up
+const rateLimiterSweepInterval = time.Minute
+
+type limitKey struct {
+	kind, userID string
+}
+
+// limitCounter is the use of a limit in the window ending at reset
+type limitCounter struct {
+	used  int64
+	reset time.Time
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{counters: make(map[limitKey]*limitCounter)}
+}
+
+// counter returns a user's counter of a limit, starting a window ending at reset if the last one
+// has ended. The caller holds l.mu.
+func (l *rateLimiter) counter(kind, userID string, reset time.Time) *limitCounter {
+	now := time.Now()
+	if now.Sub(l.swept) >= rateLimiterSweepInterval {
+		for key, counter := range l.counters {
+			if !now.Before(counter.reset) {
+				delete(l.counters, key)
+			}
+		}
+		l.swept = now
+	}
+
+	key := limitKey{kind, userID}
+	counter, ok := l.counters[key]
+	if !ok || !now.Before(counter.reset) {
+		counter = &limitCounter{reset: reset}
+		l.counters[key] = counter
+	}
+	return counter
+}
+
+// reserve counts amount against a user's limit unless that would go over it, returning the
+// total used in the current window and whether the amount was counted. A negative amount
+// reserves all that is left, and reports how much that is. Checking and counting at once keeps
+// parallel requests from all passing a check that only one of them should.
+func (l *rateLimiter) reserve(kind, userID string, reset time.Time, amount, limit int64) (int64, int64, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	counter := l.counter(kind, userID, reset)
+	if amount < 0 {
+		amount = limit - counter.used
+	}
+	if amount < 0 || counter.used+amount > limit || (amount == 0 && counter.used >= limit) {
+		return counter.used, 0, false
+	}
+	counter.used += amount
+	return counter.used, amount, true
+}
+
+// release gives back amount of a reservation made for the window ending at reset. A window
+// that has ended since is left alone.
+func (l *rateLimiter) release(kind, userID string, reset time.Time, amount int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if counter, ok := l.counters[limitKey{kind, userID}]; ok && counter.reset.Equal(reset) {
+		counter.used = max(counter.used-amount, 0)
+	}
+}
+
+// add counts amount against a user's limit and returns the total used in the current window
+func (l *rateLimiter) add(kind, userID string, reset time.Time, amount int64) int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	counter := l.counter(kind, userID, reset)
+	counter.used += amount
+	return counter.used
+}
+
+// nextMinute is when the per-minute window containing now ends
+func nextMinute(now time.Time) time.Time {
+	return now.Truncate(time.Minute).Add(time.Minute)
+}
+
+// nextDay is when the daily window containing now ends, at local midnight
+func nextDay(now time.Time) time.Time {
+	y, m, d := now.Date()
+	return time.Date(y, m, d+1, 0, 0, 0, 0, time.Local)
+}
+
+// setLimitHeaders reports a limit, what remains of it and when its window ends (in unix seconds)
+func setLimitHeaders(c *gin.Context, limit, remaining int64, reset time.Time) {
+	c.Header("X-RateLimit-Limit", strconv.FormatInt(limit, 10))
+	c.Header("X-RateLimit-Remaining", strconv.FormatInt(max(remaining, 0), 10))
+	c.Header("X-RateLimit-Reset", strconv.FormatInt(reset.Unix(), 10))
+}
+
+// abortLimited rejects a request that would go over a limit with 429 Too Many Requests
+func abortLimited(c *gin.Context, limit int64, reset time.Time, details string) {
+	setLimitHeaders(c, limit, 0, reset)
+	c.Header("Retry-After", strconv.Itoa(int(math.Ceil(time.Until(reset).Seconds()))))
+	c.AbortWithStatusJSON(http.StatusTooManyRequests, ErrorResponse{Error: "Rate limit exceeded", Details: details})
+}
+
+// rateLimit limits each user to RATE_LIMIT_PER_MINUTE API requests
+func (s *Server) rateLimit() gin.HandlerFunc {
+	limit := int64(s.cfg.RateLimitPerMinute)
+	return func(c *gin.Context) {
+		if limit <= 0 {
+			c.Next()
+			return
+		}
+		reset := nextMinute(time.Now())
+		used := s.limits.add("requests", c.GetString("user_id"), reset, 1)
+		if used > limit {
+			abortLimited(c, limit, reset, fmt.Sprintf("%d requests per minute", limit))
+			return
+		}
+		setLimitHeaders(c, limit, limit-used, reset)
+		c.Next()
+	}
+}
+
+// publicChatLimit limits each IP address to PUBLIC_CHAT_PER_MINUTE questions to public
+// notebooks, whose visitors aren't signed in
+func (s *Server) publicChatLimit() gin.HandlerFunc {
+	limit := int64(s.cfg.PublicChatPerMinute)
+	return func(c *gin.Context) {
+		if limit <= 0 {
+			c.Next()
+			return
+		}
+		reset := nextMinute(time.Now())
+		used := s.limits.add("public_chat_ip", c.ClientIP(), reset, 1)
+		if used > limit {
+			abortLimited(c, limit, reset, fmt.Sprintf("%d questions per minute", limit))
+			return
+		}
+		setLimitHeaders(c, limit, limit-used, reset)
+		c.Next()
+	}
+}
+
+// reservePublicChat counts a visitor's question against QUOTA_PUBLIC_CHATS_PER_DAY of the
+// notebook's owner, who pays for the answer, rejecting it if the owner's quota is used up. It
+// returns a function that gives the question back if it isn't answered.
+func (s *Server) reservePublicChat(c *gin.Context, ownerID string) (func(), bool) {
+	limit := int64(s.cfg.QuotaPublicChatsPerDay)
+	if limit <= 0 {
+		return func() {}, true
+	}
+	reset := nextDay(time.Now())
+	if _, _, ok := s.limits.reserve("public_chats", ownerID, reset, 1, limit); !ok {
+		abortLimited(c, limit, reset, "the owner's notebooks have answered all the questions they can today")
+		return nil, false
+	}
+	return func() { s.limits.release("public_chats", ownerID, reset, 1) }, true
+}
+
+// transformQuota limits each user to QUOTA_TRANSFORMS_PER_DAY transformations. A request
+// reserves its transformation before it runs, and gets it back unless the transformation starts.
+func (s *Server) transformQuota() gin.HandlerFunc {
+	limit := int64(s.cfg.QuotaTransformsPerDay)
+	return func(c *gin.Context) {
+		if limit <= 0 {
+			c.Next()
+			return
+		}
+		userID := c.GetString("user_id")
+		reset := nextDay(time.Now())
+		used, _, ok := s.limits.reserve("transformations", userID, reset, 1, limit)
+		if !ok {
+			abortLimited(c, limit, reset, fmt.Sprintf("%d transformations per day", limit))
+			return
+		}
+		setLimitHeaders(c, limit, limit-used, reset)
+		c.Next()
+		if c.Writer.Status() >= http.StatusMultipleChoices {
+			s.limits.release("transformations", userID, reset, 1)
+		}
+	}
+}
+
+// countingReader counts the bytes read from a request body, and fails reads past max
+type countingReader struct {
+	io.ReadCloser
+	n, max int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	if r.n >= r.max {
+		// Only the end of the body may follow
+		var b [1]byte
+		if n, err := r.ReadCloser.Read(b[:]); n == 0 {
+			return 0, err
+		}
+		return 0, fmt.Errorf("upload quota exceeded")
+	}
+	if int64(len(p)) > r.max-r.n {
+		p = p[:r.max-r.n]
+	}
+	n, err := r.ReadCloser.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+// uploadQuota limits each user to QUOTA_UPLOAD_MB_PER_DAY megabytes of uploads. An upload
+// reserves the size it declares before it is read, and one that declares no size, as chunked
+// bodies don't, reserves all that is left. Reading past the reservation fails, and what the
+// upload didn't use, or all of it if the upload fails, is given back.
+func (s *Server) uploadQuota() gin.HandlerFunc {
+	limit := int64(s.cfg.QuotaUploadMBPerDay) << 20
+	return func(c *gin.Context) {
+		if limit <= 0 {
+			c.Next()
+			return
+		}
+		userID := c.GetString("user_id")
+		reset := nextDay(time.Now())
+		used, reserved, ok := s.limits.reserve("upload_bytes", userID, reset, c.Request.ContentLength, limit)
+		if !ok {
+			abortLimited(c, limit>>20, reset, fmt.Sprintf("%d MB of uploads per day, %d MB left today",
+				limit>>20, max(limit-used, 0)>>20))
+			return
+		}
+		body := &countingReader{ReadCloser: c.Request.Body, max: reserved}
+		c.Request.Body = body
+		c.Next()
+		if c.Writer.Status() < http.StatusMultipleChoices {
+			s.limits.release("upload_bytes", userID, reset, reserved-body.n)
+		} else {
+			s.limits.release("upload_bytes", userID, reset, reserved)
+		}
+	}
+}
+
+// imageQuota limits each user to QUOTA_IMAGES_PER_DAY generated images, for routes that
+// generate images
+func (s *Server) imageQuota() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if s.checkImageQuota(c) {
+			c.Next()
+		}
+	}
+}
+
+// checkImageQuota rejects the request if the user has generated QUOTA_IMAGES_PER_DAY images
+// today, according to the usage table. A request under the quota may generate several images,
+// such as the slides of a deck, and go over it.
+func (s *Server) checkImageQuota(c *gin.Context) bool {
+	limit := int64(s.cfg.QuotaImagesPerDay)
+	if limit <= 0 {
+		return true
+	}
+	now := time.Now()
+	reset := nextDay(now)
+	y, m, d := now.Date()
+	totals, err := s.store.SumUsage(c.Request.Context(), c.GetString("user_id"), time.Date(y, m, d, 0, 0, 0, 0, time.Local), reset, "day")
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to load usage"})
+		return false
+	}
+	var images int64
+	for _, t := range totals {
+		images += int64(t.Images)
+	}
+	if images >= limit {
+		abortLimited(c, limit, reset, fmt.Sprintf("%d images per day", limit))
+		return false
+	}
+	return true
+}
@@ -0,0 +1,573 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kataras/golog"
+	"golang.org/x/net/html"
+)
+
+// Parsers of URL sources, stored as "parser" in the metadata of the source
+const (
+	URLParserMarkitdown  = "markitdown"  // The markitdown CLI, which converts the whole page
+	URLParserReadability = "readability" // Only the article, without navigation, footers and other boilerplate
+)
+
+// readabilityUserAgent is sent for pages read with readability, as some sites, such as WeChat,
+// only serve articles to browsers
+const readabilityUserAgent = "Mozilla/5.0 (compatible; " + crawlUserAgent + ")"
+
+// readabilityMinParagraph is the length, in characters, below which text doesn't count as a
+// paragraph of the article
+const readabilityMinParagraph = 25
+
+// Class names and IDs that tell the content of a page from its boilerplate
+var (
+	readabilityUnlikely = regexp.MustCompile(`(?i)banner|breadcrumb|combx|comment|community|cookie|disqus|extra|footer|header|legend|menu|modal|related|remark|replies|rss|share|shoutbox|sidebar|skyscraper|social|sponsor|ad-break|agegate|pagination|pager|popup|subscribe|recommend|copyright`)
+	readabilityMaybe    = regexp.MustCompile(`(?i)and|article|body|column|content|main|shadow|post|entry|text`)
+	readabilityPositive = regexp.MustCompile(`(?i)article|body|content|entry|hentry|h-entry|main|page|post|text|blog|story|rich_media|richtext`)
+	readabilityNegative = regexp.MustCompile(`(?i)-ad-|hidden|^hid$|banner|combx|comment|com-|contact|foot|footnote|gdpr|masthead|outbrain|promo|related|scroll|share|shoutbox|sidebar|skyscraper|sponsor|shopping|tags|tool|widget|recommend`)
+)
+
+// readabilityTitleSeparator splits a <title> into the page's title and the site's name
+var readabilityTitleSeparator = regexp.MustCompile(`\s+[|\-–—_»]\s+`)
+
+// readabilitySites are the sites whose articles are picked by their markup rather than by
+// scoring, as scoring reads them poorly. Selectors are "#id", ".class" or a tag name, and the
+// first that matches wins.
+var readabilitySites = []struct {
+	host    string   // The host or a domain it is under
+	content []string // All the elements a selector matches make up the article
+	title   []string
+	author  []string
+}{
+	// WeChat official account articles, whose text is in #js_content
+	{host: "mp.weixin.qq.com", content: []string{"#js_content"}, title: []string{"#activity-name", ".rich_media_title"}, author: []string{"#js_name", ".rich_media_meta_nickname"}},
+	// Zhihu columns
+	{host: "zhuanlan.zhihu.com", content: []string{".Post-RichText"}, title: []string{".Post-Title"}, author: []string{".AuthorInfo-name"}},
+	// Zhihu questions, with the answers shown
+	{host: "zhihu.com", content: []string{".RichContent-inner", ".RichText"}, title: []string{".QuestionHeader-title"}},
+}
+
+// readableArticle is the article of a web page
+type readableArticle struct {
+	Title   string
+	Author  string
+	Content string
+}
+
+// readArticle reads the article of a web page without its boilerplate, the way Readability
+// does: paragraphs score their parents by their length and commas, the best scored element
+// with the siblings that read like it is the article, and what is left of navigation, link
+// lists and sharing widgets is removed from it.
+func readArticle(ctx context.Context, pageURL string) (*readableArticle, error) {
+	doc, finalURL, err := fetchHTML(ctx, pageURL, readabilityUserAgent)
+	if err != nil {
+		return nil, err
+	}
+	body := findElement(doc, "body")
+	if body == nil {
+		return nil, fmt.Errorf("no text found on %s", pageURL)
+	}
+
+	article := &readableArticle{}
+	var content []*html.Node
+	host := strings.ToLower(finalURL.Hostname())
+	for _, site := range readabilitySites {
+		if host != site.host && !strings.HasSuffix(host, "."+site.host) {
+			continue
+		}
+		for _, selector := range site.content {
+			if content = selectElements(body, selector); len(content) > 0 {
+				break
+			}
+		}
+		article.Title = selectText(body, site.title)
+		article.Author = selectText(body, site.author)
+		break
+	}
+
+	removeReadabilityHidden(body)
+	if len(content) == 0 {
+		removeUnlikelyCandidates(body)
+		content = []*html.Node{readabilityContent(body)}
+	}
+
+	var text []string
+	for _, n := range content {
+		cleanReadabilityContent(n)
+		var buf bytes.Buffer
+		if err := html.Render(&buf, n); err != nil {
+			return nil, err
+		}
+		// Articles read like the storage format of Confluence pages
+		if t := strings.TrimSpace(confluenceText(buf.String())); t != "" {
+			text = append(text, t)
+		}
+	}
+	article.Content = strings.Join(text, "\n\n---\n\n")
+	if strings.TrimSpace(article.Content) == "" {
+		return nil, fmt.Errorf("no text found on %s", pageURL)
+	}
+
+	if article.Title == "" {
+		article.Title = readabilityTitle(doc)
+	}
+	if article.Author == "" {
+		article.Author = metaContent(doc, "author")
+	}
+	// The article starts with its title, unless its own heading is the title
+	if article.Title != "" && firstHeading(article.Content) != article.Title {
+		article.Content = "# " + article.Title + "\n\n" + article.Content
+	}
+	return article, nil
+}
+
+// readabilityTitle returns the title of a page: its Open Graph title, else its <title>
+// without the site's name, else its first <h1>
+func readabilityTitle(doc *html.Node) string {
+	if title := metaContent(doc, "og:title"); title != "" {
+		return title
+	}
+	if n := findElement(doc, "title"); n != nil {
+		title := nodeText(n)
+		if loc := readabilityTitleSeparator.FindAllStringIndex(title, -1); len(loc) > 0 {
+			// The site's name is after the last separator, unless the rest is too short to be a title
+			if head := strings.TrimSpace(title[:loc[len(loc)-1][0]]); utf8.RuneCountInString(head) >= 4 {
+				return head
+			}
+		}
+		if title != "" {
+			return title
+		}
+	}
+	if n := findElement(doc, "h1"); n != nil {
+		return nodeText(n)
+	}
+	return ""
+}
+
+// readabilityContent returns the element holding the article: the best scored candidate, with
+// its siblings that score nearly as well or are paragraphs of text, or the whole body if no
+// element scores
+func readabilityContent(body *html.Node) *html.Node {
+	scores := make(map[*html.Node]float64)
+	var order []*html.Node // Candidates in document order, for ties
+	addScore := func(n *html.Node, score float64) {
+		if n == nil || n.Type != html.ElementNode || n.Data == "html" {
+			return
+		}
+		if _, ok := scores[n]; !ok {
+			scores[n] = readabilityInitialScore(n)
+			order = append(order, n)
+		}
+		scores[n] += score
+	}
+
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.ElementNode && isReadabilityParagraph(n) {
+			text := nodeText(n)
+			if length := utf8.RuneCountInString(text); length >= readabilityMinParagraph {
+				score := 1 + float64(strings.Count(text, ",")+strings.Count(text, "，")+strings.Count(text, "、")) +
+					math.Min(float64(length)/100, 3)
+				// Parents get the paragraph's score, and their ancestors less of it
+				for level, ancestor := 0, n.Parent; level < 3 && ancestor != nil; level, ancestor = level+1, ancestor.Parent {
+					addScore(ancestor, score/float64(max(1, level*level+level)))
+				}
+			}
+			return
+		}
+		for child := n.FirstChild; child != nil; child = child.NextSibling {
+			walk(child)
+		}
+	}
+	walk(body)
+
+	var top *html.Node
+	for _, n := range order {
+		scores[n] *= 1 - linkDensity(n)
+		if top == nil || scores[n] > scores[top] {
+			top = n
+		}
+	}
+	if top == nil || top.Parent == nil {
+		return body
+	}
+
+	// Siblings that read like the article are part of it, such as the paragraphs after a
+	// heading split into elements of its own
+	threshold := math.Max(10, scores[top]*0.2)
+	article := &html.Node{Type: html.ElementNode, Data: "div"}
+	for sibling := top.Parent.FirstChild; sibling != nil; {
+		next := sibling.NextSibling
+		include := sibling == top
+		if !include && sibling.Type == html.ElementNode {
+			if score, ok := scores[sibling]; ok && score >= threshold {
+				include = true
+			} else if sibling.Data == "p" {
+				text := nodeText(sibling)
+				length := utf8.RuneCountInString(text)
+				density := linkDensity(sibling)
+				include = (length > 80 && density < 0.25) ||
+					(length > 0 && density == 0 && strings.ContainsAny(text, ".。!！?？"))
+			}
+		}
+		if include {
+			top.Parent.RemoveChild(sibling)
+			article.AppendChild(sibling)
+		}
+		sibling = next
+	}
+	return article
+}
+
+// readabilityInitialScore is the score an element starts with, from its tag and its class name
+// and ID
+func readabilityInitialScore(n *html.Node) float64 {
+	score := classWeight(n)
+	switch n.Data {
+	case "article", "main":
+		score += 10
+	case "div":
+		score += 5
+	case "pre", "td", "blockquote":
+		score += 3
+	case "address", "ol", "ul", "dl", "dd", "dt", "li", "form":
+		score -= 3
+	case "h1", "h2", "h3", "h4", "h5", "h6", "th":
+		score -= 5
+	}
+	return score
+}
+
+// isReadabilityParagraph reports whether an element is a paragraph of text, including divs
+// that only hold text and inline elements
+func isReadabilityParagraph(n *html.Node) bool {
+	switch n.Data {
+	case "p", "pre", "td", "blockquote", "li":
+		return true
+	case "div", "section":
+		for child := n.FirstChild; child != nil; child = child.NextSibling {
+			if child.Type == html.ElementNode && readabilityBlockElements[child.Data] {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+// readabilityBlockElements are the elements that make a div a container rather than a paragraph
+var readabilityBlockElements = map[string]bool{
+	"div": true, "section": true, "article": true, "p": true, "pre": true, "table": true, "blockquote": true,
+	"ul": true, "ol": true, "dl": true, "h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true,
+	"figure": true, "img": true, "header": true, "footer": true, "nav": true, "aside": true, "main": true,
+}
+
+// classWeight scores an element by whether its class name and ID look like content
+func classWeight(n *html.Node) float64 {
+	weight := 0.0
+	for _, value := range []string{attrValue(n, "class"), attrValue(n, "id")} {
+		if value == "" {
+			continue
+		}
+		if readabilityNegative.MatchString(value) {
+			weight -= 25
+		}
+		if readabilityPositive.MatchString(value) {
+			weight += 25
+		}
+	}
+	return weight
+}
+
+// linkDensity is the share of an element's text that is in links
+func linkDensity(n *html.Node) float64 {
+	length := utf8.RuneCountInString(nodeText(n))
+	if length == 0 {
+		return 0
+	}
+	linkLength := 0
+	for _, a := range selectElements(n, "a") {
+		linkLength += utf8.RuneCountInString(nodeText(a))
+	}
+	return float64(linkLength) / float64(length)
+}
+
+// removeReadabilityHidden removes the elements that are never content, and those hidden with
+// attributes or styles, except the article elements of readabilitySites, which scripts reveal
+func removeReadabilityHidden(n *html.Node) {
+	for child := n.FirstChild; child != nil; {
+		next := child.NextSibling
+		switch {
+		case child.Type == html.CommentNode:
+			n.RemoveChild(child)
+		case child.Type != html.ElementNode:
+		case crawlHiddenElements[child.Data] || child.Data == "iframe" || child.Data == "button" ||
+			attrValue(child, "aria-hidden") == "true" || hasAttr(child, "hidden") ||
+			strings.Contains(strings.ReplaceAll(attrValue(child, "style"), " ", ""), "display:none"):
+			n.RemoveChild(child)
+		default:
+			removeReadabilityHidden(child)
+		}
+		child = next
+	}
+}
+
+// removeUnlikelyCandidates removes the elements whose class name, ID or role says they are
+// boilerplate, such as comments, sidebars and sharing widgets
+func removeUnlikelyCandidates(n *html.Node) {
+	for child := n.FirstChild; child != nil; {
+		next := child.NextSibling
+		if child.Type == html.ElementNode {
+			match := attrValue(child, "class") + " " + attrValue(child, "id")
+			switch role := attrValue(child, "role"); {
+			case child.Data == "article" || child.Data == "main" || findElement(child, "article") != nil:
+				removeUnlikelyCandidates(child)
+			case readabilityUnlikely.MatchString(match) && !readabilityMaybe.MatchString(match),
+				role == "menu" || role == "menubar" || role == "complementary" || role == "navigation" ||
+					role == "alert" || role == "alertdialog" || role == "dialog":
+				n.RemoveChild(child)
+			default:
+				removeUnlikelyCandidates(child)
+			}
+		}
+		child = next
+	}
+}
+
+// cleanReadabilityContent removes what is left of the boilerplate from an article: containers
+// with a class name or ID that looks like boilerplate, and those that are mostly links
+func cleanReadabilityContent(n *html.Node) {
+	for child := n.FirstChild; child != nil; {
+		next := child.NextSibling
+		if child.Type == html.ElementNode {
+			switch child.Data {
+			case "div", "section", "ul", "ol", "table", "dl":
+				length := utf8.RuneCountInString(nodeText(child))
+				if (classWeight(child) < 0 && length < 500) || (linkDensity(child) > 0.5 && length < 1000) {
+					n.RemoveChild(child)
+					break
+				}
+				cleanReadabilityContent(child)
+			default:
+				cleanReadabilityContent(child)
+			}
+		}
+		child = next
+	}
+}
+
+// findElement returns the first element with a tag under n, or nil
+func findElement(n *html.Node, tag string) *html.Node {
+	if matches := selectElements(n, tag); len(matches) > 0 {
+		return matches[0]
+	}
+	return nil
+}
+
+// selectElements returns the elements under n that a selector matches, outermost only: "#id",
+// ".class" or a tag name
+func selectElements(n *html.Node, selector string) []*html.Node {
+	matches := func(el *html.Node) bool {
+		switch {
+		case strings.HasPrefix(selector, "#"):
+			return attrValue(el, "id") == selector[1:]
+		case strings.HasPrefix(selector, "."):
+			for _, class := range strings.Fields(attrValue(el, "class")) {
+				if class == selector[1:] {
+					return true
+				}
+			}
+			return false
+		default:
+			return el.Data == selector
+		}
+	}
+	var found []*html.Node
+	var walk func(el *html.Node)
+	walk = func(el *html.Node) {
+		for child := el.FirstChild; child != nil; child = child.NextSibling {
+			if child.Type != html.ElementNode {
+				continue
+			}
+			if matches(child) {
+				found = append(found, child)
+			} else {
+				walk(child)
+			}
+		}
+	}
+	walk(n)
+	return found
+}
+
+// selectText returns the text of the first element the selectors match
+func selectText(n *html.Node, selectors []string) string {
+	for _, selector := range selectors {
+		for _, el := range selectElements(n, selector) {
+			if text := nodeText(el); text != "" {
+				return text
+			}
+		}
+	}
+	return ""
+}
+
+// metaContent returns the content of a <meta> with a name or property, such as "author" or
+// "og:title"
+func metaContent(doc *html.Node, key string) string {
+	for _, meta := range selectElements(doc, "meta") {
+		if attrValue(meta, "name") == key || attrValue(meta, "property") == key {
+			return strings.Join(strings.Fields(attrValue(meta, "content")), " ")
+		}
+	}
+	return ""
+}
+
+// nodeText returns the text of an element with its whitespace collapsed
+func nodeText(n *html.Node) string {
+	var b strings.Builder
+	var walk func(n *html.Node)
+	walk = func(n *html.Node) {
+		if n.Type == html.TextNode {
+			b.WriteString(n.Data)
+			b.WriteByte(' ')
+		}
+		for child := n.FirstChild; child != nil; child = child.NextSibling {
+			walk(child)
+		}
+	}
+	walk(n)
+	return strings.Join(strings.Fields(b.String()), " ")
+}
+
+// hasAttr reports whether an HTML element has an attribute, whatever its value
+func hasAttr(n *html.Node, key string) bool {
+	for _, a := range n.Attr {
+		if a.Key == key {
+			return true
+		}
+	}
+	return false
+}
+
+// defaultURLParser is the parser of new URL sources: URL_PARSER, else markitdown when it is
+// enabled and readability otherwise
+func (s *Server) defaultURLParser() string {
+	if s.cfg.URLParser != "" {
+		return s.cfg.URLParser
+	}
+	if s.cfg.EnableMarkitdown {
+		return URLParserMarkitdown
+	}
+	return URLParserReadability
+}
+
+// urlSourceParser returns the parser a URL source is read with. Sources added before parsers
+// could be chosen were read with markitdown.
+func urlSourceParser(source *Source) string {
+	if parser, ok := source.Metadata["parser"].(string); ok && parser != "" {
+		return parser
+	}
+	return URLParserMarkitdown
+}
+
+// extractURL reads the page of a URL source with a parser, the source's own if parser is
+// empty, and records the parser in the source's metadata
+func (s *Server) extractURL(ctx context.Context, source *Source, parser string) (string, error) {
+	if parser == "" {
+		parser = urlSourceParser(source)
+	}
+	if source.Metadata == nil {
+		source.Metadata = make(map[string]interface{})
+	}
+
+	var content string
+	switch parser {
+	case URLParserMarkitdown:
+		var err error
+		if content, err = s.vectorStore.ExtractFromURL(ctx, source.URL); err != nil {
+			return "", err
+		}
+		delete(source.Metadata, "author")
+	case URLParserReadability:
+		article, err := readArticle(ctx, source.URL)
+		if err != nil {
+			return "", err
+		}
+		content = article.Content
+		if article.Author != "" {
+			source.Metadata["author"] = article.Author
+		} else {
+			delete(source.Metadata, "author")
+		}
+	default:
+		return "", fmt.Errorf("unknown URL parser: %s (supported: markitdown, readability)", parser)
+	}
+	source.Metadata["parser"] = parser
+	return content, nil
+}
+
+// handleReextractSource reads the page of a URL source again with another parser, such as
+// readability for a page markitdown filled with navigation, keeping the previous content as a
+// version
+func (s *Server) handleReextractSource(c *gin.Context) {
+	source, ok := s.getSourceInNotebook(c)
+	if !ok {
+		return
+	}
+	var req struct {
+		Parser string `json:"parser"` // Empty reads the page again with the source's parser
+	}
+	if err := c.ShouldBindJSON(&req); err != nil && err != io.EOF {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+		return
+	}
+	if req.Parser != "" && req.Parser != URLParserMarkitdown && req.Parser != URLParserReadability {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: fmt.Sprintf("unknown parser: %s (supported: markitdown, readability)", req.Parser)})
+		return
+	}
+	// Papers resolve to a downloaded PDF, and crawled pages are read by the crawler
+	if source.Type != "url" || source.URL == "" || source.FileName != "" || isCrawledPage(source) {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Only the pages of URL sources can be extracted again"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	previous := urlSourceParser(source)
+	content, err := s.extractURL(ctx, source, req.Parser)
+	if err != nil {
+		golog.Errorf("failed to extract URL content: %v", err)
+		c.JSON(http.StatusBadGateway, ErrorResponse{Error: "Failed to fetch URL content", Details: err.Error()})
+		return
+	}
+
+	version, err := s.replaceSourceContent(ctx, source, content, source.FileName, source.FileSize)
+	if err == nil && version == nil && urlSourceParser(source) != previous {
+		// The content is the same, but the parser still changed
+		err = s.store.UpdateSource(ctx, source)
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to update source", Details: err.Error()})
+		return
+	}
+	// The stored content is the page as it is now
+	if err := s.store.SaveSourceHealth(ctx, source.ID, &SourceHealth{Status: SourceHealthOK, CheckedAt: time.Now()}); err != nil {
+		golog.Errorf("failed to reset health of source %s: %v", source.ID, err)
+	}
+	s.logSourceChange(c, "reextract_source", source, version)
+
+	c.JSON(http.StatusOK, sourceRefreshResponse{Source: summarizeSources([]Source{*source})[0], Changed: version != nil, Version: version})
+}
@@ -0,0 +1,72 @@
+package backend
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// withSourceReads returns copies of the sources annotated with the user's read state.
+// The input slice is not modified since it may be shared with the cache.
+func (s *Server) withSourceReads(ctx context.Context, userID, notebookID string, sources []Source) ([]Source, error) {
+	reads, err := s.store.ListSourceReads(ctx, userID, notebookID)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]Source, len(sources))
+	for i, src := range sources {
+		if readAt, ok := reads[src.ID]; ok {
+			src.ReadAt = &readAt
+		}
+		result[i] = src
+	}
+	return result, nil
+}
+
+// unreadSources filters sources down to those the user hasn't opened yet
+func (s *Server) unreadSources(ctx context.Context, userID, notebookID string, sources []Source) ([]Source, error) {
+	reads, err := s.store.ListSourceReads(ctx, userID, notebookID)
+	if err != nil {
+		return nil, err
+	}
+
+	unread := make([]Source, 0, len(sources))
+	for _, src := range sources {
+		if _, ok := reads[src.ID]; !ok {
+			unread = append(unread, src)
+		}
+	}
+	return unread, nil
+}
+
+// handleMarkSourceRead marks a source as read by the current user
+func (s *Server) handleMarkSourceRead(c *gin.Context) {
+	source, ok := s.getSourceInNotebook(c)
+	if !ok {
+		return
+	}
+
+	if err := s.store.MarkSourceRead(c.Request.Context(), c.GetString("user_id"), source.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to mark source as read"})
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
+
+// handleMarkSourceUnread clears the current user's read state for a source
+func (s *Server) handleMarkSourceUnread(c *gin.Context) {
+	source, ok := s.getSourceInNotebook(c)
+	if !ok {
+		return
+	}
+
+	if err := s.store.MarkSourceUnread(c.Request.Context(), c.GetString("user_id"), source.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to mark source as unread"})
+		return
+	}
+
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,308 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kataras/golog"
+)
+
+const (
+	semanticScholarRecommendationsURL = "https://api.semanticscholar.org/recommendations/v1/papers"
+	crossrefWorksURL                  = "https://api.crossref.org/works"
+)
+
+// relatedPapersMaxSeeds bounds how many paper sources are searched on Crossref, one query each
+const relatedPapersMaxSeeds = 5
+
+// paperSeed is a notebook paper source that related papers are looked up from
+type paperSeed struct {
+	ref     Reference
+	doi     string
+	arxivID string
+}
+
+// notebookPaperSeeds returns the paper sources of a notebook: sources with a reference that
+// has a DOI or an arXiv identifier
+func notebookPaperSeeds(sources []Source) []paperSeed {
+	var seeds []paperSeed
+	for i := range sources {
+		if _, ok := sources[i].Metadata["reference"]; !ok {
+			continue
+		}
+		seed := paperSeed{ref: sourceReference(&sources[i])}
+		for _, id := range []string{seed.ref.Key, seed.ref.DOI} {
+			switch kind, value := parsePaperID(id); kind {
+			case "arxiv":
+				seed.arxivID = strings.ToLower(value)
+			case "doi":
+				seed.doi = strings.ToLower(value)
+			}
+		}
+		if seed.doi != "" || seed.arxivID != "" {
+			seeds = append(seeds, seed)
+		}
+	}
+	return seeds
+}
+
+// arxivBaseID drops the version suffix of an arXiv identifier
+func arxivBaseID(id string) string {
+	if m := arxivIDPattern.FindStringSubmatch(id); m != nil {
+		return m[1]
+	}
+	return id
+}
+
+// semanticScholarPaper is the subset of a Semantic Scholar paper record the suggestions use
+type semanticScholarPaper struct {
+	Title   string `json:"title"`
+	Year    int    `json:"year"`
+	Venue   string `json:"venue"`
+	URL     string `json:"url"`
+	Authors []struct {
+		Name string `json:"name"`
+	} `json:"authors"`
+	Abstract      string            `json:"abstract"`
+	CitationCount int               `json:"citationCount"`
+	ExternalIDs   map[string]string `json:"externalIds"`
+}
+
+// semanticScholarRelated asks the Semantic Scholar recommendations API for papers related to the seeds
+func (s *Server) semanticScholarRelated(ctx context.Context, seeds []paperSeed, limit int) ([]RelatedPaper, error) {
+	ids := make([]string, 0, len(seeds))
+	for _, seed := range seeds {
+		if seed.arxivID != "" {
+			ids = append(ids, "ARXIV:"+arxivBaseID(seed.arxivID))
+		} else {
+			ids = append(ids, "DOI:"+seed.doi)
+		}
+	}
+	payload, err := json.Marshal(map[string]any{"positivePaperIds": ids})
+	if err != nil {
+		return nil, err
+	}
+
+	endpoint := fmt.Sprintf("%s?fields=title,year,venue,url,authors,abstract,citationCount,externalIds&limit=%d", semanticScholarRecommendationsURL, limit)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if s.cfg.SemanticScholarAPIKey != "" {
+		req.Header.Set("x-api-key", s.cfg.SemanticScholarAPIKey)
+	}
+	resp, err := paperHTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("semantic scholar returned %s", resp.Status)
+	}
+
+	var result struct {
+		RecommendedPapers []semanticScholarPaper `json:"recommendedPapers"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 4<<20)).Decode(&result); err != nil {
+		return nil, fmt.Errorf("invalid semantic scholar response: %w", err)
+	}
+
+	papers := make([]RelatedPaper, 0, len(result.RecommendedPapers))
+	for _, p := range result.RecommendedPapers {
+		ref := Reference{
+			Key:       firstNonEmpty(p.ExternalIDs["DOI"], p.ExternalIDs["ArXiv"]),
+			EntryType: "article",
+			Title:     collapseSpace(p.Title),
+			Venue:     p.Venue,
+			DOI:       p.ExternalIDs["DOI"],
+			URL:       p.URL,
+			Abstract:  p.Abstract,
+		}
+		if p.Year > 0 {
+			ref.Year = strconv.Itoa(p.Year)
+		}
+		for _, a := range p.Authors {
+			ref.Authors = append(ref.Authors, invertName(a.Name))
+		}
+		// arXiv IDs are preferred since every arXiv paper comes with its PDF
+		id := firstNonEmpty(p.ExternalIDs["ArXiv"], p.ExternalIDs["DOI"])
+		papers = append(papers, RelatedPaper{ID: id, Reference: ref, Citations: p.CitationCount})
+	}
+	return papers, nil
+}
+
+// crossrefWork is the subset of a Crossref work record the suggestions use
+type crossrefWork struct {
+	DOI            string   `json:"DOI"`
+	Type           string   `json:"type"`
+	Title          []string `json:"title"`
+	ContainerTitle []string `json:"container-title"`
+	Publisher      string   `json:"publisher"`
+	Abstract       string   `json:"abstract"`
+	URL            string   `json:"URL"`
+	Citations      int      `json:"is-referenced-by-count"`
+	Author         []struct {
+		Given  string `json:"given"`
+		Family string `json:"family"`
+		Name   string `json:"name"`
+	} `json:"author"`
+	Issued struct {
+		DateParts [][]int `json:"date-parts"`
+	} `json:"issued"`
+}
+
+// crossrefEntryTypes maps Crossref work types to BibTeX entry types
+var crossrefEntryTypes = map[string]string{
+	"journal-article":     "article",
+	"proceedings-article": "inproceedings",
+	"book":                "book",
+	"monograph":           "book",
+	"book-chapter":        "incollection",
+	"dissertation":        "phdthesis",
+	"report":              "techreport",
+}
+
+// crossrefRelated searches Crossref for works matching the title and keywords of each seed.
+// It is the fallback when Semantic Scholar doesn't know the seeds or is unavailable.
+func crossrefRelated(ctx context.Context, seeds []paperSeed, limit int) ([]RelatedPaper, error) {
+	if len(seeds) > relatedPapersMaxSeeds {
+		seeds = seeds[:relatedPapersMaxSeeds]
+	}
+	rows := limit/len(seeds) + 1
+
+	var papers []RelatedPaper
+	var lastErr error
+	for _, seed := range seeds {
+		query := url.Values{}
+		query.Set("query.bibliographic", strings.TrimSpace(seed.ref.Title+" "+seed.ref.Keywords))
+		query.Set("rows", strconv.Itoa(rows+1)) // The seed itself usually comes back first
+		query.Set("select", "DOI,type,title,container-title,publisher,abstract,URL,is-referenced-by-count,author,issued")
+
+		body, err := paperGet(ctx, crossrefWorksURL+"?"+query.Encode(), "application/json", 4<<20)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		var result struct {
+			Message struct {
+				Items []crossrefWork `json:"items"`
+			} `json:"message"`
+		}
+		if err := json.Unmarshal(body, &result); err != nil {
+			lastErr = fmt.Errorf("invalid crossref response: %w", err)
+			continue
+		}
+
+		for _, w := range result.Message.Items {
+			if len(w.Title) == 0 || w.DOI == "" {
+				continue
+			}
+			ref := Reference{
+				Key:       w.DOI,
+				EntryType: firstNonEmpty(crossrefEntryTypes[w.Type], "misc"),
+				Title:     collapseSpace(w.Title[0]),
+				Publisher: w.Publisher,
+				DOI:       w.DOI,
+				URL:       w.URL,
+				Abstract:  stripJATS(w.Abstract),
+			}
+			if len(w.ContainerTitle) > 0 {
+				ref.Venue = w.ContainerTitle[0]
+			}
+			if len(w.Issued.DateParts) > 0 && len(w.Issued.DateParts[0]) > 0 {
+				ref.Year = strconv.Itoa(w.Issued.DateParts[0][0])
+			}
+			for _, a := range w.Author {
+				switch {
+				case a.Name != "":
+					ref.Authors = append(ref.Authors, a.Name)
+				case a.Given != "":
+					ref.Authors = append(ref.Authors, a.Family+", "+a.Given)
+				default:
+					ref.Authors = append(ref.Authors, a.Family)
+				}
+			}
+			papers = append(papers, RelatedPaper{ID: w.DOI, Reference: ref, Citations: w.Citations})
+		}
+	}
+	if len(papers) == 0 && lastErr != nil {
+		return nil, lastErr
+	}
+	return papers, nil
+}
+
+// handleRelatedPapers suggests papers related to a notebook's paper sources. Each suggestion's ID
+// can be added as a URL source, which imports the paper with its metadata and PDF.
+func (s *Server) handleRelatedPapers(c *gin.Context) {
+	ctx, cancel := requestContext(c)
+	defer cancel()
+	notebookID := c.Param("id")
+	userID := c.GetString("user_id")
+	if err := s.checkNotebookAccess(ctx, notebookID, userID); err != nil {
+		c.JSON(http.StatusForbidden, ErrorResponse{Error: "Access denied"})
+		return
+	}
+
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "10"))
+	if limit <= 0 || limit > 50 {
+		limit = 10
+	}
+
+	sources, err := s.store.ListSources(ctx, notebookID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to list sources"})
+		return
+	}
+	seeds := notebookPaperSeeds(sources)
+	if len(seeds) == 0 {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "No paper sources", Details: "add papers by arXiv ID or DOI, or import a bibliography, to get suggestions"})
+		return
+	}
+
+	// Ask for extra papers since the ones already in the notebook are dropped
+	response := RelatedPapersResponse{Provider: "semantic_scholar"}
+	papers, err := s.semanticScholarRelated(ctx, seeds, limit+len(seeds))
+	if err != nil || len(papers) == 0 {
+		if err != nil {
+			golog.Warnf("semantic scholar recommendations failed, falling back to crossref: %v", err)
+		}
+		response.Provider = "crossref"
+		papers, err = crossrefRelated(ctx, seeds, limit+len(seeds))
+		if err != nil {
+			c.JSON(http.StatusBadGateway, ErrorResponse{Error: "Failed to find related papers", Details: err.Error()})
+			return
+		}
+	}
+
+	known := make(map[string]bool)
+	for _, seed := range seeds {
+		known[seed.doi] = seed.doi != ""
+		known[arxivBaseID(seed.arxivID)] = seed.arxivID != ""
+	}
+	response.Papers = make([]RelatedPaper, 0, limit)
+	for _, p := range papers {
+		if p.ID == "" || p.Reference.Title == "" {
+			continue
+		}
+		id := strings.ToLower(p.ID)
+		if known[id] || known[strings.ToLower(p.Reference.DOI)] {
+			continue
+		}
+		known[id] = true
+		response.Papers = append(response.Papers, p)
+		if len(response.Papers) == limit {
+			break
+		}
+	}
+
+	c.JSON(http.StatusOK, response)
+}
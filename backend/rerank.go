@@ -0,0 +1,296 @@
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kataras/golog"
+	"github.com/tmc/langchaingo/schema"
+)
+
+// ollamaRerankWorkers is how many chunks an Ollama reranker scores at once
+const ollamaRerankWorkers = 4
+
+// reranker scores retrieved passages by their relevance to a query, higher is better. It
+// returns one score per passage, in the order given.
+type reranker interface {
+	score(ctx context.Context, query string, passages []string) ([]float64, error)
+}
+
+// newReranker creates the reranker configured by RERANK_PROVIDER, or nil if reranking is off
+func newReranker(cfg Config) reranker {
+	switch cfg.RerankProvider {
+	case "cohere":
+		return &apiReranker{
+			url:    firstNonEmpty(cfg.RerankURL, "https://api.cohere.com/v2/rerank"),
+			apiKey: cfg.RerankAPIKey,
+			model:  firstNonEmpty(cfg.RerankModel, "rerank-v3.5"),
+		}
+	case "jina":
+		return &apiReranker{
+			url:    firstNonEmpty(cfg.RerankURL, "https://api.jina.ai/v1/rerank"),
+			apiKey: cfg.RerankAPIKey,
+			model:  firstNonEmpty(cfg.RerankModel, "jina-reranker-v2-base-multilingual"),
+		}
+	case "ollama":
+		return &ollamaReranker{
+			url:   strings.TrimRight(firstNonEmpty(cfg.RerankURL, cfg.OllamaBaseURL), "/") + "/api/generate",
+			model: firstNonEmpty(cfg.RerankModel, cfg.OllamaModel),
+		}
+	}
+	return nil
+}
+
+// apiReranker calls a hosted rerank API. Cohere and Jina take the same request and return the
+// same response, as do self-hosted servers compatible with them.
+type apiReranker struct {
+	url    string
+	apiKey string
+	model  string
+}
+
+func (r *apiReranker) score(ctx context.Context, query string, passages []string) ([]float64, error) {
+	var response struct {
+		Results []struct {
+			Index          int     `json:"index"`
+			RelevanceScore float64 `json:"relevance_score"`
+		} `json:"results"`
+	}
+	body := map[string]any{
+		"model":     r.model,
+		"query":     query,
+		"documents": passages,
+		"top_n":     len(passages),
+	}
+	header := http.Header{}
+	if r.apiKey != "" {
+		header.Set("Authorization", "Bearer "+r.apiKey)
+	}
+	data, err := postJSON(ctx, http.MethodPost, r.url, body, header)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &response); err != nil {
+		return nil, fmt.Errorf("invalid rerank response: %w", err)
+	}
+
+	// Passages the reranker left out rank last
+	scores := make([]float64, len(passages))
+	for i := range scores {
+		scores[i] = -1
+	}
+	for _, result := range response.Results {
+		if result.Index >= 0 && result.Index < len(scores) {
+			scores[result.Index] = result.RelevanceScore
+		}
+	}
+	return scores, nil
+}
+
+// ollamaScore finds the score in an Ollama model's reply
+var ollamaScore = regexp.MustCompile(`\d+(?:\.\d+)?`)
+
+// ollamaReranker has a local Ollama model rate each passage, acting as a cross-encoder: the
+// model reads the query and the passage together
+type ollamaReranker struct {
+	url   string
+	model string
+}
+
+func (r *ollamaReranker) score(ctx context.Context, query string, passages []string) ([]float64, error) {
+	scores := make([]float64, len(passages))
+	errs := make([]error, len(passages))
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for range min(ollamaRerankWorkers, len(passages)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				scores[i], errs[i] = r.scoreOne(ctx, query, passages[i])
+			}
+		}()
+	}
+	for i := range passages {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+	return scores, nil
+}
+
+func (r *ollamaReranker) scoreOne(ctx context.Context, query, passage string) (float64, error) {
+	var response struct {
+		Response string `json:"response"`
+	}
+	body := map[string]any{
+		"model":   r.model,
+		"prompt":  rerankRelevancePrompt(query, passage),
+		"stream":  false,
+		"options": map[string]any{"temperature": 0},
+	}
+	data, err := postJSON(ctx, http.MethodPost, r.url, body, nil)
+	if err != nil {
+		return 0, err
+	}
+	if err := json.Unmarshal(data, &response); err != nil {
+		return 0, fmt.Errorf("invalid ollama response: %w", err)
+	}
+	match := ollamaScore.FindString(response.Response)
+	if match == "" {
+		// A reply without a score ranks the passage last rather than failing the rerank
+		return -1, nil
+	}
+	// The model rates from 0 to 10; scores are kept from 0 to 1 like the rerank APIs'
+	score, err := strconv.ParseFloat(match, 64)
+	return math.Min(score, 10) / 10, err
+}
+
+// retrievalDefaults returns the retrieval settings of notebooks that don't set their own: with
+// a reranker, RERANK_CANDIDATES chunks are searched for it to pick MAX_SOURCES from
+func retrievalDefaults(cfg Config) *ChatSettings {
+	defaults := &ChatSettings{TopK: cfg.MaxSources, ScoreThreshold: cfg.ScoreThreshold, MaxContextChunks: cfg.MaxSources}
+	if cfg.RerankProvider != "" && cfg.RerankCandidates > cfg.MaxSources {
+		defaults.TopK = cfg.RerankCandidates
+	}
+	return defaults
+}
+
+// rerankedKey marks the metadata of chunks Retrieve scored with the reranker
+const rerankedKey = "reranked"
+
+// retrievalScore returns the best relevance score of retrieved docs, from 0 to 1, and whether
+// the docs are scored at all: by the vector store's similarity, or by the reranker unless it
+// failed. The in-memory keyword search leaves Score unset.
+func (a *Agent) retrievalScore(docs []schema.Document) (float64, bool) {
+	best, scored := 0.0, a.vectorStore.hasScores()
+	for i, doc := range docs {
+		if i == 0 || float64(doc.Score) > best {
+			best = float64(doc.Score)
+		}
+		if reranked, _ := doc.Metadata[rerankedKey].(bool); reranked {
+			scored = true
+		}
+	}
+	return best, scored
+}
+
+// Retrieve searches a notebook for the chunks most relevant to a query, following the
+// notebook's retrieval settings; nil settings use the defaults. It searches TopK chunks, drops
+// those below ScoreThreshold and keeps MaxContextChunks of the rest. With a reranker, the kept
+// chunks are the ones it scores highest, and their Score is the reranker's; if reranking fails,
+// the search order is kept. Long sources with a summary layer are searched through their
+// summaries first. With CHUNK_NEIGHBORS, each kept chunk is widened with the chunks around it.
+func (a *Agent) Retrieve(ctx context.Context, notebookID, query string, settings *ChatSettings) ([]schema.Document, error) {
+	defer recordTiming(ctx, stageRetrieval, time.Now())
+	docs, err := a.retrieveChunks(ctx, notebookID, query, settings)
+	if err != nil || a.cfg.ChunkNeighbors <= 0 {
+		return docs, err
+	}
+	return a.expandNeighbors(ctx, notebookID, docs), nil
+}
+
+// retrieveChunks searches and reranks the chunks for Retrieve
+func (a *Agent) retrieveChunks(ctx context.Context, notebookID, query string, settings *ChatSettings) ([]schema.Document, error) {
+	r := *retrievalDefaults(a.cfg)
+	if settings != nil {
+		if settings.TopK > 0 {
+			r.TopK = settings.TopK
+		}
+		if settings.ScoreThreshold > 0 {
+			r.ScoreThreshold = settings.ScoreThreshold
+		}
+		if settings.MaxContextChunks > 0 {
+			r.MaxContextChunks = settings.MaxContextChunks
+		}
+	}
+
+	var section *chunkSpan
+	var hidden map[string]bool
+	if settings != nil {
+		section = settings.section
+		hidden = settings.hiddenSources
+	}
+	numDocs := max(r.TopK, r.MaxContextChunks)
+	if len(hidden) > 0 {
+		// Hidden sources are dropped after the search, which searches more to make up for them
+		numDocs *= 2
+	}
+	var docs []schema.Document
+	var err error
+	if section != nil {
+		docs, err = a.searchSection(ctx, notebookID, query, section, numDocs)
+	} else {
+		docs, err = a.searchChunks(ctx, notebookID, query, numDocs)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(hidden) > 0 {
+		kept := docs[:0]
+		for _, doc := range docs {
+			if sourceID, _ := doc.Metadata["source_id"].(string); !hidden[sourceID] {
+				kept = append(kept, doc)
+			}
+		}
+		docs = kept
+	}
+	// A question about a section keeps the section's passages however weakly they match
+	if r.ScoreThreshold > 0 && section == nil && a.vectorStore.hasScores() {
+		kept := docs[:0]
+		for _, doc := range docs {
+			if float64(doc.Score) >= r.ScoreThreshold {
+				kept = append(kept, doc)
+			}
+		}
+		docs = kept
+	}
+	if a.reranker == nil || len(docs) == 0 {
+		return docs[:min(len(docs), r.MaxContextChunks)], nil
+	}
+	passages := make([]string, len(docs))
+	for i, doc := range docs {
+		passages[i] = doc.PageContent
+	}
+	scores, err := a.reranker.score(ctx, query, passages)
+	if err != nil {
+		golog.Warnf("rerank failed, using search order: %v", err)
+		return docs[:min(len(docs), r.MaxContextChunks)], nil
+	}
+
+	order := make([]int, len(docs))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool { return scores[order[i]] > scores[order[j]] })
+
+	reranked := make([]schema.Document, 0, r.MaxContextChunks)
+	for _, i := range order[:min(len(order), r.MaxContextChunks)] {
+		// The metadata map may be the vector store's own, so it is copied before marking
+		doc := docs[i]
+		doc.Score = float32(scores[i])
+		doc.Metadata = maps.Clone(doc.Metadata)
+		if doc.Metadata == nil {
+			doc.Metadata = map[string]any{}
+		}
+		doc.Metadata[rerankedKey] = true
+		reranked = append(reranked, doc)
+	}
+	return reranked, nil
+}
@@ -0,0 +1,346 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/kataras/golog"
+)
+
+// s3EmptyPayloadHash is the SHA-256 of an empty request body
+const s3EmptyPayloadHash = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+
+// s3Object is an object in a ListObjectsV2 response
+type s3Object struct {
+	Key  string `xml:"Key"`
+	ETag string `xml:"ETag"`
+	Size int64  `xml:"Size"`
+}
+
+// s3Client reads and writes a bucket, signing requests with AWS Signature Version 4
+type s3Client struct {
+	scheme    string
+	host      string
+	basePath  string // "/bucket" when the bucket is addressed path-style, otherwise empty
+	region    string
+	accessKey string
+	secretKey string
+}
+
+// newS3Client addresses the bucket virtual-hosted on AWS, or path-style on a custom endpoint
+func newS3Client(settings ConnectorSettings, secret string) (*s3Client, error) {
+	client := &s3Client{
+		scheme:    "https",
+		host:      settings.Bucket + ".s3." + settings.Region + ".amazonaws.com",
+		region:    settings.Region,
+		accessKey: settings.AccessKeyID,
+		secretKey: secret,
+	}
+	if settings.Endpoint != "" {
+		u, err := url.Parse(settings.Endpoint)
+		if err != nil {
+			return nil, fmt.Errorf("invalid endpoint: %w", err)
+		}
+		client.scheme = u.Scheme
+		client.host = u.Host
+		client.basePath = strings.TrimRight(u.Path, "/") + "/" + settings.Bucket
+	}
+	return client, nil
+}
+
+// awsEscape percent-encodes everything but unreserved characters, and slashes if keepSlash,
+// as Signature Version 4 requires
+func awsEscape(s string, keepSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' || c == '/' && keepSlash {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// s3Query encodes query parameters in the sorted form Signature Version 4 signs
+func s3Query(query map[string]string) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	pairs := make([]string, len(keys))
+	for i, k := range keys {
+		pairs[i] = awsEscape(k, false) + "=" + awsEscape(query[k], false)
+	}
+	return strings.Join(pairs, "&")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// sign adds the Signature Version 4 headers to a request whose body has the given SHA-256.
+// Requests to a public bucket, without an access key, are sent unsigned.
+func (c *s3Client) sign(req *http.Request, payloadHash string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if c.accessKey == "" {
+		return
+	}
+
+	const signedHeaders = "host;x-amz-content-sha256;x-amz-date"
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		"host:" + req.URL.Host + "\nx-amz-content-sha256:" + payloadHash + "\nx-amz-date:" + amzDate + "\n",
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := amzDate[:8] + "/" + c.region + "/s3/aws4_request"
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+
+	key := hmacSHA256([]byte("AWS4"+c.secretKey), amzDate[:8])
+	for _, part := range []string{c.region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		c.accessKey, scope, signedHeaders, signature))
+}
+
+// do sends a signed request for an object key, or for the bucket if key is empty, and returns
+// the response if it succeeded
+func (c *s3Client) do(ctx context.Context, method, key string, query map[string]string, body []byte) (*http.Response, error) {
+	p := c.basePath + "/" + key
+	req, err := http.NewRequestWithContext(ctx, method, "", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.URL = &url.URL{Scheme: c.scheme, Host: c.host, Path: p, RawPath: awsEscape(p, true), RawQuery: s3Query(query)}
+	req.Host = c.host
+	req.ContentLength = int64(len(body))
+	payloadHash := s3EmptyPayloadHash
+	if len(body) > 0 {
+		sum := sha256.Sum256(body)
+		payloadHash = hex.EncodeToString(sum[:])
+	}
+	c.sign(req, payloadHash, time.Now())
+
+	resp, err := integrationHTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusOK {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	var s3Err struct {
+		Code    string `xml:"Code"`
+		Message string `xml:"Message"`
+	}
+	xml.NewDecoder(io.LimitReader(resp.Body, 4096)).Decode(&s3Err)
+	return nil, fmt.Errorf("s3 returned %s: %s %s", resp.Status, s3Err.Code, s3Err.Message)
+}
+
+// list returns a page of the objects under a prefix, and the token of the next page if there is one
+func (c *s3Client) list(ctx context.Context, prefix, token string) ([]s3Object, string, error) {
+	query := map[string]string{"list-type": "2", "prefix": prefix}
+	if token != "" {
+		query["continuation-token"] = token
+	}
+	resp, err := c.do(ctx, http.MethodGet, "", query, nil)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+
+	var page struct {
+		Contents              []s3Object `xml:"Contents"`
+		IsTruncated           bool       `xml:"IsTruncated"`
+		NextContinuationToken string     `xml:"NextContinuationToken"`
+	}
+	if err := xml.NewDecoder(resp.Body).Decode(&page); err != nil {
+		return nil, "", fmt.Errorf("failed to decode bucket listing: %w", err)
+	}
+	if !page.IsTruncated {
+		return page.Contents, "", nil
+	}
+	return page.Contents, page.NextContinuationToken, nil
+}
+
+// download saves an object to a file and returns its size
+func (c *s3Client) download(ctx context.Context, key, path string) (int64, error) {
+	resp, err := c.do(ctx, http.MethodGet, key, nil, nil)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	file, err := os.Create(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	size, err := io.Copy(file, io.LimitReader(resp.Body, connectorMaxFileSize+1))
+	if err != nil {
+		return 0, err
+	}
+	if size > connectorMaxFileSize {
+		return 0, fmt.Errorf("file larger than 50MB")
+	}
+	return size, nil
+}
+
+// put uploads an object
+func (c *s3Client) put(ctx context.Context, key string, body []byte) error {
+	resp, err := c.do(ctx, http.MethodPut, key, nil, body)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// syncS3 imports the objects under the connector's prefix that are new or changed since the
+// last sync. The bucket is listed in full each time, and objects deleted from it are removed
+// from the notebook.
+func (s *Server) syncS3(ctx context.Context, connector *Connector, result *ConnectorSyncResult) error {
+	client, err := newS3Client(connector.Settings, connector.Secret)
+	if err != nil {
+		return err
+	}
+
+	listed := make(map[string]bool)
+	token := ""
+	for {
+		objects, next, err := client.list(ctx, connector.Settings.Prefix, token)
+		if err != nil {
+			return err
+		}
+		for i := range objects {
+			listed[objects[i].Key] = true
+			if err := s.syncS3Object(ctx, client, connector, &objects[i], result); err != nil {
+				return err
+			}
+		}
+		if next == "" {
+			break
+		}
+		token = next
+	}
+
+	keys, err := s.store.ListConnectorItemKeys(ctx, connector.ID)
+	if err != nil {
+		return err
+	}
+	for _, key := range keys {
+		if listed[key] {
+			continue
+		}
+		removed, err := s.removeConnectorItem(ctx, connector, key)
+		if err != nil {
+			return err
+		}
+		if removed {
+			result.Removed++
+		}
+	}
+	return nil
+}
+
+// syncS3Object imports or updates the source of one object. An object that fails to download
+// or extract is skipped, and tried again on the next sync.
+func (s *Server) syncS3Object(ctx context.Context, client *s3Client, connector *Connector, object *s3Object, result *ConnectorSyncResult) error {
+	name := path.Base(object.Key)
+	if strings.HasSuffix(object.Key, "/") || !s.connectorImportable(name) {
+		return nil
+	}
+	if object.Size > connectorMaxFileSize {
+		golog.Warnf("skipping %s of connector %s, larger than 50MB", object.Key, connector.ID)
+		return nil
+	}
+
+	sourceID, changed, err := s.connectorItemChanged(ctx, connector, object.Key, object.ETag)
+	if err != nil || !changed {
+		return err
+	}
+
+	ext := filepath.Ext(name)
+	uniqueFileName := fmt.Sprintf("%s_%s%s", strings.TrimSuffix(name, ext), uuid.New().String()[:8], ext)
+	userUploadDir := filepath.Join(s.cfg.UploadDir, connector.UserID)
+	if err := os.MkdirAll(userUploadDir, 0755); err != nil {
+		return err
+	}
+	filePath := filepath.Join(userUploadDir, uniqueFileName)
+
+	size, err := client.download(ctx, object.Key, filePath)
+	if err != nil {
+		os.Remove(filePath)
+		golog.Warnf("failed to download %s of connector %s: %v", object.Key, connector.ID, err)
+		return nil
+	}
+	scan, err := s.scanUpload(ctx, filePath)
+	if err != nil {
+		if scan == nil {
+			os.Remove(filePath)
+		}
+		golog.Warnf("failed to scan %s of connector %s: %v", object.Key, connector.ID, err)
+		return nil
+	}
+	content, _, err := s.extractDocument(ctx, filePath)
+	if err != nil {
+		os.Remove(filePath)
+		golog.Warnf("failed to extract %s of connector %s: %v", object.Key, connector.ID, err)
+		return nil
+	}
+
+	// The previous file stays on disk with the version that refers to it
+	doc := &connectorDocument{
+		Key:      object.Key,
+		Version:  object.ETag,
+		Name:     name,
+		Type:     "file",
+		URL:      "s3://" + connector.Settings.Bucket + "/" + object.Key,
+		Content:  content,
+		FileName: uniqueFileName,
+		FileSize: size,
+		Metadata: map[string]interface{}{"path": filePath, "user_id": connector.UserID, "s3_key": object.Key},
+	}
+	if scan != nil {
+		doc.Metadata["scan"] = scan
+	}
+	added, err := s.saveConnectorDocument(ctx, connector, sourceID, doc)
+	if err != nil {
+		os.Remove(filePath)
+		return err
+	}
+	if added {
+		result.Added++
+	} else {
+		result.Updated++
+	}
+	return nil
+}
@@ -0,0 +1,240 @@
+package backend
+
+import (
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kataras/golog"
+)
+
+var (
+	// promptPlaceholder matches {name} placeholders in a saved prompt's text
+	promptPlaceholder = regexp.MustCompile(`\{(\w+)\}`)
+	// promptVariableName is the format of a saved prompt's variable names
+	promptVariableName = regexp.MustCompile(`^\w{1,64}$`)
+)
+
+// builtinPromptVariables are filled in on every run and need no declaration
+var builtinPromptVariables = map[string]bool{"date": true, "notebook": true}
+
+// normalizeSavedPrompt validates a saved prompt request and adds the placeholders of its text
+// that aren't declared as variables
+func normalizeSavedPrompt(req *SavedPromptRequest) (*SavedPrompt, error) {
+	prompt := &SavedPrompt{
+		Title:     strings.TrimSpace(req.Title),
+		Text:      strings.TrimSpace(req.Text),
+		Variables: make([]PromptVariable, 0, len(req.Variables)),
+	}
+	if prompt.Title == "" || prompt.Text == "" {
+		return nil, fmt.Errorf("title and text are required")
+	}
+
+	declared := make(map[string]bool)
+	for _, v := range req.Variables {
+		v.Name = strings.TrimSpace(v.Name)
+		if !promptVariableName.MatchString(v.Name) {
+			return nil, fmt.Errorf("invalid variable name %q, use letters, digits and underscores", v.Name)
+		}
+		if builtinPromptVariables[v.Name] {
+			return nil, fmt.Errorf("{%s} is filled in automatically and can't be declared", v.Name)
+		}
+		if declared[v.Name] {
+			return nil, fmt.Errorf("variable %s is declared twice", v.Name)
+		}
+		declared[v.Name] = true
+		v.Description = strings.TrimSpace(v.Description)
+		prompt.Variables = append(prompt.Variables, v)
+	}
+	for _, match := range promptPlaceholder.FindAllStringSubmatch(prompt.Text, -1) {
+		name := match[1]
+		if !declared[name] && !builtinPromptVariables[name] {
+			declared[name] = true
+			prompt.Variables = append(prompt.Variables, PromptVariable{Name: name})
+		}
+	}
+	return prompt, nil
+}
+
+// renderSavedPrompt fills in the placeholders of a saved prompt. Values fall back to the
+// variable's default; variables with neither are returned as missing.
+func renderSavedPrompt(prompt *SavedPrompt, notebook *Notebook, values map[string]string) (string, []string) {
+	resolved := map[string]string{
+		"date":     time.Now().Format("2006-01-02"),
+		"notebook": notebook.Name,
+	}
+	var missing []string
+	for _, v := range prompt.Variables {
+		value := strings.TrimSpace(values[v.Name])
+		if value == "" {
+			value = v.Default
+		}
+		if value == "" {
+			missing = append(missing, v.Name)
+			continue
+		}
+		resolved[v.Name] = value
+	}
+	if len(missing) > 0 {
+		return "", missing
+	}
+
+	return promptPlaceholder.ReplaceAllStringFunc(prompt.Text, func(match string) string {
+		if value, ok := resolved[match[1:len(match)-1]]; ok {
+			return value
+		}
+		return match
+	}), nil
+}
+
+func (s *Server) handleListSavedPrompts(c *gin.Context) {
+	prompts, err := s.store.ListSavedPrompts(c.Request.Context(), c.GetString("user_id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to list prompts"})
+		return
+	}
+	c.JSON(http.StatusOK, prompts)
+}
+
+func (s *Server) handleGetSavedPrompt(c *gin.Context) {
+	prompt, err := s.store.GetSavedPrompt(c.Request.Context(), c.GetString("user_id"), c.Param("promptId"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, ErrorResponse{Error: "Prompt not found"})
+		return
+	}
+	c.JSON(http.StatusOK, prompt)
+}
+
+func (s *Server) handleCreateSavedPrompt(c *gin.Context) {
+	var req SavedPromptRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+		return
+	}
+	prompt, err := normalizeSavedPrompt(&req)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid prompt", Details: err.Error()})
+		return
+	}
+	prompt.UserID = c.GetString("user_id")
+	if err := s.store.CreateSavedPrompt(c.Request.Context(), prompt); err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to create prompt"})
+		return
+	}
+	c.JSON(http.StatusCreated, prompt)
+}
+
+func (s *Server) handleUpdateSavedPrompt(c *gin.Context) {
+	ctx := c.Request.Context()
+	userID := c.GetString("user_id")
+
+	existing, err := s.store.GetSavedPrompt(ctx, userID, c.Param("promptId"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, ErrorResponse{Error: "Prompt not found"})
+		return
+	}
+	var req SavedPromptRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+		return
+	}
+	prompt, err := normalizeSavedPrompt(&req)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid prompt", Details: err.Error()})
+		return
+	}
+	prompt.ID = existing.ID
+	prompt.UserID = existing.UserID
+	prompt.CreatedAt = existing.CreatedAt
+	prompt.LastRunAt = existing.LastRunAt
+	if err := s.store.UpdateSavedPrompt(ctx, prompt); err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to update prompt"})
+		return
+	}
+	c.JSON(http.StatusOK, prompt)
+}
+
+func (s *Server) handleDeleteSavedPrompt(c *gin.Context) {
+	if err := s.store.DeleteSavedPrompt(c.Request.Context(), c.GetString("user_id"), c.Param("promptId")); err != nil {
+		c.JSON(http.StatusNotFound, ErrorResponse{Error: "Prompt not found"})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// handleRunSavedPrompt fills in a saved prompt and sends it as a chat message to a notebook.
+// The response is the same as the chat endpoint's, streamed if the client asks for it.
+func (s *Server) handleRunSavedPrompt(c *gin.Context) {
+	ctx, cancel := requestContext(c)
+	defer cancel()
+	userID := c.GetString("user_id")
+
+	prompt, err := s.store.GetSavedPrompt(ctx, userID, c.Param("promptId"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, ErrorResponse{Error: "Prompt not found"})
+		return
+	}
+	var req RunPromptRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	notebook, err := s.store.GetNotebook(ctx, req.NotebookID)
+	if err != nil {
+		c.JSON(http.StatusNotFound, ErrorResponse{Error: "Notebook not found"})
+		return
+	}
+	if notebook.UserID != "" && notebook.UserID != userID {
+		c.JSON(http.StatusForbidden, ErrorResponse{Error: "Access denied"})
+		return
+	}
+	// The run is saved in the notebook's chat history
+	if err := s.checkLegalHold(ctx, notebook.ID); err != nil {
+		c.JSON(http.StatusLocked, ErrorResponse{Error: "Notebook is under legal hold"})
+		return
+	}
+	if req.SessionID != "" {
+		session, err := s.store.GetChatSession(ctx, req.SessionID)
+		if err != nil || session.NotebookID != notebook.ID {
+			c.JSON(http.StatusNotFound, ErrorResponse{Error: "Session not found"})
+			return
+		}
+	}
+
+	message, missing := renderSavedPrompt(prompt, notebook, req.Variables)
+	if len(missing) > 0 {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Missing prompt variables", Details: strings.Join(missing, ", ")})
+		return
+	}
+
+	agent, ok := s.requireAgent(c)
+	if !ok {
+		return
+	}
+	if err := s.loadNotebookVectorIndex(ctx, notebook.ID); err != nil {
+		golog.Errorf("failed to load vector index: %v", err)
+	}
+
+	if err := s.store.TouchSavedPrompt(ctx, prompt.ID); err != nil {
+		golog.Errorf("failed to update saved prompt: %v", err)
+	}
+	activityLog := &ActivityLog{
+		UserID:       userID,
+		Action:       "run_prompt",
+		ResourceType: "prompt",
+		ResourceID:   prompt.ID,
+		ResourceName: prompt.Title,
+		Details:      fmt.Sprintf(`{"notebook_id": "%s"}`, notebook.ID),
+		IPAddress:    c.ClientIP(),
+		UserAgent:    c.GetHeader("User-Agent"),
+	}
+	if err := s.store.LogActivity(ctx, activityLog); err != nil {
+		golog.Errorf("failed to log prompt run activity: %v", err)
+	}
+
+	s.replyChat(c, ctx, agent, notebook.ID, req.SessionID, message, "", nil)
+}
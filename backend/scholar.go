@@ -0,0 +1,324 @@
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/kataras/golog"
+)
+
+const arxivAPIURL = "http://export.arxiv.org/api/query"
+
+// arxivDOIPrefix is the DataCite prefix arXiv registers its papers under
+const arxivDOIPrefix = "10.48550/arxiv."
+
+// paperMaxPDFSize bounds the size of a downloaded paper PDF
+const paperMaxPDFSize = 50 << 20
+
+// paperHTTPClient fetches paper metadata and PDFs, which can take longer than integration calls
+var paperHTTPClient = &http.Client{Timeout: 60 * time.Second}
+
+var (
+	// arxivIDPattern matches new-style (2101.00001) and old-style (hep-th/9901001) arXiv identifiers
+	arxivIDPattern = regexp.MustCompile(`^(\d{4}\.\d{4,5}|[a-z][a-z-]*(?:\.[A-Za-z]{2})?/\d{7})(v\d+)?$`)
+	doiPattern     = regexp.MustCompile(`^10\.\d{4,9}/\S+$`)
+)
+
+// parsePaperID recognizes an arXiv identifier or a DOI, bare or as a link, and returns its kind
+// ("arxiv" or "doi") and the normalized identifier. Other input returns an empty kind.
+func parsePaperID(input string) (kind, id string) {
+	input = strings.TrimSpace(input)
+
+	lower := strings.ToLower(input)
+	for _, prefix := range []string{"https://arxiv.org/abs/", "http://arxiv.org/abs/", "https://arxiv.org/pdf/", "http://arxiv.org/pdf/", "arxiv:"} {
+		if strings.HasPrefix(lower, prefix) {
+			candidate := strings.TrimSuffix(strings.TrimRight(input[len(prefix):], "/"), ".pdf")
+			if arxivIDPattern.MatchString(candidate) {
+				return "arxiv", candidate
+			}
+			return "", ""
+		}
+	}
+	if arxivIDPattern.MatchString(input) && !strings.Contains(input, "://") {
+		return "arxiv", input
+	}
+
+	if doi := normalizeDOI(input); doiPattern.MatchString(doi) {
+		if strings.HasPrefix(strings.ToLower(doi), arxivDOIPrefix) {
+			return "arxiv", doi[len(arxivDOIPrefix):]
+		}
+		if u, err := url.PathUnescape(doi); err == nil {
+			doi = u
+		}
+		return "doi", doi
+	}
+	return "", ""
+}
+
+// arxivFeed is the subset of the arXiv API's Atom response the resolver reads
+type arxivFeed struct {
+	Entries []struct {
+		ID        string `xml:"id"`
+		Title     string `xml:"title"`
+		Summary   string `xml:"summary"`
+		Published string `xml:"published"`
+		Authors   []struct {
+			Name string `xml:"name"`
+		} `xml:"author"`
+		Links []struct {
+			Href  string `xml:"href,attr"`
+			Title string `xml:"title,attr"`
+			Type  string `xml:"type,attr"`
+		} `xml:"link"`
+		DOI        string `xml:"http://arxiv.org/schemas/atom doi"`
+		JournalRef string `xml:"http://arxiv.org/schemas/atom journal_ref"`
+		Categories []struct {
+			Term string `xml:"term,attr"`
+		} `xml:"category"`
+	} `xml:"entry"`
+}
+
+// fetchArxivPaper looks up an arXiv paper and returns its reference and PDF link
+func fetchArxivPaper(ctx context.Context, id string) (*Reference, string, error) {
+	body, err := paperGet(ctx, arxivAPIURL+"?id_list="+url.QueryEscape(id), "application/atom+xml", 1<<20)
+	if err != nil {
+		return nil, "", err
+	}
+	var feed arxivFeed
+	if err := xml.Unmarshal(body, &feed); err != nil {
+		return nil, "", fmt.Errorf("invalid arXiv response: %w", err)
+	}
+	// Unknown IDs come back as an entry without a title
+	if len(feed.Entries) == 0 || strings.TrimSpace(feed.Entries[0].Title) == "" {
+		return nil, "", fmt.Errorf("arXiv paper %s not found", id)
+	}
+	entry := feed.Entries[0]
+
+	ref := &Reference{
+		Key:       "arXiv:" + id,
+		EntryType: "misc",
+		Title:     collapseSpace(entry.Title),
+		Venue:     "arXiv",
+		DOI:       normalizeDOI(entry.DOI),
+		URL:       "https://arxiv.org/abs/" + id,
+		Abstract:  collapseSpace(entry.Summary),
+	}
+	if ref.DOI == "" {
+		ref.DOI = "10.48550/arXiv." + id
+	}
+	if entry.JournalRef != "" {
+		ref.Venue = collapseSpace(entry.JournalRef)
+		ref.EntryType = "article"
+	}
+	if len(entry.Published) >= 4 {
+		ref.Year = entry.Published[:4]
+	}
+	for _, a := range entry.Authors {
+		ref.Authors = append(ref.Authors, invertName(collapseSpace(a.Name)))
+	}
+	var terms []string
+	for _, c := range entry.Categories {
+		terms = append(terms, c.Term)
+	}
+	ref.Keywords = strings.Join(terms, ", ")
+
+	pdfURL := "https://arxiv.org/pdf/" + id
+	for _, l := range entry.Links {
+		if l.Title == "pdf" || l.Type == "application/pdf" {
+			pdfURL = strings.Replace(l.Href, "http://", "https://", 1)
+		}
+	}
+	return ref, pdfURL, nil
+}
+
+// fetchDOIPaper resolves a DOI to its CSL JSON record through doi.org content negotiation and
+// returns the reference and, when the registrar lists one, a PDF link
+func fetchDOIPaper(ctx context.Context, doi string) (*Reference, string, error) {
+	body, err := paperGet(ctx, "https://doi.org/"+doi, "application/vnd.citationstyles.csl+json", 1<<20)
+	if err != nil {
+		return nil, "", err
+	}
+	refs, err := parseCSLJSON(string(body))
+	if err != nil {
+		return nil, "", err
+	}
+	if len(refs) == 0 {
+		return nil, "", fmt.Errorf("DOI %s has no title", doi)
+	}
+	ref := &refs[0]
+	ref.Key = doi
+	if ref.DOI == "" {
+		ref.DOI = doi
+	}
+	ref.Abstract = stripJATS(ref.Abstract)
+
+	// Crossref records list full-text links with their content type
+	var links struct {
+		Link []struct {
+			URL         string `json:"URL"`
+			ContentType string `json:"content-type"`
+		} `json:"link"`
+	}
+	json.Unmarshal(body, &links)
+	for _, l := range links.Link {
+		if l.ContentType == "application/pdf" {
+			return ref, l.URL, nil
+		}
+	}
+	return ref, "", nil
+}
+
+// paperGet fetches a URL with the given Accept header and returns at most limit bytes of the body
+func paperGet(ctx context.Context, target, accept string, limit int64) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", accept)
+	resp, err := paperHTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, fmt.Errorf("%s not found", target)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned %s", target, resp.Status)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, limit))
+}
+
+// downloadPaperPDF saves the PDF at pdfURL to path. Publishers often answer with an HTML
+// landing page instead, which is rejected.
+func downloadPaperPDF(ctx context.Context, pdfURL, path string) (int64, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, pdfURL, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Accept", "application/pdf")
+	resp, err := paperHTTPClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("PDF download returned %s", resp.Status)
+	}
+	if mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type")); mediaType != "application/pdf" {
+		return 0, fmt.Errorf("PDF link returned %s", mediaType)
+	}
+
+	out, err := os.Create(path)
+	if err != nil {
+		return 0, err
+	}
+	defer out.Close()
+	return io.Copy(out, io.LimitReader(resp.Body, paperMaxPDFSize))
+}
+
+// resolvePaper fills a source from an arXiv identifier or DOI: the reference is stored as
+// metadata for citation-aware outputs, and the full text comes from the paper's PDF when it
+// can be downloaded and converted, falling back to the abstract.
+func (s *Server) resolvePaper(ctx context.Context, source *Source, userID, kind, id string) error {
+	var ref *Reference
+	var pdfURL string
+	var err error
+	if kind == "arxiv" {
+		ref, pdfURL, err = fetchArxivPaper(ctx, id)
+	} else {
+		ref, pdfURL, err = fetchDOIPaper(ctx, id)
+	}
+	if err != nil {
+		return err
+	}
+
+	source.Type = "reference"
+	source.URL = ref.link()
+	if source.Name == "" || paperNameID(source.Name) == id {
+		source.Name = ref.Title
+	}
+	if source.Metadata == nil {
+		source.Metadata = make(map[string]interface{})
+	}
+	source.Metadata["reference"] = ref
+	source.Content = referenceSourceContent(ref)
+
+	// PDFs are only readable through markitdown
+	if pdfURL == "" || !s.cfg.EnableMarkitdown {
+		return nil
+	}
+	source.Metadata["pdf_url"] = pdfURL
+
+	userUploadDir := filepath.Join(s.cfg.UploadDir, userID)
+	if err := os.MkdirAll(userUploadDir, 0755); err != nil {
+		return err
+	}
+	fileName := fmt.Sprintf("%s_%s.pdf", paperFileName(id), uuid.New().String()[:8])
+	path := filepath.Join(userUploadDir, fileName)
+
+	size, err := downloadPaperPDF(ctx, pdfURL, path)
+	if err != nil {
+		os.Remove(path)
+		golog.Warnf("failed to download PDF of %s, keeping the abstract: %v", id, err)
+		return nil
+	}
+	text, _, err := s.extractDocument(ctx, path)
+	if err != nil || strings.TrimSpace(text) == "" {
+		os.Remove(path)
+		golog.Warnf("failed to extract PDF of %s, keeping the abstract: %v", id, err)
+		return nil
+	}
+
+	source.FileName = fileName
+	source.FileSize = size
+	source.Metadata["path"] = path
+	source.Metadata["user_id"] = userID
+	source.Content += "\n## 全文\n\n" + text
+	return nil
+}
+
+// paperNameID returns the identifier in a source name given as a paper link, so a name
+// defaulted to the URL is replaced by the paper title
+func paperNameID(name string) string {
+	_, id := parsePaperID(name)
+	return id
+}
+
+// paperFileName makes an identifier safe to use in a file name
+func paperFileName(id string) string {
+	return strings.NewReplacer("/", "_", ":", "_", "\\", "_").Replace(id)
+}
+
+// invertName turns "Given Family" into the "Family, Given" form references store
+func invertName(name string) string {
+	i := strings.LastIndex(name, " ")
+	if i < 0 {
+		return name
+	}
+	return name[i+1:] + ", " + name[:i]
+}
+
+var jatsTag = regexp.MustCompile(`<[^>]+>`)
+
+// stripJATS removes the JATS markup Crossref abstracts are wrapped in
+func stripJATS(text string) string {
+	return collapseSpace(jatsTag.ReplaceAllString(text, " "))
+}
+
+// collapseSpace joins the whitespace runs of wrapped metadata text into single spaces
+func collapseSpace(text string) string {
+	return strings.Join(strings.Fields(text), " ")
+}
@@ -0,0 +1,326 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/kataras/golog"
+	"github.com/tmc/langchaingo/llms"
+)
+
+// sdPollInterval is how often a queued ComfyUI prompt is checked for its image
+const sdPollInterval = time.Second
+
+// SDImageClient is a client for a self-hosted Stable Diffusion server: the AUTOMATIC1111 web UI
+// API or ComfyUI. Text is generated by the LLM passed in, as it has no model of its own.
+type SDImageClient struct {
+	baseURL    string
+	backend    string // "a1111" or "comfyui"
+	sampler    string
+	steps      int
+	width      int
+	height     int
+	httpClient *http.Client
+	uploadDir  string
+}
+
+// NewSDImageClient creates a new Stable Diffusion client. size is "WIDTHxHEIGHT", and an empty
+// sampler uses the backend's usual default.
+func NewSDImageClient(baseURL, backend, sampler string, steps int, size string, timeout time.Duration, uploadDir string) (*SDImageClient, error) {
+	var width, height int
+	if _, err := fmt.Sscanf(size, "%dx%d", &width, &height); err != nil || width <= 0 || height <= 0 {
+		return nil, fmt.Errorf("invalid SD_SIZE %q, expected WIDTHxHEIGHT", size)
+	}
+	switch backend {
+	case "a1111":
+		if sampler == "" {
+			sampler = "Euler a"
+		}
+	case "comfyui":
+		if sampler == "" {
+			sampler = "euler_ancestral"
+		}
+	default:
+		return nil, fmt.Errorf("unknown SD_BACKEND: %s (supported: a1111, comfyui)", backend)
+	}
+	return &SDImageClient{
+		baseURL:   strings.TrimRight(baseURL, "/"),
+		backend:   backend,
+		sampler:   sampler,
+		steps:     max(steps, 1),
+		width:     width,
+		height:    height,
+		uploadDir: uploadDir,
+		httpClient: &http.Client{
+			Timeout: timeout,
+			Transport: &http.Transport{
+				DisableKeepAlives: false,
+				MaxIdleConns:      100,
+				IdleConnTimeout:   5 * time.Minute,
+			},
+		},
+	}, nil
+}
+
+// GenerateImage generates an image with the Stable Diffusion server. model is the checkpoint to
+// use; an empty model keeps the one A1111 has loaded.
+func (sd *SDImageClient) GenerateImage(ctx context.Context, model, prompt string, userID string) (string, error) {
+	golog.Infof("generating image with Stable Diffusion (%s) model %s...", sd.backend, model)
+
+	var imageData []byte
+	var err error
+	if sd.backend == "comfyui" {
+		imageData, err = sd.generateComfyUI(ctx, model, prompt)
+	} else {
+		imageData, err = sd.generateA1111(ctx, model, prompt)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	golog.Infof("image data received successfully (%d bytes), saving...", len(imageData))
+
+	// Save the image to user-specific directory
+	return saveGeneratedImage(sd.uploadDir, userID, imageData)
+}
+
+// generateA1111 generates an image with the txt2img endpoint of the AUTOMATIC1111 API
+func (sd *SDImageClient) generateA1111(ctx context.Context, model, prompt string) ([]byte, error) {
+	requestBody := map[string]interface{}{
+		"prompt":       prompt,
+		"sampler_name": sd.sampler,
+		"steps":        sd.steps,
+		"width":        sd.width,
+		"height":       sd.height,
+	}
+	if model != "" {
+		requestBody["override_settings"] = map[string]interface{}{"sd_model_checkpoint": model}
+	}
+
+	var result struct {
+		Images []string        `json:"images"`
+		Error  string          `json:"error"`
+		Detail json.RawMessage `json:"detail"`
+	}
+	if err := sd.postJSON(ctx, "/sdapi/v1/txt2img", requestBody, &result); err != nil {
+		return nil, err
+	}
+	if result.Error != "" {
+		golog.Errorf("Stable Diffusion API error: %s - %s", result.Error, result.Detail)
+		return nil, fmt.Errorf("Stable Diffusion API error (%s): %s", result.Error, result.Detail)
+	}
+	if len(result.Images) == 0 {
+		golog.Errorf("no image returned by Stable Diffusion API")
+		return nil, fmt.Errorf("no image in response")
+	}
+
+	// Images may come as data URLs
+	image := result.Images[0]
+	if i := strings.Index(image, ","); strings.HasPrefix(image, "data:") && i >= 0 {
+		image = image[i+1:]
+	}
+	imageData, err := base64.StdEncoding.DecodeString(image)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode image data: %w", err)
+	}
+	return imageData, nil
+}
+
+// comfyUIWorkflow is a plain text-to-image workflow in ComfyUI's API format
+func (sd *SDImageClient) comfyUIWorkflow(model, prompt string) map[string]interface{} {
+	return map[string]interface{}{
+		"checkpoint": map[string]interface{}{
+			"class_type": "CheckpointLoaderSimple",
+			"inputs":     map[string]interface{}{"ckpt_name": model},
+		},
+		"latent": map[string]interface{}{
+			"class_type": "EmptyLatentImage",
+			"inputs":     map[string]interface{}{"width": sd.width, "height": sd.height, "batch_size": 1},
+		},
+		"positive": map[string]interface{}{
+			"class_type": "CLIPTextEncode",
+			"inputs":     map[string]interface{}{"text": prompt, "clip": []interface{}{"checkpoint", 1}},
+		},
+		"negative": map[string]interface{}{
+			"class_type": "CLIPTextEncode",
+			"inputs":     map[string]interface{}{"text": "", "clip": []interface{}{"checkpoint", 1}},
+		},
+		"sampler": map[string]interface{}{
+			"class_type": "KSampler",
+			"inputs": map[string]interface{}{
+				"seed":         rand.Int64N(1 << 48),
+				"steps":        sd.steps,
+				"cfg":          7,
+				"sampler_name": sd.sampler,
+				"scheduler":    "normal",
+				"denoise":      1,
+				"model":        []interface{}{"checkpoint", 0},
+				"positive":     []interface{}{"positive", 0},
+				"negative":     []interface{}{"negative", 0},
+				"latent_image": []interface{}{"latent", 0},
+			},
+		},
+		"decode": map[string]interface{}{
+			"class_type": "VAEDecode",
+			"inputs":     map[string]interface{}{"samples": []interface{}{"sampler", 0}, "vae": []interface{}{"checkpoint", 2}},
+		},
+		"save": map[string]interface{}{
+			"class_type": "SaveImage",
+			"inputs":     map[string]interface{}{"filename_prefix": "notex", "images": []interface{}{"decode", 0}},
+		},
+	}
+}
+
+// generateComfyUI queues the text-to-image workflow in ComfyUI, waits for it to finish and
+// downloads the image it saved
+func (sd *SDImageClient) generateComfyUI(ctx context.Context, model, prompt string) ([]byte, error) {
+	if model == "" {
+		return nil, fmt.Errorf("SD_MODEL is required with ComfyUI")
+	}
+
+	var queued struct {
+		PromptID   string          `json:"prompt_id"`
+		Error      json.RawMessage `json:"error"`
+		NodeErrors json.RawMessage `json:"node_errors"`
+	}
+	requestBody := map[string]interface{}{
+		"prompt":    sd.comfyUIWorkflow(model, prompt),
+		"client_id": uuid.New().String(),
+	}
+	if err := sd.postJSON(ctx, "/prompt", requestBody, &queued); err != nil {
+		return nil, err
+	}
+	if queued.PromptID == "" {
+		golog.Errorf("ComfyUI rejected the workflow: %s %s", queued.Error, queued.NodeErrors)
+		return nil, fmt.Errorf("ComfyUI API error: %s", queued.Error)
+	}
+
+	// The history has an entry for the prompt once it has run
+	type comfyImage struct {
+		Filename  string `json:"filename"`
+		Subfolder string `json:"subfolder"`
+		Type      string `json:"type"`
+	}
+	var image *comfyImage
+	for image == nil {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(sdPollInterval):
+		}
+
+		var history map[string]struct {
+			Status struct {
+				StatusStr string `json:"status_str"`
+			} `json:"status"`
+			Outputs map[string]struct {
+				Images []comfyImage `json:"images"`
+			} `json:"outputs"`
+		}
+		if err := sd.getJSON(ctx, "/history/"+url.PathEscape(queued.PromptID), &history); err != nil {
+			return nil, err
+		}
+		entry, ok := history[queued.PromptID]
+		if !ok {
+			continue
+		}
+		if entry.Status.StatusStr == "error" {
+			return nil, fmt.Errorf("ComfyUI failed to run the workflow")
+		}
+		for _, output := range entry.Outputs {
+			if len(output.Images) > 0 {
+				image = &output.Images[0]
+				break
+			}
+		}
+		if image == nil {
+			return nil, fmt.Errorf("no image in ComfyUI output")
+		}
+	}
+
+	query := url.Values{"filename": {image.Filename}, "subfolder": {image.Subfolder}, "type": {image.Type}}
+	downloadReq, err := http.NewRequestWithContext(ctx, "GET", sd.baseURL+"/view?"+query.Encode(), nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create download request: %w", err)
+	}
+	downloadResp, err := sd.httpClient.Do(downloadReq)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download image: %w", err)
+	}
+	defer downloadResp.Body.Close()
+
+	imageData, err := io.ReadAll(downloadResp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read image data: %w", err)
+	}
+	if downloadResp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to download image, status: %d", downloadResp.StatusCode)
+	}
+	return imageData, nil
+}
+
+// postJSON POSTs a JSON body to a path of the server and decodes its JSON response into result
+func (sd *SDImageClient) postJSON(ctx context.Context, path string, body, result interface{}) error {
+	jsonBody, err := json.Marshal(body)
+	if err != nil {
+		return fmt.Errorf("failed to marshal request body: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", sd.baseURL+path, bytes.NewReader(jsonBody))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	return sd.do(req, result)
+}
+
+// getJSON GETs a path of the server and decodes its JSON response into result
+func (sd *SDImageClient) getJSON(ctx context.Context, path string, result interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", sd.baseURL+path, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	return sd.do(req, result)
+}
+
+func (sd *SDImageClient) do(req *http.Request, result interface{}) error {
+	resp, err := sd.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send request: %w", err)
+	}
+	defer resp.Body.Close()
+	if err := json.NewDecoder(resp.Body).Decode(result); err != nil {
+		return fmt.Errorf("failed to decode response (status %d): %w", resp.StatusCode, err)
+	}
+	return nil
+}
+
+// GenerateTextWithModel generates text with a Gemini model, which this client can't
+func (sd *SDImageClient) GenerateTextWithModel(ctx context.Context, prompt string, model string) (string, error) {
+	return "", fmt.Errorf("Stable Diffusion client does not support Gemini text generation")
+}
+
+// GenerateFromSinglePrompt generates text from a single prompt using the specified LLM
+func (sd *SDImageClient) GenerateFromSinglePrompt(ctx context.Context, llm llms.Model, prompt string, options ...llms.CallOption) (string, error) {
+	if llm == nil {
+		return "", fmt.Errorf("Stable Diffusion client does not support text generation without an LLM")
+	}
+	return llms.GenerateFromSinglePrompt(ctx, llm, prompt, options...)
+}
+
+// GenerateStreamFromSinglePrompt generates text from a single prompt, streaming chunks to onChunk
+func (sd *SDImageClient) GenerateStreamFromSinglePrompt(ctx context.Context, llm llms.Model, prompt string, onChunk func(chunk string) error, options ...llms.CallOption) (string, error) {
+	options = append(options, llms.WithStreamingFunc(func(ctx context.Context, chunk []byte) error {
+		return onChunk(string(chunk))
+	}))
+	return sd.GenerateFromSinglePrompt(ctx, llm, prompt, options...)
+}
@@ -0,0 +1,226 @@
+package backend
+
+import (
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kataras/golog"
+	"github.com/tmc/langchaingo/schema"
+)
+
+const (
+	// searchContextRunes is how much text around a word-for-word match a passage shows
+	searchContextRunes = 120
+
+	// searchRRFConstant damps the weight of the top ranks in reciprocal rank fusion; 60 is the
+	// value from the original paper and what most hybrid search engines use
+	searchRRFConstant = 60
+)
+
+// handleSearchSources finds the passages of a notebook's sources that match a query, without
+// calling the LLM. It is a hybrid search: passages containing the query word for word are
+// fused with the chunks the vector store finds most similar, so both exact phrases and
+// paraphrases are found.
+func (s *Server) handleSearchSources(c *gin.Context) {
+	ctx, cancel := requestContext(c)
+	defer cancel()
+	notebookID := c.Param("id")
+	if err := s.checkNotebookAccess(ctx, notebookID, c.GetString("user_id")); err != nil {
+		c.JSON(http.StatusForbidden, ErrorResponse{Error: "Access denied"})
+		return
+	}
+
+	query := strings.TrimSpace(c.Query("q"))
+	if query == "" {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Query is required", Details: "pass the text to search for as q"})
+		return
+	}
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "10"))
+	if limit <= 0 || limit > 50 {
+		limit = 10
+	}
+
+	sources, err := s.store.ListSources(ctx, notebookID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to list sources"})
+		return
+	}
+	if err := s.loadNotebookVectorIndex(ctx, notebookID); err != nil {
+		golog.Errorf("failed to load vector index: %v", err)
+	}
+	docs, err := s.vectorStore.SimilaritySearch(ctx, notebookID, query, limit*2)
+	if err != nil {
+		// The keyword half of the search still works
+		golog.Warnf("vector search failed: %v", err)
+		docs = nil
+	}
+	if !s.vectorStore.hasScores() {
+		// The in-memory search falls back to arbitrary chunks when nothing matches
+		docs = docsMentioning(docs, query)
+	}
+
+	c.JSON(http.StatusOK, SearchResponse{
+		Query:    query,
+		Passages: fuseSearchResults(sources, docs, query, limit),
+	})
+}
+
+// keywordHit is a word-for-word occurrence of a query in a source
+type keywordHit struct {
+	source     *Source
+	start, end int // Rune offsets
+}
+
+// findKeywordHits finds the occurrences of query in the sources, ignoring case. Sources with
+// more occurrences rank first, and each source's occurrences in order; at most perSource are
+// kept of each source.
+func findKeywordHits(sources []Source, query string, perSource int) []keywordHit {
+	needle := foldCase(query)
+	needleRunes := utf8.RuneCountInString(needle)
+	var bySource [][]keywordHit
+	for i := range sources {
+		haystack := foldCase(sources[i].Content)
+		var hits []keywordHit
+		runeOffset, byteOffset := 0, 0
+		for len(hits) < perSource {
+			index := strings.Index(haystack[byteOffset:], needle)
+			if index < 0 {
+				break
+			}
+			runeOffset += utf8.RuneCountInString(haystack[byteOffset : byteOffset+index])
+			hits = append(hits, keywordHit{source: &sources[i], start: runeOffset, end: runeOffset + needleRunes})
+			byteOffset += index + len(needle)
+			runeOffset += needleRunes
+		}
+		if len(hits) > 0 {
+			bySource = append(bySource, hits)
+		}
+	}
+	sort.SliceStable(bySource, func(i, j int) bool { return len(bySource[i]) > len(bySource[j]) })
+
+	var hits []keywordHit
+	for _, sourceHits := range bySource {
+		hits = append(hits, sourceHits...)
+	}
+	return hits
+}
+
+// foldCase lowercases s rune by rune, so rune offsets into it are offsets into s
+func foldCase(s string) string {
+	return strings.Map(unicode.ToLower, s)
+}
+
+// docsMentioning keeps the chunks that contain a word of the query, or for queries in CJK
+// scripts two consecutive characters of it
+func docsMentioning(docs []schema.Document, query string) []schema.Document {
+	var terms []string
+	for _, word := range strings.Fields(foldCase(query)) {
+		runes := []rune(word)
+		if len(runes) > 1 && isCJK(runes[0]) {
+			for i := 0; i+1 < len(runes); i++ {
+				terms = append(terms, string(runes[i:i+2]))
+			}
+		} else if len(runes) > 1 {
+			terms = append(terms, word)
+		}
+	}
+
+	kept := make([]schema.Document, 0, len(docs))
+	for _, doc := range docs {
+		content := foldCase(doc.PageContent)
+		for _, term := range terms {
+			if strings.Contains(content, term) {
+				kept = append(kept, doc)
+				break
+			}
+		}
+	}
+	return kept
+}
+
+// fuseSearchResults merges the vector store's chunks and the word-for-word matches into
+// passages, ranked by reciprocal rank fusion. A match inside a chunk counts for that chunk;
+// matches close together share a passage.
+func fuseSearchResults(sources []Source, docs []schema.Document, query string, limit int) []SearchPassage {
+	passages := make([]SearchPassage, 0, limit)
+	for rank, doc := range docs {
+		sourceID, _ := doc.Metadata["source_id"].(string)
+		sourceName, _ := doc.Metadata["source"].(string)
+		start, _ := doc.Metadata["start"].(int)
+		end, _ := doc.Metadata["end"].(int)
+		passages = append(passages, SearchPassage{
+			SourceID:   sourceID,
+			SourceName: sourceName,
+			Text:       doc.PageContent,
+			Start:      start,
+			End:        end,
+			MatchedBy:  []string{"vector"},
+			Score:      1.0 / float64(searchRRFConstant+rank+1),
+		})
+	}
+
+	contents := make(map[string][]rune)
+	for rank, hit := range findKeywordHits(sources, query, limit) {
+		score := 1.0 / float64(searchRRFConstant+rank+1)
+		match := [2]int{hit.start, hit.end}
+
+		merged := false
+		for i := range passages {
+			p := &passages[i]
+			if p.SourceID != hit.source.ID || hit.start < p.Start || hit.end > p.End {
+				continue
+			}
+			if !slices.Contains(p.MatchedBy, "keyword") {
+				p.MatchedBy = append(p.MatchedBy, "keyword")
+			}
+			p.Matches = append(p.Matches, match)
+			p.Score += score
+			merged = true
+			break
+		}
+		if merged {
+			continue
+		}
+
+		content, ok := contents[hit.source.ID]
+		if !ok {
+			content = []rune(hit.source.Content)
+			contents[hit.source.ID] = content
+		}
+		start := max(0, hit.start-searchContextRunes)
+		end := min(len(content), hit.end+searchContextRunes)
+
+		// A match whose context overlaps the previous match's passage extends it
+		if n := len(passages); n > 0 {
+			last := &passages[n-1]
+			if last.SourceID == hit.source.ID && len(last.MatchedBy) == 1 && last.MatchedBy[0] == "keyword" && start <= last.End {
+				last.End = max(last.End, end)
+				last.Text = string(content[last.Start:last.End])
+				last.Matches = append(last.Matches, match)
+				continue
+			}
+		}
+		passages = append(passages, SearchPassage{
+			SourceID:   hit.source.ID,
+			SourceName: hit.source.Name,
+			Text:       string(content[start:end]),
+			Start:      start,
+			End:        end,
+			Matches:    [][2]int{match},
+			MatchedBy:  []string{"keyword"},
+			Score:      score,
+		})
+	}
+
+	sort.SliceStable(passages, func(i, j int) bool { return passages[i].Score > passages[j].Score })
+	if len(passages) > limit {
+		passages = passages[:limit]
+	}
+	return passages
+}
@@ -0,0 +1,485 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"path/filepath"
+
+	"github.com/kataras/golog"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// seedUser is a demo account of the seed data
+type seedUser struct {
+	email, name, role string
+}
+
+// seedNotebook is a demo notebook of the seed data. Its notes cite all of its sources.
+type seedNotebook struct {
+	owner       string // Email of the demo user owning it
+	name        string
+	description string
+	sources     []seedSource
+	notes       []seedNote
+	chats       []seedChat
+}
+
+type seedSource struct {
+	name, kind, url, fileName, content string
+}
+
+type seedNote struct {
+	kind, content string
+}
+
+// seedChat is a chat session of questions and answers, the answers citing all of the
+// notebook's sources
+type seedChat struct {
+	title string
+	turns [][2]string
+}
+
+var seedUsers = []seedUser{
+	{email: "admin@example.com", name: "Demo Admin", role: RoleAdmin},
+	{email: "alice@example.com", name: "Alice"},
+	{email: "bob@example.com", name: "Bob"},
+}
+
+var seedNotebooks = []seedNotebook{
+	{
+		owner:       "alice@example.com",
+		name:        "机器学习入门",
+		description: "机器学习基础概念、梯度下降与神经网络的学习笔记",
+		sources: []seedSource{
+			{name: "机器学习概述", kind: "text", content: `# 机器学习概述
+
+机器学习是人工智能的一个分支，研究如何让计算机从数据中学习规律，而不是依靠人工编写的规则。
+
+## 主要类型
+
+- 监督学习：从带标签的样本中学习输入到输出的映射，例如房价预测和垃圾邮件识别。
+- 无监督学习：在没有标签的数据中发现结构，例如聚类和降维。
+- 强化学习：智能体通过与环境交互、获得奖励来学习策略，例如下棋和机器人控制。
+
+## 基本流程
+
+一个典型的机器学习项目包括收集数据、特征工程、选择模型、训练、评估和部署。模型在训练集上学习参数，在验证集上调整超参数，最后在测试集上评估泛化能力。
+
+过拟合是指模型在训练集上表现很好、在新数据上表现较差。常用的缓解方法有正则化、早停和增加训练数据。`},
+			{name: "Gradient descent", kind: "url", url: "https://en.wikipedia.org/wiki/Gradient_descent", content: `# Gradient descent
+
+Gradient descent is a first-order iterative algorithm for finding a local minimum of a differentiable function. The idea is to take repeated steps in the opposite direction of the gradient of the function at the current point, because this is the direction of steepest descent.
+
+The size of each step is set by the learning rate. A learning rate that is too small makes convergence slow, while one that is too large can overshoot the minimum and diverge.
+
+Stochastic gradient descent (SGD) estimates the gradient from a randomly chosen subset of the data, a mini-batch, instead of the whole dataset. This makes each step much cheaper, and the noise it adds can help escape shallow local minima. Variants such as momentum and Adam adapt the step to the history of the gradients.`},
+			{name: "神经网络讲义.pdf", kind: "file", fileName: "神经网络讲义.pdf", content: `# 第三讲 神经网络
+
+## 感知机
+
+感知机是最简单的神经网络，由输入、权重、偏置和激活函数组成。单层感知机只能解决线性可分的问题，无法表示异或。
+
+## 多层网络与反向传播
+
+多层感知机在输入层和输出层之间加入隐藏层，配合非线性激活函数（如 ReLU 和 Sigmoid）可以逼近任意连续函数。
+
+反向传播算法利用链式法则，从输出层向输入层逐层计算损失函数对每个参数的梯度，再用梯度下降更新参数。1986 年 Rumelhart、Hinton 和 Williams 的论文使反向传播广为人知。
+
+## 深度学习
+
+2012 年 AlexNet 在 ImageNet 图像分类竞赛中大幅领先，标志着深度学习时代的到来。卷积神经网络擅长处理图像，循环神经网络和 Transformer 擅长处理序列。`},
+		},
+		notes: []seedNote{
+			{kind: "summary", content: `## 摘要
+
+机器学习让计算机从数据中学习规律，主要分为监督学习、无监督学习和强化学习三类 [来源 1]。模型通过梯度下降最小化损失函数来训练，学习率决定每一步的大小 [来源 2]。神经网络由多层感知机发展而来，借助反向传播计算梯度，并在 2012 年 AlexNet 之后进入深度学习时代 [来源 3]。`},
+			{kind: "faq", content: `## 常见问题解答
+
+**问：监督学习和无监督学习有什么区别？**
+答：监督学习使用带标签的样本，无监督学习在没有标签的数据中寻找结构 [来源 1]。
+
+**问：学习率设置过大会怎样？**
+答：步长过大可能越过最小值，导致训练发散 [来源 2]。
+
+**问：为什么单层感知机不能解决异或问题？**
+答：异或不是线性可分的，而单层感知机只能表示线性决策边界 [来源 3]。`},
+			{kind: "study_guide", content: `## 学习指南
+
+### 核心概念
+1. 三种学习范式及其典型任务
+2. 训练集、验证集与测试集的作用
+3. 梯度下降与随机梯度下降
+4. 反向传播与链式法则
+
+### 复习问题
+- 什么是过拟合？列举三种缓解方法。
+- 随机梯度下降为什么比批量梯度下降更快？
+- 隐藏层为什么需要非线性激活函数？`},
+			{kind: "outline", content: `## 大纲
+
+1. 机器学习概述
+   1. 定义
+   2. 监督、无监督与强化学习
+   3. 项目流程
+2. 优化方法
+   1. 梯度下降
+   2. 学习率
+   3. SGD、动量与 Adam
+3. 神经网络
+   1. 感知机
+   2. 多层网络与反向传播
+   3. 深度学习的兴起`},
+			{kind: "podcast", content: `## 播客脚本
+
+**主持人 A**：欢迎收听本期节目，今天我们聊聊机器学习入门。
+**主持人 B**：说到机器学习，最核心的一点就是让计算机从数据里学规律，而不是人来写规则。
+**主持人 A**：那模型是怎么"学"的呢？
+**主持人 B**：靠梯度下降。想象你在山上蒙着眼往下走，每一步都朝最陡的方向迈，步子大小就是学习率。
+**主持人 A**：步子太大会怎样？
+**主持人 B**：可能直接跨过谷底，越走越高。这就是训练发散。`},
+			{kind: "timeline", content: `## 时间线
+
+| 年份 | 事件 |
+|---|---|
+| 1958 | Rosenblatt 提出感知机 |
+| 1986 | Rumelhart、Hinton 和 Williams 推广反向传播算法 |
+| 2012 | AlexNet 赢得 ImageNet 竞赛，深度学习兴起 |
+| 2017 | Transformer 架构提出 |`},
+			{kind: "glossary", content: `## 术语表
+
+- **过拟合**：模型在训练数据上表现好、在新数据上表现差的现象。
+- **学习率**：梯度下降中每一步的步长。
+- **反向传播**：利用链式法则逐层计算梯度的算法。
+- **激活函数**：为神经元引入非线性的函数，如 ReLU、Sigmoid。
+- **小批量（mini-batch）**：随机梯度下降中每步使用的数据子集。`},
+			{kind: "quiz", content: `## 测验
+
+1. 以下哪项属于无监督学习？
+   - A. 房价预测
+   - B. 客户聚类
+   - C. 垃圾邮件识别
+   - 答案：B
+
+2. 学习率过大最可能导致什么？
+   - A. 收敛变慢
+   - B. 训练发散
+   - C. 过拟合
+   - 答案：B
+
+3. 哪一年 AlexNet 赢得了 ImageNet 竞赛？
+   - 答案：2012 年`},
+			{kind: "mindmap", content: "```mermaid\nmindmap\n  root((机器学习))\n    (学习范式)\n      [监督学习]\n      [无监督学习]\n      [强化学习]\n    (优化)\n      [梯度下降]\n      [学习率]\n      [Adam]\n    (神经网络)\n      [感知机]\n      [反向传播]\n      [深度学习]\n```"},
+			{kind: "infograph", content: ""},
+			{kind: "ppt", content: `## Slide 1: 机器学习入门
+
+#### // 叙事目标
+封面，引出主题。
+
+#### // 关键内容
+机器学习入门：从数据中学习
+
+#### // 视觉元素
+抽象的数据点汇聚成曲线。
+
+#### // 布局
+标题居中，大面积留白。
+
+## Slide 2: 梯度下降
+
+#### // 叙事目标
+解释模型如何学习。
+
+#### // 关键内容
+沿梯度反方向迈步，学习率决定步长；过大发散，过小缓慢。
+
+#### // 视觉元素
+等高线图上一条下降路径。
+
+#### // 布局
+左图右文。
+
+## Slide 3: 从感知机到深度学习
+
+#### // 叙事目标
+封底，以历史脉络收尾。
+
+#### // 关键内容
+1958 感知机 → 1986 反向传播 → 2012 AlexNet
+
+#### // 视觉元素
+时间轴。
+
+#### // 布局
+横向时间轴贯穿全页。`},
+			{kind: "insight", content: `## 洞察报告
+
+1. **优化与泛化是两个问题**：梯度下降解决的是在训练集上降低损失，而过拟合提醒我们真正的目标是在新数据上表现好 [来源 1][来源 2]。
+2. **硬件与数据推动了深度学习**：反向传播在 1986 年就已提出，但直到 2012 年才迎来突破，说明算法之外的条件同样关键 [来源 3]。`},
+			{kind: "data_table", content: `## 数据表格
+
+| 优化方法 | 每步使用的数据 | 特点 |
+|---|---|---|
+| 批量梯度下降 | 全部数据 | 稳定但每步开销大 |
+| 随机梯度下降 | 小批量 | 每步便宜，噪声有助于跳出局部极小值 |
+| 动量 / Adam | 小批量 | 根据历史梯度调整步长 |`},
+			{kind: "data_chart", content: `[{"title":"深度学习里程碑","option":{"title":{"text":"深度学习里程碑"},"tooltip":{},"xAxis":{"type":"category","data":["感知机","反向传播","AlexNet","Transformer"]},"yAxis":{"type":"value","name":"年份","min":1950},"series":[{"type":"bar","data":[1958,1986,2012,2017]}]}}]`},
+			{kind: "meeting_summary", content: `## 会议纪要
+
+**主题**：机器学习读书会第一次讨论
+
+**结论**
+- 先掌握梯度下降和反向传播，再学习具体网络结构。
+
+**待办**
+- [ ] Alice：整理过拟合的案例
+- [ ] Bob：准备 Adam 优化器的讲解`},
+			{kind: "references", content: `## 参考文献
+
+Rumelhart, D. E., Hinton, G. E., & Williams, R. J. (1986). Learning representations by back-propagating errors. *Nature, 323*, 533–536.
+
+Gradient descent. (n.d.). In *Wikipedia*. https://en.wikipedia.org/wiki/Gradient_descent`},
+			{kind: "draft_outline", content: `## 长文大纲：机器学习是如何"学习"的
+
+1. 引言：从规则到数据
+2. 损失函数：衡量错误
+3. 梯度下降：沿最陡的方向下山
+4. 反向传播：把误差分配给每个参数
+5. 结语：优化之外的泛化问题`},
+			{kind: "draft", content: `# 机器学习是如何"学习"的
+
+## 引言：从规则到数据
+
+传统程序由人编写规则，而机器学习让计算机从数据中归纳规律 [来源 1]。
+
+## 梯度下降：沿最陡的方向下山
+
+训练模型就是最小化损失函数。梯度下降每一步都沿梯度的反方向前进，步长由学习率决定 [来源 2]。
+
+## 反向传播：把误差分配给每个参数
+
+对于多层神经网络，反向传播利用链式法则从输出层向输入层计算梯度 [来源 3]。`},
+			{kind: "custom", content: `## 自定义笔记：下周学习计划
+
+- 周一：复习三种学习范式
+- 周三：手推一遍两层网络的反向传播
+- 周五：用小批量 SGD 训练一个手写数字分类器`},
+			{kind: "chat", content: `## 对话记录
+
+**用户**：梯度下降的学习率应该怎么选？
+
+**助手**：学习率过小收敛慢，过大可能发散。实践中常从 0.01 或 0.001 开始尝试，并配合学习率衰减或 Adam 等自适应方法 [来源 2]。`},
+		},
+		chats: []seedChat{
+			{title: "学习范式", turns: [][2]string{
+				{"机器学习有哪几种主要类型？", "主要有三类：监督学习从带标签的样本中学习，无监督学习在无标签数据中发现结构，强化学习通过与环境交互获得奖励来学习策略 [来源 1]。"},
+				{"过拟合怎么缓解？", "常用方法有正则化、早停和增加训练数据 [来源 1]。"},
+			}},
+			{title: "反向传播", turns: [][2]string{
+				{"反向传播是谁提出的？", "1986 年 Rumelhart、Hinton 和 Williams 的论文使反向传播广为人知 [来源 3]。"},
+			}},
+		},
+	},
+	{
+		owner:       "bob@example.com",
+		name:        "Go 并发编程",
+		description: "goroutine、channel 与并发模式",
+		sources: []seedSource{
+			{name: "Go 并发模型", kind: "text", content: `# Go 并发模型
+
+goroutine 是由 Go 运行时管理的轻量级线程，用 go 关键字启动，初始栈只有几 KB，因此一个程序可以同时运行成千上万个 goroutine。
+
+channel 是 goroutine 之间通信的管道。无缓冲 channel 的发送和接收会同步进行，有缓冲 channel 在缓冲区满之前发送不会阻塞。
+
+select 语句可以同时等待多个 channel 操作，常与 context 配合实现超时和取消。`},
+			{name: "Effective Go: Concurrency", kind: "url", url: "https://go.dev/doc/effective_go#concurrency", content: `# Concurrency
+
+Do not communicate by sharing memory; instead, share memory by communicating.
+
+Concurrent programming in many environments is made difficult by the subtleties required to implement correct access to shared variables. Go encourages a different approach in which shared values are passed around on channels and, in fact, never actively shared by separate threads of execution. Only one goroutine has access to the value at any given time.`},
+		},
+		notes: []seedNote{
+			{kind: "summary", content: `## 摘要
+
+goroutine 是轻量级线程，channel 用于在 goroutine 之间传递数据 [来源 1]。Go 提倡"通过通信来共享内存，而不是通过共享内存来通信" [来源 2]。`},
+			{kind: "faq", content: `## 常见问题解答
+
+**问：无缓冲和有缓冲 channel 有什么区别？**
+答：无缓冲 channel 的收发同步进行；有缓冲 channel 在缓冲区满之前发送不阻塞 [来源 1]。`},
+		},
+		chats: []seedChat{
+			{title: "channel", turns: [][2]string{
+				{"怎么给 channel 操作加超时？", "用 select 同时等待 channel 和 context 或 time.After，哪个先就绪就执行哪个分支 [来源 1]。"},
+			}},
+		},
+	},
+	{
+		owner:       "alice@example.com",
+		name:        "产品周会",
+		description: "每周产品例会的记录",
+		sources: []seedSource{
+			{name: "产品周会 第 12 周", kind: "meeting", content: `# 产品周会 第 12 周
+
+参会：Alice、Bob、Carol
+
+1. 搜索功能上线后，日活提升 8%，但移动端加载偏慢。
+2. 决定下个迭代优先优化移动端首屏，Bob 负责。
+3. Carol 提出增加导出 PDF 的需求，排入待评估列表。`},
+		},
+		notes: []seedNote{
+			{kind: "meeting_summary", content: `## 会议纪要
+
+**结论**
+- 下个迭代优先优化移动端首屏加载 [来源 1]。
+
+**待办**
+- [ ] Bob：移动端首屏性能优化
+- [ ] Carol：整理导出 PDF 的需求细节`},
+		},
+	},
+}
+
+// Seed creates the demo users, notebooks, sources, notes of every type and chat history, for
+// manual testing, screenshots and demos. The content is always the same, and seeding again
+// replaces the demo notebooks instead of adding more. The demo users sign in with password.
+func Seed(ctx context.Context, cfg Config, password string) error {
+	if len(password) < minPasswordLength {
+		return fmt.Errorf("the demo password must be at least %d characters", minPasswordLength)
+	}
+	store, err := NewStore(cfg)
+	if err != nil {
+		return fmt.Errorf("failed to initialize store: %w", err)
+	}
+	defer store.Close()
+	vectorStore, err := NewVectorStore(cfg)
+	if err != nil {
+		return fmt.Errorf("failed to initialize vector store: %w", err)
+	}
+	images := NewMockImageClient(cfg.UploadDir)
+
+	passwordHash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return fmt.Errorf("failed to hash password: %w", err)
+	}
+	users := make(map[string]*User)
+	for _, u := range seedUsers {
+		user := &User{Email: u.email, Name: u.name, Provider: "password", Role: u.role}
+		if err := store.CreateUser(ctx, user); err != nil {
+			return fmt.Errorf("failed to create user %s: %w", u.email, err)
+		}
+		if err := store.SetUserPassword(ctx, user.ID, string(passwordHash)); err != nil {
+			return fmt.Errorf("failed to set the password of %s: %w", u.email, err)
+		}
+		users[u.email] = user
+		golog.Infof("👤 demo user: %s", u.email)
+	}
+
+	for _, nb := range seedNotebooks {
+		if err := seedNotebookData(ctx, store, vectorStore, images, users[nb.owner].ID, nb); err != nil {
+			return fmt.Errorf("failed to seed notebook %s: %w", nb.name, err)
+		}
+		golog.Infof("📓 demo notebook: %s (%d sources, %d notes, %d chats)", nb.name, len(nb.sources), len(nb.notes), len(nb.chats))
+	}
+	return nil
+}
+
+// seedNotebookData replaces a demo user's notebook of the same name with the demo notebook
+func seedNotebookData(ctx context.Context, store *Store, vectorStore *VectorStore, images *MockImageClient, userID string, nb seedNotebook) error {
+	existing, err := store.ListNotebooks(ctx, userID)
+	if err != nil {
+		return err
+	}
+	for _, old := range existing {
+		if old.Name != nb.name {
+			continue
+		}
+		if err := store.DeleteNotebook(ctx, old.ID); err != nil {
+			return err
+		}
+		if err := vectorStore.DeleteByNotebook(ctx, old.ID); err != nil {
+			golog.Errorf("failed to drop vector index of notebook %s: %v", old.ID, err)
+		}
+	}
+
+	notebook, err := store.CreateNotebook(ctx, userID, nb.name, nb.description, map[string]interface{}{"seeded": true})
+	if err != nil {
+		return err
+	}
+
+	var sourceIDs []string
+	for _, s := range nb.sources {
+		source := &Source{
+			NotebookID: notebook.ID,
+			Name:       s.name,
+			Type:       s.kind,
+			URL:        s.url,
+			FileName:   s.fileName,
+			Content:    s.content,
+		}
+		if s.fileName != "" {
+			source.FileSize = int64(len(s.content))
+		}
+		if err := store.CreateSource(ctx, source); err != nil {
+			return err
+		}
+		chunkCount, err := vectorStore.IngestText(ctx, notebook.ID, source.ID, source.Name, source.Content)
+		if err != nil {
+			return fmt.Errorf("failed to index source %s: %w", source.Name, err)
+		}
+		if err := store.UpdateSourceChunkCount(ctx, source.ID, chunkCount); err != nil {
+			return err
+		}
+		sourceIDs = append(sourceIDs, source.ID)
+	}
+
+	for _, n := range nb.notes {
+		metadata := map[string]interface{}{"generated_by": "seed"}
+		switch n.kind {
+		case "infograph":
+			path, err := images.GenerateImage(ctx, "mock", nb.name, userID)
+			if err != nil {
+				return err
+			}
+			metadata["image_url"] = "/api/files/" + filepath.Base(path)
+		case "ppt":
+			var slideURLs []string
+			var slideNumbers []int
+			for i, slide := range parsePPTSlides(n.content) {
+				path, err := images.GenerateImage(ctx, "mock", slide.Content, userID)
+				if err != nil {
+					return err
+				}
+				slideURLs = append(slideURLs, "/api/files/"+filepath.Base(path))
+				slideNumbers = append(slideNumbers, i+1)
+			}
+			metadata["slides"] = slideURLs
+			metadata["slide_numbers"] = slideNumbers
+		}
+		note := &Note{
+			NotebookID: notebook.ID,
+			Title:      getTitleForType(n.kind),
+			Content:    n.content,
+			Type:       n.kind,
+			SourceIDs:  sourceIDs,
+			Metadata:   metadata,
+		}
+		if err := store.CreateNote(ctx, note); err != nil {
+			return err
+		}
+	}
+
+	for _, chat := range nb.chats {
+		session, err := store.CreateChatSession(ctx, notebook.ID, chat.title)
+		if err != nil {
+			return err
+		}
+		for _, turn := range chat.turns {
+			if _, err := store.AddChatMessage(ctx, session.ID, "user", turn[0], nil, nil); err != nil {
+				return err
+			}
+			if _, err := store.AddChatMessage(ctx, session.ID, "assistant", turn[1], sourceIDs, map[string]interface{}{"generated_by": "seed"}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -3,11 +3,14 @@ package backend
 import (
 	"context"
 	"embed"
+	"errors"
 	"fmt"
-	"io/fs"
+	"io"
+	"net"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -25,12 +28,50 @@ type Server struct {
 	cfg         Config
 	vectorStore *VectorStore
 	store       *CachedStore
-	agent       *Agent
 	http        *gin.Engine
 	auth        *AuthHandler
+	assets      *frontendAssets
+	// localUserID is the implicit user every request runs as in local mode
+	localUserID string
+	// agent is nil until an LLM provider is configured (see the setup wizard)
+	agent   *Agent
+	agentMu sync.RWMutex
+	setupMu sync.Mutex
+	// inboxMu serializes inbox lookups so concurrent quick notes don't create two inboxes
+	inboxMu sync.Mutex
 	// Track which notebooks have been loaded into vector store
 	loadedNotebooks map[string]bool
 	vectorMutex     sync.RWMutex
+	// draftJobs holds the IDs of draft jobs being generated, so a job never runs twice at once
+	draftJobs sync.Map
+	// ingestQueue feeds ingest job IDs to the ingest workers
+	ingestQueue chan string
+	// transformQueue feeds transform job IDs to the transform workers
+	transformQueue chan string
+	// transformJobs holds the cancel funcs of the transform jobs being generated
+	transformJobs sync.Map
+	// summaryJobs holds the source ID and content hash of the summary layers being written
+	summaryJobs sync.Map
+	// undoEntries holds the deleted items that can still be restored, by undo token
+	undoEntries map[string]*undoEntry
+	undoMu      sync.Mutex
+	// limits counts what each user has used of the per-user rate limits and quotas
+	limits *rateLimiter
+	// latencies keeps the latency of each route and the latest slow requests
+	latencies *latencyTracker
+	// errorReporter sends panics and LLM pipeline failures to Sentry or a webhook, nil if off
+	errorReporter *errorReporter
+	// eventSink receives the exported activity and usage events, nil if exporting is off
+	eventSink     eventSink
+	eventExportMu sync.Mutex
+	// transcriber turns uploaded audio into sources, nil unless TRANSCRIPTION_PROVIDER is set
+	transcriber transcriber
+	// ocr reads uploaded images and scanned PDFs, nil unless OCR_PROVIDER is set
+	ocr ocrEngine
+	// virusScanner checks uploads before they are read, nil unless VIRUS_SCANNER is set
+	virusScanner virusScanner
+	// presence tracks who has each notebook open
+	presence *presenceHub
 }
 
 // NewServer creates a new server
@@ -50,19 +91,34 @@ func NewServer(cfg Config) (*Server, error) {
 	// Wrap store with cache (5 minute TTL)
 	store := NewCachedStore(baseStore, 5*time.Minute)
 
-	// Initialize agent
-	agent, err := NewAgent(cfg, vectorStore)
-	if err != nil {
-		return nil, fmt.Errorf("failed to create agent: %w", err)
+	// Initialize agent, unless the LLM provider is still waiting for first-run setup
+	var agent *Agent
+	if cfg.HasLLMProvider() {
+		agent, err = NewAgent(cfg, vectorStore, newUsageSink(cfg, store))
+		if err != nil {
+			return nil, fmt.Errorf("failed to create agent: %w", err)
+		}
+	} else {
+		golog.Warnf("⚙️  no LLM provider configured, complete setup at /api/setup")
 	}
 
 	// Initialize auth handler
 	authHandler := NewAuthHandler(cfg, baseStore)
 
+	// Hash embedded frontend assets for cache busting
+	assets, err := newFrontendAssets(frontendFS)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load frontend assets: %w", err)
+	}
+
+	reporter, err := newErrorReporter(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create error reporter: %w", err)
+	}
+
 	// Create Gin router
 	gin.SetMode(gin.ReleaseMode)
 	router := gin.New()
-	router.Use(gin.Recovery(), gin.Logger())
 
 	s := &Server{
 		cfg:             cfg,
@@ -71,7 +127,29 @@ func NewServer(cfg Config) (*Server, error) {
 		agent:           agent,
 		http:            router,
 		auth:            authHandler,
+		assets:          assets,
 		loadedNotebooks: make(map[string]bool),
+		ingestQueue:     make(chan string, ingestQueueSize),
+		transformQueue:  make(chan string, transformQueueSize),
+		undoEntries:     make(map[string]*undoEntry),
+		limits:          newRateLimiter(),
+		latencies:       newLatencyTracker(cfg),
+		errorReporter:   reporter,
+		transcriber:     newTranscriber(cfg),
+		virusScanner:    newVirusScanner(cfg),
+		presence:        newPresenceHub(),
+	}
+	s.ocr = newOCREngine(cfg, s.currentAgent)
+	// Panics are logged and reported by handlePanic
+	router.Use(RequestIDMiddleware(), gin.CustomRecoveryWithWriter(io.Discard, s.handlePanic), gin.Logger(), s.trackLatency())
+
+	if cfg.LocalMode {
+		localUser := &User{Email: localUserEmail, Name: "Local User", Provider: "local"}
+		if err := baseStore.CreateUser(context.Background(), localUser); err != nil {
+			return nil, fmt.Errorf("failed to create local user: %w", err)
+		}
+		s.localUserID = localUser.ID
+		golog.Infof("🖥️  local mode enabled, OAuth disabled (user: %s)", localUser.ID)
 	}
 
 	// 延迟加载向量索引，不在启动时加载
@@ -79,50 +157,98 @@ func NewServer(cfg Config) (*Server, error) {
 
 	s.setupRoutes()
 
+	if cfg.CalendarSyncInterval > 0 {
+		s.goSupervised("calendar sync", func() { s.calendarSyncLoop(cfg.CalendarSyncInterval) })
+	}
+	if cfg.ConnectorSyncInterval > 0 {
+		s.goSupervised("connector sync", func() { s.connectorSyncLoop(cfg.ConnectorSyncInterval) })
+	}
+	if cfg.AssetSweepInterval > 0 {
+		s.goSupervised("asset sweep", func() { s.assetSweepLoop(cfg.AssetSweepInterval) })
+	}
+
+	if cfg.SourceCheckInterval > 0 {
+		s.goSupervised("source check", func() { s.sourceCheckLoop(cfg.SourceCheckInterval) })
+	}
+
+	if s.eventSink, err = newEventSink(cfg); err != nil {
+		return nil, fmt.Errorf("failed to create event export sink: %w", err)
+	}
+	if s.eventSink != nil && cfg.EventExportInterval > 0 {
+		s.goSupervised("event export", func() { s.eventExportLoop(cfg.EventExportInterval) })
+	}
+
+	go s.resumeDraftJobs()
+	go s.startIngestWorkers(cfg.IngestWorkers)
+	go s.startTransformWorkers(cfg.TransformWorkers)
+
 	return s, nil
 }
 
 // setupRoutes configures all routes
 func (s *Server) setupRoutes() {
-	// Serve static files from embedded filesystem (no audit)
-	staticFS, _ := fs.Sub(frontendFS, "frontend/static")
-	s.http.StaticFS("/static", http.FS(staticFS))
+	// Serve static files from embedded filesystem (no audit), cached by content hash
+	s.http.GET("/static/*filepath", s.assets.serveStatic)
+	s.http.HEAD("/static/*filepath", s.assets.serveStatic)
 
 	// Serve uploaded files with auth protection
 	// Remove public uploads route - files are now served via authenticated API
-	// Old: uploads.Static("/", "./data/uploads")
+	// Old: uploads.Static("/", cfg.UploadDir)
 
 	// Serve index.html at root (with audit)
-	s.http.GET("/", AuditMiddlewareLite(), func(c *gin.Context) {
-		c.Header("Cache-Control", "no-cache")
-		content, _ := frontendFS.ReadFile("frontend/index.html")
-		c.Data(http.StatusOK, "text/html; charset=utf-8", content)
-	})
+	s.http.GET("/", AuditMiddlewareLite(), s.assets.serveIndex)
 
 	// Serve index.html at /notes/:id (for shareable notebook links)
 	// This route allows users to access a notebook directly via URL like /notes/xxxxxxxx
 	// The frontend will parse the notebook ID from the URL and load it
-	s.http.GET("/notes/:id", AuditMiddlewareLite(), func(c *gin.Context) {
-		c.Header("Cache-Control", "no-cache")
-		content, _ := frontendFS.ReadFile("frontend/index.html")
-		c.Data(http.StatusOK, "text/html; charset=utf-8", content)
-	})
+	s.http.GET("/notes/:id", AuditMiddlewareLite(), s.assets.serveIndex)
 
-	// Auth routes (OAuth - no auth required)
+	// Auth routes (OAuth and password login - no auth required)
 	auth := s.http.Group("/auth")
 	{
+		auth.POST("/login", s.auth.HandlePasswordLogin)
 		auth.GET("/login/:provider", s.auth.HandleLogin)
 		auth.GET("/callback/:provider", s.auth.HandleCallback)
 	}
 
+	// First-run setup wizard (no auth required, only usable before any account exists)
+	s.http.GET("/api/setup", AuditMiddlewareLite(), s.handleGetSetup)
+	s.http.POST("/api/setup", AuditMiddlewareLite(), s.handleSetup)
+
+	// In local mode every request runs as the implicit local user
+	requireAuth := AuthMiddleware(s.cfg.JWTSecret, s.store.Store)
+	optionalAuth := OptionalAuthMiddleware(s.cfg.JWTSecret, s.store.Store)
+	if s.cfg.LocalMode {
+		requireAuth = LocalAuthMiddleware(s.localUserID)
+		optionalAuth = requireAuth
+	}
+
 	// File serving route - checks notebook public status internally
 	golog.Info("Registering /api/files/:filename route")
-	s.http.GET("/api/files/:filename", AuditMiddlewareLite(), OptionalAuthMiddleware(s.cfg.JWTSecret), s.handleServeFile)
+	s.http.GET("/api/files/:filename", AuditMiddlewareLite(), optionalAuth, s.handleServeFile)
+
+	// Presence sockets - browsers can't set the Authorization header on WebSocket requests
+	s.http.GET("/api/notebooks/:id/presence", AuditMiddlewareLite(), optionalAuth, s.handleNotebookPresence)
+
+	// Integration webhooks - authenticated by the platform's request signature
+	s.http.POST("/integrations/slack/:integrationId", AuditMiddlewareLite(), s.handleSlackCommand)
+	s.http.POST("/integrations/discord/:integrationId", AuditMiddlewareLite(), s.handleDiscordInteraction)
+	s.http.POST("/integrations/telegram/:integrationId", AuditMiddlewareLite(), s.handleTelegramWebhook)
+
+	// Automation ingest endpoints - authenticated by the hook token instead of a session
+	hooks := s.http.Group("/api/hooks", AuditMiddlewareLite(), s.hookAuth())
+	{
+		hooks.POST("/ingest", s.handleHookIngest)
+		// Folder watch agent: which files need uploading, and the batch upload itself
+		hooks.POST("/files/check", s.handleHookFilesCheck)
+		hooks.POST("/files", s.uploadQuota(), s.handleHookFiles)
+	}
 
 	// API routes
 	api := s.http.Group("/api")
 	api.Use(AuditMiddlewareLite())
-	api.Use(AuthMiddleware(s.cfg.JWTSecret)) // Apply JWT Auth
+	api.Use(requireAuth) // Apply JWT Auth
+	api.Use(s.rateLimit())
 	{
 		// Health check
 		api.GET("/health", s.handleHealth)
@@ -130,45 +256,179 @@ func (s *Server) setupRoutes() {
 
 		// Auth API (get current user)
 		api.GET("/auth/me", s.auth.HandleMe)
+		// API tokens with a narrower scope, for scripts and automations
+		api.POST("/auth/tokens", s.auth.HandleIssueToken)
+		// Signed-in devices and API tokens, which can be revoked
+		api.GET("/auth/sessions", s.auth.HandleListSessions)
+		api.DELETE("/auth/sessions", s.auth.HandleRevokeOtherSessions)
+		api.DELETE("/auth/sessions/:sessionId", s.auth.HandleRevokeSession)
+		// GitHub and Google accounts the user can sign in with
+		api.GET("/auth/identities", s.auth.HandleListIdentities)
+		api.POST("/auth/identities/:provider", s.auth.HandleLinkIdentity)
+		api.DELETE("/auth/identities/:provider", s.auth.HandleUnlinkIdentity)
+
+		// Quick capture into the inbox notebook
+		api.POST("/quick-note", s.handleQuickNote)
+
+		// Undo a recent deletion
+		api.POST("/undo/:token", s.handleUndo)
+
+		// Slack / Discord bot integrations
+		api.GET("/integrations", s.handleListIntegrations)
+		api.PUT("/integrations/:provider", s.handleSaveIntegration)
+		api.DELETE("/integrations/:provider", s.handleDeleteIntegration)
+		api.POST("/integrations/telegram/link", s.handleTelegramLinkCode)
+		api.DELETE("/integrations/telegram/links", s.handleDeleteTelegramLinks)
+
+		// Ingest hooks for automation tools
+		api.GET("/hooks", s.handleListIngestHooks)
+		api.POST("/hooks", s.handleCreateIngestHook)
+		api.DELETE("/hooks/:hookId", s.handleDeleteIngestHook)
+
+		// Chat answer styles
+		api.GET("/chat/styles", s.handleListAnswerStyles)
+
+		// Saved prompt library
+		api.GET("/prompts", s.handleListSavedPrompts)
+		api.POST("/prompts", s.handleCreateSavedPrompt)
+		api.GET("/prompts/:promptId", s.handleGetSavedPrompt)
+		api.PUT("/prompts/:promptId", s.handleUpdateSavedPrompt)
+		api.DELETE("/prompts/:promptId", s.handleDeleteSavedPrompt)
+		api.POST("/prompts/:promptId/run", s.handleRunSavedPrompt)
 
 		// Notebook routes
 		notebooks := api.Group("/notebooks")
+		// Notebooks under legal hold refuse writes
+		notebooks.Use(s.legalHoldGuard())
 		{
 			notebooks.GET("", s.handleListNotebooks)
 			notebooks.GET("/stats", s.handleListNotebooksWithStats)
 			notebooks.POST("", s.handleCreateNotebook)
+			notebooks.POST("/import", s.uploadQuota(), s.handleImportNotebook)
 			notebooks.GET("/:id", s.handleGetNotebook)
 			notebooks.PUT("/:id", s.handleUpdateNotebook)
 			notebooks.DELETE("/:id", s.handleDeleteNotebook)
+			notebooks.GET("/:id/export", s.handleExportNotebook)
+			notebooks.GET("/:id/activity", s.handleNotebookActivity)
 
 			// Public sharing
 			notebooks.PUT("/:id/public", s.handleSetNotebookPublic)
+			notebooks.GET("/:id/public/policy", s.handleGetSharePolicy)
+			notebooks.PUT("/:id/public/policy", s.handleSetSharePolicy)
+			notebooks.GET("/:id/collaborators", s.handleListCollaborators)
+
+			// Cover image
+			notebooks.PUT("/:id/cover", s.uploadQuota(), s.handleUploadNotebookCover)
+			notebooks.POST("/:id/cover/generate", s.imageQuota(), s.handleGenerateNotebookCover)
+			notebooks.DELETE("/:id/cover", s.handleDeleteNotebookCover)
 
 			// Sources within a notebook
 			notebooks.GET("/:id/sources", s.handleListSources)
 			notebooks.POST("/:id/sources", s.handleAddSource)
+			notebooks.POST("/:id/sources/bibliography", s.handleImportBibliography)
+			notebooks.GET("/:id/related-papers", s.handleRelatedPapers)
+			notebooks.GET("/:id/search", s.handleSearchSources)
+			notebooks.POST("/:id/overlap", s.handleCheckOverlap)
+			notebooks.GET("/:id/sources/:sourceId", s.handleGetSource)
+			notebooks.GET("/:id/sources/:sourceId/content", s.handleGetSourceContent)
+			notebooks.PUT("/:id/sources/:sourceId/read", s.handleMarkSourceRead)
+			notebooks.DELETE("/:id/sources/:sourceId/read", s.handleMarkSourceUnread)
+			notebooks.POST("/:id/sources/:sourceId/check", s.handleCheckSource)
+			notebooks.POST("/:id/sources/:sourceId/refresh", s.handleRefreshSource)
+			notebooks.POST("/:id/sources/:sourceId/reextract", s.handleReextractSource)
+			notebooks.PUT("/:id/sources/:sourceId/file", s.uploadQuota(), s.handleReuploadSource)
+			notebooks.PUT("/:id/sources/:sourceId/content", s.handleUpdateSourceContent)
+			notebooks.GET("/:id/sources/:sourceId/versions", s.handleListSourceVersions)
+			notebooks.GET("/:id/sources/:sourceId/versions/:version", s.handleGetSourceVersion)
+			notebooks.POST("/:id/sources/:sourceId/versions/:version/restore", s.handleRestoreSourceVersion)
+			notebooks.GET("/:id/sources/:sourceId/diff", s.handleSourceDiff)
 			notebooks.DELETE("/:id/sources/:sourceId", s.handleDeleteSource)
+			notebooks.PUT("/:id/sources/:sourceId/transcript", s.handlePairMeetingTranscript)
+			notebooks.PUT("/:id/sources/:sourceId/private", s.handleSetSourcePrivate)
+
+			// Calendar feeds importing meetings as sources
+			notebooks.GET("/:id/calendars", s.handleListCalendarFeeds)
+			notebooks.POST("/:id/calendars", s.handleCreateCalendarFeed)
+			notebooks.POST("/:id/calendars/:feedId/sync", s.handleSyncCalendarFeed)
+			notebooks.DELETE("/:id/calendars/:feedId", s.handleDeleteCalendarFeed)
+
+			// Confluence and SharePoint connectors importing pages and documents as sources
+			notebooks.GET("/:id/connectors", s.handleListConnectors)
+			notebooks.POST("/:id/connectors", s.handleCreateConnector)
+			notebooks.POST("/:id/connectors/:connectorId/sync", s.handleSyncConnector)
+			notebooks.DELETE("/:id/connectors/:connectorId", s.handleDeleteConnector)
 
 			// Notes within a notebook
 			notebooks.GET("/:id/notes", s.handleListNotes)
 			notebooks.POST("/:id/notes", s.handleCreateNote)
+			notebooks.GET("/:id/notes/:noteId", s.handleGetNote)
+			notebooks.PUT("/:id/notes/:noteId", s.handleUpdateNote)
 			notebooks.DELETE("/:id/notes/:noteId", s.handleDeleteNote)
+			notebooks.GET("/:id/notes/:noteId/versions", s.handleListNoteVersions)
+			notebooks.GET("/:id/notes/:noteId/versions/:version", s.handleGetNoteVersion)
+			notebooks.POST("/:id/notes/:noteId/versions/:version/restore", s.handleRestoreNoteVersion)
+			notebooks.PUT("/:id/notes/:noteId/share", s.handleShareNote)
+			notebooks.PUT("/:id/notes/:noteId/private", s.handleSetNotePrivate)
+			notebooks.GET("/:id/notes/:noteId/references", s.handleGetNoteReferences)
+			notebooks.GET("/:id/notes/:noteId/export", s.handleExportNote)
+			notebooks.POST("/:id/notes/:noteId/assist", s.handleNoteAssist)
+			notebooks.POST("/:id/notes/:noteId/audio", s.handleGeneratePodcastAudio)
+			notebooks.POST("/:id/notes/:noteId/edit-chat", s.handleNoteEditChat)
+			notebooks.POST("/:id/notes/:noteId/edit-chat/:messageId/apply", s.handleApplyNoteEdits)
 
 			// Transformations
-			notebooks.POST("/:id/transform", s.handleTransform)
+			notebooks.POST("/:id/transform", s.transformQuota(), s.handleTransform)
+			notebooks.GET("/:id/transform/:jobId", s.handleGetTransformJob)
+			notebooks.DELETE("/:id/transform/:jobId", s.handleCancelTransformJob)
+
+			// Long-form drafts: outline, approval, then section by section
+			notebooks.GET("/:id/drafts", s.handleListDrafts)
+			notebooks.POST("/:id/drafts", s.handleCreateDraft)
+			notebooks.GET("/:id/drafts/:draftId", s.handleGetDraft)
+			notebooks.DELETE("/:id/drafts/:draftId", s.handleDeleteDraft)
+			notebooks.PUT("/:id/drafts/:draftId/outline", s.handleUpdateDraftOutline)
+			notebooks.POST("/:id/drafts/:draftId/approve", s.handleApproveDraft)
+			notebooks.POST("/:id/drafts/:draftId/resume", s.handleResumeDraft)
 
 			// Chat within a notebook
 			notebooks.GET("/:id/chat/sessions", s.handleListChatSessions)
 			notebooks.POST("/:id/chat/sessions", s.handleCreateChatSession)
 			notebooks.DELETE("/:id/chat/sessions/:sessionId", s.handleDeleteChatSession)
 			notebooks.POST("/:id/chat/sessions/:sessionId/messages", s.handleSendMessage)
+			notebooks.POST("/:id/chat/sessions/:sessionId/export", s.handleExportChatSession)
 
 			// Quick chat (auto-create session)
 			notebooks.POST("/:id/chat", s.handleChat)
+			notebooks.POST("/:id/batch-chat", s.handleBatchChat)
+			notebooks.POST("/:id/coverage", s.handleCoverageReport)
+			notebooks.GET("/:id/chat/settings", s.handleGetChatSettings)
+			notebooks.PUT("/:id/chat/settings", s.handleSetChatSettings)
+
+			// HTTP tools the chat model can call
+			notebooks.GET("/:id/tools", s.handleListChatTools)
+			notebooks.POST("/:id/tools", s.handleCreateChatTool)
+			notebooks.GET("/:id/tools/calls", s.handleListChatToolCalls)
+			notebooks.PUT("/:id/tools/:toolId", s.handleUpdateChatTool)
+			notebooks.DELETE("/:id/tools/:toolId", s.handleDeleteChatTool)
 		}
 
 		// Upload endpoint
-		api.POST("/upload", s.handleUpload)
+		api.POST("/upload", s.uploadQuota(), s.handleUpload)
+
+		// Background source imports
+		api.GET("/jobs/:id", s.handleGetIngestJob)
+
+		// Token usage and its estimated cost
+		api.GET("/usage", s.handleGetUsage)
+		api.GET("/admin/usage", s.handleGetAdminUsage)
+		api.POST("/admin/events/export", s.handleExportEvents)
+		api.GET("/admin/slow-requests", s.handleGetSlowRequests)
+		api.GET("/admin/latencies", s.handleGetLatencies)
+
+		// Legal holds making notebooks immutable
+		api.GET("/admin/legal-holds", s.handleListLegalHolds)
+		api.PUT("/admin/notebooks/:id/legal-hold", s.handleSetLegalHold)
+		api.DELETE("/admin/notebooks/:id/legal-hold", s.handleReleaseLegalHold)
 	}
 
 	// Public notebook routes (no authentication required)
@@ -181,16 +441,21 @@ func (s *Server) setupRoutes() {
 		public.GET("/notebooks/:token", s.handleGetPublicNotebook)
 		// Get public notebook sources
 		public.GET("/notebooks/:token/sources", s.handleListPublicSources)
+		public.GET("/notebooks/:token/sources/:sourceId/content", s.handleGetPublicSourceContent)
 		// Get public notebook notes
 		public.GET("/notebooks/:token/notes", s.handleListPublicNotes)
+		public.GET("/notebooks/:token/notes/:noteId", s.handleGetPublicNote)
+		// Chat with a public notebook, if its share policy enables it
+		public.POST("/notebooks/:token/chat", s.publicChatLimit(), s.handlePublicChat)
+		public.GET("/notebooks/:token/presence", s.handlePublicPresence)
+
+		// Single shared note (page for browsers, JSON for API clients) and its images
+		public.GET("/notes/:token", s.handleGetSharedNote)
+		public.GET("/notes/:token/files/:filename", s.handleServeSharedNoteFile)
 	}
 
 	// Serve public notebook page
-	s.http.GET("/public/:token", AuditMiddlewareLite(), func(c *gin.Context) {
-		c.Header("Cache-Control", "no-cache")
-		content, _ := frontendFS.ReadFile("frontend/index.html")
-		c.Data(http.StatusOK, "text/html; charset=utf-8", content)
-	})
+	s.http.GET("/public/:token", AuditMiddlewareLite(), s.assets.serveIndex)
 }
 
 // loadNotebookVectorIndex loads a notebook's sources into the vector store on demand
@@ -210,12 +475,23 @@ func (s *Server) loadNotebookVectorIndex(ctx context.Context, notebookID string)
 		return fmt.Errorf("failed to list sources: %w", err)
 	}
 
+	// Sources ingested since the server started, or kept by a persistent store, are skipped
+	indexed, err := s.vectorStore.IndexedSourceIDs(ctx, notebookID)
+	if err != nil {
+		return fmt.Errorf("failed to list indexed sources: %w", err)
+	}
+
 	for _, src := range sources {
-		if src.Content != "" {
-			if _, err := s.vectorStore.IngestText(ctx, notebookID, src.Name, src.Content); err != nil {
+		if src.Content == "" {
+			continue
+		}
+		if !indexed[src.ID] {
+			if _, err := s.indexSourceContent(ctx, &src); err != nil {
 				golog.Errorf("failed to load source %s: %v", src.Name, err)
+				continue
 			}
 		}
+		s.indexSourceSummaries(ctx, &src, indexed[src.ID])
 	}
 
 	s.loadedNotebooks[notebookID] = true
@@ -225,11 +501,37 @@ func (s *Server) loadNotebookVectorIndex(ctx context.Context, notebookID string)
 	return nil
 }
 
+// reindexNotebookVectorIndex drops a notebook's chunks and loads its sources again. It is the
+// fallback when chunks can't be deleted selectively.
+func (s *Server) reindexNotebookVectorIndex(ctx context.Context, notebookID string) error {
+	s.vectorMutex.Lock()
+	err := s.vectorStore.DeleteByNotebook(ctx, notebookID)
+	delete(s.loadedNotebooks, notebookID)
+	s.vectorMutex.Unlock()
+	if err != nil {
+		return fmt.Errorf("failed to drop vector index: %w", err)
+	}
+	return s.loadNotebookVectorIndex(ctx, notebookID)
+}
+
 // Start starts the server
 func (s *Server) Start() error {
 	addr := fmt.Sprintf("%s:%s", s.cfg.ServerHost, s.cfg.ServerPort)
 	golog.Infof("server starting on %s", addr)
-	return s.http.Run(addr)
+	if !s.cfg.LocalMode {
+		return s.http.Run(addr)
+	}
+
+	// Listen before opening the browser so the first page load doesn't race the server
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	url := "http://" + ln.Addr().String()
+	if err := OpenBrowser(url); err != nil {
+		golog.Warnf("failed to open browser: %v (visit %s manually)", err, url)
+	}
+	return s.http.RunListener(ln)
 }
 
 // Health check handler
@@ -240,7 +542,7 @@ func (s *Server) handleHealth(c *gin.Context) {
 		Timestamp: time.Now().Unix(),
 		Services: map[string]string{
 			"vector_store": s.cfg.VectorStoreType,
-			"llm":          s.cfg.OpenAIModel,
+			"llm":          s.cfg.LLMModel(),
 		},
 	})
 }
@@ -260,6 +562,16 @@ func (s *Server) handleListNotebooks(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to list notebooks"})
 		return
 	}
+	if grant := getTokenGrant(c); grant != nil && len(grant.Notebooks) > 0 {
+		// The store may share the slice with its cache
+		allowed := make([]Notebook, 0, len(grant.Notebooks))
+		for _, notebook := range notebooks {
+			if grant.allowsNotebook(notebook.ID) {
+				allowed = append(allowed, notebook)
+			}
+		}
+		notebooks = allowed
+	}
 	c.JSON(http.StatusOK, notebooks)
 }
 
@@ -278,7 +590,16 @@ func (s *Server) handleListNotebooksWithStats(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to list notebooks with stats"})
 		return
 	}
-	c.JSON(http.StatusOK, notebooks)
+	if grant := getTokenGrant(c); grant != nil && len(grant.Notebooks) > 0 {
+		allowed := make([]NotebookWithStats, 0, len(grant.Notebooks))
+		for _, notebook := range notebooks {
+			if grant.allowsNotebook(notebook.ID) {
+				allowed = append(allowed, notebook)
+			}
+		}
+		notebooks = allowed
+	}
+	c.JSON(http.StatusOK, s.withLegalHolds(ctx, notebooks))
 }
 
 func (s *Server) handleCreateNotebook(c *gin.Context) {
@@ -337,7 +658,12 @@ func (s *Server) handleGetNotebook(c *gin.Context) {
 		return
 	}
 
-	c.JSON(http.StatusOK, notebook)
+	// A copy, since the cached notebook is shared
+	response := *notebook
+	if response.LegalHold, err = s.store.GetLegalHold(ctx, id); err != nil {
+		golog.Errorf("failed to get legal hold of notebook %s: %v", id, err)
+	}
+	c.JSON(http.StatusOK, response)
 }
 
 func (s *Server) handleUpdateNotebook(c *gin.Context) {
@@ -397,6 +723,14 @@ func (s *Server) handleDeleteNotebook(c *gin.Context) {
 		return
 	}
 
+	// Persistent vector indexes would otherwise keep the notebook's chunks
+	s.vectorMutex.Lock()
+	if err := s.vectorStore.DeleteByNotebook(ctx, id); err != nil {
+		golog.Errorf("failed to drop vector index of notebook %s: %v", id, err)
+	}
+	delete(s.loadedNotebooks, id)
+	s.vectorMutex.Unlock()
+
 	c.Status(http.StatusNoContent)
 }
 
@@ -418,9 +752,110 @@ func (s *Server) handleListSources(c *gin.Context) {
 		return
 	}
 
+	// Full content is only returned on request to keep the sources panel payload small
+	if c.Query("include") != "content" {
+		sources = summarizeSources(sources)
+	}
+
+	sources, err = s.withSourceReads(ctx, userID, notebookID, sources)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to load read state"})
+		return
+	}
+	// withSourceReads returned copies, which can be annotated in place
+	if err := s.withSourceHealth(ctx, notebookID, sources); err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to load source health"})
+		return
+	}
+	if err := s.withIngestStatus(ctx, notebookID, sources); err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to load ingest status"})
+		return
+	}
+
 	c.JSON(http.StatusOK, sources)
 }
 
+// getSourceInNotebook loads a source and verifies it belongs to the notebook and the user can access it
+func (s *Server) getSourceInNotebook(c *gin.Context) (*Source, bool) {
+	ctx := context.Background()
+	notebookID := c.Param("id")
+	userID := c.GetString("user_id")
+
+	if err := s.checkNotebookAccess(ctx, notebookID, userID); err != nil {
+		c.JSON(http.StatusForbidden, ErrorResponse{Error: err.Error()})
+		return nil, false
+	}
+
+	source, err := s.store.GetSource(ctx, c.Param("sourceId"))
+	if err != nil || source.NotebookID != notebookID {
+		c.JSON(http.StatusNotFound, ErrorResponse{Error: "Source not found"})
+		return nil, false
+	}
+
+	return source, true
+}
+
+// handleGetSource returns a single source; content is included only with ?include=content
+func (s *Server) handleGetSource(c *gin.Context) {
+	source, ok := s.getSourceInNotebook(c)
+	if !ok {
+		return
+	}
+
+	source = withTOC(source)
+	if c.Query("include") != "content" {
+		summarized := summarizeSources([]Source{*source})
+		source = &summarized[0]
+	}
+
+	c.JSON(http.StatusOK, source)
+}
+
+// handleGetSourceContent returns the full extracted text of a source
+func (s *Server) handleGetSourceContent(c *gin.Context) {
+	source, ok := s.getSourceInNotebook(c)
+	if !ok {
+		return
+	}
+
+	// Opening the full text counts as reading the source
+	if err := s.store.MarkSourceRead(c.Request.Context(), c.GetString("user_id"), source.ID); err != nil {
+		golog.Errorf("failed to mark source %s as read: %v", source.ID, err)
+	}
+
+	response := gin.H{
+		"id":      source.ID,
+		"content": source.Content,
+		"media":   sourceMedia(source),
+	}
+	// The parser of a page that can be extracted again with another one
+	if source.Type == "url" && source.URL != "" && source.FileName == "" && !isCrawledPage(source) {
+		response["parser"] = urlSourceParser(source)
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// sourceSummaryLength is the number of characters kept as a source summary in list responses
+const sourceSummaryLength = 300
+
+// summarizeSources returns copies of the sources with Content replaced by a short summary.
+// The input slice is not modified since it may be shared with the cache.
+func summarizeSources(sources []Source) []Source {
+	result := make([]Source, len(sources))
+	for i, src := range sources {
+		runes := []rune(src.Content)
+		src.ContentLen = len(runes)
+		if len(runes) > sourceSummaryLength {
+			src.Summary = string(runes[:sourceSummaryLength]) + "..."
+		} else {
+			src.Summary = src.Content
+		}
+		src.Content = ""
+		result[i] = src
+	}
+	return result
+}
+
 func (s *Server) handleAddSource(c *gin.Context) {
 	ctx := context.Background()
 	notebookID := c.Param("id")
@@ -437,6 +872,11 @@ func (s *Server) handleAddSource(c *gin.Context) {
 		URL      string                 `json:"url"`
 		Content  string                 `json:"content"`
 		Metadata map[string]interface{} `json:"metadata"`
+		Database *DatabaseSourceRequest `json:"database"` // Connection of a "database" source
+		Language string                 `json:"language"` // Preferred caption language of a YouTube video
+		Crawl    *CrawlOptions          `json:"crawl"`    // Crawl the site of a URL instead of reading one page
+		Sitemap  *SitemapOptions        `json:"sitemap"`  // Limits of the import of a sitemap URL
+		Parser   string                 `json:"parser"`   // How a web page is read: "markitdown" or "readability"; URL_PARSER by default
 	}
 
 	if err := c.ShouldBindJSON(&req); err != nil {
@@ -444,6 +884,18 @@ func (s *Server) handleAddSource(c *gin.Context) {
 		return
 	}
 
+	// A database source's content is the schema of the tables the chat may query
+	var database *SourceDatabase
+	if req.Type == "database" {
+		var err error
+		if database, req.Content, err = s.prepareDatabaseSource(ctx, req.Database); err != nil {
+			c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid database source", Details: err.Error()})
+			return
+		}
+		req.URL = ""
+		req.Metadata = databaseSourceMetadata(req.Metadata, database)
+	}
+
 	source := &Source{
 		NotebookID: notebookID,
 		Name:       req.Name,
@@ -453,23 +905,74 @@ func (s *Server) handleAddSource(c *gin.Context) {
 		Metadata:   req.Metadata,
 	}
 
-	// If URL is provided and Content is empty, fetch content from URL
-	if req.URL != "" {
-		golog.Infof("fetching content from URL: %s", req.URL)
-		content, err := s.vectorStore.ExtractFromURL(ctx, req.URL)
-		if err != nil {
-			golog.Errorf("failed to fetch URL content: %v", err)
-			c.JSON(http.StatusInternalServerError, ErrorResponse{Error: fmt.Sprintf("Failed to fetch URL content: %v", err)})
+	// Linked content is fetched in the background. arXiv identifiers and DOIs resolve to the
+	// paper's metadata and PDF instead of its landing page, and YouTube videos to their captions.
+	ingestKind := ""
+	if kind, _ := parsePaperID(req.URL); kind != "" {
+		ingestKind = "paper"
+	} else if parseYouTubeID(req.URL) != "" {
+		ingestKind = "youtube"
+		if req.Language != "" {
+			if source.Metadata == nil {
+				source.Metadata = make(map[string]interface{})
+			}
+			source.Metadata["caption_language"] = req.Language
+		}
+	} else if req.URL != "" && (req.Sitemap != nil || isSitemapURL(req.URL)) {
+		// The pages a sitemap lists are added as sources of their own
+		if req.Sitemap == nil {
+			req.Sitemap = &SitemapOptions{}
+		}
+		if err := normalizeSitemapOptions(req.Sitemap, s.cfg.SitemapMaxPages); err != nil {
+			c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid sitemap", Details: err.Error()})
+			return
+		}
+		ingestKind = "sitemap"
+		if source.Metadata == nil {
+			source.Metadata = make(map[string]interface{})
+		}
+		source.Metadata["sitemap"] = req.Sitemap
+	} else if req.URL != "" && req.Crawl != nil {
+		if err := normalizeCrawlOptions(req.Crawl, s.cfg.CrawlMaxPages); err != nil {
+			c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid crawl", Details: err.Error()})
+			return
+		}
+		ingestKind = "crawl"
+		if source.Metadata == nil {
+			source.Metadata = make(map[string]interface{})
+		}
+		source.Metadata["crawl"] = req.Crawl
+	} else if req.URL != "" {
+		ingestKind = "url"
+		switch req.Parser {
+		case "":
+			req.Parser = s.defaultURLParser()
+		case URLParserMarkitdown, URLParserReadability:
+		default:
+			c.JSON(http.StatusBadRequest, ErrorResponse{Error: fmt.Sprintf("unknown parser: %s (supported: markitdown, readability)", req.Parser)})
 			return
 		}
-		source.Content = content
-		golog.Infof("URL content fetched successfully, size: %d bytes", len(content))
+		if source.Metadata == nil {
+			source.Metadata = make(map[string]interface{})
+		}
+		source.Metadata["parser"] = req.Parser
+	}
+	if ingestKind != "" {
+		source.Content = ""
 	}
 
 	if err := s.store.CreateSource(ctx, source); err != nil {
 		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to create source"})
 		return
 	}
+	if database != nil {
+		database.SourceID = source.ID
+		if err := s.store.SaveSourceDatabase(ctx, database); err != nil {
+			s.store.DeleteSource(ctx, source.ID)
+			c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to create source", Details: err.Error()})
+			return
+		}
+	}
 
 	// Log source import activity
 	activityLog := &ActivityLog{
@@ -478,7 +981,7 @@ func (s *Server) handleAddSource(c *gin.Context) {
 		ResourceType: "source",
 		ResourceID:   source.ID,
 		ResourceName: source.Name,
-		Details:      fmt.Sprintf(`{"notebook_id": "%s", "source_type": "%s", "source_url": "%s"}`, notebookID, source.Type, source.URL),
+		Details:      fmt.Sprintf(`{"notebook_id": "%s", "source_type": "%s", "source_url": %q}`, notebookID, source.Type, source.URL),
 		IPAddress:    c.ClientIP(),
 		UserAgent:    c.GetHeader("User-Agent"),
 	}
@@ -486,18 +989,47 @@ func (s *Server) handleAddSource(c *gin.Context) {
 		golog.Errorf("failed to log source import activity: %v", err)
 	}
 
-	// Ingest into vector store (synchronous for immediate availability)
-	if source.Content != "" {
-		if chunkCount, err := s.vectorStore.IngestText(ctx, notebookID, source.Name, source.Content); err != nil {
-			golog.Errorf("failed to ingest text: %v", err)
-		} else {
-			s.store.UpdateSourceChunkCount(ctx, source.ID, chunkCount)
+	if ingestKind != "" {
+		if _, err := s.queueSourceIngest(ctx, source, userID, ingestKind); err != nil {
+			c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to queue source import", Details: err.Error()})
+			return
 		}
+		c.JSON(http.StatusAccepted, source)
+		return
 	}
 
+	// Ingest into vector store (synchronous for immediate availability)
+	s.ingestSourceText(ctx, source)
+
 	c.JSON(http.StatusCreated, source)
 }
 
+// indexSourceContent adds the chunks of a source to the vector store. Of CSV and Excel sources
+// only the headers and first rows of their tables are indexed, as the table query tool answers
+// questions about their data.
+func (s *Server) indexSourceContent(ctx context.Context, source *Source) (int, error) {
+	if omitted := tableOmittedSpans(*source); len(omitted) > 0 {
+		return s.vectorStore.IngestTable(ctx, source.NotebookID, source.ID, source.Name, source.Content, omitted)
+	}
+	return s.vectorStore.IngestText(ctx, source.NotebookID, source.ID, source.Name, source.Content)
+}
+
+// ingestSourceText indexes a text source into the vector store and records its chunk count
+func (s *Server) ingestSourceText(ctx context.Context, source *Source) {
+	if source.Content == "" {
+		return
+	}
+	s.updateSourceTOC(ctx, source)
+	chunkCount, err := s.indexSourceContent(ctx, source)
+	if err != nil {
+		golog.Errorf("failed to ingest text: %v", err)
+		return
+	}
+	source.ChunkCount = chunkCount
+	s.store.UpdateSourceChunkCount(ctx, source.ID, chunkCount)
+	s.indexSourceSummaries(ctx, source, false)
+}
+
 func (s *Server) handleDeleteSource(c *gin.Context) {
 	ctx := context.Background()
 	sourceID := c.Param("sourceId")
@@ -515,12 +1047,33 @@ func (s *Server) handleDeleteSource(c *gin.Context) {
 		return
 	}
 
+	versions, err := s.sourceVersionsForUndo(ctx, source.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to delete source", Details: err.Error()})
+		return
+	}
+
 	if err := s.store.DeleteSource(ctx, sourceID); err != nil {
 		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to delete source"})
 		return
 	}
 
-	c.Status(http.StatusNoContent)
+	// Chat must not keep citing the deleted source
+	if err := s.vectorStore.DeleteBySource(ctx, source.NotebookID, source.ID, source.Name); err != nil {
+		golog.Warnf("failed to delete chunks of source %s, re-indexing notebook: %v", source.ID, err)
+		if err := s.reindexNotebookVectorIndex(ctx, source.NotebookID); err != nil {
+			golog.Errorf("failed to re-index notebook %s: %v", source.NotebookID, err)
+		}
+	}
+
+	s.offerUndo(c, "source", source.NotebookID, func(ctx context.Context) (interface{}, error) {
+		if err := s.store.RestoreSource(ctx, source, versions); err != nil {
+			return nil, err
+		}
+		source.ChunkCount = 0
+		s.ingestSourceText(ctx, source)
+		return source, nil
+	})
 }
 
 func (s *Server) checkNotebookAccess(ctx context.Context, notebookID, userID string) error {
@@ -548,6 +1101,15 @@ func (s *Server) handleUpload(c *gin.Context) {
 		c.JSON(http.StatusForbidden, ErrorResponse{Error: err.Error()})
 		return
 	}
+	if !tokenAllowsNotebook(c, notebookID) {
+		c.JSON(http.StatusForbidden, ErrorResponse{Error: "access denied"})
+		return
+	}
+	// Uploads are outside the notebook routes, so legalHoldGuard doesn't see them
+	if err := s.checkLegalHold(ctx, notebookID); err != nil {
+		c.JSON(http.StatusLocked, ErrorResponse{Error: "Notebook is under legal hold"})
+		return
+	}
 
 	file, err := c.FormFile("file")
 	if err != nil {
@@ -555,14 +1117,23 @@ func (s *Server) handleUpload(c *gin.Context) {
 		return
 	}
 
+	if mediaKind(file.Filename) != "" && s.transcriber == nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Transcription is not configured", Details: "set TRANSCRIPTION_PROVIDER to openai, whispercpp or mock"})
+		return
+	}
+	if isImage(file.Filename) && s.ocr == nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "OCR is not configured", Details: "set OCR_PROVIDER to tesseract, vision or mock"})
+		return
+	}
+
 	// Generate unique filename to avoid conflicts
 	ext := filepath.Ext(file.Filename)
 	baseName := file.Filename[:len(file.Filename)-len(ext)]
 	uniqueFileName := fmt.Sprintf("%s_%s%s", baseName, uuid.New().String()[:8], ext)
 
 	// Store in user-specific directory for isolation
-	userUploadDir := fmt.Sprintf("./data/uploads/%s", userID)
-	tempPath := fmt.Sprintf("%s/%s", userUploadDir, uniqueFileName)
+	userUploadDir := filepath.Join(s.cfg.UploadDir, userID)
+	tempPath := filepath.Join(userUploadDir, uniqueFileName)
 
 	// Ensure user uploads directory exists
 	if err := os.MkdirAll(userUploadDir, 0755); err != nil {
@@ -587,18 +1158,12 @@ func (s *Server) handleUpload(c *gin.Context) {
 		FileSize:   file.Size,
 		Metadata:   map[string]interface{}{"path": tempPath, "user_id": userID},
 	}
-
-	// Extract content
-	content, err := s.vectorStore.ExtractDocument(ctx, tempPath)
-	if err != nil {
-		golog.Errorf("failed to extract document content: %v", err)
-		// Clean up uploaded file on error
-		os.Remove(tempPath)
-		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: fmt.Sprintf("Failed to extract document content: %v", err)})
-		return
+	// The hash lets the folder watch agent skip files already in the notebook
+	if hash, err := fileSHA256(tempPath); err == nil {
+		source.Metadata["sha256"] = hash
 	}
-	source.Content = content
 
+	// Content is extracted in the background
 	if err := s.store.CreateSource(ctx, source); err != nil {
 		golog.Errorf("failed to create source: %v", err)
 		// Clean up uploaded file on error
@@ -622,28 +1187,12 @@ func (s *Server) handleUpload(c *gin.Context) {
 		golog.Errorf("failed to log file upload activity: %v", err)
 	}
 
-	// Ingest into vector store (synchronous for immediate availability)
-	// Get chunk count from vector store stats
-	stats, _ := s.vectorStore.GetStats(ctx)
-	totalDocsBefore := stats.TotalDocuments
-
-	if source.Content != "" {
-		if _, err := s.vectorStore.IngestText(ctx, notebookID, source.Name, source.Content); err != nil {
-			golog.Errorf("failed to ingest document: %v", err)
-		} else {
-			// Get updated stats to calculate chunk count
-			stats, _ = s.vectorStore.GetStats(ctx)
-			chunkCount := stats.TotalDocuments - totalDocsBefore
-
-			// Update source with chunk count
-			source.ChunkCount = chunkCount
-
-			// Update in database
-			s.store.UpdateSourceChunkCount(ctx, source.ID, chunkCount)
-		}
+	if _, err := s.queueSourceIngest(ctx, source, userID, "file"); err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to queue file extraction", Details: err.Error()})
+		return
 	}
 
-	c.JSON(http.StatusCreated, source)
+	c.JSON(http.StatusAccepted, source)
 }
 
 // Note handlers
@@ -668,6 +1217,19 @@ func (s *Server) handleListNotes(c *gin.Context) {
 	c.JSON(http.StatusOK, notes)
 }
 
+// handleGetNote returns a note with its full content, which lists leave out of notes stored
+// in blob storage
+func (s *Server) handleGetNote(c *gin.Context) {
+	note, ok := s.getNoteInNotebook(c)
+	if !ok {
+		return
+	}
+	if note.Title == "笔记" {
+		note.Title = getTitleForType(note.Type)
+	}
+	c.JSON(http.StatusOK, note)
+}
+
 func (s *Server) handleCreateNote(c *gin.Context) {
 	ctx := context.Background()
 	notebookID := c.Param("id")
@@ -684,6 +1246,13 @@ func (s *Server) handleCreateNote(c *gin.Context) {
 		return
 	}
 
+	if s.cfg.MaxNoteContentSize > 0 && len(req.Content) > s.cfg.MaxNoteContentSize {
+		c.JSON(http.StatusRequestEntityTooLarge, ErrorResponse{
+			Error: fmt.Sprintf("Note content exceeds the maximum size of %d bytes", s.cfg.MaxNoteContentSize),
+		})
+		return
+	}
+
 	note := &Note{
 		NotebookID: notebookID,
 		Title:      req.Title,
@@ -717,33 +1286,52 @@ func (s *Server) handleCreateNote(c *gin.Context) {
 
 func (s *Server) handleDeleteNote(c *gin.Context) {
 	ctx := context.Background()
-	noteID := c.Param("noteId")
+	note, ok := s.getNoteInNotebook(c)
+	if !ok {
+		return
+	}
 
-	if err := s.store.DeleteNote(ctx, noteID); err != nil {
+	versions, err := s.noteVersionsForUndo(ctx, note.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to delete note", Details: err.Error()})
+		return
+	}
+
+	if err := s.store.DeleteNote(ctx, note.ID); err != nil {
 		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to delete note"})
 		return
 	}
 
-	c.Status(http.StatusNoContent)
+	s.offerUndo(c, "note", note.NotebookID, func(ctx context.Context) (interface{}, error) {
+		if err := s.store.RestoreNote(ctx, note, versions); err != nil {
+			return nil, err
+		}
+		return note, nil
+	})
 }
 
 // Transformation handlers
 
 func (s *Server) handleTransform(c *gin.Context) {
-	ctx := context.Background()
+	ctx := c.Request.Context()
+	if _, ok := s.requireAgent(c); !ok {
+		return
+	}
 	notebookID := c.Param("id")
 	userID := c.GetString("user_id")
 
-	// 按需加载向量索引
-	if err := s.loadNotebookVectorIndex(ctx, notebookID); err != nil {
-		golog.Errorf("failed to load vector index: %v", err)
-	}
-
 	var req TransformationRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
 		return
 	}
+	if req.Section != nil {
+		req.SourceIDs = []string{req.Section.SourceID}
+		req.UnreadOnly = false
+	}
+	if (req.Type == "infograph" || req.Type == "ppt") && !s.checkImageQuota(c) {
+		return
+	}
 
 	// Check if multiple notes of same type are allowed
 	if !s.cfg.AllowMultipleNotesOfSameType {
@@ -788,151 +1376,96 @@ func (s *Server) handleTransform(c *gin.Context) {
 		}
 	}
 
-	if len(sources) == 0 {
-		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "No sources available"})
-		return
-	}
-
-	// Generate transformation
-	response, err := s.agent.GenerateTransformation(ctx, &req, sources)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: fmt.Sprintf("Generation failed: %v", err)})
-		return
-	}
-
-	metadata := map[string]interface{}{
-		"length": req.Length,
-		"format": req.Format,
-	}
-
-	// If type is infograph, generate the image as well
-	if req.Type == "infograph" {
-		extra := "**注意：无论来源是什么语言，请务必使用中文**"
-		prompt := response.Content + "\n\n" + extra
-		imageModel := s.getImageModelForProvider()
-		imagePath, err := s.agent.provider.GenerateImage(ctx, imageModel, prompt, userID)
+	if req.UnreadOnly {
+		sources, err = s.unreadSources(ctx, userID, notebookID, sources)
 		if err != nil {
-			golog.Errorf("failed to generate infographic image: %v", err)
-			metadata["image_error"] = err.Error()
-		} else {
-			// Convert local path to web path (authenticated API)
-			webPath := "/api/files/" + filepath.Base(imagePath)
-			metadata["image_url"] = webPath
+			c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to load read state"})
+			return
 		}
-	}
-
-	// If type is ppt, generate images for each slide
-	if req.Type == "ppt" {
-		slides := s.agent.ParsePPTSlides(response.Content)
-		if len(slides) > 10 {
-			golog.Errorf("ppt contains too many slides (%d), maximum allowed is 20. skipping image generation.", len(slides))
-			metadata["image_error"] = "PPT页数超过20页上限，已停止生成图片"
-		} else {
-			var slideURLs []string
-			golog.Infof("generating %d slides for ppt...", len(slides))
-
-			for i, slide := range slides {
-				golog.Infof("generating image for slide %d/%d...", i+1, len(slides))
-				// Combine style and slide content for the image generator
-				prompt := fmt.Sprintf("Style: %s\n\nSlide Content: %s", slides[0].Style, slide.Content)
-				prompt += "\n\n**注意：无论来源是什么语言，请务必使用中文**\n"
-				imageModel := s.getImageModelForProvider()
-				imagePath, err := s.agent.provider.GenerateImage(ctx, imageModel, prompt, userID)
-				if err != nil {
-					golog.Errorf("failed to generate slide %d: %v", i+1, err)
-					continue
-				}
-				slideURLs = append(slideURLs, "/api/files/"+filepath.Base(imagePath))
-			}
-			metadata["slides"] = slideURLs
+		if len(sources) == 0 {
+			c.JSON(http.StatusBadRequest, ErrorResponse{Error: "No unread sources available"})
+			return
+		}
+		req.SourceIDs = make([]string, len(sources))
+		for i, src := range sources {
+			req.SourceIDs[i] = src.ID
 		}
 	}
 
-	// Save as note
-	// For infograph type: clear content only when image generation succeeds
-	// If image generation fails, keep the prompt as content so user can see/retry it
-	noteContent := response.Content
-	if req.Type == "infograph" {
-		// Check if image generation succeeded
-		if metadata["image_url"] != nil {
-			noteContent = "" // Clear content when image was generated successfully
+	if len(sources) == 0 {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "No sources available"})
+		return
+	}
+	if req.Section != nil {
+		if _, _, _, err := sourceSection(sources[0], req.Section); err != nil {
+			c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid section", Details: err.Error()})
+			return
 		}
-		// If image generation failed, noteContent remains as response.Content (the prompt)
 	}
 
-	note := &Note{
+	// Generation can take minutes, so it runs on a transform worker and the client polls the job
+	job := &TransformJob{
 		NotebookID: notebookID,
-		Title:      getTitleForType(req.Type),
-		Content:    noteContent,
-		Type:       req.Type,
-		SourceIDs:  req.SourceIDs,
-		Metadata:   metadata,
+		UserID:     userID,
+		Request:    req,
+		Status:     TransformStatusQueued,
 	}
-
-	if err := s.store.CreateNote(ctx, note); err != nil {
-		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to save note"})
+	job.Request.UnreadOnly = false // The unread sources are resolved into SourceIDs above
+	if err := s.store.CreateTransformJob(ctx, job); err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to create transform job"})
 		return
 	}
+	s.enqueueTransformJob(job.ID)
 
-	// Log transformation activity
-	activityLog := &ActivityLog{
-		UserID:       userID,
-		Action:       "transform",
-		ResourceType: "note",
-		ResourceID:   note.ID,
-		ResourceName: note.Title,
-		Details:      fmt.Sprintf(`{"notebook_id": "%s", "transform_type": "%s", "length": "%s", "format": "%s", "source_count": %d}`, notebookID, req.Type, req.Length, req.Format, len(req.SourceIDs)),
-		IPAddress:    c.ClientIP(),
-		UserAgent:    c.GetHeader("User-Agent"),
-	}
-	if err := s.store.LogActivity(ctx, activityLog); err != nil {
-		golog.Errorf("failed to log transformation activity: %v", err)
-	}
-
-	// If type is insight, inject the insight report as a new source
-	if req.Type == "insight" {
-		insightSource := &Source{
-			NotebookID: notebookID,
-			Name:       "洞察报告",
-			Type:       "insight",
-			Content:    response.Content,
-			Metadata: map[string]interface{}{
-				"generated_at": time.Now(),
-				"source_ids":   req.SourceIDs,
-			},
-		}
+	c.JSON(http.StatusAccepted, job)
+}
 
-		if err := s.store.CreateSource(ctx, insightSource); err != nil {
-			golog.Errorf("failed to create insight source: %v", err)
-		} else {
-			// Ingest into vector store for future reference
-			if chunkCount, err := s.vectorStore.IngestText(ctx, notebookID, insightSource.Name, insightSource.Content); err != nil {
-				golog.Errorf("failed to ingest insight text: %v", err)
-			} else {
-				s.store.UpdateSourceChunkCount(ctx, insightSource.ID, chunkCount)
-			}
+// requestContext returns a context for LLM work bounded by the client-supplied
+// X-Request-Timeout header (in seconds). The configured per-operation timeouts
+// still apply; whichever deadline is shorter wins.
+func requestContext(c *gin.Context) (context.Context, context.CancelFunc) {
+	// Not canceled with the request, but carrying its values such as its timings
+	ctx := context.WithoutCancel(c.Request.Context())
+	if value := c.GetHeader("X-Request-Timeout"); value != "" {
+		if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+			return context.WithTimeout(ctx, time.Duration(seconds)*time.Second)
 		}
 	}
+	return context.WithCancel(ctx)
+}
 
-	c.JSON(http.StatusOK, note)
+// generationErrorStatus maps an LLM generation error to an HTTP status.
+// Context overflows that survived the agent's reduced-context retries are reported as 413.
+func generationErrorStatus(err error) int {
+	if isContextLengthError(err) {
+		return http.StatusRequestEntityTooLarge
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusInternalServerError
 }
 
 func getTitleForType(t string) string {
 	titles := map[string]string{
-		"summary":     "摘要",
-		"faq":         "常见问题解答",
-		"study_guide": "学习指南",
-		"outline":     "大纲",
-		"podcast":     "播客脚本",
-		"timeline":    "时间线",
-		"glossary":    "术语表",
-		"quiz":        "测验",
-		"infograph":   "信息图",
-		"ppt":         "幻灯片",
-		"mindmap":     "思维导图",
-		"insight":     "洞察报告",
-		"data_table":  "数据表格",
-		"data_chart":  "数据图表",
+		"summary":         "摘要",
+		"faq":             "常见问题解答",
+		"study_guide":     "学习指南",
+		"outline":         "大纲",
+		"podcast":         "播客脚本",
+		"timeline":        "时间线",
+		"glossary":        "术语表",
+		"quiz":            "测验",
+		"infograph":       "信息图",
+		"ppt":             "幻灯片",
+		"mindmap":         "思维导图",
+		"insight":         "洞察报告",
+		"data_table":      "数据表格",
+		"data_chart":      "数据图表",
+		"meeting_summary": "会议纪要",
+		"references":      "参考文献",
+		"draft":           "长文草稿",
+		"chat":            "对话记录",
 	}
 	if title, ok := titles[t]; ok {
 		return title
@@ -976,18 +1509,37 @@ func (s *Server) handleCreateChatSession(c *gin.Context) {
 
 func (s *Server) handleDeleteChatSession(c *gin.Context) {
 	ctx := context.Background()
-	sessionID := c.Param("sessionId")
+	notebookID := c.Param("id")
+	if err := s.checkNotebookAccess(ctx, notebookID, c.GetString("user_id")); err != nil {
+		c.JSON(http.StatusForbidden, ErrorResponse{Error: err.Error()})
+		return
+	}
+	session, err := s.store.GetChatSession(ctx, c.Param("sessionId"))
+	if err != nil || session.NotebookID != notebookID {
+		c.JSON(http.StatusNotFound, ErrorResponse{Error: "Chat session not found"})
+		return
+	}
 
-	if err := s.store.DeleteChatSession(ctx, sessionID); err != nil {
+	if err := s.store.DeleteChatSession(ctx, session.ID); err != nil {
 		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to delete chat session"})
 		return
 	}
 
-	c.Status(http.StatusNoContent)
+	s.offerUndo(c, "chat_session", notebookID, func(ctx context.Context) (interface{}, error) {
+		if err := s.store.RestoreChatSession(ctx, session); err != nil {
+			return nil, err
+		}
+		return session, nil
+	})
 }
 
 func (s *Server) handleSendMessage(c *gin.Context) {
-	ctx := context.Background()
+	ctx, cancel := requestContext(c)
+	defer cancel()
+	agent, ok := s.requireAgent(c)
+	if !ok {
+		return
+	}
 	notebookID := c.Param("id")
 	sessionID := c.Param("sessionId")
 
@@ -1001,9 +1553,18 @@ func (s *Server) handleSendMessage(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
 		return
 	}
+	settings, err := s.resolveChatSettings(ctx, notebookID, req.Style)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid answer style", Details: err.Error()})
+		return
+	}
+	if err := s.scopeToSection(ctx, notebookID, settings, req.Section); err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid section", Details: err.Error()})
+		return
+	}
 
 	// Add user message
-	_, err := s.store.AddChatMessage(ctx, sessionID, "user", req.Message, nil)
+	_, err = s.store.AddChatMessage(ctx, sessionID, "user", req.Message, nil, nil)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to add message"})
 		return
@@ -1016,10 +1577,13 @@ func (s *Server) handleSendMessage(c *gin.Context) {
 		return
 	}
 
-	// Generate response
-	response, err := s.agent.Chat(ctx, notebookID, req.Message, session.Messages)
+	// Generate response, streamed if the client asked for it
+	ctx = withUsageScope(ctx, c.GetString("user_id"), notebookID)
+	stream := startChatStream(c)
+	response, err := agent.Chat(ctx, notebookID, req.Message, s.chatGlossary(ctx, notebookID, req.Message, nil), settings, session.Messages, s.chatToolRunner(ctx, notebookID, sessionID), stream.onToken())
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: fmt.Sprintf("Chat failed: %v", err)})
+		s.reportGenerationError(c, err)
+		stream.reply(c, generationErrorStatus(err), ErrorResponse{Error: fmt.Sprintf("Chat failed: %v", err)})
 		return
 	}
 
@@ -1028,17 +1592,22 @@ func (s *Server) handleSendMessage(c *gin.Context) {
 	for i, src := range response.Sources {
 		sourceIDs[i] = src.ID
 	}
-	_, err = s.store.AddChatMessage(ctx, sessionID, "assistant", response.Message, sourceIDs)
+	_, err = s.store.AddChatMessage(ctx, sessionID, "assistant", response.Message, sourceIDs, chatMessageMetadata(response))
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to save response"})
+		stream.reply(c, http.StatusInternalServerError, ErrorResponse{Error: "Failed to save response"})
 		return
 	}
 
-	c.JSON(http.StatusOK, response)
+	stream.reply(c, http.StatusOK, response)
 }
 
 func (s *Server) handleChat(c *gin.Context) {
-	ctx := context.Background()
+	ctx, cancel := requestContext(c)
+	defer cancel()
+	agent, ok := s.requireAgent(c)
+	if !ok {
+		return
+	}
 	notebookID := c.Param("id")
 
 	// 按需加载向量索引
@@ -1052,8 +1621,24 @@ func (s *Server) handleChat(c *gin.Context) {
 		return
 	}
 
+	s.replyChat(c, ctx, agent, notebookID, req.SessionID, req.Message, req.Style, req.Section)
+}
+
+// replyChat answers a chat message in a session of a notebook, starting a session if sessionID
+// is empty, and records both messages. style is the requested answer style, "" for the
+// notebook's default; section, if not nil, limits retrieval to a section of a source.
+func (s *Server) replyChat(c *gin.Context, ctx context.Context, agent *Agent, notebookID, sessionID, message, style string, section *SourceSection) {
+	settings, err := s.resolveChatSettings(ctx, notebookID, style)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid answer style", Details: err.Error()})
+		return
+	}
+	if err := s.scopeToSection(ctx, notebookID, settings, section); err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid section", Details: err.Error()})
+		return
+	}
+
 	// Create or get session
-	sessionID := req.SessionID
 	if sessionID == "" {
 		session, err := s.store.CreateChatSession(ctx, notebookID, "")
 		if err != nil {
@@ -1070,10 +1655,13 @@ func (s *Server) handleChat(c *gin.Context) {
 		return
 	}
 
-	// Generate response
-	response, err := s.agent.Chat(ctx, notebookID, req.Message, session.Messages)
+	// Generate response, streamed if the client asked for it
+	ctx = withUsageScope(ctx, c.GetString("user_id"), notebookID)
+	stream := startChatStream(c)
+	response, err := agent.Chat(ctx, notebookID, message, s.chatGlossary(ctx, notebookID, message, nil), settings, session.Messages, s.chatToolRunner(ctx, notebookID, sessionID), stream.onToken())
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: fmt.Sprintf("Chat failed: %v", err)})
+		s.reportGenerationError(c, err)
+		stream.reply(c, generationErrorStatus(err), ErrorResponse{Error: fmt.Sprintf("Chat failed: %v", err)})
 		return
 	}
 
@@ -1084,17 +1672,17 @@ func (s *Server) handleChat(c *gin.Context) {
 	for i, src := range response.Sources {
 		sourceIDs[i] = src.ID
 	}
-	s.store.AddChatMessage(ctx, sessionID, "user", req.Message, nil)
-	s.store.AddChatMessage(ctx, sessionID, "assistant", response.Message, sourceIDs)
+	s.store.AddChatMessage(ctx, sessionID, "user", message, nil, nil)
+	s.store.AddChatMessage(ctx, sessionID, "assistant", response.Message, sourceIDs, chatMessageMetadata(response))
 
-	c.JSON(http.StatusOK, response)
+	stream.reply(c, http.StatusOK, response)
 }
 
 // Utility functions
 
 // handleServeFile serves uploaded files with proper access control
 // Rules:
-// 1. If notebook is public -> allow access
+// 1. If notebook is public and its share policy exposes the file -> allow access
 // 2. If notebook is private -> require authentication and ownership
 //
 // Files can come from two sources:
@@ -1113,9 +1701,16 @@ func (s *Server) handleServeFile(c *gin.Context) {
 		return
 	}
 
+	// Notebook covers live in blob storage rather than the uploads directory
+	if notebook, data, err := s.store.GetNotebookCover(ctx, filename); err == nil {
+		s.serveNotebookCover(c, notebook, data)
+		return
+	}
+
 	var ownerUserID string
 	var isPublic bool
 	var notebookID string
+	var generatedBy *Notebook // Notebook of a generated image, which is watermarked for the public
 
 	// Try to find the file in sources table first (uploaded files)
 	golog.Infof("Trying to find file %s in sources table", filename)
@@ -1124,17 +1719,21 @@ func (s *Server) handleServeFile(c *gin.Context) {
 		// File is from a source upload
 		golog.Infof("File found in sources table, source_id: %s, notebook_id: %s", source.ID, notebook.ID)
 		ownerUserID = notebook.UserID
-		isPublic = notebook.IsPublic
+		isPublic = notebook.IsPublic && !source.Private && s.publicFileAllowed(ctx, notebook.ID, nil)
 		notebookID = notebook.ID
 	} else {
 		golog.Infof("File not in sources table (err: %v), trying notes table", err)
 		// File not in sources table - try notes table (generated files like infographics)
-		note, nb, err := s.store.GetNoteByFileName(ctx, filename)
+		// Of the notes sharing a generated asset, one the user may see decides access
+		note, nb, err := s.store.GetNoteByFileName(ctx, filename, func(note *Note, nb *Notebook) bool {
+			return (nb.UserID == userID && tokenAllowsNotebook(c, nb.ID)) || (nb.IsPublic && s.publicFileAllowed(ctx, nb.ID, note))
+		})
 		if err == nil && note != nil && nb != nil {
 			golog.Infof("File found in notes table, note_id: %s, notebook_id: %s, is_public: %v", note.ID, nb.ID, nb.IsPublic)
 			ownerUserID = nb.UserID
-			isPublic = nb.IsPublic
+			isPublic = nb.IsPublic && s.publicFileAllowed(ctx, nb.ID, note)
 			notebookID = nb.ID
+			generatedBy = nb
 		} else {
 			// File not found in either table
 			golog.Errorf("File not found in either table (notes err: %v)", err)
@@ -1155,15 +1754,30 @@ func (s *Server) handleServeFile(c *gin.Context) {
 			c.JSON(http.StatusUnauthorized, ErrorResponse{Error: "Authorization required"})
 			return
 		}
-		if userID != ownerUserID {
+		if userID != ownerUserID || !tokenAllowsNotebook(c, notebookID) {
 			golog.Warnf("Unauthorized access attempt by user %s to file %s owned by %s", userID, filename, ownerUserID)
 			c.JSON(http.StatusForbidden, ErrorResponse{Error: "Access denied"})
 			return
 		}
 	}
 
+	if isPublic && userID != ownerUserID && generatedBy != nil && s.serveWatermarked(c, generatedBy, filename) {
+		golog.Infof("File served watermarked: %s (notebook: %s)", filename, notebookID)
+		return
+	}
+	if !s.serveUploadedFile(c, ownerUserID, filename, isPublic) {
+		return
+	}
+
+	golog.Infof("File served: %s (notebook: %s, public: %v, user: %s)",
+		filename, notebookID, isPublic, userID)
+}
+
+// serveUploadedFile serves a file from the owner's uploads directory.
+// It reports whether the file was served; on failure an error response has been written.
+func (s *Server) serveUploadedFile(c *gin.Context, ownerUserID, filename string, isPublic bool) bool {
 	// Build file path using the owner's user ID
-	filePath := filepath.Join("./data/uploads", ownerUserID, filename)
+	filePath := filepath.Join(s.cfg.UploadDir, ownerUserID, filename)
 
 	golog.Infof("Trying to load file: %s (owner: %s, public: %v)", filePath, ownerUserID, isPublic)
 
@@ -1172,24 +1786,24 @@ func (s *Server) handleServeFile(c *gin.Context) {
 	if err != nil {
 		golog.Errorf("Failed to get absolute path for %s: %v", filePath, err)
 		c.JSON(http.StatusNotFound, ErrorResponse{Error: "File not found"})
-		return
+		return false
 	}
 
 	golog.Infof("Absolute path: %s", absPath)
 
 	// Verify the path is within the uploads directory
-	absUploadDir, _ := filepath.Abs("./data/uploads")
-	if !strings.HasPrefix(absPath, absUploadDir) {
+	absUploadDir, _ := filepath.Abs(s.cfg.UploadDir)
+	if !isWithinDir(absUploadDir, absPath) {
 		golog.Warnf("Attempted directory traversal for file: %s", filename)
 		c.JSON(http.StatusForbidden, ErrorResponse{Error: "Access denied"})
-		return
+		return false
 	}
 
 	// Check if file exists
 	if _, err := os.Stat(absPath); os.IsNotExist(err) {
 		golog.Errorf("File not found: %s", absPath)
 		c.JSON(http.StatusNotFound, ErrorResponse{Error: "File not found"})
-		return
+		return false
 	}
 
 	golog.Infof("File found and serving: %s", absPath)
@@ -1210,6 +1824,16 @@ func (s *Server) handleServeFile(c *gin.Context) {
 		contentType = "image/svg+xml"
 	case ".pdf":
 		contentType = "application/pdf"
+	case ".wav":
+		contentType = "audio/wav"
+	case ".mp3":
+		contentType = "audio/mpeg"
+	case ".m4a":
+		contentType = "audio/mp4"
+	case ".mp4":
+		contentType = "video/mp4"
+	case ".webm":
+		contentType = "video/webm"
 	}
 
 	c.Header("Content-Type", contentType)
@@ -1220,9 +1844,16 @@ func (s *Server) handleServeFile(c *gin.Context) {
 		c.Header("Cache-Control", "no-cache")
 	}
 	c.File(absPath)
+	return true
+}
 
-	golog.Infof("File served: %s (notebook: %s, public: %v, user: %s)",
-		filename, notebookID, isPublic, userID)
+// isWithinDir reports whether path is dir itself or located inside it
+func isWithinDir(dir, path string) bool {
+	rel, err := filepath.Rel(dir, path)
+	if err != nil {
+		return false
+	}
+	return rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) && !filepath.IsAbs(rel)
 }
 
 func writeFile(path, content string) error {
@@ -1237,21 +1868,6 @@ func removeFile(path string) error {
 	return os.Remove(path)
 }
 
-// getImageModelForProvider returns the image model based on configured provider
-func (s *Server) getImageModelForProvider() string {
-	switch s.cfg.ImageProvider {
-	case "glm":
-		return s.cfg.GLMImageModel
-	case "zimage":
-		return s.cfg.ZImageModel
-	case "gemini":
-		return s.cfg.GeminiImageModel
-	default:
-		// Default to Gemini if provider is unknown
-		return s.cfg.GeminiImageModel
-	}
-}
-
 // Public sharing handlers
 
 // handleSetNotebookPublic sets the notebook's public status
@@ -1307,29 +1923,29 @@ func (s *Server) handleSetNotebookPublic(c *gin.Context) {
 	c.JSON(http.StatusOK, notebook)
 }
 
-// handleGetPublicNotebook retrieves a public notebook by its token
+// handleGetPublicNotebook retrieves a public notebook by its token, with the share policy
+// that tells visitors what else they can load
 func (s *Server) handleGetPublicNotebook(c *gin.Context) {
-	ctx := context.Background()
-	token := c.Param("token")
-
-	notebook, err := s.store.GetNotebookByPublicToken(ctx, token)
-	if err != nil {
-		c.JSON(http.StatusNotFound, ErrorResponse{Error: "Public notebook not found"})
+	notebook, policy, ok := s.getPublicNotebook(c)
+	if !ok {
 		return
 	}
 
+	notebook.SharePolicy = policy
 	c.JSON(http.StatusOK, notebook)
 }
 
 // handleListPublicSources lists sources for a public notebook
 func (s *Server) handleListPublicSources(c *gin.Context) {
 	ctx := context.Background()
-	token := c.Param("token")
 
-	// First verify the notebook is public
-	notebook, err := s.store.GetNotebookByPublicToken(ctx, token)
-	if err != nil {
-		c.JSON(http.StatusNotFound, ErrorResponse{Error: "Public notebook not found"})
+	// First verify the notebook is public and shares its sources
+	notebook, policy, ok := s.getPublicNotebook(c)
+	if !ok {
+		return
+	}
+	if !policy.Sources {
+		c.JSON(http.StatusForbidden, ErrorResponse{Error: "Sources are not shared"})
 		return
 	}
 
@@ -1338,6 +1954,11 @@ func (s *Server) handleListPublicSources(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to list sources"})
 		return
 	}
+	sources = visibleSources(sources)
+
+	if c.Query("include") != "content" {
+		sources = summarizeSources(sources)
+	}
 
 	c.JSON(http.StatusOK, sources)
 }
@@ -1347,29 +1968,70 @@ func (s *Server) handleListPublicNotes(c *gin.Context) {
 	ctx := context.Background()
 	token := c.Param("token")
 
-	// First verify the notebook is public
-	notebook, err := s.store.GetNotebookByPublicToken(ctx, token)
-	if err != nil {
-		c.JSON(http.StatusNotFound, ErrorResponse{Error: "Public notebook not found"})
+	// First verify the notebook is public and shares its notes
+	notebook, policy, ok := s.getPublicNotebook(c)
+	if !ok {
+		return
+	}
+	if !policy.Notes {
+		c.JSON(http.StatusForbidden, ErrorResponse{Error: "Notes are not shared"})
 		return
 	}
 
-	notes, err := s.store.ListNotes(ctx, notebook.ID)
+	allNotes, err := s.store.ListNotes(ctx, notebook.ID)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to list notes"})
 		return
 	}
+	notes := make([]Note, 0, len(allNotes))
+	for i := range allNotes {
+		if policy.AllowsNote(&allNotes[i]) {
+			notes = append(notes, allNotes[i])
+		}
+	}
 
 	// Fix titles for notes that have default "笔记" title
 	for i := range notes {
 		if notes[i].Title == "笔记" {
 			notes[i].Title = getTitleForType(notes[i].Type)
 		}
+		// Per-note links are managed by the owner only
+		notes[i].ShareToken = ""
+		notes[i].ShareExpiresAt = nil
+		notes[i].Metadata = publicNoteMetadata(token, notes[i].Metadata)
 	}
 
 	c.JSON(http.StatusOK, notes)
 }
 
+// handleGetPublicNote returns a note of a public notebook with its full content
+func (s *Server) handleGetPublicNote(c *gin.Context) {
+	ctx := context.Background()
+
+	notebook, policy, ok := s.getPublicNotebook(c)
+	if !ok {
+		return
+	}
+	if !policy.Notes {
+		c.JSON(http.StatusForbidden, ErrorResponse{Error: "Notes are not shared"})
+		return
+	}
+
+	note, err := s.store.GetNote(ctx, c.Param("noteId"))
+	if err != nil || note.NotebookID != notebook.ID || !policy.AllowsNote(note) {
+		c.JSON(http.StatusNotFound, ErrorResponse{Error: "Note not found"})
+		return
+	}
+	if note.Title == "笔记" {
+		note.Title = getTitleForType(note.Type)
+	}
+	// Per-note links are managed by the owner only
+	note.ShareToken = ""
+	note.ShareExpiresAt = nil
+	note.Metadata = publicNoteMetadata(c.Param("token"), note.Metadata)
+	c.JSON(http.StatusOK, note)
+}
+
 // handleListPublicNotebooks lists all public notebooks with infograph or ppt notes
 func (s *Server) handleListPublicNotebooks(c *gin.Context) {
 	ctx := context.Background()
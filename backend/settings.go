@@ -0,0 +1,122 @@
+package backend
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// settingsFileName is the file under DATA_DIR holding settings saved by the setup wizard
+const settingsFileName = "settings.json"
+
+// Settings holds provider configuration saved through the first-run setup wizard.
+// Values set through environment variables always take precedence over saved ones.
+type Settings struct {
+	OpenAIAPIKey   string `json:"openai_api_key,omitempty"`
+	OpenAIBaseURL  string `json:"openai_base_url,omitempty"`
+	OpenAIModel    string `json:"openai_model,omitempty"`
+	EmbeddingModel string `json:"embedding_model,omitempty"`
+	OllamaBaseURL  string `json:"ollama_base_url,omitempty"`
+	OllamaModel    string `json:"ollama_model,omitempty"`
+
+	AzureOpenAIEndpoint            string `json:"azure_openai_endpoint,omitempty"`
+	AzureOpenAIAPIKey              string `json:"azure_openai_api_key,omitempty"`
+	AzureOpenAIDeployment          string `json:"azure_openai_deployment,omitempty"`
+	AzureOpenAIEmbeddingDeployment string `json:"azure_openai_embedding_deployment,omitempty"`
+	AzureOpenAIAPIVersion          string `json:"azure_openai_api_version,omitempty"`
+
+	GoogleAPIKey  string `json:"google_api_key,omitempty"`
+	ImageProvider string `json:"image_provider,omitempty"`
+	GLMAPIKey     string `json:"glm_api_key,omitempty"`
+	ZImageAPIKey  string `json:"zimage_api_key,omitempty"`
+}
+
+// LoadSettings reads saved settings from dataDir; a missing file yields empty settings
+func LoadSettings(dataDir string) (*Settings, error) {
+	data, err := os.ReadFile(filepath.Join(dataDir, settingsFileName))
+	if os.IsNotExist(err) {
+		return &Settings{}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read settings: %w", err)
+	}
+
+	var settings Settings
+	if err := json.Unmarshal(data, &settings); err != nil {
+		return nil, fmt.Errorf("failed to parse settings: %w", err)
+	}
+	return &settings, nil
+}
+
+// SaveSettings writes settings to dataDir. The file holds API keys, so it is
+// only readable by the current user and replaced atomically.
+func SaveSettings(dataDir string, settings *Settings) error {
+	if err := os.MkdirAll(dataDir, 0755); err != nil {
+		return fmt.Errorf("failed to create data directory: %w", err)
+	}
+
+	data, err := json.MarshalIndent(settings, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode settings: %w", err)
+	}
+
+	path := filepath.Join(dataDir, settingsFileName)
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, data, 0600); err != nil {
+		return fmt.Errorf("failed to write settings: %w", err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to save settings: %w", err)
+	}
+	return nil
+}
+
+// Merge overwrites settings with every non-empty value from other
+func (s *Settings) Merge(other Settings) {
+	mergeValue := func(dst *string, value string) {
+		if value != "" {
+			*dst = value
+		}
+	}
+	mergeValue(&s.OpenAIAPIKey, other.OpenAIAPIKey)
+	mergeValue(&s.OpenAIBaseURL, other.OpenAIBaseURL)
+	mergeValue(&s.OpenAIModel, other.OpenAIModel)
+	mergeValue(&s.EmbeddingModel, other.EmbeddingModel)
+	mergeValue(&s.OllamaBaseURL, other.OllamaBaseURL)
+	mergeValue(&s.OllamaModel, other.OllamaModel)
+	mergeValue(&s.AzureOpenAIEndpoint, other.AzureOpenAIEndpoint)
+	mergeValue(&s.AzureOpenAIAPIKey, other.AzureOpenAIAPIKey)
+	mergeValue(&s.AzureOpenAIDeployment, other.AzureOpenAIDeployment)
+	mergeValue(&s.AzureOpenAIEmbeddingDeployment, other.AzureOpenAIEmbeddingDeployment)
+	mergeValue(&s.AzureOpenAIAPIVersion, other.AzureOpenAIAPIVersion)
+	mergeValue(&s.GoogleAPIKey, other.GoogleAPIKey)
+	mergeValue(&s.ImageProvider, other.ImageProvider)
+	mergeValue(&s.GLMAPIKey, other.GLMAPIKey)
+	mergeValue(&s.ZImageAPIKey, other.ZImageAPIKey)
+}
+
+// Apply copies saved settings into cfg for every value not set through the environment
+func (s *Settings) Apply(cfg *Config) {
+	applyValue := func(dst *string, key, value string) {
+		if value != "" && os.Getenv(key) == "" {
+			*dst = value
+		}
+	}
+	applyValue(&cfg.OpenAIAPIKey, "OPENAI_API_KEY", s.OpenAIAPIKey)
+	applyValue(&cfg.OpenAIBaseURL, "OPENAI_BASE_URL", s.OpenAIBaseURL)
+	applyValue(&cfg.OpenAIModel, "OPENAI_MODEL", s.OpenAIModel)
+	applyValue(&cfg.EmbeddingModel, "EMBEDDING_MODEL", s.EmbeddingModel)
+	applyValue(&cfg.OllamaBaseURL, "OLLAMA_BASE_URL", s.OllamaBaseURL)
+	applyValue(&cfg.OllamaModel, "OLLAMA_MODEL", s.OllamaModel)
+	applyValue(&cfg.AzureOpenAIEndpoint, "AZURE_OPENAI_ENDPOINT", s.AzureOpenAIEndpoint)
+	applyValue(&cfg.AzureOpenAIAPIKey, "AZURE_OPENAI_API_KEY", s.AzureOpenAIAPIKey)
+	applyValue(&cfg.AzureOpenAIDeployment, "AZURE_OPENAI_DEPLOYMENT", s.AzureOpenAIDeployment)
+	applyValue(&cfg.AzureOpenAIEmbeddingDeployment, "AZURE_OPENAI_EMBEDDING_DEPLOYMENT", s.AzureOpenAIEmbeddingDeployment)
+	applyValue(&cfg.AzureOpenAIAPIVersion, "AZURE_OPENAI_API_VERSION", s.AzureOpenAIAPIVersion)
+	applyValue(&cfg.GoogleAPIKey, "GOOGLE_API_KEY", s.GoogleAPIKey)
+	applyValue(&cfg.ImageProvider, "IMAGE_PROVIDER", s.ImageProvider)
+	applyValue(&cfg.GLMAPIKey, "GLM_API_KEY", s.GLMAPIKey)
+	applyValue(&cfg.ZImageAPIKey, "ZIMAGE_API_KEY", s.ZImageAPIKey)
+}
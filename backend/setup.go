@@ -0,0 +1,147 @@
+package backend
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kataras/golog"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// minPasswordLength is the shortest password accepted for the setup wizard's admin account
+const minPasswordLength = 8
+
+// currentAgent returns the agent, or nil while no LLM provider is configured
+func (s *Server) currentAgent() *Agent {
+	s.agentMu.RLock()
+	defer s.agentMu.RUnlock()
+	return s.agent
+}
+
+// requireAgent returns the agent, responding with 503 if setup hasn't configured an LLM provider yet
+func (s *Server) requireAgent(c *gin.Context) (*Agent, bool) {
+	agent := s.currentAgent()
+	if agent == nil {
+		c.JSON(http.StatusServiceUnavailable, ErrorResponse{Error: "LLM provider is not configured, complete setup first"})
+		return nil, false
+	}
+	return agent, true
+}
+
+// setupRequired reports whether the server is still in its first-run state, i.e. no account exists yet
+func (s *Server) setupRequired(c *gin.Context) (bool, error) {
+	if s.cfg.LocalMode {
+		return false, nil
+	}
+	count, err := s.store.CountUsers(c.Request.Context())
+	if err != nil {
+		return false, err
+	}
+	return count == 0, nil
+}
+
+func (s *Server) handleGetSetup(c *gin.Context) {
+	required, err := s.setupRequired(c)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to check setup status"})
+		return
+	}
+
+	c.JSON(http.StatusOK, SetupStatus{
+		SetupRequired: required,
+		LLMConfigured: s.currentAgent() != nil,
+	})
+}
+
+// handleSetup creates the initial admin account and persists provider keys.
+// It is only available until the first account exists.
+func (s *Server) handleSetup(c *gin.Context) {
+	s.setupMu.Lock()
+	defer s.setupMu.Unlock()
+
+	required, err := s.setupRequired(c)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to check setup status"})
+		return
+	}
+	if !required {
+		c.JSON(http.StatusConflict, ErrorResponse{Error: "Setup has already been completed"})
+		return
+	}
+
+	var req SetupRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	email := strings.TrimSpace(req.Admin.Email)
+	if !strings.Contains(email, "@") {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "A valid admin email is required"})
+		return
+	}
+	if len(req.Admin.Password) < minPasswordLength {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Admin password must be at least 8 characters"})
+		return
+	}
+
+	// Merge with previously saved settings so fields left blank keep their values
+	settings, err := LoadSettings(s.cfg.DataDir)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: err.Error()})
+		return
+	}
+	settings.Merge(req.Settings)
+
+	cfg := s.cfg
+	settings.Apply(&cfg)
+	if !cfg.HasLLMProvider() {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "An OpenAI API key, an Ollama base URL or an Azure OpenAI endpoint is required"})
+		return
+	}
+
+	agent, err := NewAgent(cfg, s.vectorStore, newUsageSink(cfg, s.store))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	if err := SaveSettings(s.cfg.DataDir, settings); err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	passwordHash, err := bcrypt.GenerateFromPassword([]byte(req.Admin.Password), bcrypt.DefaultCost)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to hash password"})
+		return
+	}
+
+	name := strings.TrimSpace(req.Admin.Name)
+	if name == "" {
+		name = email
+	}
+	user := &User{Email: email, Name: name, Provider: "password", Role: RoleAdmin}
+	if err := s.store.CreateUser(c.Request.Context(), user); err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to create admin account"})
+		return
+	}
+	if err := s.store.SetUserPassword(c.Request.Context(), user.ID, string(passwordHash)); err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to set admin password"})
+		return
+	}
+
+	s.agentMu.Lock()
+	s.agent = agent
+	s.agentMu.Unlock()
+
+	token, err := s.auth.newSessionToken(c, user.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to generate token"})
+		return
+	}
+
+	golog.Infof("✅ first-run setup completed, admin account: %s", email)
+	c.JSON(http.StatusCreated, gin.H{"token": token, "user": user})
+}
@@ -0,0 +1,157 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kataras/golog"
+)
+
+// SharedNote is the public view of a note shared through its own link
+type SharedNote struct {
+	Note
+	NotebookName string `json:"notebook_name"`
+}
+
+// handleShareNote enables or disables the public link of a single note
+func (s *Server) handleShareNote(c *gin.Context) {
+	ctx := context.Background()
+	notebookID := c.Param("id")
+	noteID := c.Param("noteId")
+	userID := c.GetString("user_id")
+
+	if err := s.checkNotebookAccess(ctx, notebookID, userID); err != nil {
+		c.JSON(http.StatusForbidden, ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	note, err := s.store.GetNote(ctx, noteID)
+	if err != nil || note.NotebookID != notebookID {
+		c.JSON(http.StatusNotFound, ErrorResponse{Error: "Note not found"})
+		return
+	}
+
+	var req struct {
+		Enabled        bool `json:"enabled"`
+		ExpiresInHours int  `json:"expires_in_hours"` // 0 = never expires
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+		return
+	}
+	if req.ExpiresInHours < 0 {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "expires_in_hours must not be negative"})
+		return
+	}
+
+	var expiresAt *time.Time
+	if req.Enabled && req.ExpiresInHours > 0 {
+		t := time.Now().Add(time.Duration(req.ExpiresInHours) * time.Hour)
+		expiresAt = &t
+	}
+
+	note, err = s.store.SetNoteShare(ctx, noteID, req.Enabled, expiresAt)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to update note sharing"})
+		return
+	}
+
+	action := "share_note"
+	if !req.Enabled {
+		action = "unshare_note"
+	}
+	activityLog := &ActivityLog{
+		UserID:       userID,
+		Action:       action,
+		ResourceType: "note",
+		ResourceID:   note.ID,
+		ResourceName: note.Title,
+		Details:      fmt.Sprintf(`{"notebook_id": "%s"}`, notebookID),
+		IPAddress:    c.ClientIP(),
+		UserAgent:    c.GetHeader("User-Agent"),
+	}
+	if err := s.store.LogActivity(ctx, activityLog); err != nil {
+		golog.Errorf("failed to log activity: %v", err)
+	}
+
+	c.JSON(http.StatusOK, note)
+}
+
+// handleGetSharedNote serves a note shared through its own link. Browsers opening
+// the link get the frontend page, which then fetches the note itself as JSON.
+func (s *Server) handleGetSharedNote(c *gin.Context) {
+	if strings.Contains(c.GetHeader("Accept"), "text/html") {
+		s.assets.serveIndex(c)
+		return
+	}
+
+	token := c.Param("token")
+	note, notebook, err := s.store.GetNoteByShareToken(context.Background(), token)
+	if err != nil {
+		c.JSON(http.StatusNotFound, ErrorResponse{Error: "Shared note not found"})
+		return
+	}
+
+	if note.Title == "笔记" {
+		note.Title = getTitleForType(note.Type)
+	}
+	note.Metadata = sharedNoteMetadata(token, note.Metadata)
+
+	c.JSON(http.StatusOK, SharedNote{Note: *note, NotebookName: notebook.Name})
+}
+
+// handleServeSharedNoteFile serves an image referenced by a shared note, so the
+// link works without making the whole notebook public
+func (s *Server) handleServeSharedNoteFile(c *gin.Context) {
+	token := c.Param("token")
+	filename := c.Param("filename")
+
+	note, notebook, err := s.store.GetNoteByShareToken(context.Background(), token)
+	if err != nil {
+		c.JSON(http.StatusNotFound, ErrorResponse{Error: "Shared note not found"})
+		return
+	}
+
+	for _, name := range noteFileNames(note) {
+		if name == filename {
+			if !s.serveWatermarked(c, notebook, filename) {
+				s.serveUploadedFile(c, notebook.UserID, filename, true)
+			}
+			return
+		}
+	}
+
+	c.JSON(http.StatusNotFound, ErrorResponse{Error: "File not found"})
+}
+
+// sharedNoteMetadata copies note metadata, pointing image URLs at the shared note's file route
+func sharedNoteMetadata(token string, metadata map[string]interface{}) map[string]interface{} {
+	shared := make(map[string]interface{}, len(metadata))
+	for k, v := range metadata {
+		shared[k] = v
+	}
+
+	fileURL := func(name string) string {
+		return "/public/notes/" + token + "/files/" + name
+	}
+
+	if imageURL, ok := shared["image_url"].(string); ok && imageURL != "" {
+		shared["image_url"] = fileURL(noteFileNames(&Note{Metadata: map[string]interface{}{"image_url": imageURL}})[0])
+	}
+	if audioURL, ok := shared["audio_url"].(string); ok && audioURL != "" {
+		shared["audio_url"] = fileURL(noteFileNames(&Note{Metadata: map[string]interface{}{"audio_url": audioURL}})[0])
+	}
+	if slides, ok := shared["slides"]; ok {
+		var slideURLs []string
+		for _, name := range noteFileNames(&Note{Metadata: map[string]interface{}{"slides": slides}}) {
+			slideURLs = append(slideURLs, fileURL(name))
+		}
+		shared["slides"] = slideURLs
+	}
+
+	return shared
+}
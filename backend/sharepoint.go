@@ -0,0 +1,288 @@
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/uuid"
+	"github.com/kataras/golog"
+)
+
+// errDeltaExpired is returned when Microsoft Graph no longer accepts a delta link
+var errDeltaExpired = errors.New("delta link expired")
+
+// graphDriveItem is a file or folder in a Microsoft Graph delta response
+type graphDriveItem struct {
+	ID      string    `json:"id"`
+	Name    string    `json:"name"`
+	CTag    string    `json:"cTag"`
+	Size    int64     `json:"size"`
+	WebURL  string    `json:"webUrl"`
+	File    *struct{} `json:"file"`
+	Deleted *struct{} `json:"deleted"`
+}
+
+// graphClient calls Microsoft Graph as the connector's Entra ID app
+type graphClient struct {
+	baseURL string
+	token   string
+}
+
+// newGraphClient signs in with the client credentials of the connector's app
+func (s *Server) newGraphClient(ctx context.Context, connector *Connector) (*graphClient, error) {
+	graphURL, err := url.Parse(s.cfg.MicrosoftGraphURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid MICROSOFT_GRAPH_URL: %w", err)
+	}
+	form := url.Values{
+		"grant_type":    {"client_credentials"},
+		"client_id":     {connector.Settings.ClientID},
+		"client_secret": {connector.Secret},
+		"scope":         {graphURL.Scheme + "://" + graphURL.Host + "/.default"},
+	}
+	tokenURL := fmt.Sprintf("%s/%s/oauth2/v2.0/token", strings.TrimRight(s.cfg.MicrosoftLoginURL, "/"), url.PathEscape(connector.Settings.TenantID))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := integrationHTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var token struct {
+		AccessToken      string `json:"access_token"`
+		ErrorDescription string `json:"error_description"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return nil, fmt.Errorf("failed to decode token response (status %d): %w", resp.StatusCode, err)
+	}
+	if token.AccessToken == "" {
+		return nil, fmt.Errorf("sign-in failed: %s", token.ErrorDescription)
+	}
+	return &graphClient{baseURL: strings.TrimRight(s.cfg.MicrosoftGraphURL, "/"), token: token.AccessToken}, nil
+}
+
+// do sends a GET request for a Graph path or full URL and returns the response if it succeeded
+func (g *graphClient) do(ctx context.Context, pathOrURL string) (*http.Response, error) {
+	if strings.HasPrefix(pathOrURL, "/") {
+		pathOrURL = g.baseURL + pathOrURL
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, pathOrURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+g.token)
+
+	resp, err := integrationHTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusOK {
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusGone {
+		return nil, errDeltaExpired
+	}
+	var graphErr struct {
+		Error struct {
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	json.NewDecoder(io.LimitReader(resp.Body, 4096)).Decode(&graphErr)
+	return nil, fmt.Errorf("microsoft graph returned %s: %s", resp.Status, graphErr.Error.Message)
+}
+
+// get GETs a Graph path or full URL and decodes its JSON response into result
+func (g *graphClient) get(ctx context.Context, pathOrURL string, result interface{}) error {
+	resp, err := g.do(ctx, pathOrURL)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return json.NewDecoder(resp.Body).Decode(result)
+}
+
+// resolveDrive finds the drive of the connector's document library
+func (g *graphClient) resolveDrive(ctx context.Context, settings *ConnectorSettings) (string, error) {
+	var site struct {
+		ID string `json:"id"`
+	}
+	if err := g.get(ctx, "/sites/"+settings.Site, &site); err != nil {
+		return "", err
+	}
+	var drives struct {
+		Value []struct {
+			ID   string `json:"id"`
+			Name string `json:"name"`
+		} `json:"value"`
+	}
+	if err := g.get(ctx, "/sites/"+site.ID+"/drives", &drives); err != nil {
+		return "", err
+	}
+	for _, d := range drives.Value {
+		if strings.EqualFold(d.Name, settings.Library) {
+			return d.ID, nil
+		}
+	}
+	return "", fmt.Errorf("document library %q not found", settings.Library)
+}
+
+// syncSharePoint imports the documents of the connector's library changed since the last sync,
+// using the drive's delta feed. Documents deleted from the library are removed from the notebook.
+func (s *Server) syncSharePoint(ctx context.Context, connector *Connector, result *ConnectorSyncResult) error {
+	graph, err := s.newGraphClient(ctx, connector)
+	if err != nil {
+		return err
+	}
+	if connector.Settings.DriveID == "" {
+		if connector.Settings.DriveID, err = graph.resolveDrive(ctx, &connector.Settings); err != nil {
+			return err
+		}
+	}
+
+	next := connector.Cursor
+	if next == "" {
+		next = "/drives/" + url.PathEscape(connector.Settings.DriveID) + "/root/delta"
+	}
+	for next != "" {
+		var page struct {
+			Value     []graphDriveItem `json:"value"`
+			NextLink  string           `json:"@odata.nextLink"`
+			DeltaLink string           `json:"@odata.deltaLink"`
+		}
+		err := graph.get(ctx, next, &page)
+		if errors.Is(err, errDeltaExpired) && connector.Cursor != "" {
+			// Start over from a full listing; unchanged documents are skipped by their cTag
+			golog.Warnf("delta link of connector %s expired, listing the library again", connector.ID)
+			connector.Cursor = ""
+			next = "/drives/" + url.PathEscape(connector.Settings.DriveID) + "/root/delta"
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		for i := range page.Value {
+			if err := s.syncSharePointItem(ctx, graph, connector, &page.Value[i], result); err != nil {
+				return err
+			}
+		}
+
+		next = page.NextLink
+		if page.DeltaLink != "" {
+			connector.Cursor = page.DeltaLink
+		}
+	}
+	return nil
+}
+
+// syncSharePointItem imports, updates or removes the source of one item of a delta feed
+func (s *Server) syncSharePointItem(ctx context.Context, graph *graphClient, connector *Connector, item *graphDriveItem, result *ConnectorSyncResult) error {
+	if item.Deleted != nil {
+		removed, err := s.removeConnectorItem(ctx, connector, item.ID)
+		if removed {
+			result.Removed++
+		}
+		return err
+	}
+	if item.File == nil || !s.connectorImportable(item.Name) {
+		return nil
+	}
+	if item.Size > connectorMaxFileSize {
+		golog.Warnf("skipping %s of connector %s, larger than 50MB", item.Name, connector.ID)
+		return nil
+	}
+
+	sourceID, changed, err := s.connectorItemChanged(ctx, connector, item.ID, item.CTag)
+	if err != nil || !changed {
+		return err
+	}
+
+	ext := filepath.Ext(item.Name)
+	uniqueFileName := fmt.Sprintf("%s_%s%s", strings.TrimSuffix(item.Name, ext), uuid.New().String()[:8], ext)
+	userUploadDir := filepath.Join(s.cfg.UploadDir, connector.UserID)
+	if err := os.MkdirAll(userUploadDir, 0755); err != nil {
+		return err
+	}
+	path := filepath.Join(userUploadDir, uniqueFileName)
+
+	size, err := graph.download(ctx, "/drives/"+url.PathEscape(connector.Settings.DriveID)+"/items/"+url.PathEscape(item.ID)+"/content", path)
+	if err != nil {
+		os.Remove(path)
+		return fmt.Errorf("failed to download %s: %w", item.Name, err)
+	}
+	scan, err := s.scanUpload(ctx, path)
+	if err != nil {
+		if scan == nil {
+			os.Remove(path)
+		}
+		return fmt.Errorf("failed to scan %s: %w", item.Name, err)
+	}
+	content, _, err := s.extractDocument(ctx, path)
+	if err != nil {
+		os.Remove(path)
+		return fmt.Errorf("failed to extract %s: %w", item.Name, err)
+	}
+
+	// The previous file stays on disk with the version that refers to it
+	doc := &connectorDocument{
+		Key:      item.ID,
+		Version:  item.CTag,
+		Name:     item.Name,
+		Type:     "file",
+		URL:      item.WebURL,
+		Content:  content,
+		FileName: uniqueFileName,
+		FileSize: size,
+		Metadata: map[string]interface{}{"path": path, "user_id": connector.UserID},
+	}
+	if scan != nil {
+		doc.Metadata["scan"] = scan
+	}
+	added, err := s.saveConnectorDocument(ctx, connector, sourceID, doc)
+	if err != nil {
+		os.Remove(path)
+		return err
+	}
+	if added {
+		result.Added++
+	} else {
+		result.Updated++
+	}
+	return nil
+}
+
+// download saves the content of a Graph path to a file and returns its size
+func (g *graphClient) download(ctx context.Context, pathOrURL, path string) (int64, error) {
+	resp, err := g.do(ctx, pathOrURL)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	file, err := os.Create(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	size, err := io.Copy(file, io.LimitReader(resp.Body, connectorMaxFileSize+1))
+	if err != nil {
+		return 0, err
+	}
+	if size > connectorMaxFileSize {
+		return 0, fmt.Errorf("file larger than 50MB")
+	}
+	return size, nil
+}
@@ -0,0 +1,201 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kataras/golog"
+)
+
+// publicChatHistoryLimit is how many previous messages a visitor's chat request may carry
+const publicChatHistoryLimit = 10
+
+// getOwnedNotebook loads the notebook named in the URL, responding with an error unless the
+// user owns it
+func (s *Server) getOwnedNotebook(c *gin.Context) (*Notebook, bool) {
+	notebook, err := s.store.GetNotebook(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, ErrorResponse{Error: "Notebook not found"})
+		return nil, false
+	}
+	if notebook.UserID != "" && notebook.UserID != c.GetString("user_id") {
+		c.JSON(http.StatusForbidden, ErrorResponse{Error: "Access denied"})
+		return nil, false
+	}
+	return notebook, true
+}
+
+// handleGetSharePolicy returns what the notebook's public link exposes
+func (s *Server) handleGetSharePolicy(c *gin.Context) {
+	notebook, ok := s.getOwnedNotebook(c)
+	if !ok {
+		return
+	}
+	policy, err := s.store.GetSharePolicy(c.Request.Context(), notebook.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to get share policy"})
+		return
+	}
+	c.JSON(http.StatusOK, policy)
+}
+
+// handleSetSharePolicy sets what the notebook's public link exposes. It applies whether or
+// not the notebook is currently public.
+func (s *Server) handleSetSharePolicy(c *gin.Context) {
+	ctx := c.Request.Context()
+	notebook, ok := s.getOwnedNotebook(c)
+	if !ok {
+		return
+	}
+
+	var policy SharePolicy
+	if err := c.ShouldBindJSON(&policy); err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+		return
+	}
+	seen := make(map[string]bool, len(policy.NoteTypes))
+	noteTypes := make([]string, 0, len(policy.NoteTypes))
+	for _, t := range policy.NoteTypes {
+		t = strings.TrimSpace(t)
+		if t == "" || seen[t] {
+			continue
+		}
+		seen[t] = true
+		noteTypes = append(noteTypes, t)
+	}
+	policy.NoteTypes = noteTypes
+
+	if err := s.store.SetSharePolicy(ctx, notebook.ID, &policy); err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to update share policy"})
+		return
+	}
+
+	activityLog := &ActivityLog{
+		UserID:       c.GetString("user_id"),
+		Action:       "update_share_policy",
+		ResourceType: "notebook",
+		ResourceID:   notebook.ID,
+		ResourceName: notebook.Name,
+		Details:      fmt.Sprintf(`{"notes": %t, "note_types": %d, "sources": %t, "chat": %t}`, policy.Notes, len(policy.NoteTypes), policy.Sources, policy.Chat),
+		IPAddress:    c.ClientIP(),
+		UserAgent:    c.GetHeader("User-Agent"),
+	}
+	if err := s.store.LogActivity(ctx, activityLog); err != nil {
+		golog.Errorf("failed to log activity: %v", err)
+	}
+
+	c.JSON(http.StatusOK, policy)
+}
+
+// getPublicNotebook loads the public notebook named by the URL token and its share policy,
+// responding with an error if either fails
+func (s *Server) getPublicNotebook(c *gin.Context) (*Notebook, *SharePolicy, bool) {
+	ctx := c.Request.Context()
+	notebook, err := s.store.GetNotebookByPublicToken(ctx, c.Param("token"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, ErrorResponse{Error: "Public notebook not found"})
+		return nil, nil, false
+	}
+	policy, err := s.store.GetSharePolicy(ctx, notebook.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to get share policy"})
+		return nil, nil, false
+	}
+	return notebook, policy, true
+}
+
+// publicFileAllowed reports whether a file of a public notebook, an uploaded source file or an
+// image of a note, is exposed by the notebook's share policy
+func (s *Server) publicFileAllowed(ctx context.Context, notebookID string, note *Note) bool {
+	policy, err := s.store.GetSharePolicy(ctx, notebookID)
+	if err != nil {
+		golog.Errorf("failed to get share policy of notebook %s: %v", notebookID, err)
+		return false
+	}
+	if note == nil {
+		return policy.Sources
+	}
+	return policy.AllowsNote(note)
+}
+
+// publicChatRequest is a visitor's chat message. Visitors have no chat sessions, so the
+// client sends the previous messages of the conversation along.
+type publicChatRequest struct {
+	Message string        `json:"message" binding:"required"`
+	History []ChatMessage `json:"history"`
+}
+
+// handlePublicChat answers a visitor's question about a public notebook whose share policy
+// enables chat. Nothing is stored. Chat tools are not available to visitors.
+func (s *Server) handlePublicChat(c *gin.Context) {
+	ctx, cancel := requestContext(c)
+	defer cancel()
+	notebook, policy, ok := s.getPublicNotebook(c)
+	if !ok {
+		return
+	}
+	if !policy.Chat {
+		c.JSON(http.StatusForbidden, ErrorResponse{Error: "Chat is not enabled for this notebook"})
+		return
+	}
+	agent, ok := s.requireAgent(c)
+	if !ok {
+		return
+	}
+
+	var req publicChatRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+		return
+	}
+	history := make([]ChatMessage, 0, len(req.History))
+	for _, msg := range req.History {
+		// Visitors can't inject system prompts
+		if msg.Role == "user" || msg.Role == "assistant" {
+			history = append(history, ChatMessage{Role: msg.Role, Content: msg.Content})
+		}
+	}
+	if len(history) > publicChatHistoryLimit {
+		history = history[len(history)-publicChatHistoryLimit:]
+	}
+
+	// 按需加载向量索引
+	if err := s.loadNotebookVectorIndex(ctx, notebook.ID); err != nil {
+		golog.Errorf("failed to load vector index: %v", err)
+	}
+
+	// Only glossary notes the visitor could read themselves ground the answer
+	glossary := s.chatGlossary(ctx, notebook.ID, req.Message, policy.AllowsNote)
+	settings, _ := s.resolveChatSettings(ctx, notebook.ID, "")
+	if err := s.hidePrivateSources(ctx, notebook.ID, settings); err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to list private sources"})
+		return
+	}
+
+	// Visitors' questions count towards the usage and the quota of the notebook's owner
+	release, ok := s.reservePublicChat(c, notebook.UserID)
+	if !ok {
+		return
+	}
+	ctx = withUsageScope(ctx, notebook.UserID, notebook.ID)
+	stream := startChatStream(c)
+	response, err := agent.Chat(ctx, notebook.ID, req.Message, glossary, settings, history, nil, stream.onToken())
+	if err != nil {
+		release()
+		s.reportGenerationError(c, err)
+		stream.reply(c, generationErrorStatus(err), ErrorResponse{Error: fmt.Sprintf("Chat failed: %v", err)})
+		return
+	}
+	response.SessionID = ""
+	// Sources the visitor can't open are not listed
+	if !policy.Sources {
+		response.Sources = []SourceSummary{}
+		response.Citations = nil
+		delete(response.Metadata, "citations")
+	}
+
+	stream.reply(c, http.StatusOK, response)
+}
@@ -0,0 +1,259 @@
+package backend
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/kataras/golog"
+)
+
+// Limits of sitemaps
+const (
+	sitemapDefaultPages = 50
+	sitemapMaxSize      = 50 << 20 // The sitemap protocol's limit of an uncompressed file
+	// sitemapMaxFiles bounds the sitemaps read through sitemap indexes
+	sitemapMaxFiles = 50
+)
+
+// SitemapOptions turns a URL source into an import of the pages a sitemap lists, stored as
+// "sitemap" in the metadata of the source
+type SitemapOptions struct {
+	MaxPages   int    `json:"max_pages"`             // 0 means 50, at most SITEMAP_MAX_PAGES
+	PathPrefix string `json:"path_prefix,omitempty"` // Only import pages whose path starts with it, such as "/blog/"
+	Pages      int    `json:"pages,omitempty"`       // Pages the last import added
+	Failed     int    `json:"failed,omitempty"`      // Pages the last import couldn't read
+}
+
+// sitemapDocument is a sitemap, which lists either pages or, as a sitemap index, other sitemaps
+type sitemapDocument struct {
+	URLs []struct {
+		Loc string `xml:"loc"`
+	} `xml:"url"`
+	Sitemaps []struct {
+		Loc string `xml:"loc"`
+	} `xml:"sitemap"`
+}
+
+// isSitemapURL reports whether a link points at a sitemap, such as /sitemap.xml,
+// /sitemap_index.xml or /post-sitemap.xml.gz
+func isSitemapURL(link string) bool {
+	u, err := url.Parse(link)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return false
+	}
+	name := strings.ToLower(path.Base(u.Path))
+	return strings.Contains(name, "sitemap") && (strings.HasSuffix(name, ".xml") || strings.HasSuffix(name, ".xml.gz"))
+}
+
+// normalizeSitemapOptions fills in the defaults of a sitemap import and checks its limits
+func normalizeSitemapOptions(opts *SitemapOptions, maxPages int) error {
+	if opts.MaxPages < 0 || opts.MaxPages > maxPages {
+		return fmt.Errorf("max_pages must be between 1 and %d", maxPages)
+	}
+	if opts.MaxPages == 0 {
+		opts.MaxPages = min(sitemapDefaultPages, maxPages)
+	}
+	if opts.PathPrefix != "" && !strings.HasPrefix(opts.PathPrefix, "/") {
+		opts.PathPrefix = "/" + opts.PathPrefix
+	}
+	return nil
+}
+
+// sourceSitemapOptions returns the sitemap of a source, if it was added as one
+func sourceSitemapOptions(source *Source) (SitemapOptions, bool) {
+	var opts SitemapOptions
+	value, ok := source.Metadata["sitemap"]
+	if !ok {
+		return opts, false
+	}
+	data, err := json.Marshal(value)
+	if err != nil || json.Unmarshal(data, &opts) != nil {
+		return opts, false
+	}
+	return opts, true
+}
+
+// sitemapPages returns the pages a sitemap lists, following sitemap indexes, up to the page
+// limit of opts. Like a crawl, it keeps to the sitemap's host and skips what the site's
+// robots.txt disallows.
+func sitemapPages(ctx context.Context, sitemapURL string, opts SitemapOptions) ([]string, error) {
+	root, err := url.Parse(sitemapURL)
+	if err != nil || (root.Scheme != "http" && root.Scheme != "https") {
+		return nil, fmt.Errorf("not a sitemap: %s", sitemapURL)
+	}
+	disallowed := fetchRobotsDisallows(ctx, root)
+	sameDomain := true
+	crawlOpts := CrawlOptions{SameDomain: &sameDomain, PathPrefix: opts.PathPrefix}
+
+	queue := []string{sitemapURL}
+	seenSitemaps := map[string]bool{sitemapURL: true}
+	seen := make(map[string]bool)
+	var pages []string
+	for files := 0; len(queue) > 0 && files < sitemapMaxFiles && len(pages) < opts.MaxPages; files++ {
+		next := queue[0]
+		queue = queue[1:]
+		doc, err := fetchSitemap(ctx, next)
+		if err != nil {
+			if next == sitemapURL {
+				return nil, err
+			}
+			golog.Warnf("sitemap %s skipped %s: %v", sitemapURL, next, err)
+			continue
+		}
+		for _, entry := range doc.Sitemaps {
+			loc := strings.TrimSpace(entry.Loc)
+			if link, err := url.Parse(loc); err == nil && strings.EqualFold(link.Host, root.Host) && !seenSitemaps[loc] {
+				seenSitemaps[loc] = true
+				queue = append(queue, loc)
+			}
+		}
+		for _, entry := range doc.URLs {
+			link, err := url.Parse(strings.TrimSpace(entry.Loc))
+			if err != nil {
+				continue
+			}
+			link.Fragment = ""
+			if key := crawlKey(link); !seen[key] && crawlAllowed(link, root, crawlOpts, disallowed) {
+				seen[key] = true
+				pages = append(pages, link.String())
+				if len(pages) == opts.MaxPages {
+					break
+				}
+			}
+		}
+	}
+	if len(pages) == 0 {
+		return nil, fmt.Errorf("no pages found in %s", sitemapURL)
+	}
+	return pages, nil
+}
+
+// fetchSitemap reads a sitemap, gzipped or not
+func fetchSitemap(ctx context.Context, sitemapURL string) (*sitemapDocument, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, sitemapURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", crawlUserAgent)
+	resp, err := crawlHTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s returned %s", sitemapURL, resp.Status)
+	}
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, sitemapMaxSize))
+	if err != nil {
+		return nil, err
+	}
+	// .xml.gz files are usually served as they are rather than with a gzip Content-Encoding
+	if bytes.HasPrefix(data, []byte{0x1f, 0x8b}) {
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, fmt.Errorf("invalid gzipped sitemap: %w", err)
+		}
+		defer zr.Close()
+		if data, err = io.ReadAll(io.LimitReader(zr, sitemapMaxSize)); err != nil {
+			return nil, fmt.Errorf("invalid gzipped sitemap: %w", err)
+		}
+	}
+	var doc sitemapDocument
+	if err := xml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("invalid sitemap %s: %w", sitemapURL, err)
+	}
+	return &doc, nil
+}
+
+// sitemapListing is the content of a sitemap source: the pages it lists
+func sitemapListing(sitemapURL string, pages []string) string {
+	var b strings.Builder
+	b.WriteString("# Sitemap of " + sitemapURL + "\n\n")
+	for _, page := range pages {
+		b.WriteString("- " + page + "\n")
+	}
+	return b.String()
+}
+
+// ingestSitemap imports the pages of a sitemap source, each as a source of its own, skipping
+// pages the notebook already has. The job's progress counts the pages read, so that a long
+// import can be followed, and each page is indexed as soon as it is read. The sitemap source
+// itself lists the pages.
+func (s *Server) ingestSitemap(ctx context.Context, job *IngestJob, source *Source) error {
+	opts, _ := sourceSitemapOptions(source)
+	pages, err := sitemapPages(ctx, source.URL, opts)
+	if err != nil {
+		return fmt.Errorf("failed to read sitemap: %w", err)
+	}
+	source.Content = sitemapListing(source.URL, pages)
+
+	existing, err := s.store.ListSources(ctx, source.NotebookID)
+	if err != nil {
+		return err
+	}
+	known := make(map[string]bool, len(existing))
+	for _, src := range existing {
+		known[src.URL] = true
+	}
+
+	job.Stage = "crawling"
+	job.Total = len(pages)
+	opts.Pages, opts.Failed = 0, 0
+	for i, pageURL := range pages {
+		job.Progress = i
+		if err := s.store.SaveIngestJob(ctx, job); err != nil {
+			golog.Errorf("failed to save ingest job %s: %v", job.ID, err)
+		}
+		// A resumed import skips the pages it added before the server stopped
+		if known[pageURL] {
+			continue
+		}
+		if i > 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(crawlDelay):
+			}
+		}
+
+		page, _, err := fetchCrawlPage(ctx, pageURL)
+		if err == nil && strings.TrimSpace(page.Content) == "" {
+			err = fmt.Errorf("no text found")
+		}
+		if err != nil {
+			golog.Warnf("sitemap %s skipped %s: %v", source.URL, pageURL, err)
+			opts.Failed++
+			continue
+		}
+		known[pageURL] = true
+		pageSource := &Source{
+			NotebookID: source.NotebookID,
+			Name:       page.Title,
+			Type:       "url",
+			URL:        pageURL,
+			Content:    page.Content,
+			Metadata:   map[string]interface{}{"sitemap_root": source.ID},
+		}
+		if err := s.captureSource(ctx, pageSource, &ActivityLog{UserID: job.UserID, Action: "add_source", UserAgent: crawlUserAgent}); err != nil {
+			return fmt.Errorf("failed to add %s: %w", pageURL, err)
+		}
+		opts.Pages++
+	}
+	job.Progress = len(pages)
+	if opts.Failed == len(pages) {
+		return fmt.Errorf("none of the %d pages of the sitemap could be read", len(pages))
+	}
+	source.Metadata["sitemap"] = opts
+	return nil
+}
@@ -0,0 +1,113 @@
+package backend
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kataras/golog"
+)
+
+// slackMaxRequestAge rejects replayed slash command requests
+const slackMaxRequestAge = 5 * time.Minute
+
+// verifySlackSignature checks the X-Slack-Signature header against the app's signing secret
+func verifySlackSignature(secret string, header http.Header, body []byte) bool {
+	timestamp := header.Get("X-Slack-Request-Timestamp")
+	sec, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return false
+	}
+	if age := time.Since(time.Unix(sec, 0)); age > slackMaxRequestAge || age < -slackMaxRequestAge {
+		return false
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte("v0:" + timestamp + ":"))
+	mac.Write(body)
+	expected := "v0=" + hex.EncodeToString(mac.Sum(nil))
+	return hmac.Equal([]byte(expected), []byte(header.Get("X-Slack-Signature")))
+}
+
+// handleSlackCommand handles the /notex slash command. Slack expects an answer
+// within 3 seconds, so questions are acknowledged and answered asynchronously.
+func (s *Server) handleSlackCommand(c *gin.Context) {
+	in, body, ok := s.loadIntegration(c, IntegrationSlack)
+	if !ok {
+		return
+	}
+	if !verifySlackSignature(in.SigningSecret, c.Request.Header, body) {
+		c.JSON(http.StatusUnauthorized, ErrorResponse{Error: "Invalid signature"})
+		return
+	}
+
+	form, err := url.ParseQuery(string(body))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid request"})
+		return
+	}
+
+	cmd := parseIntegrationCommand(form.Get("text"))
+	if cmd.Action != "ask" || cmd.Notebook == "" || cmd.Question == "" {
+		c.JSON(http.StatusOK, gin.H{
+			"response_type": "ephemeral",
+			"text":          s.runIntegrationCommand(c.Request.Context(), in.UserID, cmd),
+		})
+		return
+	}
+
+	channelID := form.Get("channel_id")
+	responseURL := form.Get("response_url")
+	go func() {
+		ctx := context.Background()
+		answer := s.runIntegrationCommand(ctx, in.UserID, cmd)
+		if err := postSlackAnswer(ctx, in, channelID, responseURL, answer); err != nil {
+			golog.Errorf("failed to post slack answer: %v", err)
+		}
+	}()
+
+	c.JSON(http.StatusOK, gin.H{
+		"response_type": "ephemeral",
+		"text":          fmt.Sprintf("正在查询「%s」…", cmd.Notebook),
+	})
+}
+
+// postSlackAnswer posts the answer to the channel, as the bot when a token is configured,
+// otherwise through the command's response URL
+func postSlackAnswer(ctx context.Context, in *Integration, channelID, responseURL, text string) error {
+	if in.BotToken != "" && channelID != "" {
+		body, err := postJSON(ctx, http.MethodPost, "https://slack.com/api/chat.postMessage",
+			map[string]string{"channel": channelID, "text": text},
+			http.Header{"Authorization": {"Bearer " + in.BotToken}})
+		if err != nil {
+			return err
+		}
+		// Slack reports API errors with a 200 status
+		var result struct {
+			OK    bool   `json:"ok"`
+			Error string `json:"error"`
+		}
+		if err := json.Unmarshal(body, &result); err != nil {
+			return err
+		}
+		if !result.OK {
+			return fmt.Errorf("chat.postMessage: %s", result.Error)
+		}
+		return nil
+	}
+
+	if responseURL == "" {
+		return fmt.Errorf("no bot token or response URL to post to")
+	}
+	_, err := postJSON(ctx, http.MethodPost, responseURL,
+		map[string]string{"response_type": "in_channel", "text": text}, nil)
+	return err
+}
@@ -0,0 +1,336 @@
+package backend
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kataras/golog"
+)
+
+// routeLatencySamples is how many of the latest requests of a route its percentiles are taken from
+const routeLatencySamples = 1000
+
+// timingStage is a part of a request's time reported in its breakdown
+type timingStage int
+
+const (
+	stageDB timingStage = iota
+	stageRetrieval
+	stageLLM
+	stageCount
+)
+
+// requestTimings adds up the time a request spent in each stage. Stages may run concurrently,
+// e.g. parallel LLM calls, so their sum can exceed the request's duration.
+type requestTimings struct {
+	stages [stageCount]atomic.Int64 // Nanoseconds
+}
+
+type requestTimingsKey struct{}
+
+// recordTiming adds the time since start to a stage of the request ctx belongs to. It does
+// nothing outside of a request.
+func recordTiming(ctx context.Context, stage timingStage, start time.Time) {
+	if t, ok := ctx.Value(requestTimingsKey{}).(*requestTimings); ok {
+		t.stages[stage].Add(int64(time.Since(start)))
+	}
+}
+
+// routeLatencies is a ring of a route's latest request durations
+type routeLatencies struct {
+	samples []time.Duration
+	next    int
+	count   int64
+	slow    int64
+}
+
+// latencyTracker keeps the latencies of each route and the latest slow requests
+type latencyTracker struct {
+	threshold  time.Duration
+	thresholds map[string]time.Duration
+	logSize    int
+
+	mu     sync.Mutex
+	routes map[string]*routeLatencies
+	slow   []SlowRequest // Ring of the latest slow requests
+	next   int
+}
+
+func newLatencyTracker(cfg Config) *latencyTracker {
+	return &latencyTracker{
+		threshold:  cfg.SlowRequestThreshold,
+		thresholds: cfg.SlowRequestThresholds,
+		logSize:    cfg.SlowRequestLogSize,
+		routes:     make(map[string]*routeLatencies),
+	}
+}
+
+// thresholdOf returns the slow-request threshold of a route, 0 if none applies
+func (t *latencyTracker) thresholdOf(route string) time.Duration {
+	if threshold, ok := t.thresholds[route]; ok {
+		return threshold
+	}
+	return t.threshold
+}
+
+// add records the duration of a request, and keeps the request if it was slow
+func (t *latencyTracker) add(route string, duration time.Duration, slow *SlowRequest) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	r, ok := t.routes[route]
+	if !ok {
+		r = &routeLatencies{samples: make([]time.Duration, 0, routeLatencySamples)}
+		t.routes[route] = r
+	}
+	if len(r.samples) < routeLatencySamples {
+		r.samples = append(r.samples, duration)
+	} else {
+		r.samples[r.next] = duration
+		r.next = (r.next + 1) % routeLatencySamples
+	}
+	r.count++
+	if slow == nil {
+		return
+	}
+	r.slow++
+	if t.logSize <= 0 {
+		return
+	}
+	if len(t.slow) < t.logSize {
+		t.slow = append(t.slow, *slow)
+	} else {
+		t.slow[t.next] = *slow
+		t.next = (t.next + 1) % t.logSize
+	}
+}
+
+// latest returns up to limit of the slow requests kept, the most recent first
+func (t *latencyTracker) latest(limit int) []SlowRequest {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	requests := make([]SlowRequest, 0, min(limit, len(t.slow)))
+	for i := 1; i <= len(t.slow) && len(requests) < limit; i++ {
+		requests = append(requests, t.slow[(t.next-i+len(t.slow))%len(t.slow)])
+	}
+	return requests
+}
+
+// report returns the latency percentiles of each route, slowest p95 first
+func (t *latencyTracker) report() []RouteLatency {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	report := make([]RouteLatency, 0, len(t.routes))
+	for route, r := range t.routes {
+		sorted := append([]time.Duration(nil), r.samples...)
+		sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+		percentile := func(p int) float64 {
+			return milliseconds(sorted[(len(sorted)-1)*p/100])
+		}
+		report = append(report, RouteLatency{
+			Route:       route,
+			Count:       r.count,
+			Slow:        r.slow,
+			P50Ms:       percentile(50),
+			P95Ms:       percentile(95),
+			P99Ms:       percentile(99),
+			ThresholdMs: milliseconds(t.thresholdOf(route)),
+		})
+	}
+	sort.Slice(report, func(i, j int) bool { return report[i].P95Ms > report[j].P95Ms })
+	return report
+}
+
+// milliseconds converts a duration to fractional milliseconds
+func milliseconds(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// trackLatency is the middleware that times each request by route, with a breakdown of the time
+// spent in the database, retrieval and LLM calls made with the request's context, and logs the
+// requests slower than their route's threshold
+func (s *Server) trackLatency() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// Presence sockets stay open as long as a notebook is, which says nothing of latency
+		if c.IsWebsocket() {
+			c.Next()
+			return
+		}
+		timings := &requestTimings{}
+		c.Request = c.Request.WithContext(context.WithValue(c.Request.Context(), requestTimingsKey{}, timings))
+		start := time.Now()
+		c.Next()
+		duration := time.Since(start)
+
+		// Requests that matched no route would each add a route of their own
+		if c.FullPath() == "" {
+			return
+		}
+		route := c.Request.Method + " " + c.FullPath()
+		threshold := s.latencies.thresholdOf(route)
+		if threshold <= 0 || duration < threshold {
+			s.latencies.add(route, duration, nil)
+			return
+		}
+
+		db := time.Duration(timings.stages[stageDB].Load())
+		retrieval := time.Duration(timings.stages[stageRetrieval].Load())
+		llm := time.Duration(timings.stages[stageLLM].Load())
+		other := max(0, duration-db-retrieval-llm)
+		slow := &SlowRequest{
+			Route:       route,
+			Path:        c.Request.URL.Path,
+			Status:      c.Writer.Status(),
+			UserID:      c.GetString("user_id"),
+			DurationMs:  milliseconds(duration),
+			DBMs:        milliseconds(db),
+			RetrievalMs: milliseconds(retrieval),
+			LLMMs:       milliseconds(llm),
+			OtherMs:     milliseconds(other),
+			ThresholdMs: milliseconds(threshold),
+			Time:        start,
+		}
+		s.latencies.add(route, duration, slow)
+		golog.Warnf("slow request: %s %s took %s (threshold %s): db %s, retrieval %s, llm %s, other %s",
+			c.Request.Method, slow.Path, duration.Round(time.Millisecond), threshold, db.Round(time.Millisecond),
+			retrieval.Round(time.Millisecond), llm.Round(time.Millisecond), other.Round(time.Millisecond))
+	}
+}
+
+// handleGetSlowRequests returns the latest requests that exceeded their route's threshold
+func (s *Server) handleGetSlowRequests(c *gin.Context) {
+	if !s.requireAdmin(c) {
+		return
+	}
+	limit := s.cfg.SlowRequestLogSize
+	if value := c.Query("limit"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 {
+			c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid limit"})
+			return
+		}
+		limit = n
+	}
+	c.JSON(http.StatusOK, s.latencies.latest(limit))
+}
+
+// handleGetLatencies returns the p50, p95 and p99 latencies of each route since the server started
+func (s *Server) handleGetLatencies(c *gin.Context) {
+	if !s.requireAdmin(c) {
+		return
+	}
+	c.JSON(http.StatusOK, s.latencies.report())
+}
+
+// openTimedDB opens a database whose queries count towards the DB time of the request their
+// context belongs to
+func openTimedDB(driverName, dsn string) (*sql.DB, error) {
+	db, err := sql.Open(driverName, dsn)
+	if err != nil {
+		return nil, err
+	}
+	d := db.Driver()
+	db.Close()
+	return sql.OpenDB(timedConnector{driver: d, dsn: dsn}), nil
+}
+
+type timedConnector struct {
+	driver driver.Driver
+	dsn    string
+}
+
+func (t timedConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := t.driver.Open(t.dsn)
+	if err != nil {
+		return nil, err
+	}
+	return &timedConn{conn}, nil
+}
+
+func (t timedConnector) Driver() driver.Driver {
+	return t.driver
+}
+
+// timedConn times the statements of a connection. The driver must support contexts, as
+// modernc.org/sqlite does; the rest of its optional interfaces are passed on.
+type timedConn struct {
+	driver.Conn
+}
+
+func (c *timedConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	defer recordTiming(ctx, stageDB, time.Now())
+	return c.Conn.(driver.ConnBeginTx).BeginTx(ctx, opts)
+}
+
+func (c *timedConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	defer recordTiming(ctx, stageDB, time.Now())
+	stmt, err := c.Conn.(driver.ConnPrepareContext).PrepareContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	return &timedStmt{stmt}, nil
+}
+
+func (c *timedConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	defer recordTiming(ctx, stageDB, time.Now())
+	return c.Conn.(driver.ExecerContext).ExecContext(ctx, query, args)
+}
+
+func (c *timedConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	defer recordTiming(ctx, stageDB, time.Now())
+	rows, err := c.Conn.(driver.QueryerContext).QueryContext(ctx, query, args)
+	if err != nil {
+		return nil, err
+	}
+	return &timedRows{Rows: rows, ctx: ctx}, nil
+}
+
+func (c *timedConn) ResetSession(ctx context.Context) error {
+	if r, ok := c.Conn.(driver.SessionResetter); ok {
+		return r.ResetSession(ctx)
+	}
+	return nil
+}
+
+func (c *timedConn) IsValid() bool {
+	if v, ok := c.Conn.(driver.Validator); ok {
+		return v.IsValid()
+	}
+	return true
+}
+
+type timedStmt struct {
+	driver.Stmt
+}
+
+func (s *timedStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	defer recordTiming(ctx, stageDB, time.Now())
+	return s.Stmt.(driver.StmtExecContext).ExecContext(ctx, args)
+}
+
+func (s *timedStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	defer recordTiming(ctx, stageDB, time.Now())
+	rows, err := s.Stmt.(driver.StmtQueryContext).QueryContext(ctx, args)
+	if err != nil {
+		return nil, err
+	}
+	return &timedRows{Rows: rows, ctx: ctx}, nil
+}
+
+// timedRows times reading the rows of a query, where SQLite does most of a query's work
+type timedRows struct {
+	driver.Rows
+	ctx context.Context
+}
+
+func (r *timedRows) Next(dest []driver.Value) error {
+	defer recordTiming(r.ctx, stageDB, time.Now())
+	return r.Rows.Next(dest)
+}
@@ -0,0 +1,206 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kataras/golog"
+)
+
+const (
+	// sourceChangeThreshold is the share of a source's stored content that has to remain on the
+	// page for the source to count as unchanged
+	sourceChangeThreshold = 0.6
+	// sourceBrokenAfter is how many consecutive failed checks flag a source as broken, so a
+	// short outage doesn't
+	sourceBrokenAfter = 2
+)
+
+// sourceCheckHTTPClient probes URL sources
+var sourceCheckHTTPClient = &http.Client{Timeout: 30 * time.Second}
+
+// sourceCheckLoop checks every URL source each interval
+func (s *Server) sourceCheckLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		ctx := context.Background()
+		sources, err := s.store.ListSourcesByType(ctx, "url")
+		if err != nil {
+			golog.Errorf("failed to list URL sources: %v", err)
+			continue
+		}
+		flagged := 0
+		for i := range sources {
+			health, err := s.checkSourceHealth(ctx, &sources[i])
+			if err != nil {
+				golog.Warnf("failed to check source %s: %v", sources[i].ID, err)
+			} else if health.Status != SourceHealthOK {
+				flagged++
+			}
+		}
+		golog.Infof("checked %d URL sources, %d broken or changed", len(sources), flagged)
+	}
+}
+
+// contentSimilarity returns the share of the stored content's shingles still found in the
+// current content. Content added to a page doesn't lower it; content removed or rewritten does.
+func contentSimilarity(stored, current string) float64 {
+	storedTokens := overlapTokens(stored)
+	if len(storedTokens) < overlapShingleSize {
+		return 1
+	}
+	currentTokens := overlapTokens(current)
+	present := make(map[string]bool)
+	for i := 0; i+overlapShingleSize <= len(currentTokens); i++ {
+		present[shingleKey(currentTokens, i)] = true
+	}
+
+	seen := make(map[string]bool)
+	found := 0
+	for i := 0; i+overlapShingleSize <= len(storedTokens); i++ {
+		key := shingleKey(storedTokens, i)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		if present[key] {
+			found++
+		}
+	}
+	return float64(found) / float64(len(seen))
+}
+
+// probeSourceURL fetches a URL and returns its HTTP status, failing on error statuses
+func probeSourceURL(ctx context.Context, target string) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, target, nil)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("User-Agent", "notex-source-check")
+	resp, err := sourceCheckHTTPClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 1<<20))
+	if resp.StatusCode >= 400 {
+		return resp.StatusCode, fmt.Errorf("page returned %s", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
+
+// checkSourceHealth checks that a URL source still loads and still has the content it was
+// imported with, records the outcome, and notifies the notebook owner when the source becomes
+// broken or changed
+func (s *Server) checkSourceHealth(ctx context.Context, source *Source) (*SourceHealth, error) {
+	previous, err := s.store.GetSourceHealth(ctx, source.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	health := &SourceHealth{Status: SourceHealthOK, CheckedAt: time.Now()}
+	status, fetchErr := probeSourceURL(ctx, source.URL)
+	health.HTTPStatus = status
+	// The page can only be compared when it can be converted the way it was on import. A merged
+	// crawl is only compared when refreshed, as comparing it means crawling the site again.
+	opts, crawled := sourceCrawlOptions(source)
+	readable := s.cfg.EnableMarkitdown || isCrawledPage(source) || urlSourceParser(source) == URLParserReadability
+	if fetchErr == nil && readable && !(crawled && opts.Merge) {
+		if content, err := s.fetchURLSource(ctx, source); err != nil {
+			fetchErr = err
+		} else {
+			similarity := math.Round(contentSimilarity(source.Content, content)*100) / 100
+			health.Similarity = &similarity
+			if similarity < sourceChangeThreshold {
+				health.Status = SourceHealthChanged
+			}
+		}
+	}
+	if fetchErr != nil {
+		health.Error = fetchErr.Error()
+		health.Failures = 1
+		if previous != nil {
+			health.Failures = previous.Failures + 1
+			health.Status = previous.Status
+			health.Similarity = previous.Similarity
+		}
+		if health.Failures >= sourceBrokenAfter {
+			health.Status = SourceHealthBroken
+		}
+	}
+
+	if err := s.store.SaveSourceHealth(ctx, source.ID, health); err != nil {
+		return nil, err
+	}
+
+	previousStatus := SourceHealthOK
+	if previous != nil {
+		previousStatus = previous.Status
+	}
+	if health.Status != previousStatus && health.Status != SourceHealthOK {
+		s.notifySourceHealth(ctx, source, health)
+	}
+	return health, nil
+}
+
+// notifySourceHealth tells the owner of a notebook that one of its sources broke or changed.
+// The notice goes to the owner's activity log, and the sources panel flags the source.
+func (s *Server) notifySourceHealth(ctx context.Context, source *Source, health *SourceHealth) {
+	golog.Warnf("source %s (%s) is %s: %s", source.ID, source.URL, health.Status, health.Error)
+
+	notebook, err := s.store.GetNotebook(ctx, source.NotebookID)
+	if err != nil {
+		golog.Errorf("failed to load notebook of source %s: %v", source.ID, err)
+		return
+	}
+	activityLog := &ActivityLog{
+		UserID:       notebook.UserID,
+		Action:       "source_" + health.Status,
+		ResourceType: "source",
+		ResourceID:   source.ID,
+		ResourceName: source.Name,
+		Details:      fmt.Sprintf(`{"notebook_id": "%s", "url": %q, "http_status": %d, "error": %q}`, source.NotebookID, source.URL, health.HTTPStatus, health.Error),
+	}
+	if err := s.store.LogActivity(ctx, activityLog); err != nil {
+		golog.Errorf("failed to log source health activity: %v", err)
+	}
+}
+
+// withSourceHealth annotates sources with their latest health check. The slice is modified in
+// place, so it must not be shared with the cache.
+func (s *Server) withSourceHealth(ctx context.Context, notebookID string, sources []Source) error {
+	checks, err := s.store.ListSourceHealth(ctx, notebookID)
+	if err != nil {
+		return err
+	}
+	for i := range sources {
+		sources[i].Health = checks[sources[i].ID]
+	}
+	return nil
+}
+
+// handleCheckSource checks a URL source right away instead of waiting for the scheduler
+func (s *Server) handleCheckSource(c *gin.Context) {
+	source, ok := s.getSourceInNotebook(c)
+	if !ok {
+		return
+	}
+	if source.Type != "url" || source.URL == "" {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Only URL sources are checked"})
+		return
+	}
+
+	health, err := s.checkSourceHealth(c.Request.Context(), source)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to check source", Details: err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, health)
+}
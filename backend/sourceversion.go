@@ -0,0 +1,568 @@
+package backend
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/kataras/golog"
+)
+
+const (
+	// diffContextLines is the number of unchanged lines kept around each change of a diff
+	diffContextLines = 3
+	// maxDiffEdits bounds the work spent on a diff. Contents further apart than this many line
+	// edits are shown as fully replaced.
+	maxDiffEdits = 2000
+)
+
+// sourceRefreshResponse is the outcome of a change to a source's content
+type sourceRefreshResponse struct {
+	Source  Source         `json:"source"`
+	Changed bool           `json:"changed"`
+	Version *SourceVersion `json:"version,omitempty"` // The replaced content, nil if nothing changed
+}
+
+// splitDiffLines splits content into lines for diffing
+func splitDiffLines(content string) []string {
+	if content == "" {
+		return nil
+	}
+	lines := strings.Split(strings.TrimSuffix(content, "\n"), "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimSuffix(line, "\r")
+	}
+	return lines
+}
+
+// diffLines returns the line edits turning a into b. Line numbers are filled in.
+func diffLines(a, b []string) []DiffLine {
+	prefix := 0
+	for prefix < len(a) && prefix < len(b) && a[prefix] == b[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(a)-prefix && suffix < len(b)-prefix && a[len(a)-1-suffix] == b[len(b)-1-suffix] {
+		suffix++
+	}
+
+	ops := make([]DiffLine, 0, len(a)+len(b)-prefix-suffix)
+	for _, line := range a[:prefix] {
+		ops = append(ops, DiffLine{Op: "equal", Text: line})
+	}
+	ops = append(ops, myersDiff(a[prefix:len(a)-suffix], b[prefix:len(b)-suffix])...)
+	for _, line := range a[len(a)-suffix:] {
+		ops = append(ops, DiffLine{Op: "equal", Text: line})
+	}
+
+	oldLine, newLine := 0, 0
+	for i := range ops {
+		if ops[i].Op != "insert" {
+			oldLine++
+			ops[i].OldLine = oldLine
+		}
+		if ops[i].Op != "delete" {
+			newLine++
+			ops[i].NewLine = newLine
+		}
+	}
+	return ops
+}
+
+// myersDiff finds a shortest edit script between a and b with Myers' algorithm, falling back to
+// replacing a with b when they differ by more than maxDiffEdits lines
+func myersDiff(a, b []string) []DiffLine {
+	n, m := len(a), len(b)
+	replaceAll := func() []DiffLine {
+		ops := make([]DiffLine, 0, n+m)
+		for _, line := range a {
+			ops = append(ops, DiffLine{Op: "delete", Text: line})
+		}
+		for _, line := range b {
+			ops = append(ops, DiffLine{Op: "insert", Text: line})
+		}
+		return ops
+	}
+	if n == 0 || m == 0 {
+		return replaceAll()
+	}
+
+	// v[offset+k] is the furthest x reached on diagonal k. trace[d] keeps the diagonals
+	// -(d+1)..d+1 of v as they were before round d, for walking the path back.
+	max := n + m
+	offset := max + 1
+	v := make([]int, 2*max+3)
+	var trace [][]int
+	found := false
+	for d := 0; d <= max && !found; d++ {
+		if d > maxDiffEdits {
+			return replaceAll()
+		}
+		trace = append(trace, append([]int(nil), v[offset-d-1:offset+d+2]...))
+		for k := -d; k <= d; k += 2 {
+			var x int
+			if k == -d || (k != d && v[offset+k-1] < v[offset+k+1]) {
+				x = v[offset+k+1]
+			} else {
+				x = v[offset+k-1] + 1
+			}
+			y := x - k
+			for x < n && y < m && a[x] == b[y] {
+				x++
+				y++
+			}
+			v[offset+k] = x
+			if x >= n && y >= m {
+				found = true
+				break
+			}
+		}
+	}
+
+	reversed := make([]DiffLine, 0, n+m)
+	x, y := n, m
+	for d := len(trace) - 1; d >= 0; d-- {
+		snapshot := trace[d]
+		at := func(k int) int { return snapshot[k+d+1] }
+		k := x - y
+		var prevK int
+		if k == -d || (k != d && at(k-1) < at(k+1)) {
+			prevK = k + 1
+		} else {
+			prevK = k - 1
+		}
+		prevX := at(prevK)
+		prevY := prevX - prevK
+		for x > prevX && y > prevY {
+			reversed = append(reversed, DiffLine{Op: "equal", Text: a[x-1]})
+			x--
+			y--
+		}
+		if d > 0 {
+			if x == prevX {
+				reversed = append(reversed, DiffLine{Op: "insert", Text: b[y-1]})
+			} else {
+				reversed = append(reversed, DiffLine{Op: "delete", Text: a[x-1]})
+			}
+		}
+		x, y = prevX, prevY
+	}
+
+	ops := make([]DiffLine, len(reversed))
+	for i, op := range reversed {
+		ops[len(reversed)-1-i] = op
+	}
+	return ops
+}
+
+// diffSourceContent diffs two contents of a source into hunks of changes with their context
+func diffSourceContent(from, to string) *SourceDiff {
+	ops := diffLines(splitDiffLines(from), splitDiffLines(to))
+	diff := &SourceDiff{Hunks: make([]DiffHunk, 0)}
+	for _, op := range ops {
+		switch op.Op {
+		case "insert":
+			diff.Added++
+		case "delete":
+			diff.Removed++
+		}
+	}
+
+	for i := 0; i < len(ops); {
+		if ops[i].Op == "equal" {
+			i++
+			continue
+		}
+		start := i - diffContextLines
+		if start < 0 {
+			start = 0
+		}
+		// Extend the hunk over later changes separated by little enough unchanged text
+		end := i
+		for end < len(ops) {
+			if ops[end].Op != "equal" {
+				end++
+				continue
+			}
+			run := end
+			for run < len(ops) && ops[run].Op == "equal" {
+				run++
+			}
+			if run == len(ops) || run-end > 2*diffContextLines {
+				end += diffContextLines
+				if end > run {
+					end = run
+				}
+				break
+			}
+			end = run
+		}
+		diff.Hunks = append(diff.Hunks, DiffHunk{Lines: ops[start:end]})
+		i = end
+	}
+	return diff
+}
+
+// replaceSourceContent keeps the source's current content as a version and re-indexes the
+// source with the new content. Nothing is stored when the content is unchanged.
+func (s *Server) replaceSourceContent(ctx context.Context, source *Source, content, fileName string, fileSize int64) (*SourceVersion, error) {
+	if content == source.Content {
+		return nil, nil
+	}
+	version, err := s.store.ReplaceSourceContent(ctx, source, content, fileName, fileSize)
+	if err != nil {
+		return nil, err
+	}
+	if s.cfg.SourceVersionLimit > 0 {
+		if err := s.store.PruneSourceVersions(ctx, source.ID, s.cfg.SourceVersionLimit); err != nil {
+			golog.Errorf("failed to prune versions of source %s: %v", source.ID, err)
+		}
+	}
+
+	if err := s.vectorStore.DeleteBySourceID(ctx, source.ID); err != nil {
+		golog.Errorf("failed to remove old chunks of source %s: %v", source.ID, err)
+	}
+	source.ChunkCount = 0
+	s.store.UpdateSourceChunkCount(ctx, source.ID, 0)
+	s.ingestSourceText(ctx, source)
+	return version, nil
+}
+
+// logSourceChange records a change of a source's content in the user's activity log
+func (s *Server) logSourceChange(c *gin.Context, action string, source *Source, version *SourceVersion) {
+	versionNumber := 0
+	if version != nil {
+		versionNumber = version.Version
+	}
+	activityLog := &ActivityLog{
+		UserID:       c.GetString("user_id"),
+		Action:       action,
+		ResourceType: "source",
+		ResourceID:   source.ID,
+		ResourceName: source.Name,
+		Details:      fmt.Sprintf(`{"notebook_id": "%s", "source_type": "%s", "changed": %t, "version": %d}`, source.NotebookID, source.Type, version != nil, versionNumber),
+		IPAddress:    c.ClientIP(),
+		UserAgent:    c.GetHeader("User-Agent"),
+	}
+	if err := s.store.LogActivity(c.Request.Context(), activityLog); err != nil {
+		golog.Errorf("failed to log source change activity: %v", err)
+	}
+}
+
+// handleRefreshSource re-fetches a URL source, or re-reads the tables of a database source,
+// keeping its previous content as a version
+func (s *Server) handleRefreshSource(c *gin.Context) {
+	source, ok := s.getSourceInNotebook(c)
+	if !ok {
+		return
+	}
+	if source.Type == "database" {
+		s.refreshDatabaseSource(c, source)
+		return
+	}
+	// Papers resolve to a downloaded PDF rather than the page, so they are re-added instead
+	if source.Type != "url" || source.URL == "" || source.FileName != "" {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Only URL and database sources can be refreshed"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	content, err := s.fetchURLSource(ctx, source)
+	if err != nil {
+		golog.Errorf("failed to fetch URL content: %v", err)
+		c.JSON(http.StatusBadGateway, ErrorResponse{Error: "Failed to fetch URL content", Details: err.Error()})
+		return
+	}
+
+	version, err := s.replaceSourceContent(ctx, source, content, source.FileName, source.FileSize)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to update source", Details: err.Error()})
+		return
+	}
+	// The stored content is the page as it is now
+	if err := s.store.SaveSourceHealth(ctx, source.ID, &SourceHealth{Status: SourceHealthOK, CheckedAt: time.Now()}); err != nil {
+		golog.Errorf("failed to reset health of source %s: %v", source.ID, err)
+	}
+	s.logSourceChange(c, "refresh_source", source, version)
+
+	c.JSON(http.StatusOK, sourceRefreshResponse{Source: summarizeSources([]Source{*source})[0], Changed: version != nil, Version: version})
+}
+
+// handleReuploadSource replaces the file of a file source, keeping its previous content as a version
+func (s *Server) handleReuploadSource(c *gin.Context) {
+	source, ok := s.getSourceInNotebook(c)
+	if !ok {
+		return
+	}
+	if source.Type != "file" {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Only file sources can be re-uploaded"})
+		return
+	}
+
+	file, err := c.FormFile("file")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "file required"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	userID := c.GetString("user_id")
+	ext := filepath.Ext(file.Filename)
+	baseName := file.Filename[:len(file.Filename)-len(ext)]
+	uniqueFileName := fmt.Sprintf("%s_%s%s", baseName, uuid.New().String()[:8], ext)
+	userUploadDir := filepath.Join(s.cfg.UploadDir, userID)
+	path := filepath.Join(userUploadDir, uniqueFileName)
+
+	if err := os.MkdirAll(userUploadDir, 0755); err != nil {
+		golog.Errorf("failed to create user uploads directory: %v", err)
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to create uploads directory"})
+		return
+	}
+	if err := c.SaveUploadedFile(file, path); err != nil {
+		golog.Errorf("failed to save file: %v", err)
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: fmt.Sprintf("Failed to save file: %v", err)})
+		return
+	}
+
+	version, err := s.replaceSourceFile(ctx, source, path, uniqueFileName, file.Size)
+	if errors.Is(err, errInfected) {
+		c.JSON(http.StatusUnprocessableEntity, ErrorResponse{Error: "The file was quarantined by the virus scan", Details: err.Error()})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to update source", Details: err.Error()})
+		return
+	}
+	if version == nil {
+		s.logSourceChange(c, "refresh_source", source, nil)
+		c.JSON(http.StatusOK, sourceRefreshResponse{Source: summarizeSources([]Source{*source})[0]})
+		return
+	}
+	s.logSourceChange(c, "refresh_source", source, version)
+
+	c.JSON(http.StatusOK, sourceRefreshResponse{Source: summarizeSources([]Source{*source})[0], Changed: true, Version: version})
+}
+
+// replaceSourceFile replaces the content of a file source with the document saved at path,
+// keeping the previous content as a version. The new file is removed if its content is
+// unchanged, in which case no version is returned. A file the virus scan flags leaves the
+// source as it was.
+func (s *Server) replaceSourceFile(ctx context.Context, source *Source, path, fileName string, fileSize int64) (*SourceVersion, error) {
+	scan, err := s.scanUpload(ctx, path)
+	if err != nil {
+		if scan == nil {
+			os.Remove(path)
+		}
+		return nil, err
+	}
+	content, _, err := s.extractDocument(ctx, path)
+	if err != nil {
+		os.Remove(path)
+		return nil, fmt.Errorf("failed to extract document content: %w", err)
+	}
+	if content == source.Content {
+		os.Remove(path)
+		return nil, nil
+	}
+
+	// The previous file stays on disk with the version that refers to it
+	if source.Metadata == nil {
+		source.Metadata = make(map[string]interface{})
+	}
+	source.Metadata["path"] = path
+	if scan != nil {
+		source.Metadata["scan"] = scan
+	}
+	if hash, err := fileSHA256(path); err == nil {
+		source.Metadata["sha256"] = hash
+	}
+	version, err := s.replaceSourceContent(ctx, source, content, fileName, fileSize)
+	if err != nil {
+		os.Remove(path)
+		return nil, err
+	}
+	return version, nil
+}
+
+// handleUpdateSourceContent replaces the content of a pasted text source, keeping its previous
+// content as a version
+func (s *Server) handleUpdateSourceContent(c *gin.Context) {
+	source, ok := s.getSourceInNotebook(c)
+	if !ok {
+		return
+	}
+	if source.Type != "text" {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Only text sources can be edited"})
+		return
+	}
+
+	var req struct {
+		Content string `json:"content" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+		return
+	}
+
+	version, err := s.replaceSourceContent(c.Request.Context(), source, req.Content, source.FileName, source.FileSize)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to update source", Details: err.Error()})
+		return
+	}
+	s.logSourceChange(c, "edit_source", source, version)
+
+	c.JSON(http.StatusOK, sourceRefreshResponse{Source: summarizeSources([]Source{*source})[0], Changed: version != nil, Version: version})
+}
+
+// handleRestoreSourceVersion rolls a source back to a previous version. The content being
+// replaced is kept as a new version, so a restore can itself be undone.
+func (s *Server) handleRestoreSourceVersion(c *gin.Context) {
+	source, ok := s.getSourceInNotebook(c)
+	if !ok {
+		return
+	}
+
+	number, err := strconv.Atoi(c.Param("version"))
+	if err != nil || number < 1 {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid version"})
+		return
+	}
+	ctx := c.Request.Context()
+	restored, err := s.store.GetSourceVersion(ctx, source.ID, number)
+	if err != nil {
+		c.JSON(http.StatusNotFound, ErrorResponse{Error: "Source version not found"})
+		return
+	}
+
+	// A re-uploaded file's previous upload is still next to the current one
+	if path, ok := source.Metadata["path"].(string); ok && restored.FileName != "" && restored.FileName != source.FileName {
+		source.Metadata["path"] = filepath.Join(filepath.Dir(path), restored.FileName)
+	}
+	version, err := s.replaceSourceContent(ctx, source, restored.Content, restored.FileName, restored.FileSize)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to restore source", Details: err.Error()})
+		return
+	}
+	s.logSourceChange(c, "restore_source", source, version)
+
+	c.JSON(http.StatusOK, sourceRefreshResponse{Source: summarizeSources([]Source{*source})[0], Changed: version != nil, Version: version})
+}
+
+// handleListSourceVersions lists the previous versions of a source, newest first
+func (s *Server) handleListSourceVersions(c *gin.Context) {
+	source, ok := s.getSourceInNotebook(c)
+	if !ok {
+		return
+	}
+
+	versions, err := s.store.ListSourceVersions(c.Request.Context(), source.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to list source versions"})
+		return
+	}
+	c.JSON(http.StatusOK, versions)
+}
+
+// handleGetSourceVersion returns a previous version of a source with its content
+func (s *Server) handleGetSourceVersion(c *gin.Context) {
+	source, ok := s.getSourceInNotebook(c)
+	if !ok {
+		return
+	}
+
+	number, err := strconv.Atoi(c.Param("version"))
+	if err != nil || number < 1 {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid version"})
+		return
+	}
+	version, err := s.store.GetSourceVersion(c.Request.Context(), source.ID, number)
+	if err != nil {
+		c.JSON(http.StatusNotFound, ErrorResponse{Error: "Source version not found"})
+		return
+	}
+	c.JSON(http.StatusOK, version)
+}
+
+// sourceVersionContent returns the content of a version of a source, 0 being the current content
+func (s *Server) sourceVersionContent(ctx context.Context, source *Source, number int) (string, error) {
+	if number == 0 {
+		return source.Content, nil
+	}
+	version, err := s.store.GetSourceVersion(ctx, source.ID, number)
+	if err != nil {
+		return "", err
+	}
+	return version.Content, nil
+}
+
+// handleSourceDiff diffs two versions of a source. ?from defaults to the latest previous version
+// and ?to to the current content; either may be "current".
+func (s *Server) handleSourceDiff(c *gin.Context) {
+	source, ok := s.getSourceInNotebook(c)
+	if !ok {
+		return
+	}
+	ctx := c.Request.Context()
+
+	parseVersion := func(value string) (int, bool) {
+		if value == "current" {
+			return 0, true
+		}
+		number, err := strconv.Atoi(value)
+		return number, err == nil && number >= 0
+	}
+
+	from := 0
+	if value := c.Query("from"); value != "" {
+		number, ok := parseVersion(value)
+		if !ok {
+			c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid from version"})
+			return
+		}
+		from = number
+	} else {
+		versions, err := s.store.ListSourceVersions(ctx, source.ID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to list source versions"})
+			return
+		}
+		if len(versions) == 0 {
+			c.JSON(http.StatusNotFound, ErrorResponse{Error: "Source has no previous versions"})
+			return
+		}
+		from = versions[0].Version
+	}
+	to := 0
+	if value := c.Query("to"); value != "" {
+		number, ok := parseVersion(value)
+		if !ok {
+			c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid to version"})
+			return
+		}
+		to = number
+	}
+
+	fromContent, err := s.sourceVersionContent(ctx, source, from)
+	if err != nil {
+		c.JSON(http.StatusNotFound, ErrorResponse{Error: "Source version not found", Details: err.Error()})
+		return
+	}
+	toContent, err := s.sourceVersionContent(ctx, source, to)
+	if err != nil {
+		c.JSON(http.StatusNotFound, ErrorResponse{Error: "Source version not found", Details: err.Error()})
+		return
+	}
+
+	diff := diffSourceContent(fromContent, toContent)
+	diff.From = from
+	diff.To = to
+	c.JSON(http.StatusOK, diff)
+}
@@ -0,0 +1,76 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Storage stores binary blobs such as oversized note content and generated assets
+type Storage interface {
+	// Put writes data under the given key, replacing any existing blob
+	Put(ctx context.Context, key string, data []byte) error
+
+	// Get reads the blob stored under the given key
+	Get(ctx context.Context, key string) ([]byte, error)
+
+	// Delete removes the blob stored under the given key; missing blobs are not an error
+	Delete(ctx context.Context, key string) error
+}
+
+// LocalStorage is a Storage implementation backed by the local filesystem
+type LocalStorage struct {
+	baseDir string
+}
+
+// NewLocalStorage creates a new local storage rooted at baseDir
+func NewLocalStorage(baseDir string) (*LocalStorage, error) {
+	if err := os.MkdirAll(baseDir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create storage directory: %w", err)
+	}
+	return &LocalStorage{baseDir: baseDir}, nil
+}
+
+// path resolves a key to a file path, rejecting keys that escape the base directory
+func (ls *LocalStorage) path(key string) (string, error) {
+	cleaned := filepath.Clean(filepath.FromSlash(key))
+	if cleaned == "." || filepath.IsAbs(cleaned) || strings.HasPrefix(cleaned, "..") {
+		return "", fmt.Errorf("invalid storage key: %s", key)
+	}
+	return filepath.Join(ls.baseDir, cleaned), nil
+}
+
+// Put writes data under the given key
+func (ls *LocalStorage) Put(ctx context.Context, key string, data []byte) error {
+	p, err := ls.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+		return fmt.Errorf("failed to create blob directory: %w", err)
+	}
+	return os.WriteFile(p, data, 0644)
+}
+
+// Get reads the blob stored under the given key
+func (ls *LocalStorage) Get(ctx context.Context, key string) ([]byte, error) {
+	p, err := ls.path(key)
+	if err != nil {
+		return nil, err
+	}
+	return os.ReadFile(p)
+}
+
+// Delete removes the blob stored under the given key
+func (ls *LocalStorage) Delete(ctx context.Context, key string) error {
+	p, err := ls.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(p); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -2,13 +2,17 @@ package backend
 
 import (
 	"context"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"log"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/google/uuid"
 	_ "modernc.org/sqlite"
@@ -18,6 +22,13 @@ import (
 type Store struct {
 	db     *sql.DB
 	dbPath string
+
+	// blobs holds note content that exceeds noteInlineLimit
+	blobs           Storage
+	noteInlineLimit int
+
+	// secretKey encrypts the credentials stored in the database
+	secretKey []byte
 }
 
 // NewStore creates a new store
@@ -30,17 +41,28 @@ func NewStore(cfg Config) (*Store, error) {
 	absPath, _ := filepath.Abs(cfg.StorePath)
 	fmt.Printf("📦 Initializing SQLite Store at: %s\n", absPath)
 
-	db, err := sql.Open("sqlite", cfg.StorePath)
+	// Background workers write concurrently; wait for the lock instead of failing with SQLITE_BUSY.
+	// Pragmas go in the DSN so that every pooled connection gets them, not just the first, and
+	// transactions take the write lock up front, since a deferred one that reads first can't
+	// wait for it when upgrading.
+	dsn := cfg.StorePath
+	params := "_pragma=busy_timeout(5000)&_pragma=foreign_keys(1)&_txlock=immediate"
+	if strings.Contains(dsn, "?") {
+		dsn += "&" + params
+	} else {
+		dsn += "?" + params
+	}
+	db, err := openTimedDB("sqlite", dsn)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open database: %w", err)
 	}
 
-	// Enable foreign key constraints
-	if _, err := db.Exec("PRAGMA foreign_keys = ON"); err != nil {
-		return nil, fmt.Errorf("failed to enable foreign keys: %w", err)
+	blobs, err := NewLocalStorage(cfg.BlobStoragePath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize blob storage: %w", err)
 	}
 
-	store := &Store{db: db, dbPath: cfg.StorePath}
+	store := &Store{db: db, dbPath: cfg.StorePath, blobs: blobs, noteInlineLimit: cfg.NoteInlineContentLimit, secretKey: secretKey(cfg.SecretKey)}
 
 	// Initialize schema
 	if err := store.initSchema(); err != nil {
@@ -108,6 +130,15 @@ func (s *Store) initSchema() error {
 		}
 	}
 
+	// Check if cover_image column exists in notebooks table (migration)
+	err = s.db.QueryRow("SELECT COUNT(*) FROM pragma_table_info('notebooks') WHERE name='cover_image'").Scan(&count)
+	if err == nil && count == 0 {
+		// Add cover_image column
+		if _, err := s.db.Exec("ALTER TABLE notebooks ADD COLUMN cover_image TEXT"); err != nil {
+			return fmt.Errorf("failed to add cover_image column to notebooks: %w", err)
+		}
+	}
+
 	restSchema := `
 	CREATE TABLE IF NOT EXISTS sources (
 		id TEXT PRIMARY KEY,
@@ -175,6 +206,15 @@ func (s *Store) initSchema() error {
 		FOREIGN KEY (notebook_id) REFERENCES notebooks(id) ON DELETE CASCADE
 	);
 
+	CREATE TABLE IF NOT EXISTS source_reads (
+		user_id TEXT NOT NULL,
+		source_id TEXT NOT NULL,
+		read_at INTEGER NOT NULL,
+		PRIMARY KEY (user_id, source_id),
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+		FOREIGN KEY (source_id) REFERENCES sources(id) ON DELETE CASCADE
+	);
+
 	CREATE INDEX IF NOT EXISTS idx_sources_notebook ON sources(notebook_id);
 	CREATE INDEX IF NOT EXISTS idx_notes_notebook ON notes(notebook_id);
 	CREATE INDEX IF NOT EXISTS idx_chat_sessions_notebook ON chat_sessions(notebook_id);
@@ -195,12 +235,475 @@ func (s *Store) initSchema() error {
 		FOREIGN KEY (user_id) REFERENCES users(id)
 	);
 
+	CREATE TABLE IF NOT EXISTS integrations (
+		id TEXT PRIMARY KEY,
+		user_id TEXT NOT NULL,
+		provider TEXT NOT NULL,
+		bot_token TEXT,
+		signing_secret TEXT,
+		public_key TEXT,
+		application_id TEXT,
+		created_at INTEGER NOT NULL,
+		updated_at INTEGER NOT NULL,
+		UNIQUE (user_id, provider),
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+	);
+
+	CREATE TABLE IF NOT EXISTS telegram_chats (
+		integration_id TEXT NOT NULL,
+		chat_id INTEGER NOT NULL,
+		notebook_id TEXT NOT NULL,
+		updated_at INTEGER NOT NULL,
+		PRIMARY KEY (integration_id, chat_id),
+		FOREIGN KEY (integration_id) REFERENCES integrations(id) ON DELETE CASCADE,
+		FOREIGN KEY (notebook_id) REFERENCES notebooks(id) ON DELETE CASCADE
+	);
+
+	CREATE TABLE IF NOT EXISTS telegram_links (
+		integration_id TEXT NOT NULL,
+		chat_id INTEGER NOT NULL,
+		telegram_user_id INTEGER NOT NULL,
+		created_at INTEGER NOT NULL,
+		PRIMARY KEY (integration_id, chat_id, telegram_user_id),
+		FOREIGN KEY (integration_id) REFERENCES integrations(id) ON DELETE CASCADE
+	);
+
+	CREATE TABLE IF NOT EXISTS telegram_link_codes (
+		integration_id TEXT PRIMARY KEY,
+		code_hash TEXT NOT NULL,
+		expires_at INTEGER NOT NULL,
+		FOREIGN KEY (integration_id) REFERENCES integrations(id) ON DELETE CASCADE
+	);
+
+	CREATE TABLE IF NOT EXISTS ingest_hooks (
+		id TEXT PRIMARY KEY,
+		user_id TEXT NOT NULL,
+		name TEXT NOT NULL,
+		token TEXT NOT NULL UNIQUE,
+		notebook_id TEXT NOT NULL,
+		name_template TEXT,
+		created_at INTEGER NOT NULL,
+		last_used_at INTEGER,
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+		FOREIGN KEY (notebook_id) REFERENCES notebooks(id) ON DELETE CASCADE
+	);
+
+	CREATE TABLE IF NOT EXISTS calendar_feeds (
+		id TEXT PRIMARY KEY,
+		notebook_id TEXT NOT NULL,
+		user_id TEXT NOT NULL,
+		name TEXT,
+		url TEXT NOT NULL,
+		auto_summary INTEGER DEFAULT 0,
+		last_synced_at INTEGER,
+		last_error TEXT,
+		created_at INTEGER NOT NULL,
+		FOREIGN KEY (notebook_id) REFERENCES notebooks(id) ON DELETE CASCADE,
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+	);
+
+	CREATE TABLE IF NOT EXISTS calendar_events (
+		feed_id TEXT NOT NULL,
+		event_key TEXT NOT NULL,
+		source_id TEXT,
+		starts_at INTEGER NOT NULL,
+		ends_at INTEGER NOT NULL,
+		transcript_source_id TEXT,
+		summary_note_id TEXT,
+		PRIMARY KEY (feed_id, event_key),
+		FOREIGN KEY (feed_id) REFERENCES calendar_feeds(id) ON DELETE CASCADE,
+		FOREIGN KEY (source_id) REFERENCES sources(id) ON DELETE SET NULL,
+		FOREIGN KEY (transcript_source_id) REFERENCES sources(id) ON DELETE SET NULL,
+		FOREIGN KEY (summary_note_id) REFERENCES notes(id) ON DELETE SET NULL
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_calendar_events_source ON calendar_events(source_id);
+
+	CREATE TABLE IF NOT EXISTS connectors (
+		id TEXT PRIMARY KEY,
+		notebook_id TEXT NOT NULL,
+		user_id TEXT NOT NULL,
+		kind TEXT NOT NULL,
+		name TEXT,
+		settings TEXT NOT NULL,
+		secret TEXT NOT NULL,
+		cursor TEXT,
+		last_synced_at INTEGER,
+		last_error TEXT,
+		created_at INTEGER NOT NULL,
+		FOREIGN KEY (notebook_id) REFERENCES notebooks(id) ON DELETE CASCADE,
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+	);
+
+	CREATE TABLE IF NOT EXISTS connector_items (
+		connector_id TEXT NOT NULL,
+		item_key TEXT NOT NULL,
+		source_id TEXT,
+		version TEXT NOT NULL,
+		PRIMARY KEY (connector_id, item_key),
+		FOREIGN KEY (connector_id) REFERENCES connectors(id) ON DELETE CASCADE,
+		FOREIGN KEY (source_id) REFERENCES sources(id) ON DELETE SET NULL
+	);
+
+	CREATE TABLE IF NOT EXISTS draft_jobs (
+		id TEXT PRIMARY KEY,
+		notebook_id TEXT NOT NULL,
+		user_id TEXT NOT NULL,
+		brief TEXT NOT NULL,
+		length TEXT,
+		source_ids TEXT,
+		status TEXT NOT NULL,
+		outline TEXT,
+		sections TEXT,
+		citations TEXT,
+		note_id TEXT,
+		error TEXT,
+		created_at INTEGER NOT NULL,
+		updated_at INTEGER NOT NULL,
+		FOREIGN KEY (notebook_id) REFERENCES notebooks(id) ON DELETE CASCADE,
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+		FOREIGN KEY (note_id) REFERENCES notes(id) ON DELETE SET NULL
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_draft_jobs_notebook ON draft_jobs(notebook_id);
+
+	CREATE TABLE IF NOT EXISTS source_health (
+		source_id TEXT PRIMARY KEY,
+		status TEXT NOT NULL,
+		http_status INTEGER,
+		similarity REAL,
+		error TEXT,
+		failures INTEGER DEFAULT 0,
+		checked_at INTEGER NOT NULL,
+		FOREIGN KEY (source_id) REFERENCES sources(id) ON DELETE CASCADE
+	);
+
+	CREATE TABLE IF NOT EXISTS source_databases (
+		source_id TEXT PRIMARY KEY,
+		driver TEXT NOT NULL,
+		dsn TEXT NOT NULL,
+		tables TEXT NOT NULL,
+		FOREIGN KEY (source_id) REFERENCES sources(id) ON DELETE CASCADE
+	);
+
+	CREATE TABLE IF NOT EXISTS ingest_jobs (
+		id TEXT PRIMARY KEY,
+		source_id TEXT NOT NULL,
+		notebook_id TEXT NOT NULL,
+		user_id TEXT NOT NULL,
+		kind TEXT NOT NULL,
+		status TEXT NOT NULL,
+		stage TEXT,
+		error TEXT,
+		progress INTEGER NOT NULL DEFAULT 0,
+		total INTEGER NOT NULL DEFAULT 0,
+		created_at INTEGER NOT NULL,
+		updated_at INTEGER NOT NULL,
+		FOREIGN KEY (source_id) REFERENCES sources(id) ON DELETE CASCADE,
+		FOREIGN KEY (notebook_id) REFERENCES notebooks(id) ON DELETE CASCADE
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_ingest_jobs_notebook ON ingest_jobs(notebook_id);
+
+	CREATE TABLE IF NOT EXISTS transform_jobs (
+		id TEXT PRIMARY KEY,
+		notebook_id TEXT NOT NULL,
+		user_id TEXT NOT NULL,
+		request TEXT NOT NULL,
+		status TEXT NOT NULL,
+		stage TEXT,
+		note_id TEXT,
+		error TEXT,
+		created_at INTEGER NOT NULL,
+		updated_at INTEGER NOT NULL,
+		FOREIGN KEY (notebook_id) REFERENCES notebooks(id) ON DELETE CASCADE,
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE,
+		FOREIGN KEY (note_id) REFERENCES notes(id) ON DELETE SET NULL
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_transform_jobs_notebook ON transform_jobs(notebook_id);
+
+	CREATE TABLE IF NOT EXISTS source_versions (
+		id TEXT PRIMARY KEY,
+		source_id TEXT NOT NULL,
+		version INTEGER NOT NULL,
+		content TEXT,
+		file_name TEXT,
+		file_size INTEGER DEFAULT 0,
+		created_at INTEGER NOT NULL,
+		UNIQUE (source_id, version),
+		FOREIGN KEY (source_id) REFERENCES sources(id) ON DELETE CASCADE
+	);
+
+	CREATE TABLE IF NOT EXISTS source_summaries (
+		source_id TEXT NOT NULL,
+		layer INTEGER NOT NULL,
+		position INTEGER NOT NULL,
+		content_hash TEXT NOT NULL,
+		first_chunk INTEGER NOT NULL,
+		last_chunk INTEGER NOT NULL,
+		start_offset INTEGER NOT NULL,
+		end_offset INTEGER NOT NULL,
+		content TEXT NOT NULL,
+		PRIMARY KEY (source_id, layer, position),
+		FOREIGN KEY (source_id) REFERENCES sources(id) ON DELETE CASCADE
+	);
+
+	CREATE TABLE IF NOT EXISTS note_versions (
+		id TEXT PRIMARY KEY,
+		note_id TEXT NOT NULL,
+		version INTEGER NOT NULL,
+		title TEXT,
+		content TEXT,
+		metadata TEXT,
+		created_at INTEGER NOT NULL,
+		UNIQUE (note_id, version),
+		FOREIGN KEY (note_id) REFERENCES notes(id) ON DELETE CASCADE
+	);
+
+	CREATE TABLE IF NOT EXISTS chat_tools (
+		id TEXT PRIMARY KEY,
+		notebook_id TEXT NOT NULL,
+		user_id TEXT NOT NULL,
+		name TEXT NOT NULL,
+		description TEXT NOT NULL,
+		endpoint TEXT NOT NULL,
+		parameters TEXT,
+		auth_header TEXT,
+		auth_value TEXT,
+		enabled INTEGER DEFAULT 1,
+		created_at INTEGER NOT NULL,
+		updated_at INTEGER NOT NULL,
+		UNIQUE (notebook_id, name),
+		FOREIGN KEY (notebook_id) REFERENCES notebooks(id) ON DELETE CASCADE,
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+	);
+
+	CREATE TABLE IF NOT EXISTS chat_tool_calls (
+		id TEXT PRIMARY KEY,
+		tool_id TEXT NOT NULL,
+		notebook_id TEXT NOT NULL,
+		session_id TEXT,
+		tool_name TEXT NOT NULL,
+		arguments TEXT,
+		status_code INTEGER,
+		response TEXT,
+		error TEXT,
+		duration_ms INTEGER,
+		created_at INTEGER NOT NULL,
+		FOREIGN KEY (tool_id) REFERENCES chat_tools(id) ON DELETE CASCADE,
+		FOREIGN KEY (notebook_id) REFERENCES notebooks(id) ON DELETE CASCADE
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_chat_tool_calls_notebook ON chat_tool_calls(notebook_id, created_at);
+
+	CREATE TABLE IF NOT EXISTS notebook_chat_settings (
+		notebook_id TEXT PRIMARY KEY,
+		answer_style TEXT NOT NULL DEFAULT '',
+		top_k INTEGER NOT NULL DEFAULT 0,
+		score_threshold REAL NOT NULL DEFAULT 0,
+		max_context_chunks INTEGER NOT NULL DEFAULT 0,
+		updated_at INTEGER NOT NULL,
+		FOREIGN KEY (notebook_id) REFERENCES notebooks(id) ON DELETE CASCADE
+	);
+
+	CREATE TABLE IF NOT EXISTS notebook_share_policies (
+		notebook_id TEXT PRIMARY KEY,
+		policy TEXT NOT NULL,
+		updated_at INTEGER NOT NULL,
+		FOREIGN KEY (notebook_id) REFERENCES notebooks(id) ON DELETE CASCADE
+	);
+
+	CREATE TABLE IF NOT EXISTS notebook_legal_holds (
+		notebook_id TEXT PRIMARY KEY,
+		reason TEXT NOT NULL DEFAULT '',
+		set_by TEXT NOT NULL,
+		created_at INTEGER NOT NULL,
+		FOREIGN KEY (notebook_id) REFERENCES notebooks(id) ON DELETE CASCADE
+	);
+
+	CREATE TABLE IF NOT EXISTS generated_assets (
+		user_id TEXT NOT NULL,
+		file_name TEXT NOT NULL,
+		sha256 TEXT NOT NULL,
+		size INTEGER NOT NULL,
+		created_at INTEGER NOT NULL,
+		released_at INTEGER,
+		PRIMARY KEY (user_id, file_name),
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+	);
+
+	CREATE TABLE IF NOT EXISTS generated_asset_refs (
+		note_id TEXT NOT NULL,
+		user_id TEXT NOT NULL,
+		file_name TEXT NOT NULL,
+		PRIMARY KEY (note_id, file_name),
+		FOREIGN KEY (note_id) REFERENCES notes(id) ON DELETE CASCADE
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_generated_asset_refs_file ON generated_asset_refs(user_id, file_name);
+
+	CREATE TRIGGER IF NOT EXISTS generated_asset_released AFTER DELETE ON generated_asset_refs
+	BEGIN
+		UPDATE generated_assets SET released_at = CAST(strftime('%s', 'now') AS INTEGER)
+		WHERE user_id = OLD.user_id AND file_name = OLD.file_name;
+	END;
+
+	CREATE TABLE IF NOT EXISTS auth_sessions (
+		id TEXT PRIMARY KEY,
+		user_id TEXT NOT NULL,
+		name TEXT NOT NULL DEFAULT '',
+		scope TEXT NOT NULL DEFAULT '',
+		ip_address TEXT NOT NULL DEFAULT '',
+		user_agent TEXT NOT NULL DEFAULT '',
+		created_at INTEGER NOT NULL,
+		last_seen_at INTEGER NOT NULL,
+		expires_at INTEGER NOT NULL,
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_auth_sessions_user ON auth_sessions(user_id, last_seen_at);
+
+	CREATE TABLE IF NOT EXISTS user_identities (
+		provider TEXT NOT NULL,
+		subject TEXT NOT NULL,
+		user_id TEXT NOT NULL,
+		email TEXT NOT NULL DEFAULT '',
+		name TEXT NOT NULL DEFAULT '',
+		created_at INTEGER NOT NULL,
+		last_used_at INTEGER NOT NULL,
+		PRIMARY KEY (provider, subject),
+		UNIQUE (user_id, provider),
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+	);
+
+	CREATE TABLE IF NOT EXISTS unlinked_identities (
+		provider TEXT NOT NULL,
+		subject TEXT NOT NULL,
+		user_id TEXT NOT NULL,
+		unlinked_at INTEGER NOT NULL,
+		PRIMARY KEY (provider, subject),
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+	);
+
+	CREATE TABLE IF NOT EXISTS saved_prompts (
+		id TEXT PRIMARY KEY,
+		user_id TEXT NOT NULL,
+		title TEXT NOT NULL,
+		text TEXT NOT NULL,
+		variables TEXT,
+		created_at INTEGER NOT NULL,
+		updated_at INTEGER NOT NULL,
+		last_run_at INTEGER,
+		FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_saved_prompts_user ON saved_prompts(user_id);
+
+	CREATE TABLE IF NOT EXISTS usage (
+		id TEXT PRIMARY KEY,
+		user_id TEXT NOT NULL,
+		notebook_id TEXT NOT NULL,
+		operation TEXT NOT NULL,
+		model TEXT NOT NULL,
+		prompt_tokens INTEGER NOT NULL DEFAULT 0,
+		completion_tokens INTEGER NOT NULL DEFAULT 0,
+		images INTEGER NOT NULL DEFAULT 0,
+		cost REAL NOT NULL DEFAULT 0,
+		created_at INTEGER NOT NULL
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_usage_user ON usage(user_id, created_at);
+	CREATE INDEX IF NOT EXISTS idx_usage_created ON usage(created_at);
+
+	CREATE TABLE IF NOT EXISTS event_exports (
+		stream TEXT PRIMARY KEY,
+		exported_until INTEGER NOT NULL,
+		last_id TEXT NOT NULL,
+		updated_at INTEGER NOT NULL
+	);
+
 	CREATE INDEX IF NOT EXISTS idx_activity_logs_user ON activity_logs(user_id);
 	CREATE INDEX IF NOT EXISTS idx_activity_logs_created ON activity_logs(created_at);
 	`
 
-	_, err = s.db.Exec(restSchema)
-	return err
+	if _, err = s.db.Exec(restSchema); err != nil {
+		return err
+	}
+
+	// Check if share_token and share_expires_at columns exist in notes table (migration)
+	for column, columnType := range map[string]string{"share_token": "TEXT", "share_expires_at": "INTEGER"} {
+		err = s.db.QueryRow("SELECT COUNT(*) FROM pragma_table_info('notes') WHERE name=?", column).Scan(&count)
+		if err == nil && count == 0 {
+			if _, err := s.db.Exec("ALTER TABLE notes ADD COLUMN " + column + " " + columnType); err != nil {
+				return fmt.Errorf("failed to add %s column to notes: %w", column, err)
+			}
+		}
+	}
+	if _, err := s.db.Exec("CREATE UNIQUE INDEX IF NOT EXISTS idx_notes_share_token ON notes(share_token)"); err != nil {
+		return fmt.Errorf("failed to create share token index: %w", err)
+	}
+
+	// Check if private column exists in notes and sources tables (migration)
+	for _, table := range []string{"notes", "sources"} {
+		err = s.db.QueryRow("SELECT COUNT(*) FROM pragma_table_info(?) WHERE name='private'", table).Scan(&count)
+		if err == nil && count == 0 {
+			if _, err := s.db.Exec("ALTER TABLE " + table + " ADD COLUMN private INTEGER NOT NULL DEFAULT 0"); err != nil {
+				return fmt.Errorf("failed to add private column to %s: %w", table, err)
+			}
+		}
+	}
+
+	// Check if role and password_hash columns exist in users table (migration)
+	for _, column := range []string{"role", "password_hash"} {
+		err = s.db.QueryRow("SELECT COUNT(*) FROM pragma_table_info('users') WHERE name=?", column).Scan(&count)
+		if err == nil && count == 0 {
+			if _, err := s.db.Exec("ALTER TABLE users ADD COLUMN " + column + " TEXT"); err != nil {
+				return fmt.Errorf("failed to add %s column to users: %w", column, err)
+			}
+		}
+	}
+
+	// Check if the retrieval columns exist in notebook_chat_settings table (migration)
+	for column, columnType := range map[string]string{"top_k": "INTEGER", "score_threshold": "REAL", "max_context_chunks": "INTEGER"} {
+		err = s.db.QueryRow("SELECT COUNT(*) FROM pragma_table_info('notebook_chat_settings') WHERE name=?", column).Scan(&count)
+		if err == nil && count == 0 {
+			if _, err := s.db.Exec("ALTER TABLE notebook_chat_settings ADD COLUMN " + column + " " + columnType + " NOT NULL DEFAULT 0"); err != nil {
+				return fmt.Errorf("failed to add %s column to notebook_chat_settings: %w", column, err)
+			}
+		}
+	}
+
+	// Check if the progress columns exist in ingest_jobs table (migration)
+	for _, column := range []string{"progress", "total"} {
+		err = s.db.QueryRow("SELECT COUNT(*) FROM pragma_table_info('ingest_jobs') WHERE name=?", column).Scan(&count)
+		if err == nil && count == 0 {
+			if _, err := s.db.Exec("ALTER TABLE ingest_jobs ADD COLUMN " + column + " INTEGER NOT NULL DEFAULT 0"); err != nil {
+				return fmt.Errorf("failed to add %s column to ingest_jobs: %w", column, err)
+			}
+		}
+	}
+
+	// Check if content_blob column exists in notes table (migration)
+	err = s.db.QueryRow("SELECT COUNT(*) FROM pragma_table_info('notes') WHERE name='content_blob'").Scan(&count)
+	if err == nil && count == 0 {
+		// Add content_blob column
+		if _, err := s.db.Exec("ALTER TABLE notes ADD COLUMN content_blob TEXT"); err != nil {
+			return fmt.Errorf("failed to add content_blob column to notes: %w", err)
+		}
+	}
+
+	// Encrypt connector secrets stored before secrets were encrypted (migration)
+	if err := s.encryptConnectorSecrets(); err != nil {
+		return fmt.Errorf("failed to encrypt connector secrets: %w", err)
+	}
+
+	// Hash ingest hook tokens stored before only their hashes were kept (migration)
+	if err := s.hashIngestHookTokens(); err != nil {
+		return fmt.Errorf("failed to hash ingest hook tokens: %w", err)
+	}
+
+	return nil
 }
 
 // User operations
@@ -232,58 +735,299 @@ func (s *Store) CreateUser(ctx context.Context, user *User) error {
 	}
 
 	_, err = s.db.ExecContext(ctx, `
-		INSERT INTO users (id, email, name, avatar_url, provider, created_at, updated_at)
-		VALUES (?, ?, ?, ?, ?, ?, ?)
-	`, user.ID, user.Email, user.Name, user.AvatarURL, user.Provider, user.CreatedAt.Unix(), user.UpdatedAt.Unix())
+		INSERT INTO users (id, email, name, avatar_url, provider, role, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	`, user.ID, user.Email, user.Name, user.AvatarURL, user.Provider, user.Role, user.CreatedAt.Unix(), user.UpdatedAt.Unix())
 
 	return err
 }
 
-// GetUser retrieves a user by ID
-func (s *Store) GetUser(ctx context.Context, id string) (*User, error) {
-	var user User
-	var createdAt, updatedAt int64
+// CountUsers returns the number of registered users
+func (s *Store) CountUsers(ctx context.Context) (int, error) {
+	var count int
+	err := s.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM users").Scan(&count)
+	return count, err
+}
 
-	err := s.db.QueryRowContext(ctx, `
-		SELECT id, email, name, avatar_url, provider, created_at, updated_at
-		FROM users WHERE id = ?
-	`, id).Scan(&user.ID, &user.Email, &user.Name, &user.AvatarURL, &user.Provider, &createdAt, &updatedAt)
-	if err == sql.ErrNoRows {
-		return nil, fmt.Errorf("user not found")
+// SetUserPassword stores the bcrypt hash of a user's password
+func (s *Store) SetUserPassword(ctx context.Context, userID, passwordHash string) error {
+	_, err := s.db.ExecContext(ctx, `
+		UPDATE users SET password_hash = ?, updated_at = ? WHERE id = ?
+	`, passwordHash, time.Now().Unix(), userID)
+	return err
+}
+
+// CreateAuthSession records a sign-in or an issued API token, and forgets the user's expired
+// sessions
+func (s *Store) CreateAuthSession(ctx context.Context, session *AuthSession) error {
+	if session.ID == "" {
+		session.ID = uuid.New().String()
 	}
-	if err != nil {
-		return nil, err
+	now := time.Now()
+	session.CreatedAt = now
+	session.LastSeenAt = now
+	if _, err := s.db.ExecContext(ctx, `DELETE FROM auth_sessions WHERE user_id = ? AND expires_at < ?`, session.UserID, now.Unix()); err != nil {
+		return err
 	}
-
-	user.CreatedAt = time.Unix(createdAt, 0)
-	user.UpdatedAt = time.Unix(updatedAt, 0)
-
-	return &user, nil
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO auth_sessions (id, user_id, name, scope, ip_address, user_agent, created_at, last_seen_at, expires_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, session.ID, session.UserID, session.Name, session.Scope, session.IPAddress, session.UserAgent,
+		now.Unix(), now.Unix(), session.ExpiresAt.Unix())
+	return err
 }
 
-// GetUserByEmail retrieves a user by Email
-func (s *Store) GetUserByEmail(ctx context.Context, email string) (*User, error) {
-	var user User
-	var createdAt, updatedAt int64
-
-	err := s.db.QueryRowContext(ctx, `
-		SELECT id, email, name, avatar_url, provider, created_at, updated_at
-		FROM users WHERE email = ?
-	`, email).Scan(&user.ID, &user.Email, &user.Name, &user.AvatarURL, &user.Provider, &createdAt, &updatedAt)
+// TouchAuthSession checks that a session of the user is still active and records where it was
+// last seen from. Requests within sessionTouchInterval of the last one only read.
+func (s *Store) TouchAuthSession(ctx context.Context, id, userID, ipAddress, userAgent string) error {
+	var lastSeenAt, expiresAt int64
+	err := s.db.QueryRowContext(ctx, `SELECT last_seen_at, expires_at FROM auth_sessions WHERE id = ? AND user_id = ?`, id, userID).
+		Scan(&lastSeenAt, &expiresAt)
 	if err == sql.ErrNoRows {
-		return nil, fmt.Errorf("user not found")
+		return fmt.Errorf("session not found")
 	}
 	if err != nil {
-		return nil, err
+		return err
 	}
-
-	user.CreatedAt = time.Unix(createdAt, 0)
-	user.UpdatedAt = time.Unix(updatedAt, 0)
-
-	return &user, nil
+	now := time.Now()
+	if now.Unix() > expiresAt {
+		return fmt.Errorf("session expired")
+	}
+	if now.Sub(time.Unix(lastSeenAt, 0)) < sessionTouchInterval {
+		return nil
+	}
+	_, err = s.db.ExecContext(ctx, `
+		UPDATE auth_sessions SET last_seen_at = ?, ip_address = ?, user_agent = ? WHERE id = ?
+	`, now.Unix(), ipAddress, userAgent, id)
+	return err
 }
 
-// Notebook operations
+// ListAuthSessions lists a user's active sessions and API tokens, most recently seen first
+func (s *Store) ListAuthSessions(ctx context.Context, userID string) ([]AuthSession, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT id, name, scope, ip_address, user_agent, created_at, last_seen_at, expires_at
+		FROM auth_sessions WHERE user_id = ? AND expires_at >= ? ORDER BY last_seen_at DESC
+	`, userID, time.Now().Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := make([]AuthSession, 0)
+	for rows.Next() {
+		session := AuthSession{UserID: userID}
+		var createdAt, lastSeenAt, expiresAt int64
+		if err := rows.Scan(&session.ID, &session.Name, &session.Scope, &session.IPAddress, &session.UserAgent,
+			&createdAt, &lastSeenAt, &expiresAt); err != nil {
+			return nil, err
+		}
+		session.CreatedAt = time.Unix(createdAt, 0)
+		session.LastSeenAt = time.Unix(lastSeenAt, 0)
+		session.ExpiresAt = time.Unix(expiresAt, 0)
+		sessions = append(sessions, session)
+	}
+	return sessions, rows.Err()
+}
+
+// DeleteAuthSession revokes a session or API token of a user
+func (s *Store) DeleteAuthSession(ctx context.Context, userID, id string) error {
+	result, err := s.db.ExecContext(ctx, `DELETE FROM auth_sessions WHERE id = ? AND user_id = ?`, id, userID)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return fmt.Errorf("session not found")
+	}
+	return nil
+}
+
+// DeleteOtherAuthSessions revokes all of a user's sessions and API tokens but one, and returns
+// how many it revoked
+func (s *Store) DeleteOtherAuthSessions(ctx context.Context, userID, keepID string) (int, error) {
+	result, err := s.db.ExecContext(ctx, `DELETE FROM auth_sessions WHERE user_id = ? AND id != ?`, userID, keepID)
+	if err != nil {
+		return 0, err
+	}
+	n, _ := result.RowsAffected()
+	return int(n), nil
+}
+
+// LinkUserIdentity links an OAuth identity to a user, who can then sign in with it. A user has
+// at most one identity of each provider.
+func (s *Store) LinkUserIdentity(ctx context.Context, identity *UserIdentity) error {
+	now := time.Now()
+	identity.CreatedAt = now
+	identity.LastUsedAt = now
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO user_identities (provider, subject, user_id, email, name, created_at, last_used_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`, identity.Provider, identity.Subject, identity.UserID, identity.Email, identity.Name, now.Unix(), now.Unix()); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM unlinked_identities WHERE provider = ? AND subject = ?`, identity.Provider, identity.Subject); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// GetUserIdentity retrieves the identity a provider knows a person by
+func (s *Store) GetUserIdentity(ctx context.Context, provider, subject string) (*UserIdentity, error) {
+	identity := UserIdentity{Provider: provider, Subject: subject}
+	var createdAt, lastUsedAt int64
+	err := s.db.QueryRowContext(ctx, `
+		SELECT user_id, email, name, created_at, last_used_at FROM user_identities WHERE provider = ? AND subject = ?
+	`, provider, subject).Scan(&identity.UserID, &identity.Email, &identity.Name, &createdAt, &lastUsedAt)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("identity not found")
+	}
+	if err != nil {
+		return nil, err
+	}
+	identity.CreatedAt = time.Unix(createdAt, 0)
+	identity.LastUsedAt = time.Unix(lastUsedAt, 0)
+	return &identity, nil
+}
+
+// TouchUserIdentity records a sign-in with an identity and the email and name the provider
+// now has for it
+func (s *Store) TouchUserIdentity(ctx context.Context, identity *UserIdentity) error {
+	identity.LastUsedAt = time.Now()
+	_, err := s.db.ExecContext(ctx, `
+		UPDATE user_identities SET email = ?, name = ?, last_used_at = ? WHERE provider = ? AND subject = ?
+	`, identity.Email, identity.Name, identity.LastUsedAt.Unix(), identity.Provider, identity.Subject)
+	return err
+}
+
+// ListUserIdentities lists the identities linked to a user, oldest first
+func (s *Store) ListUserIdentities(ctx context.Context, userID string) ([]UserIdentity, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT provider, subject, email, name, created_at, last_used_at
+		FROM user_identities WHERE user_id = ? ORDER BY created_at, provider
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	identities := make([]UserIdentity, 0)
+	for rows.Next() {
+		identity := UserIdentity{UserID: userID}
+		var createdAt, lastUsedAt int64
+		if err := rows.Scan(&identity.Provider, &identity.Subject, &identity.Email, &identity.Name, &createdAt, &lastUsedAt); err != nil {
+			return nil, err
+		}
+		identity.CreatedAt = time.Unix(createdAt, 0)
+		identity.LastUsedAt = time.Unix(lastUsedAt, 0)
+		identities = append(identities, identity)
+	}
+	return identities, rows.Err()
+}
+
+// DeleteUserIdentity unlinks a user's identity of a provider. The identity is remembered as
+// unlinked, so that signing in with it doesn't link it again.
+func (s *Store) DeleteUserIdentity(ctx context.Context, userID, provider string) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var subject string
+	err = tx.QueryRowContext(ctx, `SELECT subject FROM user_identities WHERE user_id = ? AND provider = ?`, userID, provider).Scan(&subject)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("identity not found")
+	}
+	if err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `DELETE FROM user_identities WHERE provider = ? AND subject = ?`, provider, subject); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO unlinked_identities (provider, subject, user_id, unlinked_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT(provider, subject) DO UPDATE SET user_id = excluded.user_id, unlinked_at = excluded.unlinked_at
+	`, provider, subject, userID, time.Now().Unix()); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// IsIdentityUnlinked reports whether a user unlinked an identity and hasn't linked it since
+func (s *Store) IsIdentityUnlinked(ctx context.Context, provider, subject string) (bool, error) {
+	var n int
+	err := s.db.QueryRowContext(ctx, `
+		SELECT COUNT(*) FROM unlinked_identities WHERE provider = ? AND subject = ?
+	`, provider, subject).Scan(&n)
+	return n > 0, err
+}
+
+// GetUserPasswordHash retrieves a user and their password hash by email.
+// The hash is empty for accounts that only sign in through OAuth.
+func (s *Store) GetUserPasswordHash(ctx context.Context, email string) (*User, string, error) {
+	user, err := s.GetUserByEmail(ctx, email)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var passwordHash sql.NullString
+	if err := s.db.QueryRowContext(ctx, "SELECT password_hash FROM users WHERE id = ?", user.ID).Scan(&passwordHash); err != nil {
+		return nil, "", err
+	}
+
+	return user, passwordHash.String, nil
+}
+
+// GetUser retrieves a user by ID
+func (s *Store) GetUser(ctx context.Context, id string) (*User, error) {
+	var user User
+	var createdAt, updatedAt int64
+
+	err := s.db.QueryRowContext(ctx, `
+		SELECT id, email, name, avatar_url, provider, COALESCE(role, ''), created_at, updated_at
+		FROM users WHERE id = ?
+	`, id).Scan(&user.ID, &user.Email, &user.Name, &user.AvatarURL, &user.Provider, &user.Role, &createdAt, &updatedAt)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("user not found")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	user.CreatedAt = time.Unix(createdAt, 0)
+	user.UpdatedAt = time.Unix(updatedAt, 0)
+
+	return &user, nil
+}
+
+// GetUserByEmail retrieves a user by Email
+func (s *Store) GetUserByEmail(ctx context.Context, email string) (*User, error) {
+	var user User
+	var createdAt, updatedAt int64
+
+	err := s.db.QueryRowContext(ctx, `
+		SELECT id, email, name, avatar_url, provider, COALESCE(role, ''), created_at, updated_at
+		FROM users WHERE email = ?
+	`, email).Scan(&user.ID, &user.Email, &user.Name, &user.AvatarURL, &user.Provider, &user.Role, &createdAt, &updatedAt)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("user not found")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	user.CreatedAt = time.Unix(createdAt, 0)
+	user.UpdatedAt = time.Unix(updatedAt, 0)
+
+	return &user, nil
+}
+
+// Notebook operations
 
 // CreateNotebook creates a new notebook
 func (s *Store) CreateNotebook(ctx context.Context, userID, name, description string, metadata map[string]interface{}) (*Notebook, error) {
@@ -311,11 +1055,12 @@ func (s *Store) GetNotebook(ctx context.Context, id string) (*Notebook, error) {
 	var userID sql.NullString
 	var isPublic sql.NullInt64
 	var publicToken sql.NullString
+	var coverImage sql.NullString
 
 	err := s.db.QueryRowContext(ctx, `
-		SELECT id, user_id, name, description, is_public, public_token, created_at, updated_at, metadata
+		SELECT id, user_id, name, description, is_public, public_token, cover_image, created_at, updated_at, metadata
 		FROM notebooks WHERE id = ?
-	`, id).Scan(&nb.ID, &userID, &nb.Name, &nb.Description, &isPublic, &publicToken, &createdAt, &updatedAt, &metadataJSON)
+	`, id).Scan(&nb.ID, &userID, &nb.Name, &nb.Description, &isPublic, &publicToken, &coverImage, &createdAt, &updatedAt, &metadataJSON)
 	if err == sql.ErrNoRows {
 		return nil, fmt.Errorf("notebook not found")
 	}
@@ -331,6 +1076,7 @@ func (s *Store) GetNotebook(ctx context.Context, id string) (*Notebook, error) {
 	if publicToken.Valid {
 		nb.PublicToken = publicToken.String
 	}
+	nb.CoverImageURL = notebookCoverURL(coverImage)
 
 	nb.CreatedAt = time.Unix(createdAt, 0)
 	nb.UpdatedAt = time.Unix(updatedAt, 0)
@@ -347,7 +1093,7 @@ func (s *Store) GetNotebook(ctx context.Context, id string) (*Notebook, error) {
 // ListNotebooks retrieves all notebooks for a user
 func (s *Store) ListNotebooks(ctx context.Context, userID string) ([]Notebook, error) {
 	rows, err := s.db.QueryContext(ctx, `
-		SELECT id, user_id, name, description, is_public, public_token, created_at, updated_at, metadata
+		SELECT id, user_id, name, description, is_public, public_token, cover_image, created_at, updated_at, metadata
 		FROM notebooks
 		WHERE user_id = ?
 		ORDER BY updated_at DESC
@@ -365,8 +1111,9 @@ func (s *Store) ListNotebooks(ctx context.Context, userID string) ([]Notebook, e
 		var uid sql.NullString
 		var isPublic sql.NullInt64
 		var publicToken sql.NullString
+		var coverImage sql.NullString
 
-		if err := rows.Scan(&nb.ID, &uid, &nb.Name, &nb.Description, &isPublic, &publicToken, &createdAt, &updatedAt, &metadataJSON); err != nil {
+		if err := rows.Scan(&nb.ID, &uid, &nb.Name, &nb.Description, &isPublic, &publicToken, &coverImage, &createdAt, &updatedAt, &metadataJSON); err != nil {
 			return nil, err
 		}
 
@@ -378,6 +1125,7 @@ func (s *Store) ListNotebooks(ctx context.Context, userID string) ([]Notebook, e
 		if publicToken.Valid {
 			nb.PublicToken = publicToken.String
 		}
+		nb.CoverImageURL = notebookCoverURL(coverImage)
 
 		nb.CreatedAt = time.Unix(createdAt, 0)
 		nb.UpdatedAt = time.Unix(updatedAt, 0)
@@ -442,6 +1190,205 @@ func (s *Store) SetNotebookPublic(ctx context.Context, id string, isPublic bool)
 	return s.GetNotebook(ctx, id)
 }
 
+// GetSharePolicy returns what a notebook's public link exposes, the default policy if the
+// owner never set one
+func (s *Store) GetSharePolicy(ctx context.Context, notebookID string) (*SharePolicy, error) {
+	var policyJSON string
+	err := s.db.QueryRowContext(ctx, `SELECT policy FROM notebook_share_policies WHERE notebook_id = ?`, notebookID).Scan(&policyJSON)
+	if err == sql.ErrNoRows {
+		return DefaultSharePolicy(), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	policy := DefaultSharePolicy()
+	if err := json.Unmarshal([]byte(policyJSON), policy); err != nil {
+		return nil, fmt.Errorf("invalid share policy: %w", err)
+	}
+	return policy, nil
+}
+
+// SetSharePolicy stores what a notebook's public link exposes
+func (s *Store) SetSharePolicy(ctx context.Context, notebookID string, policy *SharePolicy) error {
+	policyJSON, _ := json.Marshal(policy)
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO notebook_share_policies (notebook_id, policy, updated_at) VALUES (?, ?, ?)
+		ON CONFLICT(notebook_id) DO UPDATE SET policy = excluded.policy, updated_at = excluded.updated_at
+	`, notebookID, string(policyJSON), time.Now().Unix())
+	return err
+}
+
+// GetLegalHold returns the legal hold of a notebook, nil if it has none
+func (s *Store) GetLegalHold(ctx context.Context, notebookID string) (*LegalHold, error) {
+	hold := &LegalHold{NotebookID: notebookID}
+	var createdAt int64
+	err := s.db.QueryRowContext(ctx, `SELECT reason, set_by, created_at FROM notebook_legal_holds WHERE notebook_id = ?`, notebookID).
+		Scan(&hold.Reason, &hold.SetBy, &createdAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	hold.CreatedAt = time.Unix(createdAt, 0)
+	return hold, nil
+}
+
+// ListLegalHolds lists the legal holds of all notebooks, newest first
+func (s *Store) ListLegalHolds(ctx context.Context) ([]LegalHold, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT notebook_id, reason, set_by, created_at FROM notebook_legal_holds ORDER BY created_at DESC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	holds := make([]LegalHold, 0)
+	for rows.Next() {
+		var hold LegalHold
+		var createdAt int64
+		if err := rows.Scan(&hold.NotebookID, &hold.Reason, &hold.SetBy, &createdAt); err != nil {
+			return nil, err
+		}
+		hold.CreatedAt = time.Unix(createdAt, 0)
+		holds = append(holds, hold)
+	}
+	return holds, rows.Err()
+}
+
+// SetLegalHold puts a notebook on legal hold, replacing the reason of an existing hold
+func (s *Store) SetLegalHold(ctx context.Context, hold *LegalHold) error {
+	if hold.CreatedAt.IsZero() {
+		hold.CreatedAt = time.Now()
+	}
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO notebook_legal_holds (notebook_id, reason, set_by, created_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT(notebook_id) DO UPDATE SET reason = excluded.reason, set_by = excluded.set_by
+	`, hold.NotebookID, hold.Reason, hold.SetBy, hold.CreatedAt.Unix())
+	return err
+}
+
+// ReleaseLegalHold lifts the legal hold of a notebook
+func (s *Store) ReleaseLegalHold(ctx context.Context, notebookID string) error {
+	result, err := s.db.ExecContext(ctx, `DELETE FROM notebook_legal_holds WHERE notebook_id = ?`, notebookID)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return fmt.Errorf("legal hold not found")
+	}
+	return nil
+}
+
+// GetChatSettings returns a notebook's chat defaults, empty if the owner never set them
+func (s *Store) GetChatSettings(ctx context.Context, notebookID string) (*ChatSettings, error) {
+	var settings ChatSettings
+	err := s.db.QueryRowContext(ctx, `
+		SELECT answer_style, top_k, score_threshold, max_context_chunks FROM notebook_chat_settings WHERE notebook_id = ?
+	`, notebookID).Scan(&settings.AnswerStyle, &settings.TopK, &settings.ScoreThreshold, &settings.MaxContextChunks)
+	if err == sql.ErrNoRows {
+		return &settings, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &settings, nil
+}
+
+// SetChatSettings stores a notebook's chat defaults
+func (s *Store) SetChatSettings(ctx context.Context, notebookID string, settings *ChatSettings) error {
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO notebook_chat_settings (notebook_id, answer_style, top_k, score_threshold, max_context_chunks, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT(notebook_id) DO UPDATE SET answer_style = excluded.answer_style, top_k = excluded.top_k,
+			score_threshold = excluded.score_threshold, max_context_chunks = excluded.max_context_chunks, updated_at = excluded.updated_at
+	`, notebookID, settings.AnswerStyle, settings.TopK, settings.ScoreThreshold, settings.MaxContextChunks, time.Now().Unix())
+	return err
+}
+
+// notebookCoverKey returns the blob storage key for a notebook cover image
+func notebookCoverKey(fileName string) string {
+	return "covers/" + fileName
+}
+
+// notebookCoverURL returns the /api/files URL for a stored cover image, or "" if there is none
+func notebookCoverURL(fileName sql.NullString) string {
+	if !fileName.Valid || fileName.String == "" {
+		return ""
+	}
+	return "/api/files/" + fileName.String
+}
+
+// SetNotebookCover stores a cover image for a notebook, replacing any previous cover.
+// ext is the file extension (including the dot) matching the image format.
+func (s *Store) SetNotebookCover(ctx context.Context, id, ext string, data []byte) (*Notebook, error) {
+	// A fresh name per upload also busts browser caches of the old cover
+	fileName := fmt.Sprintf("cover_%s_%s%s", id, uuid.New().String()[:8], ext)
+	if err := s.blobs.Put(ctx, notebookCoverKey(fileName), data); err != nil {
+		return nil, fmt.Errorf("failed to store cover image: %w", err)
+	}
+
+	if err := s.replaceNotebookCover(ctx, id, sql.NullString{String: fileName, Valid: true}); err != nil {
+		s.blobs.Delete(ctx, notebookCoverKey(fileName))
+		return nil, err
+	}
+	return s.GetNotebook(ctx, id)
+}
+
+// DeleteNotebookCover removes a notebook's cover image
+func (s *Store) DeleteNotebookCover(ctx context.Context, id string) (*Notebook, error) {
+	if err := s.replaceNotebookCover(ctx, id, sql.NullString{}); err != nil {
+		return nil, err
+	}
+	return s.GetNotebook(ctx, id)
+}
+
+// replaceNotebookCover points a notebook at a new cover file and deletes the previous blob
+func (s *Store) replaceNotebookCover(ctx context.Context, id string, fileName sql.NullString) error {
+	var previous sql.NullString
+	err := s.db.QueryRowContext(ctx, `SELECT cover_image FROM notebooks WHERE id = ?`, id).Scan(&previous)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("notebook not found")
+	}
+	if err != nil {
+		return err
+	}
+
+	if _, err := s.db.ExecContext(ctx, `
+		UPDATE notebooks SET cover_image = ?, updated_at = ? WHERE id = ?
+	`, fileName, time.Now().Unix(), id); err != nil {
+		return err
+	}
+
+	if previous.String != "" {
+		if err := s.blobs.Delete(ctx, notebookCoverKey(previous.String)); err != nil {
+			log.Printf("failed to delete cover blob %s: %v", previous.String, err)
+		}
+	}
+	return nil
+}
+
+// GetNotebookCover retrieves a cover image and the notebook it belongs to by file name
+func (s *Store) GetNotebookCover(ctx context.Context, fileName string) (*Notebook, []byte, error) {
+	var id string
+	err := s.db.QueryRowContext(ctx, `SELECT id FROM notebooks WHERE cover_image = ?`, fileName).Scan(&id)
+	if err == sql.ErrNoRows {
+		return nil, nil, fmt.Errorf("cover not found")
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	notebook, err := s.GetNotebook(ctx, id)
+	if err != nil {
+		return nil, nil, err
+	}
+	data, err := s.blobs.Get(ctx, notebookCoverKey(fileName))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read cover image: %w", err)
+	}
+	return notebook, data, nil
+}
+
 // GetNotebookByPublicToken retrieves a notebook by its public token
 func (s *Store) GetNotebookByPublicToken(ctx context.Context, token string) (*Notebook, error) {
 	var nb Notebook
@@ -450,11 +1397,12 @@ func (s *Store) GetNotebookByPublicToken(ctx context.Context, token string) (*No
 	var userID sql.NullString
 	var isPublic sql.NullInt64
 	var publicToken sql.NullString
+	var coverImage sql.NullString
 
 	err := s.db.QueryRowContext(ctx, `
-		SELECT id, user_id, name, description, is_public, public_token, created_at, updated_at, metadata
+		SELECT id, user_id, name, description, is_public, public_token, cover_image, created_at, updated_at, metadata
 		FROM notebooks WHERE public_token = ? AND is_public = 1
-	`, token).Scan(&nb.ID, &userID, &nb.Name, &nb.Description, &isPublic, &publicToken, &createdAt, &updatedAt, &metadataJSON)
+	`, token).Scan(&nb.ID, &userID, &nb.Name, &nb.Description, &isPublic, &publicToken, &coverImage, &createdAt, &updatedAt, &metadataJSON)
 	if err == sql.ErrNoRows {
 		return nil, fmt.Errorf("public notebook not found")
 	}
@@ -470,6 +1418,7 @@ func (s *Store) GetNotebookByPublicToken(ctx context.Context, token string) (*No
 	if publicToken.Valid {
 		nb.PublicToken = publicToken.String
 	}
+	nb.CoverImageURL = notebookCoverURL(coverImage)
 
 	nb.CreatedAt = time.Unix(createdAt, 0)
 	nb.UpdatedAt = time.Unix(updatedAt, 0)
@@ -485,15 +1434,40 @@ func (s *Store) GetNotebookByPublicToken(ctx context.Context, token string) (*No
 
 // DeleteNotebook deletes a notebook and all its data
 func (s *Store) DeleteNotebook(ctx context.Context, id string) error {
-	_, err := s.db.ExecContext(ctx, `DELETE FROM notebooks WHERE id = ?`, id)
-	return err
+	// Collect note blobs before the cascade removes their pointers
+	var blobKeys []string
+	rows, err := s.db.QueryContext(ctx, `SELECT content_blob FROM notes WHERE notebook_id = ? AND content_blob IS NOT NULL`, id)
+	if err == nil {
+		for rows.Next() {
+			var key string
+			if rows.Scan(&key) == nil && key != "" {
+				blobKeys = append(blobKeys, key)
+			}
+		}
+		rows.Close()
+	}
+	var coverImage sql.NullString
+	if s.db.QueryRowContext(ctx, `SELECT cover_image FROM notebooks WHERE id = ?`, id).Scan(&coverImage) == nil && coverImage.String != "" {
+		blobKeys = append(blobKeys, notebookCoverKey(coverImage.String))
+	}
+
+	if _, err := s.db.ExecContext(ctx, `DELETE FROM notebooks WHERE id = ?`, id); err != nil {
+		return err
+	}
+
+	for _, key := range blobKeys {
+		if err := s.blobs.Delete(ctx, key); err != nil {
+			log.Printf("failed to delete note blob %s: %v", key, err)
+		}
+	}
+	return nil
 }
 
 // ListNotebooksWithStats retrieves all notebooks with their source and note counts for a user
 func (s *Store) ListNotebooksWithStats(ctx context.Context, userID string) ([]NotebookWithStats, error) {
 	query := `
 		SELECT
-			n.id, n.user_id, n.name, n.description, n.is_public, n.public_token, n.created_at, n.updated_at, n.metadata,
+			n.id, n.user_id, n.name, n.description, n.is_public, n.public_token, n.cover_image, n.created_at, n.updated_at, n.metadata,
 			COALESCE((SELECT COUNT(*) FROM sources WHERE notebook_id = n.id), 0) as source_count,
 			COALESCE((SELECT COUNT(*) FROM notes WHERE notebook_id = n.id), 0) as note_count
 		FROM notebooks n
@@ -515,8 +1489,9 @@ func (s *Store) ListNotebooksWithStats(ctx context.Context, userID string) ([]No
 		var uid sql.NullString
 		var isPublic sql.NullInt64
 		var publicToken sql.NullString
+		var coverImage sql.NullString
 
-		if err := rows.Scan(&nb.ID, &uid, &nb.Name, &nb.Description, &isPublic, &publicToken, &createdAt, &updatedAt, &metadataJSON, &nb.SourceCount, &nb.NoteCount); err != nil {
+		if err := rows.Scan(&nb.ID, &uid, &nb.Name, &nb.Description, &isPublic, &publicToken, &coverImage, &createdAt, &updatedAt, &metadataJSON, &nb.SourceCount, &nb.NoteCount); err != nil {
 			return nil, err
 		}
 
@@ -528,6 +1503,7 @@ func (s *Store) ListNotebooksWithStats(ctx context.Context, userID string) ([]No
 		if publicToken.Valid {
 			nb.PublicToken = publicToken.String
 		}
+		nb.CoverImageURL = notebookCoverURL(coverImage)
 
 		nb.CreatedAt = time.Unix(createdAt, 0)
 		nb.UpdatedAt = time.Unix(updatedAt, 0)
@@ -548,13 +1524,13 @@ func (s *Store) ListNotebooksWithStats(ctx context.Context, userID string) ([]No
 func (s *Store) ListPublicNotebooks(ctx context.Context) ([]NotebookWithStats, error) {
 	query := `
 		SELECT DISTINCT
-			n.id, n.user_id, n.name, n.description, n.is_public, n.public_token, n.created_at, n.updated_at, n.metadata,
-			COALESCE((SELECT COUNT(*) FROM sources WHERE notebook_id = n.id), 0) as source_count,
-			COALESCE((SELECT COUNT(*) FROM notes WHERE notebook_id = n.id), 0) as note_count,
+			n.id, n.user_id, n.name, n.description, n.is_public, n.public_token, n.cover_image, n.created_at, n.updated_at, n.metadata,
+			COALESCE((SELECT COUNT(*) FROM sources WHERE notebook_id = n.id AND private = 0), 0) as source_count,
+			COALESCE((SELECT COUNT(*) FROM notes WHERE notebook_id = n.id AND private = 0), 0) as note_count,
 			(
 				SELECT json_extract(notes.metadata, '$.image_url')
 				FROM notes
-				WHERE notes.notebook_id = n.id AND notes.type = 'infograph'
+				WHERE notes.notebook_id = n.id AND notes.type = 'infograph' AND notes.private = 0
 					AND json_extract(notes.metadata, '$.image_url') IS NOT NULL
 				ORDER BY notes.created_at DESC
 				LIMIT 1
@@ -562,7 +1538,7 @@ func (s *Store) ListPublicNotebooks(ctx context.Context) ([]NotebookWithStats, e
 			(
 				SELECT json_extract(notes.metadata, '$.slides[0]')
 				FROM notes
-				WHERE notes.notebook_id = n.id AND notes.type = 'ppt'
+				WHERE notes.notebook_id = n.id AND notes.type = 'ppt' AND notes.private = 0
 					AND json_extract(notes.metadata, '$.slides') IS NOT NULL
 					AND json_array_length(json_extract(notes.metadata, '$.slides')) > 0
 				ORDER BY notes.created_at DESC
@@ -572,6 +1548,7 @@ func (s *Store) ListPublicNotebooks(ctx context.Context) ([]NotebookWithStats, e
 			INNER JOIN notes notes ON notes.notebook_id = n.id
 		WHERE n.is_public = 1
 			AND notes.type IN ('infograph', 'ppt')
+			AND notes.private = 0
 		ORDER BY n.updated_at DESC
 		LIMIT 20
 	`
@@ -590,10 +1567,11 @@ func (s *Store) ListPublicNotebooks(ctx context.Context) ([]NotebookWithStats, e
 		var uid sql.NullString
 		var isPublic sql.NullInt64
 		var publicToken sql.NullString
+		var coverImage sql.NullString
 		var coverImageURL sql.NullString
 		var pptFirstSlide sql.NullString
 
-		if err := rows.Scan(&nb.ID, &uid, &nb.Name, &nb.Description, &isPublic, &publicToken, &createdAt, &updatedAt, &metadataJSON, &nb.SourceCount, &nb.NoteCount, &coverImageURL, &pptFirstSlide); err != nil {
+		if err := rows.Scan(&nb.ID, &uid, &nb.Name, &nb.Description, &isPublic, &publicToken, &coverImage, &createdAt, &updatedAt, &metadataJSON, &nb.SourceCount, &nb.NoteCount, &coverImageURL, &pptFirstSlide); err != nil {
 			return nil, err
 		}
 
@@ -609,8 +1587,10 @@ func (s *Store) ListPublicNotebooks(ctx context.Context) ([]NotebookWithStats, e
 		nb.CreatedAt = time.Unix(createdAt, 0)
 		nb.UpdatedAt = time.Unix(updatedAt, 0)
 
-		// Use infograph image URL first, then PPT first slide
-		if coverImageURL.Valid && coverImageURL.String != "" {
+		// Use the notebook's own cover first, then infograph image URL, then PPT first slide
+		if cover := notebookCoverURL(coverImage); cover != "" {
+			nb.CoverImageURL = cover
+		} else if coverImageURL.Valid && coverImageURL.String != "" {
 			// Convert to web path (authenticated API)
 			fileName := filepath.Base(coverImageURL.String)
 			nb.CoverImageURL = "/api/files/" + fileName
@@ -647,10 +1627,10 @@ func (s *Store) CreateSource(ctx context.Context, source *Source) error {
 	metadataJSON, _ := json.Marshal(source.Metadata)
 
 	_, err := s.db.ExecContext(ctx, `
-		INSERT INTO sources (id, notebook_id, name, type, url, content, file_name, file_size, chunk_count, created_at, updated_at, metadata)
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+		INSERT INTO sources (id, notebook_id, name, type, url, content, file_name, file_size, chunk_count, created_at, updated_at, metadata, private)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
 	`, source.ID, source.NotebookID, source.Name, source.Type, source.URL, source.Content,
-		source.FileName, source.FileSize, source.ChunkCount, now.Unix(), now.Unix(), string(metadataJSON))
+		source.FileName, source.FileSize, source.ChunkCount, now.Unix(), now.Unix(), string(metadataJSON), source.Private)
 
 	return err
 }
@@ -662,10 +1642,10 @@ func (s *Store) GetSource(ctx context.Context, id string) (*Source, error) {
 	var createdAt, updatedAt int64
 
 	err := s.db.QueryRowContext(ctx, `
-		SELECT id, notebook_id, name, type, url, content, file_name, file_size, chunk_count, created_at, updated_at, metadata
+		SELECT id, notebook_id, name, type, url, content, file_name, file_size, chunk_count, created_at, updated_at, metadata, private
 		FROM sources WHERE id = ?
 	`, id).Scan(&src.ID, &src.NotebookID, &src.Name, &src.Type, &src.URL, &src.Content,
-		&src.FileName, &src.FileSize, &src.ChunkCount, &createdAt, &updatedAt, &metadataJSON)
+		&src.FileName, &src.FileSize, &src.ChunkCount, &createdAt, &updatedAt, &metadataJSON, &src.Private)
 	if err == sql.ErrNoRows {
 		return nil, fmt.Errorf("source not found")
 	}
@@ -685,6 +1665,28 @@ func (s *Store) GetSource(ctx context.Context, id string) (*Source, error) {
 	return &src, nil
 }
 
+// FindSourceByMetadata returns the most recent source of a notebook whose metadata has all the
+// given values, or nil if there is none
+func (s *Store) FindSourceByMetadata(ctx context.Context, notebookID string, fields map[string]string) (*Source, error) {
+	query := `SELECT id FROM sources WHERE notebook_id = ?`
+	args := []interface{}{notebookID}
+	for key, value := range fields {
+		query += ` AND json_extract(metadata, ?) = ?`
+		args = append(args, "$."+key, value)
+	}
+	query += ` ORDER BY created_at DESC LIMIT 1`
+
+	var id string
+	err := s.db.QueryRowContext(ctx, query, args...).Scan(&id)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s.GetSource(ctx, id)
+}
+
 // GetSourceByFileName finds a source by its filename and returns the source with its notebook info
 func (s *Store) GetSourceByFileName(ctx context.Context, filename string) (*Source, *Notebook, error) {
 	var src Source
@@ -692,11 +1694,13 @@ func (s *Store) GetSourceByFileName(ctx context.Context, filename string) (*Sour
 	var metadataJSON string
 	var notebookMetadataJSON string
 	var createdAt, updatedAt, notebookCreatedAt, notebookUpdatedAt int64
+	// public_token is NULL until the notebook is shared
+	var notebookPublicToken sql.NullString
 
 	err := s.db.QueryRowContext(ctx, `
 		SELECT
 			s.id, s.notebook_id, s.name, s.type, s.url, s.content, s.file_name, s.file_size, s.chunk_count,
-			s.created_at, s.updated_at, s.metadata,
+			s.created_at, s.updated_at, s.metadata, s.private,
 			n.id as nb_id, n.user_id as nb_user_id, n.name as nb_name, n.description as nb_description,
 			n.is_public as nb_is_public, n.public_token as nb_public_token,
 			n.created_at as nb_created_at, n.updated_at as nb_updated_at, n.metadata as nb_metadata
@@ -705,9 +1709,9 @@ func (s *Store) GetSourceByFileName(ctx context.Context, filename string) (*Sour
 		WHERE s.file_name = ?
 	`, filename).Scan(
 		&src.ID, &src.NotebookID, &src.Name, &src.Type, &src.URL, &src.Content,
-		&src.FileName, &src.FileSize, &src.ChunkCount, &createdAt, &updatedAt, &metadataJSON,
+		&src.FileName, &src.FileSize, &src.ChunkCount, &createdAt, &updatedAt, &metadataJSON, &src.Private,
 		&notebook.ID, &notebook.UserID, &notebook.Name, &notebook.Description,
-		&notebook.IsPublic, &notebook.PublicToken,
+		&notebook.IsPublic, &notebookPublicToken,
 		&notebookCreatedAt, &notebookUpdatedAt, &notebookMetadataJSON,
 	)
 
@@ -717,6 +1721,7 @@ func (s *Store) GetSourceByFileName(ctx context.Context, filename string) (*Sour
 	if err != nil {
 		return nil, nil, err
 	}
+	notebook.PublicToken = notebookPublicToken.String
 
 	src.CreatedAt = time.Unix(createdAt, 0)
 	src.UpdatedAt = time.Unix(updatedAt, 0)
@@ -742,7 +1747,7 @@ func (s *Store) GetSourceByFileName(ctx context.Context, filename string) (*Sour
 // ListSources retrieves all sources for a notebook
 func (s *Store) ListSources(ctx context.Context, notebookID string) ([]Source, error) {
 	rows, err := s.db.QueryContext(ctx, `
-		SELECT id, notebook_id, name, type, url, content, file_name, file_size, chunk_count, created_at, updated_at, metadata
+		SELECT id, notebook_id, name, type, url, content, file_name, file_size, chunk_count, created_at, updated_at, metadata, private
 		FROM sources WHERE notebook_id = ? ORDER BY created_at DESC
 	`, notebookID)
 	if err != nil {
@@ -757,7 +1762,7 @@ func (s *Store) ListSources(ctx context.Context, notebookID string) ([]Source, e
 		var createdAt, updatedAt int64
 
 		if err := rows.Scan(&src.ID, &src.NotebookID, &src.Name, &src.Type, &src.URL, &src.Content,
-			&src.FileName, &src.FileSize, &src.ChunkCount, &createdAt, &updatedAt, &metadataJSON); err != nil {
+			&src.FileName, &src.FileSize, &src.ChunkCount, &createdAt, &updatedAt, &metadataJSON, &src.Private); err != nil {
 			return nil, err
 		}
 
@@ -782,454 +1787,2746 @@ func (s *Store) DeleteSource(ctx context.Context, id string) error {
 	return err
 }
 
-// UpdateSourceChunkCount updates the chunk count for a source
-func (s *Store) UpdateSourceChunkCount(ctx context.Context, id string, chunkCount int) error {
-	_, err := s.db.ExecContext(ctx, `UPDATE sources SET chunk_count = ? WHERE id = ?`, chunkCount, id)
-	return err
-}
-
-// Note operations
+// RestoreSource inserts a deleted source again with its ID, timestamps and versions
+func (s *Store) RestoreSource(ctx context.Context, source *Source, versions []SourceVersion) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
 
-// CreateNote creates a new note
-func (s *Store) CreateNote(ctx context.Context, note *Note) error {
-	note.ID = uuid.New().String()
+	metadataJSON, _ := json.Marshal(source.Metadata)
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO sources (id, notebook_id, name, type, url, content, file_name, file_size, chunk_count, created_at, updated_at, metadata, private)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, source.ID, source.NotebookID, source.Name, source.Type, source.URL, source.Content,
+		source.FileName, source.FileSize, source.ChunkCount, source.CreatedAt.Unix(), source.UpdatedAt.Unix(), string(metadataJSON), source.Private); err != nil {
+		return err
+	}
+	for _, v := range versions {
+		if _, err := tx.ExecContext(ctx, `
+			INSERT INTO source_versions (id, source_id, version, content, file_name, file_size, created_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?)
+		`, v.ID, source.ID, v.Version, v.Content, v.FileName, v.FileSize, v.CreatedAt.Unix()); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// UpdateSourceMetadata saves a source's metadata
+func (s *Store) UpdateSourceMetadata(ctx context.Context, source *Source) error {
+	metadataJSON, _ := json.Marshal(source.Metadata)
+	_, err := s.db.ExecContext(ctx, `UPDATE sources SET metadata = ? WHERE id = ?`, string(metadataJSON), source.ID)
+	return err
+}
+
+// SetSourcePrivate marks a source as visible to the notebook's owner only, or visible again
+func (s *Store) SetSourcePrivate(ctx context.Context, id string, private bool) (*Source, error) {
+	result, err := s.db.ExecContext(ctx, `UPDATE sources SET private = ? WHERE id = ?`, private, id)
+	if err != nil {
+		return nil, err
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return nil, fmt.Errorf("source not found")
+	}
+	return s.GetSource(ctx, id)
+}
+
+// ListPrivateSourceIDs returns the IDs of a notebook's private sources
+func (s *Store) ListPrivateSourceIDs(ctx context.Context, notebookID string) (map[string]bool, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT id FROM sources WHERE notebook_id = ? AND private = 1`, notebookID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := make(map[string]bool)
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids[id] = true
+	}
+	return ids, rows.Err()
+}
+
+// UpdateSourceChunkCount updates the chunk count for a source
+func (s *Store) UpdateSourceChunkCount(ctx context.Context, id string, chunkCount int) error {
+	_, err := s.db.ExecContext(ctx, `UPDATE sources SET chunk_count = ? WHERE id = ?`, chunkCount, id)
+	return err
+}
+
+// ListSourcesByType lists the sources of a type across all notebooks, oldest first
+func (s *Store) ListSourcesByType(ctx context.Context, sourceType string) ([]Source, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT id, notebook_id, name, type, url, content, file_name, file_size, chunk_count, created_at, updated_at, metadata, private
+		FROM sources WHERE type = ? ORDER BY created_at
+	`, sourceType)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sources := make([]Source, 0)
+	for rows.Next() {
+		var src Source
+		var metadataJSON string
+		var createdAt, updatedAt int64
+		if err := rows.Scan(&src.ID, &src.NotebookID, &src.Name, &src.Type, &src.URL, &src.Content,
+			&src.FileName, &src.FileSize, &src.ChunkCount, &createdAt, &updatedAt, &metadataJSON, &src.Private); err != nil {
+			return nil, err
+		}
+		src.CreatedAt = time.Unix(createdAt, 0)
+		src.UpdatedAt = time.Unix(updatedAt, 0)
+		if metadataJSON != "" {
+			json.Unmarshal([]byte(metadataJSON), &src.Metadata)
+		}
+		sources = append(sources, src)
+	}
+	return sources, rows.Err()
+}
+
+// Source health operations
+
+// SaveSourceHealth records the latest health check of a source
+func (s *Store) SaveSourceHealth(ctx context.Context, sourceID string, health *SourceHealth) error {
+	var similarity sql.NullFloat64
+	if health.Similarity != nil {
+		similarity = sql.NullFloat64{Float64: *health.Similarity, Valid: true}
+	}
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO source_health (source_id, status, http_status, similarity, error, failures, checked_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+		ON CONFLICT(source_id) DO UPDATE SET status = excluded.status, http_status = excluded.http_status,
+			similarity = excluded.similarity, error = excluded.error, failures = excluded.failures, checked_at = excluded.checked_at
+	`, sourceID, health.Status, health.HTTPStatus, similarity, health.Error, health.Failures, health.CheckedAt.Unix())
+	return err
+}
+
+// scanSourceHealth scans the health columns of a source_health row after its source ID
+func scanSourceHealth(row interface{ Scan(...any) error }, sourceID *string) (*SourceHealth, error) {
+	var health SourceHealth
+	var httpStatus sql.NullInt64
+	var similarity sql.NullFloat64
+	var errorText sql.NullString
+	var checkedAt int64
+	if err := row.Scan(sourceID, &health.Status, &httpStatus, &similarity, &errorText, &health.Failures, &checkedAt); err != nil {
+		return nil, err
+	}
+	health.HTTPStatus = int(httpStatus.Int64)
+	if similarity.Valid {
+		health.Similarity = &similarity.Float64
+	}
+	health.Error = errorText.String
+	health.CheckedAt = time.Unix(checkedAt, 0)
+	return &health, nil
+}
+
+// GetSourceHealth returns the latest health check of a source, nil if it was never checked
+func (s *Store) GetSourceHealth(ctx context.Context, sourceID string) (*SourceHealth, error) {
+	row := s.db.QueryRowContext(ctx, `
+		SELECT source_id, status, http_status, similarity, error, failures, checked_at FROM source_health WHERE source_id = ?
+	`, sourceID)
+	var id string
+	health, err := scanSourceHealth(row, &id)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return health, err
+}
+
+// ListSourceHealth returns the latest health checks of a notebook's sources, keyed by source ID
+func (s *Store) ListSourceHealth(ctx context.Context, notebookID string) (map[string]*SourceHealth, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT h.source_id, h.status, h.http_status, h.similarity, h.error, h.failures, h.checked_at
+		FROM source_health h
+		JOIN sources s ON s.id = h.source_id
+		WHERE s.notebook_id = ?
+	`, notebookID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	checks := make(map[string]*SourceHealth)
+	for rows.Next() {
+		var sourceID string
+		health, err := scanSourceHealth(rows, &sourceID)
+		if err != nil {
+			return nil, err
+		}
+		checks[sourceID] = health
+	}
+	return checks, rows.Err()
+}
+
+// SaveSourceDatabase stores the connection of a database source
+func (s *Store) SaveSourceDatabase(ctx context.Context, database *SourceDatabase) error {
+	tablesJSON, _ := json.Marshal(database.Tables)
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO source_databases (source_id, driver, dsn, tables) VALUES (?, ?, ?, ?)
+		ON CONFLICT(source_id) DO UPDATE SET driver = excluded.driver, dsn = excluded.dsn, tables = excluded.tables
+	`, database.SourceID, database.Driver, database.DSN, string(tablesJSON))
+	return err
+}
+
+// scanSourceDatabase scans a source_databases row joined with its source's name and content
+func scanSourceDatabase(row interface{ Scan(...any) error }) (*SourceDatabase, error) {
+	var database SourceDatabase
+	var tablesJSON string
+	if err := row.Scan(&database.SourceID, &database.Driver, &database.DSN, &tablesJSON, &database.SourceName, &database.Schema); err != nil {
+		return nil, err
+	}
+	json.Unmarshal([]byte(tablesJSON), &database.Tables)
+	return &database, nil
+}
+
+// GetSourceDatabase returns the connection of a database source, or nil if it has none
+func (s *Store) GetSourceDatabase(ctx context.Context, sourceID string) (*SourceDatabase, error) {
+	row := s.db.QueryRowContext(ctx, `
+		SELECT d.source_id, d.driver, d.dsn, d.tables, s.name, s.content
+		FROM source_databases d
+		JOIN sources s ON s.id = d.source_id
+		WHERE d.source_id = ?
+	`, sourceID)
+	database, err := scanSourceDatabase(row)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return database, err
+}
+
+// ListSourceDatabases returns the connections of a notebook's database sources, oldest first
+func (s *Store) ListSourceDatabases(ctx context.Context, notebookID string) ([]SourceDatabase, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT d.source_id, d.driver, d.dsn, d.tables, s.name, s.content
+		FROM source_databases d
+		JOIN sources s ON s.id = d.source_id
+		WHERE s.notebook_id = ?
+		ORDER BY s.created_at
+	`, notebookID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var databases []SourceDatabase
+	for rows.Next() {
+		database, err := scanSourceDatabase(rows)
+		if err != nil {
+			return nil, err
+		}
+		databases = append(databases, *database)
+	}
+	return databases, rows.Err()
+}
+
+// UpdateSource saves a source's fields after its content was fetched or extracted
+func (s *Store) UpdateSource(ctx context.Context, source *Source) error {
+	source.UpdatedAt = time.Now()
+	metadataJSON, _ := json.Marshal(source.Metadata)
+	result, err := s.db.ExecContext(ctx, `
+		UPDATE sources SET name = ?, type = ?, url = ?, content = ?, file_name = ?, file_size = ?, chunk_count = ?, metadata = ?, updated_at = ?
+		WHERE id = ?
+	`, source.Name, source.Type, source.URL, source.Content, source.FileName, source.FileSize, source.ChunkCount,
+		string(metadataJSON), source.UpdatedAt.Unix(), source.ID)
+	if err != nil {
+		return err
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return fmt.Errorf("source not found")
+	}
+	return nil
+}
+
+// Ingest job operations
+
+// CreateIngestJob records a new ingest job
+func (s *Store) CreateIngestJob(ctx context.Context, job *IngestJob) error {
+	job.ID = uuid.New().String()
+	job.CreatedAt = time.Now()
+	job.UpdatedAt = job.CreatedAt
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO ingest_jobs (id, source_id, notebook_id, user_id, kind, status, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	`, job.ID, job.SourceID, job.NotebookID, job.UserID, job.Kind, job.Status, job.CreatedAt.Unix(), job.UpdatedAt.Unix())
+	return err
+}
+
+const ingestJobColumns = `id, source_id, notebook_id, user_id, kind, status, stage, error, progress, total, created_at, updated_at`
+
+// scanIngestJob scans an ingest_jobs row selected with ingestJobColumns
+func scanIngestJob(row interface{ Scan(...any) error }) (*IngestJob, error) {
+	var job IngestJob
+	var stage, errorText sql.NullString
+	var createdAt, updatedAt int64
+	if err := row.Scan(&job.ID, &job.SourceID, &job.NotebookID, &job.UserID, &job.Kind, &job.Status,
+		&stage, &errorText, &job.Progress, &job.Total, &createdAt, &updatedAt); err != nil {
+		return nil, err
+	}
+	job.Stage = stage.String
+	job.Error = errorText.String
+	job.CreatedAt = time.Unix(createdAt, 0)
+	job.UpdatedAt = time.Unix(updatedAt, 0)
+	return &job, nil
+}
+
+// GetIngestJob retrieves an ingest job by ID
+func (s *Store) GetIngestJob(ctx context.Context, id string) (*IngestJob, error) {
+	job, err := scanIngestJob(s.db.QueryRowContext(ctx, `SELECT `+ingestJobColumns+` FROM ingest_jobs WHERE id = ?`, id))
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("ingest job not found")
+	}
+	return job, err
+}
+
+// ListActiveIngestJobs lists the ingest jobs that were queued or running when the server stopped
+func (s *Store) ListActiveIngestJobs(ctx context.Context) ([]IngestJob, error) {
+	return s.queryIngestJobs(ctx, `SELECT `+ingestJobColumns+` FROM ingest_jobs WHERE status IN (?, ?) ORDER BY created_at, rowid`,
+		IngestStatusQueued, IngestStatusRunning)
+}
+
+// ListLatestIngestJobs returns the latest ingest job of each source of a notebook, keyed by source ID
+func (s *Store) ListLatestIngestJobs(ctx context.Context, notebookID string) (map[string]*IngestJob, error) {
+	jobs, err := s.queryIngestJobs(ctx, `SELECT `+ingestJobColumns+` FROM ingest_jobs WHERE notebook_id = ? ORDER BY created_at, rowid`, notebookID)
+	if err != nil {
+		return nil, err
+	}
+	latest := make(map[string]*IngestJob, len(jobs))
+	for i := range jobs {
+		latest[jobs[i].SourceID] = &jobs[i]
+	}
+	return latest, nil
+}
+
+func (s *Store) queryIngestJobs(ctx context.Context, query string, args ...any) ([]IngestJob, error) {
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	jobs := make([]IngestJob, 0)
+	for rows.Next() {
+		job, err := scanIngestJob(rows)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, *job)
+	}
+	return jobs, rows.Err()
+}
+
+// SaveIngestJob stores the progress of an ingest job
+func (s *Store) SaveIngestJob(ctx context.Context, job *IngestJob) error {
+	job.UpdatedAt = time.Now()
+	result, err := s.db.ExecContext(ctx, `
+		UPDATE ingest_jobs SET status = ?, stage = ?, error = ?, progress = ?, total = ?, updated_at = ? WHERE id = ?
+	`, job.Status, job.Stage, job.Error, job.Progress, job.Total, job.UpdatedAt.Unix(), job.ID)
+	if err != nil {
+		return err
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return fmt.Errorf("ingest job not found")
+	}
+	return nil
+}
+
+// Transform job operations
+
+// CreateTransformJob records a new transform job
+func (s *Store) CreateTransformJob(ctx context.Context, job *TransformJob) error {
+	job.ID = uuid.New().String()
+	job.CreatedAt = time.Now()
+	job.UpdatedAt = job.CreatedAt
+
+	requestJSON, _ := json.Marshal(job.Request)
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO transform_jobs (id, notebook_id, user_id, request, status, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`, job.ID, job.NotebookID, job.UserID, string(requestJSON), job.Status, job.CreatedAt.Unix(), job.UpdatedAt.Unix())
+	return err
+}
+
+const transformJobColumns = `id, notebook_id, user_id, request, status, stage, note_id, error, created_at, updated_at`
+
+// scanTransformJob scans a transform_jobs row selected with transformJobColumns
+func scanTransformJob(row interface{ Scan(...any) error }) (*TransformJob, error) {
+	var job TransformJob
+	var requestJSON string
+	var stage, noteID, errorText sql.NullString
+	var createdAt, updatedAt int64
+	if err := row.Scan(&job.ID, &job.NotebookID, &job.UserID, &requestJSON, &job.Status,
+		&stage, &noteID, &errorText, &createdAt, &updatedAt); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(requestJSON), &job.Request); err != nil {
+		return nil, fmt.Errorf("invalid transform request: %w", err)
+	}
+	job.Stage = stage.String
+	job.NoteID = noteID.String
+	job.Error = errorText.String
+	job.CreatedAt = time.Unix(createdAt, 0)
+	job.UpdatedAt = time.Unix(updatedAt, 0)
+	return &job, nil
+}
+
+// GetTransformJob retrieves a transform job by ID
+func (s *Store) GetTransformJob(ctx context.Context, id string) (*TransformJob, error) {
+	job, err := scanTransformJob(s.db.QueryRowContext(ctx, `SELECT `+transformJobColumns+` FROM transform_jobs WHERE id = ?`, id))
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("transform job not found")
+	}
+	return job, err
+}
+
+// ListActiveTransformJobs lists the transform jobs that were queued or running when the server stopped
+func (s *Store) ListActiveTransformJobs(ctx context.Context) ([]TransformJob, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT `+transformJobColumns+` FROM transform_jobs WHERE status IN (?, ?) ORDER BY created_at, rowid`,
+		TransformStatusQueued, TransformStatusRunning)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	jobs := make([]TransformJob, 0)
+	for rows.Next() {
+		job, err := scanTransformJob(rows)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, *job)
+	}
+	return jobs, rows.Err()
+}
+
+// SaveTransformJob stores the progress of a transform job
+func (s *Store) SaveTransformJob(ctx context.Context, job *TransformJob) error {
+	job.UpdatedAt = time.Now()
+	result, err := s.db.ExecContext(ctx, `
+		UPDATE transform_jobs SET status = ?, stage = ?, note_id = NULLIF(?, ''), error = ?, updated_at = ? WHERE id = ?
+	`, job.Status, job.Stage, job.NoteID, job.Error, job.UpdatedAt.Unix(), job.ID)
+	if err != nil {
+		return err
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return fmt.Errorf("transform job not found")
+	}
+	return nil
+}
+
+// Source version operations
+
+// ReplaceSourceContent keeps the current content of a source as its next version and replaces it
+// with new content. The source is updated in place; its metadata is saved as is.
+func (s *Store) ReplaceSourceContent(ctx context.Context, source *Source, content, fileName string, fileSize int64) (*SourceVersion, error) {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	version := &SourceVersion{
+		ID:         uuid.New().String(),
+		SourceID:   source.ID,
+		ContentLen: utf8.RuneCountInString(source.Content),
+		FileName:   source.FileName,
+		FileSize:   source.FileSize,
+		CreatedAt:  time.Now(),
+	}
+	if err := tx.QueryRowContext(ctx, `
+		SELECT COALESCE(MAX(version), 0) + 1 FROM source_versions WHERE source_id = ?
+	`, source.ID).Scan(&version.Version); err != nil {
+		return nil, err
+	}
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO source_versions (id, source_id, version, content, file_name, file_size, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`, version.ID, source.ID, version.Version, source.Content, source.FileName, source.FileSize, version.CreatedAt.Unix()); err != nil {
+		return nil, err
+	}
+	metadataJSON, _ := json.Marshal(source.Metadata)
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE sources SET content = ?, file_name = ?, file_size = ?, metadata = ?, updated_at = ? WHERE id = ?
+	`, content, fileName, fileSize, string(metadataJSON), version.CreatedAt.Unix(), source.ID); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	source.Content = content
+	source.FileName = fileName
+	source.FileSize = fileSize
+	source.UpdatedAt = version.CreatedAt
+	return version, nil
+}
+
+// ListSourceVersions lists the previous versions of a source without their content, newest first
+func (s *Store) ListSourceVersions(ctx context.Context, sourceID string) ([]SourceVersion, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT id, source_id, version, LENGTH(content), file_name, file_size, created_at
+		FROM source_versions WHERE source_id = ? ORDER BY version DESC
+	`, sourceID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	versions := make([]SourceVersion, 0)
+	for rows.Next() {
+		var v SourceVersion
+		var contentLen sql.NullInt64
+		var fileName sql.NullString
+		var createdAt int64
+		if err := rows.Scan(&v.ID, &v.SourceID, &v.Version, &contentLen, &fileName, &v.FileSize, &createdAt); err != nil {
+			return nil, err
+		}
+		v.ContentLen = int(contentLen.Int64)
+		v.FileName = fileName.String
+		v.CreatedAt = time.Unix(createdAt, 0)
+		versions = append(versions, v)
+	}
+	return versions, rows.Err()
+}
+
+// PruneSourceVersions deletes all but the newest keep versions of a source
+func (s *Store) PruneSourceVersions(ctx context.Context, sourceID string, keep int) error {
+	_, err := s.db.ExecContext(ctx, `
+		DELETE FROM source_versions WHERE source_id = ? AND version NOT IN (
+			SELECT version FROM source_versions WHERE source_id = ? ORDER BY version DESC LIMIT ?
+		)
+	`, sourceID, sourceID, keep)
+	return err
+}
+
+// GetSourceVersion retrieves a previous version of a source with its content
+func (s *Store) GetSourceVersion(ctx context.Context, sourceID string, version int) (*SourceVersion, error) {
+	var v SourceVersion
+	var content, fileName sql.NullString
+	var createdAt int64
+	err := s.db.QueryRowContext(ctx, `
+		SELECT id, source_id, version, content, file_name, file_size, created_at
+		FROM source_versions WHERE source_id = ? AND version = ?
+	`, sourceID, version).Scan(&v.ID, &v.SourceID, &v.Version, &content, &fileName, &v.FileSize, &createdAt)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("source version not found")
+	}
+	if err != nil {
+		return nil, err
+	}
+	v.Content = content.String
+	v.ContentLen = utf8.RuneCountInString(v.Content)
+	v.FileName = fileName.String
+	v.CreatedAt = time.Unix(createdAt, 0)
+	return &v, nil
+}
+
+// Source summary layer operations
+
+// SaveSourceSummaries replaces the summary layer of a source. hash identifies the content and
+// chunking the summaries were written from.
+func (s *Store) SaveSourceSummaries(ctx context.Context, sourceID, hash string, nodes []SummaryNode) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM source_summaries WHERE source_id = ?`, sourceID); err != nil {
+		return err
+	}
+	for _, node := range nodes {
+		if _, err := tx.ExecContext(ctx, `
+			INSERT INTO source_summaries (source_id, layer, position, content_hash, first_chunk, last_chunk, start_offset, end_offset, content)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+		`, sourceID, node.Layer, node.Position, hash, node.FirstChunk, node.LastChunk, node.Start, node.End, node.Content); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// GetSourceSummaries returns the summary layer of a source if it was written from content with
+// this hash, or nil
+func (s *Store) GetSourceSummaries(ctx context.Context, sourceID, hash string) ([]SummaryNode, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT layer, position, first_chunk, last_chunk, start_offset, end_offset, content
+		FROM source_summaries WHERE source_id = ? AND content_hash = ?
+		ORDER BY layer, position
+	`, sourceID, hash)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var nodes []SummaryNode
+	for rows.Next() {
+		var node SummaryNode
+		if err := rows.Scan(&node.Layer, &node.Position, &node.FirstChunk, &node.LastChunk, &node.Start, &node.End, &node.Content); err != nil {
+			return nil, err
+		}
+		nodes = append(nodes, node)
+	}
+	return nodes, rows.Err()
+}
+
+// Source read state operations
+
+// MarkSourceRead records that a user has opened a source
+func (s *Store) MarkSourceRead(ctx context.Context, userID, sourceID string) error {
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO source_reads (user_id, source_id, read_at) VALUES (?, ?, ?)
+		ON CONFLICT(user_id, source_id) DO UPDATE SET read_at = excluded.read_at
+	`, userID, sourceID, time.Now().Unix())
+	return err
+}
+
+// MarkSourceUnread clears a user's read state for a source
+func (s *Store) MarkSourceUnread(ctx context.Context, userID, sourceID string) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM source_reads WHERE user_id = ? AND source_id = ?`, userID, sourceID)
+	return err
+}
+
+// ListSourceReads returns when the user last opened each source of a notebook, keyed by source ID
+func (s *Store) ListSourceReads(ctx context.Context, userID, notebookID string) (map[string]time.Time, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT r.source_id, r.read_at
+		FROM source_reads r
+		JOIN sources s ON s.id = r.source_id
+		WHERE r.user_id = ? AND s.notebook_id = ?
+	`, userID, notebookID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	reads := make(map[string]time.Time)
+	for rows.Next() {
+		var sourceID string
+		var readAt int64
+		if err := rows.Scan(&sourceID, &readAt); err != nil {
+			return nil, err
+		}
+		reads[sourceID] = time.Unix(readAt, 0)
+	}
+	return reads, rows.Err()
+}
+
+// Note operations
+
+// CreateNote creates a new note
+func (s *Store) CreateNote(ctx context.Context, note *Note) error {
+	note.ID = uuid.New().String()
+	now := time.Now()
+	note.CreatedAt = now
+	note.UpdatedAt = now
+
+	metadataJSON, _ := json.Marshal(note.Metadata)
+	sourceIDsJSON, _ := json.Marshal(note.SourceIDs)
+
+	inlineContent, blobKey, err := s.storeNoteContent(ctx, note.ID, note.Content)
+	if err != nil {
+		return err
+	}
+
+	_, err = s.db.ExecContext(ctx, `
+		INSERT INTO notes (id, notebook_id, title, content, type, source_ids, created_at, updated_at, metadata, content_blob, private)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, note.ID, note.NotebookID, note.Title, inlineContent, note.Type, string(sourceIDsJSON),
+		now.Unix(), now.Unix(), string(metadataJSON), blobKey, note.Private)
+	if err != nil || len(noteFileNames(note)) == 0 {
+		return err
+	}
+	return s.syncAssetRefs(ctx, s.db, note.ID)
+}
+
+// noteBlobKey returns the blob storage key for a note's content
+func noteBlobKey(noteID string) string {
+	return "notes/" + noteID + ".md"
+}
+
+// notePreviewLength is how many characters of a note stored in blob storage are kept inline,
+// for note lists to show
+const notePreviewLength = 500
+
+// storeNoteContent moves oversized note content into blob storage.
+// It returns the content to keep inline, a preview for content moved out, and the blob key
+// (NULL when stored inline).
+func (s *Store) storeNoteContent(ctx context.Context, noteID, content string) (string, sql.NullString, error) {
+	if s.noteInlineLimit <= 0 || len(content) <= s.noteInlineLimit {
+		return content, sql.NullString{}, nil
+	}
+
+	key := noteBlobKey(noteID)
+	if err := s.blobs.Put(ctx, key, []byte(content)); err != nil {
+		return "", sql.NullString{}, fmt.Errorf("failed to store note content: %w", err)
+	}
+	preview := []rune(content)
+	if len(preview) > notePreviewLength {
+		preview = preview[:notePreviewLength]
+	}
+	return string(preview), sql.NullString{String: key, Valid: true}, nil
+}
+
+// resolveNoteContent loads note content from blob storage when the row holds a pointer
+func (s *Store) resolveNoteContent(ctx context.Context, note *Note, blobKey sql.NullString) {
+	if !blobKey.Valid || blobKey.String == "" {
+		return
+	}
+	data, err := s.blobs.Get(ctx, blobKey.String)
+	if err != nil {
+		log.Printf("failed to load note blob %s: %v", blobKey.String, err)
+		return
+	}
+	note.Content = string(data)
+}
+
+// LoadNoteContent replaces the preview of a listed note stored in blob storage with its content
+func (s *Store) LoadNoteContent(ctx context.Context, note *Note) error {
+	if !note.ContentExternal {
+		return nil
+	}
+	data, err := s.blobs.Get(ctx, noteBlobKey(note.ID))
+	if err != nil {
+		return fmt.Errorf("failed to load note content: %w", err)
+	}
+	note.Content = string(data)
+	note.ContentExternal = false
+	return nil
+}
+
+// GetNote retrieves a note by ID
+func (s *Store) GetNote(ctx context.Context, id string) (*Note, error) {
+	var note Note
+	var metadataJSON, sourceIDsJSON string
+	var createdAt, updatedAt int64
+	var blobKey sql.NullString
+	var shareToken sql.NullString
+	var shareExpiresAt sql.NullInt64
+
+	err := s.db.QueryRowContext(ctx, `
+		SELECT id, notebook_id, title, content, type, source_ids, created_at, updated_at, metadata, content_blob,
+			share_token, share_expires_at, private
+		FROM notes WHERE id = ?
+	`, id).Scan(&note.ID, &note.NotebookID, &note.Title, &note.Content, &note.Type,
+		&sourceIDsJSON, &createdAt, &updatedAt, &metadataJSON, &blobKey, &shareToken, &shareExpiresAt, &note.Private)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("note not found")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	note.CreatedAt = time.Unix(createdAt, 0)
+	note.UpdatedAt = time.Unix(updatedAt, 0)
+
+	if metadataJSON != "" {
+		json.Unmarshal([]byte(metadataJSON), &note.Metadata)
+	} else {
+		note.Metadata = make(map[string]interface{})
+	}
+
+	if sourceIDsJSON != "" {
+		json.Unmarshal([]byte(sourceIDsJSON), &note.SourceIDs)
+	}
+
+	s.resolveNoteContent(ctx, &note, blobKey)
+	setNoteShare(&note, shareToken, shareExpiresAt)
+
+	return &note, nil
+}
+
+// ListNotes retrieves all notes for a notebook. Of notes stored in blob storage, it returns
+// a preview only, marked with ContentExternal; LoadNoteContent or GetNote reads them in full.
+func (s *Store) ListNotes(ctx context.Context, notebookID string) ([]Note, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT id, notebook_id, title, content, type, source_ids, created_at, updated_at, metadata, content_blob,
+			share_token, share_expires_at, private
+		FROM notes WHERE notebook_id = ? ORDER BY created_at DESC
+	`, notebookID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	notes := make([]Note, 0)
+	for rows.Next() {
+		var note Note
+		var metadataJSON, sourceIDsJSON string
+		var createdAt, updatedAt int64
+		var blobKey sql.NullString
+		var shareToken sql.NullString
+		var shareExpiresAt sql.NullInt64
+
+		if err := rows.Scan(&note.ID, &note.NotebookID, &note.Title, &note.Content, &note.Type,
+			&sourceIDsJSON, &createdAt, &updatedAt, &metadataJSON, &blobKey, &shareToken, &shareExpiresAt, &note.Private); err != nil {
+			return nil, err
+		}
+
+		// Lists keep the preview of content in blob storage; GetNote loads it in full
+		note.ContentExternal = blobKey.Valid && blobKey.String != ""
+		setNoteShare(&note, shareToken, shareExpiresAt)
+
+		note.CreatedAt = time.Unix(createdAt, 0)
+		note.UpdatedAt = time.Unix(updatedAt, 0)
+
+		if metadataJSON != "" {
+			json.Unmarshal([]byte(metadataJSON), &note.Metadata)
+		} else {
+			note.Metadata = make(map[string]interface{})
+		}
+
+		if sourceIDsJSON != "" {
+			json.Unmarshal([]byte(sourceIDsJSON), &note.SourceIDs)
+		}
+
+		notes = append(notes, note)
+	}
+
+	return notes, nil
+}
+
+// setNoteShare fills a note's sharing fields from their nullable columns
+func setNoteShare(note *Note, token sql.NullString, expiresAt sql.NullInt64) {
+	note.ShareToken = token.String
+	if expiresAt.Valid && expiresAt.Int64 > 0 {
+		t := time.Unix(expiresAt.Int64, 0)
+		note.ShareExpiresAt = &t
+	}
+}
+
+// SetNoteShare enables or disables the public sharing link of a single note.
+// Enabling always issues a new token, so previously shared links stop working.
+// A nil expiresAt means the link never expires.
+func (s *Store) SetNoteShare(ctx context.Context, id string, enabled bool, expiresAt *time.Time) (*Note, error) {
+	var token sql.NullString
+	var expires sql.NullInt64
+	if enabled {
+		token = sql.NullString{String: uuid.New().String(), Valid: true}
+		if expiresAt != nil {
+			expires = sql.NullInt64{Int64: expiresAt.Unix(), Valid: true}
+		}
+	}
+
+	result, err := s.db.ExecContext(ctx, `
+		UPDATE notes SET share_token = ?, share_expires_at = ? WHERE id = ?
+	`, token, expires, id)
+	if err != nil {
+		return nil, err
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return nil, fmt.Errorf("note not found")
+	}
+
+	return s.GetNote(ctx, id)
+}
+
+// SetNotePrivate marks a note as visible to the notebook's owner only, or visible again
+func (s *Store) SetNotePrivate(ctx context.Context, id string, private bool) (*Note, error) {
+	result, err := s.db.ExecContext(ctx, `UPDATE notes SET private = ? WHERE id = ?`, private, id)
+	if err != nil {
+		return nil, err
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return nil, fmt.Errorf("note not found")
+	}
+	return s.GetNote(ctx, id)
+}
+
+// ReviseNote replaces a note's title, content and metadata, keeping the current ones as a new
+// version. Content moves in or out of blob storage as its size requires.
+func (s *Store) ReviseNote(ctx context.Context, note *Note, title, content string, metadata map[string]interface{}) (*NoteVersion, error) {
+	var oldBlobKey sql.NullString
+	err := s.db.QueryRowContext(ctx, `SELECT content_blob FROM notes WHERE id = ?`, note.ID).Scan(&oldBlobKey)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("note not found")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	inlineContent, blobKey, err := s.storeNoteContent(ctx, note.ID, content)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	version := &NoteVersion{
+		ID:         uuid.New().String(),
+		NoteID:     note.ID,
+		Title:      note.Title,
+		ContentLen: utf8.RuneCountInString(note.Content),
+		CreatedAt:  time.Now(),
+	}
+	if err := tx.QueryRowContext(ctx, `
+		SELECT COALESCE(MAX(version), 0) + 1 FROM note_versions WHERE note_id = ?
+	`, note.ID).Scan(&version.Version); err != nil {
+		return nil, err
+	}
+	oldMetadataJSON, _ := json.Marshal(note.Metadata)
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO note_versions (id, note_id, version, title, content, metadata, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`, version.ID, note.ID, version.Version, note.Title, note.Content, string(oldMetadataJSON), version.CreatedAt.Unix()); err != nil {
+		return nil, err
+	}
+	metadataJSON, _ := json.Marshal(metadata)
+	if _, err := tx.ExecContext(ctx, `
+		UPDATE notes SET title = ?, content = ?, content_blob = ?, metadata = ?, updated_at = ? WHERE id = ?
+	`, title, inlineContent, blobKey, string(metadataJSON), version.CreatedAt.Unix(), note.ID); err != nil {
+		return nil, err
+	}
+	if err := s.syncAssetRefs(ctx, tx, note.ID); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+
+	// Content that shrank back under the inline limit leaves its old blob behind
+	if oldBlobKey.Valid && oldBlobKey.String != "" && !blobKey.Valid {
+		if err := s.blobs.Delete(ctx, oldBlobKey.String); err != nil {
+			log.Printf("failed to delete note blob %s: %v", oldBlobKey.String, err)
+		}
+	}
+
+	note.Title = title
+	note.Content = content
+	note.Metadata = metadata
+	note.UpdatedAt = version.CreatedAt
+	return version, nil
+}
+
+// ListNoteVersions lists the previous versions of a note without their content, newest first
+func (s *Store) ListNoteVersions(ctx context.Context, noteID string) ([]NoteVersion, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT id, note_id, version, title, LENGTH(content), created_at
+		FROM note_versions WHERE note_id = ? ORDER BY version DESC
+	`, noteID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	versions := make([]NoteVersion, 0)
+	for rows.Next() {
+		var v NoteVersion
+		var title sql.NullString
+		var contentLen sql.NullInt64
+		var createdAt int64
+		if err := rows.Scan(&v.ID, &v.NoteID, &v.Version, &title, &contentLen, &createdAt); err != nil {
+			return nil, err
+		}
+		v.Title = title.String
+		v.ContentLen = int(contentLen.Int64)
+		v.CreatedAt = time.Unix(createdAt, 0)
+		versions = append(versions, v)
+	}
+	return versions, rows.Err()
+}
+
+// PruneNoteVersions deletes all but the newest keep versions of a note, and the references of
+// the deleted versions to generated assets
+func (s *Store) PruneNoteVersions(ctx context.Context, noteID string, keep int) error {
+	result, err := s.db.ExecContext(ctx, `
+		DELETE FROM note_versions WHERE note_id = ? AND version NOT IN (
+			SELECT version FROM note_versions WHERE note_id = ? ORDER BY version DESC LIMIT ?
+		)
+	`, noteID, noteID, keep)
+	if err != nil {
+		return err
+	}
+	if pruned, _ := result.RowsAffected(); pruned == 0 {
+		return nil
+	}
+	return s.syncAssetRefs(ctx, s.db, noteID)
+}
+
+// GetNoteVersion retrieves a previous version of a note with its content and metadata
+func (s *Store) GetNoteVersion(ctx context.Context, noteID string, version int) (*NoteVersion, error) {
+	var v NoteVersion
+	var title, content, metadataJSON sql.NullString
+	var createdAt int64
+	err := s.db.QueryRowContext(ctx, `
+		SELECT id, note_id, version, title, content, metadata, created_at
+		FROM note_versions WHERE note_id = ? AND version = ?
+	`, noteID, version).Scan(&v.ID, &v.NoteID, &v.Version, &title, &content, &metadataJSON, &createdAt)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("note version not found")
+	}
+	if err != nil {
+		return nil, err
+	}
+	v.Title = title.String
+	v.Content = content.String
+	v.ContentLen = utf8.RuneCountInString(v.Content)
+	if metadataJSON.String != "" {
+		json.Unmarshal([]byte(metadataJSON.String), &v.Metadata)
+	}
+	v.CreatedAt = time.Unix(createdAt, 0)
+	return &v, nil
+}
+
+// GetNoteByShareToken retrieves a shared note and its notebook by share token, rejecting expired links
+func (s *Store) GetNoteByShareToken(ctx context.Context, token string) (*Note, *Notebook, error) {
+	var id string
+	err := s.db.QueryRowContext(ctx, `SELECT id FROM notes WHERE share_token = ?`, token).Scan(&id)
+	if err == sql.ErrNoRows {
+		return nil, nil, fmt.Errorf("shared note not found")
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	note, err := s.GetNote(ctx, id)
+	if err != nil {
+		return nil, nil, err
+	}
+	// A private note's link stops working until the note is made visible again
+	if note.Private || (note.ShareExpiresAt != nil && time.Now().After(*note.ShareExpiresAt)) {
+		return nil, nil, fmt.Errorf("shared note not found")
+	}
+
+	notebook, err := s.GetNotebook(ctx, note.NotebookID)
+	if err != nil {
+		return nil, nil, err
+	}
+	return note, notebook, nil
+}
+
+// noteFileNames returns the base names of files a note references (infograph image, PPT slides
+// and podcast audio)
+func noteFileNames(note *Note) []string {
+	var names []string
+
+	if imageURL, ok := note.Metadata["image_url"].(string); ok && imageURL != "" {
+		names = append(names, filepath.Base(imageURL))
+	}
+	if audioURL, ok := note.Metadata["audio_url"].(string); ok && audioURL != "" {
+		names = append(names, filepath.Base(audioURL))
+	}
+
+	switch slides := note.Metadata["slides"].(type) {
+	case []interface{}:
+		for _, slide := range slides {
+			if slideURL, ok := slide.(string); ok {
+				names = append(names, filepath.Base(slideURL))
+			}
+		}
+	case string:
+		// Slides may be stored as a JSON string (from SQLite)
+		var slideURLs []string
+		if err := json.Unmarshal([]byte(slides), &slideURLs); err == nil {
+			for _, slideURL := range slideURLs {
+				names = append(names, filepath.Base(slideURL))
+			}
+		}
+	}
+
+	return names
+}
+
+// GetNoteByFileName finds a note by its filename in metadata (image_url, slides or audio_url)
+// Returns the note with its notebook info. Generated assets are shared by the notes with the
+// same image, and named by its content in every owner's uploads, so the first note accept
+// takes is returned, else the first note found; accept may be nil.
+func (s *Store) GetNoteByFileName(ctx context.Context, filename string, accept func(*Note, *Notebook) bool) (*Note, *Notebook, error) {
+	log.Printf("DEBUG: GetNoteByFileName called for filename: %s", filename)
+
+	// Get all notes and search for the filename
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT
+			n.id, n.notebook_id, n.title, n.content, n.type, n.source_ids,
+			n.created_at, n.updated_at, n.metadata, n.private,
+			nb.id as nb_id, nb.user_id as nb_user_id, nb.name as nb_name, nb.description as nb_description,
+			nb.is_public as nb_is_public, nb.public_token as nb_public_token,
+			nb.created_at as nb_created_at, nb.updated_at as nb_updated_at, nb.metadata as nb_metadata
+		FROM notes n
+		INNER JOIN notebooks nb ON n.notebook_id = nb.id
+	`)
+	if err != nil {
+		log.Printf("DEBUG: Query error: %v", err)
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	noteCount := 0
+	var firstNote *Note
+	var firstNotebook *Notebook
+	for rows.Next() {
+		noteCount++
+
+		var note Note
+		var notebook Notebook
+		var metadataJSON, sourceIDsJSON, notebookMetadataJSON string
+		var createdAt, updatedAt, nbCreatedAt, nbUpdatedAt int64
+		var nbPublicToken sql.NullString
+
+		if err := rows.Scan(
+			&note.ID, &note.NotebookID, &note.Title, &note.Content, &note.Type, &sourceIDsJSON,
+			&createdAt, &updatedAt, &metadataJSON, &note.Private,
+			&notebook.ID, &notebook.UserID, &notebook.Name, &notebook.Description,
+			&notebook.IsPublic, &nbPublicToken,
+			&nbCreatedAt, &nbUpdatedAt, &notebookMetadataJSON,
+		); err != nil {
+			log.Printf("DEBUG: Scan error at row %d: %v", noteCount, err)
+			continue
+		}
+
+		// Convert NullString to string
+		if nbPublicToken.Valid {
+			notebook.PublicToken = nbPublicToken.String
+		} else {
+			notebook.PublicToken = ""
+		}
+
+		note.CreatedAt = time.Unix(createdAt, 0)
+		note.UpdatedAt = time.Unix(updatedAt, 0)
+		notebook.CreatedAt = time.Unix(nbCreatedAt, 0)
+		notebook.UpdatedAt = time.Unix(nbUpdatedAt, 0)
+
+		if metadataJSON != "" {
+			if err := json.Unmarshal([]byte(metadataJSON), &note.Metadata); err != nil {
+				log.Printf("Failed to unmarshal note metadata: %v, JSON: %s", err, metadataJSON)
+				note.Metadata = make(map[string]interface{})
+			}
+		} else {
+			note.Metadata = make(map[string]interface{})
+		}
+
+		if notebookMetadataJSON != "" {
+			if err := json.Unmarshal([]byte(notebookMetadataJSON), &notebook.Metadata); err != nil {
+				log.Printf("Failed to unmarshal notebook metadata: %v", err)
+				notebook.Metadata = make(map[string]interface{})
+			}
+		} else {
+			notebook.Metadata = make(map[string]interface{})
+		}
+
+		if sourceIDsJSON != "" {
+			json.Unmarshal([]byte(sourceIDsJSON), &note.SourceIDs)
+		}
+
+		// Debug: print metadata for infograph type notes
+		if note.Type == "infograph" {
+			log.Printf("DEBUG: Found infograph note %s, metadata: %+v", note.ID, note.Metadata)
+		}
+
+		// Check if filename is one of the note's generated images
+		for _, name := range noteFileNames(&note) {
+			if name != filename {
+				continue
+			}
+			log.Printf("Found file in note: %s, notebook: %s, public: %v", filename, notebook.ID, notebook.IsPublic)
+			if accept == nil || accept(&note, &notebook) {
+				return &note, &notebook, nil
+			}
+			if firstNote == nil {
+				firstNote, firstNotebook = &note, &notebook
+			}
+			break
+		}
+	}
+	if firstNote != nil {
+		return firstNote, firstNotebook, nil
+	}
+
+	log.Printf("DEBUG: Checked %d notes, file not found", noteCount)
+	return nil, nil, fmt.Errorf("note not found for filename")
+}
+
+// DeleteNote deletes a note and its content blob, if any
+func (s *Store) DeleteNote(ctx context.Context, id string) error {
+	var blobKey sql.NullString
+	err := s.db.QueryRowContext(ctx, `SELECT content_blob FROM notes WHERE id = ?`, id).Scan(&blobKey)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+
+	if _, err := s.db.ExecContext(ctx, `DELETE FROM notes WHERE id = ?`, id); err != nil {
+		return err
+	}
+
+	if blobKey.Valid && blobKey.String != "" {
+		if err := s.blobs.Delete(ctx, blobKey.String); err != nil {
+			log.Printf("failed to delete note blob %s: %v", blobKey.String, err)
+		}
+	}
+	return nil
+}
+
+// RestoreNote inserts a deleted note again with its ID, timestamps, sharing link and versions
+func (s *Store) RestoreNote(ctx context.Context, note *Note, versions []NoteVersion) error {
+	inlineContent, blobKey, err := s.storeNoteContent(ctx, note.ID, note.Content)
+	if err != nil {
+		return err
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	metadataJSON, _ := json.Marshal(note.Metadata)
+	sourceIDsJSON, _ := json.Marshal(note.SourceIDs)
+	var shareExpiresAt sql.NullInt64
+	if note.ShareExpiresAt != nil {
+		shareExpiresAt = sql.NullInt64{Int64: note.ShareExpiresAt.Unix(), Valid: true}
+	}
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO notes (id, notebook_id, title, content, type, source_ids, created_at, updated_at, metadata, content_blob,
+			share_token, share_expires_at, private)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, NULLIF(?, ''), ?, ?)
+	`, note.ID, note.NotebookID, note.Title, inlineContent, note.Type, string(sourceIDsJSON),
+		note.CreatedAt.Unix(), note.UpdatedAt.Unix(), string(metadataJSON), blobKey, note.ShareToken, shareExpiresAt, note.Private); err != nil {
+		return err
+	}
+	for _, v := range versions {
+		versionMetadataJSON, _ := json.Marshal(v.Metadata)
+		if _, err := tx.ExecContext(ctx, `
+			INSERT INTO note_versions (id, note_id, version, title, content, metadata, created_at)
+			VALUES (?, ?, ?, ?, ?, ?, ?)
+		`, v.ID, note.ID, v.Version, v.Title, v.Content, string(versionMetadataJSON), v.CreatedAt.Unix()); err != nil {
+			return err
+		}
+	}
+	if err := s.syncAssetRefs(ctx, tx, note.ID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// Generated assets
+
+// sqlRunner is a database or a transaction
+type sqlRunner interface {
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+}
+
+// RegisterAsset records a generated image stored under its content hash in the uploads of a
+// user. Registering an existing asset again restarts its grace period, as a note is about to
+// reference it.
+func (s *Store) RegisterAsset(ctx context.Context, asset *GeneratedAsset) error {
+	asset.CreatedAt = time.Now()
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO generated_assets (user_id, file_name, sha256, size, created_at) VALUES (?, ?, ?, ?, ?)
+		ON CONFLICT (user_id, file_name) DO UPDATE SET released_at = excluded.created_at
+	`, asset.UserID, asset.FileName, asset.SHA256, asset.Size, asset.CreatedAt.Unix())
+	return err
+}
+
+// syncAssetRefs records which generated assets a note references, in its metadata or in that of
+// its versions, which can be restored. Files that aren't registered assets are left out.
+func (s *Store) syncAssetRefs(ctx context.Context, db sqlRunner, noteID string) error {
+	rows, err := db.QueryContext(ctx, `
+		SELECT metadata FROM notes WHERE id = ?
+		UNION ALL SELECT metadata FROM note_versions WHERE note_id = ?
+	`, noteID, noteID)
+	if err != nil {
+		return err
+	}
+	names := make(map[string]bool)
+	for rows.Next() {
+		var metadataJSON sql.NullString
+		if err := rows.Scan(&metadataJSON); err != nil {
+			rows.Close()
+			return err
+		}
+		var metadata map[string]interface{}
+		if json.Unmarshal([]byte(metadataJSON.String), &metadata) == nil {
+			for _, name := range noteFileNames(&Note{Metadata: metadata}) {
+				names[name] = true
+			}
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	if _, err := db.ExecContext(ctx, `DELETE FROM generated_asset_refs WHERE note_id = ?`, noteID); err != nil {
+		return err
+	}
+	for name := range names {
+		if _, err := db.ExecContext(ctx, `
+			INSERT OR IGNORE INTO generated_asset_refs (note_id, user_id, file_name)
+			SELECT n.id, a.user_id, a.file_name FROM notes n
+			JOIN notebooks nb ON nb.id = n.notebook_id
+			JOIN generated_assets a ON a.user_id = nb.user_id AND a.file_name = ?
+			WHERE n.id = ?
+		`, name, noteID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// ListUnusedAssets lists the generated assets no note has referenced since before the given
+// time, with their reference counts of zero
+func (s *Store) ListUnusedAssets(ctx context.Context, before time.Time) ([]GeneratedAsset, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT user_id, file_name, sha256, size, created_at FROM generated_assets a
+		WHERE COALESCE(released_at, created_at) < ? AND NOT EXISTS (
+			SELECT 1 FROM generated_asset_refs r WHERE r.user_id = a.user_id AND r.file_name = a.file_name
+		)
+	`, before.Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var assets []GeneratedAsset
+	for rows.Next() {
+		var asset GeneratedAsset
+		var createdAt int64
+		if err := rows.Scan(&asset.UserID, &asset.FileName, &asset.SHA256, &asset.Size, &createdAt); err != nil {
+			return nil, err
+		}
+		asset.CreatedAt = time.Unix(createdAt, 0)
+		assets = append(assets, asset)
+	}
+	return assets, rows.Err()
+}
+
+// CountAssetRefs returns how many notes reference a generated asset
+func (s *Store) CountAssetRefs(ctx context.Context, userID, fileName string) (int, error) {
+	var count int
+	err := s.db.QueryRowContext(ctx, `
+		SELECT COUNT(*) FROM generated_asset_refs WHERE user_id = ? AND file_name = ?
+	`, userID, fileName).Scan(&count)
+	return count, err
+}
+
+// DeleteUnusedAsset forgets a generated asset, unless a note has referenced it in the meantime.
+// It reports whether the asset was deleted, and its file can go.
+func (s *Store) DeleteUnusedAsset(ctx context.Context, userID, fileName string) (bool, error) {
+	result, err := s.db.ExecContext(ctx, `
+		DELETE FROM generated_assets WHERE user_id = ? AND file_name = ? AND NOT EXISTS (
+			SELECT 1 FROM generated_asset_refs r WHERE r.user_id = generated_assets.user_id AND r.file_name = generated_assets.file_name
+		)
+	`, userID, fileName)
+	if err != nil {
+		return false, err
+	}
+	deleted, _ := result.RowsAffected()
+	return deleted > 0, nil
+}
+
+// Chat operations
+
+// CreateChatSession creates a new chat session
+func (s *Store) CreateChatSession(ctx context.Context, notebookID, title string) (*ChatSession, error) {
+	return s.createChatSession(ctx, notebookID, title, map[string]interface{}{})
+}
+
+// CreateNoteEditSession creates a chat session bound to a note, for the note's editing chat
+func (s *Store) CreateNoteEditSession(ctx context.Context, notebookID, noteID, title string) (*ChatSession, error) {
+	return s.createChatSession(ctx, notebookID, title, map[string]interface{}{"note_id": noteID})
+}
+
+func (s *Store) createChatSession(ctx context.Context, notebookID, title string, metadata map[string]interface{}) (*ChatSession, error) {
+	id := uuid.New().String()
+	now := time.Now()
+
+	if title == "" {
+		title = "New Chat"
+	}
+
+	metadataJSON, _ := json.Marshal(metadata)
+
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO chat_sessions (id, notebook_id, title, created_at, updated_at, metadata)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, id, notebookID, title, now.Unix(), now.Unix(), string(metadataJSON))
+	if err != nil {
+		return nil, err
+	}
+
+	return s.GetChatSession(ctx, id)
+}
+
+// GetChatSession retrieves a chat session by ID
+func (s *Store) GetChatSession(ctx context.Context, id string) (*ChatSession, error) {
+	var session ChatSession
+	var metadataJSON string
+	var createdAt, updatedAt int64
+
+	err := s.db.QueryRowContext(ctx, `
+		SELECT id, notebook_id, title, created_at, updated_at, metadata
+		FROM chat_sessions WHERE id = ?
+	`, id).Scan(&session.ID, &session.NotebookID, &session.Title, &createdAt, &updatedAt, &metadataJSON)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("chat session not found")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	session.CreatedAt = time.Unix(createdAt, 0)
+	session.UpdatedAt = time.Unix(updatedAt, 0)
+
+	if metadataJSON != "" {
+		json.Unmarshal([]byte(metadataJSON), &session.Metadata)
+	} else {
+		session.Metadata = make(map[string]interface{})
+	}
+
+	// Load messages
+	session.Messages, err = s.listChatMessages(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+
+	return &session, nil
+}
+
+// ListChatSessions retrieves all chat sessions for a notebook
+func (s *Store) ListChatSessions(ctx context.Context, notebookID string) ([]ChatSession, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT id, notebook_id, title, created_at, updated_at, metadata
+		FROM chat_sessions WHERE notebook_id = ? ORDER BY updated_at DESC
+	`, notebookID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	sessions := make([]ChatSession, 0)
+	for rows.Next() {
+		var session ChatSession
+		var metadataJSON string
+		var createdAt, updatedAt int64
+
+		if err := rows.Scan(&session.ID, &session.NotebookID, &session.Title, &createdAt, &updatedAt, &metadataJSON); err != nil {
+			return nil, err
+		}
+
+		session.CreatedAt = time.Unix(createdAt, 0)
+		session.UpdatedAt = time.Unix(updatedAt, 0)
+
+		if metadataJSON != "" {
+			json.Unmarshal([]byte(metadataJSON), &session.Metadata)
+		} else {
+			session.Metadata = make(map[string]interface{})
+		}
+
+		sessions = append(sessions, session)
+	}
+
+	return sessions, nil
+}
+
+// AddChatMessage adds a message to a chat session
+func (s *Store) AddChatMessage(ctx context.Context, sessionID, role, content string, sources []string, metadata map[string]interface{}) (*ChatMessage, error) {
+	id := uuid.New().String()
 	now := time.Now()
-	note.CreatedAt = now
-	note.UpdatedAt = now
 
-	metadataJSON, _ := json.Marshal(note.Metadata)
-	sourceIDsJSON, _ := json.Marshal(note.SourceIDs)
+	if metadata == nil {
+		metadata = map[string]interface{}{}
+	}
+	metadataJSON, _ := json.Marshal(metadata)
+	sourcesJSON, _ := json.Marshal(sources)
+
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO chat_messages (id, session_id, role, content, sources, created_at, metadata)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`, id, sessionID, role, content, string(sourcesJSON), now.Unix(), string(metadataJSON))
+	if err != nil {
+		return nil, err
+	}
+
+	// Update session timestamp
+	_, err = s.db.ExecContext(ctx, `UPDATE chat_sessions SET updated_at = ? WHERE id = ?`, now.Unix(), sessionID)
+	if err != nil {
+		return nil, err
+	}
+
+	return s.GetChatMessage(ctx, id)
+}
+
+// SetChatMessageMetadata replaces the metadata of a chat message
+func (s *Store) SetChatMessageMetadata(ctx context.Context, id string, metadata map[string]interface{}) error {
+	metadataJSON, _ := json.Marshal(metadata)
+	result, err := s.db.ExecContext(ctx, `UPDATE chat_messages SET metadata = ? WHERE id = ?`, string(metadataJSON), id)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return fmt.Errorf("chat message not found")
+	}
+	return nil
+}
+
+// listChatMessages retrieves all messages for a session
+func (s *Store) listChatMessages(ctx context.Context, sessionID string) ([]ChatMessage, error) {
+	rows, err := s.db.QueryContext(ctx, `
+		SELECT id, session_id, role, content, sources, created_at, metadata
+		FROM chat_messages WHERE session_id = ? ORDER BY created_at ASC
+	`, sessionID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	messages := make([]ChatMessage, 0)
+	for rows.Next() {
+		var msg ChatMessage
+		var metadataJSON, sourcesJSON string
+		var createdAt int64
+
+		if err := rows.Scan(&msg.ID, &msg.SessionID, &msg.Role, &msg.Content, &sourcesJSON, &createdAt, &metadataJSON); err != nil {
+			return nil, err
+		}
+
+		msg.CreatedAt = time.Unix(createdAt, 0)
+
+		if metadataJSON != "" {
+			json.Unmarshal([]byte(metadataJSON), &msg.Metadata)
+		} else {
+			msg.Metadata = make(map[string]interface{})
+		}
+
+		if sourcesJSON != "" {
+			json.Unmarshal([]byte(sourcesJSON), &msg.Sources)
+		}
+
+		messages = append(messages, msg)
+	}
+
+	return messages, nil
+}
+
+// GetChatMessage retrieves a single message by ID
+func (s *Store) GetChatMessage(ctx context.Context, id string) (*ChatMessage, error) {
+	var msg ChatMessage
+	var metadataJSON, sourcesJSON string
+	var createdAt int64
+
+	err := s.db.QueryRowContext(ctx, `
+		SELECT id, session_id, role, content, sources, created_at, metadata
+		FROM chat_messages WHERE id = ?
+	`, id).Scan(&msg.ID, &msg.SessionID, &msg.Role, &msg.Content, &sourcesJSON, &createdAt, &metadataJSON)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("chat message not found")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	msg.CreatedAt = time.Unix(createdAt, 0)
+
+	if metadataJSON != "" {
+		json.Unmarshal([]byte(metadataJSON), &msg.Metadata)
+	} else {
+		msg.Metadata = make(map[string]interface{})
+	}
+
+	if sourcesJSON != "" {
+		json.Unmarshal([]byte(sourcesJSON), &msg.Sources)
+	}
+
+	return &msg, nil
+}
+
+// DeleteChatSession deletes a chat session
+func (s *Store) DeleteChatSession(ctx context.Context, id string) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM chat_sessions WHERE id = ?`, id)
+	return err
+}
+
+// RestoreChatSession inserts a deleted chat session again with its ID, timestamps and messages
+func (s *Store) RestoreChatSession(ctx context.Context, session *ChatSession) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	metadataJSON, _ := json.Marshal(session.Metadata)
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO chat_sessions (id, notebook_id, title, created_at, updated_at, metadata)
+		VALUES (?, ?, ?, ?, ?, ?)
+	`, session.ID, session.NotebookID, session.Title, session.CreatedAt.Unix(), session.UpdatedAt.Unix(), string(metadataJSON)); err != nil {
+		return err
+	}
+	for _, msg := range session.Messages {
+		msgMetadataJSON, _ := json.Marshal(msg.Metadata)
+		sourcesJSON, _ := json.Marshal(msg.Sources)
+		if _, err := tx.ExecContext(ctx, `
+			INSERT INTO chat_messages (id, session_id, role, content, sources, created_at, metadata)
+			VALUES (?, ?, ?, ?, ?, ?, ?)
+		`, msg.ID, session.ID, msg.Role, msg.Content, string(sourcesJSON), msg.CreatedAt.Unix(), string(msgMetadataJSON)); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// Integration operations
+
+// SaveIntegration creates or updates the user's integration for its provider
+func (s *Store) SaveIntegration(ctx context.Context, in *Integration) error {
+	now := time.Now()
+	in.UpdatedAt = now
+
+	existing, err := s.GetIntegrationByProvider(ctx, in.UserID, in.Provider)
+	if err == nil {
+		in.ID = existing.ID
+		in.CreatedAt = existing.CreatedAt
+		_, err := s.db.ExecContext(ctx, `
+			UPDATE integrations
+			SET bot_token = ?, signing_secret = ?, public_key = ?, application_id = ?, updated_at = ?
+			WHERE id = ?
+		`, in.BotToken, in.SigningSecret, in.PublicKey, in.ApplicationID, now.Unix(), in.ID)
+		return err
+	}
+
+	in.ID = uuid.New().String()
+	in.CreatedAt = now
+	_, err = s.db.ExecContext(ctx, `
+		INSERT INTO integrations (id, user_id, provider, bot_token, signing_secret, public_key, application_id, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, in.ID, in.UserID, in.Provider, in.BotToken, in.SigningSecret, in.PublicKey, in.ApplicationID, now.Unix(), now.Unix())
+	return err
+}
+
+// scanIntegration scans an integrations row selected with integrationColumns
+func scanIntegration(row interface{ Scan(...any) error }) (*Integration, error) {
+	var in Integration
+	var botToken, signingSecret, publicKey, applicationID sql.NullString
+	var createdAt, updatedAt int64
+	if err := row.Scan(&in.ID, &in.UserID, &in.Provider, &botToken, &signingSecret, &publicKey, &applicationID, &createdAt, &updatedAt); err != nil {
+		return nil, err
+	}
+	in.BotToken = botToken.String
+	in.SigningSecret = signingSecret.String
+	in.PublicKey = publicKey.String
+	in.ApplicationID = applicationID.String
+	in.CreatedAt = time.Unix(createdAt, 0)
+	in.UpdatedAt = time.Unix(updatedAt, 0)
+	return &in, nil
+}
+
+const integrationColumns = `id, user_id, provider, bot_token, signing_secret, public_key, application_id, created_at, updated_at`
+
+// GetIntegration retrieves an integration by ID
+func (s *Store) GetIntegration(ctx context.Context, id string) (*Integration, error) {
+	row := s.db.QueryRowContext(ctx, `SELECT `+integrationColumns+` FROM integrations WHERE id = ?`, id)
+	in, err := scanIntegration(row)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("integration not found")
+	}
+	return in, err
+}
+
+// GetIntegrationByProvider retrieves the user's integration for a provider
+func (s *Store) GetIntegrationByProvider(ctx context.Context, userID, provider string) (*Integration, error) {
+	row := s.db.QueryRowContext(ctx, `SELECT `+integrationColumns+` FROM integrations WHERE user_id = ? AND provider = ?`, userID, provider)
+	in, err := scanIntegration(row)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("integration not found")
+	}
+	return in, err
+}
+
+// ListIntegrations lists all integrations configured by a user
+func (s *Store) ListIntegrations(ctx context.Context, userID string) ([]Integration, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT `+integrationColumns+` FROM integrations WHERE user_id = ? ORDER BY provider`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	integrations := make([]Integration, 0)
+	for rows.Next() {
+		in, err := scanIntegration(rows)
+		if err != nil {
+			return nil, err
+		}
+		integrations = append(integrations, *in)
+	}
+	return integrations, rows.Err()
+}
+
+// DeleteIntegration removes the user's integration for a provider
+func (s *Store) DeleteIntegration(ctx context.Context, userID, provider string) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM integrations WHERE user_id = ? AND provider = ?`, userID, provider)
+	return err
+}
+
+// SetTelegramChatNotebook selects the notebook a Telegram chat talks to
+func (s *Store) SetTelegramChatNotebook(ctx context.Context, integrationID string, chatID int64, notebookID string) error {
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO telegram_chats (integration_id, chat_id, notebook_id, updated_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT(integration_id, chat_id) DO UPDATE SET notebook_id = excluded.notebook_id, updated_at = excluded.updated_at
+	`, integrationID, chatID, notebookID, time.Now().Unix())
+	return err
+}
+
+// GetTelegramChatNotebook returns the notebook selected for a Telegram chat, or "" if none is selected
+func (s *Store) GetTelegramChatNotebook(ctx context.Context, integrationID string, chatID int64) (string, error) {
+	var notebookID string
+	err := s.db.QueryRowContext(ctx, `
+		SELECT notebook_id FROM telegram_chats WHERE integration_id = ? AND chat_id = ?
+	`, integrationID, chatID).Scan(&notebookID)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return notebookID, err
+}
+
+// SetTelegramLinkCode replaces the code that links a Telegram account to an integration
+func (s *Store) SetTelegramLinkCode(ctx context.Context, integrationID, codeHash string, expiresAt time.Time) error {
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO telegram_link_codes (integration_id, code_hash, expires_at) VALUES (?, ?, ?)
+		ON CONFLICT(integration_id) DO UPDATE SET code_hash = excluded.code_hash, expires_at = excluded.expires_at
+	`, integrationID, codeHash, expiresAt.Unix())
+	return err
+}
+
+// ConsumeTelegramLinkCode uses up the link code of an integration, reporting whether it
+// matched and hadn't expired. A code links one account only.
+func (s *Store) ConsumeTelegramLinkCode(ctx context.Context, integrationID, codeHash string) (bool, error) {
+	result, err := s.db.ExecContext(ctx, `
+		DELETE FROM telegram_link_codes WHERE integration_id = ? AND code_hash = ? AND expires_at > ?
+	`, integrationID, codeHash, time.Now().Unix())
+	if err != nil {
+		return false, err
+	}
+	n, err := result.RowsAffected()
+	return n == 1, err
+}
+
+// AddTelegramLink allows a Telegram user to use an integration in a chat
+func (s *Store) AddTelegramLink(ctx context.Context, integrationID string, chatID, telegramUserID int64) error {
+	_, err := s.db.ExecContext(ctx, `
+		INSERT OR IGNORE INTO telegram_links (integration_id, chat_id, telegram_user_id, created_at) VALUES (?, ?, ?, ?)
+	`, integrationID, chatID, telegramUserID, time.Now().Unix())
+	return err
+}
+
+// IsTelegramLinked reports whether a Telegram user may use an integration in a chat
+func (s *Store) IsTelegramLinked(ctx context.Context, integrationID string, chatID, telegramUserID int64) (bool, error) {
+	var n int
+	err := s.db.QueryRowContext(ctx, `
+		SELECT COUNT(*) FROM telegram_links WHERE integration_id = ? AND chat_id = ? AND telegram_user_id = ?
+	`, integrationID, chatID, telegramUserID).Scan(&n)
+	return n > 0, err
+}
+
+// DeleteTelegramLinks unlinks every Telegram account from an integration
+func (s *Store) DeleteTelegramLinks(ctx context.Context, integrationID string) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM telegram_links WHERE integration_id = ?`, integrationID)
+	return err
+}
+
+// hookTokenPrefix marks the stored hash of an ingest hook token
+const hookTokenPrefix = "sha256:"
+
+// hookTokenHash is what is stored of an ingest hook token
+func hookTokenHash(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hookTokenPrefix + hex.EncodeToString(sum[:])
+}
 
+// CreateIngestHook stores a new ingest hook. Only the hash of its token is kept, so the token
+// is on the hook returned here and on no hook read back.
+func (s *Store) CreateIngestHook(ctx context.Context, hook *IngestHook) error {
+	hook.ID = uuid.New().String()
+	hook.CreatedAt = time.Now()
 	_, err := s.db.ExecContext(ctx, `
-		INSERT INTO notes (id, notebook_id, title, content, type, source_ids, created_at, updated_at, metadata)
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
-	`, note.ID, note.NotebookID, note.Title, note.Content, note.Type, string(sourceIDsJSON),
-		now.Unix(), now.Unix(), string(metadataJSON))
-
+		INSERT INTO ingest_hooks (id, user_id, name, token, notebook_id, name_template, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`, hook.ID, hook.UserID, hook.Name, hookTokenHash(hook.Token), hook.NotebookID, hook.NameTemplate, hook.CreatedAt.Unix())
 	return err
 }
 
-// GetNote retrieves a note by ID
-func (s *Store) GetNote(ctx context.Context, id string) (*Note, error) {
-	var note Note
-	var metadataJSON, sourceIDsJSON string
-	var createdAt, updatedAt int64
+// scanIngestHook scans an ingest_hooks row selected with ingestHookColumns
+func scanIngestHook(row interface{ Scan(...any) error }) (*IngestHook, error) {
+	var hook IngestHook
+	var nameTemplate sql.NullString
+	var createdAt int64
+	var lastUsedAt sql.NullInt64
+	var tokenHash string
+	if err := row.Scan(&hook.ID, &hook.UserID, &hook.Name, &tokenHash, &hook.NotebookID, &nameTemplate, &createdAt, &lastUsedAt); err != nil {
+		return nil, err
+	}
+	hook.NameTemplate = nameTemplate.String
+	hook.CreatedAt = time.Unix(createdAt, 0)
+	if lastUsedAt.Valid {
+		t := time.Unix(lastUsedAt.Int64, 0)
+		hook.LastUsedAt = &t
+	}
+	return &hook, nil
+}
 
-	err := s.db.QueryRowContext(ctx, `
-		SELECT id, notebook_id, title, content, type, source_ids, created_at, updated_at, metadata
-		FROM notes WHERE id = ?
-	`, id).Scan(&note.ID, &note.NotebookID, &note.Title, &note.Content, &note.Type,
-		&sourceIDsJSON, &createdAt, &updatedAt, &metadataJSON)
+const ingestHookColumns = `id, user_id, name, token, notebook_id, name_template, created_at, last_used_at`
+
+// GetIngestHookByToken retrieves an ingest hook by its token
+func (s *Store) GetIngestHookByToken(ctx context.Context, token string) (*IngestHook, error) {
+	row := s.db.QueryRowContext(ctx, `SELECT `+ingestHookColumns+` FROM ingest_hooks WHERE token = ?`, hookTokenHash(token))
+	hook, err := scanIngestHook(row)
 	if err == sql.ErrNoRows {
-		return nil, fmt.Errorf("note not found")
+		return nil, fmt.Errorf("ingest hook not found")
 	}
+	return hook, err
+}
+
+// ListIngestHooks lists all ingest hooks of a user
+func (s *Store) ListIngestHooks(ctx context.Context, userID string) ([]IngestHook, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT `+ingestHookColumns+` FROM ingest_hooks WHERE user_id = ? ORDER BY created_at DESC`, userID)
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 
-	note.CreatedAt = time.Unix(createdAt, 0)
-	note.UpdatedAt = time.Unix(updatedAt, 0)
+	hooks := make([]IngestHook, 0)
+	for rows.Next() {
+		hook, err := scanIngestHook(rows)
+		if err != nil {
+			return nil, err
+		}
+		hooks = append(hooks, *hook)
+	}
+	return hooks, rows.Err()
+}
 
-	if metadataJSON != "" {
-		json.Unmarshal([]byte(metadataJSON), &note.Metadata)
-	} else {
-		note.Metadata = make(map[string]interface{})
+// TouchIngestHook records that a hook was just used
+func (s *Store) TouchIngestHook(ctx context.Context, id string) error {
+	_, err := s.db.ExecContext(ctx, `UPDATE ingest_hooks SET last_used_at = ? WHERE id = ?`, time.Now().Unix(), id)
+	return err
+}
+
+// DeleteIngestHook removes one of the user's ingest hooks
+func (s *Store) DeleteIngestHook(ctx context.Context, userID, id string) error {
+	result, err := s.db.ExecContext(ctx, `DELETE FROM ingest_hooks WHERE id = ? AND user_id = ?`, id, userID)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return fmt.Errorf("ingest hook not found")
 	}
+	return nil
+}
 
-	if sourceIDsJSON != "" {
-		json.Unmarshal([]byte(sourceIDsJSON), &note.SourceIDs)
+// CreateCalendarFeed stores a new calendar feed of a notebook
+func (s *Store) CreateCalendarFeed(ctx context.Context, feed *CalendarFeed) error {
+	feed.ID = uuid.New().String()
+	feed.CreatedAt = time.Now()
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO calendar_feeds (id, notebook_id, user_id, name, url, auto_summary, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`, feed.ID, feed.NotebookID, feed.UserID, feed.Name, feed.URL, feed.AutoSummary, feed.CreatedAt.Unix())
+	return err
+}
+
+// scanCalendarFeed scans a calendar_feeds row selected with calendarFeedColumns
+func scanCalendarFeed(row interface{ Scan(...any) error }) (*CalendarFeed, error) {
+	var feed CalendarFeed
+	var name, lastError sql.NullString
+	var createdAt int64
+	var lastSyncedAt sql.NullInt64
+	if err := row.Scan(&feed.ID, &feed.NotebookID, &feed.UserID, &name, &feed.URL, &feed.AutoSummary, &lastSyncedAt, &lastError, &createdAt); err != nil {
+		return nil, err
 	}
+	feed.Name = name.String
+	feed.LastError = lastError.String
+	feed.CreatedAt = time.Unix(createdAt, 0)
+	if lastSyncedAt.Valid {
+		t := time.Unix(lastSyncedAt.Int64, 0)
+		feed.LastSyncedAt = &t
+	}
+	return &feed, nil
+}
 
-	return &note, nil
+const calendarFeedColumns = `id, notebook_id, user_id, name, url, auto_summary, last_synced_at, last_error, created_at`
+
+// GetCalendarFeed retrieves a calendar feed by ID
+func (s *Store) GetCalendarFeed(ctx context.Context, id string) (*CalendarFeed, error) {
+	row := s.db.QueryRowContext(ctx, `SELECT `+calendarFeedColumns+` FROM calendar_feeds WHERE id = ?`, id)
+	feed, err := scanCalendarFeed(row)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("calendar feed not found")
+	}
+	return feed, err
 }
 
-// ListNotes retrieves all notes for a notebook
-func (s *Store) ListNotes(ctx context.Context, notebookID string) ([]Note, error) {
-	rows, err := s.db.QueryContext(ctx, `
-		SELECT id, notebook_id, title, content, type, source_ids, created_at, updated_at, metadata
-		FROM notes WHERE notebook_id = ? ORDER BY created_at DESC
-	`, notebookID)
+// ListCalendarFeeds lists the calendar feeds of a notebook, or of all notebooks if notebookID is empty
+func (s *Store) ListCalendarFeeds(ctx context.Context, notebookID string) ([]CalendarFeed, error) {
+	query := `SELECT ` + calendarFeedColumns + ` FROM calendar_feeds`
+	var args []any
+	if notebookID != "" {
+		query += ` WHERE notebook_id = ?`
+		args = append(args, notebookID)
+	}
+	rows, err := s.db.QueryContext(ctx, query+` ORDER BY created_at`, args...)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	notes := make([]Note, 0)
+	feeds := make([]CalendarFeed, 0)
 	for rows.Next() {
-		var note Note
-		var metadataJSON, sourceIDsJSON string
-		var createdAt, updatedAt int64
-
-		if err := rows.Scan(&note.ID, &note.NotebookID, &note.Title, &note.Content, &note.Type,
-			&sourceIDsJSON, &createdAt, &updatedAt, &metadataJSON); err != nil {
+		feed, err := scanCalendarFeed(rows)
+		if err != nil {
 			return nil, err
 		}
+		feeds = append(feeds, *feed)
+	}
+	return feeds, rows.Err()
+}
 
-		note.CreatedAt = time.Unix(createdAt, 0)
-		note.UpdatedAt = time.Unix(updatedAt, 0)
+// UpdateCalendarFeedSync records the outcome of a feed sync; syncErr is empty on success
+func (s *Store) UpdateCalendarFeedSync(ctx context.Context, id, syncErr string) error {
+	_, err := s.db.ExecContext(ctx, `UPDATE calendar_feeds SET last_synced_at = ?, last_error = ? WHERE id = ?`, time.Now().Unix(), syncErr, id)
+	return err
+}
 
-		if metadataJSON != "" {
-			json.Unmarshal([]byte(metadataJSON), &note.Metadata)
-		} else {
-			note.Metadata = make(map[string]interface{})
-		}
+// DeleteCalendarFeed removes a calendar feed of a notebook. Meeting sources it created are kept.
+func (s *Store) DeleteCalendarFeed(ctx context.Context, notebookID, id string) error {
+	result, err := s.db.ExecContext(ctx, `DELETE FROM calendar_feeds WHERE id = ? AND notebook_id = ?`, id, notebookID)
+	if err != nil {
+		return err
+	}
+	if n, _ := result.RowsAffected(); n == 0 {
+		return fmt.Errorf("calendar feed not found")
+	}
+	return nil
+}
 
-		if sourceIDsJSON != "" {
-			json.Unmarshal([]byte(sourceIDsJSON), &note.SourceIDs)
-		}
+// HasCalendarEvent reports whether a meeting of a feed was already imported
+func (s *Store) HasCalendarEvent(ctx context.Context, feedID, eventKey string) (bool, error) {
+	var count int
+	err := s.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM calendar_events WHERE feed_id = ? AND event_key = ?`, feedID, eventKey).Scan(&count)
+	return count > 0, err
+}
 
-		notes = append(notes, note)
+// CreateCalendarEvent records the source created for a meeting
+func (s *Store) CreateCalendarEvent(ctx context.Context, event *CalendarEvent) error {
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO calendar_events (feed_id, event_key, source_id, starts_at, ends_at)
+		VALUES (?, ?, ?, ?, ?)
+	`, event.FeedID, event.EventKey, event.SourceID, event.StartsAt.Unix(), event.EndsAt.Unix())
+	return err
+}
+
+const calendarEventColumns = `e.feed_id, e.event_key, e.source_id, e.starts_at, e.ends_at, e.transcript_source_id, e.summary_note_id`
+
+// scanCalendarEvent scans a calendar_events row selected with calendarEventColumns
+func scanCalendarEvent(row interface{ Scan(...any) error }) (*CalendarEvent, error) {
+	var event CalendarEvent
+	var sourceID, transcriptSourceID, summaryNoteID sql.NullString
+	var startsAt, endsAt int64
+	if err := row.Scan(&event.FeedID, &event.EventKey, &sourceID, &startsAt, &endsAt, &transcriptSourceID, &summaryNoteID); err != nil {
+		return nil, err
 	}
+	event.SourceID = sourceID.String
+	event.TranscriptSourceID = transcriptSourceID.String
+	event.SummaryNoteID = summaryNoteID.String
+	event.StartsAt = time.Unix(startsAt, 0)
+	event.EndsAt = time.Unix(endsAt, 0)
+	return &event, nil
+}
 
-	return notes, nil
+// GetCalendarEventBySource retrieves the meeting a source was created for
+func (s *Store) GetCalendarEventBySource(ctx context.Context, sourceID string) (*CalendarEvent, error) {
+	row := s.db.QueryRowContext(ctx, `SELECT `+calendarEventColumns+` FROM calendar_events e WHERE e.source_id = ?`, sourceID)
+	event, err := scanCalendarEvent(row)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("meeting not found")
+	}
+	return event, err
 }
 
-// GetNoteByFileName finds a note by its filename in metadata (image_url or slides)
-// Returns the note with its notebook info
-func (s *Store) GetNoteByFileName(ctx context.Context, filename string) (*Note, *Notebook, error) {
-	log.Printf("DEBUG: GetNoteByFileName called for filename: %s", filename)
+// LatestUnpairedMeeting returns the most recent meeting of a notebook's auto-summary feeds that
+// ended between from and to and has no transcript yet, or nil if there is none
+func (s *Store) LatestUnpairedMeeting(ctx context.Context, notebookID string, from, to time.Time) (*CalendarEvent, error) {
+	row := s.db.QueryRowContext(ctx, `
+		SELECT `+calendarEventColumns+`
+		FROM calendar_events e JOIN calendar_feeds f ON f.id = e.feed_id
+		WHERE f.notebook_id = ? AND f.auto_summary = 1 AND e.source_id IS NOT NULL AND e.transcript_source_id IS NULL
+		  AND e.ends_at BETWEEN ? AND ?
+		ORDER BY e.ends_at DESC LIMIT 1
+	`, notebookID, from.Unix(), to.Unix())
+	event, err := scanCalendarEvent(row)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	return event, err
+}
 
-	// Get all notes and search for the filename
+// SetMeetingTranscript pairs a meeting with its transcript and the summary note generated from both
+func (s *Store) SetMeetingTranscript(ctx context.Context, feedID, eventKey, transcriptSourceID, summaryNoteID string) error {
+	_, err := s.db.ExecContext(ctx, `
+		UPDATE calendar_events SET transcript_source_id = ?, summary_note_id = NULLIF(?, '')
+		WHERE feed_id = ? AND event_key = ?
+	`, transcriptSourceID, summaryNoteID, feedID, eventKey)
+	return err
+}
+
+// LogActivity logs a user activity to both database and audit log file
+func (s *Store) LogActivity(ctx context.Context, log *ActivityLog) error {
+	if log.ID == "" {
+		log.ID = uuid.New().String()
+	}
+	if log.CreatedAt.IsZero() {
+		log.CreatedAt = time.Now()
+	}
+
+	// Write to database
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO activity_logs (id, user_id, action, resource_type, resource_id, resource_name, details, ip_address, user_agent, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, log.ID, log.UserID, log.Action, log.ResourceType, log.ResourceID, log.ResourceName, log.Details, log.IPAddress, log.UserAgent, log.CreatedAt.Unix())
+
+	// Also write to audit log file (async, don't fail if it errors)
+	LogUserActivity(log.Action, log.UserID, log.ResourceType, log.ResourceID, log.ResourceName, log.Details, log.IPAddress, log.UserAgent)
+
+	return err
+}
+
+// ListNotebookActivity returns the newest activity logs of a notebook: those about the notebook
+// itself and those whose details name it. Details that aren't valid JSON are skipped.
+func (s *Store) ListNotebookActivity(ctx context.Context, notebookID string, limit int) ([]NotebookActivity, error) {
 	rows, err := s.db.QueryContext(ctx, `
-		SELECT
-			n.id, n.notebook_id, n.title, n.content, n.type, n.source_ids,
-			n.created_at, n.updated_at, n.metadata,
-			nb.id as nb_id, nb.user_id as nb_user_id, nb.name as nb_name, nb.description as nb_description,
-			nb.is_public as nb_is_public, nb.public_token as nb_public_token,
-			nb.created_at as nb_created_at, nb.updated_at as nb_updated_at, nb.metadata as nb_metadata
-		FROM notes n
-		INNER JOIN notebooks nb ON n.notebook_id = nb.id
-	`)
+		SELECT id, user_id, action, resource_type, resource_id, resource_name, details, created_at
+		FROM activity_logs
+		WHERE (resource_type = 'notebook' AND resource_id = ?)
+			OR CASE WHEN json_valid(details) THEN json_extract(details, '$.notebook_id') END = ?
+		ORDER BY created_at DESC, rowid DESC LIMIT ?
+	`, notebookID, notebookID, limit)
 	if err != nil {
-		log.Printf("DEBUG: Query error: %v", err)
-		return nil, nil, err
+		return nil, err
 	}
 	defer rows.Close()
 
-	noteCount := 0
+	activities := make([]NotebookActivity, 0)
 	for rows.Next() {
-		noteCount++
+		var a NotebookActivity
+		var resourceType, resourceID, resourceName, details sql.NullString
+		var createdAt int64
+		if err := rows.Scan(&a.ID, &a.UserID, &a.Action, &resourceType, &resourceID, &resourceName, &details, &createdAt); err != nil {
+			return nil, err
+		}
+		a.ResourceType = resourceType.String
+		a.ResourceID = resourceID.String
+		a.ResourceName = resourceName.String
+		if details.String != "" {
+			json.Unmarshal([]byte(details.String), &a.Details)
+		}
+		a.CreatedAt = time.Unix(createdAt, 0)
+		activities = append(activities, a)
+	}
+	return activities, rows.Err()
+}
 
-		var note Note
-		var notebook Notebook
-		var metadataJSON, sourceIDsJSON, notebookMetadataJSON string
-		var createdAt, updatedAt, nbCreatedAt, nbUpdatedAt int64
-		var nbPublicToken sql.NullString
+// Close closes the database connection
+func (s *Store) Close() error {
+	return s.db.Close()
+}
 
-		if err := rows.Scan(
-			&note.ID, &note.NotebookID, &note.Title, &note.Content, &note.Type, &sourceIDsJSON,
-			&createdAt, &updatedAt, &metadataJSON,
-			&notebook.ID, &notebook.UserID, &notebook.Name, &notebook.Description,
-			&notebook.IsPublic, &nbPublicToken,
-			&nbCreatedAt, &nbUpdatedAt, &notebookMetadataJSON,
-		); err != nil {
-			log.Printf("DEBUG: Scan error at row %d: %v", noteCount, err)
-			continue
-		}
+// CreateDraftJob records a new draft job
+func (s *Store) CreateDraftJob(ctx context.Context, job *DraftJob) error {
+	job.ID = uuid.New().String()
+	job.CreatedAt = time.Now()
+	job.UpdatedAt = job.CreatedAt
 
-		// Convert NullString to string
-		if nbPublicToken.Valid {
-			notebook.PublicToken = nbPublicToken.String
-		} else {
-			notebook.PublicToken = ""
-		}
+	sourceIDsJSON, _ := json.Marshal(job.SourceIDs)
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO draft_jobs (id, notebook_id, user_id, brief, length, source_ids, status, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, job.ID, job.NotebookID, job.UserID, job.Brief, job.Length, string(sourceIDsJSON), job.Status,
+		job.CreatedAt.Unix(), job.UpdatedAt.Unix())
+	return err
+}
 
-		note.CreatedAt = time.Unix(createdAt, 0)
-		note.UpdatedAt = time.Unix(updatedAt, 0)
-		notebook.CreatedAt = time.Unix(nbCreatedAt, 0)
-		notebook.UpdatedAt = time.Unix(nbUpdatedAt, 0)
+const draftJobColumns = `id, notebook_id, user_id, brief, length, source_ids, status, outline, sections, citations, note_id, error, created_at, updated_at`
 
-		if metadataJSON != "" {
-			if err := json.Unmarshal([]byte(metadataJSON), &note.Metadata); err != nil {
-				log.Printf("Failed to unmarshal note metadata: %v, JSON: %s", err, metadataJSON)
-				note.Metadata = make(map[string]interface{})
-			}
-		} else {
-			note.Metadata = make(map[string]interface{})
-		}
+// scanDraftJob scans a draft_jobs row selected with draftJobColumns
+func scanDraftJob(row interface{ Scan(...any) error }) (*DraftJob, error) {
+	var job DraftJob
+	var length, sourceIDsJSON, outline, sectionsJSON, citationsJSON, noteID, errorText sql.NullString
+	var createdAt, updatedAt int64
+	if err := row.Scan(&job.ID, &job.NotebookID, &job.UserID, &job.Brief, &length, &sourceIDsJSON, &job.Status,
+		&outline, &sectionsJSON, &citationsJSON, &noteID, &errorText, &createdAt, &updatedAt); err != nil {
+		return nil, err
+	}
+	job.Length = length.String
+	job.Outline = outline.String
+	job.NoteID = noteID.String
+	job.Error = errorText.String
+	job.CreatedAt = time.Unix(createdAt, 0)
+	job.UpdatedAt = time.Unix(updatedAt, 0)
+	json.Unmarshal([]byte(sourceIDsJSON.String), &job.SourceIDs)
+	json.Unmarshal([]byte(sectionsJSON.String), &job.Sections)
+	json.Unmarshal([]byte(citationsJSON.String), &job.Citations)
+	return &job, nil
+}
 
-		if notebookMetadataJSON != "" {
-			if err := json.Unmarshal([]byte(notebookMetadataJSON), &notebook.Metadata); err != nil {
-				log.Printf("Failed to unmarshal notebook metadata: %v", err)
-				notebook.Metadata = make(map[string]interface{})
-			}
-		} else {
-			notebook.Metadata = make(map[string]interface{})
-		}
+// GetDraftJob retrieves a draft job by ID
+func (s *Store) GetDraftJob(ctx context.Context, id string) (*DraftJob, error) {
+	job, err := scanDraftJob(s.db.QueryRowContext(ctx, `SELECT `+draftJobColumns+` FROM draft_jobs WHERE id = ?`, id))
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("draft not found")
+	}
+	return job, err
+}
 
-		if sourceIDsJSON != "" {
-			json.Unmarshal([]byte(sourceIDsJSON), &note.SourceIDs)
-		}
+// ListDraftJobs lists the draft jobs of a notebook, newest first
+func (s *Store) ListDraftJobs(ctx context.Context, notebookID string) ([]DraftJob, error) {
+	return s.queryDraftJobs(ctx, `SELECT `+draftJobColumns+` FROM draft_jobs WHERE notebook_id = ? ORDER BY created_at DESC`, notebookID)
+}
 
-		// Debug: print metadata for infograph type notes
-		if note.Type == "infograph" {
-			log.Printf("DEBUG: Found infograph note %s, metadata: %+v", note.ID, note.Metadata)
-		}
+// ListActiveDraftJobs lists the draft jobs that were generating when the server stopped
+func (s *Store) ListActiveDraftJobs(ctx context.Context) ([]DraftJob, error) {
+	return s.queryDraftJobs(ctx, `SELECT `+draftJobColumns+` FROM draft_jobs WHERE status IN (?, ?) ORDER BY created_at`,
+		DraftStatusOutlining, DraftStatusDrafting)
+}
 
-		// Check if filename is in image_url
-		if imageURL, ok := note.Metadata["image_url"]; ok {
-			if imageURLStr, ok := imageURL.(string); ok {
-				log.Printf("DEBUG: Checking image_url: %s vs %s", filepath.Base(imageURLStr), filename)
-				if filepath.Base(imageURLStr) == filename {
-					log.Printf("Found file in note image_url: %s, notebook: %s, public: %v", filename, notebook.ID, notebook.IsPublic)
-					return &note, &notebook, nil
-				}
-			}
-		}
+func (s *Store) queryDraftJobs(ctx context.Context, query string, args ...any) ([]DraftJob, error) {
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
 
-		// Check if filename is in slides
-		if slides, ok := note.Metadata["slides"]; ok {
-			// Try to handle slides as JSON array
-			if slidesArray, ok := slides.([]interface{}); ok {
-				for _, slide := range slidesArray {
-					if slideURL, ok := slide.(string); ok && filepath.Base(slideURL) == filename {
-						return &note, &notebook, nil
-					}
-				}
-			}
-			// Try to handle slides as JSON string (from SQLite)
-			if slidesStr, ok := slides.(string); ok && slidesStr != "" {
-				var slidesArray []string
-				if err := json.Unmarshal([]byte(slidesStr), &slidesArray); err == nil {
-					for _, slideURL := range slidesArray {
-						if filepath.Base(slideURL) == filename {
-							return &note, &notebook, nil
-						}
-					}
-				}
-			}
+	jobs := make([]DraftJob, 0)
+	for rows.Next() {
+		job, err := scanDraftJob(rows)
+		if err != nil {
+			return nil, err
 		}
+		jobs = append(jobs, *job)
 	}
+	return jobs, rows.Err()
+}
 
-	log.Printf("DEBUG: Checked %d notes, file not found", noteCount)
-	return nil, nil, fmt.Errorf("note not found for filename")
+// SaveDraftJob stores the progress of a draft job
+func (s *Store) SaveDraftJob(ctx context.Context, job *DraftJob) error {
+	job.UpdatedAt = time.Now()
+	sectionsJSON, _ := json.Marshal(job.Sections)
+	citationsJSON, _ := json.Marshal(job.Citations)
+	result, err := s.db.ExecContext(ctx, `
+		UPDATE draft_jobs SET status = ?, outline = ?, sections = ?, citations = ?, note_id = NULLIF(?, ''), error = ?, updated_at = ?
+		WHERE id = ?
+	`, job.Status, job.Outline, string(sectionsJSON), string(citationsJSON), job.NoteID, job.Error, job.UpdatedAt.Unix(), job.ID)
+	if err != nil {
+		return err
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return fmt.Errorf("draft not found")
+	}
+	return nil
 }
 
-// DeleteNote deletes a note
-func (s *Store) DeleteNote(ctx context.Context, id string) error {
-	_, err := s.db.ExecContext(ctx, `DELETE FROM notes WHERE id = ?`, id)
+// DeleteDraftJob deletes a draft job of a notebook
+func (s *Store) DeleteDraftJob(ctx context.Context, notebookID, id string) error {
+	result, err := s.db.ExecContext(ctx, `DELETE FROM draft_jobs WHERE id = ? AND notebook_id = ?`, id, notebookID)
+	if err != nil {
+		return err
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return fmt.Errorf("draft not found")
+	}
+	return nil
+}
+
+// CreateChatTool stores a new chat tool of a notebook
+func (s *Store) CreateChatTool(ctx context.Context, tool *ChatTool) error {
+	tool.ID = uuid.New().String()
+	tool.CreatedAt = time.Now()
+	tool.UpdatedAt = tool.CreatedAt
+	parametersJSON, _ := json.Marshal(tool.Parameters)
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO chat_tools (id, notebook_id, user_id, name, description, endpoint, parameters, auth_header, auth_value, enabled, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, tool.ID, tool.NotebookID, tool.UserID, tool.Name, tool.Description, tool.Endpoint, string(parametersJSON),
+		tool.AuthHeader, tool.AuthValue, tool.Enabled, tool.CreatedAt.Unix(), tool.UpdatedAt.Unix())
+	tool.HasAuthValue = tool.AuthValue != ""
 	return err
 }
 
-// Chat operations
+const chatToolColumns = `id, notebook_id, user_id, name, description, endpoint, parameters, auth_header, auth_value, enabled, created_at, updated_at`
 
-// CreateChatSession creates a new chat session
-func (s *Store) CreateChatSession(ctx context.Context, notebookID, title string) (*ChatSession, error) {
-	id := uuid.New().String()
-	now := time.Now()
+// scanChatTool scans a chat_tools row selected with chatToolColumns
+func scanChatTool(row interface{ Scan(...any) error }) (*ChatTool, error) {
+	var tool ChatTool
+	var parametersJSON, authHeader, authValue sql.NullString
+	var createdAt, updatedAt int64
+	if err := row.Scan(&tool.ID, &tool.NotebookID, &tool.UserID, &tool.Name, &tool.Description, &tool.Endpoint,
+		&parametersJSON, &authHeader, &authValue, &tool.Enabled, &createdAt, &updatedAt); err != nil {
+		return nil, err
+	}
+	json.Unmarshal([]byte(parametersJSON.String), &tool.Parameters)
+	tool.AuthHeader = authHeader.String
+	tool.AuthValue = authValue.String
+	tool.HasAuthValue = tool.AuthValue != ""
+	tool.CreatedAt = time.Unix(createdAt, 0)
+	tool.UpdatedAt = time.Unix(updatedAt, 0)
+	return &tool, nil
+}
+
+// GetChatTool retrieves a chat tool by ID
+func (s *Store) GetChatTool(ctx context.Context, id string) (*ChatTool, error) {
+	row := s.db.QueryRowContext(ctx, `SELECT `+chatToolColumns+` FROM chat_tools WHERE id = ?`, id)
+	tool, err := scanChatTool(row)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("chat tool not found")
+	}
+	return tool, err
+}
 
-	if title == "" {
-		title = "New Chat"
+// ListChatTools lists the chat tools of a notebook, only the enabled ones if enabledOnly is set
+func (s *Store) ListChatTools(ctx context.Context, notebookID string, enabledOnly bool) ([]ChatTool, error) {
+	query := `SELECT ` + chatToolColumns + ` FROM chat_tools WHERE notebook_id = ?`
+	if enabledOnly {
+		query += ` AND enabled = 1`
+	}
+	rows, err := s.db.QueryContext(ctx, query+` ORDER BY name`, notebookID)
+	if err != nil {
+		return nil, err
 	}
+	defer rows.Close()
 
-	metadataJSON, _ := json.Marshal(map[string]interface{}{})
+	tools := make([]ChatTool, 0)
+	for rows.Next() {
+		tool, err := scanChatTool(rows)
+		if err != nil {
+			return nil, err
+		}
+		tools = append(tools, *tool)
+	}
+	return tools, rows.Err()
+}
 
-	_, err := s.db.ExecContext(ctx, `
-		INSERT INTO chat_sessions (id, notebook_id, title, created_at, updated_at, metadata)
-		VALUES (?, ?, ?, ?, ?, ?)
-	`, id, notebookID, title, now.Unix(), now.Unix(), string(metadataJSON))
+// UpdateChatTool saves the definition of a chat tool
+func (s *Store) UpdateChatTool(ctx context.Context, tool *ChatTool) error {
+	tool.UpdatedAt = time.Now()
+	parametersJSON, _ := json.Marshal(tool.Parameters)
+	result, err := s.db.ExecContext(ctx, `
+		UPDATE chat_tools SET name = ?, description = ?, endpoint = ?, parameters = ?, auth_header = ?, auth_value = ?, enabled = ?, updated_at = ?
+		WHERE id = ?
+	`, tool.Name, tool.Description, tool.Endpoint, string(parametersJSON), tool.AuthHeader, tool.AuthValue, tool.Enabled,
+		tool.UpdatedAt.Unix(), tool.ID)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return fmt.Errorf("chat tool not found")
 	}
+	tool.HasAuthValue = tool.AuthValue != ""
+	return nil
+}
 
-	return s.GetChatSession(ctx, id)
+// DeleteChatTool deletes a chat tool of a notebook along with its call log
+func (s *Store) DeleteChatTool(ctx context.Context, notebookID, id string) error {
+	result, err := s.db.ExecContext(ctx, `DELETE FROM chat_tools WHERE id = ? AND notebook_id = ?`, id, notebookID)
+	if err != nil {
+		return err
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return fmt.Errorf("chat tool not found")
+	}
+	return nil
 }
 
-// GetChatSession retrieves a chat session by ID
-func (s *Store) GetChatSession(ctx context.Context, id string) (*ChatSession, error) {
-	var session ChatSession
-	var metadataJSON string
-	var createdAt, updatedAt int64
+// LogChatToolCall records a call the chat model made to a chat tool
+func (s *Store) LogChatToolCall(ctx context.Context, call *ChatToolCall) error {
+	call.ID = uuid.New().String()
+	call.CreatedAt = time.Now()
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO chat_tool_calls (id, tool_id, notebook_id, session_id, tool_name, arguments, status_code, response, error, duration_ms, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, call.ID, call.ToolID, call.NotebookID, call.SessionID, call.ToolName, call.Arguments, call.StatusCode,
+		call.Response, call.Error, call.DurationMS, call.CreatedAt.Unix())
+	return err
+}
 
-	err := s.db.QueryRowContext(ctx, `
-		SELECT id, notebook_id, title, created_at, updated_at, metadata
-		FROM chat_sessions WHERE id = ?
-	`, id).Scan(&session.ID, &session.NotebookID, &session.Title, &createdAt, &updatedAt, &metadataJSON)
-	if err == sql.ErrNoRows {
-		return nil, fmt.Errorf("chat session not found")
+// ListChatToolCalls lists the most recent tool calls of a notebook, of one tool if toolID is set
+func (s *Store) ListChatToolCalls(ctx context.Context, notebookID, toolID string, limit int) ([]ChatToolCall, error) {
+	query := `SELECT id, tool_id, notebook_id, session_id, tool_name, arguments, status_code, response, error, duration_ms, created_at
+		FROM chat_tool_calls WHERE notebook_id = ?`
+	args := []any{notebookID}
+	if toolID != "" {
+		query += ` AND tool_id = ?`
+		args = append(args, toolID)
 	}
+	args = append(args, limit)
+	rows, err := s.db.QueryContext(ctx, query+` ORDER BY created_at DESC LIMIT ?`, args...)
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 
-	session.CreatedAt = time.Unix(createdAt, 0)
-	session.UpdatedAt = time.Unix(updatedAt, 0)
-
-	if metadataJSON != "" {
-		json.Unmarshal([]byte(metadataJSON), &session.Metadata)
-	} else {
-		session.Metadata = make(map[string]interface{})
+	calls := make([]ChatToolCall, 0)
+	for rows.Next() {
+		var call ChatToolCall
+		var sessionID, arguments, response, errorText sql.NullString
+		var statusCode, durationMS sql.NullInt64
+		var createdAt int64
+		if err := rows.Scan(&call.ID, &call.ToolID, &call.NotebookID, &sessionID, &call.ToolName, &arguments,
+			&statusCode, &response, &errorText, &durationMS, &createdAt); err != nil {
+			return nil, err
+		}
+		call.SessionID = sessionID.String
+		call.Arguments = arguments.String
+		call.StatusCode = int(statusCode.Int64)
+		call.Response = response.String
+		call.Error = errorText.String
+		call.DurationMS = durationMS.Int64
+		call.CreatedAt = time.Unix(createdAt, 0)
+		calls = append(calls, call)
 	}
+	return calls, rows.Err()
+}
 
-	// Load messages
-	session.Messages, err = s.listChatMessages(ctx, id)
-	if err != nil {
+// CreateSavedPrompt stores a new saved prompt of a user
+func (s *Store) CreateSavedPrompt(ctx context.Context, prompt *SavedPrompt) error {
+	prompt.ID = uuid.New().String()
+	prompt.CreatedAt = time.Now()
+	prompt.UpdatedAt = prompt.CreatedAt
+	variablesJSON, _ := json.Marshal(prompt.Variables)
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO saved_prompts (id, user_id, title, text, variables, created_at, updated_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?)
+	`, prompt.ID, prompt.UserID, prompt.Title, prompt.Text, string(variablesJSON), prompt.CreatedAt.Unix(), prompt.UpdatedAt.Unix())
+	return err
+}
+
+const savedPromptColumns = `id, user_id, title, text, variables, created_at, updated_at, last_run_at`
+
+// scanSavedPrompt scans a saved_prompts row selected with savedPromptColumns
+func scanSavedPrompt(row interface{ Scan(...any) error }) (*SavedPrompt, error) {
+	var prompt SavedPrompt
+	var variablesJSON sql.NullString
+	var createdAt, updatedAt int64
+	var lastRunAt sql.NullInt64
+	if err := row.Scan(&prompt.ID, &prompt.UserID, &prompt.Title, &prompt.Text, &variablesJSON,
+		&createdAt, &updatedAt, &lastRunAt); err != nil {
 		return nil, err
 	}
+	prompt.Variables = make([]PromptVariable, 0)
+	if variablesJSON.String != "" {
+		json.Unmarshal([]byte(variablesJSON.String), &prompt.Variables)
+	}
+	prompt.CreatedAt = time.Unix(createdAt, 0)
+	prompt.UpdatedAt = time.Unix(updatedAt, 0)
+	if lastRunAt.Valid {
+		t := time.Unix(lastRunAt.Int64, 0)
+		prompt.LastRunAt = &t
+	}
+	return &prompt, nil
+}
 
-	return &session, nil
+// GetSavedPrompt retrieves one of the user's saved prompts
+func (s *Store) GetSavedPrompt(ctx context.Context, userID, id string) (*SavedPrompt, error) {
+	row := s.db.QueryRowContext(ctx, `SELECT `+savedPromptColumns+` FROM saved_prompts WHERE id = ? AND user_id = ?`, id, userID)
+	prompt, err := scanSavedPrompt(row)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("saved prompt not found")
+	}
+	return prompt, err
 }
 
-// ListChatSessions retrieves all chat sessions for a notebook
-func (s *Store) ListChatSessions(ctx context.Context, notebookID string) ([]ChatSession, error) {
-	rows, err := s.db.QueryContext(ctx, `
-		SELECT id, notebook_id, title, created_at, updated_at, metadata
-		FROM chat_sessions WHERE notebook_id = ? ORDER BY updated_at DESC
-	`, notebookID)
+// ListSavedPrompts lists the saved prompts of a user by title
+func (s *Store) ListSavedPrompts(ctx context.Context, userID string) ([]SavedPrompt, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT `+savedPromptColumns+` FROM saved_prompts WHERE user_id = ? ORDER BY title COLLATE NOCASE, created_at`, userID)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	sessions := make([]ChatSession, 0)
+	prompts := make([]SavedPrompt, 0)
 	for rows.Next() {
-		var session ChatSession
-		var metadataJSON string
-		var createdAt, updatedAt int64
-
-		if err := rows.Scan(&session.ID, &session.NotebookID, &session.Title, &createdAt, &updatedAt, &metadataJSON); err != nil {
+		prompt, err := scanSavedPrompt(rows)
+		if err != nil {
 			return nil, err
 		}
+		prompts = append(prompts, *prompt)
+	}
+	return prompts, rows.Err()
+}
 
-		session.CreatedAt = time.Unix(createdAt, 0)
-		session.UpdatedAt = time.Unix(updatedAt, 0)
+// UpdateSavedPrompt saves the title, text and variables of a saved prompt
+func (s *Store) UpdateSavedPrompt(ctx context.Context, prompt *SavedPrompt) error {
+	prompt.UpdatedAt = time.Now()
+	variablesJSON, _ := json.Marshal(prompt.Variables)
+	result, err := s.db.ExecContext(ctx, `
+		UPDATE saved_prompts SET title = ?, text = ?, variables = ?, updated_at = ?
+		WHERE id = ? AND user_id = ?
+	`, prompt.Title, prompt.Text, string(variablesJSON), prompt.UpdatedAt.Unix(), prompt.ID, prompt.UserID)
+	if err != nil {
+		return err
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return fmt.Errorf("saved prompt not found")
+	}
+	return nil
+}
 
-		if metadataJSON != "" {
-			json.Unmarshal([]byte(metadataJSON), &session.Metadata)
-		} else {
-			session.Metadata = make(map[string]interface{})
-		}
+// TouchSavedPrompt records that a saved prompt was just run
+func (s *Store) TouchSavedPrompt(ctx context.Context, id string) error {
+	_, err := s.db.ExecContext(ctx, `UPDATE saved_prompts SET last_run_at = ? WHERE id = ?`, time.Now().Unix(), id)
+	return err
+}
 
-		sessions = append(sessions, session)
+// DeleteSavedPrompt removes one of the user's saved prompts
+func (s *Store) DeleteSavedPrompt(ctx context.Context, userID, id string) error {
+	result, err := s.db.ExecContext(ctx, `DELETE FROM saved_prompts WHERE id = ? AND user_id = ?`, id, userID)
+	if err != nil {
+		return err
 	}
-
-	return sessions, nil
+	if n, _ := result.RowsAffected(); n == 0 {
+		return fmt.Errorf("saved prompt not found")
+	}
+	return nil
 }
 
-// AddChatMessage adds a message to a chat session
-func (s *Store) AddChatMessage(ctx context.Context, sessionID, role, content string, sources []string) (*ChatMessage, error) {
-	id := uuid.New().String()
-	now := time.Now()
+// RecordUsage stores the usage of an LLM or image call
+func (s *Store) RecordUsage(ctx context.Context, record *UsageRecord) error {
+	record.ID = uuid.New().String()
+	record.CreatedAt = time.Now()
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO usage (id, user_id, notebook_id, operation, model, prompt_tokens, completion_tokens, images, cost, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
+	`, record.ID, record.UserID, record.NotebookID, record.Operation, record.Model, record.PromptTokens,
+		record.CompletionTokens, record.Images, record.Cost, record.CreatedAt.Unix())
+	return err
+}
 
-	metadataJSON, _ := json.Marshal(map[string]interface{}{})
-	sourcesJSON, _ := json.Marshal(sources)
+// exportEventQueries select the events of each stream after a cursor, oldest first
+var exportEventQueries = map[string]string{
+	"activity": `
+		SELECT id, user_id, action, resource_type, resource_id, resource_name, details, created_at
+		FROM activity_logs
+		WHERE (created_at > ? OR (created_at = ? AND id > ?)) AND created_at < ?
+		ORDER BY created_at, id LIMIT ?`,
+	"usage": `
+		SELECT id, user_id, notebook_id, operation, model, prompt_tokens, completion_tokens, images, cost, created_at
+		FROM usage
+		WHERE (created_at > ? OR (created_at = ? AND id > ?)) AND created_at < ?
+		ORDER BY created_at, id LIMIT ?`,
+}
 
-	_, err := s.db.ExecContext(ctx, `
-		INSERT INTO chat_messages (id, session_id, role, content, sources, created_at, metadata)
-		VALUES (?, ?, ?, ?, ?, ?, ?)
-	`, id, sessionID, role, content, string(sourcesJSON), now.Unix(), string(metadataJSON))
+// ListExportEvents returns up to limit events of the "activity" or "usage" stream after a
+// cursor and created before until, oldest first
+func (s *Store) ListExportEvents(ctx context.Context, stream string, after EventCursor, until time.Time, limit int) ([]ExportedEvent, error) {
+	query, ok := exportEventQueries[stream]
+	if !ok {
+		return nil, fmt.Errorf("unknown event stream: %s", stream)
+	}
+	rows, err := s.db.QueryContext(ctx, query, after.CreatedAt, after.CreatedAt, after.ID, until.Unix(), limit)
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 
-	// Update session timestamp
-	_, err = s.db.ExecContext(ctx, `UPDATE chat_sessions SET updated_at = ? WHERE id = ?`, now.Unix(), sessionID)
-	if err != nil {
-		return nil, err
+	events := make([]ExportedEvent, 0)
+	for rows.Next() {
+		event := ExportedEvent{Type: stream}
+		var createdAt int64
+		if stream == "activity" {
+			var resourceType, resourceID, resourceName, details sql.NullString
+			if err := rows.Scan(&event.ID, &event.UserID, &event.Action, &resourceType, &resourceID, &resourceName, &details, &createdAt); err != nil {
+				return nil, err
+			}
+			event.ResourceType = resourceType.String
+			event.ResourceID = resourceID.String
+			event.ResourceName = resourceName.String
+			if details.String != "" {
+				json.Unmarshal([]byte(details.String), &event.Details)
+			}
+			if event.ResourceType == "notebook" {
+				event.NotebookID = event.ResourceID
+			} else if id, ok := event.Details["notebook_id"].(string); ok {
+				event.NotebookID = id
+			}
+		} else {
+			if err := rows.Scan(&event.ID, &event.UserID, &event.NotebookID, &event.Action, &event.Model, &event.PromptTokens,
+				&event.CompletionTokens, &event.Images, &event.Cost, &createdAt); err != nil {
+				return nil, err
+			}
+		}
+		event.CreatedAt = time.Unix(createdAt, 0)
+		events = append(events, event)
 	}
+	return events, rows.Err()
+}
 
-	return s.getChatMessage(ctx, id)
+// GetEventExportCursor returns the last exported event of a stream, the zero cursor if none was
+func (s *Store) GetEventExportCursor(ctx context.Context, stream string) (EventCursor, error) {
+	var cursor EventCursor
+	err := s.db.QueryRowContext(ctx, `SELECT exported_until, last_id FROM event_exports WHERE stream = ?`, stream).
+		Scan(&cursor.CreatedAt, &cursor.ID)
+	if err == sql.ErrNoRows {
+		return EventCursor{}, nil
+	}
+	return cursor, err
 }
 
-// listChatMessages retrieves all messages for a session
-func (s *Store) listChatMessages(ctx context.Context, sessionID string) ([]ChatMessage, error) {
-	rows, err := s.db.QueryContext(ctx, `
-		SELECT id, session_id, role, content, sources, created_at, metadata
-		FROM chat_messages WHERE session_id = ? ORDER BY created_at ASC
-	`, sessionID)
+// SetEventExportCursor records the last exported event of a stream
+func (s *Store) SetEventExportCursor(ctx context.Context, stream string, cursor EventCursor) error {
+	_, err := s.db.ExecContext(ctx, `
+		INSERT INTO event_exports (stream, exported_until, last_id, updated_at) VALUES (?, ?, ?, ?)
+		ON CONFLICT(stream) DO UPDATE SET exported_until = excluded.exported_until, last_id = excluded.last_id,
+			updated_at = excluded.updated_at
+	`, stream, cursor.CreatedAt, cursor.ID, time.Now().Unix())
+	return err
+}
+
+// usageGroups are the SQL expressions usage can be grouped by
+var usageGroups = map[string]string{
+	"operation": "u.operation",
+	"model":     "u.model",
+	"day":       "strftime('%Y-%m-%d', u.created_at, 'unixepoch', 'localtime')",
+	"user":      "COALESCE(users.email, u.user_id)",
+}
+
+// SumUsage totals the usage of a user, or of all users if userID is empty, between since and
+// until, grouped by "operation", "model", "day" or "user"
+func (s *Store) SumUsage(ctx context.Context, userID string, since, until time.Time, groupBy string) ([]UsageTotals, error) {
+	key, ok := usageGroups[groupBy]
+	if !ok {
+		return nil, fmt.Errorf("unknown usage grouping: %s", groupBy)
+	}
+	query := `SELECT ` + key + `, COUNT(*), COALESCE(SUM(u.prompt_tokens), 0), COALESCE(SUM(u.completion_tokens), 0),
+			COALESCE(SUM(u.images), 0), COALESCE(SUM(u.cost), 0)
+		FROM usage u LEFT JOIN users ON users.id = u.user_id
+		WHERE u.created_at >= ? AND u.created_at < ?`
+	args := []any{since.Unix(), until.Unix()}
+	if userID != "" {
+		query += ` AND u.user_id = ?`
+		args = append(args, userID)
+	}
+	query += ` GROUP BY 1 ORDER BY 1`
+	rows, err := s.db.QueryContext(ctx, query, args...)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	messages := make([]ChatMessage, 0)
+	totals := make([]UsageTotals, 0)
 	for rows.Next() {
-		var msg ChatMessage
-		var metadataJSON, sourcesJSON string
-		var createdAt int64
-
-		if err := rows.Scan(&msg.ID, &msg.SessionID, &msg.Role, &msg.Content, &sourcesJSON, &createdAt, &metadataJSON); err != nil {
+		var t UsageTotals
+		if err := rows.Scan(&t.Key, &t.Calls, &t.PromptTokens, &t.CompletionTokens, &t.Images, &t.Cost); err != nil {
 			return nil, err
 		}
+		totals = append(totals, t)
+	}
+	return totals, rows.Err()
+}
 
-		msg.CreatedAt = time.Unix(createdAt, 0)
+// CreateConnector stores a new connector of a notebook, with its secret encrypted
+func (s *Store) CreateConnector(ctx context.Context, connector *Connector) error {
+	secret, err := encryptSecret(s.secretKey, connector.Secret)
+	if err != nil {
+		return err
+	}
+	connector.ID = uuid.New().String()
+	connector.CreatedAt = time.Now()
+	settingsJSON, _ := json.Marshal(connector.Settings)
+	_, err = s.db.ExecContext(ctx, `
+		INSERT INTO connectors (id, notebook_id, user_id, kind, name, settings, secret, created_at)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+	`, connector.ID, connector.NotebookID, connector.UserID, connector.Kind, connector.Name, string(settingsJSON),
+		secret, connector.CreatedAt.Unix())
+	return err
+}
 
-		if metadataJSON != "" {
-			json.Unmarshal([]byte(metadataJSON), &msg.Metadata)
-		} else {
-			msg.Metadata = make(map[string]interface{})
+// encryptConnectorSecrets encrypts the connector secrets still stored in plain text
+func (s *Store) encryptConnectorSecrets() error {
+	rows, err := s.db.Query(`SELECT id, secret FROM connectors WHERE secret != '' AND secret NOT LIKE ?`, secretPrefix+"%")
+	if err != nil {
+		return err
+	}
+	plain := make(map[string]string)
+	for rows.Next() {
+		var id, secret string
+		if err := rows.Scan(&id, &secret); err != nil {
+			rows.Close()
+			return err
 		}
+		plain[id] = secret
+	}
+	rows.Close()
 
-		if sourcesJSON != "" {
-			json.Unmarshal([]byte(sourcesJSON), &msg.Sources)
+	for id, secret := range plain {
+		encrypted, err := encryptSecret(s.secretKey, secret)
+		if err != nil {
+			return err
+		}
+		if _, err := s.db.Exec(`UPDATE connectors SET secret = ? WHERE id = ?`, encrypted, id); err != nil {
+			return err
 		}
+	}
+	return nil
+}
 
-		messages = append(messages, msg)
+// hashIngestHookTokens replaces the ingest hook tokens stored as they are by their hashes
+func (s *Store) hashIngestHookTokens() error {
+	rows, err := s.db.Query(`SELECT id, token FROM ingest_hooks WHERE token NOT LIKE ?`, hookTokenPrefix+"%")
+	if err != nil {
+		return err
+	}
+	plain := make(map[string]string)
+	for rows.Next() {
+		var id, token string
+		if err := rows.Scan(&id, &token); err != nil {
+			rows.Close()
+			return err
+		}
+		plain[id] = token
 	}
+	rows.Close()
 
-	return messages, nil
+	for id, token := range plain {
+		if _, err := s.db.Exec(`UPDATE ingest_hooks SET token = ? WHERE id = ?`, hookTokenHash(token), id); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
-// getChatMessage retrieves a single message by ID
-func (s *Store) getChatMessage(ctx context.Context, id string) (*ChatMessage, error) {
-	var msg ChatMessage
-	var metadataJSON, sourcesJSON string
+// scanConnector scans a connectors row selected with connectorColumns and decrypts its secret.
+// A secret that fails to decrypt is left empty and reported as the connector's last error.
+func (s *Store) scanConnector(row interface{ Scan(...any) error }) (*Connector, error) {
+	var connector Connector
+	var name, cursor, lastError sql.NullString
+	var settingsJSON, secret string
 	var createdAt int64
-
-	err := s.db.QueryRowContext(ctx, `
-		SELECT id, session_id, role, content, sources, created_at, metadata
-		FROM chat_messages WHERE id = ?
-	`, id).Scan(&msg.ID, &msg.SessionID, &msg.Role, &msg.Content, &sourcesJSON, &createdAt, &metadataJSON)
-	if err == sql.ErrNoRows {
-		return nil, fmt.Errorf("chat message not found")
+	var lastSyncedAt sql.NullInt64
+	if err := row.Scan(&connector.ID, &connector.NotebookID, &connector.UserID, &connector.Kind, &name, &settingsJSON,
+		&secret, &cursor, &lastSyncedAt, &lastError, &createdAt); err != nil {
+		return nil, err
 	}
+	json.Unmarshal([]byte(settingsJSON), &connector.Settings)
+	connector.Name = name.String
+	connector.Cursor = cursor.String
+	connector.LastError = lastError.String
+	plain, err := decryptSecret(s.secretKey, secret)
 	if err != nil {
-		return nil, err
+		connector.LastError = "secret: " + err.Error()
 	}
+	connector.Secret = plain
+	connector.CreatedAt = time.Unix(createdAt, 0)
+	if lastSyncedAt.Valid {
+		t := time.Unix(lastSyncedAt.Int64, 0)
+		connector.LastSyncedAt = &t
+	}
+	return &connector, nil
+}
 
-	msg.CreatedAt = time.Unix(createdAt, 0)
+const connectorColumns = `id, notebook_id, user_id, kind, name, settings, secret, cursor, last_synced_at, last_error, created_at`
 
-	if metadataJSON != "" {
-		json.Unmarshal([]byte(metadataJSON), &msg.Metadata)
-	} else {
-		msg.Metadata = make(map[string]interface{})
+// GetConnector retrieves a connector by ID
+func (s *Store) GetConnector(ctx context.Context, id string) (*Connector, error) {
+	row := s.db.QueryRowContext(ctx, `SELECT `+connectorColumns+` FROM connectors WHERE id = ?`, id)
+	connector, err := s.scanConnector(row)
+	if err == sql.ErrNoRows {
+		return nil, fmt.Errorf("connector not found")
 	}
+	return connector, err
+}
 
-	if sourcesJSON != "" {
-		json.Unmarshal([]byte(sourcesJSON), &msg.Sources)
+// ListConnectors lists the connectors of a notebook, or of all notebooks if notebookID is empty
+func (s *Store) ListConnectors(ctx context.Context, notebookID string) ([]Connector, error) {
+	query := `SELECT ` + connectorColumns + ` FROM connectors`
+	var args []any
+	if notebookID != "" {
+		query += ` WHERE notebook_id = ?`
+		args = append(args, notebookID)
+	}
+	rows, err := s.db.QueryContext(ctx, query+` ORDER BY created_at`, args...)
+	if err != nil {
+		return nil, err
 	}
+	defer rows.Close()
 
-	return &msg, nil
+	connectors := make([]Connector, 0)
+	for rows.Next() {
+		connector, err := s.scanConnector(rows)
+		if err != nil {
+			return nil, err
+		}
+		connectors = append(connectors, *connector)
+	}
+	return connectors, rows.Err()
 }
 
-// DeleteChatSession deletes a chat session
-func (s *Store) DeleteChatSession(ctx context.Context, id string) error {
-	_, err := s.db.ExecContext(ctx, `DELETE FROM chat_sessions WHERE id = ?`, id)
+// UpdateConnectorSync records the outcome of a connector sync; syncErr is empty on success.
+// The settings are saved too, as a sync may fill in some, such as a SharePoint drive ID.
+func (s *Store) UpdateConnectorSync(ctx context.Context, connector *Connector, syncErr string) error {
+	settingsJSON, _ := json.Marshal(connector.Settings)
+	_, err := s.db.ExecContext(ctx, `UPDATE connectors SET settings = ?, cursor = ?, last_synced_at = ?, last_error = ? WHERE id = ?`,
+		string(settingsJSON), connector.Cursor, time.Now().Unix(), syncErr, connector.ID)
 	return err
 }
 
-// LogActivity logs a user activity to both database and audit log file
-func (s *Store) LogActivity(ctx context.Context, log *ActivityLog) error {
-	if log.ID == "" {
-		log.ID = uuid.New().String()
+// DeleteConnector removes a connector of a notebook. Sources it imported are kept.
+func (s *Store) DeleteConnector(ctx context.Context, notebookID, id string) error {
+	result, err := s.db.ExecContext(ctx, `DELETE FROM connectors WHERE id = ? AND notebook_id = ?`, id, notebookID)
+	if err != nil {
+		return err
 	}
-	if log.CreatedAt.IsZero() {
-		log.CreatedAt = time.Now()
+	if n, _ := result.RowsAffected(); n == 0 {
+		return fmt.Errorf("connector not found")
 	}
+	return nil
+}
 
-	// Write to database
+// GetConnectorItem returns the source an item of a connector was imported as and the item's
+// version then. found is false for items never imported; sourceID is empty if the source was
+// deleted since.
+func (s *Store) GetConnectorItem(ctx context.Context, connectorID, itemKey string) (sourceID, version string, found bool, err error) {
+	var source sql.NullString
+	err = s.db.QueryRowContext(ctx, `SELECT source_id, version FROM connector_items WHERE connector_id = ? AND item_key = ?`,
+		connectorID, itemKey).Scan(&source, &version)
+	if err == sql.ErrNoRows {
+		return "", "", false, nil
+	}
+	return source.String, version, err == nil, err
+}
+
+// SaveConnectorItem records the source an item of a connector was imported as, and its version
+func (s *Store) SaveConnectorItem(ctx context.Context, connectorID, itemKey, sourceID, version string) error {
 	_, err := s.db.ExecContext(ctx, `
-		INSERT INTO activity_logs (id, user_id, action, resource_type, resource_id, resource_name, details, ip_address, user_agent, created_at)
-		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)
-	`, log.ID, log.UserID, log.Action, log.ResourceType, log.ResourceID, log.ResourceName, log.Details, log.IPAddress, log.UserAgent, log.CreatedAt.Unix())
+		INSERT INTO connector_items (connector_id, item_key, source_id, version) VALUES (?, ?, NULLIF(?, ''), ?)
+		ON CONFLICT(connector_id, item_key) DO UPDATE SET source_id = excluded.source_id, version = excluded.version
+	`, connectorID, itemKey, sourceID, version)
+	return err
+}
 
-	// Also write to audit log file (async, don't fail if it errors)
-	LogUserActivity(log.Action, log.UserID, log.ResourceType, log.ResourceID, log.ResourceName, log.Details, log.IPAddress, log.UserAgent)
+// ListConnectorItemKeys returns the keys of the items a connector has seen
+func (s *Store) ListConnectorItemKeys(ctx context.Context, connectorID string) ([]string, error) {
+	rows, err := s.db.QueryContext(ctx, `SELECT item_key FROM connector_items WHERE connector_id = ?`, connectorID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
 
-	return err
+	keys := make([]string, 0)
+	for rows.Next() {
+		var key string
+		if err := rows.Scan(&key); err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+	}
+	return keys, rows.Err()
 }
 
-// Close closes the database connection
-func (s *Store) Close() error {
-	return s.db.Close()
+// DeleteConnectorItem forgets an item of a connector
+func (s *Store) DeleteConnectorItem(ctx context.Context, connectorID, itemKey string) error {
+	_, err := s.db.ExecContext(ctx, `DELETE FROM connector_items WHERE connector_id = ? AND item_key = ?`, connectorID, itemKey)
+	return err
 }
@@ -0,0 +1,531 @@
+package backend
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// storeContractWorkers is how many goroutines write at once in the concurrency checks
+const storeContractWorkers = 8
+
+// storeContractWrites is how many writes each of those goroutines makes
+const storeContractWrites = 10
+
+// storeContractCheck is a behavior the rest of the app relies on, which every store backend
+// must keep
+type storeContractCheck struct {
+	name string
+	run  func(ctx context.Context, s *Store, userID, notebookID string) error
+}
+
+var storeContractChecks = []storeContractCheck{
+	{"metadata round-trips", checkMetadataRoundTrip},
+	{"note content round-trips inline and as a blob", checkNoteContentRoundTrip},
+	{"private notes and sources stay private", checkPrivateFlags},
+	{"foreign keys are enforced on every connection", checkForeignKeys},
+	{"deleting a notebook cascades to its contents", checkCascadeDelete},
+	{"failed transactions leave nothing behind", checkTransactionRollback},
+	{"concurrent writes are all kept", checkConcurrentWrites},
+	{"concurrent revisions get distinct versions", checkConcurrentRevisions},
+	{"generated assets are kept while referenced", checkAssetReferences},
+}
+
+// TestStoreContract runs the store contract against the SQLite store
+func TestStoreContract(t *testing.T) {
+	testStoreContract(t, func(t *testing.T) *Store {
+		dir := t.TempDir()
+		store, err := NewStore(Config{
+			StorePath:       filepath.Join(dir, "checkpoints.db"),
+			BlobStoragePath: filepath.Join(dir, "blobs"),
+			// Small, so that blobs are checked
+			NoteInlineContentLimit: 1024,
+		})
+		if err != nil {
+			t.Fatalf("failed to initialize store: %v", err)
+		}
+		t.Cleanup(func() { store.Close() })
+		return store
+	})
+}
+
+// testStoreContract runs each check of the store contract on a fresh store from newStore, in a
+// notebook of a user made for it. A new store backend must pass every check before the app
+// can use it.
+func testStoreContract(t *testing.T, newStore func(t *testing.T) *Store) {
+	for _, check := range storeContractChecks {
+		t.Run(check.name, func(t *testing.T) {
+			ctx := context.Background()
+			s := newStore(t)
+			user := &User{Email: "store-contract@notex.invalid", Name: "Store contract", Provider: "password"}
+			if err := s.CreateUser(ctx, user); err != nil {
+				t.Fatalf("failed to create user: %v", err)
+			}
+			notebook, err := s.CreateNotebook(ctx, user.ID, "Store contract: "+check.name, "", nil)
+			if err != nil {
+				t.Fatalf("failed to create notebook: %v", err)
+			}
+			if err := check.run(ctx, s, user.ID, notebook.ID); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+// contractMetadata is metadata of every JSON type, with text that needs escaping
+func contractMetadata(kind string) map[string]interface{} {
+	return map[string]interface{}{
+		"kind":    kind,
+		"text":    "中文 \"quoted\" ✓\n",
+		"number":  42.5,
+		"integer": float64(1 << 40),
+		"bool":    true,
+		"null":    nil,
+		"list":    []interface{}{float64(1), "two", false},
+		"nested":  map[string]interface{}{"key": "value", "empty": map[string]interface{}{}},
+	}
+}
+
+// sameJSON reports whether two values encode to the same JSON
+func sameJSON(a, b interface{}) error {
+	aj, _ := json.Marshal(a)
+	bj, _ := json.Marshal(b)
+	if string(aj) != string(bj) {
+		return fmt.Errorf("got %s, want %s", bj, aj)
+	}
+	return nil
+}
+
+func checkMetadataRoundTrip(ctx context.Context, s *Store, userID, notebookID string) error {
+	updated, err := s.UpdateNotebook(ctx, notebookID, "Store contract", "", contractMetadata("notebook"))
+	if err != nil {
+		return err
+	}
+	notebook, err := s.GetNotebook(ctx, updated.ID)
+	if err != nil {
+		return err
+	}
+	if err := sameJSON(contractMetadata("notebook"), notebook.Metadata); err != nil {
+		return fmt.Errorf("notebook metadata: %w", err)
+	}
+
+	source := &Source{NotebookID: notebookID, Name: "source", Type: "text", Content: "content", Metadata: contractMetadata("source")}
+	if err := s.CreateSource(ctx, source); err != nil {
+		return err
+	}
+	gotSource, err := s.GetSource(ctx, source.ID)
+	if err != nil {
+		return err
+	}
+	if err := sameJSON(contractMetadata("source"), gotSource.Metadata); err != nil {
+		return fmt.Errorf("source metadata: %w", err)
+	}
+
+	note := &Note{NotebookID: notebookID, Title: "note", Content: "content", Type: "custom", SourceIDs: []string{source.ID}, Metadata: contractMetadata("note")}
+	if err := s.CreateNote(ctx, note); err != nil {
+		return err
+	}
+	gotNote, err := s.GetNote(ctx, note.ID)
+	if err != nil {
+		return err
+	}
+	if err := sameJSON(contractMetadata("note"), gotNote.Metadata); err != nil {
+		return fmt.Errorf("note metadata: %w", err)
+	}
+	if err := sameJSON(note.SourceIDs, gotNote.SourceIDs); err != nil {
+		return fmt.Errorf("note source IDs: %w", err)
+	}
+
+	session, err := s.CreateChatSession(ctx, notebookID, "chat")
+	if err != nil {
+		return err
+	}
+	if _, err := s.AddChatMessage(ctx, session.ID, "assistant", "answer", []string{source.ID}, contractMetadata("message")); err != nil {
+		return err
+	}
+	gotSession, err := s.GetChatSession(ctx, session.ID)
+	if err != nil {
+		return err
+	}
+	if len(gotSession.Messages) != 1 {
+		return fmt.Errorf("chat session has %d messages, want 1", len(gotSession.Messages))
+	}
+	if err := sameJSON(contractMetadata("message"), gotSession.Messages[0].Metadata); err != nil {
+		return fmt.Errorf("chat message metadata: %w", err)
+	}
+	return nil
+}
+
+func checkNoteContentRoundTrip(ctx context.Context, s *Store, userID, notebookID string) error {
+	contents := map[string]string{"inline": "短内容 with **markdown**"}
+	if s.noteInlineLimit > 0 {
+		contents["blob"] = strings.Repeat("长内容 ", s.noteInlineLimit/len("长内容 ")+1)
+	}
+	for kind, content := range contents {
+		note := &Note{NotebookID: notebookID, Title: kind, Content: content, Type: "custom"}
+		if err := s.CreateNote(ctx, note); err != nil {
+			return err
+		}
+		got, err := s.GetNote(ctx, note.ID)
+		if err != nil {
+			return err
+		}
+		if got.Content != content {
+			return fmt.Errorf("%s note content: got %d bytes, want %d", kind, len(got.Content), len(content))
+		}
+
+		// Lists leave blob content out until it is loaded
+		notes, err := s.ListNotes(ctx, notebookID)
+		if err != nil {
+			return err
+		}
+		for i := range notes {
+			if notes[i].ID != note.ID {
+				continue
+			}
+			if notes[i].ContentExternal != (kind == "blob") {
+				return fmt.Errorf("listed %s note: content_external is %v", kind, notes[i].ContentExternal)
+			}
+			if err := s.LoadNoteContent(ctx, &notes[i]); err != nil {
+				return err
+			}
+			if notes[i].Content != content {
+				return fmt.Errorf("loaded %s note content: got %d bytes, want %d", kind, len(notes[i].Content), len(content))
+			}
+		}
+
+		// A revision moves the content between inline and blob storage
+		revised := content + " revised"
+		if kind == "blob" {
+			revised = "short again"
+		}
+		if _, err := s.ReviseNote(ctx, got, got.Title, revised, got.Metadata); err != nil {
+			return err
+		}
+		got, err = s.GetNote(ctx, note.ID)
+		if err != nil {
+			return err
+		}
+		if got.Content != revised {
+			return fmt.Errorf("revised %s note content: got %q", kind, got.Content)
+		}
+	}
+	return nil
+}
+
+func checkPrivateFlags(ctx context.Context, s *Store, userID, notebookID string) error {
+	source := &Source{NotebookID: notebookID, Name: "private source", Type: "text", Content: "content", Private: true}
+	if err := s.CreateSource(ctx, source); err != nil {
+		return err
+	}
+	// Saving other fields keeps the flag
+	source.Metadata = contractMetadata("source")
+	if err := s.UpdateSourceMetadata(ctx, source); err != nil {
+		return err
+	}
+	hidden, err := s.ListPrivateSourceIDs(ctx, notebookID)
+	if err != nil {
+		return err
+	}
+	if !hidden[source.ID] || len(hidden) != 1 {
+		return fmt.Errorf("private source IDs: got %v, want only %s", hidden, source.ID)
+	}
+
+	note := &Note{NotebookID: notebookID, Title: "note", Content: "content", Type: "custom"}
+	if err := s.CreateNote(ctx, note); err != nil {
+		return err
+	}
+	if _, err := s.SetNoteShare(ctx, note.ID, true, nil); err != nil {
+		return err
+	}
+	got, err := s.SetNotePrivate(ctx, note.ID, true)
+	if err != nil {
+		return err
+	}
+	if _, err := s.ReviseNote(ctx, got, got.Title, "revised", got.Metadata); err != nil {
+		return err
+	}
+	if got, err = s.GetNote(ctx, note.ID); err != nil {
+		return err
+	}
+	if !got.Private {
+		return fmt.Errorf("note is no longer private after a revision")
+	}
+	if _, _, err := s.GetNoteByShareToken(ctx, got.ShareToken); err == nil {
+		return fmt.Errorf("the share link of a private note still works")
+	}
+	if _, err := s.SetNotePrivate(ctx, note.ID, false); err != nil {
+		return err
+	}
+	if _, _, err := s.GetNoteByShareToken(ctx, got.ShareToken); err != nil {
+		return fmt.Errorf("the share link of a visible note: %w", err)
+	}
+	return nil
+}
+
+func checkForeignKeys(ctx context.Context, s *Store, userID, notebookID string) error {
+	// Connections are held at once, so the pool has to open new ones
+	for i := range storeContractWorkers {
+		conn, err := s.db.Conn(ctx)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		var enabled int
+		if err := conn.QueryRowContext(ctx, "PRAGMA foreign_keys").Scan(&enabled); err != nil {
+			return err
+		}
+		if enabled != 1 {
+			return fmt.Errorf("foreign keys are off on connection %d", i+1)
+		}
+	}
+	return nil
+}
+
+func checkCascadeDelete(ctx context.Context, s *Store, userID, notebookID string) error {
+	notebook, err := s.CreateNotebook(ctx, userID, "Store contract: cascade", "", nil)
+	if err != nil {
+		return err
+	}
+	source := &Source{NotebookID: notebook.ID, Name: "source", Type: "text", Content: "v1"}
+	if err := s.CreateSource(ctx, source); err != nil {
+		return err
+	}
+	if _, err := s.ReplaceSourceContent(ctx, source, "v2", "", 0); err != nil {
+		return err
+	}
+	note := &Note{NotebookID: notebook.ID, Title: "note", Content: "v1", Type: "custom"}
+	if err := s.CreateNote(ctx, note); err != nil {
+		return err
+	}
+	if _, err := s.ReviseNote(ctx, note, note.Title, "v2", note.Metadata); err != nil {
+		return err
+	}
+	session, err := s.CreateChatSession(ctx, notebook.ID, "chat")
+	if err != nil {
+		return err
+	}
+	if _, err := s.AddChatMessage(ctx, session.ID, "user", "question", nil, nil); err != nil {
+		return err
+	}
+
+	if err := s.DeleteNotebook(ctx, notebook.ID); err != nil {
+		return err
+	}
+	if _, err := s.GetSource(ctx, source.ID); err == nil {
+		return fmt.Errorf("source outlived its notebook")
+	}
+	if _, err := s.GetNote(ctx, note.ID); err == nil {
+		return fmt.Errorf("note outlived its notebook")
+	}
+	if _, err := s.GetChatSession(ctx, session.ID); err == nil {
+		return fmt.Errorf("chat session outlived its notebook")
+	}
+	for _, orphan := range []struct{ table, column, id string }{
+		{"source_versions", "source_id", source.ID},
+		{"note_versions", "note_id", note.ID},
+		{"chat_messages", "session_id", session.ID},
+	} {
+		var count int
+		if err := s.db.QueryRowContext(ctx, "SELECT COUNT(*) FROM "+orphan.table+" WHERE "+orphan.column+" = ?", orphan.id).Scan(&count); err != nil {
+			return err
+		}
+		if count > 0 {
+			return fmt.Errorf("%d rows of %s outlived their parent", count, orphan.table)
+		}
+	}
+	return nil
+}
+
+func checkTransactionRollback(ctx context.Context, s *Store, userID, notebookID string) error {
+	// The second message reuses the first one's ID, so the session's insert must be undone
+	messageID := uuid.New().String()
+	now := time.Now()
+	session := &ChatSession{
+		ID:         uuid.New().String(),
+		NotebookID: notebookID,
+		Title:      "chat",
+		CreatedAt:  now,
+		UpdatedAt:  now,
+		Messages: []ChatMessage{
+			{ID: messageID, Role: "user", Content: "question", CreatedAt: now},
+			{ID: messageID, Role: "assistant", Content: "answer", CreatedAt: now},
+		},
+	}
+	if err := s.RestoreChatSession(ctx, session); err == nil {
+		return fmt.Errorf("restoring a chat session with a duplicate message ID succeeded")
+	}
+	if _, err := s.GetChatSession(ctx, session.ID); err == nil {
+		return fmt.Errorf("chat session of a failed restore was kept")
+	}
+
+	versionID := uuid.New().String()
+	note := &Note{
+		ID:         uuid.New().String(),
+		NotebookID: notebookID,
+		Title:      "note",
+		Content:    "content",
+		Type:       "custom",
+		CreatedAt:  now,
+		UpdatedAt:  now,
+	}
+	versions := []NoteVersion{
+		{ID: versionID, Version: 1, Title: "note", Content: "v1", CreatedAt: now},
+		{ID: versionID, Version: 2, Title: "note", Content: "v2", CreatedAt: now},
+	}
+	if err := s.RestoreNote(ctx, note, versions); err == nil {
+		return fmt.Errorf("restoring a note with a duplicate version ID succeeded")
+	}
+	if _, err := s.GetNote(ctx, note.ID); err == nil {
+		return fmt.Errorf("note of a failed restore was kept")
+	}
+	return nil
+}
+
+// runConcurrently calls write from storeContractWorkers goroutines storeContractWrites times
+// each, returning the first error
+func runConcurrently(write func(worker, i int) error) error {
+	errs := make(chan error, storeContractWorkers*storeContractWrites)
+	var wg sync.WaitGroup
+	for worker := range storeContractWorkers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range storeContractWrites {
+				if err := write(worker, i); err != nil {
+					errs <- err
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	return <-errs
+}
+
+func checkConcurrentWrites(ctx context.Context, s *Store, userID, notebookID string) error {
+	session, err := s.CreateChatSession(ctx, notebookID, "chat")
+	if err != nil {
+		return err
+	}
+	err = runConcurrently(func(worker, i int) error {
+		note := &Note{NotebookID: notebookID, Title: fmt.Sprintf("note %d-%d", worker, i), Content: "content", Type: "custom"}
+		if err := s.CreateNote(ctx, note); err != nil {
+			return fmt.Errorf("failed to create note: %w", err)
+		}
+		if _, err := s.AddChatMessage(ctx, session.ID, "user", note.Title, nil, nil); err != nil {
+			return fmt.Errorf("failed to add chat message: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	want := storeContractWorkers * storeContractWrites
+	notes, err := s.ListNotes(ctx, notebookID)
+	if err != nil {
+		return err
+	}
+	if len(notes) != want {
+		return fmt.Errorf("notebook has %d notes, want %d", len(notes), want)
+	}
+	got, err := s.GetChatSession(ctx, session.ID)
+	if err != nil {
+		return err
+	}
+	if len(got.Messages) != want {
+		return fmt.Errorf("chat session has %d messages, want %d", len(got.Messages), want)
+	}
+	return nil
+}
+
+func checkConcurrentRevisions(ctx context.Context, s *Store, userID, notebookID string) error {
+	note := &Note{NotebookID: notebookID, Title: "note", Content: "v0", Type: "custom"}
+	if err := s.CreateNote(ctx, note); err != nil {
+		return err
+	}
+	err := runConcurrently(func(worker, i int) error {
+		// Each writer revises its own copy, as concurrent requests do
+		current := *note
+		if _, err := s.ReviseNote(ctx, &current, note.Title, fmt.Sprintf("v%d-%d", worker, i), nil); err != nil {
+			return fmt.Errorf("failed to revise note: %w", err)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	versions, err := s.ListNoteVersions(ctx, note.ID)
+	if err != nil {
+		return err
+	}
+	want := storeContractWorkers * storeContractWrites
+	seen := make(map[int]bool, len(versions))
+	for _, v := range versions {
+		seen[v.Version] = true
+	}
+	if len(versions) != want || len(seen) != want {
+		return fmt.Errorf("note has %d versions numbered %d ways, want %d", len(versions), len(seen), want)
+	}
+	return nil
+}
+
+func checkAssetReferences(ctx context.Context, s *Store, userID, notebookID string) error {
+	asset := &GeneratedAsset{UserID: userID, FileName: "asset_contract.png", SHA256: "contract", Size: 1}
+	if err := s.RegisterAsset(ctx, asset); err != nil {
+		return err
+	}
+	// Unused assets are listed from before a time, so a time to come lists them right away
+	unused := func() (bool, error) {
+		assets, err := s.ListUnusedAssets(ctx, time.Now().Add(time.Hour))
+		for _, a := range assets {
+			if a.UserID == userID && a.FileName == asset.FileName {
+				return true, err
+			}
+		}
+		return false, err
+	}
+
+	var notes []*Note
+	for i := 0; i < 2; i++ {
+		note := &Note{NotebookID: notebookID, Title: "slides", Content: "slides", Type: "ppt",
+			Metadata: map[string]interface{}{"slides": []interface{}{"/api/files/" + asset.FileName}}}
+		if err := s.CreateNote(ctx, note); err != nil {
+			return err
+		}
+		notes = append(notes, note)
+	}
+	for i, note := range notes {
+		if err := s.DeleteNote(ctx, note.ID); err != nil {
+			return err
+		}
+		count, err := s.CountAssetRefs(ctx, userID, asset.FileName)
+		if err != nil {
+			return err
+		}
+		isUnused, err := unused()
+		if err != nil {
+			return err
+		}
+		if want := len(notes) - i - 1; count != want || isUnused != (want == 0) {
+			return fmt.Errorf("asset has %d references and unused %v after deleting %d notes, want %d", count, isUnused, i+1, want)
+		}
+	}
+	deleted, err := s.DeleteUnusedAsset(ctx, userID, asset.FileName)
+	if err != nil {
+		return err
+	}
+	if !deleted {
+		return fmt.Errorf("unused asset was not deleted")
+	}
+	return nil
+}
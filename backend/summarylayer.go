@@ -0,0 +1,215 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/kataras/golog"
+	"github.com/tmc/langchaingo/prompts"
+	"github.com/tmc/langchaingo/schema"
+)
+
+// summaryGroupSize is how many chunks, or summaries of the layer below, one summary covers
+const summaryGroupSize = 8
+
+// summaryMatches is how many summaries a question is matched against before the chunks under
+// them are searched
+const summaryMatches = 3
+
+// SummarizeSource writes the summary layer of a long source: a summary of every
+// summaryGroupSize chunks, then summaries of those summaries, up to one summary of the whole
+// source.
+func (a *Agent) SummarizeSource(ctx context.Context, sourceName string, chunks []textChunk) ([]SummaryNode, error) {
+	layer := make([]SummaryNode, len(chunks))
+	for i, chunk := range chunks {
+		layer[i] = chunk.node(i)
+		layer[i].FirstChunk, layer[i].LastChunk = i, i
+	}
+
+	var nodes []SummaryNode
+	for level := 1; len(layer) > 1; level++ {
+		kind := "原文片段"
+		if level > 1 {
+			kind = "各部分的摘要"
+		}
+
+		var next []SummaryNode
+		for first := 0; first < len(layer); first += summaryGroupSize {
+			group := layer[first:min(first+summaryGroupSize, len(layer))]
+			texts := make([]string, len(group))
+			for i, node := range group {
+				texts[i] = node.Content
+			}
+			summary, err := a.summarizeSection(ctx, sourceName, kind, strings.Join(texts, "\n\n"))
+			if err != nil {
+				return nil, err
+			}
+			last := group[len(group)-1]
+			next = append(next, SummaryNode{
+				Layer:      level,
+				Position:   len(next),
+				FirstChunk: group[0].FirstChunk,
+				LastChunk:  last.LastChunk,
+				Start:      group[0].Start,
+				End:        last.End,
+				FirstPage:  group[0].FirstPage,
+				LastPage:   last.LastPage,
+				StartTime:  group[0].StartTime,
+				EndTime:    last.EndTime,
+				Chapter:    group[0].Chapter,
+				Content:    summary,
+			})
+		}
+		nodes = append(nodes, next...)
+		layer = next
+	}
+	return nodes, nil
+}
+
+// summarizeSection summarizes one run of a source's chunks or summaries. MODEL_ROUTES can send
+// these calls to a cheaper model under the key "source_summary".
+func (a *Agent) summarizeSection(ctx context.Context, sourceName, kind, text string) (string, error) {
+	promptTemplate := prompts.NewPromptTemplate(sourceSectionSummaryPrompt(), []string{"source", "kind", "text"})
+	promptTemplate.TemplateFormat = prompts.TemplateFormatFString
+	promptValue, err := promptTemplate.Format(map[string]any{
+		"source": sourceName,
+		"kind":   kind,
+		"text":   text,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to format prompt: %w", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, a.cfg.TransformationTimeout)
+	defer cancel()
+	summary, err := a.generateFor(ctx, "source_summary", promptValue)
+	if err != nil {
+		return "", fmt.Errorf("failed to summarize %s: %w", sourceName, err)
+	}
+	if summary = strings.TrimSpace(summary); summary == "" {
+		return "", fmt.Errorf("the model returned an empty summary of %s", sourceName)
+	}
+	return summary, nil
+}
+
+// searchChunks searches a notebook's chunks for Retrieve. When long sources have summary
+// layers, the summaries closest to the query are found first and the chunks they cover are
+// searched, so passages from the matching sections come first; the notebook-wide results follow.
+func (a *Agent) searchChunks(ctx context.Context, notebookID, query string, numDocs int) ([]schema.Document, error) {
+	docs, err := a.vectorStore.SimilaritySearch(ctx, notebookID, query, numDocs)
+	if err != nil || a.cfg.SummaryLayerThreshold <= 0 {
+		return docs, err
+	}
+	summaries, err := a.vectorStore.searchIn(ctx, notebookID, query, summaryMatches, searchScope{summaries: true})
+	if err != nil {
+		golog.Warnf("summary search failed, searching chunks only: %v", err)
+		return docs, nil
+	}
+	if len(summaries) == 0 {
+		return docs, nil
+	}
+
+	// The matched sections fill about half of the results
+	perSummary := max(1, numDocs/(2*len(summaries)))
+	seen := make(map[chunkKey]bool)
+	merged := make([]schema.Document, 0, numDocs)
+	add := func(doc schema.Document) {
+		sourceID, _ := doc.Metadata["source_id"].(string)
+		sourceName, _ := doc.Metadata["source"].(string)
+		chunk, _ := doc.Metadata["chunk"].(int)
+		key := chunkKey{sourceID, sourceName, chunk}
+		if !seen[key] {
+			seen[key] = true
+			merged = append(merged, doc)
+		}
+	}
+	for _, summary := range summaries {
+		span := &chunkSpan{}
+		span.sourceID, _ = summary.Metadata["source_id"].(string)
+		span.sourceName, _ = summary.Metadata["source"].(string)
+		span.first, _ = summary.Metadata["first_chunk"].(int)
+		span.last, _ = summary.Metadata["last_chunk"].(int)
+		drilled, err := a.vectorStore.searchIn(ctx, notebookID, query, perSummary, searchScope{within: span})
+		if err != nil {
+			golog.Warnf("failed to search the chunks under a summary of %s: %v", span.sourceName, err)
+			continue
+		}
+		for _, doc := range drilled {
+			add(doc)
+		}
+	}
+	for _, doc := range docs {
+		add(doc)
+	}
+	return merged[:min(len(merged), numDocs)], nil
+}
+
+// indexSourceSummaries adds the summary layer of a source of at least SUMMARY_LAYER_THRESHOLD
+// characters to the vector store. Summaries stored for the source's current content are reused;
+// otherwise they are written in the background. indexed says the vector store already has the
+// source, and so any stored summaries.
+func (s *Server) indexSourceSummaries(ctx context.Context, source *Source, indexed bool) {
+	if s.cfg.SummaryLayerThreshold <= 0 || utf8.RuneCountInString(source.Content) < s.cfg.SummaryLayerThreshold {
+		return
+	}
+	// Summaries of rows wouldn't answer much the table query tool can't
+	if isTabular(*source) {
+		return
+	}
+
+	hash := chunkContentHash(source.Content, s.cfg.ChunkSize, s.cfg.ChunkOverlap)
+	nodes, err := s.store.GetSourceSummaries(ctx, source.ID, hash)
+	if err != nil {
+		golog.Warnf("failed to load the summaries of source %s: %v", source.Name, err)
+	}
+	if len(nodes) > 0 {
+		if indexed {
+			return
+		}
+		if err := s.vectorStore.IngestSummaries(ctx, source.NotebookID, source.ID, source.Name, nodes); err != nil {
+			golog.Errorf("failed to index the summaries of source %s: %v", source.Name, err)
+		}
+		return
+	}
+
+	agent := s.currentAgent()
+	if agent == nil {
+		return
+	}
+	if _, running := s.summaryJobs.LoadOrStore(source.ID+"/"+hash, true); running {
+		return
+	}
+	go s.summarizeSource(agent, *source, hash)
+}
+
+// summarizeSource writes, stores and indexes the summary layer of a source, one LLM call per
+// summary. The summaries are dropped if the source changed or was deleted meanwhile.
+func (s *Server) summarizeSource(agent *Agent, source Source, hash string) {
+	defer s.summaryJobs.Delete(source.ID + "/" + hash)
+	ctx := s.withNotebookUsage(context.Background(), source.NotebookID)
+
+	chunks := s.vectorStore.splitText(source.Content, s.cfg.ChunkSize, s.cfg.ChunkOverlap)
+	golog.Infof("writing the summary layer of source %s (%d chunks)", source.Name, len(chunks))
+	nodes, err := agent.SummarizeSource(ctx, source.Name, chunks)
+	if err != nil {
+		golog.Errorf("failed to write the summary layer of source %s: %v", source.Name, err)
+		return
+	}
+
+	current, err := s.store.GetSource(ctx, source.ID)
+	if err != nil || chunkContentHash(current.Content, s.cfg.ChunkSize, s.cfg.ChunkOverlap) != hash {
+		golog.Infof("source %s changed while it was summarized, dropping its summaries", source.Name)
+		return
+	}
+	if err := s.store.SaveSourceSummaries(ctx, source.ID, hash, nodes); err != nil {
+		golog.Errorf("failed to save the summaries of source %s: %v", source.Name, err)
+		return
+	}
+	if err := s.vectorStore.IngestSummaries(ctx, source.NotebookID, source.ID, source.Name, nodes); err != nil {
+		golog.Errorf("failed to index the summaries of source %s: %v", source.Name, err)
+		return
+	}
+	golog.Infof("indexed %d summaries of source %s", len(nodes), source.Name)
+}
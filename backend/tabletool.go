@@ -0,0 +1,453 @@
+package backend
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/kataras/golog"
+)
+
+const (
+	// tableToolName is the function name of the built-in tool that queries tabular sources
+	tableToolName = "query_tables"
+	// tableMaxRows bounds the rows loaded from each table
+	tableMaxRows = 100000
+	// tableMaxDescribed bounds the tables and columns listed in the tool description
+	tableMaxDescribed = 20
+	// tableQueryMaxRows bounds the rows of a query result the model sees
+	tableQueryMaxRows = 50
+	// tableQueryTimeout bounds how long a query runs
+	tableQueryTimeout = 5 * time.Second
+	// tableIndexedRows is how many rows of each table are indexed for search, so that passages
+	// show what the table holds; the rest are only queried
+	tableIndexedRows = 20
+)
+
+var (
+	// tableSeparatorRe matches the line under the header of a Markdown table: | --- | :---: |
+	tableSeparatorRe = regexp.MustCompile(`^\|?\s*:?-{3,}:?\s*(\|\s*:?-{3,}:?\s*)*\|?$`)
+	// tableQueryRe matches the start of the read-only statements a query may be
+	tableQueryRe = regexp.MustCompile(`(?i)^(select|with)\b`)
+)
+
+// dataTable is a table of a CSV or spreadsheet source, with SQL names for it and its columns
+type dataTable struct {
+	name    string
+	source  string
+	columns []string
+	numeric []bool // Whether every value of a column is a number
+	rows    [][]string
+}
+
+// isTabular reports whether a source is a CSV, TSV or Excel file
+func isTabular(source Source) bool {
+	switch strings.ToLower(filepath.Ext(source.FileName)) {
+	case ".csv", ".tsv", ".xlsx", ".xls":
+		return true
+	}
+	return false
+}
+
+// sourceTables returns the tables of a CSV, TSV or Excel source, or none for other sources. CSV
+// and TSV files are kept as they are; each sheet of a workbook is a Markdown table under a
+// "## sheet" heading.
+func sourceTables(source Source) []dataTable {
+	base := strings.TrimSuffix(source.Name, filepath.Ext(source.Name))
+	var tables []dataTable
+	switch strings.ToLower(filepath.Ext(source.FileName)) {
+	case ".csv":
+		tables = delimitedTable(base, source.Content, ',')
+	case ".tsv":
+		tables = delimitedTable(base, source.Content, '\t')
+	case ".xlsx", ".xls":
+		tables = markdownTables(base, source.Content)
+	}
+	for i := range tables {
+		tables[i].source = source.Name
+		tables[i].prepare()
+	}
+	return tables
+}
+
+// delimitedTable reads CSV or TSV text whose first row holds the column names
+func delimitedTable(name, content string, delimiter rune) []dataTable {
+	reader := csv.NewReader(strings.NewReader(strings.TrimPrefix(content, "\ufeff")))
+	reader.Comma = delimiter
+	reader.FieldsPerRecord = -1
+	reader.LazyQuotes = true
+	records, err := reader.ReadAll()
+	if err != nil || len(records) < 2 {
+		return nil
+	}
+	return []dataTable{{name: name, columns: records[0], rows: records[1:]}}
+}
+
+// markdownTables reads the Markdown tables of content, naming each after the heading above it
+func markdownTables(name, content string) []dataTable {
+	var tables []dataTable
+	heading := ""
+	lines := strings.Split(content, "\n")
+	for i := 0; i < len(lines); i++ {
+		line := strings.TrimSpace(lines[i])
+		if strings.HasPrefix(line, "#") {
+			heading = strings.TrimSpace(strings.TrimLeft(line, "#"))
+			continue
+		}
+		if !strings.HasPrefix(line, "|") || i+1 >= len(lines) || !tableSeparatorRe.MatchString(strings.TrimSpace(lines[i+1])) {
+			continue
+		}
+		table := dataTable{name: name, columns: markdownCells(line)}
+		if heading != "" {
+			table.name = name + "_" + heading
+		}
+		for i += 2; i < len(lines) && strings.HasPrefix(strings.TrimSpace(lines[i]), "|"); i++ {
+			table.rows = append(table.rows, markdownCells(strings.TrimSpace(lines[i])))
+		}
+		if len(table.rows) > 0 {
+			tables = append(tables, table)
+		}
+	}
+	// A workbook with one sheet is named after the file alone
+	if len(tables) == 1 {
+		tables[0].name = name
+	}
+	return tables
+}
+
+// markdownCells splits a Markdown table row into its cells, unescaping "\|" in them. pandas
+// writes empty cells as NaN.
+func markdownCells(line string) []string {
+	line = strings.TrimPrefix(strings.TrimSuffix(line, "|"), "|")
+	cells := strings.Split(strings.ReplaceAll(line, `\|`, "\x00"), "|")
+	for i, cell := range cells {
+		cells[i] = strings.ReplaceAll(strings.TrimSpace(cell), "\x00", "|")
+		if cells[i] == "NaN" {
+			cells[i] = ""
+		}
+	}
+	return cells
+}
+
+// tableOmittedSpans returns the character spans of the rows of a tabular source past the first
+// tableIndexedRows of each table, which are left out of the search index
+func tableOmittedSpans(source Source) [][2]int {
+	if !isTabular(source) {
+		return nil
+	}
+	ext := strings.ToLower(filepath.Ext(source.FileName))
+	delimited := ext == ".csv" || ext == ".tsv"
+	lines := strings.SplitAfter(source.Content, "\n")
+	starts := make([]int, len(lines)+1) // Character offset of each line, and of the end
+	for i, line := range lines {
+		starts[i+1] = starts[i] + utf8.RuneCountInString(line)
+	}
+
+	var spans [][2]int
+	if delimited {
+		// The first line is the header; quoted values spanning lines only shift the cut
+		if first := 1 + tableIndexedRows; first < len(lines) {
+			spans = append(spans, [2]int{starts[first], starts[len(lines)]})
+		}
+		return spans
+	}
+	for i := 0; i+1 < len(lines); i++ {
+		if !strings.HasPrefix(strings.TrimSpace(lines[i]), "|") || !tableSeparatorRe.MatchString(strings.TrimSpace(lines[i+1])) {
+			continue
+		}
+		first := i + 2 // The first row
+		end := first
+		for end < len(lines) && strings.HasPrefix(strings.TrimSpace(lines[end]), "|") {
+			end++
+		}
+		if first+tableIndexedRows < end {
+			spans = append(spans, [2]int{starts[first+tableIndexedRows], starts[end]})
+		}
+		i = end - 1
+	}
+	return spans
+}
+
+// prepare gives the table and its columns SQL names, evens out its rows and finds which columns
+// are numeric
+func (t *dataTable) prepare() {
+	t.name = sqlName(t.name, "table")
+	if len(t.rows) > tableMaxRows {
+		t.rows = t.rows[:tableMaxRows]
+	}
+	seen := make(map[string]bool)
+	for i, column := range t.columns {
+		name := sqlName(column, fmt.Sprintf("column_%d", i+1))
+		for n := 2; seen[strings.ToLower(name)]; n++ {
+			name = fmt.Sprintf("%s_%d", sqlName(column, "column"), n)
+		}
+		seen[strings.ToLower(name)] = true
+		t.columns[i] = name
+	}
+
+	t.numeric = make([]bool, len(t.columns))
+	for i := range t.numeric {
+		t.numeric[i] = true
+	}
+	for r, row := range t.rows {
+		if len(row) < len(t.columns) {
+			row = append(row, make([]string, len(t.columns)-len(row))...)
+		}
+		row = row[:len(t.columns)]
+		t.rows[r] = row
+		for i, value := range row {
+			if _, ok := parseTableNumber(value); value != "" && !ok {
+				t.numeric[i] = false
+			}
+		}
+	}
+}
+
+// parseTableNumber reads a number as spreadsheets write it, allowing thousands separators
+func parseTableNumber(value string) (float64, bool) {
+	n, err := strconv.ParseFloat(strings.ReplaceAll(strings.TrimSpace(value), ",", ""), 64)
+	return n, err == nil
+}
+
+// sqlName turns a file, sheet or column name into an identifier that needs no quoting, keeping
+// letters of any script
+func sqlName(name, fallback string) string {
+	var b strings.Builder
+	underscore := false
+	for _, r := range strings.ToLower(strings.TrimSpace(name)) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			b.WriteRune(r)
+			underscore = false
+		} else if !underscore && b.Len() > 0 {
+			b.WriteByte('_')
+			underscore = true
+		}
+	}
+	result := strings.TrimRight(b.String(), "_")
+	if result == "" {
+		return fallback
+	}
+	if unicode.IsDigit([]rune(result)[0]) {
+		return "t_" + result
+	}
+	return result
+}
+
+// notebookTables returns the tables of a notebook's tabular sources, with unique names
+func (s *Server) notebookTables(ctx context.Context, notebookID string) []dataTable {
+	sources, err := s.store.ListSources(ctx, notebookID)
+	if err != nil {
+		golog.Errorf("failed to list sources for table queries: %v", err)
+		return nil
+	}
+	var tables []dataTable
+	seen := make(map[string]bool)
+	for _, source := range sources {
+		for _, table := range sourceTables(source) {
+			name := table.name
+			for n := 2; seen[name]; n++ {
+				name = fmt.Sprintf("%s_%d", table.name, n)
+			}
+			seen[name] = true
+			table.name = name
+			tables = append(tables, table)
+		}
+	}
+	return tables
+}
+
+// tableTool describes the built-in table query tool to the model, listing the tables with their
+// columns and a first row as an example
+func tableTool(notebookID string, tables []dataTable) ChatTool {
+	var b strings.Builder
+	b.WriteString("Run one read-only SQLite SELECT query over the tables loaded from the notebook's CSV and Excel sources. " +
+		"Use it for counts, sums, averages, rankings and other calculations over the data instead of reading the table " +
+		"from the source passages. Tables:")
+	for i, table := range tables {
+		if i == tableMaxDescribed {
+			fmt.Fprintf(&b, "\n- and %d more tables", len(tables)-i)
+			break
+		}
+		fmt.Fprintf(&b, "\n- %s (from %s, %d rows):", table.name, table.source, len(table.rows))
+		for c, column := range table.columns {
+			if c == tableMaxDescribed {
+				b.WriteString(" …")
+				break
+			}
+			kind := "TEXT"
+			if table.numeric[c] {
+				kind = "REAL"
+			}
+			fmt.Fprintf(&b, " %s %s", column, kind)
+			if c < len(table.columns)-1 {
+				b.WriteByte(',')
+			}
+		}
+		if len(table.rows) > 0 {
+			fmt.Fprintf(&b, "; first row: %s", strings.Join(table.rows[0][:min(len(table.rows[0]), tableMaxDescribed)], " | "))
+		}
+	}
+
+	return ChatTool{
+		NotebookID:  notebookID,
+		Name:        tableToolName,
+		Description: b.String(),
+		Parameters: map[string]interface{}{
+			"type": "object",
+			"properties": map[string]interface{}{
+				"sql": map[string]interface{}{"type": "string", "description": "A single SELECT statement in SQLite syntax"},
+			},
+			"required": []string{"sql"},
+		},
+		Enabled: true,
+	}
+}
+
+// queryTables loads the tables into an in-memory SQLite database and runs a SELECT query the
+// model wrote, returning the result as CSV
+func queryTables(ctx context.Context, tables []dataTable, arguments string) (string, error) {
+	var args struct {
+		SQL string `json:"sql"`
+	}
+	if err := json.Unmarshal([]byte(arguments), &args); err != nil {
+		return "", fmt.Errorf("arguments must be a JSON object with a sql field")
+	}
+	query := strings.TrimSpace(strings.TrimRight(strings.TrimSpace(args.SQL), ";"))
+	if !tableQueryRe.MatchString(query) || strings.Contains(query, ";") {
+		return "", fmt.Errorf("only a single SELECT statement is allowed")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, tableQueryTimeout)
+	defer cancel()
+	db, err := sql.Open("sqlite", "file::memory:")
+	if err != nil {
+		return "", err
+	}
+	defer db.Close()
+	// Every connection to :memory: is a database of its own
+	db.SetMaxOpenConns(1)
+	if err := loadTables(ctx, db, tables); err != nil {
+		return "", fmt.Errorf("failed to load tables: %w", err)
+	}
+	if _, err := db.ExecContext(ctx, "PRAGMA query_only = ON"); err != nil {
+		return "", err
+	}
+
+	rows, err := db.QueryContext(ctx, query)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+	return queryResultCSV(rows)
+}
+
+// queryResultCSV writes the rows of a query result as CSV, with its column names first and at
+// most tableQueryMaxRows rows
+func queryResultCSV(rows *sql.Rows) (string, error) {
+	columns, err := rows.Columns()
+	if err != nil {
+		return "", err
+	}
+
+	var b strings.Builder
+	writer := csv.NewWriter(&b)
+	writer.Write(columns)
+	values := make([]any, len(columns))
+	pointers := make([]any, len(columns))
+	for i := range values {
+		pointers[i] = &values[i]
+	}
+	count := 0
+	for rows.Next() {
+		if count == tableQueryMaxRows {
+			writer.Flush()
+			fmt.Fprintf(&b, "(only the first %d rows are shown)\n", tableQueryMaxRows)
+			return b.String(), nil
+		}
+		if err := rows.Scan(pointers...); err != nil {
+			return "", err
+		}
+		record := make([]string, len(values))
+		for i, value := range values {
+			switch v := value.(type) {
+			case nil:
+				record[i] = ""
+			case float64:
+				record[i] = strconv.FormatFloat(v, 'f', -1, 64)
+			case []byte:
+				record[i] = string(v)
+			case time.Time:
+				record[i] = v.Format(time.RFC3339)
+			default:
+				record[i] = fmt.Sprint(v)
+			}
+		}
+		writer.Write(record)
+		count++
+	}
+	if err := rows.Err(); err != nil {
+		return "", err
+	}
+	writer.Flush()
+	if count == 0 {
+		b.WriteString("(no rows)\n")
+	}
+	return b.String(), nil
+}
+
+// loadTables creates the tables in db and inserts their rows, with NULL for empty values
+func loadTables(ctx context.Context, db *sql.DB, tables []dataTable) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, table := range tables {
+		definitions := make([]string, len(table.columns))
+		for i, column := range table.columns {
+			kind := "TEXT"
+			if table.numeric[i] {
+				kind = "REAL"
+			}
+			definitions[i] = fmt.Sprintf(`"%s" %s`, column, kind)
+		}
+		if _, err := tx.ExecContext(ctx, fmt.Sprintf(`CREATE TABLE "%s" (%s)`, table.name, strings.Join(definitions, ", "))); err != nil {
+			return err
+		}
+
+		insert, err := tx.PrepareContext(ctx, fmt.Sprintf(`INSERT INTO "%s" VALUES (%s)`,
+			table.name, strings.TrimSuffix(strings.Repeat("?, ", len(table.columns)), ", ")))
+		if err != nil {
+			return err
+		}
+		values := make([]any, len(table.columns))
+		for _, row := range table.rows {
+			for i, value := range row {
+				switch n, ok := parseTableNumber(value); {
+				case value == "":
+					values[i] = nil
+				case table.numeric[i] && ok:
+					values[i] = n
+				default:
+					values[i] = value
+				}
+			}
+			if _, err := insert.ExecContext(ctx, values...); err != nil {
+				insert.Close()
+				return err
+			}
+		}
+		insert.Close()
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,425 @@
+package backend
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/kataras/golog"
+)
+
+const telegramAPIBase = "https://api.telegram.org"
+
+// telegramMaxMessageLength is Telegram's limit on message text
+const telegramMaxMessageLength = 4096
+
+// telegramMaxFileSize is the largest file the Bot API lets bots download
+const telegramMaxFileSize = 20 * 1024 * 1024
+
+// telegramLinkLifetime is how long a code linking a Telegram account to the bot stays valid
+const telegramLinkLifetime = 10 * time.Minute
+
+// telegramHelp describes what the Telegram bot understands
+const telegramHelp = "用法：\n" +
+	"• /notebook <名称> 选择本聊天使用的笔记本\n" +
+	"• /list 列出可用的笔记本\n" +
+	"• 转发文章或发送文件：添加为来源\n" +
+	"• 直接发送消息：基于笔记本来源回答问题"
+
+// telegramUpdate is the subset of a Bot API update the bot handles
+type telegramUpdate struct {
+	UpdateID int64            `json:"update_id"`
+	Message  *telegramMessage `json:"message"`
+}
+
+type telegramMessage struct {
+	MessageID int64 `json:"message_id"`
+	From      *struct {
+		ID int64 `json:"id"`
+	} `json:"from"` // Empty for messages posted to channels
+	Chat struct {
+		ID int64 `json:"id"`
+	} `json:"chat"`
+	Text          string            `json:"text"`
+	Caption       string            `json:"caption"`
+	Document      *telegramDocument `json:"document"`
+	ForwardOrigin json.RawMessage   `json:"forward_origin"`
+	ForwardDate   int64             `json:"forward_date"` // Pre Bot API 7.0 forwards
+}
+
+type telegramDocument struct {
+	FileID   string `json:"file_id"`
+	FileName string `json:"file_name"`
+	FileSize int64  `json:"file_size"`
+}
+
+// forwarded reports whether the message was forwarded from another chat
+func (m *telegramMessage) forwarded() bool {
+	return len(m.ForwardOrigin) > 0 || m.ForwardDate != 0
+}
+
+// telegramCall invokes a Bot API method and decodes its result
+func telegramCall(ctx context.Context, token, method string, payload, result any) error {
+	body, err := postJSON(ctx, http.MethodPost, fmt.Sprintf("%s/bot%s/%s", telegramAPIBase, token, method), payload, nil)
+	var resp struct {
+		OK          bool            `json:"ok"`
+		Description string          `json:"description"`
+		Result      json.RawMessage `json:"result"`
+	}
+	if jsonErr := json.Unmarshal(body, &resp); jsonErr != nil {
+		if err != nil {
+			// Don't leak the bot token from the request URL into logs
+			return fmt.Errorf("telegram %s failed", method)
+		}
+		return jsonErr
+	}
+	if !resp.OK {
+		return fmt.Errorf("telegram %s: %s", method, resp.Description)
+	}
+	if result != nil {
+		return json.Unmarshal(resp.Result, result)
+	}
+	return nil
+}
+
+// setTelegramWebhook points the bot's webhook at this server
+func setTelegramWebhook(ctx context.Context, in *Integration, webhookURL string) error {
+	return telegramCall(ctx, in.BotToken, "setWebhook", map[string]any{
+		"url":             webhookURL,
+		"secret_token":    in.SigningSecret,
+		"allowed_updates": []string{"message"},
+	}, nil)
+}
+
+// handleTelegramLinkCode returns a one-time code that links the caller's Telegram account to
+// their bot: sending "/start <code>" to the bot lets that account use it in that chat
+func (s *Server) handleTelegramLinkCode(c *gin.Context) {
+	ctx := c.Request.Context()
+	in, err := s.store.GetIntegrationByProvider(ctx, c.GetString("user_id"), IntegrationTelegram)
+	if err != nil {
+		c.JSON(http.StatusNotFound, ErrorResponse{Error: "Telegram integration not found"})
+		return
+	}
+	code, err := randomToken()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to generate link code"})
+		return
+	}
+	expiresAt := time.Now().Add(telegramLinkLifetime)
+	if err := s.store.SetTelegramLinkCode(ctx, in.ID, telegramCodeHash(code), expiresAt); err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to save link code"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"code": code, "command": "/start " + code, "expires_at": expiresAt})
+}
+
+// handleDeleteTelegramLinks unlinks every Telegram account from the caller's bot
+func (s *Server) handleDeleteTelegramLinks(c *gin.Context) {
+	ctx := c.Request.Context()
+	in, err := s.store.GetIntegrationByProvider(ctx, c.GetString("user_id"), IntegrationTelegram)
+	if err != nil {
+		c.JSON(http.StatusNotFound, ErrorResponse{Error: "Telegram integration not found"})
+		return
+	}
+	if err := s.store.DeleteTelegramLinks(ctx, in.ID); err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to unlink Telegram accounts"})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// handleTelegramWebhook receives bot updates. Telegram retries until it gets a 200,
+// so updates are acknowledged right away and handled in the background.
+func (s *Server) handleTelegramWebhook(c *gin.Context) {
+	in, body, ok := s.loadIntegration(c, IntegrationTelegram)
+	if !ok {
+		return
+	}
+	secret := c.GetHeader("X-Telegram-Bot-Api-Secret-Token")
+	if !hmac.Equal([]byte(secret), []byte(in.SigningSecret)) {
+		c.JSON(http.StatusUnauthorized, ErrorResponse{Error: "Invalid secret token"})
+		return
+	}
+
+	var update telegramUpdate
+	if err := json.Unmarshal(body, &update); err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid update"})
+		return
+	}
+
+	if msg := update.Message; msg != nil {
+		go func() {
+			ctx := context.Background()
+			reply := s.handleTelegramMessage(ctx, in, msg)
+			if reply == "" {
+				return
+			}
+			if err := telegramCall(ctx, in.BotToken, "sendMessage", map[string]any{
+				"chat_id":          msg.Chat.ID,
+				"text":             truncateRunes(reply, telegramMaxMessageLength),
+				"reply_parameters": map[string]any{"message_id": msg.MessageID},
+			}, nil); err != nil {
+				golog.Errorf("failed to send telegram reply: %v", err)
+			}
+		}()
+	}
+
+	c.Status(http.StatusOK)
+}
+
+// telegramCodeHash is how link codes are stored, so that the database doesn't hold usable codes
+func telegramCodeHash(code string) string {
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+// handleTelegramMessage handles one message and returns the reply text. Anyone can find and
+// message a bot, so only the owner's Telegram account, in the chats it linked with
+// "/start <code>", acts for the owner; every other message is ignored without a reply.
+func (s *Server) handleTelegramMessage(ctx context.Context, in *Integration, msg *telegramMessage) string {
+	if msg.From == nil {
+		return ""
+	}
+	text := strings.TrimSpace(msg.Text)
+	command, arg, _ := strings.Cut(text, " ")
+	command, _, _ = strings.Cut(command, "@") // Commands in groups carry the bot name
+	arg = strings.TrimSpace(arg)
+
+	if command == "/start" && arg != "" && !msg.forwarded() {
+		linked, err := s.store.ConsumeTelegramLinkCode(ctx, in.ID, telegramCodeHash(arg))
+		if err != nil {
+			golog.Errorf("failed to check telegram link code: %v", err)
+			return ""
+		}
+		if !linked {
+			auditLogger.Infof("telegram link of integration %s refused for user %d in chat %d", in.ID, msg.From.ID, msg.Chat.ID)
+			return ""
+		}
+		if err := s.store.AddTelegramLink(ctx, in.ID, msg.Chat.ID, msg.From.ID); err != nil {
+			golog.Errorf("failed to link telegram chat: %v", err)
+			return "绑定失败，请重新生成绑定码"
+		}
+		return "绑定成功。\n" + telegramHelp
+	}
+
+	allowed, err := s.store.IsTelegramLinked(ctx, in.ID, msg.Chat.ID, msg.From.ID)
+	if err != nil {
+		golog.Errorf("failed to check telegram link: %v", err)
+		return ""
+	}
+	if !allowed {
+		return ""
+	}
+
+	if strings.HasPrefix(text, "/") && !msg.forwarded() {
+		switch command {
+		case "/list":
+			return s.runIntegrationCommand(ctx, in.UserID, integrationCommand{Action: "list"})
+		case "/notebook":
+			if arg == "" {
+				notebook := s.telegramChatNotebook(ctx, in, msg.Chat.ID)
+				if notebook == nil {
+					return "尚未选择笔记本，请使用 /notebook <名称>"
+				}
+				return fmt.Sprintf("当前笔记本：「%s」", notebook.Name)
+			}
+			notebook, err := s.findNotebook(ctx, in.UserID, arg)
+			if err != nil {
+				return fmt.Sprintf("找不到笔记本「%s」", arg)
+			}
+			if err := s.store.SetTelegramChatNotebook(ctx, in.ID, msg.Chat.ID, notebook.ID); err != nil {
+				golog.Errorf("failed to select telegram notebook: %v", err)
+				return "切换笔记本失败"
+			}
+			return fmt.Sprintf("已切换到「%s」", notebook.Name)
+		default:
+			return telegramHelp
+		}
+	}
+
+	notebook := s.telegramChatNotebook(ctx, in, msg.Chat.ID)
+	if notebook == nil {
+		return "请先使用 /notebook <名称> 选择笔记本"
+	}
+
+	switch {
+	case msg.Document != nil:
+		source, err := s.captureTelegramDocument(ctx, in, notebook, msg.Document)
+		if err != nil {
+			golog.Errorf("failed to capture telegram document: %v", err)
+			return "添加文件失败：" + err.Error()
+		}
+		return fmt.Sprintf("已添加来源「%s」到「%s」", source.Name, notebook.Name)
+
+	case msg.forwarded():
+		content := text
+		if content == "" {
+			content = strings.TrimSpace(msg.Caption)
+		}
+		if content == "" {
+			return "无法识别转发的内容"
+		}
+		source, err := s.captureTelegramText(ctx, in, notebook, content)
+		if err != nil {
+			golog.Errorf("failed to capture telegram message: %v", err)
+			return "添加来源失败"
+		}
+		return fmt.Sprintf("已添加来源「%s」到「%s」", source.Name, notebook.Name)
+
+	case text != "":
+		return s.runIntegrationCommand(ctx, in.UserID, integrationCommand{Action: "ask", Notebook: notebook.ID, Question: text})
+	}
+
+	return ""
+}
+
+// telegramChatNotebook returns the notebook selected for a chat, or nil if none is selected or it was deleted
+func (s *Server) telegramChatNotebook(ctx context.Context, in *Integration, chatID int64) *Notebook {
+	notebookID, err := s.store.GetTelegramChatNotebook(ctx, in.ID, chatID)
+	if err != nil || notebookID == "" {
+		return nil
+	}
+	notebook, err := s.store.GetNotebook(ctx, notebookID)
+	if err != nil || notebook.UserID != in.UserID {
+		return nil
+	}
+	return notebook
+}
+
+// captureTelegramText adds forwarded text as a source. A forwarded link is fetched as an article.
+func (s *Server) captureTelegramText(ctx context.Context, in *Integration, notebook *Notebook, content string) (*Source, error) {
+	source := &Source{
+		NotebookID: notebook.ID,
+		Name:       quickNoteTitle(content),
+		Type:       "text",
+		Content:    content,
+		Metadata:   map[string]interface{}{"telegram": true},
+	}
+
+	if u, err := url.Parse(content); err == nil && (u.Scheme == "http" || u.Scheme == "https") && !strings.ContainsAny(content, " \n") {
+		link := &Source{URL: content, Metadata: source.Metadata}
+		if article, err := s.extractURL(ctx, link, s.defaultURLParser()); err == nil {
+			source.Type = "url"
+			source.URL = content
+			source.Name = content
+			source.Content = article
+		} else {
+			golog.Warnf("failed to fetch forwarded link, storing it as text: %v", err)
+		}
+	}
+
+	err := s.captureSource(ctx, source, &ActivityLog{UserID: in.UserID, Action: "telegram_capture", UserAgent: "telegram"})
+	return source, err
+}
+
+// captureTelegramDocument downloads a file sent to the bot and adds it as a source, like an upload
+func (s *Server) captureTelegramDocument(ctx context.Context, in *Integration, notebook *Notebook, doc *telegramDocument) (*Source, error) {
+	if doc.FileSize > telegramMaxFileSize {
+		return nil, fmt.Errorf("文件超过 20MB")
+	}
+
+	var file struct {
+		FilePath string `json:"file_path"`
+	}
+	if err := telegramCall(ctx, in.BotToken, "getFile", map[string]string{"file_id": doc.FileID}, &file); err != nil {
+		return nil, err
+	}
+
+	// The sender names the file, so only its base name is kept
+	name := filepath.Base(strings.ReplaceAll(doc.FileName, `\`, "/"))
+	if name == "." || name == ".." || name == "/" {
+		name = filepath.Base(file.FilePath)
+	}
+	if name == "." || name == ".." || name == "/" {
+		return nil, fmt.Errorf("无效的文件名")
+	}
+	ext := filepath.Ext(name)
+	uniqueFileName := fmt.Sprintf("%s_%s%s", strings.TrimSuffix(name, ext), uuid.New().String()[:8], ext)
+
+	userUploadDir := filepath.Join(s.cfg.UploadDir, in.UserID)
+	if err := os.MkdirAll(userUploadDir, 0755); err != nil {
+		return nil, err
+	}
+	path := filepath.Join(userUploadDir, uniqueFileName)
+
+	size, err := downloadTelegramFile(ctx, in.BotToken, file.FilePath, path)
+	if err != nil {
+		os.Remove(path)
+		return nil, err
+	}
+
+	scan, err := s.scanUpload(ctx, path)
+	if err != nil {
+		if scan == nil {
+			os.Remove(path)
+		}
+		return nil, err
+	}
+	content, _, err := s.extractDocument(ctx, path)
+	if err != nil {
+		os.Remove(path)
+		return nil, err
+	}
+
+	source := &Source{
+		NotebookID: notebook.ID,
+		Name:       name,
+		Type:       "file",
+		FileName:   uniqueFileName,
+		FileSize:   size,
+		Content:    content,
+		Metadata:   map[string]interface{}{"path": path, "user_id": in.UserID, "telegram": true},
+	}
+	if scan != nil {
+		source.Metadata["scan"] = scan
+	}
+	if err := s.captureSource(ctx, source, &ActivityLog{UserID: in.UserID, Action: "telegram_capture", UserAgent: "telegram"}); err != nil {
+		os.Remove(path)
+		return nil, err
+	}
+	return source, nil
+}
+
+// downloadTelegramFile saves a file from the Bot API file endpoint to path
+func downloadTelegramFile(ctx context.Context, token, filePath, path string) (int64, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, fmt.Sprintf("%s/file/bot%s/%s", telegramAPIBase, token, filePath), nil)
+	if err != nil {
+		return 0, err
+	}
+	resp, err := integrationHTTPClient.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("failed to download file")
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("failed to download file: %s", resp.Status)
+	}
+
+	out, err := os.Create(path)
+	if err != nil {
+		return 0, err
+	}
+	defer out.Close()
+	return io.Copy(out, io.LimitReader(resp.Body, telegramMaxFileSize))
+}
+
+// truncateRunes shortens text to at most limit characters
+func truncateRunes(text string, limit int) string {
+	runes := []rune(text)
+	if len(runes) <= limit {
+		return text
+	}
+	return string(runes[:limit-1]) + "…"
+}
@@ -0,0 +1,253 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"maps"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/kataras/golog"
+	"github.com/tmc/langchaingo/schema"
+)
+
+// maxTOCEntries bounds the table of contents kept in a source's metadata
+const maxTOCEntries = 500
+
+// maxTOCTitleLength is the longest line, in characters, taken for a heading of plain text
+const maxTOCTitleLength = 80
+
+var (
+	// Markdown headings: "## Title", and setext underlines below a title line
+	atxHeadingRe    = regexp.MustCompile(`^ {0,3}(#{1,6})[ \t]+(.*?)[ \t#]*$`)
+	setextHeadingRe = regexp.MustCompile(`^ {0,3}(=+|-+)[ \t]*$`)
+	codeFenceRe     = regexp.MustCompile("^ {0,3}(```|~~~)")
+
+	// HTML headings, for sources kept as HTML
+	htmlHeadingRe = regexp.MustCompile(`(?is)<h([1-6])\b[^>]*>(.*?)</h[1-6]\s*>`)
+	htmlTagRe     = regexp.MustCompile(`(?s)<[^>]*>`)
+
+	// Numbered headings of plain text, as PDFs often extract to: "第三章 …", "Chapter 2 …", "2.1 …"
+	cjkHeadingRe      = regexp.MustCompile(`^第[一二三四五六七八九十百零〇0-9]+([章篇部节])\s*\S`)
+	chapterHeadingRe  = regexp.MustCompile(`^(?i:chapter|part)\s+([0-9]+|[IVXLC]+)\b`)
+	numberedHeadingRe = regexp.MustCompile(`^([0-9]+(?:\.[0-9]+){0,3})\s+\p{Lu}`)
+)
+
+// extractTOC finds the headings of a source: Markdown headings, which markitdown produces for
+// PDFs, Word files and web pages, or failing those HTML headings, or failing those numbered
+// chapter and section lines of plain text.
+func extractTOC(content string) []TOCEntry {
+	toc := markdownHeadings(content)
+	if len(toc) == 0 {
+		toc = htmlHeadings(content)
+	}
+	if len(toc) == 0 {
+		toc = numberedHeadings(content)
+	}
+	if len(toc) > maxTOCEntries {
+		toc = toc[:maxTOCEntries]
+	}
+
+	// Each section runs to the next heading of the same or a higher level
+	total := utf8.RuneCountInString(content)
+	for i := range toc {
+		toc[i].End = total
+		for _, next := range toc[i+1:] {
+			if next.Level <= toc[i].Level {
+				toc[i].End = next.Start
+				break
+			}
+		}
+	}
+	return toc
+}
+
+// sourceLine is a line of a source with the character offset it starts at
+type sourceLine struct {
+	text  string
+	start int
+}
+
+// sourceLines splits content into lines, keeping their character offsets
+func sourceLines(content string) []sourceLine {
+	var lines []sourceLine
+	offset := 0
+	for _, text := range strings.Split(content, "\n") {
+		lines = append(lines, sourceLine{text: strings.TrimRight(text, "\r"), start: offset})
+		offset += utf8.RuneCountInString(text) + 1
+	}
+	return lines
+}
+
+// markdownHeadings returns the ATX and setext headings outside code blocks
+func markdownHeadings(content string) []TOCEntry {
+	var toc []TOCEntry
+	inCode := false
+	lines := sourceLines(content)
+	for i, line := range lines {
+		if codeFenceRe.MatchString(line.text) {
+			inCode = !inCode
+			continue
+		}
+		if inCode {
+			continue
+		}
+		if m := atxHeadingRe.FindStringSubmatch(line.text); m != nil {
+			if title := cleanHeading(m[2]); title != "" {
+				toc = append(toc, TOCEntry{Level: len(m[1]), Title: title, Start: line.start})
+			}
+			continue
+		}
+		if m := setextHeadingRe.FindStringSubmatch(line.text); m != nil && i > 0 {
+			previous := lines[i-1]
+			title := cleanHeading(previous.text)
+			if title == "" || atxHeadingRe.MatchString(previous.text) || setextHeadingRe.MatchString(previous.text) {
+				continue
+			}
+			level := 1
+			if m[1][0] == '-' {
+				level = 2
+			}
+			toc = append(toc, TOCEntry{Level: level, Title: title, Start: previous.start})
+		}
+	}
+	return toc
+}
+
+// htmlHeadings returns the <h1> to <h6> headings of HTML content
+func htmlHeadings(content string) []TOCEntry {
+	var toc []TOCEntry
+	for _, m := range htmlHeadingRe.FindAllStringSubmatchIndex(content, -1) {
+		title := cleanHeading(html.UnescapeString(htmlTagRe.ReplaceAllString(content[m[4]:m[5]], "")))
+		if title == "" {
+			continue
+		}
+		toc = append(toc, TOCEntry{
+			Level: int(content[m[2]] - '0'),
+			Title: title,
+			Start: utf8.RuneCountInString(content[:m[0]]),
+		})
+	}
+	return toc
+}
+
+// numberedHeadings returns the short lines of plain text that start like a chapter or section
+func numberedHeadings(content string) []TOCEntry {
+	var toc []TOCEntry
+	for _, line := range sourceLines(content) {
+		text := strings.TrimSpace(line.text)
+		if text == "" || utf8.RuneCountInString(text) > maxTOCTitleLength || strings.ContainsAny(text[len(text)-1:], ".,;:") ||
+			strings.HasSuffix(text, "。") || strings.HasSuffix(text, "，") {
+			continue
+		}
+		level := 0
+		if m := cjkHeadingRe.FindStringSubmatch(text); m != nil {
+			level = 1
+			if m[1] == "节" {
+				level = 2
+			}
+		} else if chapterHeadingRe.MatchString(text) {
+			level = 1
+		} else if m := numberedHeadingRe.FindStringSubmatch(text); m != nil {
+			level = strings.Count(m[1], ".") + 1
+		}
+		if level > 0 {
+			toc = append(toc, TOCEntry{Level: level, Title: text, Start: line.start})
+		}
+	}
+	return toc
+}
+
+// cleanHeading collapses whitespace in a heading and drops Markdown emphasis around it
+func cleanHeading(title string) string {
+	title = strings.Join(strings.Fields(title), " ")
+	return strings.TrimSpace(strings.Trim(title, "*_`"))
+}
+
+// updateSourceTOC extracts the table of contents of a source into its "toc" metadata
+func (s *Server) updateSourceTOC(ctx context.Context, source *Source) {
+	toc := extractTOC(source.Content)
+	if _, had := source.Metadata["toc"]; len(toc) == 0 && !had {
+		return
+	}
+
+	// The metadata map may be shared with the cache, so it is copied before changing
+	metadata := maps.Clone(source.Metadata)
+	if metadata == nil {
+		metadata = map[string]interface{}{}
+	}
+	if len(toc) == 0 {
+		delete(metadata, "toc")
+	} else {
+		metadata["toc"] = toc
+	}
+	source.Metadata = metadata
+	if err := s.store.UpdateSourceMetadata(ctx, source); err != nil {
+		golog.Errorf("failed to save the table of contents of source %s: %v", source.ID, err)
+	}
+}
+
+// withTOC returns the source with a "toc" in its metadata, extracting it on the fly for sources
+// added before tables of contents were stored
+func withTOC(source *Source) *Source {
+	if _, ok := source.Metadata["toc"]; ok {
+		return source
+	}
+	toc := extractTOC(source.Content)
+	if len(toc) == 0 {
+		return source
+	}
+	clone := *source
+	clone.Metadata = maps.Clone(source.Metadata)
+	if clone.Metadata == nil {
+		clone.Metadata = map[string]interface{}{}
+	}
+	clone.Metadata["toc"] = toc
+	return &clone
+}
+
+// scopeToSection limits the retrieval of a chat question to a section of one of the notebook's
+// sources, by finding the chunks that overlap the section
+func (s *Server) scopeToSection(ctx context.Context, notebookID string, settings *ChatSettings, section *SourceSection) error {
+	if section == nil {
+		return nil
+	}
+	source, err := s.store.GetSource(ctx, section.SourceID)
+	if err != nil || source.NotebookID != notebookID {
+		return fmt.Errorf("source not found")
+	}
+	end := section.End
+	if end <= 0 {
+		end = utf8.RuneCountInString(source.Content)
+	}
+	if section.Start < 0 || section.Start >= end {
+		return fmt.Errorf("invalid section %d-%d", section.Start, end)
+	}
+
+	span := &chunkSpan{sourceID: source.ID, sourceName: source.Name, first: -1}
+	for i, chunk := range s.vectorStore.splitText(source.Content, s.cfg.ChunkSize, s.cfg.ChunkOverlap) {
+		if chunk.End > section.Start && chunk.Start < end {
+			if span.first < 0 {
+				span.first = i
+			}
+			span.last = i
+		}
+	}
+	if span.first < 0 {
+		return fmt.Errorf("the section is outside the source")
+	}
+	settings.section = span
+	return nil
+}
+
+// searchSection searches the chunks of one section of a source. If none match the query, the
+// section's first chunks are used, since the question is about that section.
+func (a *Agent) searchSection(ctx context.Context, notebookID, query string, span *chunkSpan, numDocs int) ([]schema.Document, error) {
+	docs, err := a.vectorStore.searchIn(ctx, notebookID, query, numDocs, searchScope{within: span})
+	if err != nil || len(docs) > 0 {
+		return docs, err
+	}
+	return a.vectorStore.ChunkRange(ctx, notebookID, span.sourceID, span.sourceName, span.first, min(span.last, span.first+numDocs-1))
+}
@@ -0,0 +1,262 @@
+package backend
+
+import (
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/kataras/golog"
+)
+
+// Scopes of API tokens, each allowing what the ones before it do
+const (
+	ScopeRead  = "read"  // GET requests
+	ScopeChat  = "chat"  // Asking the model about sources, which costs tokens but changes no content
+	ScopeWrite = "write" // Everything else
+)
+
+// tokenScopes ranks the scopes
+var tokenScopes = map[string]int{ScopeRead: 1, ScopeChat: 2, ScopeWrite: 3}
+
+// Lifetimes of API tokens
+const (
+	defaultTokenLifetime = 30 * 24 * time.Hour
+	maxTokenLifetime     = 365 * 24 * time.Hour
+)
+
+// chatRoutes are the POST routes the chat scope allows
+var chatRoutes = map[string]bool{
+	"/api/notebooks/:id/chat":                              true,
+	"/api/notebooks/:id/chat/sessions":                     true,
+	"/api/notebooks/:id/chat/sessions/:sessionId/messages": true,
+	"/api/notebooks/:id/batch-chat":                        true,
+	"/api/notebooks/:id/coverage":                          true,
+}
+
+// credentialRoutes are the GET routes that list credentials and the tokens that act for the
+// user, which need the write scope: reading them could otherwise yield a broader credential
+var credentialRoutes = map[string]bool{
+	"/api/auth/sessions": true,
+	"/api/integrations":  true,
+	"/api/hooks":         true,
+}
+
+// notebookFreeRoutes are the routes outside a notebook that notebook-restricted tokens may
+// use. The handlers of those taking a notebook from elsewhere check it with tokenAllowsNotebook.
+var notebookFreeRoutes = map[string]bool{
+	"GET /api/health":          true,
+	"GET /api/config":          true,
+	"GET /api/auth/me":         true,
+	"GET /api/notebooks":       true, // Listing is limited to the token's notebooks
+	"GET /api/notebooks/stats": true,
+	"POST /api/upload":         true,
+	"GET /api/jobs/:id":        true,
+	"GET /api/files/:filename": true,
+}
+
+// tokenGrant is what a scoped API token allows. Session tokens have none and allow everything.
+type tokenGrant struct {
+	Scope     string
+	Notebooks []string // Empty allows all of the user's notebooks
+}
+
+// GenerateScopedJWT issues an API token limited to a scope and, unless notebookIDs is empty,
+// to some notebooks
+func GenerateScopedJWT(userID, sessionID, secret, scope string, notebookIDs []string, lifetime time.Duration) (string, error) {
+	claims := jwt.MapClaims{
+		"user_id": userID,
+		"sid":     sessionID,
+		"scope":   scope,
+		"iat":     time.Now().Unix(),
+		"exp":     time.Now().Add(lifetime).Unix(),
+	}
+	if len(notebookIDs) > 0 {
+		claims["notebooks"] = notebookIDs
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	return token.SignedString([]byte(secret))
+}
+
+// grantFromClaims reads the scope of a token, which is nil for session tokens
+func grantFromClaims(claims jwt.MapClaims) (*tokenGrant, error) {
+	scope, ok := claims["scope"]
+	if !ok {
+		return nil, nil
+	}
+	grant := &tokenGrant{}
+	if grant.Scope, ok = scope.(string); !ok || tokenScopes[grant.Scope] == 0 {
+		return nil, fmt.Errorf("invalid scope: %v", scope)
+	}
+	if notebooks, ok := claims["notebooks"]; ok {
+		list, ok := notebooks.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("invalid notebooks claim")
+		}
+		for _, id := range list {
+			id, ok := id.(string)
+			if !ok {
+				return nil, fmt.Errorf("invalid notebooks claim")
+			}
+			grant.Notebooks = append(grant.Notebooks, id)
+		}
+	}
+	return grant, nil
+}
+
+// allowsNotebook reports whether the grant covers a notebook
+func (g *tokenGrant) allowsNotebook(notebookID string) bool {
+	return g == nil || len(g.Notebooks) == 0 || slices.Contains(g.Notebooks, notebookID)
+}
+
+// permits checks a request against the grant. The route decides the scope it needs: reading
+// for GET except credentialRoutes, chat for chatRoutes and write otherwise. A
+// notebook-restricted token may only use the routes of its notebooks and notebookFreeRoutes.
+func (g *tokenGrant) permits(c *gin.Context) error {
+	route := c.FullPath()
+	need := ScopeWrite
+	switch {
+	case credentialRoutes[route]:
+	case c.Request.Method == http.MethodGet || c.Request.Method == http.MethodHead:
+		need = ScopeRead
+	case c.Request.Method == http.MethodPost && chatRoutes[route]:
+		need = ScopeChat
+	}
+	if tokenScopes[g.Scope] < tokenScopes[need] {
+		return fmt.Errorf("this token is limited to the %s scope, %s is needed", g.Scope, need)
+	}
+
+	if len(g.Notebooks) == 0 || notebookFreeRoutes[c.Request.Method+" "+route] {
+		return nil
+	}
+	if strings.HasPrefix(route, "/api/notebooks/:id") && g.allowsNotebook(c.Param("id")) {
+		return nil
+	}
+	return fmt.Errorf("this token is limited to some notebooks")
+}
+
+// setTokenGrant authorizes a request made with a scoped token, responding with an error if the
+// token doesn't allow it
+func setTokenGrant(c *gin.Context, claims jwt.MapClaims) bool {
+	grant, err := grantFromClaims(claims)
+	if err != nil {
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid token claims"})
+		return false
+	}
+	if grant == nil {
+		return true
+	}
+	if err := grant.permits(c); err != nil {
+		auditLogger.Infof("scoped token refused for %s %s: %v", c.Request.Method, c.FullPath(), err)
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Token scope does not allow this request", "details": err.Error()})
+		return false
+	}
+	c.Set("token_grant", grant)
+	return true
+}
+
+// getTokenGrant returns the scope of the request's token, nil for a session
+func getTokenGrant(c *gin.Context) *tokenGrant {
+	grant, _ := c.Get("token_grant")
+	g, _ := grant.(*tokenGrant)
+	return g
+}
+
+// tokenAllowsNotebook reports whether the request's token covers a notebook, for routes that
+// take the notebook from somewhere other than the URL
+func tokenAllowsNotebook(c *gin.Context, notebookID string) bool {
+	return getTokenGrant(c).allowsNotebook(notebookID)
+}
+
+// HandleIssueToken issues an API token with a narrower scope than the session, for scripts and
+// automations: read-only or chat-only, optionally restricted to some of the user's notebooks.
+// Scoped tokens can't issue tokens.
+func (h *AuthHandler) HandleIssueToken(c *gin.Context) {
+	userID := c.GetString("user_id")
+	if getTokenGrant(c) != nil {
+		c.JSON(http.StatusForbidden, ErrorResponse{Error: "API tokens can only be issued from a signed-in session"})
+		return
+	}
+	if h.config.LocalMode {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Tokens are not used in local mode"})
+		return
+	}
+
+	var req struct {
+		Name           string   `json:"name"`
+		Scope          string   `json:"scope" binding:"required"`
+		NotebookIDs    []string `json:"notebook_ids"`
+		ExpiresInHours int      `json:"expires_in_hours"` // 0 = 30 days
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: err.Error()})
+		return
+	}
+	if tokenScopes[req.Scope] == 0 {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: fmt.Sprintf("unknown scope: %s (supported: read, chat, write)", req.Scope)})
+		return
+	}
+	lifetime := defaultTokenLifetime
+	if req.ExpiresInHours < 0 {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "expires_in_hours must not be negative"})
+		return
+	} else if req.ExpiresInHours > 0 {
+		lifetime = time.Duration(req.ExpiresInHours) * time.Hour
+	}
+	if lifetime > maxTokenLifetime {
+		c.JSON(http.StatusBadRequest, ErrorResponse{Error: "tokens expire within a year"})
+		return
+	}
+	for _, id := range req.NotebookIDs {
+		notebook, err := h.store.GetNotebook(c.Request.Context(), id)
+		if err != nil || (notebook.UserID != "" && notebook.UserID != userID) {
+			c.JSON(http.StatusBadRequest, ErrorResponse{Error: fmt.Sprintf("notebook not found: %s", id)})
+			return
+		}
+	}
+
+	// The token's session lists it among the user's sessions, where it can be revoked
+	expiresAt := time.Now().Add(lifetime)
+	session := &AuthSession{
+		UserID:    userID,
+		Name:      req.Name,
+		Scope:     req.Scope,
+		IPAddress: c.ClientIP(),
+		UserAgent: c.GetHeader("User-Agent"),
+		ExpiresAt: expiresAt,
+	}
+	if err := h.store.CreateAuthSession(c.Request.Context(), session); err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to generate token"})
+		return
+	}
+	token, err := GenerateScopedJWT(userID, session.ID, h.config.JWTSecret, req.Scope, req.NotebookIDs, lifetime)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to generate token"})
+		return
+	}
+
+	activityLog := &ActivityLog{
+		UserID:       userID,
+		Action:       "issue_token",
+		ResourceType: "session",
+		ResourceID:   session.ID,
+		ResourceName: req.Name,
+		Details:      fmt.Sprintf(`{"scope": %q, "notebook_ids": %s, "expires_at": %q}`, req.Scope, toJson(req.NotebookIDs), expiresAt.Format(time.RFC3339)),
+		IPAddress:    c.ClientIP(),
+		UserAgent:    c.GetHeader("User-Agent"),
+	}
+	if err := h.store.LogActivity(c.Request.Context(), activityLog); err != nil {
+		golog.Errorf("failed to log token activity: %v", err)
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"token":        token,
+		"session_id":   session.ID,
+		"scope":        req.Scope,
+		"notebook_ids": req.NotebookIDs,
+		"expires_at":   expiresAt,
+	})
+}
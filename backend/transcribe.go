@@ -0,0 +1,402 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// audioExtensions and videoExtensions are the uploads transcribed into sources instead of
+// converted as documents
+var (
+	audioExtensions = map[string]bool{".mp3": true, ".wav": true, ".m4a": true}
+	videoExtensions = map[string]bool{".mp4": true, ".webm": true}
+)
+
+// openAITranscriptionLimit is the largest file the OpenAI transcription API accepts
+const openAITranscriptionLimit = 25 << 20
+
+// transcriptMarker matches the time span a transcript line starts with, "[00:01:05-00:01:09] "
+var transcriptMarker = regexp.MustCompile(`^\[(\d{2,}):([0-5]\d):([0-5]\d)-(\d{2,}):([0-5]\d):([0-5]\d)\] `)
+
+// mediaKind tells by its extension whether a file is "audio" or "video" to transcribe, or ""
+func mediaKind(path string) string {
+	ext := strings.ToLower(filepath.Ext(path))
+	switch {
+	case audioExtensions[ext]:
+		return "audio"
+	case videoExtensions[ext]:
+		return "video"
+	}
+	return ""
+}
+
+// extractAudioTrack writes the audio track of a video to dir as a small mono MP3, which is all
+// speech recognition needs
+func extractAudioTrack(ctx context.Context, ffmpeg, path, dir string) (string, error) {
+	out := filepath.Join(dir, "audio.mp3")
+	cmd := exec.CommandContext(ctx, ffmpeg, "-nostdin", "-loglevel", "error", "-i", path, "-vn", "-ac", "1", "-ar", "16000", "-b:a", "32k", out)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		return "", fmt.Errorf("failed to extract the audio track: %w, output: %s", err, output)
+	}
+	return out, nil
+}
+
+// transcriptSegment is a stretch of speech and when it is spoken in the audio
+type transcriptSegment struct {
+	Start time.Duration
+	End   time.Duration
+	Text  string
+}
+
+// formatTranscript writes segments a line each, starting with their time span so that the
+// chunks of the transcript know which part of the audio they are
+func formatTranscript(segments []transcriptSegment) string {
+	var b strings.Builder
+	for _, seg := range segments {
+		text := strings.Join(strings.Fields(seg.Text), " ")
+		if text == "" {
+			continue
+		}
+		start := int(seg.Start / time.Second)
+		end := max(int(math.Ceil(seg.End.Seconds())), start+1)
+		fmt.Fprintf(&b, "[%s-%s] %s\n", transcriptClock(start), transcriptClock(end), text)
+	}
+	return b.String()
+}
+
+// transcriptClock formats seconds as the hh:mm:ss of a transcript marker
+func transcriptClock(seconds int) string {
+	return fmt.Sprintf("%02d:%02d:%02d", seconds/3600, seconds/60%60, seconds%60)
+}
+
+// formatClock formats seconds for display, as m:ss or h:mm:ss
+func formatClock(seconds int) string {
+	if seconds >= 3600 {
+		return fmt.Sprintf("%d:%02d:%02d", seconds/3600, seconds/60%60, seconds%60)
+	}
+	return fmt.Sprintf("%d:%02d", seconds/60, seconds%60)
+}
+
+// setChunkTimes sets the seconds of audio chunks of a transcript cover, from the time spans its
+// lines start with. Chunks of text without them get no times.
+func setChunkTimes(runes []rune, chunks []textChunk) {
+	type span struct{ offset, start, end int }
+	var spans []span
+	for i := 0; i < len(runes); i++ {
+		if (i > 0 && runes[i-1] != '\n') || runes[i] != '[' {
+			continue
+		}
+		line := string(runes[i:min(i+40, len(runes))])
+		m := transcriptMarker.FindStringSubmatch(line)
+		if m == nil {
+			continue
+		}
+		clock := func(h, m, s string) int {
+			hours, _ := strconv.Atoi(h)
+			minutes, _ := strconv.Atoi(m)
+			seconds, _ := strconv.Atoi(s)
+			return hours*3600 + minutes*60 + seconds
+		}
+		spans = append(spans, span{offset: i, start: clock(m[1], m[2], m[3]), end: clock(m[4], m[5], m[6])})
+	}
+	if len(spans) == 0 {
+		return
+	}
+	// A chunk runs from the segment it starts in to the one it ends in; text before the first
+	// marker counts as part of the first segment
+	segmentAt := func(offset int) span {
+		i := sort.Search(len(spans), func(i int) bool { return spans[i].offset > offset })
+		return spans[max(i-1, 0)]
+	}
+	for i := range chunks {
+		chunks[i].StartTime = segmentAt(chunks[i].Start).start
+		chunks[i].EndTime = max(segmentAt(chunks[i].End-1).end, chunks[i].StartTime+1)
+	}
+}
+
+// transcriber turns speech into text with timestamps
+type transcriber interface {
+	transcribe(ctx context.Context, path string) ([]transcriptSegment, error)
+}
+
+// newTranscriber creates the transcriber configured by TRANSCRIPTION_PROVIDER, or nil if audio
+// can't be transcribed
+func newTranscriber(cfg Config) transcriber {
+	switch cfg.TranscriptionProvider {
+	case "openai":
+		return &openAITranscriber{
+			url:      strings.TrimRight(firstNonEmpty(cfg.OpenAIImageBaseURL(), "https://api.openai.com/v1"), "/") + "/audio/transcriptions",
+			apiKey:   cfg.OpenAIAPIKey,
+			model:    cfg.TranscriptionModel,
+			language: cfg.TranscriptionLanguage,
+			ffmpeg:   cfg.FFmpegPath,
+			client:   &http.Client{Timeout: cfg.TransformationTimeout},
+		}
+	case "whispercpp":
+		return &whisperCppTranscriber{
+			binary:   cfg.WhisperCppBinary,
+			model:    cfg.WhisperCppModel,
+			language: cfg.TranscriptionLanguage,
+			ffmpeg:   cfg.FFmpegPath,
+		}
+	case "mock":
+		return mockTranscriber{}
+	}
+	return nil
+}
+
+// openAITranscriber calls the OpenAI transcription API (Whisper), or a server compatible with it.
+// Videos are sent as their audio track, to stay under the API's size limit.
+type openAITranscriber struct {
+	url      string
+	apiKey   string
+	model    string
+	language string
+	ffmpeg   string
+	client   *http.Client
+}
+
+func (o *openAITranscriber) transcribe(ctx context.Context, path string) ([]transcriptSegment, error) {
+	if mediaKind(path) == "video" {
+		tmpDir, err := os.MkdirTemp("", "whisper-")
+		if err != nil {
+			return nil, fmt.Errorf("failed to create temp directory: %w", err)
+		}
+		defer os.RemoveAll(tmpDir)
+		if path, err = extractAudioTrack(ctx, o.ffmpeg, path, tmpDir); err != nil {
+			return nil, err
+		}
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	if info, err := file.Stat(); err == nil && info.Size() > openAITranscriptionLimit {
+		return nil, fmt.Errorf("audio file is %d MB, the OpenAI transcription API accepts at most 25 MB", info.Size()>>20)
+	}
+
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	fields := map[string]string{"model": o.model, "response_format": "verbose_json", "timestamp_granularities[]": "segment"}
+	if o.language != "" {
+		fields["language"] = o.language
+	}
+	for key, value := range fields {
+		if err := form.WriteField(key, value); err != nil {
+			return nil, err
+		}
+	}
+	part, err := form.CreateFormFile("file", filepath.Base(path))
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(part, file); err != nil {
+		return nil, err
+	}
+	if err := form.Close(); err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, o.url, &body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	req.Header.Set("Authorization", "Bearer "+o.apiKey)
+
+	resp, err := o.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send transcription request: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		message, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return nil, fmt.Errorf("OpenAI transcription API error, status %d: %s", resp.StatusCode, message)
+	}
+
+	var result struct {
+		Text     string  `json:"text"`
+		Duration float64 `json:"duration"`
+		Segments []struct {
+			Start float64 `json:"start"`
+			End   float64 `json:"end"`
+			Text  string  `json:"text"`
+		} `json:"segments"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return nil, fmt.Errorf("failed to decode transcription: %w", err)
+	}
+	seconds := func(s float64) time.Duration { return time.Duration(s * float64(time.Second)) }
+	// Models without segments, such as gpt-4o-transcribe, give the text as one
+	if len(result.Segments) == 0 {
+		return []transcriptSegment{{End: seconds(result.Duration), Text: result.Text}}, nil
+	}
+	segments := make([]transcriptSegment, len(result.Segments))
+	for i, seg := range result.Segments {
+		segments[i] = transcriptSegment{Start: seconds(seg.Start), End: seconds(seg.End), Text: seg.Text}
+	}
+	return segments, nil
+}
+
+// whisperCppTranscriber runs whisper.cpp locally. ffmpeg first converts the audio, or the audio
+// track of a video, to the 16 kHz mono WAV it reads.
+type whisperCppTranscriber struct {
+	binary   string
+	model    string
+	language string
+	ffmpeg   string
+}
+
+func (w *whisperCppTranscriber) transcribe(ctx context.Context, path string) ([]transcriptSegment, error) {
+	tmpDir, err := os.MkdirTemp("", "whisper-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create temp directory: %w", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	wav := filepath.Join(tmpDir, "audio.wav")
+	convert := exec.CommandContext(ctx, w.ffmpeg, "-nostdin", "-loglevel", "error", "-i", path, "-vn", "-ar", "16000", "-ac", "1", "-c:a", "pcm_s16le", wav)
+	if output, err := convert.CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("ffmpeg conversion failed: %w, output: %s", err, output)
+	}
+
+	out := filepath.Join(tmpDir, "transcript")
+	args := []string{"-m", w.model, "-f", wav, "-oj", "-of", out, "-np"}
+	if w.language != "" {
+		args = append(args, "-l", w.language)
+	}
+	if output, err := exec.CommandContext(ctx, w.binary, args...).CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("whisper.cpp transcription failed: %w, output: %s", err, output)
+	}
+
+	data, err := os.ReadFile(out + ".json")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read whisper.cpp output: %w", err)
+	}
+	var result struct {
+		Transcription []struct {
+			Offsets struct {
+				From int64 `json:"from"`
+				To   int64 `json:"to"`
+			} `json:"offsets"`
+			Text string `json:"text"`
+		} `json:"transcription"`
+	}
+	if err := json.Unmarshal(data, &result); err != nil {
+		return nil, fmt.Errorf("failed to decode whisper.cpp output: %w", err)
+	}
+	segments := make([]transcriptSegment, len(result.Transcription))
+	for i, seg := range result.Transcription {
+		segments[i] = transcriptSegment{
+			Start: time.Duration(seg.Offsets.From) * time.Millisecond,
+			End:   time.Duration(seg.Offsets.To) * time.Millisecond,
+			Text:  seg.Text,
+		}
+	}
+	return segments, nil
+}
+
+// mockTranscriber is the transcriber of TRANSCRIPTION_PROVIDER=mock. It hears a sentence every
+// few seconds of the audio, the length of a WAV or guessed from the size of other files, so it
+// needs no ffmpeg for videos either.
+type mockTranscriber struct{}
+
+var mockTranscriptSentences = []string{
+	"大家好，欢迎收听今天的内容。",
+	"我们先回顾一下上次讨论的要点。",
+	"接下来看一个具体的例子。",
+	"这里有几个数据值得注意。",
+	"这个问题有不同的看法，我们逐一分析。",
+	"最后总结一下今天的重点。",
+}
+
+func (mockTranscriber) transcribe(ctx context.Context, path string) ([]transcriptSegment, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	// A 128 kbps MP3 is 16 KB a second, a 1 Mbps video 125 KB
+	bytesPerSecond := 16000
+	if mediaKind(path) == "video" {
+		bytesPerSecond = 125000
+	}
+	duration := time.Duration(len(data)) * time.Second / time.Duration(bytesPerSecond)
+	if len(data) >= 44 && string(data[:4]) == "RIFF" && string(data[8:12]) == "WAVE" {
+		if byteRate := binary.LittleEndian.Uint32(data[28:32]); byteRate > 0 {
+			duration = time.Duration(len(data)-44) * time.Second / time.Duration(byteRate)
+		}
+	}
+
+	const step = 5 * time.Second
+	count := min(max(int((duration+step-1)/step), 1), 720)
+	segments := make([]transcriptSegment, count)
+	offset := int(mockHash(filepath.Base(path)) % uint32(len(mockTranscriptSentences)))
+	for i := range segments {
+		end := time.Duration(i+1) * step
+		if i == count-1 && duration > time.Duration(i)*step {
+			end = duration
+		}
+		segments[i] = transcriptSegment{
+			Start: time.Duration(i) * step,
+			End:   end,
+			Text:  fmt.Sprintf("第 %d 段：%s", i+1, mockTranscriptSentences[(offset+i)%len(mockTranscriptSentences)]),
+		}
+	}
+	return segments, nil
+}
+
+// transcribeMedia transcribes an audio or video file with the configured transcriber, returning
+// the transcript and how long the recording is
+func (s *Server) transcribeMedia(ctx context.Context, path string) (string, time.Duration, error) {
+	if s.transcriber == nil {
+		return "", 0, fmt.Errorf("transcription is not configured, set TRANSCRIPTION_PROVIDER")
+	}
+	segments, err := s.transcriber.transcribe(ctx, path)
+	if err != nil {
+		return "", 0, err
+	}
+	transcript := formatTranscript(segments)
+	if transcript == "" {
+		return "", 0, fmt.Errorf("no speech found in the recording")
+	}
+	var duration time.Duration
+	for _, seg := range segments {
+		duration = max(duration, seg.End)
+	}
+	return transcript, duration, nil
+}
+
+// sourceMedia returns the recording a transcribed source was made from, for players to seek to
+// the time of a citation, or nil for other sources. YouTube sources play in YouTube's embed.
+func sourceMedia(source *Source) gin.H {
+	if source.Type == "youtube" {
+		return youtubeMedia(source)
+	}
+	kind, _ := source.Metadata["media"].(string)
+	if kind == "" || source.FileName == "" {
+		return nil
+	}
+	return gin.H{"kind": kind, "url": "/api/files/" + source.FileName, "duration": source.Metadata["duration"]}
+}
@@ -0,0 +1,435 @@
+package backend
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kataras/golog"
+)
+
+// transformQueueSize is how many transform jobs can wait for a worker before enqueueing blocks
+const transformQueueSize = 64
+
+// startTransformWorkers starts the workers that run queued transform jobs, then requeues the
+// jobs that were queued or running when the server stopped
+func (s *Server) startTransformWorkers(workers int) {
+	if workers < 1 {
+		workers = 1
+	}
+	for i := 0; i < workers; i++ {
+		go func() {
+			for id := range s.transformQueue {
+				s.runTransformJob(id)
+			}
+		}()
+	}
+
+	jobs, err := s.store.ListActiveTransformJobs(context.Background())
+	if err != nil {
+		golog.Errorf("failed to list transform jobs: %v", err)
+		return
+	}
+	for _, job := range jobs {
+		golog.Infof("resuming transform job %s (%s)", job.ID, job.Request.Type)
+		s.enqueueTransformJob(job.ID)
+	}
+}
+
+// enqueueTransformJob hands a job to the workers without blocking the caller
+func (s *Server) enqueueTransformJob(id string) {
+	select {
+	case s.transformQueue <- id:
+	default:
+		go func() { s.transformQueue <- id }()
+	}
+}
+
+// runTransformJob generates the note of a transform job. The job's cancel func is registered
+// before the job is loaded, so a cancellation racing with the start still stops it.
+func (s *Server) runTransformJob(id string) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	s.transformJobs.Store(id, cancel)
+	defer s.transformJobs.Delete(id)
+
+	job, err := s.store.GetTransformJob(ctx, id)
+	if err != nil {
+		// The notebook, and its jobs with it, may have been deleted while queued
+		golog.Warnf("failed to load transform job %s: %v", id, err)
+		return
+	}
+	if job.Status != TransformStatusQueued && job.Status != TransformStatusRunning {
+		return
+	}
+	report := &ErrorReport{Component: "transform", UserID: job.UserID, NotebookID: job.NotebookID,
+		Extra: map[string]string{"job_id": job.ID, "type": job.Request.Type}}
+	defer func() {
+		if recovered := recover(); recovered != nil {
+			s.reportPanic(recovered, report)
+			job.Status = TransformStatusFailed
+			job.Stage = ""
+			job.Error = fmt.Sprintf("internal error: %v", recovered)
+			if err := s.store.SaveTransformJob(context.Background(), job); err != nil {
+				golog.Errorf("failed to save transform job %s: %v", job.ID, err)
+			}
+		}
+	}()
+
+	setStage := func(stage string) {
+		job.Status = TransformStatusRunning
+		job.Stage = stage
+		if err := s.store.SaveTransformJob(context.Background(), job); err != nil {
+			golog.Errorf("failed to save transform job %s: %v", job.ID, err)
+		}
+	}
+
+	var note *Note
+	agent := s.currentAgent()
+	if agent == nil {
+		err = fmt.Errorf("LLM provider is not configured")
+	} else {
+		setStage("generating")
+		note, err = s.generateTransformNote(ctx, agent, job, setStage)
+	}
+
+	job.Stage = ""
+	switch {
+	case err != nil && ctx.Err() != nil:
+		job.Status = TransformStatusCanceled
+	case err != nil:
+		golog.Errorf("transform job %s failed: %v", job.ID, err)
+		report.Kind = "error"
+		report.Message = err.Error()
+		s.reportError(report)
+		job.Status = TransformStatusFailed
+		job.Error = err.Error()
+	default:
+		job.Status = TransformStatusCompleted
+		job.NoteID = note.ID
+	}
+	if err := s.store.SaveTransformJob(context.Background(), job); err != nil {
+		golog.Errorf("failed to save transform job %s: %v", job.ID, err)
+	}
+}
+
+// generateTransformNote generates the transformation of a job's sources, renders its images and
+// saves it as a note
+func (s *Server) generateTransformNote(ctx context.Context, agent *Agent, job *TransformJob, setStage func(stage string)) (*Note, error) {
+	notebookID := job.NotebookID
+	userID := job.UserID
+	req := &job.Request
+	ctx = withUsageScope(ctx, userID, notebookID)
+
+	// 按需加载向量索引
+	if err := s.loadNotebookVectorIndex(ctx, notebookID); err != nil {
+		golog.Errorf("failed to load vector index: %v", err)
+	}
+
+	sources, err := s.store.ListSources(ctx, notebookID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get sources: %w", err)
+	}
+	// The sources were picked when the job was created; some may have been deleted since
+	selected := make(map[string]bool, len(req.SourceIDs))
+	for _, id := range req.SourceIDs {
+		selected[id] = true
+	}
+	filtered := make([]Source, 0, len(req.SourceIDs))
+	for _, src := range sources {
+		if selected[src.ID] {
+			filtered = append(filtered, src)
+		}
+	}
+	sources = filtered
+	if len(sources) == 0 {
+		return nil, fmt.Errorf("no sources available")
+	}
+
+	// A section transformation sees only the section's text
+	var sectionStart int
+	var sectionLabel string
+	var sectionSource Source
+	if req.Section != nil {
+		sectionSource = sources[0]
+		sources[0], sectionStart, sectionLabel, err = sourceSection(sources[0], req.Section)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Generate transformation. Reference lists are formatted from source metadata, not by the LLM.
+	var response *TransformationResponse
+	if req.Type == "references" {
+		response = referencesTransformation(req, sources)
+	} else {
+		response, err = agent.GenerateTransformation(ctx, req, sources)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("generation failed: %w", err)
+	}
+
+	metadata := map[string]interface{}{
+		"length": req.Length,
+		"format": req.Format,
+	}
+	for _, key := range []string{"citations", "citation_style", "context_degraded", "context_limit", "context_retries", "generated_by", "fallback_from"} {
+		if v, ok := response.Metadata[key]; ok {
+			metadata[key] = v
+		}
+	}
+	if req.Section != nil {
+		// Citations point into the whole source, not the section
+		if citations, ok := metadata["citations"].([]Citation); ok {
+			for i := range citations {
+				citations[i].Start += sectionStart
+				citations[i].End += sectionStart
+				setCitationLocation(sectionSource.Content, &citations[i])
+			}
+		}
+		metadata["section"] = sectionLabel
+	}
+
+	// If type is infograph, generate the image as well
+	if req.Type == "infograph" {
+		setStage("rendering")
+		extra := "**注意：无论来源是什么语言，请务必使用中文**"
+		prompt := response.Content + "\n\n" + extra
+		image, err := agent.generateImage(ctx, prompt, userID)
+		if err != nil {
+			golog.Errorf("failed to generate infographic image: %v", err)
+			metadata["image_error"] = err.Error()
+		} else {
+			// Convert local path to web path (authenticated API)
+			webPath := "/api/files/" + s.storeGeneratedAsset(ctx, userID, image.Path)
+			metadata["image_url"] = webPath
+			metadata["image_generated_by"] = image.GeneratedBy.String()
+			if image.FallbackFrom != "" {
+				metadata["image_fallback_from"] = image.FallbackFrom
+			}
+		}
+	}
+
+	// If type is ppt, generate images for each slide
+	if req.Type == "ppt" {
+		slides := parsePPTSlides(response.Content)
+		if len(slides) > 10 {
+			golog.Errorf("ppt contains too many slides (%d), maximum allowed is 20. skipping image generation.", len(slides))
+			metadata["image_error"] = "PPT页数超过20页上限，已停止生成图片"
+		} else {
+			setStage("rendering")
+			golog.Infof("generating %d slides for ppt...", len(slides))
+			images := s.generateSlideImages(ctx, agent, slides, userID)
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+
+			// Slides whose image failed are left out, the others keep their order
+			var slideURLs, slideProviders []string
+			var slideNumbers []int
+			for i, image := range images {
+				if image != nil {
+					slideURLs = append(slideURLs, "/api/files/"+s.storeGeneratedAsset(ctx, userID, image.Path))
+					slideProviders = append(slideProviders, image.GeneratedBy.String())
+					slideNumbers = append(slideNumbers, i+1)
+				}
+			}
+			metadata["slides"] = slideURLs
+			metadata["slides_generated_by"] = slideProviders // The provider of each slide, in order
+			metadata["slide_numbers"] = slideNumbers         // The slide of the content each image shows, from 1
+		}
+	}
+
+	// If type is podcast, read the script aloud when a speech provider is configured
+	if req.Type == "podcast" && s.cfg.EnablePodcast && agent.speech != nil {
+		setStage("voicing")
+		audio, err := s.voicePodcast(ctx, agent, response.Content, userID, nil)
+		if err != nil {
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return nil, ctxErr
+			}
+			golog.Errorf("failed to generate podcast audio: %v", err)
+			metadata["audio_error"] = err.Error()
+		} else {
+			maps.Copy(metadata, audio)
+		}
+	}
+
+	// A job canceled while its images or audio were rendering leaves no note behind
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	// Save as note
+	// For infograph type: clear content only when image generation succeeds
+	// If image generation fails, keep the prompt as content so user can see/retry it
+	noteContent := response.Content
+	if req.Type == "infograph" {
+		// Check if image generation succeeded
+		if metadata["image_url"] != nil {
+			noteContent = "" // Clear content when image was generated successfully
+		}
+		// If image generation failed, noteContent remains as response.Content (the prompt)
+	}
+
+	title := getTitleForType(req.Type)
+	if req.Section != nil {
+		title = fmt.Sprintf("%s：%s", title, sectionLabel)
+	}
+	note := &Note{
+		NotebookID: notebookID,
+		Title:      title,
+		Content:    noteContent,
+		Type:       req.Type,
+		SourceIDs:  req.SourceIDs,
+		Metadata:   metadata,
+	}
+
+	// The notebook may have been put on legal hold while the job ran
+	if err := s.checkLegalHold(ctx, notebookID); err != nil {
+		return nil, err
+	}
+	if err := s.store.CreateNote(ctx, note); err != nil {
+		return nil, fmt.Errorf("failed to save note: %w", err)
+	}
+	// Once the note exists the job completes, so the remaining steps ignore a late cancel
+	ctx = context.WithoutCancel(ctx)
+
+	// Log transformation activity
+	activityLog := &ActivityLog{
+		UserID:       userID,
+		Action:       "transform",
+		ResourceType: "note",
+		ResourceID:   note.ID,
+		ResourceName: note.Title,
+		Details:      fmt.Sprintf(`{"notebook_id": "%s", "transform_type": "%s", "length": "%s", "format": "%s", "source_count": %d, "job_id": "%s"}`, notebookID, req.Type, req.Length, req.Format, len(req.SourceIDs), job.ID),
+	}
+	if err := s.store.LogActivity(ctx, activityLog); err != nil {
+		golog.Errorf("failed to log transformation activity: %v", err)
+	}
+
+	// If type is insight, inject the insight report as a new source
+	if req.Type == "insight" {
+		insightSource := &Source{
+			NotebookID: notebookID,
+			Name:       "洞察报告",
+			Type:       "insight",
+			Content:    response.Content,
+			Metadata: map[string]interface{}{
+				"generated_at": time.Now(),
+				"source_ids":   req.SourceIDs,
+			},
+		}
+
+		if err := s.store.CreateSource(ctx, insightSource); err != nil {
+			golog.Errorf("failed to create insight source: %v", err)
+		} else {
+			// Ingest into vector store for future reference
+			if chunkCount, err := s.vectorStore.IngestText(ctx, notebookID, insightSource.ID, insightSource.Name, insightSource.Content); err != nil {
+				golog.Errorf("failed to ingest insight text: %v", err)
+			} else {
+				s.store.UpdateSourceChunkCount(ctx, insightSource.ID, chunkCount)
+			}
+		}
+	}
+
+	return note, nil
+}
+
+// generateSlideImages generates the image of each slide, SLIDE_IMAGE_WORKERS at a time. The
+// images are in slide order, nil for slides whose image failed.
+func (s *Server) generateSlideImages(ctx context.Context, agent *Agent, slides []Slide, userID string) []*generatedImage {
+	images := make([]*generatedImage, len(slides))
+	indexes := make(chan int)
+	var wg sync.WaitGroup
+	for range min(max(s.cfg.SlideImageWorkers, 1), len(slides)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				if ctx.Err() != nil {
+					continue
+				}
+				golog.Infof("generating image for slide %d/%d...", i+1, len(slides))
+				// Combine style and slide content for the image generator
+				prompt := fmt.Sprintf("Style: %s\n\nSlide Content: %s", slides[0].Style, slides[i].Content)
+				prompt += "\n\n**注意：无论来源是什么语言，请务必使用中文**\n"
+				image, err := agent.generateImage(ctx, prompt, userID)
+				if err != nil {
+					golog.Errorf("failed to generate slide %d: %v", i+1, err)
+					continue
+				}
+				images[i] = image
+			}
+		}()
+	}
+	for i := range slides {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+	return images
+}
+
+// getTransformJobInNotebook loads the transform job named in the URL, responding with 404 unless
+// it belongs to the notebook
+func (s *Server) getTransformJobInNotebook(c *gin.Context) (*TransformJob, bool) {
+	ctx := c.Request.Context()
+	notebookID := c.Param("id")
+	if err := s.checkNotebookAccess(ctx, notebookID, c.GetString("user_id")); err != nil {
+		c.JSON(http.StatusForbidden, ErrorResponse{Error: "Access denied"})
+		return nil, false
+	}
+	job, err := s.store.GetTransformJob(ctx, c.Param("jobId"))
+	if err != nil || job.NotebookID != notebookID {
+		c.JSON(http.StatusNotFound, ErrorResponse{Error: "Job not found"})
+		return nil, false
+	}
+	return job, true
+}
+
+// handleGetTransformJob returns the status of a transform job, with its note once completed
+func (s *Server) handleGetTransformJob(c *gin.Context) {
+	job, ok := s.getTransformJobInNotebook(c)
+	if !ok {
+		return
+	}
+	if job.Status == TransformStatusCompleted && job.NoteID != "" {
+		note, err := s.store.GetNote(c.Request.Context(), job.NoteID)
+		if err != nil {
+			golog.Warnf("failed to load note %s of transform job %s: %v", job.NoteID, job.ID, err)
+		} else {
+			job.Note = note
+		}
+	}
+	c.JSON(http.StatusOK, job)
+}
+
+// handleCancelTransformJob cancels a queued or running transform job. The job is marked canceled
+// before its context is canceled, so a worker that is just starting it sees one or the other.
+func (s *Server) handleCancelTransformJob(c *gin.Context) {
+	job, ok := s.getTransformJobInNotebook(c)
+	if !ok {
+		return
+	}
+	if job.Status != TransformStatusQueued && job.Status != TransformStatusRunning {
+		c.JSON(http.StatusConflict, ErrorResponse{Error: "Job already finished", Details: job.Status})
+		return
+	}
+
+	job.Status = TransformStatusCanceled
+	job.Stage = ""
+	if err := s.store.SaveTransformJob(c.Request.Context(), job); err != nil {
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to cancel job"})
+		return
+	}
+	if cancel, ok := s.transformJobs.Load(job.ID); ok {
+		cancel.(context.CancelFunc)()
+	}
+
+	c.JSON(http.StatusOK, job)
+}
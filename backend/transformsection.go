@@ -0,0 +1,109 @@
+package backend
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// sourceSection cuts the section a transformation targets out of its source. It returns the
+// source holding only the section's text, the section's start offset in characters into the
+// source, and a label for the section such as "Chapter 3" or "第 10–20 页".
+func sourceSection(source Source, section *TransformationSection) (Source, int, string, error) {
+	var start, end int
+	var label string
+	var err error
+	switch {
+	case len(section.Heading) > 0:
+		start, end, label, err = headingSpan(source.Content, section.Heading)
+	case section.FirstPage > 0:
+		start, end, label, err = pageSpan(source.Content, section.FirstPage, section.LastPage)
+	default:
+		err = fmt.Errorf("a section needs a heading or a first page")
+	}
+	if err != nil {
+		return source, 0, "", fmt.Errorf("%s: %w", source.Name, err)
+	}
+
+	text := string([]rune(source.Content)[start:end])
+	trimmed := strings.TrimLeftFunc(text, unicode.IsSpace)
+	start += utf8.RuneCountInString(text) - utf8.RuneCountInString(trimmed)
+	source.Content = strings.TrimRightFunc(trimmed, unicode.IsSpace)
+	if source.Content == "" {
+		return source, 0, "", fmt.Errorf("%s: the section %s is empty", source.Name, label)
+	}
+	return source, start, label, nil
+}
+
+// headingSpan finds the section under a path of headings, each one nested in the one before.
+// A heading matches its title, or the start of its title up to a word break, so "Chapter 3"
+// finds "Chapter 3: Results".
+func headingSpan(content string, path []string) (int, int, string, error) {
+	toc := extractTOC(content)
+	if len(toc) == 0 {
+		return 0, 0, "", fmt.Errorf("the source has no headings")
+	}
+
+	start, end, level := 0, utf8.RuneCountInString(content), 0
+	var label string
+	for _, want := range path {
+		want = strings.TrimSpace(want)
+		found := false
+		for _, entry := range toc {
+			if entry.Start >= start && entry.Start < end && entry.Level > level && headingMatches(entry.Title, want) {
+				start, end, level, label = entry.Start, entry.End, entry.Level, entry.Title
+				found = true
+				break
+			}
+		}
+		if !found {
+			return 0, 0, "", fmt.Errorf("no heading %q", want)
+		}
+	}
+	return start, end, label, nil
+}
+
+// headingMatches reports whether a heading title is, or starts with, the wanted text
+func headingMatches(title, want string) bool {
+	if want == "" || len(want) > len(title) || !strings.EqualFold(title[:len(want)], want) {
+		return false
+	}
+	rest := title[len(want):]
+	next, _ := utf8.DecodeRuneInString(rest)
+	return rest == "" || !unicode.IsLetter(next) && !unicode.IsDigit(next)
+}
+
+// pageSpan finds a range of pages. markitdown keeps the form feeds pdfminer puts between the pages
+// of a PDF, so sources of other formats have no pages.
+func pageSpan(content string, first, last int) (int, int, string, error) {
+	pages := strings.Split(content, "\f")
+	if len(pages) > 1 && strings.TrimSpace(pages[len(pages)-1]) == "" {
+		pages = pages[:len(pages)-1]
+	}
+	if len(pages) < 2 {
+		return 0, 0, "", fmt.Errorf("the source has no page breaks, select the section by heading instead")
+	}
+	if last == 0 {
+		last = first
+	}
+	if first < 1 || last < first || first > len(pages) {
+		return 0, 0, "", fmt.Errorf("invalid pages %d-%d, the source has %d pages", first, last, len(pages))
+	}
+	last = min(last, len(pages))
+
+	start, end := 0, 0
+	for i, page := range pages[:last] {
+		if i == first-1 {
+			start = end
+		}
+		end += utf8.RuneCountInString(page) + 1
+	}
+	end--
+
+	label := fmt.Sprintf("第 %d 页", first)
+	if last > first {
+		label = fmt.Sprintf("第 %d–%d 页", first, last)
+	}
+	return start, end, label, nil
+}
@@ -10,25 +10,185 @@ type User struct {
 	Email     string    `json:"email"`
 	Name      string    `json:"name"`
 	AvatarURL string    `json:"avatar_url"`
-	Provider  string    `json:"provider"` // google, github
+	Provider  string    `json:"provider"` // google, github, password, local
+	Role      string    `json:"role,omitempty"`
 	CreatedAt time.Time `json:"created_at"`
 	UpdatedAt time.Time `json:"updated_at"`
 }
 
+// RoleAdmin is the role of the account created by the first-run setup wizard
+const RoleAdmin = "admin"
+
 // Source represents a document source added to a notebook
 type Source struct {
-	ID         string                 `json:"id"`
-	NotebookID string                 `json:"notebook_id"`
-	Name       string                 `json:"name"`
-	Type       string                 `json:"type"` // "file", "url", "text", "youtube"
-	URL        string                 `json:"url,omitempty"`
-	Content    string                 `json:"content,omitempty"`
-	FileName   string                 `json:"file_name,omitempty"`
-	FileSize   int64                  `json:"file_size,omitempty"`
-	ChunkCount int                    `json:"chunk_count"`
-	CreatedAt  time.Time              `json:"created_at"`
-	UpdatedAt  time.Time              `json:"updated_at"`
-	Metadata   map[string]interface{} `json:"metadata,omitempty"`
+	ID           string                 `json:"id"`
+	NotebookID   string                 `json:"notebook_id"`
+	Name         string                 `json:"name"`
+	Type         string                 `json:"type"` // "file", "url", "text", "youtube", "database"
+	URL          string                 `json:"url,omitempty"`
+	Content      string                 `json:"content,omitempty"`
+	Summary      string                 `json:"summary,omitempty"`        // Leading excerpt of Content, used in list responses
+	ContentLen   int                    `json:"content_length,omitempty"` // Length of Content in characters
+	FileName     string                 `json:"file_name,omitempty"`
+	FileSize     int64                  `json:"file_size,omitempty"`
+	ChunkCount   int                    `json:"chunk_count"`
+	ReadAt       *time.Time             `json:"read_at,omitempty"`       // When the requesting user last opened it, nil if unread
+	Health       *SourceHealth          `json:"health,omitempty"`        // Last health check of a URL source, nil if never checked
+	IngestStatus string                 `json:"ingest_status,omitempty"` // Background import of a URL source or upload, empty if none
+	IngestJobID  string                 `json:"ingest_job_id,omitempty"`
+	IngestError  string                 `json:"ingest_error,omitempty"`
+	IngestDone   int                    `json:"ingest_done,omitempty"` // Pages read of a sitemap being imported, of IngestTotal
+	IngestTotal  int                    `json:"ingest_total,omitempty"`
+	Private      bool                   `json:"private,omitempty"` // Only the owner sees it, even when the notebook is public
+	CreatedAt    time.Time              `json:"created_at"`
+	UpdatedAt    time.Time              `json:"updated_at"`
+	Metadata     map[string]interface{} `json:"metadata,omitempty"`
+}
+
+// SourceDatabase is the connection of a database source, which the chat model queries live. The
+// DSN may hold a password and is never returned by the API.
+type SourceDatabase struct {
+	SourceID   string
+	SourceName string
+	Schema     string   // The source's content: the allowed tables and their columns
+	Driver     string   // "sqlite" or "postgres"
+	DSN        string   // As given, made read-only when it is opened
+	Tables     []string // Tables and views the model may query
+}
+
+// Source health check statuses
+const (
+	SourceHealthOK      = "ok"
+	SourceHealthChanged = "changed" // The page now differs substantially from the stored content
+	SourceHealthBroken  = "broken"  // The page failed to load in consecutive checks
+)
+
+// SourceHealth is the outcome of the latest health check of a URL source
+type SourceHealth struct {
+	Status     string    `json:"status"`
+	HTTPStatus int       `json:"http_status,omitempty"`
+	Similarity *float64  `json:"similarity,omitempty"` // Share of the stored content still on the page, nil if not compared
+	Error      string    `json:"error,omitempty"`
+	Failures   int       `json:"failures,omitempty"` // Consecutive failed checks
+	CheckedAt  time.Time `json:"checked_at"`
+}
+
+// Ingest job statuses
+const (
+	IngestStatusQueued  = "queued"
+	IngestStatusRunning = "running"
+	IngestStatusDone    = "done"
+	IngestStatusFailed  = "failed"
+)
+
+// IngestJob fetches or extracts the content of a source in the background and indexes it
+type IngestJob struct {
+	ID         string    `json:"id"`
+	SourceID   string    `json:"source_id"`
+	NotebookID string    `json:"notebook_id"`
+	UserID     string    `json:"user_id"`
+	Kind       string    `json:"kind"` // "url", "crawl", "sitemap", "paper", "youtube", "file", or "index" for content that only needs indexing
+	Status     string    `json:"status"`
+	Stage      string    `json:"stage,omitempty"` // What a running job is doing: "fetching", "crawling", "scanning", "extracting", "transcribing" or "indexing"
+	Error      string    `json:"error,omitempty"`
+	Progress   int       `json:"progress,omitempty"` // Items done of a job with many, such as the pages of a sitemap
+	Total      int       `json:"total,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// Transform job statuses
+const (
+	TransformStatusQueued    = "queued"
+	TransformStatusRunning   = "running"
+	TransformStatusCompleted = "completed"
+	TransformStatusFailed    = "failed"
+	TransformStatusCanceled  = "canceled"
+)
+
+// TransformJob generates a transformation note in the background. The request is stored with
+// its sources already resolved, so a resumed job uses the sources the user picked.
+type TransformJob struct {
+	ID         string                `json:"id"`
+	NotebookID string                `json:"notebook_id"`
+	UserID     string                `json:"user_id"`
+	Request    TransformationRequest `json:"request"`
+	Status     string                `json:"status"`
+	Stage      string                `json:"stage,omitempty"` // What a running job is doing: "generating", "rendering" or "voicing"
+	NoteID     string                `json:"note_id,omitempty"`
+	Note       *Note                 `json:"note,omitempty"` // Set on completed jobs when polled
+	Error      string                `json:"error,omitempty"`
+	CreatedAt  time.Time             `json:"created_at"`
+	UpdatedAt  time.Time             `json:"updated_at"`
+}
+
+// SourceVersion is a previous content of a source, kept when the source is refreshed or re-uploaded
+type SourceVersion struct {
+	ID         string    `json:"id"`
+	SourceID   string    `json:"source_id"`
+	Version    int       `json:"version"`
+	Content    string    `json:"content,omitempty"`
+	ContentLen int       `json:"content_length"` // Length of Content in characters
+	FileName   string    `json:"file_name,omitempty"`
+	FileSize   int64     `json:"file_size,omitempty"`
+	CreatedAt  time.Time `json:"created_at"` // When this content was replaced
+}
+
+// SummaryNode is a summary in the summary layer of a long source. Layer 1 summaries cover a
+// run of the source's chunks, and each layer above summarizes a run of the one below.
+type SummaryNode struct {
+	Layer      int    `json:"layer"`
+	Position   int    `json:"position"`    // Order within the layer
+	FirstChunk int    `json:"first_chunk"` // First and last source chunk covered
+	LastChunk  int    `json:"last_chunk"`
+	Start      int    `json:"start"` // Offsets of the covered text in the source, in characters
+	End        int    `json:"end"`
+	FirstPage  int    `json:"first_page,omitempty"` // Pages of a PDF or slides of a deck the covered text is on, counted from 1
+	LastPage   int    `json:"last_page,omitempty"`
+	StartTime  int    `json:"start_time,omitempty"` // Seconds of audio a transcript's covered text spans
+	EndTime    int    `json:"end_time,omitempty"`
+	Chapter    string `json:"chapter,omitempty"` // Chapter of an EPUB book or section of a Word document the covered text starts in
+	Content    string `json:"content"`
+}
+
+// TOCEntry is a heading in a source's table of contents. Start and End are the character offsets
+// of its section, which runs to the next heading of the same or a higher level.
+type TOCEntry struct {
+	Level int    `json:"level"`
+	Title string `json:"title"`
+	Start int    `json:"start"`
+	End   int    `json:"end"`
+}
+
+// SourceSection limits a chat question to a section of one source, given by character offsets
+// such as those of a table of contents entry. An End of 0 runs to the end of the source.
+type SourceSection struct {
+	SourceID string `json:"source_id"`
+	Start    int    `json:"start"`
+	End      int    `json:"end,omitempty"`
+}
+
+// SourceDiff is a line diff between two contents of a source
+type SourceDiff struct {
+	From    int        `json:"from"` // Version number, 0 for the current content
+	To      int        `json:"to"`
+	Added   int        `json:"added"`   // Lines added
+	Removed int        `json:"removed"` // Lines removed
+	Hunks   []DiffHunk `json:"hunks"`
+}
+
+// DiffHunk is a run of changed lines with a few unchanged lines around it
+type DiffHunk struct {
+	Lines []DiffLine `json:"lines"`
+}
+
+// DiffLine is a line of a diff. OldLine and NewLine are 1-based line numbers in the old and new
+// content, 0 on the side the line is missing from.
+type DiffLine struct {
+	Op      string `json:"op"` // "equal", "insert" or "delete"
+	Text    string `json:"text"`
+	OldLine int    `json:"old_line,omitempty"`
+	NewLine int    `json:"new_line,omitempty"`
 }
 
 // Note represents a note generated from sources
@@ -42,19 +202,111 @@ type Note struct {
 	CreatedAt  time.Time              `json:"created_at"`
 	UpdatedAt  time.Time              `json:"updated_at"`
 	Metadata   map[string]interface{} `json:"metadata,omitempty"`
+
+	// Per-note public sharing link (see /public/notes/:token)
+	ShareToken     string     `json:"share_token,omitempty"`
+	ShareExpiresAt *time.Time `json:"share_expires_at,omitempty"`
+
+	// Private notes are seen by the owner only: not on the public page, and not through
+	// their share link
+	Private bool `json:"private,omitempty"`
+
+	// ContentExternal marks a listed note whose content is in blob storage: Content holds its
+	// beginning only, and the note itself its full content
+	ContentExternal bool `json:"content_external,omitempty"`
+}
+
+// NoteVersion is a previous title, content and metadata of a note, kept when the note is edited
+type NoteVersion struct {
+	ID         string                 `json:"id"`
+	NoteID     string                 `json:"note_id"`
+	Version    int                    `json:"version"`
+	Title      string                 `json:"title"`
+	Content    string                 `json:"content,omitempty"`
+	ContentLen int                    `json:"content_length"` // Length of Content in characters
+	Metadata   map[string]interface{} `json:"metadata,omitempty"`
+	CreatedAt  time.Time              `json:"created_at"` // When this revision was replaced
 }
 
 // Notebook represents a collection of sources and notes
 type Notebook struct {
-	ID          string                 `json:"id"`
-	UserID      string                 `json:"user_id"`
-	Name        string                 `json:"name"`
-	Description string                 `json:"description,omitempty"`
-	IsPublic    bool                   `json:"is_public"`
-	PublicToken string                 `json:"public_token,omitempty"`
-	CreatedAt   time.Time              `json:"created_at"`
-	UpdatedAt   time.Time              `json:"updated_at"`
-	Metadata    map[string]interface{} `json:"metadata,omitempty"`
+	ID            string                 `json:"id"`
+	UserID        string                 `json:"user_id"`
+	Name          string                 `json:"name"`
+	Description   string                 `json:"description,omitempty"`
+	IsPublic      bool                   `json:"is_public"`
+	PublicToken   string                 `json:"public_token,omitempty"`
+	CoverImageURL string                 `json:"cover_image_url,omitempty"`
+	CreatedAt     time.Time              `json:"created_at"`
+	UpdatedAt     time.Time              `json:"updated_at"`
+	Metadata      map[string]interface{} `json:"metadata,omitempty"`
+	SharePolicy   *SharePolicy           `json:"share_policy,omitempty"` // Set on public notebook responses
+	LegalHold     *LegalHold             `json:"legal_hold,omitempty"`   // Set on the owner's notebook responses
+}
+
+// LegalHold makes a notebook immutable for compliance: its sources, notes and chat history can't
+// be added to, changed or deleted until an admin releases the hold
+type LegalHold struct {
+	NotebookID string    `json:"notebook_id"`
+	Reason     string    `json:"reason,omitempty"`
+	SetBy      string    `json:"set_by"` // ID of the admin who set the hold
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// GeneratedAsset is a generated image stored once per owner under the hash of its content, and
+// kept while a note references it
+type GeneratedAsset struct {
+	UserID    string    `json:"user_id"`
+	FileName  string    `json:"file_name"`
+	SHA256    string    `json:"sha256"`
+	Size      int64     `json:"size"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// ChatSettings are a notebook's defaults for chat
+type ChatSettings struct {
+	AnswerStyle string `json:"answer_style"` // ID of an answer style, "" answers without one
+
+	// Retrieval. Zero values use the server's defaults, which differ with reranking.
+	TopK             int     `json:"top_k"`              // Chunks searched per question
+	ScoreThreshold   float64 `json:"score_threshold"`    // Minimum similarity of a searched chunk
+	MaxContextChunks int     `json:"max_context_chunks"` // Chunks given to the model
+
+	Defaults *ChatSettings `json:"defaults,omitempty"` // The server's defaults, set on responses
+
+	section *chunkSpan // Set per question to only search a section of a source
+	// Set for answers to others than the owner, to leave out the notebook's private sources
+	hiddenSources map[string]bool
+}
+
+// SharePolicy is what the public link of a notebook exposes. The public handlers enforce it.
+type SharePolicy struct {
+	Notes     bool     `json:"notes"`                // Notes are listed
+	NoteTypes []string `json:"note_types,omitempty"` // If set, only notes of these types are listed
+	Sources   bool     `json:"sources"`              // Sources and their content are listed
+	Chat      bool     `json:"chat"`                 // Visitors can chat with the sources
+}
+
+// DefaultSharePolicy is the policy of notebooks whose owner never set one: notes and sources
+// are public, chat is not
+func DefaultSharePolicy() *SharePolicy {
+	return &SharePolicy{Notes: true, Sources: true}
+}
+
+// AllowsNote reports whether the policy exposes a note. Private notes are never exposed.
+func (p *SharePolicy) AllowsNote(note *Note) bool {
+	if !p.Notes || note.Private {
+		return false
+	}
+	if len(p.NoteTypes) == 0 {
+		return true
+	}
+	for _, t := range p.NoteTypes {
+		if t == note.Type {
+			return true
+		}
+	}
+	return false
 }
 
 // NotebookWithStats represents a notebook with statistics
@@ -71,6 +323,7 @@ type NotebookWithStats struct {
 	SourceCount   int                    `json:"source_count"`
 	NoteCount     int                    `json:"note_count"`
 	CoverImageURL string                 `json:"cover_image_url,omitempty"`
+	LegalHold     *LegalHold             `json:"legal_hold,omitempty"`
 }
 
 // ChatMessage represents a chat message
@@ -113,11 +366,25 @@ type Podcast struct {
 
 // TransformationRequest represents a request to generate a note
 type TransformationRequest struct {
-	Type      string   `json:"type"`       // "summary", "faq", "study_guide", "outline", "podcast", "custom"
-	Prompt    string   `json:"prompt"`     // Custom prompt for "custom" type
-	SourceIDs []string `json:"source_ids"` // Specific sources to use, empty = all
-	Length    string   `json:"length"`     // "short", "medium", "long"
-	Format    string   `json:"format"`     // "markdown", "bullet_points", "paragraphs"
+	Type       string   `json:"type"`        // "summary", "faq", "study_guide", "outline", "podcast", "custom"
+	Prompt     string   `json:"prompt"`      // Custom prompt for "custom" type
+	SourceIDs  []string `json:"source_ids"`  // Specific sources to use, empty = all
+	Length     string   `json:"length"`      // "short", "medium", "long"
+	Format     string   `json:"format"`      // "markdown", "bullet_points", "paragraphs"
+	UnreadOnly bool     `json:"unread_only"` // Only use sources the user hasn't opened yet
+
+	CitationStyle string `json:"citation_style"` // "apa" (default) or "mla", for the "references" type
+
+	// Section narrows the transformation to part of one source, e.g. a chapter of a textbook
+	Section *TransformationSection `json:"section,omitempty"`
+}
+
+// TransformationSection picks part of a source for a transformation, by heading path or by page range
+type TransformationSection struct {
+	SourceID  string   `json:"source_id"`
+	Heading   []string `json:"heading,omitempty"`    // Headings from the table of contents, outermost first, e.g. ["Part II", "Chapter 3"]
+	FirstPage int      `json:"first_page,omitempty"` // Pages of a PDF, counted from 1
+	LastPage  int      `json:"last_page,omitempty"`  // Defaults to FirstPage
 }
 
 // TransformationResponse represents the response from a transformation
@@ -132,15 +399,516 @@ type TransformationResponse struct {
 
 // SourceSummary is a lightweight source reference
 type SourceSummary struct {
-	ID   string `json:"id"`
-	Name string `json:"name"`
-	Type string `json:"type"`
+	ID    string   `json:"id"`
+	Name  string   `json:"name"`
+	Type  string   `json:"type"`
+	Score *float64 `json:"score,omitempty"` // Best relevance (0-1) of the source's retrieved chunks, if scored
+}
+
+// Citation points at the passage of a source a generated answer drew from.
+// Start and End are character (rune) offsets into the source content.
+type Citation struct {
+	Index      int    `json:"index"` // Matches the [来源 N] / Source N numbering given to the LLM
+	SourceID   string `json:"source_id"`
+	SourceName string `json:"source_name"`
+	Start      int    `json:"start"`
+	End        int    `json:"end"`
+	FirstPage  int    `json:"first_page,omitempty"` // Pages of a PDF source or slides of a deck the passage is on
+	LastPage   int    `json:"last_page,omitempty"`
+	StartTime  int    `json:"start_time,omitempty"` // Seconds into the audio of a transcript the passage is spoken
+	EndTime    int    `json:"end_time,omitempty"`
+	Chapter    string `json:"chapter,omitempty"` // Chapter of an EPUB book or section of a Word document the passage is in
+	URL        string `json:"url,omitempty"`     // Deep link into the public viewer, set on public responses only
+}
+
+// Collaborator is a user with access to a notebook, and whether they are viewing it now
+type Collaborator struct {
+	UserID      string     `json:"user_id"`
+	Name        string     `json:"name"`
+	Email       string     `json:"email"`
+	AvatarURL   string     `json:"avatar_url,omitempty"`
+	Role        string     `json:"role"`               // "owner", or "viewer" for others with access
+	Active      bool       `json:"active"`             // Has the notebook open now
+	Sessions    int        `json:"sessions,omitempty"` // Open tabs and devices
+	ActiveSince *time.Time `json:"active_since,omitempty"`
+	LastSeen    *time.Time `json:"last_seen,omitempty"` // Latest heartbeat
+}
+
+// CollaboratorsResponse lists the collaborators of a notebook
+type CollaboratorsResponse struct {
+	Collaborators []Collaborator `json:"collaborators"`
+	PublicViewers int            `json:"public_viewers"` // Anonymous viewers of the public page
+}
+
+// QuickNoteRequest is a snippet captured without choosing a notebook
+type QuickNoteRequest struct {
+	Content string `json:"content" binding:"required"`
+	Title   string `json:"title"` // Defaults to the first line of content
+	URL     string `json:"url"`   // Page the snippet came from, stored but not fetched
+}
+
+// QuickNoteResponse reports where a quick note was filed
+type QuickNoteResponse struct {
+	NotebookID   string  `json:"notebook_id"`
+	NotebookName string  `json:"notebook_name"`
+	Source       *Source `json:"source"`
+}
+
+// ChatExportRequest turns a chat session, or a range of its messages, into a source or a note
+type ChatExportRequest struct {
+	As            string `json:"as"`    // "source" (default) or "note"
+	Title         string `json:"title"` // Defaults to the session title, or the first question
+	FromMessageID string `json:"from_message_id"`
+	ToMessageID   string `json:"to_message_id"`
+}
+
+// ChatExportResponse holds the source or note a chat session was exported to
+type ChatExportResponse struct {
+	Source       *Source `json:"source,omitempty"`
+	Note         *Note   `json:"note,omitempty"`
+	MessageCount int     `json:"message_count"`
+}
+
+// Integration connects a Slack or Discord bot to a user's notebooks.
+// Secrets are never serialized back to clients.
+type Integration struct {
+	ID            string    `json:"id"`
+	UserID        string    `json:"user_id"`
+	Provider      string    `json:"provider"` // "slack", "discord", "telegram"
+	BotToken      string    `json:"-"`
+	SigningSecret string    `json:"-"`                        // Slack request signing secret, Telegram webhook secret token
+	PublicKey     string    `json:"public_key,omitempty"`     // Discord application public key (hex)
+	ApplicationID string    `json:"application_id,omitempty"` // Discord application ID
+	CreatedAt     time.Time `json:"created_at"`
+	UpdatedAt     time.Time `json:"updated_at"`
+}
+
+// IntegrationRequest configures an integration
+type IntegrationRequest struct {
+	BotToken      string `json:"bot_token"`
+	SigningSecret string `json:"signing_secret"`
+	PublicKey     string `json:"public_key"`
+	ApplicationID string `json:"application_id"`
+	BaseURL       string `json:"base_url"` // Public URL of this server for webhook registration, defaults to the request's host
+}
+
+// IntegrationResponse describes a configured integration and the URL to register with the platform
+type IntegrationResponse struct {
+	Integration
+	HasBotToken bool   `json:"has_bot_token"`
+	Endpoint    string `json:"endpoint"` // Path of the slash command / interactions endpoint
+}
+
+// IngestHook lets automation tools push content into a notebook through /api/hooks/ingest.
+// The token authenticates the caller in place of a user session. Only its hash is stored, so
+// it is returned once, when the hook is created.
+type IngestHook struct {
+	ID           string     `json:"id"`
+	UserID       string     `json:"user_id"`
+	Name         string     `json:"name"`
+	Token        string     `json:"token,omitempty"`
+	NotebookID   string     `json:"notebook_id"`
+	NameTemplate string     `json:"name_template"` // Source name, e.g. "{title} ({date})"; defaults to "{title}"
+	CreatedAt    time.Time  `json:"created_at"`
+	LastUsedAt   *time.Time `json:"last_used_at,omitempty"`
+}
+
+// IngestHookRequest creates an ingest hook
+type IngestHookRequest struct {
+	Name         string `json:"name" binding:"required"`
+	NotebookID   string `json:"notebook_id" binding:"required"`
+	NameTemplate string `json:"name_template"`
+}
+
+// HookFile identifies a file of a watched folder by its path relative to the folder and the
+// SHA-256 of its bytes
+type HookFile struct {
+	Path   string `json:"path"`
+	SHA256 string `json:"sha256"`
+}
+
+// HookFilesCheckRequest asks which files of a watched folder need uploading
+type HookFilesCheckRequest struct {
+	Files []HookFile `json:"files" binding:"required"`
+}
+
+// HookFileResult is what happened, or would happen, to one file pushed through an ingest hook.
+// Status is "new", "changed" or "unchanged" when checking, and "added", "updated", "unchanged"
+// or "failed" when uploading.
+type HookFileResult struct {
+	Path     string `json:"path"`
+	Status   string `json:"status"`
+	SourceID string `json:"source_id,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// SavedPrompt is a chat prompt a user keeps for recurring analyses. {name} placeholders in
+// Text are filled in from its variables each time it is run against a notebook.
+type SavedPrompt struct {
+	ID        string           `json:"id"`
+	UserID    string           `json:"user_id"`
+	Title     string           `json:"title"`
+	Text      string           `json:"text"`
+	Variables []PromptVariable `json:"variables"`
+	CreatedAt time.Time        `json:"created_at"`
+	UpdatedAt time.Time        `json:"updated_at"`
+	LastRunAt *time.Time       `json:"last_run_at,omitempty"`
+}
+
+// PromptVariable is a placeholder of a saved prompt
+type PromptVariable struct {
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	Default     string `json:"default,omitempty"` // Used when a run doesn't give a value
+}
+
+// SavedPromptRequest creates or replaces a saved prompt. Placeholders used in the text but
+// not listed in variables are added without a default.
+type SavedPromptRequest struct {
+	Title     string           `json:"title" binding:"required"`
+	Text      string           `json:"text" binding:"required"`
+	Variables []PromptVariable `json:"variables"`
+}
+
+// RunPromptRequest runs a saved prompt as a chat message in a notebook
+type RunPromptRequest struct {
+	NotebookID string            `json:"notebook_id" binding:"required"`
+	SessionID  string            `json:"session_id"` // Continues a chat session; a new one is started if empty
+	Variables  map[string]string `json:"variables"`
+}
+
+// CalendarFeed is an ICS feed (e.g. a Google Calendar secret address) attached to a notebook.
+// Each meeting in the feed becomes a dated source of the notebook.
+type CalendarFeed struct {
+	ID           string     `json:"id"`
+	NotebookID   string     `json:"notebook_id"`
+	UserID       string     `json:"user_id"`
+	Name         string     `json:"name"`
+	URL          string     `json:"url"`
+	AutoSummary  bool       `json:"auto_summary"` // Pair uploads right after a meeting with it as its transcript
+	LastSyncedAt *time.Time `json:"last_synced_at,omitempty"`
+	LastError    string     `json:"last_error,omitempty"`
+	CreatedAt    time.Time  `json:"created_at"`
+}
+
+// CalendarFeedRequest attaches a calendar feed to a notebook
+type CalendarFeedRequest struct {
+	URL         string `json:"url" binding:"required"`
+	Name        string `json:"name"`
+	AutoSummary bool   `json:"auto_summary"`
+}
+
+// CalendarEvent links an imported meeting to its source, transcript and summary note
+type CalendarEvent struct {
+	FeedID             string
+	EventKey           string // Event UID plus start time, unique per occurrence
+	SourceID           string
+	StartsAt           time.Time
+	EndsAt             time.Time
+	TranscriptSourceID string
+	SummaryNoteID      string
+}
+
+// MeetingTranscriptRequest pairs a meeting source with an uploaded transcript
+type MeetingTranscriptRequest struct {
+	TranscriptSourceID string `json:"transcript_source_id" binding:"required"`
+}
+
+// Connector imports the pages of Confluence spaces or the files of a SharePoint document
+// library into a notebook as sources, and keeps them in sync
+type Connector struct {
+	ID           string            `json:"id"`
+	NotebookID   string            `json:"notebook_id"`
+	UserID       string            `json:"user_id"`
+	Kind         string            `json:"kind"` // "confluence", "sharepoint" or "s3"
+	Name         string            `json:"name"`
+	Settings     ConnectorSettings `json:"settings"`
+	Secret       string            `json:"-"` // Confluence API token, SharePoint client secret or S3 secret access key; encrypted when stored
+	Cursor       string            `json:"-"` // Where the next sync starts: a time for Confluence, a delta link for SharePoint
+	LastSyncedAt *time.Time        `json:"last_synced_at,omitempty"`
+	LastError    string            `json:"last_error,omitempty"`
+	CreatedAt    time.Time         `json:"created_at"`
+}
+
+// ConnectorSettings locates what a connector imports and how it signs in
+type ConnectorSettings struct {
+	// Confluence
+	BaseURL  string   `json:"base_url,omitempty"` // e.g. https://acme.atlassian.net/wiki
+	Spaces   []string `json:"spaces,omitempty"`   // Space keys
+	Username string   `json:"username,omitempty"` // Atlassian account email; empty for a Data Center personal access token
+
+	// SharePoint, signed in as an Entra ID app with the Sites.Read.All application permission
+	Site     string `json:"site,omitempty"`    // e.g. acme.sharepoint.com:/sites/Engineering
+	Library  string `json:"library,omitempty"` // Document library name, "Documents" by default
+	TenantID string `json:"tenant_id,omitempty"`
+	ClientID string `json:"client_id,omitempty"`
+	DriveID  string `json:"drive_id,omitempty"` // The library's drive, found on the first sync
+
+	// S3 and S3-compatible storage such as MinIO or Cloudflare R2
+	Bucket      string `json:"bucket,omitempty"`
+	Prefix      string `json:"prefix,omitempty"`        // Only objects whose keys start with it are imported
+	Region      string `json:"region,omitempty"`        // "us-east-1" by default
+	Endpoint    string `json:"endpoint,omitempty"`      // For other than AWS, addressed path-style
+	AccessKeyID string `json:"access_key_id,omitempty"` // Empty for a public bucket
+}
+
+// ConnectorRequest attaches a connector to a notebook
+type ConnectorRequest struct {
+	Kind     string            `json:"kind" binding:"required"`
+	Name     string            `json:"name"`
+	Settings ConnectorSettings `json:"settings"`
+	Secret   string            `json:"secret"` // required except for public S3 buckets
+}
+
+// NotebookImportResult is the notebook created from an imported archive, with the number of
+// items recreated in it
+type NotebookImportResult struct {
+	Notebook *Notebook `json:"notebook"`
+	Sources  int       `json:"sources"`
+	Notes    int       `json:"notes"`
+	Chats    int       `json:"chats"`
+}
+
+// ConnectorSyncResult counts the sources a connector sync changed
+type ConnectorSyncResult struct {
+	Added   int `json:"added"`
+	Updated int `json:"updated"`
+	Removed int `json:"removed"`
+}
+
+// Reference is the bibliographic record of a source imported from BibTeX or Zotero,
+// stored in the source's metadata under "reference"
+type Reference struct {
+	Key       string   `json:"key,omitempty"` // BibTeX citation key or CSL item ID
+	EntryType string   `json:"entry_type"`    // BibTeX entry type: "article", "book", "inproceedings", ...
+	Title     string   `json:"title"`
+	Authors   []string `json:"authors"` // "Family, Given", or a literal name for organizations
+	Year      string   `json:"year,omitempty"`
+	Venue     string   `json:"venue,omitempty"` // Journal, proceedings or book title
+	Volume    string   `json:"volume,omitempty"`
+	Issue     string   `json:"issue,omitempty"`
+	Pages     string   `json:"pages,omitempty"`
+	Publisher string   `json:"publisher,omitempty"`
+	DOI       string   `json:"doi,omitempty"`
+	URL       string   `json:"url,omitempty"`
+	Abstract  string   `json:"abstract,omitempty"`
+	Keywords  string   `json:"keywords,omitempty"`
+}
+
+// BibliographyImportResponse reports the sources created from a bibliography export
+type BibliographyImportResponse struct {
+	Imported int      `json:"imported"`
+	Skipped  int      `json:"skipped"` // Entries already in the notebook (same DOI or citation key)
+	Sources  []Source `json:"sources"`
+}
+
+// NoteReferencesResponse lists the formatted citations of a note's sources
+type NoteReferencesResponse struct {
+	Style      string   `json:"style"`
+	References []string `json:"references"`
+}
+
+// RelatedPaper is a paper suggested from a notebook's paper sources
+type RelatedPaper struct {
+	ID        string    `json:"id"` // arXiv ID or DOI, added as a URL source to import the paper
+	Reference Reference `json:"reference"`
+	Citations int       `json:"citations,omitempty"`
+}
+
+// SearchPassage is a passage of a source that matches a search within a notebook's sources.
+// Start, End and Matches are character (rune) offsets into the source content.
+type SearchPassage struct {
+	SourceID   string   `json:"source_id"`
+	SourceName string   `json:"source_name"`
+	Text       string   `json:"text"`
+	Start      int      `json:"start"`
+	End        int      `json:"end"`
+	Matches    [][2]int `json:"matches,omitempty"` // Where the query occurs word for word
+	MatchedBy  []string `json:"matched_by"`        // "keyword" and/or "vector"
+	Score      float64  `json:"score"`             // Fused rank of both searches, higher first
+}
+
+// SearchResponse lists the passages of a notebook's sources matching a query, best first
+type SearchResponse struct {
+	Query    string          `json:"query"`
+	Passages []SearchPassage `json:"passages"`
+}
+
+// RelatedPapersResponse lists related-paper suggestions and the service they came from
+type RelatedPapersResponse struct {
+	Provider string         `json:"provider"` // "semantic_scholar" or "crossref"
+	Papers   []RelatedPaper `json:"papers"`
+}
+
+// OverlapCheckRequest asks which passages of a draft closely match the notebook's sources.
+// The draft is either a saved note or the given content.
+type OverlapCheckRequest struct {
+	NoteID    string   `json:"note_id"`
+	Content   string   `json:"content"`
+	SourceIDs []string `json:"source_ids"` // Defaults to all sources in the notebook
+	Threshold float64  `json:"threshold"`  // Minimum similarity to flag a passage, defaults to 0.5
+}
+
+// OverlapPassage is a passage of the draft that closely matches a source passage.
+// Start and End are character (rune) offsets into the draft; the citation locates the source passage.
+type OverlapPassage struct {
+	Start      int      `json:"start"`
+	End        int      `json:"end"`
+	Text       string   `json:"text"`
+	Similarity float64  `json:"similarity"` // Share of the passage's word sequences found in the source, 0 to 1
+	Quoted     bool     `json:"quoted"`     // The passage is in quotation marks, so the overlap is likely intended
+	Citation   Citation `json:"citation"`
+}
+
+// OverlapReport lists the flagged passages of a draft
+type OverlapReport struct {
+	Coverage float64          `json:"coverage"` // Share of the draft's text in flagged passages, 0 to 1
+	Passages []OverlapPassage `json:"passages"`
+}
+
+// NoteAssistRequest asks the writing assistant to work on a note, or on a passage of it
+type NoteAssistRequest struct {
+	Operation    string `json:"operation" binding:"required"` // "rewrite", "expand", "shorten" or "critique"
+	Selection    string `json:"selection"`                    // Passage of the note to work on, defaults to the whole note
+	Instructions string `json:"instructions"`                 // Extra guidance such as audience or tone
+	Apply        bool   `json:"apply"`                        // Replace the passage in the note with the result; not for critique
+}
+
+// NoteAssistResponse is the writing assistant's output with the source passages it was grounded in
+type NoteAssistResponse struct {
+	Operation string     `json:"operation"`
+	Result    string     `json:"result"`
+	Citations []Citation `json:"citations"`
+	Note      *Note      `json:"note,omitempty"` // The updated note, when the result was applied
+}
+
+// NoteEdit is one change proposed in a note's editing chat: Find is replaced by Replace
+type NoteEdit struct {
+	Find    string `json:"find"` // Exact text of the note to replace, empty to append Replace to the note
+	Replace string `json:"replace"`
+}
+
+// NoteEditChatRequest is a message in a note's editing chat
+type NoteEditChatRequest struct {
+	Message   string `json:"message" binding:"required"`
+	SessionID string `json:"session_id"` // A session of this note's editing chat, empty to start one
+}
+
+// NoteEditProposal is the assistant's reply in a note's editing chat: the edits it proposes and
+// why. Nothing changes until the edits are applied.
+type NoteEditProposal struct {
+	SessionID string     `json:"session_id"`
+	MessageID string     `json:"message_id"`
+	Message   string     `json:"message"`
+	Edits     []NoteEdit `json:"edits"`
+	Citations []Citation `json:"citations"`
+}
+
+// ApplyNoteEditsRequest accepts a proposal's edits, all of them unless Edits picks some by index
+type ApplyNoteEditsRequest struct {
+	Edits []int `json:"edits"`
+}
+
+// Draft job stages
+const (
+	DraftStatusOutlining        = "outlining"
+	DraftStatusAwaitingApproval = "awaiting_approval" // The outline waits for the user to edit and approve it
+	DraftStatusDrafting         = "drafting"
+	DraftStatusCompleted        = "completed"
+	DraftStatusFailed           = "failed"
+)
+
+// DraftJob turns sources into a long-form document in stages: an outline is generated, edited
+// and approved by the user, then expanded section by section. Progress is stored after every
+// step, so an interrupted or failed job resumes where it stopped.
+type DraftJob struct {
+	ID         string         `json:"id"`
+	NotebookID string         `json:"notebook_id"`
+	UserID     string         `json:"user_id"`
+	Brief      string         `json:"brief"` // What the document should cover
+	Length     string         `json:"length"`
+	SourceIDs  []string       `json:"source_ids"` // Empty means all sources of the notebook
+	Status     string         `json:"status"`
+	Outline    string         `json:"outline"`  // Markdown with one "## " heading per section
+	Sections   []DraftSection `json:"sections"` // Set when the outline is approved
+	Citations  []Citation     `json:"citations"`
+	NoteID     string         `json:"note_id,omitempty"` // The finished document
+	Error      string         `json:"error,omitempty"`
+	CreatedAt  time.Time      `json:"created_at"`
+	UpdatedAt  time.Time      `json:"updated_at"`
+}
+
+// DraftSection is one section of the approved outline and, once written, its text.
+// [来源 N] markers in the text refer to the job's citation with index N.
+type DraftSection struct {
+	Heading string `json:"heading"`
+	Points  string `json:"points,omitempty"` // The outline's notes under the heading
+	Content string `json:"content,omitempty"`
+}
+
+// DraftRequest starts a draft job
+type DraftRequest struct {
+	Brief     string   `json:"brief" binding:"required"`
+	SourceIDs []string `json:"source_ids"`
+	Length    string   `json:"length"` // Length of each section: "short", "medium" or "long"
+}
+
+// DraftOutlineRequest replaces the outline of a draft waiting for approval
+type DraftOutlineRequest struct {
+	Outline string `json:"outline" binding:"required"`
+}
+
+// ChatTool is an HTTP endpoint registered on a notebook that the chat model can call as a
+// function. The auth header value is never serialized back to clients.
+type ChatTool struct {
+	ID           string                 `json:"id"`
+	NotebookID   string                 `json:"notebook_id"`
+	UserID       string                 `json:"user_id"`
+	Name         string                 `json:"name"`        // Function name shown to the model
+	Description  string                 `json:"description"` // Tells the model what the tool looks up and when to call it
+	Endpoint     string                 `json:"endpoint"`    // Receives the call's arguments as a JSON POST body
+	Parameters   map[string]interface{} `json:"parameters"`  // JSON Schema of the arguments
+	AuthHeader   string                 `json:"auth_header,omitempty"`
+	AuthValue    string                 `json:"-"`
+	HasAuthValue bool                   `json:"has_auth_value"`
+	Enabled      bool                   `json:"enabled"`
+	CreatedAt    time.Time              `json:"created_at"`
+	UpdatedAt    time.Time              `json:"updated_at"`
+}
+
+// ChatToolRequest registers or updates a chat tool. An empty auth_value keeps the stored one
+// on update.
+type ChatToolRequest struct {
+	Name        string                 `json:"name" binding:"required"`
+	Description string                 `json:"description" binding:"required"`
+	Endpoint    string                 `json:"endpoint" binding:"required"`
+	Parameters  map[string]interface{} `json:"parameters"`
+	AuthHeader  string                 `json:"auth_header"`
+	AuthValue   string                 `json:"auth_value"`
+	Enabled     *bool                  `json:"enabled"`
+}
+
+// ChatToolCall logs one call the chat model made to a chat tool
+type ChatToolCall struct {
+	ID         string    `json:"id"`
+	ToolID     string    `json:"tool_id"`
+	NotebookID string    `json:"notebook_id"`
+	SessionID  string    `json:"session_id,omitempty"`
+	ToolName   string    `json:"tool_name"`
+	Arguments  string    `json:"arguments"`
+	StatusCode int       `json:"status_code,omitempty"`
+	Response   string    `json:"response,omitempty"` // Truncated response body
+	Error      string    `json:"error,omitempty"`
+	DurationMS int64     `json:"duration_ms"`
+	CreatedAt  time.Time `json:"created_at"`
 }
 
 // ChatRequest represents a chat request
 type ChatRequest struct {
 	Message   string                 `json:"message"`
 	SessionID string                 `json:"session_id,omitempty"`
+	Style     string                 `json:"style,omitempty"` // Answer style ID; defaults to the notebook's chat settings
+	Section   *SourceSection         `json:"section,omitempty"`
 	Context   map[string]interface{} `json:"context,omitempty"`
 }
 
@@ -148,11 +916,78 @@ type ChatRequest struct {
 type ChatResponse struct {
 	Message   string                 `json:"message"`
 	Sources   []SourceSummary        `json:"sources"`
+	Citations []Citation             `json:"citations,omitempty"`
 	SessionID string                 `json:"session_id"`
 	MessageID string                 `json:"message_id"`
 	Metadata  map[string]interface{} `json:"metadata,omitempty"`
 }
 
+// BatchChatRequest asks a notebook a list of questions at once, e.g. a question bank
+type BatchChatRequest struct {
+	Questions []string `json:"questions" binding:"required"`
+	Style     string   `json:"style"`  // Answer style for all questions, defaults to the notebook's
+	Format    string   `json:"format"` // "json" (default) or "csv"
+}
+
+// BatchChatResult is the answer to one question of a batch
+type BatchChatResult struct {
+	Index     int        `json:"index"`
+	Question  string     `json:"question"`
+	Answer    string     `json:"answer"`
+	Sources   []string   `json:"sources"` // Names of the sources the answer drew from
+	Citations []Citation `json:"citations,omitempty"`
+	Error     string     `json:"error,omitempty"`
+}
+
+// BatchChatResponse holds the answers of a batch in the order the questions were asked
+type BatchChatResponse struct {
+	Results    []BatchChatResult `json:"results"`
+	Answered   int               `json:"answered"`
+	Failed     int               `json:"failed"`
+	Retrievals int               `json:"retrievals"` // Searches run; repeated questions share one
+}
+
+// Support levels of a question in a coverage report
+const (
+	SupportStrong  = "strong"  // The retrieved passages answer the question
+	SupportPartial = "partial" // They answer part of it
+	SupportNone    = "none"    // They don't answer it
+)
+
+// CoverageRequest asks how well a notebook's sources cover a list of questions
+type CoverageRequest struct {
+	Questions []string `json:"questions" binding:"required"`
+	SaveNote  bool     `json:"save_note"` // Also save the report as a note
+}
+
+// QuestionCoverage is how well the sources support the answer to one question
+type QuestionCoverage struct {
+	Index     int      `json:"index"`
+	Question  string   `json:"question"`
+	Support   string   `json:"support"` // SupportStrong, SupportPartial or SupportNone; empty on error
+	Reason    string   `json:"reason,omitempty"`
+	Sources   []string `json:"sources"`   // IDs of the sources whose passages support the answer
+	Retrieved []string `json:"retrieved"` // IDs of the sources of all retrieved passages
+	Error     string   `json:"error,omitempty"`
+}
+
+// SourceCoverage is how much one source contributes to answering the questions
+type SourceCoverage struct {
+	SourceID   string `json:"source_id"`
+	SourceName string `json:"source_name"`
+	Supported  []int  `json:"supported"` // Indexes of the questions its passages support
+	Retrieved  int    `json:"retrieved"` // Questions it was retrieved for
+}
+
+// CoverageReport shows which sources answer a list of questions and which questions the
+// sources answer poorly, i.e. the gaps in the notebook's sources
+type CoverageReport struct {
+	Questions []QuestionCoverage `json:"questions"`
+	Sources   []SourceCoverage   `json:"sources"` // All sources of the notebook, most supporting first
+	Weak      []int              `json:"weak"`    // Indexes of the questions with partial or no support
+	Note      *Note              `json:"note,omitempty"`
+}
+
 // ErrorResponse represents an error response
 type ErrorResponse struct {
 	Error   string `json:"error"`
@@ -172,6 +1007,52 @@ type HealthResponse struct {
 type ConfigResponse struct {
 }
 
+// SetupRequest is the payload accepted by the first-run setup wizard
+type SetupRequest struct {
+	Admin    SetupAdmin `json:"admin"`
+	Settings Settings   `json:"settings"`
+}
+
+// SetupAdmin describes the initial admin account
+type SetupAdmin struct {
+	Email    string `json:"email" binding:"required"`
+	Name     string `json:"name"`
+	Password string `json:"password" binding:"required"`
+}
+
+// SetupStatus reports whether the server still needs first-run setup
+type SetupStatus struct {
+	SetupRequired bool `json:"setup_required"`
+	LLMConfigured bool `json:"llm_configured"`
+}
+
+// AuthSession is a sign-in on a device, or an issued API token. Tokens name their session,
+// so deleting it revokes the token.
+type AuthSession struct {
+	ID         string    `json:"id"`
+	UserID     string    `json:"-"`
+	Name       string    `json:"name,omitempty"`  // Name of an API token
+	Scope      string    `json:"scope,omitempty"` // Scope of an API token; empty for sign-ins
+	IPAddress  string    `json:"ip_address"`      // Where the session was last seen from
+	UserAgent  string    `json:"user_agent"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+	ExpiresAt  time.Time `json:"expires_at"`
+	Current    bool      `json:"current"` // Whether the listing request was made with it
+}
+
+// UserIdentity is an account of an OAuth provider linked to a user, who signs in with any of
+// their identities. It is how the provider knows the person, so it survives changes of email.
+type UserIdentity struct {
+	Provider   string    `json:"provider"` // github or google
+	Subject    string    `json:"subject"`  // The provider's ID of the account
+	UserID     string    `json:"-"`
+	Email      string    `json:"email,omitempty"` // As the provider last reported them
+	Name       string    `json:"name,omitempty"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+}
+
 // ActivityLog represents a user activity log entry
 type ActivityLog struct {
 	ID           string    `json:"id"`
@@ -185,3 +1066,128 @@ type ActivityLog struct {
 	UserAgent    string    `json:"user_agent"`
 	CreatedAt    time.Time `json:"created_at"`
 }
+
+// NotebookActivity is an entry in a notebook's activity feed, an activity log without the
+// client details
+type NotebookActivity struct {
+	ID           string                 `json:"id"`
+	UserID       string                 `json:"user_id"`
+	Action       string                 `json:"action"`
+	ResourceType string                 `json:"resource_type"`
+	ResourceID   string                 `json:"resource_id"`
+	ResourceName string                 `json:"resource_name"`
+	Details      map[string]interface{} `json:"details,omitempty"`
+	CreatedAt    time.Time              `json:"created_at"`
+}
+
+// UsageRecord is the token usage of one LLM call, or the images of one image call
+type UsageRecord struct {
+	ID               string    `json:"id"`
+	UserID           string    `json:"user_id"`
+	NotebookID       string    `json:"notebook_id,omitempty"`
+	Operation        string    `json:"operation"` // "chat", a transformation type, "source_summary", ...
+	Model            string    `json:"model"`     // provider/model
+	PromptTokens     int       `json:"prompt_tokens"`
+	CompletionTokens int       `json:"completion_tokens"`
+	Images           int       `json:"images,omitempty"`
+	Cost             float64   `json:"cost"` // Estimated, in USD
+	CreatedAt        time.Time `json:"created_at"`
+}
+
+// UsageTotals sums the usage records of a group
+type UsageTotals struct {
+	Key              string  `json:"key,omitempty"` // The operation, model, day or user the totals are for
+	Calls            int     `json:"calls"`
+	PromptTokens     int     `json:"prompt_tokens"`
+	CompletionTokens int     `json:"completion_tokens"`
+	Images           int     `json:"images"`
+	Cost             float64 `json:"cost"`
+}
+
+// UsageReport is the usage of a user, or of all users, over a period
+type UsageReport struct {
+	Since       time.Time     `json:"since"`
+	Until       time.Time     `json:"until"`
+	Total       UsageTotals   `json:"total"`
+	ByOperation []UsageTotals `json:"by_operation"`
+	ByModel     []UsageTotals `json:"by_model"`
+	ByDay       []UsageTotals `json:"by_day"`
+	ByUser      []UsageTotals `json:"by_user,omitempty"` // Admin report only, keyed by email
+}
+
+// ExportedEvent is an activity log or usage record as sent to the event export sink. Client
+// details such as IP addresses are left out.
+type ExportedEvent struct {
+	Type             string                 `json:"type"` // "activity" or "usage"
+	ID               string                 `json:"id"`
+	UserID           string                 `json:"user_id"`
+	NotebookID       string                 `json:"notebook_id,omitempty"`
+	Action           string                 `json:"action"` // The activity action, or the usage operation
+	ResourceType     string                 `json:"resource_type,omitempty"`
+	ResourceID       string                 `json:"resource_id,omitempty"`
+	ResourceName     string                 `json:"resource_name,omitempty"`
+	Details          map[string]interface{} `json:"details,omitempty"`
+	Model            string                 `json:"model,omitempty"`
+	PromptTokens     int                    `json:"prompt_tokens,omitempty"`
+	CompletionTokens int                    `json:"completion_tokens,omitempty"`
+	Images           int                    `json:"images,omitempty"`
+	Cost             float64                `json:"cost,omitempty"`
+	CreatedAt        time.Time              `json:"created_at"`
+}
+
+// EventCursor marks the last event of a stream that was exported
+type EventCursor struct {
+	CreatedAt int64 // Unix seconds
+	ID        string
+}
+
+// SlowRequest is a request that took longer than its route's slow-request threshold, with the
+// time its database, retrieval and LLM calls took
+type SlowRequest struct {
+	Route       string    `json:"route"` // Method and route pattern, e.g. "POST /api/notebooks/:id/chat"
+	Path        string    `json:"path"`
+	Status      int       `json:"status"`
+	UserID      string    `json:"user_id,omitempty"`
+	DurationMs  float64   `json:"duration_ms"`
+	DBMs        float64   `json:"db_ms"`
+	RetrievalMs float64   `json:"retrieval_ms"`
+	LLMMs       float64   `json:"llm_ms"`
+	OtherMs     float64   `json:"other_ms"` // The rest of the duration
+	ThresholdMs float64   `json:"threshold_ms"`
+	Time        time.Time `json:"time"`
+}
+
+// RouteLatency is the latency of a route since the server started. Percentiles are taken from
+// its latest 1000 requests.
+type RouteLatency struct {
+	Route       string  `json:"route"`
+	Count       int64   `json:"count"`
+	Slow        int64   `json:"slow"` // Requests over the threshold
+	P50Ms       float64 `json:"p50_ms"`
+	P95Ms       float64 `json:"p95_ms"`
+	P99Ms       float64 `json:"p99_ms"`
+	ThresholdMs float64 `json:"threshold_ms"` // 0 if slow requests aren't logged
+}
+
+// ErrorReport is a panic or failure sent to Sentry or the error report webhook
+type ErrorReport struct {
+	Kind        string            `json:"kind"`      // "panic" or "error"
+	Component   string            `json:"component"` // "http", "ingest", "transform", "draft", or a background loop
+	Message     string            `json:"message"`
+	Stack       []StackFrame      `json:"stack,omitempty"` // Of panics, outermost call first
+	UserID      string            `json:"user_id,omitempty"`
+	NotebookID  string            `json:"notebook_id,omitempty"`
+	RequestID   string            `json:"request_id,omitempty"`
+	Route       string            `json:"route,omitempty"` // Method and route pattern of the request
+	Extra       map[string]string `json:"extra,omitempty"` // e.g. the job ID
+	Environment string            `json:"environment,omitempty"`
+	ServerName  string            `json:"server_name,omitempty"`
+	Time        time.Time         `json:"time"`
+}
+
+// StackFrame is a call in the stack of a panic
+type StackFrame struct {
+	Function string `json:"function"`
+	File     string `json:"file"`
+	Line     int    `json:"line"`
+}
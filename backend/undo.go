@@ -0,0 +1,132 @@
+package backend
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/kataras/golog"
+)
+
+// undoWindow is how long a deleted source, note or chat session can be restored
+const undoWindow = 60 * time.Second
+
+// undoEntry is a deleted item that can be restored until it expires
+type undoEntry struct {
+	UserID       string
+	NotebookID   string
+	ResourceType string
+	ExpiresAt    time.Time
+	// restore inserts the item again and returns it
+	restore func(ctx context.Context) (interface{}, error)
+}
+
+// UndoResponse is returned by a deletion that can be undone
+type UndoResponse struct {
+	UndoToken string    `json:"undo_token"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// UndoResult is the item an undo restored
+type UndoResult struct {
+	ResourceType string      `json:"resource_type"` // "source", "note" or "chat_session"
+	Item         interface{} `json:"item"`
+}
+
+// offerUndo keeps a restore func for the deleted item and responds with its undo token
+func (s *Server) offerUndo(c *gin.Context, resourceType, notebookID string, restore func(ctx context.Context) (interface{}, error)) {
+	now := time.Now()
+	entry := &undoEntry{
+		UserID:       c.GetString("user_id"),
+		NotebookID:   notebookID,
+		ResourceType: resourceType,
+		ExpiresAt:    now.Add(undoWindow),
+		restore:      restore,
+	}
+	token := uuid.New().String()
+
+	s.undoMu.Lock()
+	for t, e := range s.undoEntries {
+		if now.After(e.ExpiresAt) {
+			delete(s.undoEntries, t)
+		}
+	}
+	s.undoEntries[token] = entry
+	s.undoMu.Unlock()
+
+	c.JSON(http.StatusOK, UndoResponse{UndoToken: token, ExpiresAt: entry.ExpiresAt})
+}
+
+// handleUndo restores the item deleted with the given undo token. A token works once.
+func (s *Server) handleUndo(c *gin.Context) {
+	token := c.Param("token")
+	s.undoMu.Lock()
+	entry, ok := s.undoEntries[token]
+	if ok && entry.UserID == c.GetString("user_id") && time.Now().Before(entry.ExpiresAt) {
+		delete(s.undoEntries, token)
+	} else {
+		ok = false
+	}
+	s.undoMu.Unlock()
+	if !ok {
+		c.JSON(http.StatusNotFound, ErrorResponse{Error: "Nothing to undo", Details: "the undo token is unknown or expired"})
+		return
+	}
+
+	ctx := context.Background()
+	// The notebook may have been deleted in the meantime
+	if err := s.checkNotebookAccess(ctx, entry.NotebookID, entry.UserID); err != nil {
+		c.JSON(http.StatusNotFound, ErrorResponse{Error: "Nothing to undo", Details: err.Error()})
+		return
+	}
+	if err := s.checkLegalHold(ctx, entry.NotebookID); err != nil {
+		c.JSON(http.StatusLocked, ErrorResponse{Error: "Notebook is under legal hold"})
+		return
+	}
+	item, err := entry.restore(ctx)
+	if err != nil {
+		golog.Errorf("failed to restore %s: %v", entry.ResourceType, err)
+		c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to restore " + entry.ResourceType, Details: err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, UndoResult{ResourceType: entry.ResourceType, Item: item})
+}
+
+// sourceVersionsForUndo loads the versions of a source with their content, so they can be
+// restored along with it
+func (s *Server) sourceVersionsForUndo(ctx context.Context, sourceID string) ([]SourceVersion, error) {
+	list, err := s.store.ListSourceVersions(ctx, sourceID)
+	if err != nil {
+		return nil, err
+	}
+	versions := make([]SourceVersion, 0, len(list))
+	for _, v := range list {
+		version, err := s.store.GetSourceVersion(ctx, sourceID, v.Version)
+		if err != nil {
+			return nil, err
+		}
+		versions = append(versions, *version)
+	}
+	return versions, nil
+}
+
+// noteVersionsForUndo loads the versions of a note with their content, so they can be restored
+// along with it
+func (s *Server) noteVersionsForUndo(ctx context.Context, noteID string) ([]NoteVersion, error) {
+	list, err := s.store.ListNoteVersions(ctx, noteID)
+	if err != nil {
+		return nil, err
+	}
+	versions := make([]NoteVersion, 0, len(list))
+	for _, v := range list {
+		version, err := s.store.GetNoteVersion(ctx, noteID, v.Version)
+		if err != nil {
+			return nil, err
+		}
+		versions = append(versions, *version)
+	}
+	return versions, nil
+}
@@ -0,0 +1,174 @@
+package backend
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kataras/golog"
+)
+
+// defaultModelPrices are list prices in USD of common models, used to estimate the cost of
+// usage. MODEL_PRICES adds others, such as Azure deployments and image models, and overrides
+// these. Ollama models cost nothing.
+var defaultModelPrices = map[string]ModelPrice{
+	"gpt-4o":           {Input: 2.50, Output: 10.00},
+	"gpt-4o-mini":      {Input: 0.15, Output: 0.60},
+	"gpt-4.1":          {Input: 2.00, Output: 8.00},
+	"gpt-4.1-mini":     {Input: 0.40, Output: 1.60},
+	"gpt-4.1-nano":     {Input: 0.10, Output: 0.40},
+	"o3-mini":          {Input: 1.10, Output: 4.40},
+	"gemini-2.5-flash": {Input: 0.30, Output: 2.50},
+	"gemini-2.5-pro":   {Input: 1.25, Output: 10.00},
+	"gpt-image-1":      {Image: 0.042},
+	"dall-e-3":         {Image: 0.04},
+}
+
+// usageDays is the period usage reports cover when no start date is given
+const usageDays = 30
+
+// usageScope attributes LLM and image calls to a user, a notebook and an operation
+type usageScope struct {
+	userID, notebookID, operation string
+}
+
+type usageScopeKey struct{}
+
+// withUsageScope attributes the LLM and image calls made under ctx to a user and notebook
+func withUsageScope(ctx context.Context, userID, notebookID string) context.Context {
+	scope, _ := ctx.Value(usageScopeKey{}).(usageScope)
+	scope.userID, scope.notebookID = userID, notebookID
+	return context.WithValue(ctx, usageScopeKey{}, scope)
+}
+
+// withUsageOperation names the operation the calls made under ctx are for, unless a caller
+// already named it, so a draft's outline counts as "draft" rather than "outline"
+func withUsageOperation(ctx context.Context, operation string) context.Context {
+	scope, _ := ctx.Value(usageScopeKey{}).(usageScope)
+	if scope.operation != "" {
+		return ctx
+	}
+	scope.operation = operation
+	return context.WithValue(ctx, usageScopeKey{}, scope)
+}
+
+// withNotebookUsage attributes the calls made under ctx to a notebook and its owner, for work
+// that runs in the background rather than for a user's request
+func (s *Server) withNotebookUsage(ctx context.Context, notebookID string) context.Context {
+	var userID string
+	if notebook, err := s.store.GetNotebook(ctx, notebookID); err == nil {
+		userID = notebook.UserID
+	}
+	return withUsageScope(ctx, userID, notebookID)
+}
+
+// usageSink stores the usage of a call to a model; a nil sink drops it
+type usageSink func(ctx context.Context, model ModelRoute, record *UsageRecord)
+
+// record passes the usage of a call to the sink, attributed to the user, notebook and operation
+// of the context
+func (sink usageSink) record(ctx context.Context, model ModelRoute, promptTokens, completionTokens, images int) {
+	if sink == nil {
+		return
+	}
+	scope, _ := ctx.Value(usageScopeKey{}).(usageScope)
+	if scope.operation == "" {
+		scope.operation = "other"
+	}
+	sink(ctx, model, &UsageRecord{
+		UserID:           scope.userID,
+		NotebookID:       scope.notebookID,
+		Operation:        scope.operation,
+		Model:            model.String(),
+		PromptTokens:     promptTokens,
+		CompletionTokens: completionTokens,
+		Images:           images,
+	})
+}
+
+// newUsageSink returns the sink that estimates the cost of usage and writes it to the usage table
+func newUsageSink(cfg Config, store *CachedStore) usageSink {
+	return func(ctx context.Context, model ModelRoute, record *UsageRecord) {
+		record.Cost = estimateCost(cfg, model, record)
+		if err := store.RecordUsage(context.WithoutCancel(ctx), record); err != nil {
+			golog.Errorf("failed to record usage of %s: %v", record.Model, err)
+		}
+	}
+}
+
+// estimateCost prices a usage record, at zero for models without a known price
+func estimateCost(cfg Config, model ModelRoute, record *UsageRecord) float64 {
+	if model.Provider == "ollama" {
+		return 0
+	}
+	price, ok := cfg.ModelPrices[model.Model]
+	if !ok {
+		price = defaultModelPrices[model.Model]
+	}
+	return (float64(record.PromptTokens)*price.Input+float64(record.CompletionTokens)*price.Output)/1e6 +
+		float64(record.Images)*price.Image
+}
+
+// handleGetUsage reports the current user's usage, by default over the last 30 days
+func (s *Server) handleGetUsage(c *gin.Context) {
+	s.replyUsageReport(c, c.GetString("user_id"))
+}
+
+// handleGetAdminUsage reports the usage of all users, for admins
+func (s *Server) handleGetAdminUsage(c *gin.Context) {
+	if !s.requireAdmin(c) {
+		return
+	}
+	s.replyUsageReport(c, "")
+}
+
+// replyUsageReport totals the usage of a user, or of all users if userID is empty, between the
+// since and until dates (YYYY-MM-DD, both included)
+func (s *Server) replyUsageReport(c *gin.Context, userID string) {
+	ctx := c.Request.Context()
+	y, m, d := time.Now().Date()
+	until := time.Date(y, m, d+1, 0, 0, 0, 0, time.Local)
+	if value := c.Query("until"); value != "" {
+		day, err := time.ParseInLocation(time.DateOnly, value, time.Local)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid until date", Details: err.Error()})
+			return
+		}
+		until = day.AddDate(0, 0, 1)
+	}
+	since := until.AddDate(0, 0, -usageDays)
+	if value := c.Query("since"); value != "" {
+		day, err := time.ParseInLocation(time.DateOnly, value, time.Local)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, ErrorResponse{Error: "Invalid since date", Details: err.Error()})
+			return
+		}
+		since = day
+	}
+
+	report := &UsageReport{Since: since, Until: until}
+	groups := map[string]*[]UsageTotals{
+		"operation": &report.ByOperation,
+		"model":     &report.ByModel,
+		"day":       &report.ByDay,
+	}
+	if userID == "" {
+		groups["user"] = &report.ByUser
+	}
+	for groupBy, totals := range groups {
+		var err error
+		if *totals, err = s.store.SumUsage(ctx, userID, since, until, groupBy); err != nil {
+			c.JSON(http.StatusInternalServerError, ErrorResponse{Error: "Failed to load usage"})
+			return
+		}
+	}
+	for _, t := range report.ByOperation {
+		report.Total.Calls += t.Calls
+		report.Total.PromptTokens += t.PromptTokens
+		report.Total.CompletionTokens += t.CompletionTokens
+		report.Total.Images += t.Images
+		report.Total.Cost += t.Cost
+	}
+	c.JSON(http.StatusOK, report)
+}
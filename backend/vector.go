@@ -6,8 +6,11 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"slices"
+	"sort"
 	"strings"
 	"sync"
+	"unicode"
 
 	"github.com/kataras/golog"
 	"github.com/tmc/langchaingo/schema"
@@ -18,6 +21,112 @@ type VectorStore struct {
 	cfg  Config
 	docs []schema.Document
 	mu   sync.RWMutex
+
+	// index is set when VECTOR_STORE_TYPE names an external store (pgvector, qdrant);
+	// chunks are then kept there instead of docs
+	index vectorIndex
+
+	// disk is set for the sqlite type; it keeps the chunks of docs across restarts
+	disk *chunkCache
+}
+
+// vectorIndex is an external store for chunks and their embeddings. Implementations return
+// documents with the same metadata keys as the in-memory store.
+type vectorIndex interface {
+	upsert(ctx context.Context, notebookID, sourceID, sourceName string, chunks []textChunk) error
+	upsertSummaries(ctx context.Context, notebookID, sourceID, sourceName string, nodes []SummaryNode) error
+	search(ctx context.Context, notebookID, query string, numDocs int, scope searchScope) ([]schema.Document, error)
+	chunkRange(ctx context.Context, notebookID, sourceID, sourceName string, from, to int) ([]schema.Document, error)
+	deleteBySourceName(ctx context.Context, sourceName string) error
+	deleteBySourceID(ctx context.Context, sourceID string) error
+	deleteBySource(ctx context.Context, notebookID, sourceID, sourceName string) error
+	deleteByNotebook(ctx context.Context, notebookID string) error
+	indexedSourceIDs(ctx context.Context, notebookID string) (map[string]bool, error)
+	stats(ctx context.Context) (VectorStats, error)
+}
+
+// searchScope narrows a search. The zero value searches all the source chunks of a notebook.
+type searchScope struct {
+	summaries bool       // Search the summary layers of long sources instead of the chunks
+	within    *chunkSpan // Only search these chunks of one source
+}
+
+// chunkSpan is a run of one source's chunks, numbered first to last
+type chunkSpan struct {
+	sourceID, sourceName string
+	first, last          int
+}
+
+// matches reports whether an in-memory document is in the scope
+func (scope searchScope) matches(doc schema.Document) bool {
+	layer, _ := doc.Metadata["layer"].(int)
+	if (layer > 0) != scope.summaries {
+		return false
+	}
+	if scope.within == nil {
+		return true
+	}
+	sid, _ := doc.Metadata["source_id"].(string)
+	name, _ := doc.Metadata["source"].(string)
+	chunk, _ := doc.Metadata["chunk"].(int)
+	return sid == scope.within.sourceID && name == scope.within.sourceName &&
+		chunk >= scope.within.first && chunk <= scope.within.last
+}
+
+// chunkMetadata returns the metadata of a source chunk, given as a layer 0 node
+func chunkMetadata(notebookID, sourceID, sourceName string, node SummaryNode) map[string]any {
+	metadata := map[string]any{
+		"notebook_id": notebookID,
+		"source":      sourceName,
+		"source_id":   sourceID,
+		"chunk":       node.Position,
+		"start":       node.Start,
+		"end":         node.End,
+	}
+	addPageMetadata(metadata, node.FirstPage, node.LastPage)
+	addTimeMetadata(metadata, node.StartTime, node.EndTime)
+	if node.Chapter != "" {
+		metadata["chapter"] = node.Chapter
+	}
+	return metadata
+}
+
+// summaryMetadata returns the metadata of a summary in a source's summary layer. "chunk" is its
+// position within the layer.
+func summaryMetadata(notebookID, sourceID, sourceName string, node SummaryNode) map[string]any {
+	metadata := map[string]any{
+		"notebook_id": notebookID,
+		"source":      sourceName,
+		"source_id":   sourceID,
+		"layer":       node.Layer,
+		"chunk":       node.Position,
+		"first_chunk": node.FirstChunk,
+		"last_chunk":  node.LastChunk,
+		"start":       node.Start,
+		"end":         node.End,
+	}
+	addPageMetadata(metadata, node.FirstPage, node.LastPage)
+	addTimeMetadata(metadata, node.StartTime, node.EndTime)
+	if node.Chapter != "" {
+		metadata["chapter"] = node.Chapter
+	}
+	return metadata
+}
+
+// addPageMetadata sets the "first_page" and "last_page" of a chunk of a PDF source
+func addPageMetadata(metadata map[string]any, firstPage, lastPage int) {
+	if firstPage > 0 {
+		metadata["first_page"] = firstPage
+		metadata["last_page"] = lastPage
+	}
+}
+
+// addTimeMetadata sets the "start_time" and "end_time", in seconds, of a chunk of a transcript
+func addTimeMetadata(metadata map[string]any, startTime, endTime int) {
+	if endTime > 0 {
+		metadata["start_time"] = startTime
+		metadata["end_time"] = endTime
+	}
 }
 
 // VectorStats contains statistics about the vector store
@@ -34,10 +143,35 @@ func NewVectorStore(cfg Config) (*VectorStore, error) {
 		return nil, fmt.Errorf("failed to create data directory: %w", err)
 	}
 
-	return &VectorStore{
+	vs := &VectorStore{
 		cfg:  cfg,
 		docs: make([]schema.Document, 0),
-	}, nil
+	}
+
+	switch cfg.VectorStoreType {
+	case "sqlite":
+		disk, err := newChunkCache(cfg.SQLitePath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open vector index at %s: %w", cfg.SQLitePath, err)
+		}
+		vs.disk = disk
+	case "pgvector", "postgres":
+		pg, err := newPgvectorIndex(context.Background(), cfg)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open pgvector store: %w", err)
+		}
+		vs.index = pg
+		golog.Infof("[VectorStore] Using pgvector store")
+	case "qdrant":
+		qd, err := newQdrantIndex(context.Background(), cfg)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open qdrant store: %w", err)
+		}
+		vs.index = qd
+		golog.Infof("[VectorStore] Using qdrant collection %s", cfg.QdrantCollection)
+	}
+
+	return vs, nil
 }
 
 // IngestDocuments loads and indexes documents from file paths
@@ -51,7 +185,7 @@ func (vs *VectorStore) IngestDocuments(ctx context.Context, notebookID string, p
 		}
 
 		fmt.Printf("[VectorStore] File loaded, size: %d bytes\n", len(content))
-		if _, err := vs.IngestText(ctx, notebookID, filepath.Base(path), content); err != nil {
+		if _, err := vs.IngestText(ctx, notebookID, "", filepath.Base(path), content); err != nil {
 			return err
 		}
 	}
@@ -63,6 +197,16 @@ func (vs *VectorStore) IngestDocuments(ctx context.Context, notebookID string, p
 func (vs *VectorStore) ExtractDocument(ctx context.Context, path string) (string, error) {
 	// Check if file needs markitdown conversion
 	ext := strings.ToLower(filepath.Ext(path))
+	switch ext {
+	case ".epub":
+		return extractEPUB(path)
+	case ".docx":
+		return extractDOCX(path)
+	case ".pptx":
+		return extractPPTX(path)
+	case ".xlsx":
+		return extractXLSX(path)
+	}
 	if vs.cfg.EnableMarkitdown && vs.needsMarkitdown(ext) {
 		return vs.convertWithMarkitdown(path)
 	}
@@ -75,10 +219,33 @@ func (vs *VectorStore) ExtractDocument(ctx context.Context, path string) (string
 	return string(bytes), nil
 }
 
-// IngestText ingests raw text content
-func (vs *VectorStore) IngestText(ctx context.Context, notebookID, sourceName, content string) (int, error) {
-	// Split content into chunks
-	chunks := vs.splitText(content, vs.cfg.ChunkSize, vs.cfg.ChunkOverlap)
+// IngestText ingests raw text content. Each chunk records its character offsets
+// in content so answers can cite the exact passage of the source.
+func (vs *VectorStore) IngestText(ctx context.Context, notebookID, sourceID, sourceName, content string) (int, error) {
+	return vs.ingestText(ctx, notebookID, sourceID, sourceName, content, nil)
+}
+
+// IngestTable ingests the content of a CSV or spreadsheet source like IngestText, leaving out
+// the chunks that lie wholly within the omitted character spans, the rows past the first of
+// each table. Questions about the data are answered by querying the table instead.
+func (vs *VectorStore) IngestTable(ctx context.Context, notebookID, sourceID, sourceName, content string, omitted [][2]int) (int, error) {
+	return vs.ingestText(ctx, notebookID, sourceID, sourceName, content, omitted)
+}
+
+func (vs *VectorStore) ingestText(ctx context.Context, notebookID, sourceID, sourceName, content string, omitted [][2]int) (int, error) {
+	if vs.index != nil {
+		chunks := omitChunks(vs.splitText(content, vs.cfg.ChunkSize, vs.cfg.ChunkOverlap), omitted)
+		if len(chunks) == 0 {
+			return 0, nil
+		}
+		if err := vs.index.upsert(ctx, notebookID, sourceID, sourceName, chunks); err != nil {
+			return 0, fmt.Errorf("failed to store chunks: %w", err)
+		}
+		golog.Infof("[VectorStore] Ingested %d chunks from source '%s' into %s\n", len(chunks), sourceName, vs.cfg.VectorStoreType)
+		return len(chunks), nil
+	}
+
+	chunks := omitChunks(vs.sourceChunks(ctx, notebookID, sourceID, sourceName, content), omitted)
 
 	vs.mu.Lock()
 	defer vs.mu.Unlock()
@@ -86,12 +253,8 @@ func (vs *VectorStore) IngestText(ctx context.Context, notebookID, sourceName, c
 	// Create documents
 	for i, chunk := range chunks {
 		doc := schema.Document{
-			PageContent: chunk,
-			Metadata: map[string]any{
-				"notebook_id": notebookID,
-				"source":      sourceName,
-				"chunk":       i,
-			},
+			PageContent: chunk.Text,
+			Metadata:    chunkMetadata(notebookID, sourceID, sourceName, chunk.node(i)),
 		}
 		vs.docs = append(vs.docs, doc)
 	}
@@ -100,8 +263,133 @@ func (vs *VectorStore) IngestText(ctx context.Context, notebookID, sourceName, c
 	return len(chunks), nil
 }
 
+// IngestSummaries indexes the summary layer of a source, replacing any it had. Summaries are
+// only found by searches of the summary layer.
+func (vs *VectorStore) IngestSummaries(ctx context.Context, notebookID, sourceID, sourceName string, nodes []SummaryNode) error {
+	if vs.index != nil {
+		if err := vs.index.upsertSummaries(ctx, notebookID, sourceID, sourceName, nodes); err != nil {
+			return fmt.Errorf("failed to store summaries: %w", err)
+		}
+		return nil
+	}
+
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+
+	kept := vs.docs[:0]
+	for _, doc := range vs.docs {
+		layer, _ := doc.Metadata["layer"].(int)
+		sid, _ := doc.Metadata["source_id"].(string)
+		nid, _ := doc.Metadata["notebook_id"].(string)
+		if layer == 0 || sid != sourceID || nid != notebookID {
+			kept = append(kept, doc)
+		}
+	}
+	vs.docs = kept
+	for _, node := range nodes {
+		vs.docs = append(vs.docs, schema.Document{
+			PageContent: node.Content,
+			Metadata:    summaryMetadata(notebookID, sourceID, sourceName, node),
+		})
+	}
+	golog.Infof("[VectorStore] Ingested %d summaries of source '%s'", len(nodes), sourceName)
+	return nil
+}
+
+// omitChunks drops the chunks that lie wholly within one of the omitted character spans
+func omitChunks(chunks []textChunk, omitted [][2]int) []textChunk {
+	if len(omitted) == 0 {
+		return chunks
+	}
+	kept := make([]textChunk, 0, len(chunks))
+	for _, chunk := range chunks {
+		if !slices.ContainsFunc(omitted, func(span [2]int) bool { return span[0] <= chunk.Start && chunk.End <= span[1] }) {
+			kept = append(kept, chunk)
+		}
+	}
+	return kept
+}
+
+// sourceChunks splits content into chunks. With the on-disk index, an unchanged source's
+// chunks are loaded from disk instead, and newly split chunks are stored.
+func (vs *VectorStore) sourceChunks(ctx context.Context, notebookID, sourceID, sourceName, content string) []textChunk {
+	if vs.disk == nil || sourceID == "" {
+		return vs.splitText(content, vs.cfg.ChunkSize, vs.cfg.ChunkOverlap)
+	}
+
+	hash := chunkContentHash(content, vs.cfg.ChunkSize, vs.cfg.ChunkOverlap)
+	chunks, found, err := vs.disk.load(ctx, sourceID, hash)
+	if err != nil {
+		golog.Warnf("[VectorStore] failed to load chunks of source '%s' from disk: %v", sourceName, err)
+	}
+	if found {
+		golog.Infof("[VectorStore] Loaded %d chunks of source '%s' from disk", len(chunks), sourceName)
+		setChunkPages([]rune(content), chunks)
+		setChunkTimes([]rune(content), chunks)
+		setChunkChapters([]rune(content), chunks)
+		return chunks
+	}
+
+	chunks = vs.splitText(content, vs.cfg.ChunkSize, vs.cfg.ChunkOverlap)
+	if err := vs.disk.save(ctx, notebookID, sourceID, sourceName, hash, chunks); err != nil {
+		golog.Warnf("[VectorStore] failed to store chunks of source '%s' on disk: %v", sourceName, err)
+	}
+	return chunks
+}
+
+// dropFromDisk removes chunks from the on-disk index, if there is one. Failures only leave
+// unused rows behind, so they are logged.
+func (vs *VectorStore) dropFromDisk(ctx context.Context, condition string, args ...any) {
+	if vs.disk == nil {
+		return
+	}
+	if err := vs.disk.deleteWhere(ctx, condition, args...); err != nil {
+		golog.Warnf("[VectorStore] failed to delete chunks on disk: %v", err)
+	}
+}
+
+// textChunk is a piece of a source with its [Start, End) offsets in characters (runes), for
+// PDFs the pages it starts and ends on, for transcripts the seconds of audio it covers, and for
+// EPUB books the chapter it starts in
+type textChunk struct {
+	Text      string
+	Start     int
+	End       int
+	FirstPage int
+	LastPage  int
+	StartTime int
+	EndTime   int
+	Chapter   string
+}
+
+// node returns the chunk as the layer 0 node at position i, as the indexes store chunks
+func (c textChunk) node(i int) SummaryNode {
+	return SummaryNode{Position: i, Start: c.Start, End: c.End, FirstPage: c.FirstPage, LastPage: c.LastPage,
+		StartTime: c.StartTime, EndTime: c.EndTime, Chapter: c.Chapter, Content: c.Text}
+}
+
+// setChunkPages numbers the pages chunks are on. markitdown keeps the form feeds pdfminer puts
+// between the pages of a PDF; chunks of text without them get no pages.
+func setChunkPages(runes []rune, chunks []textChunk) {
+	var breaks []int
+	for i, r := range runes {
+		if r == '\f' {
+			breaks = append(breaks, i)
+		}
+	}
+	if len(breaks) == 0 {
+		return
+	}
+	// A page is one more than the number of breaks before it; a chunk starting on a break
+	// starts on the next page, and one ending on a break ends on the page before
+	for i := range chunks {
+		chunks[i].FirstPage = sort.SearchInts(breaks, chunks[i].Start+1) + 1
+		chunks[i].LastPage = max(sort.SearchInts(breaks, chunks[i].End-1)+1, chunks[i].FirstPage)
+	}
+}
+
 // splitText splits text into chunks
-func (vs *VectorStore) splitText(text string, chunkSize, chunkOverlap int) []string {
+func (vs *VectorStore) splitText(text string, chunkSize, chunkOverlap int) []textChunk {
 	if chunkSize <= 0 {
 		chunkSize = 1000
 	}
@@ -116,7 +404,7 @@ func (vs *VectorStore) splitText(text string, chunkSize, chunkOverlap int) []str
 		fmt.Printf("[VectorStore] Splitting text (len=%d, chunkSize=%d, overlap=%d)\n", len(text), chunkSize, chunkOverlap)
 	}
 
-	var chunks []string
+	var chunks []textChunk
 
 	// Check if text contains mostly CJK characters (Chinese, Japanese, Korean)
 	runes := []rune(text)
@@ -142,8 +430,7 @@ func (vs *VectorStore) splitText(text string, chunkSize, chunkOverlap int) []str
 				end = len(runes)
 			}
 
-			chunk := string(runes[i:end])
-			chunks = append(chunks, chunk)
+			chunks = append(chunks, textChunk{Text: string(runes[i:end]), Start: i, End: end})
 
 			if end >= len(runes) {
 				break
@@ -152,7 +439,7 @@ func (vs *VectorStore) splitText(text string, chunkSize, chunkOverlap int) []str
 	} else {
 		// For Western text, split by words
 		// fmt.Println("[VectorStore] Using word-based splitting")
-		words := strings.Fields(text)
+		words, spans := splitWords(runes)
 
 		for i := 0; i < len(words); i += (chunkSize - chunkOverlap) {
 			end := i + chunkSize
@@ -160,8 +447,11 @@ func (vs *VectorStore) splitText(text string, chunkSize, chunkOverlap int) []str
 				end = len(words)
 			}
 
-			chunk := strings.Join(words[i:end], " ")
-			chunks = append(chunks, chunk)
+			chunks = append(chunks, textChunk{
+				Text:  strings.Join(words[i:end], " "),
+				Start: spans[i][0],
+				End:   spans[end-1][1],
+			})
 
 			if end >= len(words) {
 				break
@@ -170,15 +460,80 @@ func (vs *VectorStore) splitText(text string, chunkSize, chunkOverlap int) []str
 	}
 
 	// fmt.Printf("[VectorStore] Created %d chunks\n", len(chunks))
+	setChunkPages(runes, chunks)
+	setChunkTimes(runes, chunks)
+	setChunkChapters(runes, chunks)
 	return chunks
 }
 
+// splitWords splits runes into whitespace-separated words like strings.Fields,
+// also returning the [start, end) rune offsets of each word
+func splitWords(runes []rune) ([]string, [][2]int) {
+	var words []string
+	var spans [][2]int
+	start := -1
+	for i, r := range runes {
+		if unicode.IsSpace(r) {
+			if start >= 0 {
+				words = append(words, string(runes[start:i]))
+				spans = append(spans, [2]int{start, i})
+				start = -1
+			}
+		} else if start < 0 {
+			start = i
+		}
+	}
+	if start >= 0 {
+		words = append(words, string(runes[start:]))
+		spans = append(spans, [2]int{start, len(runes)})
+	}
+	return words, spans
+}
+
+// ChunkRange returns the chunks of a source numbered from to to (inclusive), in order. Chunks are
+// numbered in the order they appear in the source.
+func (vs *VectorStore) ChunkRange(ctx context.Context, notebookID, sourceID, sourceName string, from, to int) ([]schema.Document, error) {
+	if vs.index != nil {
+		return vs.index.chunkRange(ctx, notebookID, sourceID, sourceName, from, to)
+	}
+
+	vs.mu.RLock()
+	defer vs.mu.RUnlock()
+
+	scope := searchScope{within: &chunkSpan{sourceID: sourceID, sourceName: sourceName, first: from, last: to}}
+	var docs []schema.Document
+	for _, doc := range vs.docs {
+		if nid, _ := doc.Metadata["notebook_id"].(string); nid == notebookID && scope.matches(doc) {
+			docs = append(docs, doc)
+		}
+	}
+	sort.SliceStable(docs, func(i, j int) bool {
+		return docs[i].Metadata["chunk"].(int) < docs[j].Metadata["chunk"].(int)
+	})
+	return docs, nil
+}
+
+// hasScores reports whether searches set each document's Score to its similarity to the query.
+// The in-memory keyword search doesn't.
+func (vs *VectorStore) hasScores() bool {
+	return vs.index != nil
+}
+
 // SimilaritySearch performs a similarity search (simple keyword matching for now)
 func (vs *VectorStore) SimilaritySearch(ctx context.Context, notebookID, query string, numDocs int) ([]schema.Document, error) {
+	return vs.searchIn(ctx, notebookID, query, numDocs, searchScope{})
+}
+
+// searchIn performs a similarity search within a scope
+func (vs *VectorStore) searchIn(ctx context.Context, notebookID, query string, numDocs int, scope searchScope) ([]schema.Document, error) {
 	if numDocs <= 0 {
 		numDocs = 5
 	}
 
+	if vs.index != nil {
+		return vs.index.search(ctx, notebookID, query, numDocs, scope)
+	}
+
 	vs.mu.RLock()
 	defer vs.mu.RUnlock()
 
@@ -192,7 +547,7 @@ func (vs *VectorStore) SimilaritySearch(ctx context.Context, notebookID, query s
 	// Filter docs by notebookID
 	candidateDocs := make([]schema.Document, 0)
 	for _, doc := range vs.docs {
-		if nid, ok := doc.Metadata["notebook_id"].(string); ok && nid == notebookID {
+		if nid, ok := doc.Metadata["notebook_id"].(string); ok && nid == notebookID && scope.matches(doc) {
 			candidateDocs = append(candidateDocs, doc)
 		}
 	}
@@ -270,7 +625,7 @@ func (vs *VectorStore) SimilaritySearch(ctx context.Context, notebookID, query s
 
 	// If no matches found, return top recent documents (fallback)
 	// This allows the LLM to use the full context
-	if len(scores) == 0 {
+	if len(scores) == 0 && scope == (searchScope{}) {
 		// fmt.Println("[VectorStore] No matches found, returning fallback documents")
 		result := make([]schema.Document, 0, min(numDocs, len(candidateDocs)))
 		// Return from end (most recent)
@@ -298,6 +653,11 @@ func min(a, b int) int {
 
 // Delete removes documents by source
 func (vs *VectorStore) Delete(ctx context.Context, source string) error {
+	if vs.index != nil {
+		return vs.index.deleteBySourceName(ctx, source)
+	}
+	vs.dropFromDisk(ctx, "source_name = ?", source)
+
 	vs.mu.Lock()
 	defer vs.mu.Unlock()
 
@@ -312,8 +672,103 @@ func (vs *VectorStore) Delete(ctx context.Context, source string) error {
 	return nil
 }
 
+// DeleteBySourceID removes the chunks of a source, so it can be re-ingested after its content changes
+func (vs *VectorStore) DeleteBySourceID(ctx context.Context, sourceID string) error {
+	if vs.index != nil {
+		return vs.index.deleteBySourceID(ctx, sourceID)
+	}
+	vs.dropFromDisk(ctx, "source_id = ?", sourceID)
+
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+
+	filtered := make([]schema.Document, 0, len(vs.docs))
+	for _, doc := range vs.docs {
+		if docSourceID, ok := doc.Metadata["source_id"].(string); !ok || docSourceID != sourceID {
+			filtered = append(filtered, doc)
+		}
+	}
+	vs.docs = filtered
+
+	return nil
+}
+
+// DeleteBySource removes the chunks of a deleted source of a notebook. Chunks are matched by
+// source ID; chunks ingested without one are matched by the source's name.
+func (vs *VectorStore) DeleteBySource(ctx context.Context, notebookID, sourceID, sourceName string) error {
+	if vs.index != nil {
+		return vs.index.deleteBySource(ctx, notebookID, sourceID, sourceName)
+	}
+	vs.dropFromDisk(ctx, "source_id = ?", sourceID)
+
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+
+	filtered := make([]schema.Document, 0, len(vs.docs))
+	for _, doc := range vs.docs {
+		if nid, _ := doc.Metadata["notebook_id"].(string); nid == notebookID {
+			docSourceID, _ := doc.Metadata["source_id"].(string)
+			docSource, _ := doc.Metadata["source"].(string)
+			if docSourceID == sourceID || (docSourceID == "" && docSource == sourceName) {
+				continue
+			}
+		}
+		filtered = append(filtered, doc)
+	}
+	vs.docs = filtered
+
+	return nil
+}
+
+// DeleteByNotebook removes all chunks of a notebook
+func (vs *VectorStore) DeleteByNotebook(ctx context.Context, notebookID string) error {
+	if vs.index != nil {
+		return vs.index.deleteByNotebook(ctx, notebookID)
+	}
+	vs.dropFromDisk(ctx, "notebook_id = ?", notebookID)
+
+	vs.mu.Lock()
+	defer vs.mu.Unlock()
+
+	filtered := make([]schema.Document, 0, len(vs.docs))
+	for _, doc := range vs.docs {
+		if nid, ok := doc.Metadata["notebook_id"].(string); !ok || nid != notebookID {
+			filtered = append(filtered, doc)
+		}
+	}
+	vs.docs = filtered
+
+	return nil
+}
+
+// IndexedSourceIDs returns the IDs of the sources of a notebook that already have chunks
+// in the store
+func (vs *VectorStore) IndexedSourceIDs(ctx context.Context, notebookID string) (map[string]bool, error) {
+	if vs.index != nil {
+		return vs.index.indexedSourceIDs(ctx, notebookID)
+	}
+
+	vs.mu.RLock()
+	defer vs.mu.RUnlock()
+
+	ids := make(map[string]bool)
+	for _, doc := range vs.docs {
+		if nid, _ := doc.Metadata["notebook_id"].(string); nid != notebookID {
+			continue
+		}
+		if sourceID, _ := doc.Metadata["source_id"].(string); sourceID != "" {
+			ids[sourceID] = true
+		}
+	}
+	return ids, nil
+}
+
 // GetStats returns statistics about the vector store
 func (vs *VectorStore) GetStats(ctx context.Context) (VectorStats, error) {
+	if vs.index != nil {
+		return vs.index.stats(ctx)
+	}
+
 	vs.mu.RLock()
 	defer vs.mu.RUnlock()
 
@@ -351,8 +806,13 @@ func (vs *VectorStore) ExtractFromURL(ctx context.Context, url string) (string,
 		return "", fmt.Errorf("markitdown is disabled, cannot fetch URL content")
 	}
 
-	// Create temporary output file
-	tmpFile := filepath.Join(os.TempDir(), fmt.Sprintf("markitdown_url_%d.md", os.Getpid()))
+	// Create temporary output directory (unique per call, so concurrent fetches don't collide)
+	tmpDir, err := os.MkdirTemp("", "markitdown-")
+	if err != nil {
+		return "", fmt.Errorf("failed to create temp directory: %w", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	tmpFile := filepath.Join(tmpDir, "output.md")
 
 	// Run markitdown command with URL
 	cmd := exec.Command("markitdown", url, "-o", tmpFile)
@@ -368,9 +828,6 @@ func (vs *VectorStore) ExtractFromURL(ctx context.Context, url string) (string,
 		return "", fmt.Errorf("failed to read markitdown output: %w", err)
 	}
 
-	// Clean up temporary file
-	os.Remove(tmpFile)
-
 	fmt.Printf("[VectorStore] URL content fetched successfully, output size: %d bytes\n", len(content))
 	return string(content), nil
 }
@@ -379,8 +836,13 @@ func (vs *VectorStore) ExtractFromURL(ctx context.Context, url string) (string,
 func (vs *VectorStore) convertWithMarkitdown(filePath string) (string, error) {
 	fmt.Printf("[VectorStore] Converting with markitdown: %s\n", filePath)
 
-	// Create temporary output file
-	tmpFile := filepath.Join(os.TempDir(), fmt.Sprintf("markitdown_%s.md", filepath.Base(filePath)))
+	// Create temporary output directory (unique per call, so concurrent conversions don't collide)
+	tmpDir, err := os.MkdirTemp("", "markitdown-")
+	if err != nil {
+		return "", fmt.Errorf("failed to create temp directory: %w", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	tmpFile := filepath.Join(tmpDir, "output.md")
 
 	// Run markitdown command
 	cmd := exec.Command("markitdown", filePath, "-o", tmpFile)
@@ -396,9 +858,6 @@ func (vs *VectorStore) convertWithMarkitdown(filePath string) (string, error) {
 		return "", fmt.Errorf("failed to read markitdown output: %w", err)
 	}
 
-	// Clean up temporary file
-	os.Remove(tmpFile)
-
 	fmt.Printf("[VectorStore] markitdown conversion successful, output size: %d bytes\n", len(content))
 	return string(content), nil
 }
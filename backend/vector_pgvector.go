@@ -0,0 +1,360 @@
+package backend
+
+import (
+	"context"
+	"crypto/sha1"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/tmc/langchaingo/embeddings"
+	ollamallm "github.com/tmc/langchaingo/llms/ollama"
+	"github.com/tmc/langchaingo/llms/openai"
+	"github.com/tmc/langchaingo/schema"
+)
+
+// pgvectorDriver is the database/sql driver the pgvector index connects with. It is registered
+// by vector_pgx.go, which is only built with the pgvector build tag.
+const pgvectorDriver = "pgx"
+
+// pgvectorSchema creates the chunk table. The embedding column has no fixed dimension, so the
+// embedding model can change; chunks are always searched within one notebook. Rows with a layer
+// above 0 are the summaries of long sources, covering chunks first_chunk to last_chunk.
+const pgvectorSchema = `
+	CREATE EXTENSION IF NOT EXISTS vector;
+
+	CREATE TABLE IF NOT EXISTS notex_chunks (
+		id TEXT PRIMARY KEY,
+		notebook_id TEXT NOT NULL,
+		source_id TEXT NOT NULL DEFAULT '',
+		source_name TEXT NOT NULL DEFAULT '',
+		chunk INTEGER NOT NULL,
+		start_offset INTEGER NOT NULL,
+		end_offset INTEGER NOT NULL,
+		content TEXT NOT NULL,
+		embedding vector NOT NULL,
+		layer INTEGER NOT NULL DEFAULT 0,
+		first_chunk INTEGER NOT NULL DEFAULT 0,
+		last_chunk INTEGER NOT NULL DEFAULT 0,
+		first_page INTEGER NOT NULL DEFAULT 0,
+		last_page INTEGER NOT NULL DEFAULT 0,
+		start_time INTEGER NOT NULL DEFAULT 0,
+		end_time INTEGER NOT NULL DEFAULT 0,
+		chapter TEXT NOT NULL DEFAULT ''
+	);
+
+	ALTER TABLE notex_chunks ADD COLUMN IF NOT EXISTS layer INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE notex_chunks ADD COLUMN IF NOT EXISTS first_chunk INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE notex_chunks ADD COLUMN IF NOT EXISTS last_chunk INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE notex_chunks ADD COLUMN IF NOT EXISTS first_page INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE notex_chunks ADD COLUMN IF NOT EXISTS last_page INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE notex_chunks ADD COLUMN IF NOT EXISTS start_time INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE notex_chunks ADD COLUMN IF NOT EXISTS end_time INTEGER NOT NULL DEFAULT 0;
+	ALTER TABLE notex_chunks ADD COLUMN IF NOT EXISTS chapter TEXT NOT NULL DEFAULT '';
+
+	CREATE INDEX IF NOT EXISTS idx_notex_chunks_notebook ON notex_chunks(notebook_id);
+	CREATE INDEX IF NOT EXISTS idx_notex_chunks_source ON notex_chunks(source_id);
+`
+
+// pgvectorIndex stores chunks and their embeddings in PostgreSQL with the pgvector extension,
+// so the index outlives the server
+type pgvectorIndex struct {
+	db       *sql.DB
+	embedder embeddings.Embedder
+}
+
+// newPgvectorIndex connects to PostgreSQL and creates the chunk table
+func newPgvectorIndex(ctx context.Context, cfg Config) (*pgvectorIndex, error) {
+	if !slices.Contains(sql.Drivers(), pgvectorDriver) {
+		return nil, fmt.Errorf("pgvector support is not compiled in, build with -tags pgvector")
+	}
+	embedder, err := newEmbedder(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create embedder: %w", err)
+	}
+
+	db, err := sql.Open(pgvectorDriver, cfg.PostgreSQLURL)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to connect to postgres: %w", err)
+	}
+	if _, err := db.ExecContext(ctx, pgvectorSchema); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to create pgvector schema: %w", err)
+	}
+
+	return &pgvectorIndex{db: db, embedder: embedder}, nil
+}
+
+// newEmbedder creates an embedder for the configured LLM provider and EMBEDDING_MODEL
+func newEmbedder(cfg Config) (embeddings.Embedder, error) {
+	if cfg.IsMock() {
+		return mockEmbedder{}, nil
+	}
+	if cfg.IsAzure() {
+		if cfg.AzureOpenAIEmbeddingDeployment == "" {
+			return nil, fmt.Errorf("AZURE_OPENAI_EMBEDDING_DEPLOYMENT required for embeddings with Azure OpenAI")
+		}
+		llm, err := openai.New(azureOptions(cfg, cfg.AzureOpenAIDeployment)...)
+		if err != nil {
+			return nil, err
+		}
+		return embeddings.NewEmbedder(llm)
+	}
+	if cfg.IsOllama() {
+		llm, err := ollamallm.New(
+			ollamallm.WithModel(cfg.EmbeddingModel),
+			ollamallm.WithServerURL(cfg.OllamaBaseURL),
+		)
+		if err != nil {
+			return nil, err
+		}
+		return embeddings.NewEmbedder(llm)
+	}
+
+	opts := []openai.Option{
+		openai.WithToken(cfg.OpenAIAPIKey),
+		openai.WithEmbeddingModel(cfg.EmbeddingModel),
+	}
+	if cfg.OpenAIBaseURL != "" {
+		opts = append(opts, openai.WithBaseURL(cfg.OpenAIBaseURL))
+	}
+	llm, err := openai.New(opts...)
+	if err != nil {
+		return nil, err
+	}
+	return embeddings.NewEmbedder(llm)
+}
+
+// pgvectorChunkID derives a chunk's row ID from its position, so re-ingesting a source
+// overwrites its chunks instead of duplicating them. Summaries also include their layer.
+func pgvectorChunkID(notebookID, sourceID, sourceName string, layer, chunk int) string {
+	key := notebookID + "\x00" + sourceID + "\x00" + sourceName + "\x00" + strconv.Itoa(chunk)
+	if layer > 0 {
+		key += "\x00" + strconv.Itoa(layer)
+	}
+	sum := sha1.Sum([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// pgvectorLiteral formats an embedding as a pgvector value, e.g. [0.1,0.2]
+func pgvectorLiteral(v []float32) string {
+	var sb strings.Builder
+	sb.WriteByte('[')
+	for i, x := range v {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		sb.WriteString(strconv.FormatFloat(float64(x), 'f', -1, 32))
+	}
+	sb.WriteByte(']')
+	return sb.String()
+}
+
+// upsert embeds the chunks of a source and stores them
+func (p *pgvectorIndex) upsert(ctx context.Context, notebookID, sourceID, sourceName string, chunks []textChunk) error {
+	nodes := make([]SummaryNode, len(chunks))
+	for i, chunk := range chunks {
+		nodes[i] = chunk.node(i)
+	}
+	return p.store(ctx, notebookID, sourceID, sourceName, nodes, false)
+}
+
+// upsertSummaries embeds the summary layer of a source and stores it in place of the old one
+func (p *pgvectorIndex) upsertSummaries(ctx context.Context, notebookID, sourceID, sourceName string, nodes []SummaryNode) error {
+	return p.store(ctx, notebookID, sourceID, sourceName, nodes, true)
+}
+
+// store embeds and stores rows of a source: chunks, given as layer 0 nodes, or summaries. With
+// replaceSummaries, the source's previous summaries are deleted first.
+func (p *pgvectorIndex) store(ctx context.Context, notebookID, sourceID, sourceName string, nodes []SummaryNode, replaceSummaries bool) error {
+	texts := make([]string, len(nodes))
+	for i, node := range nodes {
+		texts[i] = node.Content
+	}
+	vectors, err := p.embedder.EmbedDocuments(ctx, texts)
+	if err != nil {
+		return fmt.Errorf("failed to embed chunks: %w", err)
+	}
+	if len(vectors) != len(nodes) {
+		return fmt.Errorf("embedder returned %d vectors for %d chunks", len(vectors), len(nodes))
+	}
+
+	tx, err := p.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if replaceSummaries {
+		if _, err := tx.ExecContext(ctx, `
+			DELETE FROM notex_chunks WHERE notebook_id = $1 AND source_id = $2 AND source_name = $3 AND layer > 0
+		`, notebookID, sourceID, sourceName); err != nil {
+			return err
+		}
+	}
+	for i, node := range nodes {
+		if _, err := tx.ExecContext(ctx, `
+			INSERT INTO notex_chunks (id, notebook_id, source_id, source_name, chunk, start_offset, end_offset, content, embedding, layer, first_chunk, last_chunk, first_page, last_page, start_time, end_time, chapter)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9::vector, $10, $11, $12, $13, $14, $15, $16, $17)
+			ON CONFLICT (id) DO UPDATE SET
+				start_offset = EXCLUDED.start_offset,
+				end_offset = EXCLUDED.end_offset,
+				content = EXCLUDED.content,
+				embedding = EXCLUDED.embedding,
+				first_chunk = EXCLUDED.first_chunk,
+				last_chunk = EXCLUDED.last_chunk,
+				first_page = EXCLUDED.first_page,
+				last_page = EXCLUDED.last_page,
+				start_time = EXCLUDED.start_time,
+				end_time = EXCLUDED.end_time,
+				chapter = EXCLUDED.chapter
+		`, pgvectorChunkID(notebookID, sourceID, sourceName, node.Layer, node.Position), notebookID, sourceID, sourceName, node.Position,
+			node.Start, node.End, node.Content, pgvectorLiteral(vectors[i]), node.Layer, node.FirstChunk, node.LastChunk,
+			node.FirstPage, node.LastPage, node.StartTime, node.EndTime, node.Chapter); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// search returns the chunks or summaries of a notebook closest to the query by cosine distance
+func (p *pgvectorIndex) search(ctx context.Context, notebookID, query string, numDocs int, scope searchScope) ([]schema.Document, error) {
+	vector, err := p.embedder.EmbedQuery(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to embed query: %w", err)
+	}
+
+	condition := "layer = 0"
+	args := []any{notebookID, pgvectorLiteral(vector), numDocs}
+	if scope.summaries {
+		condition = "layer > 0"
+	}
+	if span := scope.within; span != nil {
+		condition += " AND source_id = $4 AND source_name = $5 AND chunk BETWEEN $6 AND $7"
+		args = append(args, span.sourceID, span.sourceName, span.first, span.last)
+	}
+	rows, err := p.db.QueryContext(ctx, `
+		SELECT source_id, source_name, chunk, start_offset, end_offset, content, layer, first_chunk, last_chunk,
+			first_page, last_page, start_time, end_time, chapter, embedding <=> $2::vector AS distance
+		FROM notex_chunks WHERE notebook_id = $1 AND `+condition+`
+		ORDER BY distance LIMIT $3
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	docs := make([]schema.Document, 0, numDocs)
+	for rows.Next() {
+		var sourceID, sourceName, content string
+		var node SummaryNode
+		var distance float64
+		if err := rows.Scan(&sourceID, &sourceName, &node.Position, &node.Start, &node.End, &content, &node.Layer,
+			&node.FirstChunk, &node.LastChunk, &node.FirstPage, &node.LastPage, &node.StartTime, &node.EndTime, &node.Chapter, &distance); err != nil {
+			return nil, err
+		}
+		metadata := chunkMetadata(notebookID, sourceID, sourceName, node)
+		if node.Layer > 0 {
+			metadata = summaryMetadata(notebookID, sourceID, sourceName, node)
+		}
+		docs = append(docs, schema.Document{
+			PageContent: content,
+			Metadata:    metadata,
+			Score:       float32(1 - distance),
+		})
+	}
+	return docs, rows.Err()
+}
+
+// chunkRange returns a source's chunks numbered from to to, in order
+func (p *pgvectorIndex) chunkRange(ctx context.Context, notebookID, sourceID, sourceName string, from, to int) ([]schema.Document, error) {
+	rows, err := p.db.QueryContext(ctx, `
+		SELECT chunk, start_offset, end_offset, first_page, last_page, start_time, end_time, chapter, content FROM notex_chunks
+		WHERE notebook_id = $1 AND source_id = $2 AND source_name = $3 AND layer = 0 AND chunk BETWEEN $4 AND $5
+		ORDER BY chunk
+	`, notebookID, sourceID, sourceName, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var docs []schema.Document
+	for rows.Next() {
+		var node SummaryNode
+		if err := rows.Scan(&node.Position, &node.Start, &node.End, &node.FirstPage, &node.LastPage, &node.StartTime, &node.EndTime,
+			&node.Chapter, &node.Content); err != nil {
+			return nil, err
+		}
+		docs = append(docs, schema.Document{
+			PageContent: node.Content,
+			Metadata:    chunkMetadata(notebookID, sourceID, sourceName, node),
+		})
+	}
+	return docs, rows.Err()
+}
+
+// deleteWhere removes the chunks matching a condition on the chunk table
+func (p *pgvectorIndex) deleteWhere(ctx context.Context, condition string, args ...any) error {
+	_, err := p.db.ExecContext(ctx, `DELETE FROM notex_chunks WHERE `+condition, args...)
+	return err
+}
+
+func (p *pgvectorIndex) deleteBySourceName(ctx context.Context, sourceName string) error {
+	return p.deleteWhere(ctx, "source_name = $1", sourceName)
+}
+
+func (p *pgvectorIndex) deleteBySourceID(ctx context.Context, sourceID string) error {
+	return p.deleteWhere(ctx, "source_id = $1", sourceID)
+}
+
+func (p *pgvectorIndex) deleteBySource(ctx context.Context, notebookID, sourceID, sourceName string) error {
+	return p.deleteWhere(ctx, "notebook_id = $1 AND (source_id = $2 OR (source_id = '' AND source_name = $3))",
+		notebookID, sourceID, sourceName)
+}
+
+func (p *pgvectorIndex) deleteByNotebook(ctx context.Context, notebookID string) error {
+	return p.deleteWhere(ctx, "notebook_id = $1", notebookID)
+}
+
+// indexedSourceIDs returns the IDs of a notebook's sources that have chunks
+func (p *pgvectorIndex) indexedSourceIDs(ctx context.Context, notebookID string) (map[string]bool, error) {
+	rows, err := p.db.QueryContext(ctx, `
+		SELECT DISTINCT source_id FROM notex_chunks WHERE notebook_id = $1 AND source_id <> ''
+	`, notebookID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	ids := make(map[string]bool)
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids[id] = true
+	}
+	return ids, rows.Err()
+}
+
+// stats counts the stored chunks and reads the dimension of their embeddings
+func (p *pgvectorIndex) stats(ctx context.Context) (VectorStats, error) {
+	var stats VectorStats
+	var dimension sql.NullInt64
+	err := p.db.QueryRowContext(ctx, `
+		SELECT COUNT(*), (SELECT vector_dims(embedding) FROM notex_chunks LIMIT 1) FROM notex_chunks
+	`).Scan(&stats.TotalDocuments, &dimension)
+	if err != nil {
+		return stats, err
+	}
+	stats.TotalVectors = stats.TotalDocuments
+	stats.Dimension = int(dimension.Int64)
+	return stats, nil
+}
@@ -0,0 +1,7 @@
+//go:build pgvector
+
+package backend
+
+// Registers the "pgx" database/sql driver used by the pgvector store. Build with
+// -tags pgvector after adding github.com/jackc/pgx/v5 to go.mod.
+import _ "github.com/jackc/pgx/v5/stdlib"
@@ -0,0 +1,462 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/tmc/langchaingo/embeddings"
+	"github.com/tmc/langchaingo/schema"
+)
+
+// qdrantBatchSize is how many chunks are embedded and upserted per request
+const qdrantBatchSize = 64
+
+var qdrantHTTPClient = &http.Client{Timeout: 60 * time.Second}
+
+// qdrantIndex stores chunks in a Qdrant collection over its REST API. All notebooks share one
+// collection; every request filters on the notebook_id payload field, which is indexed.
+type qdrantIndex struct {
+	baseURL    string
+	apiKey     string
+	collection string
+	embedder   embeddings.Embedder
+
+	// The collection is created on the first upsert, once the embedding dimension is known
+	mu        sync.Mutex
+	dimension int
+}
+
+// qdrantPayload is the payload stored with each point. Points with a layer are the summaries of
+// long sources.
+type qdrantPayload struct {
+	NotebookID string `json:"notebook_id"`
+	SourceID   string `json:"source_id"`
+	SourceName string `json:"source_name"`
+	Chunk      int    `json:"chunk"`
+	Start      int    `json:"start"`
+	End        int    `json:"end"`
+	Content    string `json:"content"`
+	Layer      int    `json:"layer,omitempty"`
+	FirstChunk int    `json:"first_chunk,omitempty"`
+	LastChunk  int    `json:"last_chunk,omitempty"`
+	FirstPage  int    `json:"first_page,omitempty"`
+	LastPage   int    `json:"last_page,omitempty"`
+	StartTime  int    `json:"start_time,omitempty"`
+	EndTime    int    `json:"end_time,omitempty"`
+	Chapter    string `json:"chapter,omitempty"`
+}
+
+// metadata returns the document metadata of a point
+func (p qdrantPayload) metadata() map[string]any {
+	node := SummaryNode{
+		Layer: p.Layer, Position: p.Chunk, FirstChunk: p.FirstChunk, LastChunk: p.LastChunk, Start: p.Start, End: p.End,
+		FirstPage: p.FirstPage, LastPage: p.LastPage, StartTime: p.StartTime, EndTime: p.EndTime, Chapter: p.Chapter,
+	}
+	if p.Layer > 0 {
+		return summaryMetadata(p.NotebookID, p.SourceID, p.SourceName, node)
+	}
+	return chunkMetadata(p.NotebookID, p.SourceID, p.SourceName, node)
+}
+
+// qdrantSummaries is a filter condition matching the summaries; chunks have no layer
+var qdrantSummaries = map[string]any{"key": "layer", "range": map[string]any{"gte": 1}}
+
+// qdrantMatch is a filter condition matching a keyword payload field
+func qdrantMatch(key, value string) map[string]any {
+	return map[string]any{"key": key, "match": map[string]any{"value": value}}
+}
+
+// qdrantFilter requires all the given conditions
+func qdrantFilter(conditions ...any) map[string]any {
+	return map[string]any{"must": conditions}
+}
+
+// newQdrantIndex checks that Qdrant is reachable and reads the collection's dimension if it
+// already exists
+func newQdrantIndex(ctx context.Context, cfg Config) (*qdrantIndex, error) {
+	embedder, err := newEmbedder(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create embedder: %w", err)
+	}
+
+	q := &qdrantIndex{
+		baseURL:    strings.TrimRight(cfg.QdrantURL, "/"),
+		apiKey:     cfg.QdrantAPIKey,
+		collection: cfg.QdrantCollection,
+		embedder:   embedder,
+	}
+	info, found, err := q.collectionInfo(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to qdrant: %w", err)
+	}
+	if found {
+		q.dimension = info.Config.Params.Vectors.Size
+	}
+	return q, nil
+}
+
+// do sends a request to Qdrant and decodes the "result" field of the response into result.
+// It returns the HTTP status so callers can tell a missing collection from other errors.
+func (q *qdrantIndex) do(ctx context.Context, method, path string, body, result any) (int, error) {
+	var reader io.Reader
+	if body != nil {
+		payload, err := json.Marshal(body)
+		if err != nil {
+			return 0, err
+		}
+		reader = bytes.NewReader(payload)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, q.baseURL+path, reader)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if q.apiKey != "" {
+		req.Header.Set("api-key", q.apiKey)
+	}
+	resp, err := qdrantHTTPClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		detail, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return resp.StatusCode, fmt.Errorf("qdrant returned %s: %s", resp.Status, strings.TrimSpace(string(detail)))
+	}
+	if result == nil {
+		return resp.StatusCode, nil
+	}
+	envelope := struct {
+		Result any `json:"result"`
+	}{Result: result}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 32<<20)).Decode(&envelope); err != nil {
+		return resp.StatusCode, fmt.Errorf("invalid qdrant response: %w", err)
+	}
+	return resp.StatusCode, nil
+}
+
+// collectionPath returns the API path of the collection followed by suffix
+func (q *qdrantIndex) collectionPath(suffix string) string {
+	return "/collections/" + url.PathEscape(q.collection) + suffix
+}
+
+type qdrantCollectionInfo struct {
+	PointsCount int `json:"points_count"`
+	Config      struct {
+		Params struct {
+			Vectors struct {
+				Size int `json:"size"`
+			} `json:"vectors"`
+		} `json:"params"`
+	} `json:"config"`
+}
+
+// collectionInfo reads the collection; found is false if it doesn't exist yet
+func (q *qdrantIndex) collectionInfo(ctx context.Context) (info qdrantCollectionInfo, found bool, err error) {
+	status, err := q.do(ctx, http.MethodGet, q.collectionPath(""), nil, &info)
+	if status == http.StatusNotFound {
+		return info, false, nil
+	}
+	return info, err == nil, err
+}
+
+// ensureCollection creates the collection and its payload indexes for vectors of the given size
+func (q *qdrantIndex) ensureCollection(ctx context.Context, size int) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.dimension != 0 {
+		if q.dimension != size {
+			return fmt.Errorf("embedding dimension %d does not match collection %s (%d)", size, q.collection, q.dimension)
+		}
+		return nil
+	}
+
+	body := map[string]any{"vectors": map[string]any{"size": size, "distance": "Cosine"}}
+	if _, err := q.do(ctx, http.MethodPut, q.collectionPath(""), body, nil); err != nil {
+		return fmt.Errorf("failed to create collection: %w", err)
+	}
+	for _, field := range []string{"notebook_id", "source_id", "source_name"} {
+		body := map[string]any{"field_name": field, "field_schema": "keyword"}
+		if _, err := q.do(ctx, http.MethodPut, q.collectionPath("/index?wait=true"), body, nil); err != nil {
+			return fmt.Errorf("failed to index %s: %w", field, err)
+		}
+	}
+	q.dimension = size
+	return nil
+}
+
+// ready reports whether the collection exists. Until the first upsert there is nothing to
+// search or delete.
+func (q *qdrantIndex) ready() bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.dimension != 0
+}
+
+// upsert embeds the chunks of a source and stores them in batches. Point IDs are derived from
+// the chunk's position, so re-ingesting a source overwrites its chunks.
+func (q *qdrantIndex) upsert(ctx context.Context, notebookID, sourceID, sourceName string, chunks []textChunk) error {
+	nodes := make([]SummaryNode, len(chunks))
+	for i, chunk := range chunks {
+		nodes[i] = chunk.node(i)
+	}
+	return q.store(ctx, notebookID, sourceID, sourceName, nodes)
+}
+
+// upsertSummaries embeds the summary layer of a source and stores it in place of the old one
+func (q *qdrantIndex) upsertSummaries(ctx context.Context, notebookID, sourceID, sourceName string, nodes []SummaryNode) error {
+	filter := qdrantFilter(
+		qdrantMatch("notebook_id", notebookID),
+		qdrantMatch("source_id", sourceID),
+		qdrantMatch("source_name", sourceName),
+		qdrantSummaries,
+	)
+	if err := q.deleteWhere(ctx, filter); err != nil {
+		return err
+	}
+	return q.store(ctx, notebookID, sourceID, sourceName, nodes)
+}
+
+// store embeds and stores points of a source in batches: chunks, given as layer 0 nodes, or
+// summaries. Summary point IDs also include the layer.
+func (q *qdrantIndex) store(ctx context.Context, notebookID, sourceID, sourceName string, nodes []SummaryNode) error {
+	for first := 0; first < len(nodes); first += qdrantBatchSize {
+		batch := nodes[first:min(first+qdrantBatchSize, len(nodes))]
+		texts := make([]string, len(batch))
+		for i, node := range batch {
+			texts[i] = node.Content
+		}
+		vectors, err := q.embedder.EmbedDocuments(ctx, texts)
+		if err != nil {
+			return fmt.Errorf("failed to embed chunks: %w", err)
+		}
+		if len(vectors) != len(batch) {
+			return fmt.Errorf("embedder returned %d vectors for %d chunks", len(vectors), len(batch))
+		}
+		if err := q.ensureCollection(ctx, len(vectors[0])); err != nil {
+			return err
+		}
+
+		points := make([]map[string]any, len(batch))
+		for i, node := range batch {
+			key := notebookID + "\x00" + sourceID + "\x00" + sourceName + "\x00" + strconv.Itoa(node.Position)
+			if node.Layer > 0 {
+				key += "\x00" + strconv.Itoa(node.Layer)
+			}
+			points[i] = map[string]any{
+				"id":     uuid.NewSHA1(uuid.NameSpaceOID, []byte(key)).String(),
+				"vector": vectors[i],
+				"payload": qdrantPayload{
+					NotebookID: notebookID,
+					SourceID:   sourceID,
+					SourceName: sourceName,
+					Chunk:      node.Position,
+					Start:      node.Start,
+					End:        node.End,
+					Content:    node.Content,
+					Layer:      node.Layer,
+					FirstChunk: node.FirstChunk,
+					LastChunk:  node.LastChunk,
+					FirstPage:  node.FirstPage,
+					LastPage:   node.LastPage,
+					StartTime:  node.StartTime,
+					EndTime:    node.EndTime,
+					Chapter:    node.Chapter,
+				},
+			}
+		}
+		if _, err := q.do(ctx, http.MethodPut, q.collectionPath("/points?wait=true"), map[string]any{"points": points}, nil); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// search returns the chunks or summaries of a notebook closest to the query
+func (q *qdrantIndex) search(ctx context.Context, notebookID, query string, numDocs int, scope searchScope) ([]schema.Document, error) {
+	if !q.ready() {
+		return []schema.Document{}, nil
+	}
+	vector, err := q.embedder.EmbedQuery(ctx, query)
+	if err != nil {
+		return nil, fmt.Errorf("failed to embed query: %w", err)
+	}
+
+	var hits []struct {
+		Score   float32       `json:"score"`
+		Payload qdrantPayload `json:"payload"`
+	}
+	conditions := []any{qdrantMatch("notebook_id", notebookID)}
+	if scope.summaries {
+		conditions = append(conditions, qdrantSummaries)
+	}
+	if span := scope.within; span != nil {
+		conditions = append(conditions,
+			qdrantMatch("source_id", span.sourceID),
+			qdrantMatch("source_name", span.sourceName),
+			map[string]any{"key": "chunk", "range": map[string]any{"gte": span.first, "lte": span.last}},
+		)
+	}
+	filter := qdrantFilter(conditions...)
+	if !scope.summaries {
+		filter["must_not"] = []any{qdrantSummaries}
+	}
+	body := map[string]any{
+		"vector":       vector,
+		"limit":        numDocs,
+		"filter":       filter,
+		"with_payload": true,
+	}
+	if _, err := q.do(ctx, http.MethodPost, q.collectionPath("/points/search"), body, &hits); err != nil {
+		return nil, err
+	}
+
+	docs := make([]schema.Document, 0, len(hits))
+	for _, hit := range hits {
+		docs = append(docs, schema.Document{
+			PageContent: hit.Payload.Content,
+			Metadata:    hit.Payload.metadata(),
+			Score:       hit.Score,
+		})
+	}
+	return docs, nil
+}
+
+// chunkRange returns a source's chunks numbered from to to, in order
+func (q *qdrantIndex) chunkRange(ctx context.Context, notebookID, sourceID, sourceName string, from, to int) ([]schema.Document, error) {
+	if !q.ready() {
+		return nil, nil
+	}
+
+	var page struct {
+		Points []struct {
+			Payload qdrantPayload `json:"payload"`
+		} `json:"points"`
+	}
+	filter := qdrantFilter(
+		qdrantMatch("notebook_id", notebookID),
+		qdrantMatch("source_id", sourceID),
+		qdrantMatch("source_name", sourceName),
+		map[string]any{"key": "chunk", "range": map[string]any{"gte": from, "lte": to}},
+	)
+	filter["must_not"] = []any{qdrantSummaries}
+	body := map[string]any{
+		"filter":       filter,
+		"limit":        to - from + 1,
+		"with_payload": true,
+		"with_vector":  false,
+	}
+	if _, err := q.do(ctx, http.MethodPost, q.collectionPath("/points/scroll"), body, &page); err != nil {
+		return nil, err
+	}
+
+	docs := make([]schema.Document, 0, len(page.Points))
+	for _, point := range page.Points {
+		docs = append(docs, schema.Document{
+			PageContent: point.Payload.Content,
+			Metadata:    point.Payload.metadata(),
+		})
+	}
+	sort.SliceStable(docs, func(i, j int) bool {
+		return docs[i].Metadata["chunk"].(int) < docs[j].Metadata["chunk"].(int)
+	})
+	return docs, nil
+}
+
+// deleteWhere removes the points matching a filter
+func (q *qdrantIndex) deleteWhere(ctx context.Context, filter map[string]any) error {
+	if !q.ready() {
+		return nil
+	}
+	_, err := q.do(ctx, http.MethodPost, q.collectionPath("/points/delete?wait=true"), map[string]any{"filter": filter}, nil)
+	return err
+}
+
+func (q *qdrantIndex) deleteBySourceName(ctx context.Context, sourceName string) error {
+	return q.deleteWhere(ctx, qdrantFilter(qdrantMatch("source_name", sourceName)))
+}
+
+func (q *qdrantIndex) deleteBySourceID(ctx context.Context, sourceID string) error {
+	return q.deleteWhere(ctx, qdrantFilter(qdrantMatch("source_id", sourceID)))
+}
+
+func (q *qdrantIndex) deleteBySource(ctx context.Context, notebookID, sourceID, sourceName string) error {
+	filter := qdrantFilter(qdrantMatch("notebook_id", notebookID))
+	filter["should"] = []any{
+		qdrantMatch("source_id", sourceID),
+		qdrantFilter(qdrantMatch("source_id", ""), qdrantMatch("source_name", sourceName)),
+	}
+	return q.deleteWhere(ctx, filter)
+}
+
+func (q *qdrantIndex) deleteByNotebook(ctx context.Context, notebookID string) error {
+	return q.deleteWhere(ctx, qdrantFilter(qdrantMatch("notebook_id", notebookID)))
+}
+
+// indexedSourceIDs scrolls through a notebook's points and collects their source IDs
+func (q *qdrantIndex) indexedSourceIDs(ctx context.Context, notebookID string) (map[string]bool, error) {
+	ids := make(map[string]bool)
+	if !q.ready() {
+		return ids, nil
+	}
+
+	var offset any
+	for {
+		var page struct {
+			Points []struct {
+				Payload struct {
+					SourceID string `json:"source_id"`
+				} `json:"payload"`
+			} `json:"points"`
+			NextPageOffset any `json:"next_page_offset"`
+		}
+		body := map[string]any{
+			"filter":       qdrantFilter(qdrantMatch("notebook_id", notebookID)),
+			"limit":        256,
+			"with_payload": []string{"source_id"},
+			"with_vector":  false,
+		}
+		if offset != nil {
+			body["offset"] = offset
+		}
+		if _, err := q.do(ctx, http.MethodPost, q.collectionPath("/points/scroll"), body, &page); err != nil {
+			return nil, err
+		}
+		for _, point := range page.Points {
+			if point.Payload.SourceID != "" {
+				ids[point.Payload.SourceID] = true
+			}
+		}
+		if page.NextPageOffset == nil {
+			return ids, nil
+		}
+		offset = page.NextPageOffset
+	}
+}
+
+// stats reads the point count and vector size of the collection
+func (q *qdrantIndex) stats(ctx context.Context) (VectorStats, error) {
+	info, found, err := q.collectionInfo(ctx)
+	if err != nil || !found {
+		return VectorStats{}, err
+	}
+	return VectorStats{
+		TotalDocuments: info.PointsCount,
+		TotalVectors:   info.PointsCount,
+		Dimension:      info.Config.Params.Vectors.Size,
+	}, nil
+}
@@ -0,0 +1,110 @@
+package backend
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+)
+
+// chunkCacheSchema keeps the chunks of each source with the hash of the content they were split
+// from, so an unchanged source is loaded as is after a restart
+const chunkCacheSchema = `
+	CREATE TABLE IF NOT EXISTS source_chunks (
+		source_id TEXT NOT NULL,
+		chunk INTEGER NOT NULL,
+		notebook_id TEXT NOT NULL,
+		source_name TEXT NOT NULL,
+		content_hash TEXT NOT NULL,
+		start_offset INTEGER NOT NULL,
+		end_offset INTEGER NOT NULL,
+		content TEXT NOT NULL,
+		PRIMARY KEY (source_id, chunk)
+	);
+
+	CREATE INDEX IF NOT EXISTS idx_source_chunks_notebook ON source_chunks(notebook_id);
+`
+
+// chunkCache persists the in-memory index of the sqlite vector store type at SQLITE_PATH. It is
+// a cache: when it fails, sources are split again as if it were empty.
+type chunkCache struct {
+	db *sql.DB
+}
+
+// newChunkCache opens the chunk cache database and creates its table
+func newChunkCache(path string) (*chunkCache, error) {
+	db, err := sql.Open("sqlite", path+"?_pragma=busy_timeout(5000)")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(chunkCacheSchema); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &chunkCache{db: db}, nil
+}
+
+// chunkContentHash identifies a source's content together with the chunking settings, so chunks
+// are split again when either changes
+func chunkContentHash(content string, chunkSize, chunkOverlap int) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%d/%d\n%s", chunkSize, chunkOverlap, content)))
+	return hex.EncodeToString(sum[:])
+}
+
+// load returns the stored chunks of a source if they were split from content with this hash
+func (cc *chunkCache) load(ctx context.Context, sourceID, hash string) ([]textChunk, bool, error) {
+	rows, err := cc.db.QueryContext(ctx, `
+		SELECT content_hash, start_offset, end_offset, content FROM source_chunks
+		WHERE source_id = ? ORDER BY chunk
+	`, sourceID)
+	if err != nil {
+		return nil, false, err
+	}
+	defer rows.Close()
+
+	var chunks []textChunk
+	for rows.Next() {
+		var chunkHash string
+		var chunk textChunk
+		if err := rows.Scan(&chunkHash, &chunk.Start, &chunk.End, &chunk.Text); err != nil {
+			return nil, false, err
+		}
+		if chunkHash != hash {
+			return nil, false, nil
+		}
+		chunks = append(chunks, chunk)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, false, err
+	}
+	return chunks, len(chunks) > 0, nil
+}
+
+// save replaces the stored chunks of a source
+func (cc *chunkCache) save(ctx context.Context, notebookID, sourceID, sourceName, hash string, chunks []textChunk) error {
+	tx, err := cc.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, `DELETE FROM source_chunks WHERE source_id = ?`, sourceID); err != nil {
+		return err
+	}
+	for i, chunk := range chunks {
+		if _, err := tx.ExecContext(ctx, `
+			INSERT INTO source_chunks (source_id, chunk, notebook_id, source_name, content_hash, start_offset, end_offset, content)
+			VALUES (?, ?, ?, ?, ?, ?, ?, ?)
+		`, sourceID, i, notebookID, sourceName, hash, chunk.Start, chunk.End, chunk.Text); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// deleteWhere removes the stored chunks matching a condition
+func (cc *chunkCache) deleteWhere(ctx context.Context, condition string, args ...any) error {
+	_, err := cc.db.ExecContext(ctx, `DELETE FROM source_chunks WHERE `+condition, args...)
+	return err
+}
@@ -0,0 +1,267 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/kataras/golog"
+)
+
+// Scan statuses of uploads
+const (
+	ScanStatusClean    = "clean"
+	ScanStatusInfected = "infected"
+)
+
+// clamdChunkSize is how much of a file is sent to clamd at a time
+const clamdChunkSize = 64 << 10
+
+// eicarSignature is the EICAR anti-virus test file, which the mock scanner flags
+const eicarSignature = `X5O!P%@AP[4\PZX54(P^)7CC)7}$EICAR-STANDARD-ANTIVIRUS-TEST-FILE!$H+H*`
+
+// errInfected refuses an upload that the virus scanner flagged
+var errInfected = errors.New("the file was flagged by the virus scan")
+
+// ScanResult is the virus scan of an uploaded file, recorded as "scan" in the metadata of its
+// source
+type ScanResult struct {
+	Status     string    `json:"status"`
+	Scanner    string    `json:"scanner"`
+	Signature  string    `json:"signature,omitempty"`  // What the scanner found in an infected file
+	Quarantine string    `json:"quarantine,omitempty"` // Name of an infected file in QUARANTINE_DIR
+	ScannedAt  time.Time `json:"scanned_at"`
+}
+
+// virusScanner checks a file for malware. It returns the signature of what it found, or an
+// empty string for a clean file.
+type virusScanner interface {
+	name() string
+	scan(ctx context.Context, path string) (string, error)
+}
+
+// newVirusScanner returns the scanner of VIRUS_SCANNER, or nil if scanning is off
+func newVirusScanner(cfg Config) virusScanner {
+	switch cfg.VirusScanner {
+	case "clamav":
+		return &clamdScanner{address: cfg.ClamAVAddress, timeout: cfg.VirusScanTimeout}
+	case "http":
+		return &httpScanner{url: cfg.VirusScanURL, token: cfg.VirusScanToken, client: &http.Client{Timeout: cfg.VirusScanTimeout}}
+	case "mock":
+		return mockScanner{}
+	}
+	return nil
+}
+
+// clamdScanner streams files to a ClamAV daemon with its INSTREAM command, so clamd needn't be
+// able to read the uploads directory
+type clamdScanner struct {
+	address string
+	timeout time.Duration
+}
+
+func (c *clamdScanner) name() string { return "clamav" }
+
+func (c *clamdScanner) scan(ctx context.Context, path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	network, address := "tcp", strings.TrimPrefix(c.address, "tcp://")
+	if strings.HasPrefix(c.address, "unix://") || strings.HasPrefix(c.address, "/") {
+		network, address = "unix", strings.TrimPrefix(c.address, "unix://")
+	}
+	dialer := net.Dialer{Timeout: 10 * time.Second}
+	conn, err := dialer.DialContext(ctx, network, address)
+	if err != nil {
+		return "", fmt.Errorf("failed to connect to clamd: %w", err)
+	}
+	defer conn.Close()
+	deadline := time.Now().Add(c.timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetDeadline(deadline)
+
+	// Each chunk is sent after its length as a 4-byte big-endian number, and a zero length ends
+	// the stream
+	if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return "", fmt.Errorf("failed to send to clamd: %w", err)
+	}
+	buf := make([]byte, clamdChunkSize)
+	size := make([]byte, 4)
+	for {
+		n, err := file.Read(buf)
+		if n > 0 {
+			binary.BigEndian.PutUint32(size, uint32(n))
+			if _, werr := conn.Write(append(size, buf[:n]...)); werr != nil {
+				// clamd hangs up on streams over its StreamMaxLength, its reply says so
+				break
+			}
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+	}
+	binary.BigEndian.PutUint32(size, 0)
+	conn.Write(size)
+
+	reply, err := io.ReadAll(io.LimitReader(conn, 4096))
+	if err != nil && len(reply) == 0 {
+		return "", fmt.Errorf("failed to read the clamd reply: %w", err)
+	}
+	// The reply is "stream: OK", "stream: <signature> FOUND" or "<reason> ERROR"
+	answer := strings.TrimSpace(strings.TrimRight(string(reply), "\x00"))
+	answer = strings.TrimPrefix(answer, "stream: ")
+	switch {
+	case answer == "OK":
+		return "", nil
+	case strings.HasSuffix(answer, " FOUND"):
+		return strings.TrimSuffix(answer, " FOUND"), nil
+	default:
+		return "", fmt.Errorf("clamd failed: %s", answer)
+	}
+}
+
+// httpScanner posts files to a scanning API, which answers {"infected": true, "signature": "..."}
+type httpScanner struct {
+	url    string
+	token  string
+	client *http.Client
+}
+
+func (h *httpScanner) name() string { return "http" }
+
+func (h *httpScanner) scan(ctx context.Context, path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.url, file)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("X-File-Name", filepath.Base(path))
+	if h.token != "" {
+		req.Header.Set("Authorization", "Bearer "+h.token)
+	}
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("scanning API failed: %w", err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("scanning API returned %s: %s", resp.Status, bytes.TrimSpace(body))
+	}
+	var result struct {
+		Infected  *bool  `json:"infected"`
+		Signature string `json:"signature"`
+	}
+	if err := json.Unmarshal(body, &result); err != nil || result.Infected == nil {
+		return "", fmt.Errorf("invalid scanning API response: %s", bytes.TrimSpace(body))
+	}
+	if !*result.Infected {
+		return "", nil
+	}
+	if result.Signature == "" {
+		return "unknown", nil
+	}
+	return result.Signature, nil
+}
+
+// mockScanner is the scanner of VIRUS_SCANNER=mock. It flags files containing the EICAR test
+// string, so that quarantine can be tried without ClamAV.
+type mockScanner struct{}
+
+func (mockScanner) name() string { return "mock" }
+
+func (mockScanner) scan(ctx context.Context, path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	if bytes.Contains(data, []byte(eicarSignature)) {
+		return "Eicar-Test-Signature", nil
+	}
+	return "", nil
+}
+
+// scanUpload checks an uploaded file before it is read. An infected file is moved to
+// QUARANTINE_DIR, and errInfected returned with the result. A scan that fails refuses the file
+// too, as unscanned files must not get in. Without a scanner the result is nil.
+func (s *Server) scanUpload(ctx context.Context, path string) (*ScanResult, error) {
+	if s.virusScanner == nil {
+		return nil, nil
+	}
+	signature, err := s.virusScanner.scan(ctx, path)
+	if err != nil {
+		return nil, fmt.Errorf("virus scan failed: %w", err)
+	}
+	result := &ScanResult{Status: ScanStatusClean, Scanner: s.virusScanner.name(), ScannedAt: time.Now()}
+	if signature == "" {
+		return result, nil
+	}
+
+	result.Status = ScanStatusInfected
+	result.Signature = signature
+	golog.Warnf("virus scan flagged %s: %s", filepath.Base(path), signature)
+	if err := os.MkdirAll(s.cfg.QuarantineDir, 0700); err != nil {
+		os.Remove(path)
+		golog.Errorf("failed to create quarantine directory, deleted %s: %v", filepath.Base(path), err)
+		return result, fmt.Errorf("%w: %s", errInfected, signature)
+	}
+	// Upload names are unique, but a file can be flagged again after a restart
+	name := fmt.Sprintf("%d_%s", result.ScannedAt.Unix(), filepath.Base(path))
+	if err := moveFile(path, filepath.Join(s.cfg.QuarantineDir, name)); err != nil {
+		os.Remove(path)
+		golog.Errorf("failed to quarantine %s, deleted it: %v", filepath.Base(path), err)
+	} else {
+		result.Quarantine = name
+	}
+	return result, fmt.Errorf("%w: %s", errInfected, signature)
+}
+
+// moveFile renames a file, copying it when the destination is on another file system
+func moveFile(from, to string) error {
+	if err := os.Rename(from, to); err == nil {
+		return nil
+	}
+	in, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	out, err := os.OpenFile(to, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		in.Close()
+		return err
+	}
+	_, err = io.Copy(out, in)
+	in.Close()
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(to)
+		return err
+	}
+	return os.Remove(from)
+}
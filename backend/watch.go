@@ -0,0 +1,295 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"mime/multipart"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/kataras/golog"
+)
+
+const (
+	// watchSettleTime is how long a file must go unmodified before it is uploaded, so files
+	// still being written or copied aren't sent half-finished
+	watchSettleTime = 2 * time.Second
+	// watchBatchBytes bounds the size of the files sent in one upload request
+	watchBatchBytes = 32 << 20
+	// watchMaxFileSize skips files too large to be useful as sources
+	watchMaxFileSize = 100 << 20
+)
+
+// watchExtensions are the documents the folder watch agent uploads; other files are ignored
+var watchExtensions = map[string]bool{
+	".txt": true, ".md": true, ".csv": true, ".tsv": true,
+	".pdf": true, ".epub": true, ".docx": true, ".doc": true, ".pptx": true, ".ppt": true, ".xlsx": true, ".xls": true,
+}
+
+// fileSHA256 returns the hex SHA-256 of a file's bytes
+func fileSHA256(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// watchedFile is a file of the watched folder as it was when last uploaded or found unchanged
+type watchedFile struct {
+	modTime time.Time
+	size    int64
+}
+
+// FolderWatcher uploads the new and changed documents of a local folder to a notebook through
+// an ingest hook. The folder is scanned periodically; files the server already has are found by
+// their hash and aren't sent again.
+type FolderWatcher struct {
+	dir        string
+	serverURL  string
+	token      string
+	interval   time.Duration
+	httpClient *http.Client
+	seen       map[string]watchedFile // By path relative to dir
+}
+
+// NewFolderWatcher creates a watcher of dir uploading to the server at serverURL with an ingest
+// hook token
+func NewFolderWatcher(dir, serverURL, token string, interval time.Duration) (*FolderWatcher, error) {
+	info, err := os.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, fmt.Errorf("%s is not a directory", dir)
+	}
+	if token == "" {
+		return nil, fmt.Errorf("an ingest hook token is required (NOTEX_HOOK_TOKEN)")
+	}
+	if interval <= 0 {
+		return nil, fmt.Errorf("invalid watch interval %s", interval)
+	}
+	return &FolderWatcher{
+		dir:        dir,
+		serverURL:  strings.TrimRight(serverURL, "/"),
+		token:      token,
+		interval:   interval,
+		httpClient: &http.Client{Timeout: 10 * time.Minute},
+		seen:       make(map[string]watchedFile),
+	}, nil
+}
+
+// Run scans the folder right away and then every interval until ctx is done. A failed scan is
+// logged and retried on the next one.
+func (w *FolderWatcher) Run(ctx context.Context) error {
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	for {
+		if err := w.scan(ctx); err != nil {
+			golog.Errorf("failed to sync %s: %v", w.dir, err)
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// watchIgnored reports whether a file or folder name is hidden, temporary or a partial download
+func watchIgnored(name string) bool {
+	if strings.HasPrefix(name, ".") || strings.HasPrefix(name, "~$") || strings.HasSuffix(name, "~") {
+		return true
+	}
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".tmp", ".part", ".crdownload", ".download", ".swp":
+		return true
+	}
+	return false
+}
+
+// scan uploads the files of the folder that are new or changed since they were last seen
+func (w *FolderWatcher) scan(ctx context.Context) error {
+	type candidate struct {
+		HookFile
+		abs  string
+		stat watchedFile
+	}
+	var candidates []candidate
+	err := filepath.WalkDir(w.dir, func(abs string, d fs.DirEntry, err error) error {
+		if err != nil {
+			golog.Warnf("skipping %s: %v", abs, err)
+			return nil
+		}
+		if abs != w.dir && watchIgnored(d.Name()) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() || !d.Type().IsRegular() || !watchExtensions[strings.ToLower(filepath.Ext(d.Name()))] {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		rel, err := filepath.Rel(w.dir, abs)
+		if err != nil {
+			return nil
+		}
+		rel = filepath.ToSlash(rel)
+		stat := watchedFile{modTime: info.ModTime(), size: info.Size()}
+		if w.seen[rel] == stat || time.Since(stat.modTime) < watchSettleTime {
+			return nil
+		}
+		if stat.size > watchMaxFileSize {
+			golog.Warnf("skipping %s, larger than %d MB", rel, watchMaxFileSize>>20)
+			w.seen[rel] = stat
+			return nil
+		}
+		hash, err := fileSHA256(abs)
+		if err != nil {
+			golog.Warnf("skipping %s: %v", rel, err)
+			return nil
+		}
+		candidates = append(candidates, candidate{HookFile: HookFile{Path: rel, SHA256: hash}, abs: abs, stat: stat})
+		return nil
+	})
+	if err != nil || len(candidates) == 0 {
+		return err
+	}
+
+	// Ask which files the server doesn't have yet before sending any
+	files := make([]HookFile, len(candidates))
+	for i, c := range candidates {
+		files[i] = c.HookFile
+	}
+	var checked []HookFileResult
+	if err := w.postJSON(ctx, "/api/hooks/files/check", HookFilesCheckRequest{Files: files}, &checked); err != nil {
+		return err
+	}
+	if len(checked) != len(candidates) {
+		return fmt.Errorf("check returned %d results for %d files", len(checked), len(candidates))
+	}
+
+	var batch []candidate
+	var batchBytes int64
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		files := make([]HookFile, len(batch))
+		paths := make([]string, len(batch))
+		for i, c := range batch {
+			files[i], paths[i] = c.HookFile, c.abs
+		}
+		results, err := w.upload(ctx, files, paths)
+		if err != nil {
+			return err
+		}
+		for i, result := range results[:min(len(results), len(batch))] {
+			if result.Status == "failed" {
+				golog.Warnf("failed to upload %s: %s", result.Path, result.Error)
+				continue
+			}
+			golog.Infof("%s: %s", result.Path, result.Status)
+			w.seen[batch[i].Path] = batch[i].stat
+		}
+		batch, batchBytes = nil, 0
+		return nil
+	}
+	for i, c := range candidates {
+		if checked[i].Status == "unchanged" {
+			w.seen[c.Path] = c.stat
+			continue
+		}
+		if len(batch) > 0 && batchBytes+c.stat.size > watchBatchBytes {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+		batch = append(batch, c)
+		batchBytes += c.stat.size
+	}
+	return flush()
+}
+
+// upload sends files in one multipart request, each followed by its path relative to the folder
+func (w *FolderWatcher) upload(ctx context.Context, files []HookFile, paths []string) ([]HookFileResult, error) {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+	for i, file := range files {
+		part, err := mw.CreateFormFile("file", filepath.Base(paths[i]))
+		if err != nil {
+			return nil, err
+		}
+		f, err := os.Open(paths[i])
+		if err != nil {
+			return nil, err
+		}
+		_, err = io.Copy(part, f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		if err := mw.WriteField("path", file.Path); err != nil {
+			return nil, err
+		}
+	}
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+
+	var results []HookFileResult
+	if err := w.post(ctx, "/api/hooks/files", mw.FormDataContentType(), &body, &results); err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// postJSON POSTs a JSON body to a path of the server and decodes its JSON response into result
+func (w *FolderWatcher) postJSON(ctx context.Context, path string, body, result interface{}) error {
+	jsonBody, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	return w.post(ctx, path, "application/json", bytes.NewReader(jsonBody), result)
+}
+
+func (w *FolderWatcher) post(ctx context.Context, path, contentType string, body io.Reader, result interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.serverURL+path, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("X-Hook-Token", w.token)
+
+	resp, err := w.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		var errResp ErrorResponse
+		json.NewDecoder(io.LimitReader(resp.Body, 4096)).Decode(&errResp)
+		return fmt.Errorf("server returned %s: %s %s", resp.Status, errResp.Error, errResp.Details)
+	}
+	return json.NewDecoder(resp.Body).Decode(result)
+}
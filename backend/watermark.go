@@ -0,0 +1,145 @@
+package backend
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"image"
+	_ "image/jpeg"
+	_ "image/png"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kataras/golog"
+)
+
+// watermarkDir is where stamped copies of an owner's generated images are kept, within their
+// uploads directory
+const watermarkDir = "watermarked"
+
+// watermarkTimeout bounds how long ImageMagick may take to stamp one image
+const watermarkTimeout = 30 * time.Second
+
+// watermarkExtensions are the generated images that are stamped
+var watermarkExtensions = map[string]bool{".png": true, ".jpg": true, ".jpeg": true}
+
+// watermarkEnabled reports whether public generated images are stamped
+func (s *Server) watermarkEnabled() bool {
+	return s.cfg.PublicWatermark != "" || s.cfg.PublicWatermarkImage != "" || s.cfg.PublicAttribution != ""
+}
+
+// serveWatermarked serves a generated image of a notebook to the public with the deployment's
+// watermark and attribution footer. Stamped images are kept on disk, and stamped again when the
+// image or the settings change. It reports whether the image was served; if not, the caller
+// serves the original, so that a missing ImageMagick doesn't break public pages.
+func (s *Server) serveWatermarked(c *gin.Context, notebook *Notebook, filename string) bool {
+	if !s.watermarkEnabled() || !watermarkExtensions[strings.ToLower(filepath.Ext(filename))] {
+		return false
+	}
+	ctx := c.Request.Context()
+	ownerDir := filepath.Join(s.cfg.UploadDir, notebook.UserID)
+	input := filepath.Join(ownerDir, filename)
+	info, err := os.Stat(input)
+	if err != nil {
+		return false
+	}
+
+	footer := s.attribution(ctx, notebook)
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%d\x00%d\x00%s\x00%s\x00%s\x00%s", filename, info.ModTime().UnixNano(), info.Size(),
+		s.cfg.PublicWatermark, s.cfg.PublicWatermarkImage, s.cfg.WatermarkFont, footer)
+	ext := filepath.Ext(filename)
+	name := strings.TrimSuffix(filename, ext) + "-" + hex.EncodeToString(h.Sum(nil))[:16] + ext
+	output := filepath.Join(ownerDir, watermarkDir, name)
+
+	if _, err := os.Stat(output); err != nil {
+		if err := s.stampImage(ctx, input, output, footer); err != nil {
+			golog.Errorf("failed to watermark %s, serving it as is: %v", filename, err)
+			return false
+		}
+	}
+	s.serveUploadedFile(c, notebook.UserID, filepath.Join(watermarkDir, name), true)
+	return true
+}
+
+// attribution fills in the PUBLIC_ATTRIBUTION footer for a notebook
+func (s *Server) attribution(ctx context.Context, notebook *Notebook) string {
+	if s.cfg.PublicAttribution == "" {
+		return ""
+	}
+	owner := ""
+	if user, err := s.store.GetUser(ctx, notebook.UserID); err == nil {
+		owner = user.Name
+	}
+	return strings.NewReplacer("{notebook}", notebook.Name, "{owner}", owner).Replace(s.cfg.PublicAttribution)
+}
+
+// stampImage writes a copy of an image with the watermark text and logo in its bottom right
+// corner and the footer in a band below it. Sizes follow the width of the image.
+func (s *Server) stampImage(ctx context.Context, input, output, footer string) error {
+	file, err := os.Open(input)
+	if err != nil {
+		return err
+	}
+	config, _, err := image.DecodeConfig(file)
+	file.Close()
+	if err != nil {
+		return fmt.Errorf("unreadable image: %w", err)
+	}
+	size := max(12, config.Width/40) // Point size of the text
+	margin := size
+
+	args := []string{input}
+	if s.cfg.WatermarkFont != "" {
+		args = append(args, "-font", s.cfg.WatermarkFont)
+	}
+	offset := margin // Distance of the watermark text from the bottom, above the logo
+	if s.cfg.PublicWatermarkImage != "" {
+		logoWidth := config.Width / 8
+		args = append(args, "(", s.cfg.PublicWatermarkImage, "-resize", fmt.Sprintf("%dx%d>", logoWidth, logoWidth), ")",
+			"-gravity", "southeast", "-geometry", fmt.Sprintf("+%d+%d", margin, margin),
+			"-compose", "dissolve", "-define", "compose:args=60", "-composite", "-compose", "over")
+		offset += logoWidth + margin/2
+	}
+	if s.cfg.PublicWatermark != "" {
+		args = append(args, "-gravity", "southeast", "-pointsize", fmt.Sprint(size),
+			"-fill", "rgba(255,255,255,0.7)", "-stroke", "rgba(0,0,0,0.4)", "-strokewidth", "1",
+			"-annotate", fmt.Sprintf("+%d+%d", margin, offset), magickText(s.cfg.PublicWatermark))
+	}
+	if footer != "" {
+		band := size * 2
+		args = append(args, "-background", "#202124", "-gravity", "south", "-splice", fmt.Sprintf("0x%d", band),
+			"-stroke", "none", "-fill", "white", "-pointsize", fmt.Sprint(size*4/5),
+			"-annotate", fmt.Sprintf("+0+%d", (band-size*4/5)/2), magickText(footer))
+	}
+
+	if err := os.MkdirAll(filepath.Dir(output), 0755); err != nil {
+		return err
+	}
+	// ImageMagick picks the format by the extension, so the temporary file keeps it
+	ext := filepath.Ext(output)
+	tmp := strings.TrimSuffix(output, ext) + ".tmp" + ext
+	ctx, cancel := context.WithTimeout(ctx, watermarkTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, s.cfg.MagickPath, append(args, tmp)...)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("ImageMagick failed: %w, output: %s", err, out)
+	}
+	return os.Rename(tmp, output)
+}
+
+// magickText escapes text for -annotate, which would read a file named by text starting with
+// "@" and expand "%" escapes such as %f. Notebook names are up to their owners.
+func magickText(text string) string {
+	text = strings.NewReplacer(`\`, `\\`, "%", "%%").Replace(text)
+	if strings.HasPrefix(text, "@") {
+		text = `\` + text
+	}
+	return text
+}
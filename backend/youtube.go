@@ -0,0 +1,297 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/kataras/golog"
+)
+
+// youtubePlayerURL is the InnerTube endpoint the YouTube apps read video details and caption
+// tracks from
+var youtubePlayerURL = "https://www.youtube.com/youtubei/v1/player"
+
+// youtubeClientVersion is the Android app version sent to InnerTube, whose caption links work
+// without the signed tokens the web player needs
+const youtubeClientVersion = "20.10.38"
+
+// youtubeSegmentLength is roughly how long a transcript line runs. Captions come a few words
+// at a time, which would be too short to cite.
+const youtubeSegmentLength = 15 * time.Second
+
+var youtubeIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{11}$`)
+
+// parseYouTubeID returns the video ID of a YouTube watch, short, embed or live link, or an
+// empty string for other input
+func parseYouTubeID(input string) string {
+	u, err := url.Parse(strings.TrimSpace(input))
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		return ""
+	}
+	host := strings.TrimPrefix(strings.ToLower(u.Hostname()), "www.")
+	var id string
+	switch host {
+	case "youtu.be":
+		id = strings.Trim(u.Path, "/")
+	case "youtube.com", "m.youtube.com", "music.youtube.com", "youtube-nocookie.com":
+		if u.Path == "/watch" {
+			id = u.Query().Get("v")
+			break
+		}
+		for _, prefix := range []string{"/shorts/", "/embed/", "/live/", "/v/"} {
+			if strings.HasPrefix(u.Path, prefix) {
+				id = strings.Trim(u.Path[len(prefix):], "/")
+			}
+		}
+	}
+	if !youtubeIDPattern.MatchString(id) {
+		return ""
+	}
+	return id
+}
+
+// YouTubeVideo is what a YouTube source records about its video
+type YouTubeVideo struct {
+	VideoID       string  `json:"video_id"`
+	Title         string  `json:"title"`
+	Channel       string  `json:"channel"`
+	ChannelID     string  `json:"channel_id,omitempty"`
+	Duration      float64 `json:"duration"`                 // Seconds
+	Language      string  `json:"language,omitempty"`       // Language code of the transcript's captions
+	AutoGenerated bool    `json:"auto_generated,omitempty"` // The captions are YouTube's speech recognition
+}
+
+// youtubePlayer is the part of an InnerTube player response a source needs
+type youtubePlayer struct {
+	PlayabilityStatus struct {
+		Status string `json:"status"`
+		Reason string `json:"reason"`
+	} `json:"playabilityStatus"`
+	VideoDetails struct {
+		VideoID          string `json:"videoId"`
+		Title            string `json:"title"`
+		Author           string `json:"author"`
+		ChannelID        string `json:"channelId"`
+		LengthSeconds    string `json:"lengthSeconds"`
+		ShortDescription string `json:"shortDescription"`
+	} `json:"videoDetails"`
+	Captions struct {
+		Tracklist struct {
+			CaptionTracks []youtubeCaptionTrack `json:"captionTracks"`
+		} `json:"playerCaptionsTracklistRenderer"`
+	} `json:"captions"`
+}
+
+type youtubeCaptionTrack struct {
+	BaseURL      string `json:"baseUrl"`
+	LanguageCode string `json:"languageCode"`
+	Kind         string `json:"kind"` // "asr" for automatic captions
+}
+
+// fetchYouTubePlayer reads the details and caption tracks of a video
+func fetchYouTubePlayer(ctx context.Context, videoID string) (*youtubePlayer, error) {
+	body, err := json.Marshal(map[string]interface{}{
+		"videoId": videoID,
+		"context": map[string]interface{}{
+			"client": map[string]interface{}{
+				"clientName":        "ANDROID",
+				"clientVersion":     youtubeClientVersion,
+				"androidSdkVersion": 30,
+				"hl":                "en",
+			},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, youtubePlayerURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "com.google.android.youtube/"+youtubeClientVersion+" (Linux; U; Android 11) gzip")
+	resp, err := paperHTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("YouTube returned %s", resp.Status)
+	}
+
+	var player youtubePlayer
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 8<<20)).Decode(&player); err != nil {
+		return nil, fmt.Errorf("invalid YouTube response: %w", err)
+	}
+	if player.VideoDetails.VideoID == "" {
+		reason := player.PlayabilityStatus.Reason
+		if reason == "" {
+			reason = "not found"
+		}
+		return nil, fmt.Errorf("YouTube video %s: %s", videoID, reason)
+	}
+	return &player, nil
+}
+
+// pickCaptionTrack chooses the captions of the first preferred language that has any, human
+// captions before automatic ones. A language matches its regional variants, so "zh" matches
+// "zh-Hans". Without a match the video's first track is used.
+func pickCaptionTrack(tracks []youtubeCaptionTrack, languages []string) *youtubeCaptionTrack {
+	if len(tracks) == 0 {
+		return nil
+	}
+	matches := func(code, language string) bool {
+		code, language = strings.ToLower(code), strings.ToLower(language)
+		return code == language || strings.HasPrefix(code, language+"-")
+	}
+	for _, language := range languages {
+		for _, asr := range []bool{false, true} {
+			for i := range tracks {
+				if (tracks[i].Kind == "asr") == asr && matches(tracks[i].LanguageCode, language) {
+					return &tracks[i]
+				}
+			}
+		}
+	}
+	for i := range tracks {
+		if tracks[i].Kind != "asr" {
+			return &tracks[i]
+		}
+	}
+	return &tracks[0]
+}
+
+// fetchYouTubeCaptions downloads a caption track and joins its captions into transcript
+// segments of about youtubeSegmentLength
+func fetchYouTubeCaptions(ctx context.Context, track *youtubeCaptionTrack) ([]transcriptSegment, error) {
+	link, err := url.Parse(track.BaseURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid caption link: %w", err)
+	}
+	query := link.Query()
+	query.Set("fmt", "json3")
+	link.RawQuery = query.Encode()
+
+	body, err := paperGet(ctx, link.String(), "application/json", 8<<20)
+	if err != nil {
+		return nil, err
+	}
+	var captions struct {
+		Events []struct {
+			StartMs    int64 `json:"tStartMs"`
+			DurationMs int64 `json:"dDurationMs"`
+			Segs       []struct {
+				UTF8 string `json:"utf8"`
+			} `json:"segs"`
+		} `json:"events"`
+	}
+	if err := json.Unmarshal(body, &captions); err != nil {
+		return nil, fmt.Errorf("invalid captions: %w", err)
+	}
+
+	var segments []transcriptSegment
+	var current *transcriptSegment
+	for _, event := range captions.Events {
+		var text strings.Builder
+		for _, seg := range event.Segs {
+			text.WriteString(seg.UTF8)
+		}
+		line := strings.Join(strings.Fields(text.String()), " ")
+		if line == "" {
+			continue
+		}
+		start := time.Duration(event.StartMs) * time.Millisecond
+		end := start + time.Duration(event.DurationMs)*time.Millisecond
+		if current == nil || start-current.Start >= youtubeSegmentLength {
+			segments = append(segments, transcriptSegment{Start: start, End: end, Text: line})
+			current = &segments[len(segments)-1]
+			continue
+		}
+		current.Text += " " + line
+		current.End = max(current.End, end)
+	}
+	return segments, nil
+}
+
+// resolveYouTube fills a source from a YouTube link: the video's captions become its content,
+// as a transcript whose citations point at positions in the video, and the title, channel and
+// duration are stored as metadata. A video without captions keeps its description.
+func (s *Server) resolveYouTube(ctx context.Context, source *Source, videoID string) error {
+	player, err := fetchYouTubePlayer(ctx, videoID)
+	if err != nil {
+		return err
+	}
+	details := player.VideoDetails
+	video := &YouTubeVideo{
+		VideoID:   videoID,
+		Title:     details.Title,
+		Channel:   details.Author,
+		ChannelID: details.ChannelID,
+	}
+	if seconds, err := strconv.Atoi(details.LengthSeconds); err == nil {
+		video.Duration = float64(seconds)
+	}
+
+	// A language given with the source comes before the configured ones
+	languages := s.cfg.YouTubeLanguages
+	if language, _ := source.Metadata["caption_language"].(string); language != "" {
+		languages = append([]string{language}, languages...)
+	}
+	track := pickCaptionTrack(player.Captions.Tracklist.CaptionTracks, languages)
+
+	var content string
+	if track != nil {
+		segments, err := fetchYouTubeCaptions(ctx, track)
+		if err != nil {
+			return fmt.Errorf("failed to fetch captions: %w", err)
+		}
+		content = formatTranscript(segments)
+		video.Language = track.LanguageCode
+		video.AutoGenerated = track.Kind == "asr"
+	}
+	if strings.TrimSpace(content) == "" {
+		if strings.TrimSpace(details.ShortDescription) == "" {
+			return fmt.Errorf("YouTube video %s has no captions or description", videoID)
+		}
+		golog.Warnf("YouTube video %s has no captions, keeping its description", videoID)
+		content = details.ShortDescription
+	}
+
+	source.Type = "youtube"
+	source.URL = "https://www.youtube.com/watch?v=" + videoID
+	if source.Name == "" || parseYouTubeID(source.Name) == videoID {
+		source.Name = video.Title
+	}
+	if source.Metadata == nil {
+		source.Metadata = make(map[string]interface{})
+	}
+	source.Metadata["youtube"] = video
+	source.Content = content
+	return nil
+}
+
+// youtubeMedia returns the player of a YouTube source for the source content response
+func youtubeMedia(source *Source) gin.H {
+	videoID := parseYouTubeID(source.URL)
+	if source.Type != "youtube" || videoID == "" {
+		return nil
+	}
+	media := gin.H{"kind": "youtube", "url": "https://www.youtube-nocookie.com/embed/" + videoID}
+	switch video := source.Metadata["youtube"].(type) {
+	case *YouTubeVideo:
+		media["duration"] = video.Duration
+	case map[string]interface{}:
+		media["duration"] = video["duration"]
+	}
+	return media
+}
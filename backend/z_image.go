@@ -6,8 +6,6 @@ import (
 	"fmt"
 	"io"
 	"net/http"
-	"os"
-	"path/filepath"
 	"strings"
 	"time"
 
@@ -20,15 +18,17 @@ type ZImageClient struct {
 	apiKey     string
 	baseURL    string
 	httpClient *http.Client
+	uploadDir  string
 }
 
 // NewZImageClient creates a new ZImage client
-func NewZImageClient(apiKey string) *ZImageClient {
+func NewZImageClient(apiKey string, timeout time.Duration, uploadDir string) *ZImageClient {
 	return &ZImageClient{
-		apiKey:  apiKey,
-		baseURL: "https://dashscope.aliyuncs.com/api/v1/services/aigc/image-generation/generation",
+		apiKey:    apiKey,
+		uploadDir: uploadDir,
+		baseURL:   "https://dashscope.aliyuncs.com/api/v1/services/aigc/image-generation/generation",
 		httpClient: &http.Client{
-			Timeout: 5 * time.Minute,
+			Timeout: timeout,
 			Transport: &http.Transport{
 				DisableKeepAlives: false,
 				MaxIdleConns:      100,
@@ -136,26 +136,7 @@ func (z *ZImageClient) GenerateImage(ctx context.Context, model, prompt string,
 	golog.Infof("image data received successfully (%d bytes), saving...", len(imageData))
 
 	// Save the image to user-specific directory
-	fileName := fmt.Sprintf("infograph_%d.png", time.Now().UnixNano())
-	var uploadDir string
-	if userID != "" {
-		uploadDir = filepath.Join("./data/uploads", userID)
-	} else {
-		uploadDir = "./data/uploads"
-	}
-
-	if err := os.MkdirAll(uploadDir, 0755); err != nil {
-		return "", fmt.Errorf("failed to create upload directory: %w", err)
-	}
-
-	filePath := filepath.Join(uploadDir, fileName)
-	if err := os.WriteFile(filePath, imageData, 0644); err != nil {
-		golog.Errorf("failed to save image to %s: %v", filePath, err)
-		return "", fmt.Errorf("failed to save image: %w", err)
-	}
-
-	golog.Infof("infographic saved to %s", filePath)
-	return filePath, nil
+	return saveGeneratedImage(z.uploadDir, userID, imageData)
 }
 
 // GenerateTextWithModel generates text using Z-Image (optional, for compatibility)
@@ -167,3 +148,8 @@ func (z *ZImageClient) GenerateTextWithModel(ctx context.Context, prompt string,
 func (z *ZImageClient) GenerateFromSinglePrompt(ctx context.Context, llm llms.Model, prompt string, options ...llms.CallOption) (string, error) {
 	return "", fmt.Errorf("Z-Image client does not support text generation")
 }
+
+// GenerateStreamFromSinglePrompt generates streamed text (optional, for compatibility)
+func (z *ZImageClient) GenerateStreamFromSinglePrompt(ctx context.Context, llm llms.Model, prompt string, onChunk func(chunk string) error, options ...llms.CallOption) (string, error) {
+	return "", fmt.Errorf("Z-Image client does not support text generation")
+}
@@ -0,0 +1,492 @@
+// Command loadtest drives synthetic ingestion and chat traffic against a running Notex server
+// and reports the throughput and latency of each, for capacity planning.
+//
+// It creates a notebook, uploads a generated corpus of text sources to it with the configured
+// concurrency, then asks questions about the corpus for a fixed duration or number of chats,
+// and deletes the notebook at the end unless -keep is given.
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/kataras/golog"
+)
+
+func main() {
+	serverURL := flag.String("url", "http://localhost:8080", "Notex server to test")
+	token := flag.String("token", os.Getenv("NOTEX_TOKEN"), "API token (default: NOTEX_TOKEN); not needed against a local-mode server")
+	email := flag.String("email", "", "Sign in with this email and -password instead of a token")
+	password := flag.String("password", "", "Password for -email")
+	concurrency := flag.Int("concurrency", 8, "Concurrent requests")
+	docs := flag.Int("docs", 50, "Documents in the synthetic corpus")
+	docWords := flag.Int("doc-words", 1500, "Words per document")
+	chats := flag.Int("chats", 0, "Chat requests to send (default: send for -duration)")
+	duration := flag.Duration("duration", time.Minute, "How long to send chat requests, unless -chats is given")
+	stream := flag.Bool("stream", false, "Stream chat answers and report the time to the first token")
+	seed := flag.Int64("seed", 1, "Seed of the synthetic corpus and questions")
+	keep := flag.Bool("keep", false, "Keep the test notebook instead of deleting it")
+	asJSON := flag.Bool("json", false, "Print the report as JSON")
+	flag.Parse()
+
+	// Progress goes to stderr, so that the report can be piped
+	golog.SetOutput(os.Stderr)
+
+	if *concurrency < 1 || *docs < 1 || *docWords < 1 || *chats < 0 {
+		golog.Fatal("-concurrency, -docs and -doc-words must be positive, -chats not negative")
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	c := &client{
+		baseURL:    strings.TrimRight(*serverURL, "/"),
+		token:      *token,
+		httpClient: &http.Client{Timeout: 10 * time.Minute},
+	}
+	if *email != "" {
+		if err := c.login(ctx, *email, *password); err != nil {
+			golog.Fatalf("failed to sign in: %v", err)
+		}
+	}
+
+	corpus := newCorpus(*seed, *docs, *docWords)
+	notebookID, err := c.createNotebook(ctx, fmt.Sprintf("Load test %s", time.Now().Format("2006-01-02 15:04:05")))
+	if err != nil {
+		golog.Fatalf("failed to create notebook: %v", err)
+	}
+	golog.Infof("created notebook %s", notebookID)
+	if !*keep {
+		defer func() {
+			// The test may have been interrupted, which cancels ctx
+			if err := c.deleteNotebook(context.Background(), notebookID); err != nil {
+				golog.Errorf("failed to delete notebook %s: %v", notebookID, err)
+			}
+		}()
+	}
+
+	report := report{Server: *serverURL, Concurrency: *concurrency, Docs: *docs, DocWords: *docWords}
+
+	golog.Infof("ingesting %d documents of %d words with %d workers", *docs, *docWords, *concurrency)
+	next := atomic.Int64{}
+	report.Ingest = run(ctx, *concurrency, func() (*sample, bool) {
+		i := int(next.Add(1)) - 1
+		if i >= len(corpus.docs) {
+			return nil, false
+		}
+		return c.addSource(ctx, notebookID, corpus.docs[i]), true
+	})
+
+	if ctx.Err() == nil {
+		if *chats > 0 {
+			golog.Infof("sending %d chat requests with %d workers", *chats, *concurrency)
+		} else {
+			golog.Infof("sending chat requests for %s with %d workers", *duration, *concurrency)
+		}
+		start := time.Now()
+		sent := atomic.Int64{}
+		report.Chat = run(ctx, *concurrency, func() (*sample, bool) {
+			n := sent.Add(1)
+			if *chats > 0 && n > int64(*chats) || *chats == 0 && time.Since(start) >= *duration {
+				return nil, false
+			}
+			return c.chat(ctx, notebookID, corpus.question(n), *stream), true
+		})
+	}
+
+	if *asJSON {
+		out, _ := json.MarshalIndent(report, "", "  ")
+		fmt.Println(string(out))
+	} else {
+		report.print(os.Stdout)
+	}
+}
+
+// client calls the Notex API
+type client struct {
+	baseURL    string
+	token      string
+	httpClient *http.Client
+}
+
+// sample is the outcome of one request
+type sample struct {
+	status     int           // 0 if the request failed without a reply
+	err        error         // Set for failures, including error statuses
+	latency    time.Duration // Until the whole reply was read
+	firstToken time.Duration // Until the first streamed token, 0 without one
+}
+
+func (c *client) newRequest(ctx context.Context, method, path string, body any) (*http.Request, error) {
+	var r io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		r = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, r)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	return req, nil
+}
+
+// do sends a request and decodes a JSON reply into out, if not nil
+func (c *client) do(ctx context.Context, method, path string, body, out any) error {
+	req, err := c.newRequest(ctx, method, path, body)
+	if err != nil {
+		return err
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(data))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.Unmarshal(data, out)
+}
+
+// timed sends a request for the load, reading the whole reply
+func (c *client) timed(ctx context.Context, method, path string, body any, header http.Header) *sample {
+	req, err := c.newRequest(ctx, method, path, body)
+	if err != nil {
+		return &sample{err: err}
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	start := time.Now()
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return &sample{err: err, latency: time.Since(start)}
+	}
+	defer resp.Body.Close()
+
+	s := &sample{status: resp.StatusCode}
+	var reply bytes.Buffer
+	if strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream") {
+		// A stream always replies 200; it ends with a "done" or an "error" event
+		scanner := bufio.NewScanner(resp.Body)
+		scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+		event := ""
+		for scanner.Scan() {
+			line := scanner.Text()
+			switch {
+			case strings.HasPrefix(line, "event:"):
+				event = strings.TrimSpace(strings.TrimPrefix(line, "event:"))
+				if event == "token" && s.firstToken == 0 {
+					s.firstToken = time.Since(start)
+				}
+			case strings.HasPrefix(line, "data:") && event == "error":
+				s.err = fmt.Errorf("stream error: %s", strings.TrimSpace(strings.TrimPrefix(line, "data:")))
+			}
+		}
+		err = scanner.Err()
+	} else {
+		_, err = io.Copy(&reply, resp.Body)
+	}
+	s.latency = time.Since(start)
+	if err != nil && s.err == nil {
+		s.err = err
+	}
+	if s.err == nil && resp.StatusCode >= 300 {
+		s.err = fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(reply.Bytes()))
+	}
+	return s
+}
+
+func (c *client) login(ctx context.Context, email, password string) error {
+	var reply struct {
+		Token string `json:"token"`
+	}
+	if err := c.do(ctx, http.MethodPost, "/auth/login", map[string]string{"email": email, "password": password}, &reply); err != nil {
+		return err
+	}
+	c.token = reply.Token
+	return nil
+}
+
+func (c *client) createNotebook(ctx context.Context, name string) (string, error) {
+	var notebook struct {
+		ID string `json:"id"`
+	}
+	body := map[string]string{"name": name, "description": "Synthetic corpus of the load test"}
+	if err := c.do(ctx, http.MethodPost, "/api/notebooks", body, &notebook); err != nil {
+		return "", err
+	}
+	return notebook.ID, nil
+}
+
+func (c *client) deleteNotebook(ctx context.Context, id string) error {
+	return c.do(ctx, http.MethodDelete, "/api/notebooks/"+id, nil, nil)
+}
+
+// addSource uploads a text source, which the server indexes before replying
+func (c *client) addSource(ctx context.Context, notebookID string, doc document) *sample {
+	body := map[string]string{"name": doc.name, "type": "text", "content": doc.content}
+	return c.timed(ctx, http.MethodPost, "/api/notebooks/"+notebookID+"/sources", body, nil)
+}
+
+// chat asks a question in a new session
+func (c *client) chat(ctx context.Context, notebookID, question string, stream bool) *sample {
+	var header http.Header
+	if stream {
+		header = http.Header{"Accept": {"text/event-stream"}}
+	}
+	return c.timed(ctx, http.MethodPost, "/api/notebooks/"+notebookID+"/chat", map[string]string{"message": question}, header)
+}
+
+// run sends requests from workers until next reports there are no more or ctx is done. Requests
+// cut short by ctx are left out of the results.
+func run(ctx context.Context, workers int, next func() (*sample, bool)) *phase {
+	var mu sync.Mutex
+	var samples []*sample
+	var wg sync.WaitGroup
+	start := time.Now()
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ctx.Err() == nil {
+				s, ok := next()
+				if !ok {
+					return
+				}
+				if ctx.Err() != nil {
+					return
+				}
+				mu.Lock()
+				samples = append(samples, s)
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	return summarize(samples, time.Since(start))
+}
+
+// document is a source of the synthetic corpus
+type document struct {
+	name    string
+	content string
+}
+
+// corpus is a set of generated documents, each stating facts the questions ask about, so that
+// answering takes retrieval over the whole corpus
+type corpus struct {
+	rand  *rand.Rand
+	docs  []document
+	facts []fact
+	mu    sync.Mutex
+}
+
+type fact struct {
+	subject, attribute, value string
+}
+
+var (
+	loadtestWords = strings.Fields(`system network storage memory process thread kernel buffer cache
+		index query vector model latency throughput cluster replica shard leader follower consensus
+		protocol packet router switch gateway proxy balancer service client server request response
+		message queue stream batch window event signal metric trace log alert threshold budget quota
+		policy schema table column record field value key hash tree graph node edge path cycle
+		algorithm heuristic estimate sample dataset feature label training inference evaluation
+		benchmark experiment result analysis summary report review design architecture component
+		module interface contract version release deployment rollout migration upgrade rollback`)
+	loadtestAttributes = []string{"code name", "founding year", "lead engineer", "home city", "primary color", "launch date"}
+	loadtestValues     = strings.Fields(`Aurora Basalt Cobalt Delta Ember Falcon Granite Harbor Ion Juniper
+		Kestrel Lumen Meridian Nimbus Onyx Pioneer Quartz Raven Sierra Tundra Umber Vesper Willow Zephyr`)
+)
+
+func newCorpus(seed int64, docs, words int) *corpus {
+	r := rand.New(rand.NewSource(seed))
+	c := &corpus{rand: r}
+	for i := range docs {
+		subject := fmt.Sprintf("Project %s-%d", loadtestValues[r.Intn(len(loadtestValues))], i+1)
+		var b strings.Builder
+		fmt.Fprintf(&b, "# %s\n\n", subject)
+		sentence := 0
+		for n := 0; n < words; {
+			// One sentence in ten states a fact about the document's subject
+			if sentence%10 == 0 {
+				f := fact{
+					subject:   subject,
+					attribute: loadtestAttributes[r.Intn(len(loadtestAttributes))],
+					value:     loadtestValues[r.Intn(len(loadtestValues))],
+				}
+				c.facts = append(c.facts, f)
+				fmt.Fprintf(&b, "The %s of %s is %s. ", f.attribute, f.subject, f.value)
+				n += 6
+			} else {
+				length := 8 + r.Intn(12)
+				for j := range length {
+					word := loadtestWords[r.Intn(len(loadtestWords))]
+					if j == 0 {
+						word = strings.ToUpper(word[:1]) + word[1:]
+					}
+					b.WriteString(word)
+					if j < length-1 {
+						b.WriteByte(' ')
+					}
+				}
+				b.WriteString(". ")
+				n += length
+			}
+			sentence++
+			if sentence%6 == 0 {
+				b.WriteString("\n\n")
+			}
+		}
+		c.docs = append(c.docs, document{name: fmt.Sprintf("%s.md", subject), content: b.String()})
+	}
+	return c
+}
+
+// question returns the nth question, about a random fact of the corpus
+func (c *corpus) question(n int64) string {
+	c.mu.Lock()
+	f := c.facts[c.rand.Intn(len(c.facts))]
+	c.mu.Unlock()
+	return fmt.Sprintf("What is the %s of %s? (question %d)", f.attribute, f.subject, n)
+}
+
+// report is the outcome of a load test
+type report struct {
+	Server      string `json:"server"`
+	Concurrency int    `json:"concurrency"`
+	Docs        int    `json:"docs"`
+	DocWords    int    `json:"doc_words"`
+	Ingest      *phase `json:"ingest"`
+	Chat        *phase `json:"chat,omitempty"`
+}
+
+// phase sums up the requests of one kind of traffic
+type phase struct {
+	Requests   int            `json:"requests"`
+	Errors     int            `json:"errors"`
+	Statuses   map[string]int `json:"statuses"` // By status code, "error" for requests without a reply
+	Seconds    float64        `json:"seconds"`
+	Throughput float64        `json:"throughput"` // Successful requests per second
+	Latency    *percentiles   `json:"latency_ms,omitempty"`
+	FirstToken *percentiles   `json:"first_token_ms,omitempty"`
+	LastError  string         `json:"last_error,omitempty"`
+}
+
+type percentiles struct {
+	P50  float64 `json:"p50"`
+	P95  float64 `json:"p95"`
+	P99  float64 `json:"p99"`
+	Max  float64 `json:"max"`
+	Mean float64 `json:"mean"`
+}
+
+func summarize(samples []*sample, elapsed time.Duration) *phase {
+	p := &phase{Requests: len(samples), Statuses: make(map[string]int), Seconds: elapsed.Seconds()}
+	var latencies, firstTokens []time.Duration
+	for _, s := range samples {
+		if s.status == 0 {
+			p.Statuses["error"]++
+		} else {
+			p.Statuses[fmt.Sprint(s.status)]++
+		}
+		if s.err != nil {
+			p.Errors++
+			p.LastError = s.err.Error()
+			continue
+		}
+		latencies = append(latencies, s.latency)
+		if s.firstToken > 0 {
+			firstTokens = append(firstTokens, s.firstToken)
+		}
+	}
+	if elapsed > 0 {
+		p.Throughput = float64(len(latencies)) / elapsed.Seconds()
+	}
+	p.Latency = percentilesOf(latencies)
+	p.FirstToken = percentilesOf(firstTokens)
+	return p
+}
+
+// percentilesOf returns the percentiles of durations in milliseconds, nil without any
+func percentilesOf(durations []time.Duration) *percentiles {
+	if len(durations) == 0 {
+		return nil
+	}
+	sort.Slice(durations, func(i, j int) bool { return durations[i] < durations[j] })
+	ms := func(d time.Duration) float64 { return float64(d.Microseconds()) / 1000 }
+	at := func(p int) float64 { return ms(durations[(len(durations)-1)*p/100]) }
+	var total time.Duration
+	for _, d := range durations {
+		total += d
+	}
+	return &percentiles{
+		P50:  at(50),
+		P95:  at(95),
+		P99:  at(99),
+		Max:  ms(durations[len(durations)-1]),
+		Mean: ms(total / time.Duration(len(durations))),
+	}
+}
+
+func (r report) print(w io.Writer) {
+	fmt.Fprintf(w, "server %s, %d workers, %d documents of %d words\n", r.Server, r.Concurrency, r.Docs, r.DocWords)
+	r.Ingest.print(w, "ingest")
+	if r.Chat != nil {
+		r.Chat.print(w, "chat")
+	}
+}
+
+func (p *phase) print(w io.Writer, name string) {
+	statuses := make([]string, 0, len(p.Statuses))
+	for status, n := range p.Statuses {
+		statuses = append(statuses, fmt.Sprintf("%s×%d", status, n))
+	}
+	sort.Strings(statuses)
+	fmt.Fprintf(w, "\n%s: %d requests, %d errors in %.1fs, %.2f req/s (%s)\n",
+		name, p.Requests, p.Errors, p.Seconds, p.Throughput, strings.Join(statuses, ", "))
+	if p.Latency != nil {
+		fmt.Fprintf(w, "  latency      %s\n", p.Latency)
+	}
+	if p.FirstToken != nil {
+		fmt.Fprintf(w, "  first token  %s\n", p.FirstToken)
+	}
+	if p.LastError != "" {
+		fmt.Fprintf(w, "  last error   %s\n", p.LastError)
+	}
+}
+
+func (p *percentiles) String() string {
+	return fmt.Sprintf("p50 %.0fms  p95 %.0fms  p99 %.0fms  max %.0fms  mean %.0fms", p.P50, p.P95, p.P99, p.Max, p.Mean)
+}
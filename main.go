@@ -2,11 +2,14 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"runtime"
+	"syscall"
 	"time"
 
 	"github.com/kataras/golog"
@@ -19,8 +22,14 @@ var Version = "1.0.0"
 func main() {
 	// Command line flags
 	serverMode := flag.Bool("server", false, "Run in HTTP server mode")
+	localMode := flag.Bool("local", false, "Run as a local desktop app (no login, localhost only, opens the browser)")
 	ingestFile := flag.String("ingest", "", "Path to a file to ingest")
 	notebookName := flag.String("notebook", "", "Notebook name (for ingest)")
+	watchDir := flag.String("watch", "", "Folder to watch, uploading new and changed files to a notebook")
+	serverURL := flag.String("server-url", "", "Notex server to upload to (for watch, default: NOTEX_SERVER_URL)")
+	hookToken := flag.String("hook-token", "", "Ingest hook token of the notebook (for watch, default: NOTEX_HOOK_TOKEN)")
+	seed := flag.Bool("seed", false, "Create demo users, notebooks, notes and chat history")
+	seedPassword := flag.String("seed-password", "notex-demo", "Password of the demo users (for seed)")
 	version := flag.Bool("version", false, "Show version information")
 	flag.Parse()
 
@@ -40,11 +49,35 @@ func main() {
 		}
 	}()
 
+	// Load configuration first so the log directory can be configured
+	cfg := backend.LoadConfig()
+	if *localMode {
+		if err := cfg.EnableLocalMode(); err != nil {
+			golog.Fatalf("failed to enable local mode: %v", err)
+		}
+	}
+
 	golog.SetTimeFormat("2006/01/02 15:04:05.000")
-	logFiles := "./logs/notex.log.%Y%m%d"
+
+	// Watch mode is a client of a running server, it logs to the console and needs no LLM
+	if *watchDir != "" {
+		if *serverURL != "" {
+			cfg.WatchServerURL = *serverURL
+		}
+		if *hookToken != "" {
+			cfg.WatchHookToken = *hookToken
+		}
+		runWatchMode(cfg, *watchDir)
+		return
+	}
+
+	if err := os.MkdirAll(cfg.LogDir, 0755); err != nil {
+		golog.Fatal(err)
+	}
+	logFiles := filepath.Join(cfg.LogDir, "notex.log.%Y%m%d")
 	w, err := rotatelogs.New(
 		logFiles,
-		rotatelogs.WithLinkName("./logs/notex.log"),
+		rotatelogs.WithLinkName(filepath.Join(cfg.LogDir, "notex.log")),
 		rotatelogs.WithMaxAge(time.Duration(7)*24*time.Hour),
 		rotatelogs.WithRotationTime(24*time.Hour))
 	if err != nil {
@@ -52,17 +85,28 @@ func main() {
 	}
 	defer w.Close()
 	golog.SetOutput(w)
+	backend.InitAuditLog(cfg.LogDir)
 
-	// Load and validate configuration
-	cfg := backend.LoadConfig()
-	if err := backend.ValidateConfig(cfg); err != nil {
+	// Apply provider settings saved by the first-run setup wizard
+	settings, err := backend.LoadSettings(cfg.DataDir)
+	if err != nil {
+		golog.Fatalf("failed to load settings: %v", err)
+	}
+	settings.Apply(&cfg)
+
+	// Validate configuration. Servers may start without an LLM provider so the
+	// setup wizard can collect the keys through the web UI.
+	if err := backend.ValidateConfig(cfg); errors.Is(err, backend.ErrLLMNotConfigured) && (*serverMode || *localMode) {
+		golog.Warnf("configuration incomplete: %v", err)
+	} else if err != nil {
 		golog.Fatalf("configuration error: %v\n\n"+
 			"Required environment variables:\n"+
 			"  - OPENAI_API_KEY (for OpenAI) or\n"+
 			"  - OLLAMA_BASE_URL (for local Ollama)\n\n"+
 			"Optional:\n"+
 			"  - VECTOR_STORE_TYPE (default: sqlite)\n"+
-			"  - STORE_PATH (default: ./data/checkpoints.db)\n"+
+			"  - DATA_DIR (default: data)\n"+
+			"  - STORE_PATH (default: <DATA_DIR>/checkpoints.db)\n"+
 			"  - SERVER_PORT (default: 8080)\n"+
 			"Error: %v", err, err)
 	}
@@ -70,8 +114,8 @@ func main() {
 	ctx := context.Background()
 
 	switch {
-	case *serverMode:
-		// Server mode
+	case *serverMode, *localMode:
+		// Server mode (local mode is a single-user server)
 		runServerMode(cfg)
 
 	case *ingestFile != "":
@@ -81,6 +125,10 @@ func main() {
 		}
 		runIngestMode(ctx, cfg, *ingestFile, *notebookName)
 
+	case *seed:
+		// Seed mode
+		runSeedMode(ctx, cfg, *seedPassword)
+
 	default:
 		printUsage()
 	}
@@ -159,7 +207,7 @@ func runIngestMode(ctx context.Context, cfg backend.Config, filePath, notebookNa
 	}
 
 	// Ingest document
-	if _, err := vectorStore.IngestText(ctx, notebookID, source.Name, content); err != nil {
+	if _, err := vectorStore.IngestText(ctx, notebookID, source.ID, source.Name, content); err != nil {
 		golog.Fatalf("ingestion failed: %v", err)
 	}
 
@@ -167,20 +215,54 @@ func runIngestMode(ctx context.Context, cfg backend.Config, filePath, notebookNa
 	golog.Infof("📓 notebook: %s (ID: %s)", notebookName, notebookID)
 }
 
+func runSeedMode(ctx context.Context, cfg backend.Config, password string) {
+	golog.Infof("🌱 seeding demo data...")
+
+	if err := backend.Seed(ctx, cfg, password); err != nil {
+		golog.Fatalf("seeding failed: %v", err)
+	}
+
+	golog.Infof("✅ seeding complete! demo users sign in with password %q", password)
+}
+
+func runWatchMode(cfg backend.Config, dir string) {
+	watcher, err := backend.NewFolderWatcher(dir, cfg.WatchServerURL, cfg.WatchHookToken, cfg.WatchInterval)
+	if err != nil {
+		golog.Fatalf("failed to watch %s: %v", dir, err)
+	}
+
+	golog.Infof("👀 watching %s, uploading to %s every %s", dir, cfg.WatchServerURL, cfg.WatchInterval)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	watcher.Run(ctx)
+}
+
 func printUsage() {
 	fmt.Println("Notex - Privacy-first AI notebook")
 	fmt.Println("\nUsage:")
 	fmt.Println("  notex [options]")
 	fmt.Println("\nOptions:")
 	fmt.Println("  -server          Start the web server")
+	fmt.Println("  -local           Start as a local desktop app (no login, opens the browser)")
 	fmt.Println("  -ingest <file>   Ingest a file into the vector store")
 	fmt.Println("  -notebook <name> Notebook name for ingest (default: 'Default Notebook')")
+	fmt.Println("  -watch <folder>  Upload new and changed files of a folder to a notebook")
+	fmt.Println("  -server-url <url> Server to upload to when watching (default: NOTEX_SERVER_URL)")
+	fmt.Println("  -hook-token <token> Ingest hook token when watching (default: NOTEX_HOOK_TOKEN)")
+	fmt.Println("  -seed            Create demo users, notebooks, notes and chat history")
+	fmt.Println("  -seed-password <password> Password of the demo users (default: 'notex-demo')")
 	fmt.Println("  -version         Show version information")
 	fmt.Println("\nExamples:")
 	fmt.Println("  # Start web server")
 	fmt.Println("  notex -server")
+	fmt.Println("\n  # Run as a personal desktop app")
+	fmt.Println("  notex -local")
 	fmt.Println("\n  # Ingest a file")
 	fmt.Println("  notex -ingest document.pdf -notebook 'My Notes'")
+	fmt.Println("\n  # Fill an empty data directory with demo content, without API keys")
+	fmt.Println("  LLM_PROVIDER=mock DATA_DIR=demo notex -seed")
+	fmt.Println("\n  # Keep a folder in sync with a notebook through an ingest hook")
+	fmt.Println("  notex -watch ~/Papers -server-url http://localhost:8080 -hook-token <token>")
 	fmt.Println("\nEnvironment Variables:")
 	fmt.Println("  OPENAI_API_KEY      Your OpenAI API key")
 	fmt.Println("  OLLAMA_BASE_URL     Ollama server URL (default: http://localhost:11434)")